@@ -0,0 +1,191 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/DataDog/datadog-agent/cmd/agent/common"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/configresolver"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/listeners"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/providers"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	snmpDiscoverSubnet string
+	snmpDiscoverJSON   bool
+)
+
+func init() {
+	AgentCmd.AddCommand(snmpCommand)
+	snmpCommand.AddCommand(snmpDiscoverCommand)
+
+	snmpDiscoverCommand.Flags().StringVarP(&snmpDiscoverSubnet, "subnet", "s", "", "sweep only this subnet, with the credentials of the snmp_listener configurations covering it")
+	snmpDiscoverCommand.Flags().BoolVarP(&snmpDiscoverJSON, "json", "j", false, "print out the devices as JSON")
+}
+
+var snmpCommand = &cobra.Command{
+	Use:   "snmp",
+	Short: "SNMP utilities",
+	Long:  ``,
+}
+
+var snmpDiscoverCommand = &cobra.Command{
+	Use:   "discover",
+	Short: "Preview the devices the SNMP autodiscovery would schedule checks for",
+	Long: `Run a single sweep of the subnets of the snmp_listener configuration and print the devices
+answering, with the check configurations that would be scheduled for them. Nothing is scheduled
+and the device cache isn't written. Exits with an error if no device answered.`,
+	RunE: doSNMPDiscover,
+}
+
+// snmpDiscoveredDevice is a device answering the discovery with the check configurations it would get
+type snmpDiscoveredDevice struct {
+	listeners.SNMPDiscoveredDevice
+	CheckConfigs []string `json:"check_configs"`
+}
+
+func doSNMPDiscover(cmd *cobra.Command, args []string) error {
+	err := common.SetupConfig(confFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to set up global agent configuration: %v", err)
+	}
+
+	err = config.SetupLogger(loggerName, config.GetEnvDefault("DD_LOG_LEVEL", "off"), "", "", false, true, false)
+	if err != nil {
+		fmt.Printf("Cannot setup logger, exiting: %v\n", err)
+		return err
+	}
+
+	listenerConfig, err := snmp.NewListenerConfig()
+	if err != nil {
+		return fmt.Errorf("unable to read the snmp_listener configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	discovered, err := listeners.DiscoverSNMPDevices(ctx, listenerConfig, snmpDiscoverSubnet)
+	if err != nil {
+		return err
+	}
+
+	templates := getSNMPTemplates(ctx)
+	devices := make([]snmpDiscoveredDevice, 0, len(discovered))
+	for _, device := range discovered {
+		devices = append(devices, snmpDiscoveredDevice{
+			SNMPDiscoveredDevice: device,
+			CheckConfigs:         resolveSNMPTemplates(templates, device),
+		})
+	}
+
+	var b bytes.Buffer
+	if snmpDiscoverJSON {
+		out, err := json.MarshalIndent(devices, "", "  ")
+		if err != nil {
+			return err
+		}
+		b.Write(out)
+		b.WriteString("\n")
+	} else {
+		printSNMPDevices(&b, devices, listenerConfig.DeviceLatency)
+	}
+
+	// the check configurations hold the credentials
+	scrubbed, err := log.CredentialsCleanerBytes(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to scrub sensitive data from the output: %v", err)
+	}
+	fmt.Print(string(scrubbed))
+
+	if len(devices) == 0 {
+		return fmt.Errorf("no device answered the discovery")
+	}
+	return nil
+}
+
+// getSNMPTemplates returns the configuration templates of the configuration directories
+func getSNMPTemplates(ctx context.Context) []integration.Config {
+	confSearchPaths := []string{
+		config.Datadog.GetString("confd_path"),
+		filepath.Join(common.GetDistPath(), "conf.d"),
+		"",
+	}
+	configs, err := providers.NewFileConfigProvider(confSearchPaths).Collect(ctx)
+	if err != nil {
+		log.Warnf("Unable to read the configuration templates: %v", err)
+	}
+	var templates []integration.Config
+	for _, c := range configs {
+		if c.IsTemplate() {
+			templates = append(templates, c)
+		}
+	}
+	return templates
+}
+
+// resolveSNMPTemplates renders the templates matching the AD identifier of a device
+func resolveSNMPTemplates(templates []integration.Config, device listeners.SNMPDiscoveredDevice) []string {
+	checkConfigs := []string{}
+	for _, tpl := range templates {
+		matches := false
+		for _, adIdentifier := range tpl.ADIdentifiers {
+			if adIdentifier == device.ADIdentifier {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		resolved, _, err := configresolver.Resolve(tpl, device.Service)
+		if err != nil {
+			log.Warnf("Unable to resolve the template %s for the device %s: %v", tpl.Name, device.IP, err)
+			continue
+		}
+		checkConfigs = append(checkConfigs, resolved.String())
+	}
+	return checkConfigs
+}
+
+// printSNMPDevices prints the devices answering the discovery, with the latency of their probe when
+// the device latency is enabled
+func printSNMPDevices(b *bytes.Buffer, devices []snmpDiscoveredDevice, withLatency bool) {
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	header := "IP\tSUBNET\tCREDENTIAL\tSYSOBJECTID\tAD IDENTIFIER\tLOADER"
+	if withLatency {
+		header += "\tLATENCY"
+	}
+	fmt.Fprintln(w, header)
+	for _, device := range devices {
+		loader := device.Loader
+		if loader == "" {
+			loader = "default"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s", device.IP, device.Subnet, device.Credential, device.SysObjectID, device.ADIdentifier, loader)
+		if withLatency {
+			fmt.Fprintf(w, "\t%.1fms", device.LatencyMs)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	for _, device := range devices {
+		for _, checkConfig := range device.CheckConfigs {
+			fmt.Fprintf(b, "\n=== Check configuration for %s ===\n%s\n", device.IP, checkConfig)
+		}
+	}
+	fmt.Fprintf(b, "\n%d device(s) answered\n", len(devices))
+}
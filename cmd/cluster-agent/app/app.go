@@ -46,6 +46,7 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver"
 	apicommon "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/common"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection"
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/autoscalers"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/clustername"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 	"github.com/DataDog/datadog-agent/pkg/version"
@@ -162,11 +163,21 @@ func start(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	if config.Datadog.GetBool("external_metrics_provider.enabled") {
+		if err := autoscalers.ValidateUnitConversions(); err != nil {
+			return log.Errorf("Invalid external metrics provider configuration, exiting: %v", err)
+		}
+	}
+
 	mainCtx, mainCtxCancel := context.WithCancel(context.Background())
 	defer mainCtxCancel() // Calling cancel twice is safe
 
 	// Expose the registered metrics via HTTP.
 	http.Handle("/metrics", telemetry.Handler())
+	if config.Datadog.GetBool("external_metrics_provider.enabled") && autoscalers.ServedMetricsEndpointEnabled() {
+		// Expose the external metrics served to the autoscalers
+		http.Handle(autoscalers.ServedMetricsPath, autoscalers.ServedMetricsHandler())
+	}
 	go func() {
 		port := config.Datadog.GetInt("metrics_port")
 		err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
@@ -59,5 +59,13 @@ func getSettingsClient() (commonsettings.Client, error) {
 
 // initRuntimeSettings builds the map of runtime Cluster Agent settings configurable at runtime.
 func initRuntimeSettings() error {
-	return commonsettings.RegisterRuntimeSetting(commonsettings.LogLevelRuntimeSetting{})
+	if err := commonsettings.RegisterRuntimeSetting(commonsettings.LogLevelRuntimeSetting{}); err != nil {
+		return err
+	}
+	for _, limit := range []string{"external_metrics_provider.max_metrics", "external_metrics_provider.max_metrics_per_namespace"} {
+		if err := commonsettings.RegisterRuntimeSetting(commonsettings.ExternalMetricsLimitRuntimeSetting{ConfigKey: limit}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -70,6 +70,13 @@ var (
 		Short: "Run runtime self test",
 		RunE:  runRuntimeSelfTest,
 	}
+
+	kernelStatsCmd = &cobra.Command{
+		Use:   "kernel-stats <perf map> <on|off>",
+		Short: "Enable or disable the collection of the kernel stats of a perf map",
+		Args:  cobra.ExactArgs(2),
+		RunE:  setKernelStats,
+	}
 )
 
 func init() {
@@ -80,6 +87,7 @@ func init() {
 	checkPoliciesCmd.Flags().StringVar(&checkPoliciesArgs.dir, "policies-dir", coreconfig.DefaultRuntimePoliciesDir, "Path to policies directory")
 
 	runtimeCmd.AddCommand(selfTestCmd)
+	runtimeCmd.AddCommand(kernelStatsCmd)
 }
 
 func dumpProcessCache(cmd *cobra.Command, args []string) error {
@@ -157,6 +165,36 @@ func runRuntimeSelfTest(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func setKernelStats(cmd *cobra.Command, args []string) error {
+	var enabled bool
+	switch args[1] {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		return fmt.Errorf("invalid state %s, expected on or off", args[1])
+	}
+
+	client, err := secagent.NewRuntimeSecurityClient()
+	if err != nil {
+		return errors.Wrap(err, "unable to create a runtime security client instance")
+	}
+	defer client.Close()
+
+	result, err := client.SetKernelStats(args[0], enabled)
+	if err != nil {
+		return errors.Wrap(err, "unable to set the kernel stats collection")
+	}
+
+	if result.Ok {
+		fmt.Printf("Kernel stats of %s: %s\n", args[0], args[1])
+	} else {
+		fmt.Printf("Kernel stats of %s: error: %v\n", args[0], result.Error)
+	}
+	return nil
+}
+
 func newRuntimeReporter(stopper restart.Stopper, sourceName, sourceType string, endpoints *config.Endpoints, context *client.DestinationsContext) (event.Reporter, error) {
 	health := health.RegisterLiveness("runtime-security")
 
@@ -0,0 +1,117 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/serverless"
+	"github.com/DataDog/datadog-agent/pkg/serverless/daemon"
+	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// initBinaryName is the name the binary is invoked with to run as the init process of a
+	// container, on Cloud Run or Container Apps, instead of as a Lambda extension
+	initBinaryName = "serverless-init"
+
+	// terminationGracePeriodEnvVar is the time in seconds left by the platform between the
+	// SIGTERM sent to the container and its SIGKILL
+	terminationGracePeriodEnvVar = "DD_SERVERLESS_TERMINATION_GRACE_PERIOD"
+
+	serviceEnvVar = "DD_SERVICE"
+)
+
+// runInit runs the serverless agent as the init process of a container: the command in args is run
+// as its child process, whose output is collected as logs, and the telemetry is flushed once it
+// exits. It returns the exit code of the child.
+func runInit(args []string) int {
+	if err := config.SetupLogger(
+		loggerName,
+		"error", // will be re-set later with the value from the env var
+		"",      // logFile -> by setting this to an empty string, we don't write the logs to any file
+		"",      // syslog URI
+		false,   // syslog_rfc
+		true,    // log_to_console
+		false,   // log_format_json
+	); err != nil {
+		log.Errorf("Unable to setup logger: %s", err)
+	}
+
+	if logLevel := os.Getenv(logLevelEnvVar); len(logLevel) > 0 {
+		if err := config.ChangeLogLevel(logLevel); err != nil {
+			log.Errorf("While changing the loglevel: %s", err)
+		}
+	}
+
+	if len(args) == 0 {
+		log.Errorf("No command to run, usage: %s <command> [args...]", initBinaryName)
+		return 1
+	}
+
+	// the signals must be caught before the child is started, to be forwarded to it
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	setupProxy()
+	resolveAPIKey()
+	if !config.Datadog.IsSet("api_key") {
+		log.Error("No API key configured, the telemetry won't be sent")
+	}
+
+	// there is no Lambda runtime to register to, the daemon only serves the client libraries
+	// and flushes the telemetry
+	daemonAddr, socketPath := daemonListenAddrs()
+	serverlessDaemon := daemon.StartDaemon(daemonAddr, socketPath)
+	defer serverlessDaemon.Stop()
+
+	metricAgent := &metrics.ServerlessMetricAgent{}
+	metricAgent.Start(daemon.FlushTimeout, &metrics.MetricConfig{}, &metrics.MetricDogStatsD{})
+	serverlessDaemon.SetStatsdServer(metricAgent)
+
+	traceAgent := &trace.ServerlessTraceAgent{}
+	traceAgent.Start(config.Datadog.GetBool("apm_config.enabled"), &trace.LoadConfig{Path: datadogConfigPath})
+	serverlessDaemon.SetTraceAgent(traceAgent)
+
+	// there is no invocation to learn the tags from, they are known from the config and the
+	// environment, and the metrics held until they are known are released
+	serverlessDaemon.ComputeGlobalTags(config.GetConfiguredTags(true))
+
+	logs := serverless.ChildLogs{
+		Tags:    config.GetConfiguredTags(true),
+		Service: os.Getenv(serviceEnvVar),
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+	}
+	if config.Datadog.GetBool("serverless.logs_enabled") {
+		logs.Channel = make(chan *logConfig.ChannelMessage)
+		setupLogAgent(logs.Channel)
+	}
+
+	return serverless.RunInit(args, serverlessDaemon, logs, signalCh, terminationGracePeriod())
+}
+
+// terminationGracePeriod returns the termination grace period of the container
+func terminationGracePeriod() time.Duration {
+	v, exists := os.LookupEnv(terminationGracePeriodEnvVar)
+	if !exists {
+		return serverless.DefaultTerminationGracePeriod
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		log.Warnf("Invalid %s %q, using %s", terminationGracePeriodEnvVar, v, serverless.DefaultTerminationGracePeriod)
+		return serverless.DefaultTerminationGracePeriod
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
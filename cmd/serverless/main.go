@@ -11,7 +11,9 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,6 +31,7 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/serverless/daemon"
 	"github.com/DataDog/datadog-agent/pkg/serverless/flush"
 	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/serverless/proxy"
 	"github.com/DataDog/datadog-agent/pkg/serverless/registration"
 	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
 	"github.com/DataDog/datadog-agent/pkg/util/flavor"
@@ -70,6 +73,9 @@ where they can be graphed on dashboards. The Datadog Serverless Agent implements
 	logLevelEnvVar             = "DD_LOG_LEVEL"
 	flushStrategyEnvVar        = "DD_SERVERLESS_FLUSH_STRATEGY"
 	logsLogsTypeSubscribed     = "DD_LOGS_CONFIG_LAMBDA_LOGS_TYPE"
+	proxyEnabledEnvVar         = "DD_EXPERIMENTAL_ENABLE_PROXY"
+	socketPathEnvVar           = "DD_SERVERLESS_SOCKET_PATH"
+	tcpDisabledEnvVar          = "DD_SERVERLESS_DISABLE_TCP"
 
 	// AWS Lambda is writing the Lambda function files in /var/task, we want the
 	// configuration file to be at the root of this directory.
@@ -92,10 +98,13 @@ const (
 	logsAPIRegistrationRoute   = "/2020-08-15/logs"
 	logsAPIRegistrationTimeout = 5 * time.Second
 	logsAPIHttpServerPort      = 8124
-	logsAPICollectionRoute     = "/lambda/logs"
 	logsAPITimeout             = 1000
 	logsAPIMaxBytes            = 262144
 	logsAPIMaxItems            = 1000
+
+	// runtimeAPIProxyAddr is the address of the runtime API proxy, the runtime must be
+	// configured to use it as its AWS_LAMBDA_RUNTIME_API when the proxy is enabled.
+	runtimeAPIProxyAddr = "127.0.0.1:9000"
 )
 
 func init() {
@@ -124,6 +133,12 @@ func run(cmd *cobra.Command, args []string) error {
 func main() {
 	flavor.SetFlavor(flavor.ServerlessAgent)
 
+	// the binary runs as the init process of a container when invoked as serverless-init,
+	// the command to run being its arguments
+	if filepath.Base(os.Args[0]) == initBinaryName {
+		os.Exit(runInit(os.Args[1:]))
+	}
+
 	// if not command has been provided, run the agent
 	if len(os.Args) == 1 {
 		os.Args = append(os.Args, "run")
@@ -161,14 +176,27 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 		}
 	}
 
-	// immediately starts the communication server
-	serverlessDaemon = daemon.StartDaemon(httpServerAddr)
+	// the metrics, traces and logs are sent through the same proxy, whose settings are loaded
+	// before any of their HTTP clients is created
+	setupProxy()
+
+	// immediately starts the communication server, on a unix socket as well when configured
+	// for the runtimes which can't reach the extension over TCP
+	daemonAddr, socketPath := daemonListenAddrs()
+	serverlessDaemon = daemon.StartDaemon(daemonAddr, socketPath)
 	err = serverlessDaemon.RestoreCurrentStateFromFile()
 	if err != nil {
 		log.Debug("Unable to restore the state from file")
 	} else {
 		serverlessDaemon.ComputeGlobalTags(config.GetConfiguredTags(true))
 	}
+
+	// the runtime API proxy must listen before the runtime starts calling it
+	if enabled, _ := strconv.ParseBool(os.Getenv(proxyEnabledEnvVar)); enabled {
+		log.Debugf("Starting the runtime API proxy on %s", runtimeAPIProxyAddr)
+		proxy.Start(runtimeAPIProxyAddr, os.Getenv(runtimeAPIEnvVar), serverlessDaemon)
+	}
+
 	// serverless parts
 	// ----------------
 
@@ -206,26 +234,10 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 		log.Warn("An API Key has been set in multiple places:", strings.Join(apikeySetIn, ", "))
 	}
 
-	// try to read API key from KMS
-
-	var apiKey string
-	if apiKey, err = readAPIKeyFromKMS(); err != nil {
-		log.Errorf("Error while trying to read an API Key from KMS: %s", err)
-	} else if apiKey != "" {
-		log.Info("Using deciphered KMS API Key.")
-		os.Setenv(apiKeyEnvVar, apiKey)
-	}
-
-	// try to read the API key from Secrets Manager, only if not set from KMS
+	resolveAPIKey()
 
-	if apiKey == "" {
-		if apiKey, err = readAPIKeyFromSecretsManager(); err != nil {
-			log.Errorf("Error while trying to read an API Key from Secrets Manager: %s", err)
-		} else if apiKey != "" {
-			log.Info("Using API key set in Secrets Manager.")
-			os.Setenv(apiKeyEnvVar, apiKey)
-		}
-	}
+	// the API key may have been rotated while a SnapStart function was snapshotted
+	serverlessDaemon.SetRestoreHook(resolveAPIKey)
 
 	// adaptive flush configuration
 	if v, exists := os.LookupEnv(flushStrategyEnvVar); exists {
@@ -255,7 +267,7 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 	metricAgent := &metrics.ServerlessMetricAgent{}
 	metricAgent.Start(daemon.FlushTimeout, &metrics.MetricConfig{}, &metrics.MetricDogStatsD{})
 	serverlessDaemon.SetStatsdServer(metricAgent)
-	serverlessDaemon.SetupLogCollectionHandler(logsAPICollectionRoute, logChannel, config.Datadog.GetBool("serverless.logs_enabled"), config.Datadog.GetBool("enhanced_metrics"))
+	serverlessDaemon.SetupLogCollectionHandler(logChannel, config.Datadog.GetBool("serverless.logs_enabled"), config.Datadog.GetBool("enhanced_metrics"))
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -272,6 +284,11 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 	// enable logs collection
 	go func() {
 		defer wg.Done()
+		if daemonAddr == "" {
+			// the Logs API only sends the logs over TCP
+			log.Warnf("Not subscribing to the logs as the TCP address of the extension is disabled by %s", tcpDisabledEnvVar)
+			return
+		}
 		log.Debug("Enabling logs collection HTTP route")
 		logRegistrationURL := registration.BuildURL(os.Getenv(runtimeAPIEnvVar), logsAPIRegistrationRoute)
 		logRegistrationError := registration.EnableLogsCollection(
@@ -280,7 +297,7 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 			logsAPIRegistrationTimeout,
 			os.Getenv(logsLogsTypeSubscribed),
 			logsAPIHttpServerPort,
-			logsAPICollectionRoute,
+			daemon.LogsCollectionRoute,
 			logsAPITimeout,
 			logsAPIMaxBytes,
 			logsAPIMaxItems)
@@ -309,6 +326,56 @@ func runAgent(stopCh chan struct{}) (serverlessDaemon *daemon.Daemon, err error)
 	return
 }
 
+// resolveAPIKey reads the API key from KMS, or from Secrets Manager if not set from KMS, and
+// sets it in the environment. It returns the API key read, empty when none was.
+func resolveAPIKey() string {
+	// try to read API key from KMS
+
+	apiKey, err := readAPIKeyFromKMS()
+	if err != nil {
+		log.Errorf("Error while trying to read an API Key from KMS: %s", err)
+	} else if apiKey != "" {
+		log.Info("Using deciphered KMS API Key.")
+		os.Setenv(apiKeyEnvVar, apiKey)
+	}
+
+	// try to read the API key from Secrets Manager, only if not set from KMS
+
+	if apiKey == "" {
+		if apiKey, err = readAPIKeyFromSecretsManager(); err != nil {
+			log.Errorf("Error while trying to read an API Key from Secrets Manager: %s", err)
+		} else if apiKey != "" {
+			log.Info("Using API key set in Secrets Manager.")
+			os.Setenv(apiKeyEnvVar, apiKey)
+		}
+	}
+	return apiKey
+}
+
+// setupProxy loads the proxy settings from the environment variables, the configuration file
+// being only loaded by the trace agent once the metrics and logs clients may be created
+func setupProxy() {
+	config.LoadProxyFromEnv()
+	if proxy := daemon.GetProxySettings(); proxy != nil {
+		log.Infof("Sending the metrics, traces and logs through the proxy (%s)", proxy)
+	} else {
+		log.Debug("No proxy configured, sending the metrics, traces and logs directly")
+	}
+}
+
+// daemonListenAddrs returns the TCP address and the unix socket path the daemon listens on. The TCP
+// address can only be disabled when a unix socket is configured, for the daemon to stay reachable.
+func daemonListenAddrs() (addr, socketPath string) {
+	socketPath = os.Getenv(socketPathEnvVar)
+	if disabled, _ := strconv.ParseBool(os.Getenv(tcpDisabledEnvVar)); disabled {
+		if socketPath != "" {
+			return "", socketPath
+		}
+		log.Warnf("%s is ignored as %s isn't set, listening on %s", tcpDisabledEnvVar, socketPathEnvVar, httpServerAddr)
+	}
+	return httpServerAddr, socketPath
+}
+
 // handleSignals handles OS signals, if a SIGTERM is received,
 // the serverless agent stops.
 func handleSignals(serverlessDaemon *daemon.Daemon, stopCh chan struct{}) {
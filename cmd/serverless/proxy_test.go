@@ -0,0 +1,166 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/forwarder"
+	"github.com/DataDog/datadog-agent/pkg/logs/client"
+	logshttp "github.com/DataDog/datadog-agent/pkg/logs/client/http"
+	logsconfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/serverless/daemon"
+	traceconfig "github.com/DataDog/datadog-agent/pkg/trace/config"
+)
+
+// testProxy is an HTTPS proxy tunneling the connections to their targets
+type testProxy struct {
+	*httptest.Server
+	mu      sync.Mutex
+	targets map[string]bool
+}
+
+func startTestProxy(t *testing.T) *testProxy {
+	p := &testProxy{targets: make(map[string]bool)}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.tunnel))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only the tunnels are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	p.mu.Lock()
+	p.targets[r.Host] = true
+	p.mu.Unlock()
+
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")) //nolint:errcheck
+	go func() {
+		io.Copy(target, conn) //nolint:errcheck
+		target.Close()
+	}()
+	io.Copy(conn, target) //nolint:errcheck
+	conn.Close()
+}
+
+// tunneled returns whether a connection to the server was tunneled through the proxy
+func (p *testProxy) tunneled(server *httptest.Server) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.targets[server.Listener.Addr().String()]
+}
+
+// startTestIntake starts an intake accepting all the payloads
+func startTestIntake(t *testing.T) *httptest.Server {
+	intake := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(intake.Close)
+	return intake
+}
+
+func setEnvForTest(t *testing.T, key, value string) {
+	previous, found := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestSetupProxy(t *testing.T) {
+	proxy := startTestProxy(t)
+	metricsIntake := startTestIntake(t)
+	tracesIntake := startTestIntake(t)
+	logsIntake := startTestIntake(t)
+	directIntake := startTestIntake(t)
+
+	mockConfig := config.Mock()
+	mockConfig.Set("skip_ssl_validation", true)
+	setEnvForTest(t, "DD_PROXY_HTTPS", "http://user:password@"+proxy.Listener.Addr().String())
+	setEnvForTest(t, "DD_PROXY_NO_PROXY", directIntake.Listener.Addr().String())
+	setupProxy()
+
+	// the credentials of the proxy aren't reported on the status route
+	settings := daemon.GetProxySettings()
+	require.NotNil(t, settings)
+	assert.Equal(t, proxy.URL, settings.HTTPS)
+	assert.NotContains(t, settings.String(), "password")
+
+	// metrics
+	syncForwarder := forwarder.NewSyncForwarder(map[string][]string{
+		metricsIntake.URL: {"api_key"},
+		directIntake.URL:  {"api_key"},
+	}, 5*time.Second)
+	payload := []byte("{}")
+	require.NoError(t, syncForwarder.SubmitV1Series(forwarder.Payloads{&payload}, nil))
+	stats := syncForwarder.TakeEndpointStats()
+	assert.Equal(t, int64(1), stats[metricsIntake.URL].Sent)
+	assert.Equal(t, int64(1), stats[directIntake.URL].Sent)
+
+	// traces
+	traceConfig := traceconfig.New()
+	traceConfig.SkipSSLValidation = true
+	resp, err := traceConfig.NewHTTPClient().Post(tracesIntake.URL+"/api/v0.2/traces", "application/x-protobuf", strings.NewReader(""))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// logs
+	logsURL, err := url.Parse(logsIntake.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(logsURL.Port())
+	require.NoError(t, err)
+	destinationsContext := client.NewDestinationsContext()
+	destinationsContext.Start()
+	defer destinationsContext.Stop()
+	destination := logshttp.NewDestination(logsconfig.Endpoint{
+		APIKey: "api_key",
+		Host:   logsURL.Hostname(),
+		Port:   port,
+		UseSSL: true,
+	}, logshttp.JSONContentType, destinationsContext, 0)
+	require.NoError(t, destination.Send([]byte("{}")))
+
+	assert.True(t, proxy.tunneled(metricsIntake), "the metrics weren't sent through the proxy")
+	assert.True(t, proxy.tunneled(tracesIntake), "the traces weren't sent through the proxy")
+	assert.True(t, proxy.tunneled(logsIntake), "the logs weren't sent through the proxy")
+	assert.False(t, proxy.tunneled(directIntake), "the intake in no_proxy was reached through the proxy")
+
+	// the connection errors carry the URL of the proxy
+	proxy.Close()
+	_, err = traceConfig.NewHTTPClient().Post(tracesIntake.URL+"/api/v0.2/traces", "application/x-protobuf", strings.NewReader(""))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "through proxy "+proxy.URL)
+}
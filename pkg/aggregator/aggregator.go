@@ -226,6 +226,10 @@ type BufferedAggregator struct {
 	// Used by the Dogstatsd Batcher.
 	MetricSamplePool *metrics.MetricSamplePool
 
+	// AcceptSample, when set, is called on every DogStatsD sample before it is
+	// aggregated and may drop it. It must be set before any sample is received.
+	AcceptSample func(*metrics.MetricSample) bool
+
 	statsdSampler          TimeSampler
 	checkSamplers          map[check.ID]*CheckSampler
 	serviceChecks          metrics.ServiceChecks
@@ -449,6 +453,9 @@ func (agg *BufferedAggregator) addEvent(e metrics.Event) {
 
 // addSample adds the metric sample
 func (agg *BufferedAggregator) addSample(metricSample *metrics.MetricSample, timestamp float64) {
+	if agg.AcceptSample != nil && !agg.AcceptSample(metricSample) {
+		return
+	}
 	agg.statsdSampler.addSample(metricSample, timestamp)
 }
 
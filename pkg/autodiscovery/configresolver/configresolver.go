@@ -76,6 +76,13 @@ func Resolve(tpl integration.Config, svc listeners.Service) (integration.Config,
 	copy(resolvedConfig.InitConfig, tpl.InitConfig)
 	copy(resolvedConfig.Instances, tpl.Instances)
 
+	// The services discovered by the cluster agent for the cluster check runners turn the
+	// templates they match into cluster checks
+	if clusterSvc, ok := svc.(listeners.ClusterCheckService); ok && clusterSvc.IsClusterCheck() {
+		resolvedConfig.ClusterCheck = true
+		resolvedConfig.WeightHint = clusterSvc.GetWeightHint()
+	}
+
 	// Ignore the config from file if it's overridden by an empty config
 	// or by a different config for the same check
 	if tpl.Provider == names.File && svc.GetCheckNames(ctx) != nil {
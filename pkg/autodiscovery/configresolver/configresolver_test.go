@@ -99,6 +99,23 @@ func (s *dummyService) GetExtraConfig(key []byte) ([]byte, error) {
 	return []byte(s.ExtraConfig[string(key)]), nil
 }
 
+// dummyClusterCheckService is a service whose checks are cluster checks
+type dummyClusterCheckService struct {
+	dummyService
+	ClusterCheck bool
+	WeightHint   int
+}
+
+// IsClusterCheck returns whether the checks of the service are cluster checks
+func (s *dummyClusterCheckService) IsClusterCheck() bool {
+	return s.ClusterCheck
+}
+
+// GetWeightHint returns the weight hint of the checks of the service
+func (s *dummyClusterCheckService) GetWeightHint() int {
+	return s.WeightHint
+}
+
 func TestGetFallbackHost(t *testing.T) {
 	ip, err := getFallbackHost(map[string]string{"bridge": "172.17.0.1"})
 	assert.Equal(t, "172.17.0.1", ip)
@@ -706,6 +723,53 @@ func TestResolve(t *testing.T) {
 				Entity:        "a5901276aed1",
 			},
 		},
+		{
+			testName: "cluster check service",
+			svc: &dummyClusterCheckService{
+				dummyService: dummyService{
+					ID:            "snmp://a5901276aed1",
+					ADIdentifiers: []string{"snmp"},
+					Hosts:         map[string]string{"": "10.0.0.1"},
+				},
+				ClusterCheck: true,
+				WeightHint:   600,
+			},
+			tpl: integration.Config{
+				Name:          "snmp",
+				ADIdentifiers: []string{"snmp"},
+				Instances:     []integration.Data{integration.Data("ip_address: %%host%%")},
+			},
+			out: integration.Config{
+				Name:          "snmp",
+				ADIdentifiers: []string{"snmp"},
+				Instances:     []integration.Data{integration.Data("ip_address: 10.0.0.1\ntags:\n- foo:bar\n")},
+				Entity:        "snmp://a5901276aed1",
+				ClusterCheck:  true,
+				WeightHint:    600,
+			},
+		},
+		{
+			testName: "service discovered for the node agent",
+			svc: &dummyClusterCheckService{
+				dummyService: dummyService{
+					ID:            "snmp://a5901276aed1",
+					ADIdentifiers: []string{"snmp"},
+					Hosts:         map[string]string{"": "10.0.0.1"},
+				},
+				WeightHint: 600,
+			},
+			tpl: integration.Config{
+				Name:          "snmp",
+				ADIdentifiers: []string{"snmp"},
+				Instances:     []integration.Data{integration.Data("ip_address: %%host%%")},
+			},
+			out: integration.Config{
+				Name:          "snmp",
+				ADIdentifiers: []string{"snmp"},
+				Instances:     []integration.Data{integration.Data("ip_address: 10.0.0.1\ntags:\n- foo:bar\n")},
+				Entity:        "snmp://a5901276aed1",
+			},
+		},
 	}
 
 	for i, tc := range testCases {
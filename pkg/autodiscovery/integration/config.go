@@ -57,6 +57,7 @@ type Config struct {
 	IgnoreAutodiscoveryTags bool         `json:"ignore_autodiscovery_tags"` // used to ignore tags coming from autodiscovery (include in digest: true)
 	MetricsExcluded         bool         `json:"metrics_excluded"`          // whether metrics collection is disabled (set by container listeners only) (include in digest: false)
 	LogsExcluded            bool         `json:"logs_excluded"`             // whether logs collection is disabled (set by container listeners only) (include in digest: false)
+	WeightHint              int          `json:"weight_hint"`               // expected cost of the check to balance cluster checks, 0 for the default (include in digest: false)
 }
 
 // CommonInstanceConfig holds the reserved fields for the yaml instance data
@@ -136,9 +136,18 @@ func (l *KubeletListener) processEvents(evBundle workloadmeta.EventBundle, first
 }
 
 func (l *KubeletListener) processPod(pod workloadmeta.KubernetesPod, firstRun bool) {
-	containers := make([]workloadmeta.Container, 0, len(pod.Containers))
+	if pod.Terminating && pod.StartTime.IsZero() {
+		// the pod is deleted before the kubelet ever started it, there is
+		// nothing to monitor. The pods started before they were deleted
+		// still get their services, so that their last logs are collected.
+		log.Debugf("pod %q is terminating and was never started, not scheduling its checks", pod.Name)
+		return
+	}
+
+	containerIDs := pod.AllContainers()
+	containers := make([]workloadmeta.Container, 0, len(containerIDs))
 
-	for _, containerID := range pod.Containers {
+	for _, containerID := range containerIDs {
 		container, err := l.store.GetContainer(containerID)
 		if err != nil {
 			log.Debugf("pod %q has reference to non-existing container %q", pod.Name, containerID)
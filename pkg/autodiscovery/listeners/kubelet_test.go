@@ -43,22 +43,32 @@ func TestCreatePodService(t *testing.T) {
 					Name:      podName,
 					Namespace: podNamespace,
 				},
-				IP: "127.0.0.1",
+				IP:     "127.0.0.1",
+				HostIP: "10.0.0.1",
 			},
 			containers: []workloadmeta.Container{
 				{
 					Ports: []workloadmeta.ContainerPort{
 						{
-							Name: "http",
-							Port: 80,
+							Name:     "http",
+							Port:     80,
+							Protocol: "TCP",
 						},
 					},
 				},
 				{
 					Ports: []workloadmeta.ContainerPort{
 						{
-							Name: "ssh",
-							Port: 22,
+							Name:     "ssh",
+							Port:     22,
+							Protocol: "TCP",
+						},
+						{
+							Name:     "dns",
+							Port:     53,
+							Protocol: "UDP",
+							HostPort: 5353,
+							HostIP:   "10.0.0.1",
 						},
 					},
 				},
@@ -72,6 +82,10 @@ func TestCreatePodService(t *testing.T) {
 							Port: 22,
 							Name: "ssh",
 						},
+						{
+							Port: 53,
+							Name: "dns",
+						},
 						{
 							Port: 80,
 							Name: "http",
@@ -102,6 +116,41 @@ func TestCreatePodService(t *testing.T) {
 	}
 }
 
+func TestProcessPodTerminating(t *testing.T) {
+	pod := workloadmeta.KubernetesPod{
+		EntityID: workloadmeta.EntityID{
+			Kind: workloadmeta.KindKubernetesPod,
+			ID:   podID,
+		},
+		EntityMeta: workloadmeta.EntityMeta{
+			Name:      podName,
+			Namespace: podNamespace,
+		},
+		IP:                "127.0.0.1",
+		StartTime:         time.Now().Add(-time.Hour),
+		DeletionTimestamp: time.Now(),
+		Terminating:       true,
+	}
+
+	ch := make(chan Service)
+	listener := newListener(t, ch)
+	actualServices, doneCh := consumeServiceCh(ch)
+
+	listener.processPod(pod, false)
+
+	neverStartedPod := pod
+	neverStartedPod.ID = "never-started"
+	neverStartedPod.StartTime = time.Time{}
+	listener.processPod(neverStartedPod, false)
+
+	close(ch)
+	<-doneCh
+
+	// the terminating pod gets its service, not the one deleted before it started
+	assert.Len(t, actualServices, 1)
+	assert.Contains(t, actualServices, "kubernetes_pod://foobar")
+}
+
 func TestCreateContainerService(t *testing.T) {
 	pod := workloadmeta.KubernetesPod{
 		EntityID: workloadmeta.EntityID{
@@ -244,12 +293,14 @@ func TestCreateContainerService(t *testing.T) {
 				Image:      basicImage,
 				Ports: []workloadmeta.ContainerPort{
 					{
-						Name: "http",
-						Port: 80,
+						Name:     "http",
+						Port:     80,
+						Protocol: "TCP",
 					},
 					{
-						Name: "ssh",
-						Port: 22,
+						Name:     "ssh",
+						Port:     22,
+						Protocol: "TCP",
 					},
 				},
 				State: workloadmeta.ContainerState{
@@ -8,18 +8,27 @@ package listeners
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
+	"github.com/DataDog/datadog-agent/pkg/collector/corechecks/snmp/checkconfig"
 	"github.com/DataDog/datadog-agent/pkg/persistentcache"
+	"github.com/DataDog/datadog-agent/pkg/secrets"
 	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
 	"github.com/DataDog/datadog-agent/pkg/util/containers"
+	"github.com/DataDog/datadog-agent/pkg/util/flavor"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	"github.com/gosnmp/gosnmp"
 )
 
 const (
@@ -27,8 +36,42 @@ const (
 	defaultAllowedFailures   = 3
 	defaultDiscoveryInterval = 3600
 	tagSeparator             = ","
+
+	// defaultSecretRefreshInterval is how often the secrets referenced by the credentials are resolved again
+	defaultSecretRefreshInterval = 3600
+
+	sysObjectIDOid = "1.3.6.1.2.1.1.2.0"
+	sysUpTimeOid   = "1.3.6.1.2.1.1.3.0"
+	sysNameOid     = "1.3.6.1.2.1.1.5.0"
+	// systemOidPrefix prefixes the OIDs of the system subtree
+	systemOidPrefix = "1.3.6.1.2.1.1."
+)
+
+var (
+	snmpEvictedDevices = telemetry.NewCounterWithOpts("snmp_listener", "evicted_devices",
+		[]string{"subnet"}, "Number of SNMP devices unscheduled after failing the allowed discovery attempts and health checks",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpResurrectedDevices = telemetry.NewCounterWithOpts("snmp_listener", "resurrected_devices",
+		[]string{"subnet"}, "Number of unscheduled SNMP devices scheduled again after answering a discovery",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpProbeSuccesses = telemetry.NewCounterWithOpts("snmp_listener", "discovery_probe_successes",
+		[]string{"subnet", "oid"}, "Number of SNMP discoveries answered, by the probe OID the device answered",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpSecretResolutionErrors = telemetry.NewCounterWithOpts("snmp_listener", "secret_resolution_errors",
+		[]string{"subnet"}, "Number of failed resolutions of the secrets referenced by the SNMP credentials, the previous credentials being kept",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
 )
 
+// snmpSessions is the pool of the sessions of the probes, nil to create a session by probe
+var snmpSessions = snmp.SharedSessionPool()
+
+// tagTemplateRegex matches discovery facts referenced in subnet tags, e.g. `sys_name:%%sysName%%`
+var tagTemplateRegex = regexp.MustCompile(`%%([a-zA-Z_]+)%%`)
+
+// profileOIDCount returns the number of OIDs collected from the devices of the profile matching a
+// sysObjectID, counted from the profile definitions of the check
+var profileOIDCount = checkconfig.GetProfileOIDCount
+
 func init() {
 	Register("snmp", NewSNMPListener)
 }
@@ -41,6 +84,29 @@ type SNMPListener struct {
 	stop       chan bool
 	config     snmp.ListenerConfig
 	services   map[string]Service
+	// devicesByIP holds the subnets of the scheduled services by entity ID, by device IP, so that
+	// the devices found both by a sweep and by a neighbor walk are scheduled once
+	devicesByIP map[string]map[string]*snmpSubnet
+	// reloads receives the configs reloaded from the config file when they changed
+	reloads chan []snmp.Config
+	// activeSources holds the sources being discovered, so that the sweeps of the sources whose
+	// config was removed are cancelled as soon as the config file is reloaded
+	activeSources map[*snmpSubnetSource]struct{}
+	// pendingDevices holds the devices discovered while the max devices per agent was reached, by
+	// entity ID, until they can be scheduled
+	pendingDevices map[string]*snmpDevice
+	// discoveryOrder holds the rank of the first discovery of each device, by entity ID, to prioritize
+	// the devices discovered first
+	discoveryOrder map[string]uint64
+	discoveries    uint64
+	// clusterChecks is set when the listener runs in the cluster agent, the checks of the devices
+	// being cluster checks dispatched to the cluster check runners
+	clusterChecks bool
+	// memoryConstrained is true while the discovery is over its memory budget, the subnet sweeps being paused
+	memoryConstrained bool
+	// scanQueueMemory is the approximate memory used by the devices queued and visited by the neighbor walk
+	// in progress, if any
+	scanQueueMemory int64
 }
 
 // SNMPService implements and store results from the Service interface for the SNMP listener
@@ -50,24 +116,89 @@ type SNMPService struct {
 	deviceIP     string
 	creationTime integration.CreationTime
 	config       snmp.Config
+	sysName      string
+	clusterCheck bool
+	weightHint   int
+	// interfaceCount is the number of interfaces of the device, 0 when it is unknown
+	interfaceCount int
 }
 
-// Make sure SNMPService implements the Service interface
+// Make sure SNMPService implements the Service and the ClusterCheckService interfaces
 var _ Service = &SNMPService{}
+var _ ClusterCheckService = &SNMPService{}
 
 type snmpSubnet struct {
-	adIdentifier   string
-	config         snmp.Config
+	adIdentifier string
+	// config is the config of the subnet, its credentials are the ones resolved when the subnet was
+	// created: currentConfig returns the config with the rotated credentials
+	config snmp.Config
+	// rotatedConfig holds a *snmp.Config with the rotated credentials, swapped as a whole since the
+	// workers read it concurrently, it is empty until the credentials are rotated
+	rotatedConfig  atomic.Value
 	startingIP     net.IP
 	network        net.IPNet
 	cacheKey       string
 	devices        map[string]string
 	deviceFailures map[string]int
+	// evictedDevices holds the IPs of the devices unscheduled after the allowed failures,
+	// by entity ID, until they answer a discovery again
+	evictedDevices map[string]string
+	// probeOIDs holds the probe OID each device last answered, by entity ID, so that it is tried
+	// first by the next discoveries
+	probeOIDs map[string]string
+	// sysObjectIDs holds the sysObjectID of the devices discovered with it, by entity ID, to prioritize
+	// them by profile
+	sysObjectIDs map[string]string
+	// interfaceCounts holds the number of interfaces of the devices, by entity ID, when the collection
+	// interval is suggested from it
+	interfaceCounts map[string]int
+	nextHealthCheck time.Time
+	// neighbors is true for the subnet holding the devices found by a neighbor walk outside of the
+	// swept subnets of its config, it is never swept
+	neighbors bool
+	// ctx is the context of the source of the subnet, cancelled when its config is removed
+	ctx context.Context
+}
+
+// currentConfig returns the config of the subnet with its current credentials, the returned config
+// must not be modified
+func (s *snmpSubnet) currentConfig() snmp.Config {
+	if config, ok := s.rotatedConfig.Load().(*snmp.Config); ok {
+		return *config
+	}
+	return s.config
+}
+
+// rotateCredentials swaps the config of the subnet for a copy with the credentials of the given config
+func (s *snmpSubnet) rotateCredentials(from snmp.Config) {
+	config := s.currentConfig()
+	config.CopyCredentials(from)
+	s.rotatedConfig.Store(&config)
+}
+
+// cancelled returns whether the config of the subnet was removed
+func (s *snmpSubnet) cancelled() bool {
+	return s.ctx != nil && s.ctx.Err() != nil
+}
+
+// snmpDeviceInfo is what a discovery learns about a device
+type snmpDeviceInfo struct {
+	// sysObjectID is empty when the device was discovered with another probe OID
+	sysObjectID string
+	sysName     string
+	// probeOID is the OID the device answered
+	probeOID string
+	// interfaceCount is the ifNumber of the device, 0 when it wasn't read
+	interfaceCount int
+	// latency is the round trip of the GET of the probe OID answered
+	latency time.Duration
 }
 
 type snmpJob struct {
 	subnet    *snmpSubnet
 	currentIP net.IP
+	// healthCheck is true to probe a device already discovered instead of discovering it
+	healthCheck bool
 }
 
 // NewSNMPListener creates a SNMPListener
@@ -77,9 +208,10 @@ func NewSNMPListener() (ServiceListener, error) {
 		return nil, err
 	}
 	return &SNMPListener{
-		services: map[string]Service{},
-		stop:     make(chan bool),
-		config:   snmpConfig,
+		services:      map[string]Service{},
+		stop:          make(chan bool),
+		config:        snmpConfig,
+		clusterChecks: flavor.GetFlavor() == flavor.ClusterAgent,
 	}, nil
 }
 
@@ -108,7 +240,7 @@ func (l *SNMPListener) loadCache(subnet *snmpSubnet) {
 	}
 	for _, deviceIP := range devices {
 		entityID := subnet.config.Digest(deviceIP.String())
-		l.createService(entityID, subnet, deviceIP.String(), false)
+		l.createService(entityID, subnet, deviceIP.String(), "", false)
 	}
 }
 
@@ -138,78 +270,560 @@ var worker = func(l *SNMPListener, jobs <-chan snmpJob) {
 			log.Debug("Stopping SNMP worker")
 			return
 		case job := <-jobs:
+			if job.subnet.cancelled() {
+				continue
+			}
 			log.Debugf("Handling IP %s", job.currentIP.String())
 			l.checkDevice(job)
 		}
 	}
 }
 
-func (l *SNMPListener) checkDevice(job snmpJob) {
-	deviceIP := job.currentIP.String()
-	params, err := job.subnet.config.BuildSNMPParams(deviceIP)
+// errBuildingParams is wrapped by the errors building the SNMP parameters of a device, which come
+// from its configuration and don't tell whether the device is up
+var errBuildingParams = errors.New("error building params")
+
+// connectDevice returns a session to a device from the pool of the probes, it must be released
+// with the error of its last request
+func connectDevice(config snmp.Config, deviceIP string) (*snmp.PooledSession, error) {
+	params, err := config.BuildSNMPParams(deviceIP)
 	if err != nil {
-		log.Errorf("Error building params for device %s: %v", deviceIP, err)
-		return
+		return nil, fmt.Errorf("%w: %v", errBuildingParams, err)
+	}
+	session, err := snmpSessions.Connect(params)
+	if err != nil {
+		return nil, fmt.Errorf("connect error: %v", err)
+	}
+	return session, nil
+}
+
+// Don't make it a method, to be overridden in tests
+var probeDevice = func(config snmp.Config, deviceIP string, oid string) error {
+	session, err := connectDevice(config, deviceIP)
+	if err != nil {
+		return err
+	}
+
+	value, err := session.Get([]string{oid})
+	session.Release(err)
+	if err != nil {
+		return err
+	}
+	if len(value.Variables) < 1 || !hasValue(value.Variables[0]) {
+		return errors.New("no data")
 	}
+	return nil
+}
+
+// hasValue returns whether a variable was answered, the agents answer noSuchObject for the OIDs
+// they restrict access to
+func hasValue(variable gosnmp.SnmpPDU) bool {
+	switch variable.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		return false
+	}
+	return variable.Value != nil
+}
+
+// healthCheckDevice probes a device already discovered with a GET of its sysUpTime, or of the probe
+// OID it was discovered with when it isn't in the system subtree, counting a failure towards its
+// removal if it doesn't answer. It returns whether the device answered.
+func (l *SNMPListener) healthCheckDevice(job snmpJob) bool {
+	deviceIP := job.currentIP.String()
 	entityID := job.subnet.config.Digest(deviceIP)
-	if err := params.Connect(); err != nil {
-		log.Debugf("SNMP connect to %s error: %v", deviceIP, err)
+	oid := sysUpTimeOid
+	l.RLock()
+	if probeOID, found := job.subnet.probeOIDs[entityID]; found && !strings.HasPrefix(probeOID, systemOidPrefix) {
+		oid = probeOID
+	}
+	l.RUnlock()
+	if err := probeDevice(job.subnet.currentConfig(), deviceIP, oid); err != nil {
+		if errors.Is(err, errBuildingParams) {
+			// the device is kept, the configuration is at fault
+			log.Errorf("SNMP health check of %s error: %v", deviceIP, err)
+			return false
+		}
+		log.Debugf("SNMP health check of %s error: %v", deviceIP, err)
 		l.deleteService(entityID, job.subnet)
-	} else {
-		defer params.Conn.Close()
+		return false
+	}
 
-		oids := []string{"1.3.6.1.2.1.1.2.0"}
-		// Since `params<GoSNMP>.ContextEngineID` is empty
-		// `params.Get` might lead to multiple SNMP GET calls when using SNMP v3
-		value, err := params.Get(oids)
-		if err != nil {
-			log.Debugf("SNMP get to %s error: %v", deviceIP, err)
-			l.deleteService(entityID, job.subnet)
-		} else if len(value.Variables) < 1 || value.Variables[0].Value == nil {
-			log.Debugf("SNMP get to %s no data", deviceIP)
-			l.deleteService(entityID, job.subnet)
-		} else {
-			log.Debugf("SNMP get to %s success: %v", deviceIP, value.Variables[0].Value)
-			l.createService(entityID, job.subnet, deviceIP, true)
+	l.Lock()
+	defer l.Unlock()
+	if _, present := l.services[entityID]; present {
+		job.subnet.deviceFailures[entityID] = 0
+		discoveryInventory.deviceUp(job.subnet, deviceIP, "", true, time.Now())
+	}
+	return true
+}
+
+// checkDevice discovers or health checks the device of the job, and returns whether it answered
+func (l *SNMPListener) checkDevice(job snmpJob) bool {
+	if job.healthCheck {
+		return l.healthCheckDevice(job)
+	}
+
+	deviceIP := job.currentIP.String()
+	entityID := job.subnet.config.Digest(deviceIP)
+	l.RLock()
+	lastProbeOID := job.subnet.probeOIDs[entityID]
+	probeOIDs := orderProbeOIDs(job.subnet.config.DiscoveryProbeOIDs, lastProbeOID)
+	deviceLatency := l.config.DeviceLatency
+	_, scheduled := l.services[entityID]
+	l.RUnlock()
+	info, err := queryDeviceInfo(job.subnet.currentConfig(), deviceIP, probeOIDs)
+	if err != nil {
+		if errors.Is(err, errBuildingParams) {
+			// the device is kept, the configuration is at fault
+			log.Errorf("SNMP discovery of %s error: %v", deviceIP, err)
+			return false
 		}
+		log.Debugf("SNMP discovery of %s error: %v", deviceIP, err)
+		// most of the addresses of a subnet have no device, only the timeouts of the devices known
+		// to answer tell whether the timeout is too short
+		if (scheduled || lastProbeOID != "") && isProbeTimeout(err) {
+			discoveryInventory.probeTimedOut(job.subnet)
+		}
+		l.deleteService(entityID, job.subnet)
+		return false
+	}
+	snmpProbeSuccesses.Inc(job.subnet.config.Network, info.probeOID)
+
+	l.Lock()
+	job.subnet.probeOIDs[entityID] = info.probeOID
+	if info.sysObjectID != "" {
+		if job.subnet.sysObjectIDs == nil {
+			job.subnet.sysObjectIDs = map[string]string{}
+		}
+		job.subnet.sysObjectIDs[entityID] = info.sysObjectID
 	}
+	if interval := recordInterfaceCount(job.subnet, entityID, info.interfaceCount); interval != 0 {
+		log.Infof("SNMP device %s of subnet %s has %d interfaces, its min collection interval is %ds", deviceIP, job.subnet.config.Network, info.interfaceCount, interval)
+		snmpAdjustedIntervals.Inc(job.subnet.config.Network)
+	}
+	l.Unlock()
+	l.createService(entityID, job.subnet, deviceIP, info.sysName, true)
+	// the device is known to the inventory once scheduled
+	discoveryInventory.probeAnswered(job.subnet, deviceIP, info.latency, deviceLatency)
+	return true
 }
 
-func (l *SNMPListener) checkDevices() {
-	subnets := []snmpSubnet{}
-	for _, config := range l.config.Configs {
-		ipAddr, ipNet, err := net.ParseCIDR(config.Network)
+// orderProbeOIDs returns the OIDs to probe a device with, the one it last answered first
+func orderProbeOIDs(configured []string, lastAnswered string) []string {
+	if len(configured) == 0 {
+		configured = []string{sysObjectIDOid}
+	}
+	if lastAnswered == "" {
+		return configured
+	}
+	oids := make([]string, 0, len(configured))
+	oids = append(oids, lastAnswered)
+	for _, oid := range configured {
+		if oid != lastAnswered {
+			oids = append(oids, oid)
+		}
+	}
+	if len(oids) > len(configured) {
+		// the OID is no longer configured
+		return oids[1:]
+	}
+	return oids
+}
+
+// queryDeviceInfo probes a device with the given OIDs in order until one of them answers, getting its
+// sysObjectID when it is the probe OID, its sysName when the tags of the subnet reference it, and its
+// interface count when the collection interval is suggested from it.
+// The next OIDs are only tried when the device answers without a value, a device which doesn't
+// answer at all isn't probed again. Don't make it a method, to be overridden in tests.
+var queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+	session, err := connectDevice(config, deviceIP)
+	if err != nil {
+		return snmpDeviceInfo{}, err
+	}
+	// a device answering without a value doesn't make the session unhealthy
+	var getErr error
+	defer func() { session.Release(getErr) }()
+
+	for _, probeOID := range probeOIDs {
+		oids := []string{probeOID}
+		if config.TagsReference("sysName") {
+			oids = append(oids, sysNameOid)
+		}
+		// The engine of a v3 device is discovered by its first GET, unless it is cached by the pool,
+		// and the GET is retried on timeout: the latency is the round trip of the last request sent
+		var sent time.Time
+		session.OnSent = func(*gosnmp.GoSNMP) { sent = time.Now() }
+		value, err := session.Get(oids)
+		session.OnSent = nil
+		latency := time.Since(sent)
 		if err != nil {
-			log.Errorf("Couldn't parse SNMP network: %s", err)
+			getErr = err
+			return snmpDeviceInfo{}, fmt.Errorf("get error: %v", err)
+		}
+		if len(value.Variables) < 1 || !hasValue(value.Variables[0]) {
+			log.Debugf("SNMP get of %s to %s: no data", probeOID, deviceIP)
+			continue
+		}
+		log.Debugf("SNMP get of %s to %s success: %v", probeOID, deviceIP, value.Variables[0].Value)
+		info := snmpDeviceInfo{probeOID: probeOID, latency: latency}
+		if probeOID == sysObjectIDOid {
+			info.sysObjectID = fmt.Sprintf("%v", value.Variables[0].Value)
+		}
+		if len(value.Variables) > 1 {
+			if rawName, ok := value.Variables[1].Value.([]byte); ok {
+				info.sysName = string(rawName)
+			}
+		}
+		if config.InterfaceCountThreshold > 0 {
+			info.interfaceCount = queryInterfaceCount(session, deviceIP)
+		}
+		return info, nil
+	}
+	return snmpDeviceInfo{}, errors.New("no data")
+}
+
+// snmpSubnetSource tracks the subnets currently scanned for a configuration
+type snmpSubnetSource struct {
+	// key is the fingerprint of the config, to tell whether it changed when the config file is reloaded
+	key         string
+	config      snmp.Config
+	source      snmp.SubnetSource
+	listed      bool
+	nextRefresh time.Time
+	// subnets holds the subnets to scan, by network
+	subnets map[string]*snmpSubnet
+	// removedSubnets holds the subnets no longer provided by the source,
+	// until all their devices are evicted
+	removedSubnets map[string]*snmpSubnet
+	// neighbors holds the devices found by the neighbor walk of the seeds outside of the subnets,
+	// nil when the config has no seeds
+	neighbors *snmpSubnet
+	// ctx is cancelled when the config is removed, to stop the sweeps of its subnets
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newSubnetSource creates the source of the subnets of a config, the secrets referenced by its
+// credentials are resolved before the first discovery
+func (l *SNMPListener) newSubnetSource(config snmp.Config) *snmpSubnetSource {
+	l.resolveSecrets(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &snmpSubnetSource{
+		key:            config.Fingerprint(),
+		config:         config,
+		source:         config.NewSubnetSource(),
+		subnets:        map[string]*snmpSubnet{},
+		removedSubnets: map[string]*snmpSubnet{},
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	if len(config.Seeds) > 0 {
+		source.neighbors = newSNMPNeighborSubnet(config)
+		source.neighbors.ctx = ctx
+		discoveryInventory.addSubnet(source.neighbors)
+		l.loadCache(source.neighbors)
+	}
+	l.Lock()
+	if l.activeSources == nil {
+		l.activeSources = map[*snmpSubnetSource]struct{}{}
+	}
+	l.activeSources[source] = struct{}{}
+	l.Unlock()
+	return source
+}
+
+// context returns the context of the source, which is cancelled when its config is removed
+func (s *snmpSubnetSource) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// deviceSubnets returns the subnets of the source whose devices are discovered: the subnets
+// currently scanned and the subnet of the neighbor walk
+func (s *snmpSubnetSource) deviceSubnets() []*snmpSubnet {
+	subnets := make([]*snmpSubnet, 0, len(s.subnets)+1)
+	for _, subnet := range s.subnets {
+		subnets = append(subnets, subnet)
+	}
+	if s.neighbors != nil {
+		subnets = append(subnets, s.neighbors)
+	}
+	return subnets
+}
+
+func newSNMPSubnet(config snmp.Config, network string) (*snmpSubnet, error) {
+	ipAddr, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+	// Each subnet of a source has its own copy of the config so that the network is rendered in its checks
+	config.Network = network
+
+	startingIP := ipAddr.Mask(ipNet.Mask)
+
+	configHash := config.Digest(config.Network)
+	cacheKey := fmt.Sprintf("snmp:%s", configHash)
+	adIdentifier := config.ADIdentifier
+	if adIdentifier == "" {
+		adIdentifier = "snmp"
+	}
+
+	return &snmpSubnet{
+		adIdentifier:   adIdentifier,
+		config:         config,
+		startingIP:     startingIP,
+		network:        *ipNet,
+		cacheKey:       cacheKey,
+		devices:        map[string]string{},
+		deviceFailures: map[string]int{},
+		evictedDevices: map[string]string{},
+		probeOIDs:      map[string]string{},
+		sysObjectIDs:   map[string]string{},
+	}, nil
+}
+
+// refreshSubnets lists again the networks of the sources due for a refresh and returns the subnets
+// which appeared. Subnets which disappeared stop being scanned, their devices are evicted by
+// evictRemovedSubnets after the allowed failures.
+func (l *SNMPListener) refreshSubnets(sources []*snmpSubnetSource, now time.Time) []*snmpSubnet {
+	var added []*snmpSubnet
+	for _, source := range sources {
+		refreshInterval := source.source.RefreshInterval()
+		if source.listed && (refreshInterval == 0 || now.Before(source.nextRefresh)) {
 			continue
 		}
+		source.listed = true
+		source.nextRefresh = now.Add(refreshInterval)
 
-		startingIP := ipAddr.Mask(ipNet.Mask)
+		networks := map[string]struct{}{}
+		for _, network := range source.source.Networks(source.context()) {
+			networks[network] = struct{}{}
+			if _, found := source.subnets[network]; found {
+				continue
+			}
+			if subnet, found := source.removedSubnets[network]; found {
+				log.Infof("SNMP subnet %s is back, resuming its discovery", network)
+				delete(source.removedSubnets, network)
+				source.subnets[network] = subnet
+				discoveryInventory.addSubnet(subnet)
+				added = append(added, subnet)
+				continue
+			}
+			subnet, err := newSNMPSubnet(source.config, network)
+			if err != nil {
+				log.Errorf("Couldn't parse SNMP network: %s", err)
+				continue
+			}
+			subnet.ctx = source.ctx
+			if refreshInterval > 0 {
+				log.Infof("Discovered SNMP subnet %s, starting its discovery", network)
+			}
+			discoveryInventory.addSubnet(subnet)
+			l.loadCache(subnet)
+			source.subnets[network] = subnet
+			added = append(added, subnet)
+		}
 
-		configHash := config.Digest(config.Network)
-		cacheKey := fmt.Sprintf("snmp:%s", configHash)
-		adIdentifier := config.ADIdentifier
-		if adIdentifier == "" {
-			adIdentifier = "snmp"
+		for network, subnet := range source.subnets {
+			if _, found := networks[network]; !found {
+				log.Infof("SNMP subnet %s is gone, stopping its discovery", network)
+				delete(source.subnets, network)
+				source.removedSubnets[network] = subnet
+				discoveryInventory.markSubnetRemoved(subnet)
+			}
 		}
+	}
+	return added
+}
 
-		subnet := snmpSubnet{
-			adIdentifier:   adIdentifier,
-			config:         config,
-			startingIP:     startingIP,
-			network:        *ipNet,
-			cacheKey:       cacheKey,
-			devices:        map[string]string{},
-			deviceFailures: map[string]int{},
+// evictRemovedSubnets counts a failure for each device of the subnets no longer provided
+// by their source, so that they are removed after the allowed failures
+func (l *SNMPListener) evictRemovedSubnets(sources []*snmpSubnetSource) {
+	for _, source := range sources {
+		for network, subnet := range source.removedSubnets {
+			// the devices are updated by the workers, they are deleted from a copy
+			l.RLock()
+			entityIDs := make([]string, 0, len(subnet.devices))
+			for entityID := range subnet.devices {
+				entityIDs = append(entityIDs, entityID)
+			}
+			l.RUnlock()
+			for _, entityID := range entityIDs {
+				l.deleteService(entityID, subnet)
+			}
+			l.Lock()
+			l.forgetPendingDevices(subnet)
+			evicted := len(subnet.devices) == 0
+			l.Unlock()
+			if evicted {
+				delete(source.removedSubnets, network)
+				discoveryInventory.deleteSubnet(subnet)
+			}
 		}
-		subnets = append(subnets, subnet)
+	}
+}
+
+// scanSubnets sends a job for each IP of the subnets, it returns false if the listener has been stopped.
+// The sweep of a subnet whose config was removed stops at once, and the subnets aren't swept while the
+// discovery is over its memory budget, which is checked again every memoryCheckInterval IPs of a sweep:
+// the sweeps skipped or stopped are done again on the next discovery.
+func (l *SNMPListener) scanSubnets(subnets []*snmpSubnet, jobs chan<- snmpJob) bool {
+	for _, subnet := range subnets {
+		if subnet.cancelled() {
+			continue
+		}
+		if l.checkMemoryBudget() {
+			log.Debugf("Skipping the sweep of SNMP subnet %s, the discovery is over its memory budget", subnet.config.Network)
+			snmpPausedSweeps.Inc(subnet.config.Network)
+			continue
+		}
+		discoveryInventory.startSweep(subnet, time.Now())
+		startingIP := make(net.IP, len(subnet.startingIP))
+		copy(startingIP, subnet.startingIP)
+		swept, paused := 0, false
+		for currentIP := startingIP; subnet.network.Contains(currentIP) && !subnet.cancelled(); incrementIP(currentIP) {
+			if swept++; swept%memoryCheckInterval == 0 && l.checkMemoryBudget() {
+				log.Debugf("Stopping the sweep of SNMP subnet %s at %s, the discovery is over its memory budget", subnet.config.Network, currentIP)
+				snmpPausedSweeps.Inc(subnet.config.Network)
+				paused = true
+				break
+			}
+			discoveryInventory.advanceSweep(subnet)
+
+			if ignored := subnet.config.IsIPIgnored(currentIP); ignored {
+				continue
+			}
+
+			jobIP := make(net.IP, len(currentIP))
+			copy(jobIP, currentIP)
+			job := snmpJob{
+				subnet:    subnet,
+				currentIP: jobIP,
+			}
+			jobs <- job
 
-		l.loadCache(&subnet)
+			select {
+			case <-l.stop:
+				return false
+			default:
+			}
+		}
+		if paused {
+			discoveryInventory.pauseSweep(subnet)
+		} else {
+			discoveryInventory.endSweep(subnet, time.Now())
+		}
 	}
+	return true
+}
+
+// healthCheckSubnets sends a health check job for each device of the subnets due for a health check,
+// it returns false if the listener has been stopped
+func (l *SNMPListener) healthCheckSubnets(sources []*snmpSubnetSource, jobs chan<- snmpJob, now time.Time) bool {
+	for _, source := range sources {
+		for _, subnet := range source.deviceSubnets() {
+			interval := time.Duration(subnet.config.HealthCheckInterval) * time.Second
+			if interval <= 0 || now.Before(subnet.nextHealthCheck) {
+				continue
+			}
+			subnet.nextHealthCheck = now.Add(interval)
+
+			// the workers update the devices of the subnet
+			l.RLock()
+			deviceIPs := make([]string, 0, len(subnet.devices))
+			for _, deviceIP := range subnet.devices {
+				deviceIPs = append(deviceIPs, deviceIP)
+			}
+			l.RUnlock()
+
+			for _, deviceIP := range deviceIPs {
+				ip := net.ParseIP(deviceIP)
+				if ip == nil {
+					continue
+				}
+				jobs <- snmpJob{
+					subnet:      subnet,
+					currentIP:   ip,
+					healthCheck: true,
+				}
+
+				select {
+				case <-l.stop:
+					return false
+				default:
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Don't make it a method, to be overridden in tests
+var resolveSecrets snmp.SecretResolver = secrets.Refresh
+
+// resolveSecrets resolves the secrets referenced by the credentials of a config, and returns whether
+// a credential changed. When the secrets can't be resolved, the previous credentials are kept.
+func (l *SNMPListener) resolveSecrets(config *snmp.Config) bool {
+	changed, err := config.ResolveSecrets(resolveSecrets)
+	if err != nil {
+		log.Warnf("Couldn't resolve the secrets of the SNMP credentials of %s, keeping the previous credentials: %v", config.Network, err)
+		snmpSecretResolutionErrors.Inc(config.Network)
+		return false
+	}
+	return changed
+}
+
+// refreshSecrets resolves again the secrets referenced by the credentials, and reschedules the checks
+// of the devices whose credentials were rotated. Their entity IDs don't change, the secrets being
+// part of their digest by handle.
+func (l *SNMPListener) refreshSecrets(sources []*snmpSubnetSource) {
+	for _, source := range sources {
+		if !l.resolveSecrets(&source.config) {
+			continue
+		}
+		log.Infof("SNMP credentials of %s were rotated, rescheduling the checks of its devices", source.config.Network)
+		subnets := source.deviceSubnets()
+		for _, subnet := range source.removedSubnets {
+			subnets = append(subnets, subnet)
+		}
+		l.Lock()
+		for _, subnet := range subnets {
+			subnet.rotateCredentials(source.config)
+			config := subnet.currentConfig()
+			for entityID := range subnet.devices {
+				svc, present := l.services[entityID]
+				if !present {
+					continue
+				}
+				rescheduled := *svc.(*SNMPService)
+				rescheduled.config = config
+				l.delService <- svc
+				l.services[entityID] = &rescheduled
+				l.newService <- &rescheduled
+			}
+		}
+		l.Unlock()
+	}
+}
+
+func (l *SNMPListener) checkDevices() {
+	if l.config.SecretRefreshInterval == 0 {
+		l.config.SecretRefreshInterval = defaultSecretRefreshInterval
+	}
+
+	sources := make([]*snmpSubnetSource, 0, len(l.config.Configs))
+	for _, config := range l.config.Configs {
+		sources = append(sources, l.newSubnetSource(config))
+	}
+	subnets := l.refreshSubnets(sources, time.Now())
 
 	if l.config.Workers == 0 {
 		l.config.Workers = defaultWorkers
 	}
+	// the workers use at most one session each
+	snmpSessions.Resize(l.config.Workers)
 
 	if l.config.AllowedFailures == 0 {
 		l.config.AllowedFailures = defaultAllowedFailures
@@ -226,65 +840,162 @@ func (l *SNMPListener) checkDevices() {
 
 	discoveryTicker := time.NewTicker(time.Duration(l.config.DiscoveryInterval) * time.Second)
 
-	for {
-		var subnet *snmpSubnet
-		for i := range subnets {
-			// Use `&subnets[i]` to pass the correct pointer address to snmpJob{}
-			subnet = &subnets[i]
-			startingIP := make(net.IP, len(subnet.startingIP))
-			copy(startingIP, subnet.startingIP)
-			for currentIP := startingIP; subnet.network.Contains(currentIP); incrementIP(currentIP) {
-
-				if ignored := subnet.config.IsIPIgnored(currentIP); ignored {
-					continue
-				}
+	// The tickers follow the sources, which change when the config file is reloaded
+	var healthCheckTicker, refreshTicker, secretRefreshTicker intervalTicker
+	defer healthCheckTicker.stop()
+	defer refreshTicker.stop()
+	defer secretRefreshTicker.stop()
+	resetTickers := func() {
+		healthCheckTicker.reset(healthCheckInterval(sources))
+		refreshTicker.reset(refreshInterval(sources))
+		secretRefreshTicker.reset(l.secretRefreshInterval(sources))
+	}
+	resetTickers()
 
-				jobIP := make(net.IP, len(currentIP))
-				copy(jobIP, currentIP)
-				job := snmpJob{
-					subnet:    subnet,
-					currentIP: jobIP,
-				}
-				jobs <- job
+	if l.config.ConfigReloadInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if l.reloads == nil {
+			l.reloads = make(chan []snmp.Config, 1)
+		}
+		go l.watchConfig(ctx, time.Duration(l.config.ConfigReloadInterval)*time.Second, sourceFingerprints(sources))
+	}
 
-				select {
-				case <-l.stop:
-					return
-				default:
-				}
-			}
+	// the neighbors of the seeds are walked after each full sweep
+	walk := true
+	for {
+		if !l.scanSubnets(subnets, jobs) {
+			return
 		}
+		if walk && !l.walkSeeds(sources) {
+			return
+		}
+		walk = false
 
 		select {
 		case <-l.stop:
 			return
 		case <-discoveryTicker.C:
+			walk = true
+			l.evictRemovedSubnets(sources)
+			// the max devices grows with the number of cluster check runners
+			l.Lock()
+			l.promotePendingDevices()
+			l.Unlock()
+			subnets = subnets[:0]
+			for _, source := range sources {
+				for _, subnet := range source.subnets {
+					subnets = append(subnets, subnet)
+				}
+			}
+		case now := <-refreshTicker.C():
+			// Newly discovered subnets are scanned right away, the others on the next discovery
+			subnets = l.refreshSubnets(sources, now)
+		case now := <-healthCheckTicker.C():
+			if !l.healthCheckSubnets(sources, jobs, now) {
+				return
+			}
+			// the subnets are scanned on the next discovery
+			subnets = nil
+		case <-secretRefreshTicker.C():
+			l.refreshSecrets(sources)
+			// the subnets are scanned on the next discovery
+			subnets = nil
+		case configs := <-l.reloads:
+			// The subnets of the new configs are scanned right away, the others on the next discovery
+			sources, subnets = l.reloadSources(sources, configs, time.Now())
+			resetTickers()
+			walk = true
 		}
 	}
 }
 
-func (l *SNMPListener) createService(entityID string, subnet *snmpSubnet, deviceIP string, writeCache bool) {
+func (l *SNMPListener) createService(entityID string, subnet *snmpSubnet, deviceIP string, sysName string, writeCache bool) {
 	l.Lock()
 	defer l.Unlock()
-	if _, present := l.services[entityID]; present {
+	if subnet.cancelled() {
+		return
+	}
+	if l.isScheduledElsewhere(entityID, subnet, deviceIP) {
+		log.Debugf("SNMP device %s of subnet %s is already scheduled by another subnet", deviceIP, subnet.config.Network)
+		return
+	}
+	if svc, present := l.services[entityID]; present {
+		if writeCache {
+			// the device answered, only consecutive failures count towards its removal
+			subnet.deviceFailures[entityID] = 0
+		}
+		discoveryInventory.deviceUp(subnet, deviceIP, sysName, writeCache, time.Now())
+		// Devices loaded from the cache don't carry discovery facts yet,
+		// reschedule them once a sweep learned a new sysName so their tags are rendered,
+		// a new sysObjectID changing the weight hint of their cluster check, or a new interface
+		// count changing their tags and their collection interval
+		snmpSvc := svc.(*SNMPService)
+		if sysName == "" {
+			sysName = snmpSvc.sysName
+		}
+		if snmpSvc.sysName == sysName && snmpSvc.weightHint == l.weightHint(subnet, entityID) && snmpSvc.interfaceCount == subnet.interfaceCounts[entityID] {
+			return
+		}
+		l.delService <- svc
+	}
+	device := snmpDevice{entityID: entityID, subnet: subnet, deviceIP: deviceIP, sysName: sysName}
+	if _, present := l.services[entityID]; !present && !l.admitDevice(device) {
 		return
 	}
+	if _, evicted := subnet.evictedDevices[entityID]; evicted && writeCache {
+		log.Infof("SNMP device %s of subnet %s answered again, scheduling its check", deviceIP, subnet.config.Network)
+		delete(subnet.evictedDevices, entityID)
+		snmpResurrectedDevices.Inc(subnet.config.Network)
+	}
+	l.scheduleDevice(device, writeCache)
+}
+
+// scheduleDevice creates the service of a device, the caller must hold the lock
+func (l *SNMPListener) scheduleDevice(device snmpDevice, writeCache bool) {
+	subnet := device.subnet
 	svc := &SNMPService{
 		adIdentifier: subnet.adIdentifier,
-		entityID:     entityID,
-		deviceIP:     deviceIP,
+		entityID:     device.entityID,
+		deviceIP:     device.deviceIP,
 		creationTime: integration.Before,
-		config:       subnet.config,
+		config:       subnet.currentConfig(),
+		sysName:      device.sysName,
+		clusterCheck: l.clusterChecks,
+		weightHint:   l.weightHint(subnet, device.entityID),
+
+		interfaceCount: subnet.interfaceCounts[device.entityID],
 	}
-	l.services[entityID] = svc
-	subnet.devices[entityID] = deviceIP
-	subnet.deviceFailures[entityID] = 0
+	l.services[device.entityID] = svc
+	l.registerDevice(device.entityID, subnet, device.deviceIP)
+	subnet.devices[device.entityID] = device.deviceIP
+	subnet.deviceFailures[device.entityID] = 0
+	discoveryInventory.deviceUp(subnet, device.deviceIP, device.sysName, writeCache, time.Now())
 	if writeCache {
 		l.writeCache(subnet)
 	}
 	l.newService <- svc
 }
 
+// weightHint returns the weight hint of the cluster check of a device, the number of OIDs expected
+// from its profile, 0 when the listener doesn't run in the cluster agent or the profile is unknown.
+// The OID counts of the config override the ones of the profile definitions. The caller must hold the lock.
+func (l *SNMPListener) weightHint(subnet *snmpSubnet, entityID string) int {
+	sysObjectID := subnet.sysObjectIDs[entityID]
+	if !l.clusterChecks || sysObjectID == "" {
+		return 0
+	}
+	if count, found := l.config.ProfileOIDCount(sysObjectID); found {
+		return count
+	}
+	count, err := profileOIDCount(sysObjectID)
+	if err != nil {
+		log.Debugf("Unknown OID count for sysObjectID %s: %s", sysObjectID, err)
+		return 0
+	}
+	return count
+}
+
 func (l *SNMPListener) deleteService(entityID string, subnet *snmpSubnet) {
 	l.Lock()
 	defer l.Unlock()
@@ -298,15 +1009,80 @@ func (l *SNMPListener) deleteService(entityID string, subnet *snmpSubnet) {
 			failure++
 		}
 
-		if l.config.AllowedFailures != -1 && failure >= l.config.AllowedFailures {
+		deviceIP := subnet.devices[entityID]
+		if allowedFailures := l.allowedFailures(subnet); allowedFailures != -1 && failure >= allowedFailures {
+			log.Infof("SNMP device %s of subnet %s failed %d times in a row, unscheduling its check", deviceIP, subnet.config.Network, failure)
 			l.delService <- svc
 			delete(l.services, entityID)
 			delete(subnet.devices, entityID)
+			forgetDeviceInfo(subnet, entityID)
+			l.unregisterDevice(entityID, deviceIP)
+			if subnet.evictedDevices == nil {
+				subnet.evictedDevices = map[string]string{}
+			}
+			subnet.evictedDevices[entityID] = deviceIP
+			snmpEvictedDevices.Inc(subnet.config.Network)
 			l.writeCache(subnet)
+			discoveryInventory.deviceRemoved(subnet, deviceIP)
+			l.promotePendingDevices()
+		} else {
+			discoveryInventory.deviceFailed(subnet, deviceIP, failure)
 		}
+	} else if pending, found := l.pendingDevices[entityID]; found && pending.subnet == subnet {
+		// a pending device is only scheduled while it answers
+		l.forgetPendingDevice(entityID)
+		forgetDeviceInfo(subnet, entityID)
 	}
 }
 
+// forgetDeviceInfo removes what the discovery learnt about a device which is no longer scheduled nor
+// pending, it is learnt again if the device answers a later sweep. The caller must hold the lock.
+func forgetDeviceInfo(subnet *snmpSubnet, entityID string) {
+	delete(subnet.probeOIDs, entityID)
+	delete(subnet.sysObjectIDs, entityID)
+	delete(subnet.interfaceCounts, entityID)
+}
+
+// registerDevice records the subnet of a scheduled service, the caller must hold the lock
+func (l *SNMPListener) registerDevice(entityID string, subnet *snmpSubnet, deviceIP string) {
+	if l.devicesByIP == nil {
+		l.devicesByIP = map[string]map[string]*snmpSubnet{}
+	}
+	if l.devicesByIP[deviceIP] == nil {
+		l.devicesByIP[deviceIP] = map[string]*snmpSubnet{}
+	}
+	l.devicesByIP[deviceIP][entityID] = subnet
+}
+
+// unregisterDevice forgets an unscheduled service, the caller must hold the lock
+func (l *SNMPListener) unregisterDevice(entityID string, deviceIP string) {
+	delete(l.devicesByIP[deviceIP], entityID)
+	if len(l.devicesByIP[deviceIP]) == 0 {
+		delete(l.devicesByIP, deviceIP)
+	}
+}
+
+// isScheduledElsewhere returns whether a service of another subnet is scheduled for the device when
+// either of the subnets is the subnet of a neighbor walk. Overlapping sweeps keep scheduling their
+// devices independently. The caller must hold the lock.
+func (l *SNMPListener) isScheduledElsewhere(entityID string, subnet *snmpSubnet, deviceIP string) bool {
+	for ownerID, owner := range l.devicesByIP[deviceIP] {
+		if ownerID != entityID && (subnet.neighbors || owner.neighbors) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedFailures returns the number of consecutive failures after which the devices of
+// the subnet are unscheduled, -1 to never unschedule them
+func (l *SNMPListener) allowedFailures(subnet *snmpSubnet) int {
+	if subnet.config.AllowedFailures != 0 {
+		return subnet.config.AllowedFailures
+	}
+	return l.config.AllowedFailures
+}
+
 func incrementIP(ip net.IP) {
 	for i := len(ip) - 1; i >= 0; i-- {
 		ip[i]++
@@ -385,6 +1161,18 @@ func (s *SNMPService) HasFilter(filter containers.FilterType) bool {
 	return false
 }
 
+// IsClusterCheck returns whether the check of the device is dispatched to the cluster check runners,
+// when the listener runs in the cluster agent
+func (s *SNMPService) IsClusterCheck() bool {
+	return s.clusterCheck
+}
+
+// GetWeightHint returns the number of OIDs expected from the profile of the device, to balance the
+// cluster checks of the devices between the runners
+func (s *SNMPService) GetWeightHint() int {
+	return s.weightHint
+}
+
 // GetExtraConfig returns data from configuration
 func (s *SNMPService) GetExtraConfig(key []byte) ([]byte, error) {
 	switch string(key) {
@@ -421,13 +1209,52 @@ func (s *SNMPService) GetExtraConfig(key []byte) ([]byte, error) {
 	case "collect_device_metadata":
 		return []byte(strconv.FormatBool(s.config.CollectDeviceMetadata)), nil
 	case "tags":
-		return []byte(convertToCommaSepTags(s.config.Tags)), nil
+		return []byte(convertToCommaSepTags(s.resolveTags())), nil
 	case "min_collection_interval":
-		return []byte(fmt.Sprintf("%d", s.config.MinCollectionInterval)), nil
+		return []byte(fmt.Sprintf("%d", s.minCollectionInterval())), nil
 	}
 	return []byte{}, ErrNotSupported
 }
 
+// resolveTags renders the discovery facts referenced in the subnet tags.
+// Tags referencing an unknown or empty fact are omitted. The devices whose
+// interface count is known are tagged with its bucket.
+func (s *SNMPService) resolveTags() []string {
+	facts := map[string]string{
+		"subnet":    s.config.Network,
+		"device_ip": s.deviceIP,
+		"namespace": s.config.Namespace,
+		"sysName":   s.sysName,
+	}
+	tags := make([]string, 0, len(s.config.Tags))
+	seen := make(map[string]bool, len(s.config.Tags))
+	for _, tag := range s.config.Tags {
+		resolved := true
+		rendered := tagTemplateRegex.ReplaceAllStringFunc(tag, func(match string) string {
+			value := facts[strings.Trim(match, "%")]
+			if value == "" {
+				resolved = false
+			}
+			return value
+		})
+		if !resolved {
+			log.Debugf("Omitting tag %q for device %s: unresolved discovery fact", tag, s.deviceIP)
+			continue
+		}
+		if seen[rendered] {
+			continue
+		}
+		seen[rendered] = true
+		tags = append(tags, rendered)
+	}
+	if s.interfaceCount > 0 {
+		if tag := interfaceCountTag + ":" + interfaceCountBucket(s.interfaceCount); !seen[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 func convertToCommaSepTags(tags []string) string {
 	normalizedTags := make([]string, 0, len(tags))
 	for _, tag := range tags {
@@ -0,0 +1,267 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+var (
+	snmpPendingDevices = telemetry.NewGaugeWithOpts("snmp_listener", "pending_devices",
+		[]string{}, "Number of SNMP devices discovered but not scheduled, the max devices per agent being reached",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpPreemptedDevices = telemetry.NewCounterWithOpts("snmp_listener", "preempted_devices",
+		[]string{"subnet"}, "Number of scheduled SNMP devices made pending for devices of a higher priority",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+// snmpRunnerCounter returns the number of cluster check runners the checks of the devices are
+// dispatched to, nil when the listener doesn't run in the cluster agent
+var (
+	snmpRunnerCounter      func() int
+	snmpRunnerCounterMutex sync.RWMutex
+)
+
+// SetSNMPRunnerCounter sets the function returning the number of cluster check runners, so that the
+// max devices per agent of the SNMP listener running in the cluster agent applies to each runner
+func SetSNMPRunnerCounter(counter func() int) {
+	snmpRunnerCounterMutex.Lock()
+	defer snmpRunnerCounterMutex.Unlock()
+	snmpRunnerCounter = counter
+}
+
+// snmpRunners returns the number of agents the devices are scheduled on, at least 1
+func snmpRunners() int {
+	snmpRunnerCounterMutex.RLock()
+	counter := snmpRunnerCounter
+	snmpRunnerCounterMutex.RUnlock()
+	if counter == nil {
+		return 1
+	}
+	if runners := counter(); runners > 1 {
+		return runners
+	}
+	return 1
+}
+
+// snmpDevice is a device discovered by the listener, scheduled or pending
+type snmpDevice struct {
+	entityID string
+	subnet   *snmpSubnet
+	deviceIP string
+	sysName  string
+}
+
+// maxDevices returns the number of devices scheduled at most, 0 for no limit. The caller must hold the lock.
+func (l *SNMPListener) maxDevices() int {
+	return l.config.MaxDevicesPerAgent * snmpRunners()
+}
+
+// admitDevice returns whether a device which isn't scheduled can be, and makes it pending otherwise.
+// When the max devices is reached, the device is only scheduled in place of the scheduled device with
+// the lowest priority if it has a higher priority. The caller must hold the lock.
+func (l *SNMPListener) admitDevice(device snmpDevice) bool {
+	if _, found := l.discoveryOrder[device.entityID]; !found {
+		if l.discoveryOrder == nil {
+			l.discoveryOrder = map[string]uint64{}
+		}
+		l.discoveries++
+		l.discoveryOrder[device.entityID] = l.discoveries
+	}
+	maxDevices := l.maxDevices()
+	if maxDevices == 0 || len(l.services) < maxDevices {
+		l.forgetPendingDevice(device.entityID)
+		return true
+	}
+	if lowest, found := l.lowestScheduledDevice(); found && l.outranks(device, lowest) {
+		log.Infof("SNMP device %s of subnet %s has a higher priority than %s, scheduling its check in place", device.deviceIP, device.subnet.config.Network, lowest.deviceIP)
+		l.unscheduleToPending(lowest)
+		snmpPreemptedDevices.Inc(lowest.subnet.config.Network)
+		l.forgetPendingDevice(device.entityID)
+		return true
+	}
+	if _, pending := l.pendingDevices[device.entityID]; !pending {
+		log.Debugf("SNMP device %s of subnet %s is pending, %d devices are scheduled already", device.deviceIP, device.subnet.config.Network, maxDevices)
+	}
+	l.addPendingDevice(device)
+	return false
+}
+
+// lowestScheduledDevice returns the scheduled device with the lowest priority. The caller must hold the lock.
+func (l *SNMPListener) lowestScheduledDevice() (snmpDevice, bool) {
+	var lowest snmpDevice
+	found := false
+	for entityID, svc := range l.services {
+		snmpSvc, ok := svc.(*SNMPService)
+		if !ok {
+			continue
+		}
+		subnet, registered := l.devicesByIP[snmpSvc.deviceIP][entityID]
+		if !registered {
+			continue
+		}
+		device := snmpDevice{entityID: entityID, subnet: subnet, deviceIP: snmpSvc.deviceIP, sysName: snmpSvc.sysName}
+		if !found || l.outranks(lowest, device) {
+			lowest, found = device, true
+		}
+	}
+	return lowest, found
+}
+
+// highestPendingDevice returns the pending device with the highest priority, the pending devices of the
+// subnets whose config was removed are forgotten. The caller must hold the lock.
+func (l *SNMPListener) highestPendingDevice() (snmpDevice, bool) {
+	var highest snmpDevice
+	found := false
+	for entityID, device := range l.pendingDevices {
+		if device.subnet.cancelled() {
+			l.forgetPendingDevice(entityID)
+			continue
+		}
+		if !found || l.outranks(*device, highest) {
+			highest, found = *device, true
+		}
+	}
+	return highest, found
+}
+
+// outranks returns whether a device has a higher priority than another one, following the device priority
+// rule. The devices discovered first come first between devices of the same priority. The caller must hold
+// the lock.
+func (l *SNMPListener) outranks(a snmpDevice, b snmpDevice) bool {
+	switch l.config.DevicePriority {
+	case snmp.DevicePriorityLowestIP:
+		if order := bytes.Compare(net.ParseIP(a.deviceIP).To16(), net.ParseIP(b.deviceIP).To16()); order != 0 {
+			return order < 0
+		}
+	case snmp.DevicePriorityProfile:
+		priorityA := l.config.ProfilePriority(a.subnet.sysObjectIDs[a.entityID])
+		priorityB := l.config.ProfilePriority(b.subnet.sysObjectIDs[b.entityID])
+		if priorityA != priorityB {
+			return priorityA > priorityB
+		}
+	}
+	if orderA, orderB := l.discoveryOrder[a.entityID], l.discoveryOrder[b.entityID]; orderA != orderB {
+		return orderA < orderB
+	}
+	return a.entityID < b.entityID
+}
+
+// unscheduleToPending unschedules a device to make room for a device of a higher priority, it stays
+// pending until it can be scheduled again. The caller must hold the lock.
+func (l *SNMPListener) unscheduleToPending(device snmpDevice) {
+	if svc, present := l.services[device.entityID]; present {
+		l.delService <- svc
+		delete(l.services, device.entityID)
+	}
+	delete(device.subnet.devices, device.entityID)
+	l.unregisterDevice(device.entityID, device.deviceIP)
+	l.writeCache(device.subnet)
+	discoveryInventory.deviceRemoved(device.subnet, device.deviceIP)
+	l.addPendingDevice(device)
+}
+
+// promotePendingDevices schedules the pending devices with the highest priority while fewer devices than
+// the max devices are scheduled. The caller must hold the lock.
+func (l *SNMPListener) promotePendingDevices() {
+	for len(l.pendingDevices) > 0 {
+		if maxDevices := l.maxDevices(); maxDevices != 0 && len(l.services) >= maxDevices {
+			return
+		}
+		device, found := l.highestPendingDevice()
+		if !found {
+			return
+		}
+		log.Infof("SNMP device %s of subnet %s is no longer pending, scheduling its check", device.deviceIP, device.subnet.config.Network)
+		l.forgetPendingDevice(device.entityID)
+		l.scheduleDevice(device, true)
+	}
+}
+
+// rebalanceDevices applies a change of the max devices: pending devices are scheduled when it increased,
+// and the scheduled devices with the lowest priority become pending when it decreased. The other devices
+// keep their state. The caller must hold the lock.
+func (l *SNMPListener) rebalanceDevices() {
+	if maxDevices := l.maxDevices(); maxDevices != 0 {
+		for len(l.services) > maxDevices {
+			lowest, found := l.lowestScheduledDevice()
+			if !found {
+				break
+			}
+			log.Infof("SNMP device %s of subnet %s is pending, the max devices per agent decreased", lowest.deviceIP, lowest.subnet.config.Network)
+			l.unscheduleToPending(lowest)
+		}
+	}
+	l.promotePendingDevices()
+}
+
+// setDeviceCapacity applies the max devices per agent and the device priority reloaded from the config file.
+// The profile OID counts apply to the weight hints of the devices as they are discovered again.
+func (l *SNMPListener) setDeviceCapacity(listenerConfig snmp.ListenerConfig) {
+	l.Lock()
+	defer l.Unlock()
+	l.config.ProfileOIDCounts = listenerConfig.ProfileOIDCounts
+	if l.config.MaxDevicesPerAgent == listenerConfig.MaxDevicesPerAgent &&
+		l.config.DevicePriority == listenerConfig.DevicePriority &&
+		equalProfilePriorities(l.config.ProfilePriorities, listenerConfig.ProfilePriorities) {
+		return
+	}
+	log.Infof("SNMP max devices per agent changed to %d (%s), rebalancing the devices", listenerConfig.MaxDevicesPerAgent, listenerConfig.DevicePriority)
+	l.config.MaxDevicesPerAgent = listenerConfig.MaxDevicesPerAgent
+	l.config.DevicePriority = listenerConfig.DevicePriority
+	l.config.ProfilePriorities = listenerConfig.ProfilePriorities
+	l.rebalanceDevices()
+}
+
+func equalProfilePriorities(a []snmp.ProfilePriority, b []snmp.ProfilePriority) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addPendingDevice records a pending device, or updates it. The caller must hold the lock.
+func (l *SNMPListener) addPendingDevice(device snmpDevice) {
+	if l.pendingDevices == nil {
+		l.pendingDevices = map[string]*snmpDevice{}
+	}
+	l.pendingDevices[device.entityID] = &device
+	discoveryInventory.devicePending(device.subnet, device.deviceIP, device.sysName, time.Now())
+	snmpPendingDevices.Set(float64(len(l.pendingDevices)))
+}
+
+// forgetPendingDevice forgets a device which is no longer pending. The caller must hold the lock.
+func (l *SNMPListener) forgetPendingDevice(entityID string) {
+	device, found := l.pendingDevices[entityID]
+	if !found {
+		return
+	}
+	delete(l.pendingDevices, entityID)
+	discoveryInventory.pendingDeviceRemoved(device.subnet, device.deviceIP)
+	snmpPendingDevices.Set(float64(len(l.pendingDevices)))
+}
+
+// forgetPendingDevices forgets the pending devices of a subnet which is no longer discovered. The caller
+// must hold the lock.
+func (l *SNMPListener) forgetPendingDevices(subnet *snmpSubnet) {
+	for entityID, device := range l.pendingDevices {
+		if device.subnet == subnet {
+			l.forgetPendingDevice(entityID)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scheduledIPs returns the sorted IPs of the scheduled devices
+func scheduledIPs(l *SNMPListener) []string {
+	ips := make([]string, 0, len(l.services))
+	for _, svc := range l.services {
+		ips = append(ips, svc.(*SNMPService).deviceIP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// pendingIPs returns the sorted IPs of the pending devices
+func pendingIPs(l *SNMPListener) []string {
+	ips := make([]string, 0, len(l.pendingDevices))
+	for _, device := range l.pendingDevices {
+		ips = append(ips, device.deviceIP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func newCappedListener(t *testing.T, listenerConfig snmp.ListenerConfig) (*SNMPListener, *snmpSubnet, chan Service, chan Service) {
+	newSvc := make(chan Service, 20)
+	delSvc := make(chan Service, 20)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+		config:     listenerConfig,
+	}
+	subnet, err := newSNMPSubnet(snmp.Config{Community: "public", AllowedFailures: 1}, "10.0.0.0/24")
+	require.NoError(t, err)
+	return l, subnet, newSvc, delSvc
+}
+
+func answerDiscovery(l *SNMPListener, subnet *snmpSubnet, deviceIP string) string {
+	entityID := subnet.config.Digest(deviceIP)
+	l.createService(entityID, subnet, deviceIP, "", true)
+	return entityID
+}
+
+func TestMaxDevicesFirstDiscovered(t *testing.T) {
+	l, subnet, newSvc, _ := newCappedListener(t, snmp.ListenerConfig{MaxDevicesPerAgent: 2, DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	first := answerDiscovery(l, subnet, "10.0.0.9")
+	answerDiscovery(l, subnet, "10.0.0.8")
+	answerDiscovery(l, subnet, "10.0.0.7")
+	answerDiscovery(l, subnet, "10.0.0.6")
+	assert.Equal(t, []string{"10.0.0.8", "10.0.0.9"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.6", "10.0.0.7"}, pendingIPs(l))
+	assert.Len(t, newSvc, 2)
+
+	// the pending devices answering again stay pending
+	answerDiscovery(l, subnet, "10.0.0.7")
+	assert.Equal(t, []string{"10.0.0.8", "10.0.0.9"}, scheduledIPs(l))
+
+	// the device discovered first among the pending ones takes the place of an evicted device
+	l.deleteService(first, subnet)
+	assert.Equal(t, []string{"10.0.0.7", "10.0.0.8"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.6"}, pendingIPs(l))
+
+	pending := discoveryInventory.subnets[subnet.cacheKey].pending
+	assert.Len(t, pending, 1)
+	assert.Contains(t, pending, "10.0.0.6")
+}
+
+func TestMaxDevicesLowestIP(t *testing.T) {
+	l, subnet, _, delSvc := newCappedListener(t, snmp.ListenerConfig{MaxDevicesPerAgent: 2, DevicePriority: snmp.DevicePriorityLowestIP})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	answerDiscovery(l, subnet, "10.0.0.9")
+	answerDiscovery(l, subnet, "10.0.0.10")
+	// a device with a lower IP takes the place of the scheduled device with the highest IP
+	answerDiscovery(l, subnet, "10.0.0.2")
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.9"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.10"}, pendingIPs(l))
+	assert.Len(t, delSvc, 1)
+
+	// a device with a higher IP stays pending
+	answerDiscovery(l, subnet, "10.0.0.200")
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.9"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.10", "10.0.0.200"}, pendingIPs(l))
+
+	// a pending device which no longer answers is forgotten
+	l.deleteService(subnet.config.Digest("10.0.0.10"), subnet)
+	assert.Equal(t, []string{"10.0.0.200"}, pendingIPs(l))
+}
+
+func TestMaxDevicesProfilePriority(t *testing.T) {
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{
+		MaxDevicesPerAgent: 1,
+		DevicePriority:     snmp.DevicePriorityProfile,
+		ProfilePriorities:  []snmp.ProfilePriority{{SysObjectID: "1.3.6.1.4.1.9.*", Priority: 10}},
+	})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.1")] = "1.3.6.1.4.1.2636.1.1.1.2.21"
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.2")] = "1.3.6.1.4.1.9.1.1745"
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.3")] = "1.3.6.1.4.1.9.1.1746"
+	answerDiscovery(l, subnet, "10.0.0.1")
+	answerDiscovery(l, subnet, "10.0.0.2")
+	answerDiscovery(l, subnet, "10.0.0.3")
+	assert.Equal(t, []string{"10.0.0.2"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, pendingIPs(l))
+}
+
+func TestMaxDevicesRebalance(t *testing.T) {
+	l, subnet, newSvc, delSvc := newCappedListener(t, snmp.ListenerConfig{MaxDevicesPerAgent: 3, DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	for _, deviceIP := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		answerDiscovery(l, subnet, deviceIP)
+	}
+	for len(newSvc) > 0 {
+		<-newSvc
+	}
+
+	// a reload without change doesn't touch the devices
+	l.setDeviceCapacity(snmp.ListenerConfig{MaxDevicesPerAgent: 3, DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	assert.Len(t, newSvc, 0)
+	assert.Len(t, delSvc, 0)
+
+	// only the devices past the new limit are unscheduled
+	l.setDeviceCapacity(snmp.ListenerConfig{MaxDevicesPerAgent: 2, DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.4", "10.0.0.5"}, pendingIPs(l))
+	assert.Len(t, delSvc, 1)
+	assert.Len(t, newSvc, 0)
+
+	// removing the limit schedules the pending devices
+	l.setDeviceCapacity(snmp.ListenerConfig{DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}, scheduledIPs(l))
+	assert.Empty(t, l.pendingDevices)
+	assert.Len(t, newSvc, 3)
+}
+
+func TestMaxDevicesPerRunner(t *testing.T) {
+	defer SetSNMPRunnerCounter(nil)
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{MaxDevicesPerAgent: 1, DevicePriority: snmp.DevicePriorityFirstDiscovered})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	runners := 2
+	SetSNMPRunnerCounter(func() int { return runners })
+	for _, deviceIP := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		answerDiscovery(l, subnet, deviceIP)
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, scheduledIPs(l))
+	assert.Equal(t, []string{"10.0.0.3"}, pendingIPs(l))
+
+	// a new runner makes room for the pending devices on the next discovery
+	runners = 3
+	l.promotePendingDevices()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, scheduledIPs(l))
+}
+
+func TestClusterCheckWeightHint(t *testing.T) {
+	l, subnet, newSvc, delSvc := newCappedListener(t, snmp.ListenerConfig{
+		ProfileOIDCounts: []snmp.ProfileOIDCount{{SysObjectID: "1.3.6.1.4.1.9.*", OIDCount: 600}},
+	})
+	l.clusterChecks = true
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	ciscoID := subnet.config.Digest("10.0.0.1")
+	subnet.sysObjectIDs[ciscoID] = "1.3.6.1.4.1.9.1.1745"
+	answerDiscovery(l, subnet, "10.0.0.1")
+	answerDiscovery(l, subnet, "10.0.0.2")
+	require.Len(t, newSvc, 2)
+	weights := map[string]int{}
+	for len(newSvc) > 0 {
+		svc := (<-newSvc).(*SNMPService)
+		assert.True(t, svc.IsClusterCheck())
+		weights[svc.deviceIP] = svc.GetWeightHint()
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 600, "10.0.0.2": 0}, weights)
+
+	// a device answering again keeps its check, unless its weight hint changed
+	answerDiscovery(l, subnet, "10.0.0.1")
+	assert.Len(t, newSvc, 0)
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.2")] = "1.3.6.1.4.1.9.1.1746"
+	answerDiscovery(l, subnet, "10.0.0.2")
+	require.Len(t, delSvc, 1)
+	require.Len(t, newSvc, 1)
+	<-delSvc
+	assert.Equal(t, 600, (<-newSvc).(*SNMPService).GetWeightHint())
+
+	// the eviction of a device unschedules its cluster check
+	l.deleteService(ciscoID, subnet)
+	require.Len(t, delSvc, 1)
+	assert.Equal(t, "10.0.0.1", (<-delSvc).(*SNMPService).deviceIP)
+}
+
+func TestClusterCheckWeightHintFromProfiles(t *testing.T) {
+	l, subnet, newSvc, _ := newCappedListener(t, snmp.ListenerConfig{
+		ProfileOIDCounts: []snmp.ProfileOIDCount{{SysObjectID: "1.3.6.1.4.1.9.1.1745", OIDCount: 600}},
+	})
+	l.clusterChecks = true
+	defer discoveryInventory.deleteSubnet(subnet)
+	defer func(f func(string) (int, error)) { profileOIDCount = f }(profileOIDCount)
+	profileOIDCount = func(sysObjectID string) (int, error) {
+		if strings.HasPrefix(sysObjectID, "1.3.6.1.4.1.9.") {
+			return 250, nil
+		}
+		return 0, errors.New("no profile")
+	}
+
+	// the OID counts of the config override the ones of the profile definitions
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.1")] = "1.3.6.1.4.1.9.1.1745"
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.2")] = "1.3.6.1.4.1.9.1.1746"
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.3")] = "1.3.6.1.4.1.2636.1.1.1.2.21"
+	for _, deviceIP := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		answerDiscovery(l, subnet, deviceIP)
+	}
+	require.Len(t, newSvc, 3)
+	weights := map[string]int{}
+	for len(newSvc) > 0 {
+		svc := (<-newSvc).(*SNMPService)
+		weights[svc.deviceIP] = svc.GetWeightHint()
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1": 600, "10.0.0.2": 250, "10.0.0.3": 0}, weights)
+}
+
+func TestNodeAgentDevicesWithoutWeightHint(t *testing.T) {
+	l, subnet, newSvc, _ := newCappedListener(t, snmp.ListenerConfig{
+		ProfileOIDCounts: []snmp.ProfileOIDCount{{SysObjectID: "1.3.6.1.4.1.9.*", OIDCount: 600}},
+	})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	subnet.sysObjectIDs[subnet.config.Digest("10.0.0.1")] = "1.3.6.1.4.1.9.1.1745"
+	answerDiscovery(l, subnet, "10.0.0.1")
+	require.Len(t, newSvc, 1)
+	svc := (<-newSvc).(*SNMPService)
+	assert.False(t, svc.IsClusterCheck())
+	assert.Equal(t, 0, svc.GetWeightHint())
+}
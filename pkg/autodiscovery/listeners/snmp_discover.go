@@ -0,0 +1,178 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+)
+
+// SNMPDiscoveredDevice is a device answering a dry-run discovery of the SNMP listener
+type SNMPDiscoveredDevice struct {
+	IP           string `json:"ip"`
+	Subnet       string `json:"subnet"`
+	Credential   string `json:"credential"`
+	SysObjectID  string `json:"sys_object_id"`
+	SysName      string `json:"sys_name,omitempty"`
+	ADIdentifier string `json:"ad_identifier"`
+	Loader       string `json:"loader,omitempty"`
+	// LatencyMs is the round-trip latency in milliseconds of the probe answered, only set when the device
+	// latency is enabled
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	// Service is the service the listener would create for the device
+	Service Service `json:"-"`
+}
+
+// DiscoverSNMPDevices runs a single synchronous sweep of the subnets of the listener configuration,
+// or of the given subnet only with the credentials of the configurations covering it, and returns
+// the devices answering. Nothing is scheduled and the device cache isn't written. The ignored IP
+// addresses, the number of workers and the device latency of the listener apply.
+func DiscoverSNMPDevices(ctx context.Context, listenerConfig snmp.ListenerConfig, subnetFilter string) ([]SNMPDiscoveredDevice, error) {
+	var filter *net.IPNet
+	if subnetFilter != "" {
+		_, ipNet, err := net.ParseCIDR(subnetFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", subnetFilter, err)
+		}
+		filter = ipNet
+	}
+
+	var subnets []*snmpSubnet
+	for _, config := range listenerConfig.Configs {
+		for _, network := range config.NewSubnetSource().Networks(ctx) {
+			subnet, err := newSNMPSubnet(config, network)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse SNMP network: %v", err)
+			}
+			if filter != nil {
+				if !subnetContains(subnet.network, *filter) {
+					continue
+				}
+				// only the requested subnet is swept, with the settings of the configuration
+				subnet.startingIP = filter.IP
+				subnet.network = *filter
+			}
+			subnets = append(subnets, subnet)
+		}
+	}
+	if len(subnets) == 0 {
+		if filter != nil {
+			return nil, fmt.Errorf("no snmp_listener configuration covers the subnet %s", subnetFilter)
+		}
+		return nil, fmt.Errorf("no snmp_listener configuration found")
+	}
+
+	workers := listenerConfig.Workers
+	if workers == 0 {
+		workers = defaultWorkers
+	}
+	snmpSessions.Resize(workers)
+
+	var (
+		lock    sync.Mutex
+		devices []SNMPDiscoveredDevice
+		wg      sync.WaitGroup
+	)
+	jobs := make(chan snmpJob)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if device, ok := discoverDevice(job, listenerConfig.DeviceLatency); ok {
+					lock.Lock()
+					devices = append(devices, device)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+sweep:
+	for _, subnet := range subnets {
+		startingIP := make(net.IP, len(subnet.startingIP))
+		copy(startingIP, subnet.startingIP)
+		for currentIP := startingIP; subnet.network.Contains(currentIP); incrementIP(currentIP) {
+			if subnet.config.IsIPIgnored(currentIP) {
+				continue
+			}
+			jobIP := make(net.IP, len(currentIP))
+			copy(jobIP, currentIP)
+			select {
+			case jobs <- snmpJob{subnet: subnet, currentIP: jobIP}:
+			case <-ctx.Done():
+				break sweep
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(devices, func(i, j int) bool {
+		ipI, ipJ := net.ParseIP(devices[i].IP), net.ParseIP(devices[j].IP)
+		if c := bytes.Compare(ipI.To16(), ipJ.To16()); c != 0 {
+			return c < 0
+		}
+		return devices[i].Subnet < devices[j].Subnet
+	})
+	return devices, ctx.Err()
+}
+
+// discoverDevice queries a device of a dry-run discovery, keeping the latency of its probe when withLatency is set
+func discoverDevice(job snmpJob, withLatency bool) (SNMPDiscoveredDevice, bool) {
+	deviceIP := job.currentIP.String()
+	info, err := queryDeviceInfo(job.subnet.config, deviceIP, orderProbeOIDs(job.subnet.config.DiscoveryProbeOIDs, ""))
+	if err != nil {
+		return SNMPDiscoveredDevice{}, false
+	}
+	device := SNMPDiscoveredDevice{
+		IP:           deviceIP,
+		Subnet:       job.subnet.config.Network,
+		Credential:   describeCredential(job.subnet.config),
+		SysObjectID:  info.sysObjectID,
+		SysName:      info.sysName,
+		ADIdentifier: job.subnet.adIdentifier,
+		Loader:       job.subnet.config.Loader,
+		Service: &SNMPService{
+			adIdentifier: job.subnet.adIdentifier,
+			entityID:     job.subnet.config.Digest(deviceIP),
+			deviceIP:     deviceIP,
+			creationTime: integration.Before,
+			config:       job.subnet.config,
+			sysName:      info.sysName,
+		},
+	}
+	if withLatency {
+		device.LatencyMs = durationMillis(info.latency)
+	}
+	return device, true
+}
+
+// describeCredential describes the credential of a configuration without revealing its secrets
+func describeCredential(config snmp.Config) string {
+	if config.User != "" {
+		return fmt.Sprintf("v3 user %s", config.User)
+	}
+	version := config.Version
+	if version == "" {
+		version = "2c"
+	}
+	return fmt.Sprintf("v%s community", version)
+}
+
+// subnetContains returns whether the network contains the whole subnet
+func subnetContains(network net.IPNet, subnet net.IPNet) bool {
+	networkOnes, networkBits := network.Mask.Size()
+	subnetOnes, subnetBits := subnet.Mask.Size()
+	return networkBits == subnetBits && subnetOnes >= networkOnes && network.Contains(subnet.IP)
+}
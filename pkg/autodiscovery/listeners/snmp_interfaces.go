@@ -0,0 +1,90 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"fmt"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// ifNumberOid is the number of network interfaces of a device, from IF-MIB
+	ifNumberOid = "1.3.6.1.2.1.2.1.0"
+
+	interfaceCountTag = "interface_count"
+)
+
+// interfaceCountBuckets are the lower bounds of the interface_count tag values, after the 0 one
+var interfaceCountBuckets = []int{100, 500, 1000, 5000}
+
+var snmpAdjustedIntervals = telemetry.NewCounterWithOpts("snmp_listener", "adjusted_collection_intervals",
+	[]string{"subnet"}, "Number of SNMP devices given a longer min collection interval for their interface count",
+	telemetry.Options{NoDoubleUnderscoreSep: true})
+
+// queryInterfaceCount gets the ifNumber of a device, 0 when it doesn't answer it. It is a GET of its
+// own, not to lose the discovery of the devices which don't implement IF-MIB.
+func queryInterfaceCount(session *snmp.PooledSession, deviceIP string) int {
+	value, err := session.Get([]string{ifNumberOid})
+	if err != nil {
+		log.Debugf("SNMP get of %s to %s: %v", ifNumberOid, deviceIP, err)
+		return 0
+	}
+	if len(value.Variables) < 1 || !hasValue(value.Variables[0]) {
+		log.Debugf("SNMP get of %s to %s: no data", ifNumberOid, deviceIP)
+		return 0
+	}
+	switch value.Variables[0].Type {
+	case gosnmp.Integer, gosnmp.Gauge32, gosnmp.Counter32, gosnmp.Uinteger32:
+		return int(gosnmp.ToBigInt(value.Variables[0].Value).Int64())
+	}
+	log.Debugf("SNMP get of %s to %s: unexpected type %v", ifNumberOid, deviceIP, value.Variables[0].Type)
+	return 0
+}
+
+// recordInterfaceCount records the interface count of a device discovered, a device whose interface count
+// is unknown keeps the last one known. It returns the min collection interval suggested for the device
+// when it changed, 0 otherwise. The caller must hold the lock.
+func recordInterfaceCount(subnet *snmpSubnet, entityID string, count int) uint {
+	if count <= 0 {
+		return 0
+	}
+	if subnet.interfaceCounts == nil {
+		subnet.interfaceCounts = map[string]int{}
+	}
+	previous := subnet.config.SuggestedCollectionInterval(subnet.interfaceCounts[entityID])
+	subnet.interfaceCounts[entityID] = count
+	if interval := subnet.config.SuggestedCollectionInterval(count); interval != previous {
+		return interval
+	}
+	return 0
+}
+
+// interfaceCountBucket returns the value of the interface_count tag of a device, a range of
+// interface counts keeping the cardinality of the tag low
+func interfaceCountBucket(count int) string {
+	lower := 0
+	for _, upper := range interfaceCountBuckets {
+		if count < upper {
+			return fmt.Sprintf("%d-%d", lower, upper-1)
+		}
+		lower = upper
+	}
+	return fmt.Sprintf("%d+", lower)
+}
+
+// minCollectionInterval returns the min collection interval of the check of the device, the one
+// suggested for its interface count unless the config sets one
+func (s *SNMPService) minCollectionInterval() uint {
+	if interval := s.config.SuggestedCollectionInterval(s.interfaceCount); interval != 0 {
+		return interval
+	}
+	return s.config.MinCollectionInterval
+}
@@ -0,0 +1,155 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterfaceCountBucket(t *testing.T) {
+	for count, bucket := range map[int]string{
+		1:      "0-99",
+		99:     "0-99",
+		100:    "100-499",
+		499:    "100-499",
+		500:    "500-999",
+		1000:   "1000-4999",
+		4999:   "1000-4999",
+		5000:   "5000+",
+		100000: "5000+",
+	} {
+		assert.Equal(t, bucket, interfaceCountBucket(count), count)
+	}
+}
+
+func TestQueryDeviceInfoInterfaceCount(t *testing.T) {
+	port, asked := startFakeSNMPAgent(t, map[string]gosnmp.SnmpPDU{
+		sysObjectIDOid: {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1745"},
+		ifNumberOid:    {Type: gosnmp.Integer, Value: 2400},
+	})
+	config := snmp.Config{
+		Port:      port,
+		Version:   "2",
+		Community: "public",
+		Timeout:   1,
+	}
+
+	// ifNumber is only read when the collection interval is suggested from it
+	info, err := queryDeviceInfo(config, "127.0.0.1", orderProbeOIDs(nil, ""))
+	require.NoError(t, err)
+	assert.Equal(t, 0, info.interfaceCount)
+	assert.Equal(t, []string{sysObjectIDOid}, asked())
+
+	config.InterfaceCountThreshold = 1000
+	info, err = queryDeviceInfo(config, "127.0.0.1", orderProbeOIDs(nil, ""))
+	require.NoError(t, err)
+	assert.Equal(t, 2400, info.interfaceCount)
+	assert.Equal(t, []string{sysObjectIDOid, ifNumberOid}, asked())
+
+	// a device without ifNumber is discovered all the same
+	port, _ = startFakeSNMPAgent(t, map[string]gosnmp.SnmpPDU{
+		sysObjectIDOid: {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1745"},
+	})
+	config.Port = port
+	info, err = queryDeviceInfo(config, "127.0.0.1", orderProbeOIDs(nil, ""))
+	require.NoError(t, err)
+	assert.Equal(t, snmpDeviceInfo{sysObjectID: ".1.3.6.1.4.1.9.1.1745", probeOID: sysObjectIDOid}, info)
+}
+
+func TestInterfaceCountCollectionInterval(t *testing.T) {
+	defer func(original func(snmp.Config, string, []string) (snmpDeviceInfo, error)) { queryDeviceInfo = original }(queryDeviceInfo)
+	interfaceCount := 0
+	queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+		return snmpDeviceInfo{probeOID: sysObjectIDOid, interfaceCount: interfaceCount}, nil
+	}
+
+	for _, test := range []struct {
+		name           string
+		config         snmp.Config
+		interfaceCount int
+		interval       string
+		tags           string
+	}{
+		{
+			name:           "at the threshold",
+			config:         snmp.Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1},
+			interfaceCount: 1000,
+			interval:       "0",
+			tags:           "interface_count:1000-4999",
+		},
+		{
+			name:           "over the threshold",
+			config:         snmp.Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1},
+			interfaceCount: 2400,
+			interval:       "36",
+			tags:           "interface_count:1000-4999",
+		},
+		{
+			name:           "explicit interval",
+			config:         snmp.Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1, MinCollectionInterval: 20},
+			interfaceCount: 2400,
+			interval:       "20",
+			tags:           "interface_count:1000-4999",
+		},
+		{
+			name:           "unknown interface count",
+			config:         snmp.Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1},
+			interfaceCount: 0,
+			interval:       "0",
+			tags:           "",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			newSvc := make(chan Service, 10)
+			delSvc := make(chan Service, 10)
+			test.config.Network = "10.0.0.0/30"
+			test.config.Community = "public"
+			subnet, err := newSNMPSubnet(test.config, test.config.Network)
+			require.NoError(t, err)
+			l := &SNMPListener{
+				services:   map[string]Service{},
+				newService: newSvc,
+				delService: delSvc,
+			}
+
+			interfaceCount = test.interfaceCount
+			require.True(t, l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP("10.0.0.1")}))
+			require.Len(t, newSvc, 1)
+			svc := <-newSvc
+			interval, err := svc.GetExtraConfig([]byte("min_collection_interval"))
+			require.NoError(t, err)
+			assert.Equal(t, test.interval, string(interval))
+			tags, err := svc.GetExtraConfig([]byte("tags"))
+			require.NoError(t, err)
+			assert.Equal(t, test.tags, string(tags))
+
+			// the interface count is kept when it can't be read again, the device isn't rescheduled
+			interfaceCount = 0
+			require.True(t, l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP("10.0.0.1")}))
+			assert.Len(t, newSvc, 0)
+			assert.Len(t, delSvc, 0)
+		})
+	}
+}
+
+func TestRecordInterfaceCount(t *testing.T) {
+	subnet := &snmpSubnet{config: snmp.Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1}}
+
+	assert.Equal(t, uint(0), recordInterfaceCount(subnet, "id", 1000))
+	// the device is counted once when it gets an adjusted interval, and again when it changes
+	assert.Equal(t, uint(16), recordInterfaceCount(subnet, "id", 1001))
+	assert.Equal(t, uint(0), recordInterfaceCount(subnet, "id", 1001))
+	assert.Equal(t, uint(0), recordInterfaceCount(subnet, "id", 0))
+	assert.Equal(t, uint(30), recordInterfaceCount(subnet, "id", 2000))
+	assert.Equal(t, 2000, subnet.interfaceCounts["id"])
+}
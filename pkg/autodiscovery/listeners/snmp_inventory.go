@@ -0,0 +1,339 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SNMPDeviceStatus describes a device found by the SNMP discovery
+type SNMPDeviceStatus struct {
+	IP      string `json:"ip"`
+	SysName string `json:"sys_name,omitempty"`
+	// ConsecutiveFailures is the number of discovery attempts which failed since the device last answered
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// LastSuccessfulPoll is the unix time of the last answer, zero for devices loaded from the cache which didn't answer yet
+	LastSuccessfulPoll int64 `json:"last_successful_poll,omitempty"`
+	// LatencyMs is the round-trip latency in milliseconds of the last discovery probe answered, only kept for
+	// the scheduled devices when the device latency is enabled
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
+
+// SNMPProbeLatencyStatus describes the round-trip latency of the discovery probes of the sweeps of a subnet
+type SNMPProbeLatencyStatus struct {
+	AnsweredProbes uint64  `json:"answered_probes"`
+	TimedOutProbes uint64  `json:"timed_out_probes"`
+	TimeoutRatio   float64 `json:"timeout_ratio"`
+	// P50Ms, P95Ms and P99Ms are estimated from the fixed buckets of the latency histogram, zero until a
+	// probe is answered
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	// ConfiguredTimeout is the timeout in seconds of the probes of the subnet
+	ConfiguredTimeout int `json:"configured_timeout"`
+	// SuggestedTimeout is the p99 latency plus a margin, in seconds, zero until a probe is answered
+	SuggestedTimeout int `json:"suggested_timeout,omitempty"`
+}
+
+// SNMPSubnetStatus describes the discovery state of a subnet
+type SNMPSubnetStatus struct {
+	Network      string `json:"network"`
+	ADIdentifier string `json:"ad_identifier"`
+	Loader       string `json:"loader,omitempty"`
+	// Removed is true when the subnet source no longer provides the subnet, its devices are being evicted
+	Removed bool `json:"removed,omitempty"`
+
+	Scanning        bool    `json:"scanning"`
+	ScannedIPs      uint64  `json:"scanned_ips"`
+	TotalIPs        uint64  `json:"total_ips"`
+	ProgressPercent float64 `json:"progress_percent"`
+	// LastSweepStart and LastSweepEnd are unix times, zero until the first sweep starts or ends
+	LastSweepStart int64 `json:"last_sweep_start,omitempty"`
+	LastSweepEnd   int64 `json:"last_sweep_end,omitempty"`
+
+	// Devices are the devices currently scheduled
+	Devices []SNMPDeviceStatus `json:"devices"`
+	// FailingDevices are the scheduled devices which didn't answer the last discovery attempts,
+	// they are unscheduled after the allowed failures
+	FailingDevices []SNMPDeviceStatus `json:"failing_devices"`
+	// PendingDevices are the devices which answered but aren't scheduled, the max devices per agent
+	// being reached, they are scheduled when scheduled devices are evicted
+	PendingDevices []SNMPDeviceStatus `json:"pending_devices"`
+
+	// ProbeLatency describes the discovery probes of the sweeps, nil until a probe is answered or times out
+	ProbeLatency *SNMPProbeLatencyStatus `json:"probe_latency,omitempty"`
+}
+
+type snmpSubnetInventory struct {
+	status  SNMPSubnetStatus
+	devices map[string]*SNMPDeviceStatus
+	pending map[string]*SNMPDeviceStatus
+	// latency counts the discovery probes of the sweeps since the subnet is discovered
+	latency snmpLatencyHistogram
+	// timeout is the timeout in seconds of the probes of the subnet
+	timeout int
+}
+
+// snmpInventory keeps the state of the SNMP discovery for the agent status and flare.
+// The discovery loop and workers update it as they go, it has its own lock so that
+// reading it never blocks the discovery.
+type snmpInventory struct {
+	sync.RWMutex
+	// subnets are indexed by the cache key of the subnet, unique per config and network
+	subnets map[string]*snmpSubnetInventory
+}
+
+// discoveryInventory is the inventory of the SNMP listener
+var discoveryInventory = newSNMPInventory()
+
+func newSNMPInventory() *snmpInventory {
+	return &snmpInventory{subnets: map[string]*snmpSubnetInventory{}}
+}
+
+// getSubnet returns the inventory of a subnet, creating it if needed. The caller must hold the lock.
+func (i *snmpInventory) getSubnet(subnet *snmpSubnet) *snmpSubnetInventory {
+	inventory, found := i.subnets[subnet.cacheKey]
+	if !found {
+		inventory = &snmpSubnetInventory{
+			status: SNMPSubnetStatus{
+				Network:      subnet.network.String(),
+				ADIdentifier: subnet.adIdentifier,
+				Loader:       subnet.config.Loader,
+			},
+			devices: map[string]*SNMPDeviceStatus{},
+			pending: map[string]*SNMPDeviceStatus{},
+			timeout: subnet.config.Timeout,
+		}
+		i.subnets[subnet.cacheKey] = inventory
+	}
+	return inventory
+}
+
+func (i *snmpInventory) addSubnet(subnet *snmpSubnet) {
+	i.Lock()
+	defer i.Unlock()
+	i.getSubnet(subnet).status.Removed = false
+}
+
+func (i *snmpInventory) markSubnetRemoved(subnet *snmpSubnet) {
+	i.Lock()
+	defer i.Unlock()
+	i.getSubnet(subnet).status.Removed = true
+}
+
+func (i *snmpInventory) deleteSubnet(subnet *snmpSubnet) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.subnets, subnet.cacheKey)
+	for _, quantile := range snmpLatencyQuantiles {
+		snmpProbeLatencyQuantiles.Delete(subnet.config.Network, quantile.label)
+	}
+	snmpProbeTimeoutRatio.Delete(subnet.config.Network)
+}
+
+func (i *snmpInventory) startSweep(subnet *snmpSubnet, now time.Time) {
+	i.Lock()
+	defer i.Unlock()
+	status := &i.getSubnet(subnet).status
+	status.Scanning = true
+	status.ScannedIPs = 0
+	status.TotalIPs = subnetSize(subnet.network)
+	status.LastSweepStart = now.Unix()
+}
+
+func (i *snmpInventory) advanceSweep(subnet *snmpSubnet) {
+	i.Lock()
+	defer i.Unlock()
+	i.getSubnet(subnet).status.ScannedIPs++
+}
+
+// pauseSweep records a sweep stopped before its end, the end of the previous sweep being kept
+func (i *snmpInventory) pauseSweep(subnet *snmpSubnet) {
+	i.Lock()
+	defer i.Unlock()
+	i.getSubnet(subnet).status.Scanning = false
+}
+
+func (i *snmpInventory) endSweep(subnet *snmpSubnet, now time.Time) {
+	i.Lock()
+	defer i.Unlock()
+	inventory := i.getSubnet(subnet)
+	inventory.status.Scanning = false
+	inventory.status.LastSweepEnd = now.Unix()
+
+	if inventory.latency.answered+inventory.latency.timeouts == 0 {
+		return
+	}
+	for _, quantile := range snmpLatencyQuantiles {
+		snmpProbeLatencyQuantiles.Set(inventory.latency.quantile(quantile.q).Seconds(), subnet.config.Network, quantile.label)
+	}
+	snmpProbeTimeoutRatio.Set(inventory.latency.timeoutRatio(), subnet.config.Network)
+}
+
+// probeAnswered records the round-trip latency of a discovery probe answered by a device during a sweep.
+// The latency of the device is kept as well when retainDevice is set and the device is scheduled, so
+// that no more latencies than the max devices are kept.
+func (i *snmpInventory) probeAnswered(subnet *snmpSubnet, deviceIP string, latency time.Duration, retainDevice bool) {
+	snmpProbeLatency.Observe(latency.Seconds(), subnet.config.Network)
+	i.Lock()
+	defer i.Unlock()
+	inventory := i.getSubnet(subnet)
+	inventory.latency.observe(latency)
+	if !retainDevice {
+		return
+	}
+	if device, found := inventory.devices[deviceIP]; found {
+		device.LatencyMs = durationMillis(latency)
+	}
+}
+
+// probeTimedOut records a discovery probe of a sweep which timed out
+func (i *snmpInventory) probeTimedOut(subnet *snmpSubnet) {
+	snmpProbeTimeouts.Inc(subnet.config.Network)
+	i.Lock()
+	defer i.Unlock()
+	i.getSubnet(subnet).latency.observeTimeout()
+}
+
+// deviceUp records a device answering the discovery, or loaded from the cache when polled is false
+func (i *snmpInventory) deviceUp(subnet *snmpSubnet, deviceIP string, sysName string, polled bool, now time.Time) {
+	i.Lock()
+	defer i.Unlock()
+	devices := i.getSubnet(subnet).devices
+	device, found := devices[deviceIP]
+	if !found {
+		device = &SNMPDeviceStatus{IP: deviceIP}
+		devices[deviceIP] = device
+	}
+	if sysName != "" {
+		device.SysName = sysName
+	}
+	if polled {
+		device.ConsecutiveFailures = 0
+		device.LastSuccessfulPoll = now.Unix()
+	}
+}
+
+func (i *snmpInventory) deviceFailed(subnet *snmpSubnet, deviceIP string, failures int) {
+	i.Lock()
+	defer i.Unlock()
+	if device, found := i.getSubnet(subnet).devices[deviceIP]; found {
+		device.ConsecutiveFailures = failures
+	}
+}
+
+func (i *snmpInventory) deviceRemoved(subnet *snmpSubnet, deviceIP string) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.getSubnet(subnet).devices, deviceIP)
+}
+
+// devicePending records a device which answered the discovery but isn't scheduled
+func (i *snmpInventory) devicePending(subnet *snmpSubnet, deviceIP string, sysName string, now time.Time) {
+	i.Lock()
+	defer i.Unlock()
+	pending := i.getSubnet(subnet).pending
+	device, found := pending[deviceIP]
+	if !found {
+		device = &SNMPDeviceStatus{IP: deviceIP}
+		pending[deviceIP] = device
+	}
+	if sysName != "" {
+		device.SysName = sysName
+	}
+	device.LastSuccessfulPoll = now.Unix()
+}
+
+func (i *snmpInventory) pendingDeviceRemoved(subnet *snmpSubnet, deviceIP string) {
+	i.Lock()
+	defer i.Unlock()
+	if inventory, found := i.subnets[subnet.cacheKey]; found {
+		delete(inventory.pending, deviceIP)
+	}
+}
+
+// status returns a snapshot of the inventory, sorted by network and device IP
+func (i *snmpInventory) status() []SNMPSubnetStatus {
+	i.RLock()
+	defer i.RUnlock()
+	subnets := make([]SNMPSubnetStatus, 0, len(i.subnets))
+	for _, inventory := range i.subnets {
+		status := inventory.status
+		if status.TotalIPs > 0 {
+			status.ProgressPercent = 100 * float64(status.ScannedIPs) / float64(status.TotalIPs)
+		}
+		status.Devices = make([]SNMPDeviceStatus, 0, len(inventory.devices))
+		status.FailingDevices = []SNMPDeviceStatus{}
+		for _, device := range inventory.devices {
+			status.Devices = append(status.Devices, *device)
+			if device.ConsecutiveFailures > 0 {
+				status.FailingDevices = append(status.FailingDevices, *device)
+			}
+		}
+		status.PendingDevices = make([]SNMPDeviceStatus, 0, len(inventory.pending))
+		for _, device := range inventory.pending {
+			status.PendingDevices = append(status.PendingDevices, *device)
+		}
+		sortDeviceStatuses(status.Devices)
+		sortDeviceStatuses(status.FailingDevices)
+		sortDeviceStatuses(status.PendingDevices)
+		status.ProbeLatency = inventory.latencyStatus()
+		subnets = append(subnets, status)
+	}
+	sort.Slice(subnets, func(a, b int) bool {
+		if subnets[a].Network != subnets[b].Network {
+			return subnets[a].Network < subnets[b].Network
+		}
+		return subnets[a].ADIdentifier < subnets[b].ADIdentifier
+	})
+	return subnets
+}
+
+// latencyStatus returns the status of the latency of the probes of the subnet, nil until a probe is
+// answered or times out. The caller must hold the lock.
+func (s *snmpSubnetInventory) latencyStatus() *SNMPProbeLatencyStatus {
+	if s.latency.answered+s.latency.timeouts == 0 {
+		return nil
+	}
+	p99 := s.latency.quantile(0.99)
+	return &SNMPProbeLatencyStatus{
+		AnsweredProbes:    s.latency.answered,
+		TimedOutProbes:    s.latency.timeouts,
+		TimeoutRatio:      s.latency.timeoutRatio(),
+		P50Ms:             durationMillis(s.latency.quantile(0.5)),
+		P95Ms:             durationMillis(s.latency.quantile(0.95)),
+		P99Ms:             durationMillis(p99),
+		ConfiguredTimeout: s.timeout,
+		SuggestedTimeout:  suggestedTimeout(p99),
+	}
+}
+
+func sortDeviceStatuses(devices []SNMPDeviceStatus) {
+	sort.Slice(devices, func(a, b int) bool {
+		ipA, ipB := net.ParseIP(devices[a].IP), net.ParseIP(devices[b].IP)
+		if ipA == nil || ipB == nil {
+			return devices[a].IP < devices[b].IP
+		}
+		return string(ipA.To16()) < string(ipB.To16())
+	})
+}
+
+// subnetSize returns the number of IPs of a network, capped for large IPv6 networks
+func subnetSize(network net.IPNet) uint64 {
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 64 {
+		return ^uint64(0)
+	}
+	return uint64(1) << uint(bits-ones)
+}
+
+// GetSNMPDiscoveryStatus returns the state of the SNMP discovery of each subnet, for the agent status and flare
+func GetSNMPDiscoveryStatus() []SNMPSubnetStatus {
+	return discoveryInventory.status()
+}
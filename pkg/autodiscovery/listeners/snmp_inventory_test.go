@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findSubnetStatus(t *testing.T, network string) SNMPSubnetStatus {
+	for _, status := range GetSNMPDiscoveryStatus() {
+		if status.Network == network {
+			return status
+		}
+	}
+	require.Failf(t, "subnet not found", "no status for subnet %s", network)
+	return SNMPSubnetStatus{}
+}
+
+func TestSNMPDiscoveryInventory(t *testing.T) {
+	discoveryInventory = newSNMPInventory()
+
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+		stop:       make(chan bool),
+		config:     snmp.ListenerConfig{AllowedFailures: 3},
+	}
+
+	subnet, err := newSNMPSubnet(snmp.Config{Community: "public", Loader: "core"}, "10.7.0.0/30")
+	require.NoError(t, err)
+	discoveryInventory.addSubnet(subnet)
+
+	// a device loaded from the cache, then answering a sweep
+	l.createService("id1", subnet, "10.7.0.2", "", false)
+	l.createService("id1", subnet, "10.7.0.2", "switch-2", true)
+	// a device answering once, then failing
+	l.createService("id2", subnet, "10.7.0.1", "router-1", true)
+	l.deleteService("id2", subnet)
+	l.deleteService("id2", subnet)
+
+	status := findSubnetStatus(t, "10.7.0.0/30")
+	assert.Equal(t, "snmp", status.ADIdentifier)
+	assert.Equal(t, "core", status.Loader)
+	require.Len(t, status.Devices, 2)
+	assert.Equal(t, "10.7.0.1", status.Devices[0].IP)
+	assert.Equal(t, "router-1", status.Devices[0].SysName)
+	assert.Equal(t, 2, status.Devices[0].ConsecutiveFailures)
+	assert.NotZero(t, status.Devices[0].LastSuccessfulPoll)
+	assert.Equal(t, "10.7.0.2", status.Devices[1].IP)
+	assert.Equal(t, "switch-2", status.Devices[1].SysName)
+	assert.Equal(t, 0, status.Devices[1].ConsecutiveFailures)
+	require.Len(t, status.FailingDevices, 1)
+	assert.Equal(t, "10.7.0.1", status.FailingDevices[0].IP)
+
+	// answering again resets the failures
+	l.createService("id2", subnet, "10.7.0.1", "router-1", true)
+	l.deleteService("id2", subnet)
+	l.deleteService("id2", subnet)
+	assert.Len(t, findSubnetStatus(t, "10.7.0.0/30").Devices, 2)
+
+	// the device is unscheduled after the allowed failures
+	l.deleteService("id2", subnet)
+	status = findSubnetStatus(t, "10.7.0.0/30")
+	require.Len(t, status.Devices, 1)
+	assert.Equal(t, "10.7.0.2", status.Devices[0].IP)
+	assert.Empty(t, status.FailingDevices)
+}
+
+func TestSNMPDiscoveryInventorySweep(t *testing.T) {
+	discoveryInventory = newSNMPInventory()
+
+	l := &SNMPListener{stop: make(chan bool)}
+	subnet, err := newSNMPSubnet(snmp.Config{Community: "public"}, "10.8.0.0/30")
+	require.NoError(t, err)
+
+	jobs := make(chan snmpJob)
+	done := make(chan bool)
+	go func() {
+		done <- l.scanSubnets([]*snmpSubnet{subnet}, jobs)
+	}()
+
+	<-jobs
+	<-jobs
+	// the scan blocks on sending the job of the third IP
+	require.Eventually(t, func() bool {
+		return findSubnetStatus(t, "10.8.0.0/30").ScannedIPs == 3
+	}, time.Second, 10*time.Millisecond)
+	status := findSubnetStatus(t, "10.8.0.0/30")
+	assert.True(t, status.Scanning)
+	assert.Equal(t, uint64(4), status.TotalIPs)
+	assert.Equal(t, float64(75), status.ProgressPercent)
+	assert.NotZero(t, status.LastSweepStart)
+	assert.Zero(t, status.LastSweepEnd)
+
+	<-jobs
+	<-jobs
+	assert.True(t, <-done)
+	status = findSubnetStatus(t, "10.8.0.0/30")
+	assert.False(t, status.Scanning)
+	assert.Equal(t, float64(100), status.ProgressPercent)
+	assert.NotZero(t, status.LastSweepEnd)
+}
+
+func TestSNMPDiscoveryStatusJSON(t *testing.T) {
+	discoveryInventory = newSNMPInventory()
+
+	_, network, _ := net.ParseCIDR("10.9.0.0/30")
+	subnet := &snmpSubnet{adIdentifier: "snmp", network: *network, cacheKey: "snmp:test"}
+	discoveryInventory.deviceUp(subnet, "10.9.0.1", "", false, time.Now())
+
+	data, err := json.Marshal(GetSNMPDiscoveryStatus())
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{
+		"network": "10.9.0.0/30",
+		"ad_identifier": "snmp",
+		"scanning": false,
+		"scanned_ips": 0,
+		"total_ips": 0,
+		"progress_percent": 0,
+		"devices": [{"ip": "10.9.0.1", "consecutive_failures": 0}],
+		"failing_devices": []
+	}]`, string(data))
+}
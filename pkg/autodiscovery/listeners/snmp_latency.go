@@ -0,0 +1,176 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+)
+
+// snmpLatencyBuckets are the upper bounds of the buckets of the round-trip latency of the discovery probes
+var snmpLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// snmpLatencyQuantiles are the quantiles of the latency exposed in the telemetry and the status
+var snmpLatencyQuantiles = []struct {
+	label string
+	q     float64
+}{
+	{"0.5", 0.5},
+	{"0.95", 0.95},
+	{"0.99", 0.99},
+}
+
+const (
+	// minSuggestedTimeoutMargin is the margin added at least to the p99 latency for the suggested timeout,
+	// half of the p99 latency being added when it is larger
+	minSuggestedTimeoutMargin = 250 * time.Millisecond
+	// minSuggestedTimeout is the suggested timeout when the devices answer faster, in seconds
+	minSuggestedTimeout = 1
+)
+
+var (
+	snmpProbeLatency = telemetry.NewHistogramWithOpts("snmp_listener", "discovery_probe_latency_seconds",
+		[]string{"subnet"}, "Round-trip latency of the SNMP discovery probes answered during the subnet sweeps",
+		snmpLatencyBucketSeconds(), telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpProbeTimeouts = telemetry.NewCounterWithOpts("snmp_listener", "discovery_probe_timeouts",
+		[]string{"subnet"}, "Number of SNMP discovery probes of the subnet sweeps which timed out",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpProbeLatencyQuantiles = telemetry.NewGaugeWithOpts("snmp_listener", "discovery_probe_latency_quantile_seconds",
+		[]string{"subnet", "quantile"}, "Estimated quantiles of the round-trip latency of the SNMP discovery probes answered, updated at the end of each subnet sweep",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpProbeTimeoutRatio = telemetry.NewGaugeWithOpts("snmp_listener", "discovery_probe_timeout_ratio",
+		[]string{"subnet"}, "Ratio of the SNMP discovery probes of the subnet sweeps which timed out, updated at the end of each subnet sweep",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+func snmpLatencyBucketSeconds() []float64 {
+	buckets := make([]float64, 0, len(snmpLatencyBuckets))
+	for _, bound := range snmpLatencyBuckets {
+		buckets = append(buckets, bound.Seconds())
+	}
+	return buckets
+}
+
+// snmpLatencyHistogram counts the discovery probes of the sweeps of a subnet, by round-trip latency
+// in the fixed snmpLatencyBuckets for the answered ones, so that its memory doesn't grow with the
+// number of probes
+type snmpLatencyHistogram struct {
+	// counts holds the number of probes answered by bucket, the last one counting the probes slower
+	// than the last bound. It is nil until a probe is answered.
+	counts   []uint64
+	answered uint64
+	timeouts uint64
+	// max is the highest latency observed, bounding the last bucket
+	max time.Duration
+}
+
+func (h *snmpLatencyHistogram) observe(latency time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(snmpLatencyBuckets)+1)
+	}
+	bucket := len(snmpLatencyBuckets)
+	for i, bound := range snmpLatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.counts[bucket]++
+	h.answered++
+	if latency > h.max {
+		h.max = latency
+	}
+}
+
+func (h *snmpLatencyHistogram) observeTimeout() {
+	h.timeouts++
+}
+
+// quantile estimates a quantile of the latency of the probes answered, interpolating linearly in
+// its bucket, 0 when no probe was answered
+func (h *snmpLatencyHistogram) quantile(q float64) time.Duration {
+	if h.answered == 0 {
+		return 0
+	}
+	rank := q * float64(h.answered)
+	var cumulated uint64
+	for i, count := range h.counts {
+		if count == 0 || float64(cumulated+count) < rank {
+			cumulated += count
+			continue
+		}
+		var lower, upper time.Duration
+		if i > 0 {
+			lower = snmpLatencyBuckets[i-1]
+		}
+		if i < len(snmpLatencyBuckets) && snmpLatencyBuckets[i] < h.max {
+			upper = snmpLatencyBuckets[i]
+		} else {
+			upper = h.max
+		}
+		position := (rank - float64(cumulated)) / float64(count)
+		return lower + time.Duration(position*float64(upper-lower))
+	}
+	return h.max
+}
+
+// timeoutRatio returns the ratio of the probes which timed out, 0 when there was no probe
+func (h *snmpLatencyHistogram) timeoutRatio() float64 {
+	if total := h.answered + h.timeouts; total > 0 {
+		return float64(h.timeouts) / float64(total)
+	}
+	return 0
+}
+
+// suggestedTimeout returns the timeout in seconds suggested for the devices of a subnet from the p99
+// latency of its probes plus a margin, 0 when no probe was answered
+func suggestedTimeout(p99 time.Duration) int {
+	if p99 <= 0 {
+		return 0
+	}
+	margin := p99 / 2
+	if margin < minSuggestedTimeoutMargin {
+		margin = minSuggestedTimeoutMargin
+	}
+	timeout := int(math.Ceil((p99 + margin).Seconds()))
+	if timeout < minSuggestedTimeout {
+		return minSuggestedTimeout
+	}
+	return timeout
+}
+
+// isProbeTimeout returns whether a discovery probe failed because the device didn't answer in time,
+// after the retries of the config
+func isProbeTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "request timeout")
+}
+
+// durationMillis returns a duration in milliseconds, for the status
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,182 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	var h snmpLatencyHistogram
+	assert.Zero(t, h.quantile(0.5))
+	assert.Zero(t, h.timeoutRatio())
+
+	// 90 probes answered in 10-25ms, 9 in 100-250ms and 1 in 4s
+	for i := 0; i < 90; i++ {
+		h.observe(20 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.observe(200 * time.Millisecond)
+	}
+	h.observe(4 * time.Second)
+	h.observeTimeout()
+	h.observeTimeout()
+
+	assert.Equal(t, uint64(100), h.answered)
+	assert.Equal(t, uint64(2), h.timeouts)
+	assert.InDelta(t, 2.0/102, h.timeoutRatio(), 1e-9)
+	// the quantiles are interpolated in their bucket, the last bucket being bounded by the max
+	assert.InDelta(t, float64(10*time.Millisecond)+float64(15*time.Millisecond)*50/90, float64(h.quantile(0.5)), 1)
+	assert.InDelta(t, float64(100*time.Millisecond)+float64(150*time.Millisecond)*5/9, float64(h.quantile(0.95)), 1)
+	assert.Equal(t, 250*time.Millisecond, h.quantile(0.99))
+	assert.Equal(t, 4*time.Second, h.quantile(1))
+
+	// the latencies over the last bucket are bounded by the max
+	var slow snmpLatencyHistogram
+	slow.observe(8 * time.Second)
+	assert.Equal(t, 6500*time.Millisecond, slow.quantile(0.5))
+	assert.Len(t, slow.counts, len(snmpLatencyBuckets)+1)
+}
+
+func TestSuggestedTimeout(t *testing.T) {
+	assert.Equal(t, 0, suggestedTimeout(0))
+	assert.Equal(t, 1, suggestedTimeout(20*time.Millisecond))
+	// the margin is at least 250ms
+	assert.Equal(t, 2, suggestedTimeout(800*time.Millisecond))
+	// half of the p99 latency otherwise
+	assert.Equal(t, 3, suggestedTimeout(1800*time.Millisecond))
+	assert.Equal(t, 8, suggestedTimeout(5*time.Second))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsProbeTimeout(t *testing.T) {
+	assert.False(t, isProbeTimeout(nil))
+	assert.False(t, isProbeTimeout(errors.New("no data")))
+	assert.True(t, isProbeTimeout(fmt.Errorf("get error: %v", errors.New("request timeout (after 3 retries)"))))
+	assert.True(t, isProbeTimeout(fmt.Errorf("read: %w", timeoutError{})))
+	var netErr net.Error = timeoutError{}
+	assert.True(t, isProbeTimeout(netErr))
+}
+
+func TestSweepProbeLatency(t *testing.T) {
+	discoveryInventory = newSNMPInventory()
+	defer func(original func(snmp.Config, string, []string) (snmpDeviceInfo, error)) { queryDeviceInfo = original }(queryDeviceInfo)
+	timedOut := map[string]bool{}
+	queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+		if timedOut[deviceIP] {
+			return snmpDeviceInfo{}, errors.New("get error: request timeout (after 3 retries)")
+		}
+		switch deviceIP {
+		case "10.0.0.1":
+			return snmpDeviceInfo{probeOID: sysObjectIDOid, latency: 20 * time.Millisecond}, nil
+		case "10.0.0.2":
+			return snmpDeviceInfo{probeOID: sysObjectIDOid, latency: 800 * time.Millisecond}, nil
+		case "10.0.0.3":
+			return snmpDeviceInfo{}, errors.New("no data")
+		}
+		return snmpDeviceInfo{}, errors.New("get error: request timeout (after 3 retries)")
+	}
+
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{MaxDevicesPerAgent: 1, DeviceLatency: true})
+	defer discoveryInventory.deleteSubnet(subnet)
+	subnet.config.Network = "10.0.0.0/24"
+	subnet.config.Timeout = 5
+	discoveryInventory.addSubnet(subnet)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP(ip)})
+	}
+	discoveryInventory.endSweep(subnet, time.Now())
+
+	status := findSubnetStatus(t, "10.0.0.0/24")
+	require.NotNil(t, status.ProbeLatency)
+	assert.Equal(t, uint64(2), status.ProbeLatency.AnsweredProbes)
+	// the devices answering without a value didn't time out, and the addresses which never
+	// answered aren't counted
+	assert.Zero(t, status.ProbeLatency.TimedOutProbes)
+	assert.Zero(t, status.ProbeLatency.TimeoutRatio)
+	assert.Equal(t, 5, status.ProbeLatency.ConfiguredTimeout)
+	assert.Greater(t, status.ProbeLatency.P99Ms, 500.0)
+	assert.LessOrEqual(t, status.ProbeLatency.P99Ms, 800.0)
+	assert.Equal(t, 2, status.ProbeLatency.SuggestedTimeout)
+
+	// the latency is only kept for the scheduled devices, the max devices bounding them
+	require.Len(t, status.Devices, 1)
+	assert.Equal(t, "10.0.0.1", status.Devices[0].IP)
+	assert.Equal(t, 20.0, status.Devices[0].LatencyMs)
+	require.Len(t, status.PendingDevices, 1)
+	assert.Zero(t, status.PendingDevices[0].LatencyMs)
+
+	// the timeouts of the devices which answered before are counted
+	timedOut["10.0.0.1"] = true
+	timedOut["10.0.0.2"] = true
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"} {
+		l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP(ip)})
+	}
+	discoveryInventory.endSweep(subnet, time.Now())
+
+	status = findSubnetStatus(t, "10.0.0.0/24")
+	require.NotNil(t, status.ProbeLatency)
+	assert.Equal(t, uint64(2), status.ProbeLatency.AnsweredProbes)
+	assert.Equal(t, uint64(2), status.ProbeLatency.TimedOutProbes)
+	assert.Equal(t, 0.5, status.ProbeLatency.TimeoutRatio)
+}
+
+func TestSweepProbeLatencyDeviceLatencyDisabled(t *testing.T) {
+	discoveryInventory = newSNMPInventory()
+	defer func(original func(snmp.Config, string, []string) (snmpDeviceInfo, error)) { queryDeviceInfo = original }(queryDeviceInfo)
+	queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+		return snmpDeviceInfo{probeOID: sysObjectIDOid, latency: 20 * time.Millisecond}, nil
+	}
+
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{})
+	defer discoveryInventory.deleteSubnet(subnet)
+	subnet.config.Network = "10.0.0.0/24"
+	l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP("10.0.0.1")})
+
+	status := findSubnetStatus(t, "10.0.0.0/24")
+	require.NotNil(t, status.ProbeLatency)
+	assert.Equal(t, uint64(1), status.ProbeLatency.AnsweredProbes)
+	require.Len(t, status.Devices, 1)
+	assert.Zero(t, status.Devices[0].LatencyMs)
+}
+
+func TestDiscoverSNMPDevicesLatency(t *testing.T) {
+	defer func(original func(snmp.Config, string, []string) (snmpDeviceInfo, error)) { queryDeviceInfo = original }(queryDeviceInfo)
+	queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+		if deviceIP == "10.0.0.1" {
+			return snmpDeviceInfo{probeOID: sysObjectIDOid, latency: 1500 * time.Microsecond}, nil
+		}
+		return snmpDeviceInfo{}, errors.New("timeout")
+	}
+
+	listenerConfig := snmp.ListenerConfig{Configs: []snmp.Config{{Network: "10.0.0.0/30", Community: "public"}}}
+	devices, err := DiscoverSNMPDevices(context.Background(), listenerConfig, "")
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Zero(t, devices[0].LatencyMs)
+
+	listenerConfig.DeviceLatency = true
+	devices, err = DiscoverSNMPDevices(context.Background(), listenerConfig, "")
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, 1.5, devices[0].LatencyMs)
+}
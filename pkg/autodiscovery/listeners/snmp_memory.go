@@ -0,0 +1,174 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+var (
+	snmpMemoryUsage = telemetry.NewGaugeWithOpts("snmp_listener", "memory_usage_bytes",
+		[]string{}, "Approximate memory used by the SNMP discovery, its device registry and its session pool, when a memory budget is set",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpMemoryConstrained = telemetry.NewGaugeWithOpts("snmp_listener", "memory_constrained",
+		[]string{}, "1 while the SNMP discovery is over its memory budget, its subnet sweeps being paused, 0 otherwise",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	snmpPausedSweeps = telemetry.NewCounterWithOpts("snmp_listener", "paused_sweeps",
+		[]string{"subnet"}, "Number of SNMP subnet sweeps skipped while the discovery is over its memory budget",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+// memoryCheckInterval is the number of IPs swept, or of devices visited by a neighbor walk, between two
+// checks of the memory budget
+const memoryCheckInterval = 64
+
+// The memory used by the discovery is approximated by the size of the structs it holds and the length
+// of their strings, the overhead of the maps and the strings shared between them aren't accounted for
+var (
+	stringHeaderSize          = int64(unsafe.Sizeof(""))
+	intSize                   = int64(unsafe.Sizeof(0))
+	boolSize                  = int64(unsafe.Sizeof(false))
+	ipHeaderSize              = int64(unsafe.Sizeof(net.IP{}))
+	pointerSize               = int64(unsafe.Sizeof(&snmpSubnet{}))
+	serviceStructSize         = int64(unsafe.Sizeof(SNMPService{}))
+	subnetStructSize          = int64(unsafe.Sizeof(snmpSubnet{}))
+	deviceStructSize          = int64(unsafe.Sizeof(snmpDevice{}))
+	deviceStatusStructSize    = int64(unsafe.Sizeof(SNMPDeviceStatus{}))
+	subnetInventoryStructSize = int64(unsafe.Sizeof(snmpSubnetInventory{}))
+)
+
+// stringSize returns the approximate memory used by a string
+func stringSize(s string) int64 {
+	return stringHeaderSize + int64(len(s))
+}
+
+// stringMapSize returns the approximate memory used by a map of strings by string
+func stringMapSize(m map[string]string) int64 {
+	var size int64
+	for key, value := range m {
+		size += stringSize(key) + stringSize(value)
+	}
+	return size
+}
+
+// ipsSize returns the approximate memory used by a slice of IPs
+func ipsSize(ips []net.IP) int64 {
+	size := int64(len(ips)) * ipHeaderSize
+	for _, ip := range ips {
+		size += int64(len(ip))
+	}
+	return size
+}
+
+// intMapSize returns the approximate memory used by a map of integers by string
+func intMapSize(m map[string]int) int64 {
+	var size int64
+	for key := range m {
+		size += stringSize(key) + intSize
+	}
+	return size
+}
+
+// memoryUsage returns the approximate memory used by the devices of a subnet
+func (s *snmpSubnet) memoryUsage() int64 {
+	return subnetStructSize + stringMapSize(s.devices) + intMapSize(s.deviceFailures) + stringMapSize(s.evictedDevices) +
+		stringMapSize(s.probeOIDs) + stringMapSize(s.sysObjectIDs) + intMapSize(s.interfaceCounts)
+}
+
+// memoryUsage returns the approximate memory used by the device statuses of the inventory
+func (i *snmpInventory) memoryUsage() int64 {
+	i.RLock()
+	defer i.RUnlock()
+	var size int64
+	for key, inventory := range i.subnets {
+		size += stringSize(key) + subnetInventoryStructSize + stringSize(inventory.status.Network) + stringSize(inventory.status.ADIdentifier) +
+			int64(len(inventory.latency.counts))*intSize
+		for _, devices := range []map[string]*SNMPDeviceStatus{inventory.devices, inventory.pending} {
+			for deviceIP, device := range devices {
+				size += stringSize(deviceIP) + pointerSize + deviceStatusStructSize + int64(len(device.IP)+len(device.SysName))
+			}
+		}
+	}
+	return size
+}
+
+// registryMemoryUsage returns the approximate memory used by the scheduled and pending devices and the
+// subnets of the active sources. The caller must hold the lock.
+func (l *SNMPListener) registryMemoryUsage() int64 {
+	var size int64
+	for entityID, svc := range l.services {
+		size += stringSize(entityID) + pointerSize
+		if snmpSvc, ok := svc.(*SNMPService); ok {
+			size += serviceStructSize + int64(len(snmpSvc.entityID)+len(snmpSvc.deviceIP)+len(snmpSvc.sysName))
+		}
+	}
+	for deviceIP, subnets := range l.devicesByIP {
+		size += stringSize(deviceIP)
+		for entityID := range subnets {
+			size += stringSize(entityID) + pointerSize
+		}
+	}
+	for entityID, device := range l.pendingDevices {
+		size += stringSize(entityID) + pointerSize + deviceStructSize + int64(len(device.entityID)+len(device.deviceIP)+len(device.sysName))
+	}
+	for entityID := range l.discoveryOrder {
+		size += stringSize(entityID) + intSize
+	}
+	for source := range l.activeSources {
+		for _, subnet := range source.deviceSubnets() {
+			size += subnet.memoryUsage()
+		}
+		for _, subnet := range source.removedSubnets {
+			size += subnet.memoryUsage()
+		}
+	}
+	return size
+}
+
+// memoryUsage returns the approximate memory used by the discovery: its device registry, the queue of
+// its neighbor walk, its inventory and its session pool. The caller must hold the lock.
+func (l *SNMPListener) memoryUsage() int64 {
+	return l.registryMemoryUsage() + l.scanQueueMemory + discoveryInventory.memoryUsage() + snmpSessions.MemoryUsage()
+}
+
+// setScanQueueMemory records the approximate memory used by the devices queued and visited by the
+// neighbor walk in progress
+func (l *SNMPListener) setScanQueueMemory(size int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.scanQueueMemory = size
+}
+
+// checkMemoryBudget returns whether the discovery is over its memory budget, in which case the new subnet
+// sweeps are paused until devices are evicted. The session pool is shrunk while it is.
+func (l *SNMPListener) checkMemoryBudget() bool {
+	l.Lock()
+	defer l.Unlock()
+	budget := l.config.DiscoveryMemoryBudget
+	if budget <= 0 {
+		return false
+	}
+	usage := l.memoryUsage()
+	snmpMemoryUsage.Set(float64(usage))
+	constrained := usage > budget
+	if constrained == l.memoryConstrained {
+		return constrained
+	}
+	l.memoryConstrained = constrained
+	if constrained {
+		log.Warnf("SNMP discovery uses about %d bytes, over its memory budget of %d bytes: pausing the subnet sweeps and shrinking the session pool until devices are unscheduled", usage, budget)
+		snmpMemoryConstrained.Set(1)
+	} else {
+		log.Infof("SNMP discovery uses about %d bytes, within its memory budget of %d bytes again: resuming the subnet sweeps", usage, budget)
+		snmpMemoryConstrained.Set(0)
+	}
+	snmpSessions.SetConstrained(constrained)
+	return constrained
+}
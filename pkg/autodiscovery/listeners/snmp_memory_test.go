@@ -0,0 +1,148 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sweptIPs sweeps the subnet and returns the number of IPs sent to the workers
+func sweptIPs(t *testing.T, l *SNMPListener, subnet *snmpSubnet) int {
+	jobs := make(chan snmpJob, 256)
+	require.True(t, l.scanSubnets([]*snmpSubnet{subnet}, jobs))
+	return len(jobs)
+}
+
+func TestMemoryUsageAccounting(t *testing.T) {
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{})
+	defer discoveryInventory.deleteSubnet(subnet)
+	l.activeSources = map[*snmpSubnetSource]struct{}{
+		{subnets: map[string]*snmpSubnet{subnet.config.Network: subnet}}: {},
+	}
+
+	empty := l.registryMemoryUsage()
+	assert.Equal(t, subnetStructSize, empty)
+
+	answerDiscovery(l, subnet, "10.0.0.1")
+	one := l.registryMemoryUsage()
+	assert.Greater(t, one, empty)
+	// the estimation is consistent
+	assert.Equal(t, one, l.registryMemoryUsage())
+
+	// the strings of the devices are accounted for
+	l.createService(subnet.config.Digest("10.0.0.1"), subnet, "10.0.0.1", "router", true)
+	assert.Equal(t, one+int64(len("router")), l.registryMemoryUsage())
+
+	answerDiscovery(l, subnet, "10.0.0.2")
+	assert.Greater(t, l.registryMemoryUsage(), one+int64(len("router")))
+}
+
+func TestMemoryBudget(t *testing.T) {
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{})
+	defer discoveryInventory.deleteSubnet(subnet)
+	defer snmpSessions.SetConstrained(false)
+	l.activeSources = map[*snmpSubnetSource]struct{}{
+		{subnets: map[string]*snmpSubnet{subnet.config.Network: subnet}}: {},
+	}
+
+	// no budget, the sweeps go on
+	first := answerDiscovery(l, subnet, "10.0.0.1")
+	l.Lock()
+	oneDevice := l.memoryUsage()
+	l.Unlock()
+	second := answerDiscovery(l, subnet, "10.0.0.2")
+	assert.False(t, l.checkMemoryBudget())
+	assert.Equal(t, 256, sweptIPs(t, l, subnet))
+
+	// the budget is exceeded by the third device, the evicted devices are still accounted for
+	// until they answer again, but much less than the scheduled ones
+	l.Lock()
+	twoDevices := l.memoryUsage()
+	l.config.DiscoveryMemoryBudget = twoDevices + (twoDevices-oneDevice)/2
+	l.Unlock()
+	assert.False(t, l.checkMemoryBudget())
+	answerDiscovery(l, subnet, "10.0.0.3")
+	assert.True(t, l.checkMemoryBudget())
+	assert.True(t, l.memoryConstrained)
+	assert.Equal(t, 0, sweptIPs(t, l, subnet))
+
+	// the health checks still evict devices, releasing their memory
+	l.deleteService(first, subnet)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, scheduledIPs(l))
+	assert.False(t, l.checkMemoryBudget())
+	assert.False(t, l.memoryConstrained)
+	assert.Equal(t, 256, sweptIPs(t, l, subnet))
+
+	// a device discovered again makes it exceed the budget again
+	answerDiscovery(l, subnet, "10.0.0.4")
+	assert.True(t, l.checkMemoryBudget())
+	l.deleteService(second, subnet)
+	assert.False(t, l.checkMemoryBudget())
+}
+
+func TestMemoryBudgetDuringSweep(t *testing.T) {
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{})
+	defer discoveryInventory.deleteSubnet(subnet)
+	defer snmpSessions.SetConstrained(false)
+	l.activeSources = map[*snmpSubnetSource]struct{}{
+		{subnets: map[string]*snmpSubnet{subnet.config.Network: subnet}}: {},
+	}
+
+	l.Lock()
+	empty := l.memoryUsage()
+	l.Unlock()
+	answerDiscovery(l, subnet, "10.0.0.1")
+	l.Lock()
+	oneDevice := l.memoryUsage()
+	l.config.DiscoveryMemoryBudget = oneDevice + (oneDevice-empty)/2
+	l.Unlock()
+
+	// a device discovered early in the sweep exceeds the budget, the sweep stops at the next check
+	jobs := make(chan snmpJob)
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range jobs {
+			if count++; count == 10 {
+				answerDiscovery(l, subnet, "10.0.0.10")
+			}
+		}
+		received <- count
+	}()
+	require.True(t, l.scanSubnets([]*snmpSubnet{subnet}, jobs))
+	close(jobs)
+	assert.Equal(t, memoryCheckInterval-1, <-received)
+	assert.True(t, l.memoryConstrained)
+	discoveryInventory.Lock()
+	assert.False(t, discoveryInventory.getSubnet(subnet).status.Scanning)
+	discoveryInventory.Unlock()
+}
+
+func TestMemoryUsageScanQueue(t *testing.T) {
+	l, subnet, _, _ := newCappedListener(t, snmp.ListenerConfig{})
+	defer discoveryInventory.deleteSubnet(subnet)
+
+	l.Lock()
+	usage := l.memoryUsage()
+	l.Unlock()
+
+	// the devices queued by a neighbor walk are accounted for until it ends
+	queue := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	l.setScanQueueMemory(ipsSize(queue))
+	l.Lock()
+	assert.Equal(t, usage+2*(ipHeaderSize+net.IPv6len), l.memoryUsage())
+	l.Unlock()
+	l.setScanQueueMemory(0)
+	l.Lock()
+	assert.Equal(t, usage, l.memoryUsage())
+	l.Unlock()
+}
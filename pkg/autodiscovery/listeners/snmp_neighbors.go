@@ -0,0 +1,236 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// lldpRemManAddrIfSubtypeOid is a column of the lldpRemManAddrTable, the management addresses
+	// of the LLDP neighbors are part of its index
+	lldpRemManAddrIfSubtypeOid = "1.0.8802.1.1.2.1.4.2.1.3"
+	// cdpCacheAddressOid is the column of the cdpCacheTable holding the addresses of the CDP neighbors
+	cdpCacheAddressOid = "1.3.6.1.4.1.9.9.23.1.2.1.1.4"
+
+	lldpManAddrSubtypeIPv4 = "1"
+	lldpManAddrSubtypeIPv6 = "2"
+)
+
+// newSNMPNeighborSubnet returns the subnet holding the devices found by the neighbor walk of a config
+// outside of its swept subnets. It is never swept, its network is only shown in the status.
+func newSNMPNeighborSubnet(config snmp.Config) *snmpSubnet {
+	adIdentifier := config.ADIdentifier
+	if adIdentifier == "" {
+		adIdentifier = "snmp"
+	}
+	return &snmpSubnet{
+		adIdentifier:   adIdentifier,
+		config:         config,
+		network:        net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 8*net.IPv4len)},
+		cacheKey:       fmt.Sprintf("snmp:neighbors:%s", config.Digest(strings.Join(config.Seeds, ","))),
+		devices:        map[string]string{},
+		deviceFailures: map[string]int{},
+		evictedDevices: map[string]string{},
+		probeOIDs:      map[string]string{},
+		sysObjectIDs:   map[string]string{},
+		neighbors:      true,
+	}
+}
+
+// walkSeeds walks the neighbors of the seeds of the sources, it returns false if the listener has been stopped
+func (l *SNMPListener) walkSeeds(sources []*snmpSubnetSource) bool {
+	for _, source := range sources {
+		if source.neighbors == nil || source.neighbors.cancelled() {
+			continue
+		}
+		if !l.walkSource(source) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkSource discovers the seeds of a source and their LLDP and CDP neighbors, recursively up to the
+// neighbor walk depth of its config. Each device is reached once per walk, the neighbor tables forming
+// cycles. The devices of the walk which are no longer reachable from the seeds count a failure towards
+// their removal. The memory of the devices queued and visited is accounted for in the memory budget,
+// the walk stopping, without counting any failure, when it is exceeded. It returns false if the
+// listener has been stopped.
+func (l *SNMPListener) walkSource(source *snmpSubnetSource) bool {
+	defer l.setScanQueueMemory(0)
+	config := source.neighbors.config
+	visited := map[string]bool{}
+	var visitedMemory int64
+	devices := config.SeedIPs()
+	for depth := 0; len(devices) > 0; depth++ {
+		var neighbors []net.IP
+		devicesMemory, neighborsMemory := ipsSize(devices), int64(0)
+		for _, ip := range devices {
+			deviceIP := ip.String()
+			if visited[deviceIP] || config.IsIPIgnored(ip) {
+				continue
+			}
+			visited[deviceIP] = true
+			visitedMemory += stringSize(deviceIP) + boolSize
+			if len(visited)%memoryCheckInterval == 0 {
+				l.setScanQueueMemory(visitedMemory + devicesMemory + neighborsMemory)
+				if l.checkMemoryBudget() {
+					log.Debugf("Stopping the neighbor walk of %s at %s, the discovery is over its memory budget", config.Network, deviceIP)
+					snmpPausedSweeps.Inc(config.Network)
+					return true
+				}
+			}
+
+			answered := l.discoverNeighbor(source, ip)
+
+			select {
+			case <-l.stop:
+				return false
+			default:
+			}
+
+			if !answered || depth >= config.NeighborWalkDepth {
+				continue
+			}
+			found, err := walkNeighbors(config, deviceIP)
+			if err != nil {
+				log.Debugf("SNMP neighbor walk of %s error: %v", deviceIP, err)
+				continue
+			}
+			neighbors = append(neighbors, found...)
+			neighborsMemory += ipsSize(found)
+		}
+		devices = neighbors
+	}
+
+	l.RLock()
+	var lost []string
+	for entityID, deviceIP := range source.neighbors.devices {
+		if !visited[deviceIP] {
+			lost = append(lost, entityID)
+		}
+	}
+	l.RUnlock()
+	for _, entityID := range lost {
+		l.deleteService(entityID, source.neighbors)
+	}
+	return true
+}
+
+// discoverNeighbor probes a device reached by a neighbor walk with the subnet of the source containing
+// it, or with the subnet of the walk when none does, and returns whether it answered. The devices
+// already scheduled by a sweep or by the walk of another config aren't probed again.
+func (l *SNMPListener) discoverNeighbor(source *snmpSubnetSource, ip net.IP) bool {
+	subnet := source.neighbors
+	for _, swept := range source.subnets {
+		if swept.network.Contains(ip) {
+			subnet = swept
+			break
+		}
+	}
+	deviceIP := ip.String()
+	entityID := subnet.config.Digest(deviceIP)
+
+	l.RLock()
+	owners := l.devicesByIP[deviceIP]
+	_, own := owners[entityID]
+	l.RUnlock()
+	// only the devices of the walk itself are discovered again by the walk
+	if len(owners) > 0 && !(subnet.neighbors && own) {
+		return true
+	}
+	return l.checkDevice(snmpJob{subnet: subnet, currentIP: ip})
+}
+
+// walkNeighbors returns the management addresses of the LLDP and CDP neighbors of a device.
+// Don't make it a method, to be overridden in tests.
+var walkNeighbors = func(config snmp.Config, deviceIP string) (_ []net.IP, err error) {
+	session, err := connectDevice(config, deviceIP)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { session.Release(err) }()
+
+	var neighbors []net.IP
+	lldpEntries, err := session.WalkAll(lldpRemManAddrIfSubtypeOid)
+	if err != nil {
+		return nil, fmt.Errorf("LLDP walk error: %v", err)
+	}
+	for _, entry := range lldpEntries {
+		if ip := lldpManAddr(entry.Name); ip != nil {
+			neighbors = append(neighbors, ip)
+		}
+	}
+	cdpEntries, err := session.WalkAll(cdpCacheAddressOid)
+	if err != nil {
+		return nil, fmt.Errorf("CDP walk error: %v", err)
+	}
+	for _, entry := range cdpEntries {
+		if ip := cdpAddress(entry); ip != nil {
+			neighbors = append(neighbors, ip)
+		}
+	}
+	return neighbors, nil
+}
+
+// lldpManAddr returns the IP address in the index of an entry of the lldpRemManAddrTable:
+// lldpRemTimeMark.lldpRemLocalPortNum.lldpRemIndex.lldpRemManAddrSubtype.length.lldpRemManAddr,
+// nil when the management address isn't an IP address
+func lldpManAddr(oid string) net.IP {
+	oid = strings.TrimPrefix(oid, ".")
+	if !strings.HasPrefix(oid, lldpRemManAddrIfSubtypeOid+".") {
+		return nil
+	}
+	index := strings.Split(strings.TrimPrefix(oid, lldpRemManAddrIfSubtypeOid+"."), ".")
+	if len(index) < 5 {
+		return nil
+	}
+	length, err := strconv.Atoi(index[4])
+	if err != nil || len(index) != 5+length {
+		return nil
+	}
+	switch {
+	case index[3] == lldpManAddrSubtypeIPv4 && length == net.IPv4len:
+	case index[3] == lldpManAddrSubtypeIPv6 && length == net.IPv6len:
+	default:
+		return nil
+	}
+	ip := make(net.IP, length)
+	for i, part := range index[5:] {
+		b, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(b)
+	}
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// cdpAddress returns the IP address of an entry of the cdpCacheTable, nil when it isn't an IP address
+func cdpAddress(entry gosnmp.SnmpPDU) net.IP {
+	raw, ok := entry.Value.([]byte)
+	if !ok || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil
+	}
+	ip := make(net.IP, len(raw))
+	copy(ip, raw)
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
@@ -0,0 +1,215 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lldpNeighbor returns the lldpRemManAddrTable entry of a neighbor with an IPv4 management address
+func lldpNeighbor(localPort int, ip string) (string, gosnmp.SnmpPDU) {
+	index := make([]string, 0, net.IPv4len)
+	for _, b := range net.ParseIP(ip).To4() {
+		index = append(index, fmt.Sprintf("%d", b))
+	}
+	oid := fmt.Sprintf("%s.0.%d.1.1.4.%s", lldpRemManAddrIfSubtypeOid, localPort, strings.Join(index, "."))
+	return oid, gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 2}
+}
+
+// cdpNeighbor returns the cdpCacheTable entry of a neighbor with an IPv4 address
+func cdpNeighbor(ifIndex int, ip string) (string, gosnmp.SnmpPDU) {
+	oid := fmt.Sprintf("%s.%d.1", cdpCacheAddressOid, ifIndex)
+	return oid, gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte(net.ParseIP(ip).To4())}
+}
+
+// startNeighborGraph starts a fake SNMP agent per device of a small topology with a cycle:
+// 127.0.0.1 -LLDP-> 127.0.0.2 -CDP-> 127.0.0.3 -LLDP-> 127.0.0.1 and 127.0.0.3 -CDP-> 127.0.0.4.
+// It returns the port of the agents and the functions listing the OIDs they were asked, by IP.
+func startNeighborGraph(t *testing.T) (uint16, map[string]func() []string) {
+	neighbors := map[string][]func() (string, gosnmp.SnmpPDU){
+		"127.0.0.1": {func() (string, gosnmp.SnmpPDU) { return lldpNeighbor(1, "127.0.0.2") }},
+		"127.0.0.2": {func() (string, gosnmp.SnmpPDU) { return cdpNeighbor(3, "127.0.0.3") }},
+		"127.0.0.3": {
+			func() (string, gosnmp.SnmpPDU) { return lldpNeighbor(1, "127.0.0.1") },
+			func() (string, gosnmp.SnmpPDU) { return cdpNeighbor(2, "127.0.0.4") },
+		},
+		"127.0.0.4": nil,
+	}
+	answers := func(ip string) map[string]gosnmp.SnmpPDU {
+		device := map[string]gosnmp.SnmpPDU{
+			sysObjectIDOid: {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1745"},
+		}
+		for _, neighbor := range neighbors[ip] {
+			oid, answer := neighbor()
+			device[oid] = answer
+		}
+		return device
+	}
+
+	asked := map[string]func() []string{}
+	port, askedFirst := startFakeSNMPAgent(t, answers("127.0.0.1"))
+	asked["127.0.0.1"] = askedFirst
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"} {
+		_, asked[ip] = startFakeSNMPAgentOn(t, fmt.Sprintf("%s:%d", ip, port), answers(ip))
+	}
+	return port, asked
+}
+
+func newNeighborWalkListener() *SNMPListener {
+	return &SNMPListener{
+		services:   map[string]Service{},
+		newService: make(chan Service, 10),
+		delService: make(chan Service, 10),
+		stop:       make(chan bool),
+	}
+}
+
+func newNeighborWalkSource(config snmp.Config) *snmpSubnetSource {
+	return &snmpSubnetSource{
+		config:         config,
+		subnets:        map[string]*snmpSubnet{},
+		removedSubnets: map[string]*snmpSubnet{},
+		neighbors:      newSNMPNeighborSubnet(config),
+	}
+}
+
+func subnetDeviceIPs(subnet *snmpSubnet) []string {
+	ips := make([]string, 0, len(subnet.devices))
+	for _, ip := range subnet.devices {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func countOID(oids []string, oid string) int {
+	count := 0
+	for _, asked := range oids {
+		if asked == oid {
+			count++
+		}
+	}
+	return count
+}
+
+func TestNeighborWalk(t *testing.T) {
+	port, asked := startNeighborGraph(t)
+	l := newNeighborWalkListener()
+	source := newNeighborWalkSource(snmp.Config{
+		Port:              port,
+		Version:           "2",
+		Community:         "public",
+		Timeout:           1,
+		AllowedFailures:   1,
+		Seeds:             []string{"127.0.0.1"},
+		NeighborWalkDepth: 2,
+	})
+
+	// 127.0.0.4 is three hops away from the seed
+	assert.True(t, l.walkSource(source))
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, subnetDeviceIPs(source.neighbors))
+	assert.Len(t, l.services, 3)
+	assert.Len(t, l.newService, 3)
+	// the neighbors of the devices at the walk depth aren't walked
+	assert.Equal(t, []string{sysObjectIDOid}, asked["127.0.0.3"]())
+	asked["127.0.0.1"]()
+	asked["127.0.0.2"]()
+
+	// each device is reached once despite the cycle
+	source.neighbors.config.NeighborWalkDepth = 3
+	assert.True(t, l.walkSource(source))
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}, subnetDeviceIPs(source.neighbors))
+	assert.Len(t, l.services, 4)
+	assert.Len(t, l.newService, 4)
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"} {
+		assert.Equal(t, 1, countOID(asked[ip](), sysObjectIDOid), ip)
+	}
+
+	// the devices no longer reachable from the seed are removed after the allowed failures
+	source.neighbors.config.NeighborWalkDepth = 1
+	assert.True(t, l.walkSource(source))
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, subnetDeviceIPs(source.neighbors))
+	assert.Len(t, l.services, 2)
+	assert.Len(t, l.delService, 2)
+}
+
+func TestNeighborWalkDeduplicatesSweep(t *testing.T) {
+	port, asked := startNeighborGraph(t)
+	l := newNeighborWalkListener()
+	config := snmp.Config{
+		Port:              port,
+		Version:           "2",
+		Community:         "public",
+		Timeout:           1,
+		Seeds:             []string{"127.0.0.1"},
+		NeighborWalkDepth: 3,
+	}
+	source := newNeighborWalkSource(config)
+	// the devices of the subnets swept with the same config are scheduled with their subnet
+	swept, err := newSNMPSubnet(config, "127.0.0.4/32")
+	require.NoError(t, err)
+	source.subnets["127.0.0.4/32"] = swept
+
+	// another config sweeping 127.0.0.2 discovered it first
+	other := config
+	other.Community = "private"
+	other.Seeds = nil
+	otherSubnet, err := newSNMPSubnet(other, "127.0.0.0/29")
+	require.NoError(t, err)
+	assert.True(t, l.checkDevice(snmpJob{subnet: otherSubnet, currentIP: net.ParseIP("127.0.0.2")}))
+	asked["127.0.0.2"]()
+
+	// the walk doesn't discover it again, but walks its neighbors
+	assert.True(t, l.walkSource(source))
+	assert.Equal(t, 0, countOID(asked["127.0.0.2"](), sysObjectIDOid))
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.3"}, subnetDeviceIPs(source.neighbors))
+	assert.ElementsMatch(t, []string{"127.0.0.4"}, subnetDeviceIPs(swept))
+	assert.ElementsMatch(t, []string{"127.0.0.2"}, subnetDeviceIPs(otherSubnet))
+	assert.Len(t, l.services, 4)
+
+	// and the sweep of the other config doesn't schedule the devices found by the walk
+	assert.True(t, l.checkDevice(snmpJob{subnet: otherSubnet, currentIP: net.ParseIP("127.0.0.3")}))
+	assert.ElementsMatch(t, []string{"127.0.0.2"}, subnetDeviceIPs(otherSubnet))
+	assert.Len(t, l.services, 4)
+	assert.Len(t, l.newService, 4)
+}
+
+func TestLLDPManAddr(t *testing.T) {
+	oid, _ := lldpNeighbor(12, "10.0.0.1")
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), lldpManAddr(oid))
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), lldpManAddr("."+oid))
+
+	ipv6 := lldpRemManAddrIfSubtypeOid + ".0.3.1.2.16.253.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1"
+	assert.Equal(t, net.ParseIP("fd00::1"), lldpManAddr(ipv6))
+
+	for _, oid := range []string{
+		// MAC address subtype
+		lldpRemManAddrIfSubtypeOid + ".0.3.1.6.6.0.28.115.1.2.3",
+		// truncated address
+		lldpRemManAddrIfSubtypeOid + ".0.3.1.1.4.10.0.0",
+		lldpRemManAddrIfSubtypeOid + ".0.3.1.1.4.10.0.0.256",
+		lldpRemManAddrIfSubtypeOid + ".0.3.1.1.4.0.0.0.0",
+		"1.0.8802.1.1.2.1.4.1.1.9.0.3.1",
+	} {
+		assert.Nil(t, lldpManAddr(oid), oid)
+	}
+}
+
+func TestCDPAddress(t *testing.T) {
+	_, entry := cdpNeighbor(1, "10.0.0.1")
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), cdpAddress(entry))
+	assert.Nil(t, cdpAddress(gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte{0, 0, 0, 0}}))
+	assert.Nil(t, cdpAddress(gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("switch")}))
+	assert.Nil(t, cdpAddress(gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 1}))
+}
@@ -0,0 +1,230 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// Don't make it a method, to be overridden in tests
+var reloadListenerConfig = snmp.ReloadListenerConfig
+
+// watchConfig reloads the config file periodically until the context is cancelled
+func (l *SNMPListener) watchConfig(ctx context.Context, interval time.Duration, fingerprints []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fingerprints = l.reloadConfig(fingerprints)
+		}
+	}
+}
+
+// reloadConfig reloads the config file and sends its configs to the discovery loop when they changed,
+// it returns the fingerprints of the current configs. A change of the max devices per agent is applied
+// right away. The sweeps of the configs removed from the file
+// are cancelled right away, without waiting for the discovery loop to be done with a sweep in progress.
+func (l *SNMPListener) reloadConfig(fingerprints []string) []string {
+	listenerConfig, err := reloadListenerConfig()
+	if err != nil {
+		log.Warnf("Couldn't reload the SNMP listener config, keeping the current configs: %v", err)
+		return fingerprints
+	}
+	l.setDeviceCapacity(listenerConfig)
+	reloaded := configFingerprints(listenerConfig.Configs)
+	if reflect.DeepEqual(fingerprints, reloaded) {
+		return fingerprints
+	}
+	log.Infof("SNMP listener configs changed in the config file, applying them")
+	l.cancelRemovedSources(reloaded)
+
+	// the discovery loop only needs the latest configs when it didn't apply the previous ones yet
+	select {
+	case <-l.reloads:
+	default:
+	}
+	l.reloads <- listenerConfig.Configs
+	return reloaded
+}
+
+// cancelRemovedSources cancels the context of the sources whose config isn't part of the reloaded configs
+func (l *SNMPListener) cancelRemovedSources(fingerprints []string) {
+	reloaded := make(map[string]struct{}, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		reloaded[fingerprint] = struct{}{}
+	}
+	l.RLock()
+	defer l.RUnlock()
+	for source := range l.activeSources {
+		if _, found := reloaded[source.key]; !found {
+			source.cancel()
+		}
+	}
+}
+
+// reloadSources applies the configs reloaded from the config file. The sources whose config was removed
+// or changed are removed with their devices, and a source is created for each new config, its secrets
+// being resolved again. The sources whose config didn't change keep their subnets and devices. It returns
+// the sources and the subnets of the new sources.
+func (l *SNMPListener) reloadSources(sources []*snmpSubnetSource, configs []snmp.Config, now time.Time) ([]*snmpSubnetSource, []*snmpSubnet) {
+	// the same config may be listed more than once
+	wanted := map[string]int{}
+	for _, config := range configs {
+		wanted[config.Fingerprint()]++
+	}
+
+	kept := make([]*snmpSubnetSource, 0, len(configs))
+	for _, source := range sources {
+		if wanted[source.key] > 0 && source.context().Err() == nil {
+			wanted[source.key]--
+			kept = append(kept, source)
+			continue
+		}
+		log.Infof("SNMP config of %s was removed, stopping its discovery", source.config.Network)
+		l.removeSource(source)
+	}
+
+	var added []*snmpSubnetSource
+	for _, config := range configs {
+		fingerprint := config.Fingerprint()
+		if wanted[fingerprint] == 0 {
+			continue
+		}
+		wanted[fingerprint]--
+		log.Infof("SNMP config of %s was added, starting its discovery", config.Network)
+		added = append(added, l.newSubnetSource(config))
+	}
+	return append(kept, added...), l.refreshSubnets(added, now)
+}
+
+// removeSource stops the discovery of a source whose config was removed, and unschedules its devices
+// right away instead of after the allowed failures
+func (l *SNMPListener) removeSource(source *snmpSubnetSource) {
+	source.cancel()
+	subnets := source.deviceSubnets()
+	for _, subnet := range source.removedSubnets {
+		subnets = append(subnets, subnet)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	delete(l.activeSources, source)
+	for _, subnet := range subnets {
+		for entityID, deviceIP := range subnet.devices {
+			if svc, present := l.services[entityID]; present {
+				l.delService <- svc
+				delete(l.services, entityID)
+			}
+			delete(subnet.devices, entityID)
+			l.unregisterDevice(entityID, deviceIP)
+		}
+		l.forgetPendingDevices(subnet)
+		discoveryInventory.deleteSubnet(subnet)
+	}
+	l.promotePendingDevices()
+}
+
+// configFingerprints returns the sorted fingerprints of configs
+func configFingerprints(configs []snmp.Config) []string {
+	fingerprints := make([]string, 0, len(configs))
+	for _, config := range configs {
+		fingerprints = append(fingerprints, config.Fingerprint())
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// sourceFingerprints returns the sorted fingerprints of the configs of sources
+func sourceFingerprints(sources []*snmpSubnetSource) []string {
+	fingerprints := make([]string, 0, len(sources))
+	for _, source := range sources {
+		fingerprints = append(fingerprints, source.key)
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// healthCheckInterval returns the smallest health check interval of the sources, 0 when none is
+// health checked. Each subnet is checked when it's due.
+func healthCheckInterval(sources []*snmpSubnetSource) time.Duration {
+	var smallest time.Duration
+	for _, source := range sources {
+		if interval := time.Duration(source.config.HealthCheckInterval) * time.Second; interval > 0 && (smallest == 0 || interval < smallest) {
+			smallest = interval
+		}
+	}
+	return smallest
+}
+
+// refreshInterval returns the smallest refresh interval of the sources, 0 when none of them lists
+// its networks dynamically
+func refreshInterval(sources []*snmpSubnetSource) time.Duration {
+	var smallest time.Duration
+	for _, source := range sources {
+		if interval := source.source.RefreshInterval(); interval > 0 && (smallest == 0 || interval < smallest) {
+			smallest = interval
+		}
+	}
+	return smallest
+}
+
+// secretRefreshInterval returns how often the secrets referenced by the credentials are resolved
+// again, 0 when no config references a secret
+func (l *SNMPListener) secretRefreshInterval(sources []*snmpSubnetSource) time.Duration {
+	if l.config.SecretRefreshInterval <= 0 {
+		return 0
+	}
+	for _, source := range sources {
+		if len(source.config.SecretHandles) > 0 {
+			return time.Duration(l.config.SecretRefreshInterval) * time.Second
+		}
+	}
+	return 0
+}
+
+// intervalTicker is a ticker whose interval can change, it doesn't tick while its interval is 0
+type intervalTicker struct {
+	interval time.Duration
+	ticker   *time.Ticker
+}
+
+// reset restarts the ticker when its interval changed
+func (t *intervalTicker) reset(interval time.Duration) {
+	if interval == t.interval {
+		return
+	}
+	t.stop()
+	t.interval = interval
+	if interval > 0 {
+		t.ticker = time.NewTicker(interval)
+	}
+}
+
+// stop stops the ticker
+func (t *intervalTicker) stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+		t.ticker = nil
+	}
+	t.interval = 0
+}
+
+// C returns the channel of the ticker, nil while it doesn't tick
+func (t *intervalTicker) C() <-chan time.Time {
+	if t.ticker == nil {
+		return nil
+	}
+	return t.ticker.C
+}
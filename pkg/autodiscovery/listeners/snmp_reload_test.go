@@ -0,0 +1,180 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/snmp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scheduledConfigs returns the network and community of the config of each scheduled service
+func scheduledConfigs(l *SNMPListener) []string {
+	configs := make([]string, 0, len(l.services))
+	for _, svc := range l.services {
+		config := svc.(*SNMPService).config
+		configs = append(configs, config.Network+" "+config.Community)
+	}
+	return configs
+}
+
+// discoverFirstDevice schedules the first device of each subnet, as a sweep would
+func discoverFirstDevice(l *SNMPListener, subnets []*snmpSubnet, newSvc chan Service) {
+	for _, subnet := range subnets {
+		deviceIP := make(net.IP, len(subnet.startingIP))
+		copy(deviceIP, subnet.startingIP)
+		incrementIP(deviceIP)
+		l.createService(subnet.config.Digest(deviceIP.String()), subnet, deviceIP.String(), "", false)
+		<-newSvc
+	}
+}
+
+func TestReloadConfigs(t *testing.T) {
+	defer func(previous func() (snmp.ListenerConfig, error)) { reloadListenerConfig = previous }(reloadListenerConfig)
+
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+		reloads:    make(chan []snmp.Config, 1),
+	}
+
+	unchanged := snmp.Config{Network: "10.0.0.0/30", Community: "public", Loader: "core"}
+	changed := snmp.Config{Network: "10.0.1.0/30", Community: "private", Loader: "core"}
+	removed := snmp.Config{Network: "10.0.2.0/30", Community: "public", Loader: "core"}
+	var sources []*snmpSubnetSource
+	for _, config := range []snmp.Config{unchanged, changed, removed} {
+		sources = append(sources, l.newSubnetSource(config))
+	}
+	discoverFirstDevice(l, l.refreshSubnets(sources, time.Now()), newSvc)
+	assert.ElementsMatch(t, []string{"10.0.0.0/30 public", "10.0.1.0/30 private", "10.0.2.0/30 public"}, scheduledConfigs(l))
+	unchangedService := l.services[sources[0].subnets["10.0.0.0/30"].config.Digest("10.0.0.1")]
+
+	// the credentials of a config changed, another one was removed and a new one added
+	changed.Community = "rotated"
+	added := snmp.Config{Network: "10.0.3.0/30", Community: "public", Loader: "core"}
+	reloadListenerConfig = func() (snmp.ListenerConfig, error) {
+		return snmp.ListenerConfig{Configs: []snmp.Config{unchanged, changed, added}}, nil
+	}
+	fingerprints := l.reloadConfig(sourceFingerprints(sources))
+	assert.Equal(t, configFingerprints([]snmp.Config{unchanged, changed, added}), fingerprints)
+
+	// the sweeps of the configs which are gone are cancelled before the configs are applied
+	assert.NoError(t, sources[0].ctx.Err())
+	assert.Error(t, sources[1].ctx.Err())
+	assert.Error(t, sources[2].ctx.Err())
+	require.Len(t, l.reloads, 1)
+
+	sources, subnets := l.reloadSources(sources, <-l.reloads, time.Now())
+	require.Len(t, sources, 3)
+	assert.Equal(t, "10.0.0.0/30", sources[0].config.Network)
+	assert.Len(t, delSvc, 2)
+	assert.Len(t, newSvc, 0)
+	require.Len(t, subnets, 2)
+
+	// only the subnets of the new configs are discovered, the unchanged one keeps its device
+	discoverFirstDevice(l, subnets, newSvc)
+	assert.ElementsMatch(t, []string{"10.0.0.0/30 public", "10.0.1.0/30 rotated", "10.0.3.0/30 public"}, scheduledConfigs(l))
+	assert.Same(t, unchangedService, l.services[sources[0].subnets["10.0.0.0/30"].config.Digest("10.0.0.1")])
+	assert.Len(t, l.activeSources, 3)
+
+	// the same configs are not applied again
+	assert.Equal(t, fingerprints, l.reloadConfig(fingerprints))
+	assert.Len(t, l.reloads, 0)
+
+	// the current configs are kept when the config file can't be reloaded
+	reloadListenerConfig = func() (snmp.ListenerConfig, error) {
+		return snmp.ListenerConfig{}, fmt.Errorf("invalid config file")
+	}
+	assert.Equal(t, fingerprints, l.reloadConfig(fingerprints))
+	assert.Len(t, l.reloads, 0)
+}
+
+func TestReloadConfigsSecrets(t *testing.T) {
+	defer func(previous snmp.SecretResolver) { resolveSecrets = previous }(resolveSecrets)
+	community := "community-1"
+	resolveSecrets = func(handles []string, origin string) (map[string]string, error) {
+		return map[string]string{"snmp_community": community}, nil
+	}
+
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+	}
+	config := snmp.Config{
+		Network:       "10.0.0.0/30",
+		Community:     "ENC[snmp_community]",
+		SecretHandles: map[string]string{"community_string": "snmp_community"},
+	}
+	sources := []*snmpSubnetSource{l.newSubnetSource(config)}
+	assert.Equal(t, "community-1", sources[0].config.Community)
+
+	// the config referencing a secret doesn't change once its secret is resolved
+	reloaded, subnets := l.reloadSources(sources, []snmp.Config{config}, time.Now())
+	assert.Equal(t, sources, reloaded)
+	assert.Empty(t, subnets)
+
+	// a new config is created with the secrets resolved again
+	community = "community-2"
+	config.Port = 1161
+	reloaded, _ = l.reloadSources(sources, []snmp.Config{config}, time.Now())
+	require.Len(t, reloaded, 1)
+	assert.Equal(t, "community-2", reloaded[0].config.Community)
+}
+
+func TestScanCancelledSubnet(t *testing.T) {
+	newSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		stop:       make(chan bool),
+	}
+	subnet, err := newSNMPSubnet(snmp.Config{Community: "public"}, "10.0.0.0/30")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	subnet.ctx = ctx
+
+	jobs := make(chan snmpJob, 10)
+	assert.True(t, l.scanSubnets([]*snmpSubnet{subnet}, jobs))
+	assert.Len(t, jobs, 4)
+
+	// the subnet of a removed config isn't swept, and the devices found by a sweep in progress aren't scheduled
+	cancel()
+	jobs = make(chan snmpJob, 10)
+	assert.True(t, l.scanSubnets([]*snmpSubnet{subnet}, jobs))
+	assert.Len(t, jobs, 0)
+	l.createService("id", subnet, "10.0.0.1", "", false)
+	assert.Len(t, newSvc, 0)
+	assert.Empty(t, l.services)
+}
+
+func TestIntervalTicker(t *testing.T) {
+	var ticker intervalTicker
+	assert.Nil(t, ticker.C())
+
+	ticker.reset(time.Millisecond)
+	c := ticker.C()
+	require.NotNil(t, c)
+	<-c
+	// the ticker isn't restarted when its interval is the same
+	ticker.reset(time.Millisecond)
+	assert.Equal(t, c, ticker.C())
+
+	ticker.reset(0)
+	assert.Nil(t, ticker.C())
+}
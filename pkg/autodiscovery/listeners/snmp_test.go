@@ -6,15 +6,23 @@
 package listeners
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/snmp"
 
+	"github.com/gosnmp/gosnmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSNMPListener(t *testing.T) {
@@ -294,3 +302,676 @@ func TestExtraConfigv3(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "core", string(info))
 }
+
+func TestExtraConfigTagTemplates(t *testing.T) {
+	snmpConfig := snmp.Config{
+		Network:   "192.168.0.0/24",
+		Community: "public",
+		Namespace: "my-ns",
+		Tags: []string{
+			"site:paris",
+			"autodiscovery_subnet:%%subnet%%",
+			"sys_name:%%sysName%%",
+			"device:%%namespace%%:%%device_ip%%",
+			"unknown:%%unknown_fact%%",
+			"site:paris",
+		},
+	}
+
+	svc := SNMPService{
+		adIdentifier: "snmp",
+		entityID:     "id",
+		deviceIP:     "192.168.0.1",
+		creationTime: integration.Before,
+		config:       snmpConfig,
+		sysName:      "router-1",
+	}
+
+	info, err := svc.GetExtraConfig([]byte("tags"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "site:paris,autodiscovery_subnet:192.168.0.0/24,sys_name:router-1,device:my-ns:192.168.0.1", string(info))
+
+	// sysName is unknown for devices loaded from the cache
+	svc.sysName = ""
+	info, err = svc.GetExtraConfig([]byte("tags"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "site:paris,autodiscovery_subnet:192.168.0.0/24,device:my-ns:192.168.0.1", string(info))
+}
+
+func TestCreateServiceRescan(t *testing.T) {
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+
+	subnet := &snmpSubnet{
+		adIdentifier: "snmp",
+		config: snmp.Config{
+			Network:   "192.168.0.0/24",
+			Community: "public",
+			Tags:      []string{"sys_name:%%sysName%%"},
+		},
+		devices:        map[string]string{},
+		deviceFailures: map[string]int{},
+	}
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+	}
+
+	// loaded from cache, then discovered twice by subsequent sweeps
+	l.createService("id", subnet, "192.168.0.1", "", false)
+	l.createService("id", subnet, "192.168.0.1", "router-1", false)
+	l.createService("id", subnet, "192.168.0.1", "router-1", false)
+
+	assert.Equal(t, 2, len(newSvc))
+	assert.Equal(t, 1, len(delSvc))
+	assert.Equal(t, 1, len(l.services))
+
+	<-newSvc
+	svc := <-newSvc
+	info, err := svc.GetExtraConfig([]byte("tags"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "sys_name:router-1", string(info))
+}
+
+func TestSwitchLoaderAndNamespace(t *testing.T) {
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+	}
+	newSubnet := func(loader, namespace string) *snmpSubnet {
+		subnet, err := newSNMPSubnet(snmp.Config{
+			Community:       "public",
+			Loader:          loader,
+			Namespace:       namespace,
+			AllowedFailures: 1,
+		}, "192.168.0.0/24")
+		assert.NoError(t, err)
+		return subnet
+	}
+	deviceIP := "192.168.0.1"
+
+	before := newSubnet("python", "default")
+	beforeID := before.config.Digest(deviceIP)
+	l.createService(beforeID, before, deviceIP, "", false)
+
+	// the same subnet with another loader and namespace schedules its devices with new entity IDs
+	after := newSubnet("core", "org-2")
+	afterID := after.config.Digest(deviceIP)
+	assert.NotEqual(t, beforeID, afterID)
+	assert.NotEqual(t, before.cacheKey, after.cacheKey)
+	l.createService(afterID, after, deviceIP, "", false)
+	assert.Equal(t, 2, len(l.services))
+	assert.Equal(t, 2, len(newSvc))
+
+	<-newSvc
+	svc := <-newSvc
+	loader, err := svc.GetExtraConfig([]byte("loader"))
+	assert.NoError(t, err)
+	assert.Equal(t, "core", string(loader))
+	namespace, err := svc.GetExtraConfig([]byte("namespace"))
+	assert.NoError(t, err)
+	assert.Equal(t, "org-2", string(namespace))
+
+	// the devices of the previous config are unscheduled
+	l.deleteService(beforeID, before)
+	assert.Equal(t, 1, len(delSvc))
+	assert.Equal(t, beforeID, (<-delSvc).GetEntity())
+	assert.Equal(t, 1, len(l.services))
+	assert.Contains(t, l.services, afterID)
+}
+
+type fakeSubnetSource struct {
+	networks        []string
+	refreshInterval time.Duration
+}
+
+func (s *fakeSubnetSource) Networks(context.Context) []string {
+	return s.networks
+}
+
+func (s *fakeSubnetSource) RefreshInterval() time.Duration {
+	return s.refreshInterval
+}
+
+func TestRefreshSubnets(t *testing.T) {
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+		config:     snmp.ListenerConfig{AllowedFailures: 2},
+	}
+	fakeSource := &fakeSubnetSource{
+		networks:        []string{"10.0.1.0/30"},
+		refreshInterval: time.Minute,
+	}
+	source := &snmpSubnetSource{
+		config:         snmp.Config{Community: "public"},
+		source:         fakeSource,
+		subnets:        map[string]*snmpSubnet{},
+		removedSubnets: map[string]*snmpSubnet{},
+	}
+	sources := []*snmpSubnetSource{source}
+	now := time.Now()
+
+	added := l.refreshSubnets(sources, now)
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "10.0.1.0/30", added[0].network.String())
+	assert.Equal(t, "10.0.1.0/30", added[0].config.Network)
+	assert.Equal(t, "public", added[0].config.Community)
+	firstSubnet := added[0]
+	l.createService("id", firstSubnet, "10.0.1.1", "", false)
+	<-newSvc
+
+	// not due for a refresh yet
+	fakeSource.networks = []string{"10.0.2.0/30"}
+	assert.Empty(t, l.refreshSubnets(sources, now.Add(30*time.Second)))
+
+	// the first subnet is gone, the new one is scanned right away
+	added = l.refreshSubnets(sources, now.Add(time.Minute))
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "10.0.2.0/30", added[0].network.String())
+	assert.Equal(t, 1, len(source.subnets))
+	assert.Equal(t, 1, len(source.removedSubnets))
+
+	// the devices of the removed subnet are evicted after the allowed failures
+	l.evictRemovedSubnets(sources)
+	assert.Equal(t, 0, len(delSvc))
+	assert.Equal(t, 1, len(source.removedSubnets))
+	l.evictRemovedSubnets(sources)
+	assert.Equal(t, 1, len(delSvc))
+	assert.Equal(t, 0, len(l.services))
+	assert.Equal(t, 0, len(source.removedSubnets))
+
+	// a subnet coming back is scanned again
+	fakeSource.networks = []string{"10.0.1.0/30", "10.0.2.0/30"}
+	added = l.refreshSubnets(sources, now.Add(2*time.Minute))
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "10.0.1.0/30", added[0].network.String())
+	assert.Equal(t, 2, len(source.subnets))
+}
+
+func TestRefreshSubnetsStatic(t *testing.T) {
+	l := &SNMPListener{services: map[string]Service{}}
+	source := &snmpSubnetSource{
+		config:         snmp.Config{Network: "10.0.1.0/30", Community: "public"},
+		source:         &fakeSubnetSource{networks: []string{"10.0.1.0/30"}},
+		subnets:        map[string]*snmpSubnet{},
+		removedSubnets: map[string]*snmpSubnet{},
+	}
+	sources := []*snmpSubnetSource{source}
+
+	assert.Equal(t, 1, len(l.refreshSubnets(sources, time.Now())))
+	// static sources are only listed once
+	assert.Empty(t, l.refreshSubnets(sources, time.Now().Add(time.Hour)))
+	assert.Equal(t, 1, len(source.subnets))
+}
+
+func TestCheckDeviceParamsError(t *testing.T) {
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: make(chan Service, 10),
+		delService: delSvc,
+		stop:       make(chan bool),
+		config:     snmp.ListenerConfig{AllowedFailures: 1},
+	}
+	// no authentication mechanism, the parameters of the devices can't be built
+	subnet, err := newSNMPSubnet(snmp.Config{}, "10.0.0.0/30")
+	assert.NoError(t, err)
+	entityID := subnet.config.Digest("10.0.0.1")
+	l.createService(entityID, subnet, "10.0.0.1", "", true)
+
+	// the device is kept, the error comes from the configuration
+	for _, healthCheck := range []bool{false, true} {
+		assert.False(t, l.checkDevice(snmpJob{subnet: subnet, currentIP: net.ParseIP("10.0.0.1"), healthCheck: healthCheck}))
+		assert.Contains(t, l.services, entityID)
+		assert.Zero(t, subnet.deviceFailures[entityID])
+		assert.Empty(t, delSvc)
+	}
+}
+
+func TestHealthCheckEviction(t *testing.T) {
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	jobs := make(chan snmpJob, 10)
+
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+		stop:       make(chan bool),
+		config:     snmp.ListenerConfig{AllowedFailures: 10},
+	}
+	subnet, err := newSNMPSubnet(snmp.Config{
+		Community:           "public",
+		AllowedFailures:     3,
+		HealthCheckInterval: 60,
+	}, "10.0.0.0/30")
+	assert.NoError(t, err)
+	source := &snmpSubnetSource{subnets: map[string]*snmpSubnet{"10.0.0.0/30": subnet}}
+
+	deviceUp := true
+	defer func(original func(snmp.Config, string, string) error) { probeDevice = original }(probeDevice)
+	probeDevice = func(config snmp.Config, deviceIP string, oid string) error {
+		assert.Equal(t, "10.0.0.1", deviceIP)
+		assert.Equal(t, sysUpTimeOid, oid)
+		if !deviceUp {
+			return fmt.Errorf("timeout")
+		}
+		return nil
+	}
+	healthCheck := func(now time.Time) int {
+		assert.True(t, l.healthCheckSubnets([]*snmpSubnetSource{source}, jobs, now))
+		checked := len(jobs)
+		for len(jobs) > 0 {
+			l.checkDevice(<-jobs)
+		}
+		return checked
+	}
+
+	entityID := subnet.config.Digest("10.0.0.1")
+	subnet.probeOIDs[entityID] = sysUpTimeOid
+	subnet.sysObjectIDs[entityID] = "1.3.6.1.4.1.9.1.1"
+	subnet.interfaceCounts = map[string]int{entityID: 48}
+	l.createService(entityID, subnet, "10.0.0.1", "", true)
+	<-newSvc
+
+	now := time.Now()
+	assert.Equal(t, 1, healthCheck(now))
+	// not due yet
+	assert.Equal(t, 0, healthCheck(now.Add(30*time.Second)))
+
+	// the device disappears for three cycles, the subnet allows 3 failures
+	deviceUp = false
+	for i := 1; i <= 3; i++ {
+		now = now.Add(time.Minute)
+		assert.Equal(t, 1, healthCheck(now))
+		if i < 3 {
+			assert.Equal(t, i, subnet.deviceFailures[entityID])
+			assert.Equal(t, 0, len(delSvc))
+		}
+	}
+	assert.Equal(t, 1, len(delSvc))
+	assert.Equal(t, 0, len(l.services))
+	assert.Equal(t, map[string]string{entityID: "10.0.0.1"}, subnet.evictedDevices)
+	// what was learnt about the device is forgotten with it
+	assert.NotContains(t, subnet.probeOIDs, entityID)
+	assert.NotContains(t, subnet.sysObjectIDs, entityID)
+	assert.NotContains(t, subnet.interfaceCounts, entityID)
+
+	// evicted devices are no longer health checked
+	now = now.Add(time.Minute)
+	assert.Equal(t, 0, healthCheck(now))
+
+	// the device is back and answers the next sweep
+	deviceUp = true
+	l.createService(entityID, subnet, "10.0.0.1", "", true)
+	assert.Equal(t, 1, len(newSvc))
+	assert.Equal(t, 0, len(subnet.evictedDevices))
+	assert.Equal(t, 0, subnet.deviceFailures[entityID])
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, 1, healthCheck(now))
+	assert.Equal(t, 1, len(l.services))
+}
+
+func TestDiscoverSNMPDevices(t *testing.T) {
+	defer func(original func(snmp.Config, string, []string) (snmpDeviceInfo, error)) { queryDeviceInfo = original }(queryDeviceInfo)
+	queryDeviceInfo = func(config snmp.Config, deviceIP string, probeOIDs []string) (snmpDeviceInfo, error) {
+		assert.Equal(t, []string{sysObjectIDOid}, probeOIDs)
+		switch deviceIP {
+		case "10.0.0.5", "10.0.1.2":
+			return snmpDeviceInfo{sysObjectID: "1.3.6.1.4.1.9.1.1745", sysName: "switch-" + deviceIP, probeOID: sysObjectIDOid}, nil
+		case "10.0.0.6":
+			assert.Fail(t, "ignored IP addresses must not be queried")
+		}
+		return snmpDeviceInfo{}, fmt.Errorf("timeout")
+	}
+
+	listenerConfig := snmp.ListenerConfig{
+		Workers: 3,
+		Configs: []snmp.Config{
+			{
+				Network:            "10.0.0.0/24",
+				Community:          "public",
+				Loader:             "core",
+				IgnoredIPAddresses: map[string]bool{"10.0.0.6": true},
+			},
+			{
+				Network:      "10.0.1.0/30",
+				Version:      "3",
+				User:         "monitor",
+				AuthKey:      "secret",
+				ADIdentifier: "snmp-v3",
+			},
+		},
+	}
+
+	devices, err := DiscoverSNMPDevices(context.Background(), listenerConfig, "")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	assert.Equal(t, "10.0.0.5", devices[0].IP)
+	assert.Equal(t, "10.0.0.0/24", devices[0].Subnet)
+	assert.Equal(t, "v2c community", devices[0].Credential)
+	assert.Equal(t, "1.3.6.1.4.1.9.1.1745", devices[0].SysObjectID)
+	assert.Equal(t, "snmp", devices[0].ADIdentifier)
+	assert.Equal(t, "core", devices[0].Loader)
+	assert.Equal(t, "10.0.1.2", devices[1].IP)
+	assert.Equal(t, "v3 user monitor", devices[1].Credential)
+	assert.Equal(t, "snmp-v3", devices[1].ADIdentifier)
+
+	// the service is the one the listener would create
+	hosts, err := devices[0].Service.GetHosts(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"": "10.0.0.5"}, hosts)
+	assert.Equal(t, listenerConfig.Configs[0].Digest("10.0.0.5"), devices[0].Service.GetEntity())
+
+	// only the requested subnet is swept
+	devices, err = DiscoverSNMPDevices(context.Background(), listenerConfig, "10.0.0.4/30")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "10.0.0.5", devices[0].IP)
+	assert.Equal(t, "10.0.0.0/24", devices[0].Subnet)
+
+	_, err = DiscoverSNMPDevices(context.Background(), listenerConfig, "192.168.0.0/24")
+	assert.EqualError(t, err, "no snmp_listener configuration covers the subnet 192.168.0.0/24")
+	_, err = DiscoverSNMPDevices(context.Background(), listenerConfig, "10.0.0.0/16")
+	assert.Error(t, err)
+	_, err = DiscoverSNMPDevices(context.Background(), listenerConfig, "not a subnet")
+	assert.Error(t, err)
+}
+
+// startFakeSNMPAgent starts an SNMP v2c agent on localhost which only answers the given OIDs, and
+// noSuchObject for the others. It returns its port and a function listing the OIDs it was asked.
+func startFakeSNMPAgent(t testing.TB, answers map[string]gosnmp.SnmpPDU) (uint16, func() []string) {
+	return startFakeSNMPAgentOn(t, "127.0.0.1:0", answers)
+}
+
+// startFakeSNMPAgentOn starts the fake SNMP agent on the given address, GETNEXT requests are answered
+// with the next of the given OIDs so that they can be walked
+func startFakeSNMPAgentOn(t testing.TB, address string, answers map[string]gosnmp.SnmpPDU) (uint16, func() []string) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("Couldn't listen on %s: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	oids := make([]string, 0, len(answers))
+	for oid := range answers {
+		oids = append(oids, oid)
+	}
+	sort.Slice(oids, func(i, j int) bool { return compareOIDs(oids[i], oids[j]) < 0 })
+
+	var mu sync.Mutex
+	var asked []string
+	go func() {
+		buf := make([]byte, 65536)
+		decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request, err := decoder.SnmpDecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			response := gosnmp.SnmpPacket{
+				Version:   request.Version,
+				Community: request.Community,
+				PDUType:   gosnmp.GetResponse,
+				RequestID: request.RequestID,
+			}
+			for _, variable := range request.Variables {
+				oid := strings.TrimPrefix(variable.Name, ".")
+				mu.Lock()
+				asked = append(asked, oid)
+				mu.Unlock()
+				if request.PDUType == gosnmp.GetNextRequest {
+					next := sort.Search(len(oids), func(i int) bool { return compareOIDs(oids[i], oid) > 0 })
+					if next == len(oids) {
+						response.Variables = append(response.Variables, gosnmp.SnmpPDU{Name: variable.Name, Type: gosnmp.EndOfMibView})
+						continue
+					}
+					answer := answers[oids[next]]
+					answer.Name = "." + oids[next]
+					response.Variables = append(response.Variables, answer)
+					continue
+				}
+				answer, found := answers[oid]
+				if !found {
+					answer = gosnmp.SnmpPDU{Type: gosnmp.NoSuchObject}
+				}
+				answer.Name = variable.Name
+				response.Variables = append(response.Variables, answer)
+			}
+			payload, err := response.MarshalMsg()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(payload, addr) //nolint:errcheck
+		}
+	}()
+
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	return port, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		oids := asked
+		asked = nil
+		return oids
+	}
+}
+
+// compareOIDs compares two numeric OIDs in lexicographic order of their sub-identifiers
+func compareOIDs(a, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		subA, _ := strconv.Atoi(partsA[i])
+		subB, _ := strconv.Atoi(partsB[i])
+		if subA != subB {
+			return subA - subB
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+func TestDiscoveryProbeOIDs(t *testing.T) {
+	sysDescrOid := "1.3.6.1.2.1.1.1.0"
+	port, asked := startFakeSNMPAgent(t, map[string]gosnmp.SnmpPDU{
+		ifNumberOid: {Type: gosnmp.Integer, Value: 4},
+	})
+
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: make(chan Service, 10),
+		delService: make(chan Service, 10),
+		stop:       make(chan bool),
+	}
+	subnet, err := newSNMPSubnet(snmp.Config{
+		Port:               port,
+		Version:            "2",
+		Community:          "public",
+		Timeout:            1,
+		DiscoveryProbeOIDs: []string{sysObjectIDOid, sysDescrOid, ifNumberOid},
+	}, "127.0.0.1/32")
+	require.NoError(t, err)
+	entityID := subnet.config.Digest("127.0.0.1")
+	job := snmpJob{subnet: subnet, currentIP: net.ParseIP("127.0.0.1")}
+
+	// the device restricts access to the system subtree, the probe OIDs are tried in order
+	l.checkDevice(job)
+	assert.Equal(t, []string{sysObjectIDOid, sysDescrOid, ifNumberOid}, asked())
+	assert.Contains(t, l.services, entityID)
+	assert.Equal(t, ifNumberOid, subnet.probeOIDs[entityID])
+
+	// the OID the device answered is tried first by the next discoveries
+	l.checkDevice(job)
+	assert.Equal(t, []string{ifNumberOid}, asked())
+
+	// and health checks the device instead of its sysUpTime
+	job.healthCheck = true
+	l.checkDevice(job)
+	assert.Equal(t, []string{ifNumberOid}, asked())
+}
+
+func TestDiscoveryProbeOIDsSysObjectID(t *testing.T) {
+	port, asked := startFakeSNMPAgent(t, map[string]gosnmp.SnmpPDU{
+		sysObjectIDOid: {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1745"},
+		sysNameOid:     {Type: gosnmp.OctetString, Value: []byte("switch-1")},
+	})
+
+	config := snmp.Config{
+		Port:      port,
+		Version:   "2",
+		Community: "public",
+		Timeout:   1,
+		Tags:      []string{"sys_name:%%sysName%%"},
+	}
+	info, err := queryDeviceInfo(config, "127.0.0.1", orderProbeOIDs(nil, ""))
+	require.NoError(t, err)
+	assert.Equal(t, snmpDeviceInfo{sysObjectID: ".1.3.6.1.4.1.9.1.1745", sysName: "switch-1", probeOID: sysObjectIDOid}, info)
+	assert.Equal(t, []string{sysObjectIDOid, sysNameOid}, asked())
+
+	// none of the probe OIDs answers
+	_, err = queryDeviceInfo(config, "127.0.0.1", []string{"1.3.6.1.2.1.2.1.0"})
+	assert.EqualError(t, err, "no data")
+}
+
+// BenchmarkSweepSessionPool sweeps a /24 of devices answering on the loopback addresses with the
+// workers of the listener, with a session by probe or with the session pool
+func BenchmarkSweepSessionPool(b *testing.B) {
+	answers := map[string]gosnmp.SnmpPDU{
+		sysObjectIDOid: {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1745"},
+	}
+	port, _ := startFakeSNMPAgent(b, answers)
+	deviceIPs := []string{"127.0.0.1"}
+	for i := 2; i < 255; i++ {
+		deviceIP := fmt.Sprintf("127.0.0.%d", i)
+		startFakeSNMPAgentOn(b, fmt.Sprintf("%s:%d", deviceIP, port), answers)
+		deviceIPs = append(deviceIPs, deviceIP)
+	}
+	config := snmp.Config{
+		Port:      port,
+		Version:   "2",
+		Community: "public",
+		Timeout:   1,
+	}
+
+	for _, bench := range []struct {
+		name string
+		pool *snmp.SessionPool
+	}{
+		{name: "session by probe"},
+		{name: "session pool", pool: snmp.NewSessionPool(defaultWorkers)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			defer func(previous *snmp.SessionPool) { snmpSessions = previous }(snmpSessions)
+			snmpSessions = bench.pool
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				jobs := make(chan string)
+				var wg sync.WaitGroup
+				for w := 0; w < defaultWorkers; w++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for deviceIP := range jobs {
+							if _, err := queryDeviceInfo(config, deviceIP, orderProbeOIDs(nil, "")); err != nil {
+								b.Error(err)
+							}
+						}
+					}()
+				}
+				for _, deviceIP := range deviceIPs {
+					jobs <- deviceIP
+				}
+				close(jobs)
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestOrderProbeOIDs(t *testing.T) {
+	configured := []string{"1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.2.1.0"}
+	assert.Equal(t, []string{sysObjectIDOid}, orderProbeOIDs(nil, ""))
+	assert.Equal(t, configured, orderProbeOIDs(configured, ""))
+	assert.Equal(t, []string{"1.3.6.1.2.1.2.1.0", "1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.1.1.0"}, orderProbeOIDs(configured, "1.3.6.1.2.1.2.1.0"))
+	// an OID no longer configured isn't tried
+	assert.Equal(t, configured, orderProbeOIDs(configured, "1.3.6.1.2.1.4.1.0"))
+}
+
+func TestRefreshSecrets(t *testing.T) {
+	defer func(previous snmp.SecretResolver) { resolveSecrets = previous }(resolveSecrets)
+	community := "community-1"
+	var resolveErr error
+	resolveSecrets = func(handles []string, origin string) (map[string]string, error) {
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		return map[string]string{"snmp_community": community}, nil
+	}
+
+	newSvc := make(chan Service, 10)
+	delSvc := make(chan Service, 10)
+	l := &SNMPListener{
+		services:   map[string]Service{},
+		newService: newSvc,
+		delService: delSvc,
+	}
+	config := snmp.Config{
+		Community:     "ENC[snmp_community]",
+		Loader:        "core",
+		SecretHandles: map[string]string{"community_string": "snmp_community"},
+	}
+	assert.True(t, l.resolveSecrets(&config))
+	source := &snmpSubnetSource{
+		config:         config,
+		subnets:        map[string]*snmpSubnet{},
+		removedSubnets: map[string]*snmpSubnet{},
+	}
+	subnet, err := newSNMPSubnet(config, "192.168.0.0/24")
+	require.NoError(t, err)
+	source.subnets[subnet.config.Network] = subnet
+	deviceIP := "192.168.0.1"
+	entityID := subnet.config.Digest(deviceIP)
+	l.createService(entityID, subnet, deviceIP, "", false)
+	<-newSvc
+
+	// the secret didn't change, nothing is rescheduled
+	l.refreshSecrets([]*snmpSubnetSource{source})
+	assert.Len(t, delSvc, 0)
+	assert.Len(t, newSvc, 0)
+
+	// the rotated secret reschedules the check of the device with the new credential
+	community = "community-2"
+	l.refreshSecrets([]*snmpSubnetSource{source})
+	require.Len(t, delSvc, 1)
+	require.Len(t, newSvc, 1)
+	assert.Equal(t, entityID, (<-delSvc).GetEntity())
+	svc := <-newSvc
+	assert.Equal(t, entityID, svc.GetEntity())
+	value, err := svc.GetExtraConfig([]byte("community"))
+	assert.NoError(t, err)
+	assert.Equal(t, "community-2", string(value))
+	assert.Equal(t, "community-2", subnet.currentConfig().Community)
+	assert.Equal(t, entityID, subnet.config.Digest(deviceIP))
+
+	// a resolution failure keeps the previous credential
+	resolveErr = fmt.Errorf("backend unavailable")
+	community = "community-3"
+	l.refreshSecrets([]*snmpSubnetSource{source})
+	assert.Len(t, delSvc, 0)
+	assert.Len(t, newSvc, 0)
+	assert.Equal(t, "community-2", subnet.currentConfig().Community)
+	assert.Equal(t, "community-2", l.services[entityID].(*SNMPService).config.Community)
+}
@@ -39,6 +39,13 @@ type Service interface {
 	GetExtraConfig([]byte) ([]byte, error)               // Extra configuration values
 }
 
+// ClusterCheckService is implemented by the services whose checks are cluster checks, dispatched
+// by the cluster agent to the cluster check runners instead of running where they are discovered.
+type ClusterCheckService interface {
+	IsClusterCheck() bool // whether the checks of the service are cluster checks
+	GetWeightHint() int   // expected cost of the checks of the service, 0 for the default
+}
+
 // ServiceListener monitors running services and triggers check (un)scheduling
 //
 // It holds a cache of running services, listens to new/killed services and
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/listeners"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/status/health"
 	"github.com/DataDog/datadog-agent/pkg/util"
@@ -161,6 +162,10 @@ func (d *dispatcher) run(ctx context.Context) {
 	d.store.active = true
 	d.store.Unlock()
 
+	// the max devices per agent of the SNMP listener applies to each runner
+	listeners.SetSNMPRunnerCounter(d.countNodes)
+	defer listeners.SetSNMPRunnerCounter(nil)
+
 	healthProbe := health.RegisterLiveness("clusterchecks-dispatch")
 	defer health.Deregister(healthProbe) //nolint:errcheck
 
@@ -69,11 +69,14 @@ func (d *dispatcher) processNodeStatus(nodeName, clientIP string, status types.N
 }
 
 // getLeastBusyNode returns the name of the node that is assigned
-// the lowest number of checks. In case of equality, one is chosen
-// randomly, based on map iterations being randomized.
+// the lowest weight of checks, the checks without weight hint
+// counting for one. With advanced dispatching, the busyness of the
+// nodes includes the one expected from the weight hints of the checks
+// without stats yet. In case of equality, one is chosen randomly,
+// based on map iterations being randomized.
 func (d *dispatcher) getLeastBusyNode() string {
 	var leastBusyNode string
-	minCheckCount := int(-1)
+	minCheckWeight := int(-1)
 	minBusyness := int(-1)
 
 	d.store.RLock()
@@ -87,21 +90,39 @@ func (d *dispatcher) getLeastBusyNode() string {
 			// dispatching based on clc runners stats
 			// only when advancedDispatching is true and
 			// started collecting busyness values
-			if minBusyness == -1 || store.busyness < minBusyness {
+			nodeBusyness := store.busyness + d.store.estimatedBusyness(store)
+			if minBusyness == -1 || nodeBusyness < minBusyness {
 				leastBusyNode = name
-				minBusyness = store.busyness
+				minBusyness = nodeBusyness
 			}
 		} else {
-			// count-based round robin dispatching
-			if minCheckCount == -1 || len(store.digestToConfig) < minCheckCount {
+			// weight-based round robin dispatching
+			store.RLock()
+			weight := store.configWeight()
+			store.RUnlock()
+			if minCheckWeight == -1 || weight < minCheckWeight {
 				leastBusyNode = name
-				minCheckCount = len(store.digestToConfig)
+				minCheckWeight = weight
 			}
 		}
 	}
 	return leastBusyNode
 }
 
+// countNodes returns the number of nodes reporting, the checks being dispatched to them
+func (d *dispatcher) countNodes() int {
+	d.store.RLock()
+	defer d.store.RUnlock()
+	count := 0
+	for name := range d.store.nodes {
+		// the dummy "" node holds the unscheduled configs
+		if name != "" {
+			count++
+		}
+	}
+	return count
+}
+
 // expireNodes iterates over nodes and removes the ones that have not
 // reported for more than the expiration duration. The configurations
 // dispatched to these nodes will be moved to the danglingConfigs map.
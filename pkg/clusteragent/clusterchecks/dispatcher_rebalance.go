@@ -52,7 +52,7 @@ func (d *dispatcher) calculateAvg() (int, error) {
 	defer d.store.RUnlock()
 
 	for _, node := range d.store.nodes {
-		busyness = node.GetBusyness(busynessFunc)
+		busyness = d.nodeBusyness(node)
 		length++
 	}
 
@@ -63,6 +63,13 @@ func (d *dispatcher) calculateAvg() (int, error) {
 	return busyness / length, nil
 }
 
+// nodeBusyness returns the busyness of a node from the stats of its runner, plus the one expected
+// from the weight hints of the checks it doesn't report stats for yet, so that the checks just
+// dispatched aren't ignored. The caller must hold the store lock.
+func (d *dispatcher) nodeBusyness(node *nodeStore) int {
+	return node.GetBusyness(busynessFunc) + d.store.estimatedBusyness(node)
+}
+
 // getDiffAndWeights creates a map that contains the difference between
 // the busyness on each node and the total average busyness, and a Weights
 // struct containing nodes and their busyness values
@@ -74,7 +81,7 @@ func (d *dispatcher) getDiffAndWeights(avg int) (map[string]int, Weights) {
 	defer d.store.RUnlock()
 
 	for nodeName, node := range d.store.nodes {
-		busyness := node.GetBusyness(busynessFunc)
+		busyness := d.nodeBusyness(node)
 		diffMap[nodeName] = busyness - avg
 		weights = append(weights, Weight{
 			nodeName: nodeName,
@@ -93,7 +100,7 @@ func (d *dispatcher) updateDiff(avg int) map[string]int {
 	defer d.store.RUnlock()
 
 	for nodeName, node := range d.store.nodes {
-		busyness := node.GetBusyness(busynessFunc)
+		busyness := d.nodeBusyness(node)
 		diffMap[nodeName] = busyness - avg
 	}
 
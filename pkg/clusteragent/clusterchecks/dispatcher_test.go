@@ -18,6 +18,7 @@ import (
 
 	"github.com/DataDog/datadog-agent/pkg/autodiscovery/integration"
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/clusterchecks/types"
+	"github.com/DataDog/datadog-agent/pkg/collector/check"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/clustername"
 	"github.com/DataDog/datadog-agent/pkg/version"
@@ -379,6 +380,128 @@ func TestDispatchFourConfigsTwoNodes(t *testing.T) {
 	requireNotLocked(t, dispatcher.store)
 }
 
+func TestGetLeastBusyNodeWeighted(t *testing.T) {
+	dispatcher := newDispatcher()
+
+	// The configs without weight hint count for one
+	heavy := generateIntegration("A")
+	heavy.WeightHint = 600
+	dispatcher.addConfig(heavy, "node1")
+	dispatcher.addConfig(generateIntegration("B"), "node2")
+	dispatcher.addConfig(generateIntegration("C"), "node2")
+	assert.Equal(t, "node2", dispatcher.getLeastBusyNode())
+
+	heavier := generateIntegration("D")
+	heavier.WeightHint = 700
+	dispatcher.addConfig(heavier, "node2")
+	assert.Equal(t, "node1", dispatcher.getLeastBusyNode())
+
+	requireNotLocked(t, dispatcher.store)
+}
+
+func TestGetLeastBusyNodeAdvancedWeighted(t *testing.T) {
+	dispatcher := newDispatcher()
+	dispatcher.advancedDispatching = true
+
+	// node2 is the least busy from the stats of its runner, but the check
+	// of the device just dispatched to it isn't running yet
+	device := generateSNMPIntegration("10.1.0.1", 600)
+	dispatcher.addConfig(generateIntegration("A"), "node1")
+	dispatcher.addConfig(device, "node2")
+	dispatcher.store.nodes["node1"].busyness = 100
+	dispatcher.store.nodes["node2"].busyness = 50
+	assert.Equal(t, "node1", dispatcher.getLeastBusyNode())
+	assert.Equal(t, 120, dispatcher.nodeBusyness(dispatcher.store.nodes["node2"]))
+
+	// once the runner reports the stats of the check, its weight hint is ignored
+	id := check.BuildID(device.Name, device.Instances[0], device.InitConfig)
+	dispatcher.store.nodes["node2"].clcRunnerStats = types.CLCRunnersStats{string(id): {MetricSamples: 250, IsClusterCheck: true}}
+	assert.Equal(t, "node2", dispatcher.getLeastBusyNode())
+	assert.Equal(t, 50, dispatcher.nodeBusyness(dispatcher.store.nodes["node2"]))
+
+	requireNotLocked(t, dispatcher.store)
+}
+
+// generateSNMPIntegration returns the cluster check of a device discovered by the SNMP listener
+// of the cluster agent, weighing the OID count of its profile
+func generateSNMPIntegration(ip string, oidCount int) integration.Config {
+	return integration.Config{
+		Name:         "snmp",
+		Instances:    []integration.Data{integration.Data("ip_address: " + ip)},
+		ClusterCheck: true,
+		WeightHint:   oidCount,
+	}
+}
+
+// nodeOfConfig returns the node a config is dispatched to
+func nodeOfConfig(t *testing.T, dispatcher *dispatcher, config integration.Config) string {
+	patched, err := dispatcher.patchConfiguration(config)
+	require.NoError(t, err)
+	dispatcher.store.RLock()
+	defer dispatcher.store.RUnlock()
+	node, found := dispatcher.store.digestToNode[patched.Digest()]
+	require.True(t, found, "config %s isn't dispatched", config.Instances[0])
+	return node
+}
+
+func TestDispatchSNMPDevicesThreeNodes(t *testing.T) {
+	dispatcher := newDispatcher()
+	dispatcher.processNodeStatus("nodeA", "10.0.0.1", types.NodeStatus{})
+	dispatcher.processNodeStatus("nodeB", "10.0.0.2", types.NodeStatus{})
+	dispatcher.processNodeStatus("nodeC", "10.0.0.3", types.NodeStatus{})
+
+	core := generateSNMPIntegration("10.1.0.1", 600)
+	distribution := generateSNMPIntegration("10.1.0.2", 300)
+	accessSwitches := []integration.Config{
+		generateSNMPIntegration("10.1.0.3", 100),
+		generateSNMPIntegration("10.1.0.4", 100),
+		generateSNMPIntegration("10.1.0.5", 100),
+	}
+	dispatcher.Schedule(append([]integration.Config{core, distribution}, accessSwitches...))
+
+	// The devices are balanced by OID count: the access switches together
+	// weigh as much as the distribution router, the core router is alone
+	coreNode := nodeOfConfig(t, dispatcher, core)
+	distributionNode := nodeOfConfig(t, dispatcher, distribution)
+	accessNode := nodeOfConfig(t, dispatcher, accessSwitches[0])
+	assert.ElementsMatch(t, []string{"nodeA", "nodeB", "nodeC"}, []string{coreNode, distributionNode, accessNode})
+	for _, config := range accessSwitches {
+		assert.Equal(t, accessNode, nodeOfConfig(t, dispatcher, config))
+	}
+	configs, _, err := dispatcher.getClusterCheckConfigs(coreNode)
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, 600, configs[0].WeightHint)
+
+	// The runner of the access switches is lost, its devices are dispatched
+	// again to the least busy runner without being discovered again
+	dispatcher.store.nodes[accessNode].heartbeat = timestampNow() - 35
+	dispatcher.expireNodes()
+	assert.Len(t, dispatcher.store.danglingConfigs, 3)
+	require.True(t, dispatcher.shouldDispatchDanling())
+	dispatcher.reschedule(dispatcher.retrieveAndClearDangling())
+	for _, config := range accessSwitches {
+		assert.Equal(t, distributionNode, nodeOfConfig(t, dispatcher, config))
+	}
+	allConfigs, err := dispatcher.getAllConfigs()
+	require.NoError(t, err)
+	assert.Len(t, allConfigs, 5)
+
+	// The eviction of a device unschedules its check from its runner,
+	// which pulls its configs again
+	dispatcher.store.nodes[coreNode].lastConfigChange = 0
+	dispatcher.Unschedule([]integration.Config{core})
+	configs, lastChange, err := dispatcher.getClusterCheckConfigs(coreNode)
+	require.NoError(t, err)
+	assert.Len(t, configs, 0)
+	assert.NotZero(t, lastChange)
+	allConfigs, err = dispatcher.getAllConfigs()
+	require.NoError(t, err)
+	assert.Len(t, allConfigs, 4)
+
+	requireNotLocked(t, dispatcher.store)
+}
+
 func TestDanglingConfig(t *testing.T) {
 	dispatcher := newDispatcher()
 	config := integration.Config{
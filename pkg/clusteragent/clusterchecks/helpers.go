@@ -54,6 +54,12 @@ func busynessFunc(s types.CLCRunnerStats) int {
 	return int(checkExecutionTimeWeight*float64(s.AverageExecutionTime) + checkMetricSamplesWeight*float64(s.MetricSamples))
 }
 
+// weightHintBusyness returns the busyness expected from a check before it runs, its weight hint
+// being the number of metric samples it should send
+func weightHintBusyness(weightHint int) int {
+	return int(checkMetricSamplesWeight * float64(weightHint))
+}
+
 // orderedKeys sorts the keys of a map and return them in a slice
 func orderedKeys(m map[string]int) []string {
 	keys := []string{}
@@ -118,6 +118,41 @@ func (s *nodeStore) removeConfig(digest string) {
 	dispatchedConfigs.Dec(s.name, le.JoinLeaderValue)
 }
 
+// configWeight returns the weight of the configs dispatched to the node, each config weighing
+// its weight hint, and 1 when it has none. The caller must hold the lock.
+func (s *nodeStore) configWeight() int {
+	weight := 0
+	for _, config := range s.digestToConfig {
+		if config.WeightHint > 1 {
+			weight += config.WeightHint
+		} else {
+			weight++
+		}
+	}
+	return weight
+}
+
+// estimatedBusyness returns the busyness expected from the configs dispatched to a node which its
+// runner doesn't report stats for yet, from the metric samples their weight hint is expected to
+// send. The caller must hold the store lock, not the node one.
+func (s *clusterStore) estimatedBusyness(node *nodeStore) int {
+	node.RLock()
+	defer node.RUnlock()
+	reported := make(map[string]struct{}, len(node.clcRunnerStats))
+	for id := range node.clcRunnerStats {
+		if digest, found := s.idToDigest[check.ID(id)]; found {
+			reported[digest] = struct{}{}
+		}
+	}
+	busyness := 0
+	for digest, config := range node.digestToConfig {
+		if _, found := reported[digest]; !found && config.WeightHint > 0 {
+			busyness += weightHintBusyness(config.WeightHint)
+		}
+	}
+	return busyness
+}
+
 // AddRunnerStats stores runner stats for a check
 // The nodeStore handles thread safety for this public method
 func (s *nodeStore) AddRunnerStats(checkID string, stats types.CLCRunnerStats) {
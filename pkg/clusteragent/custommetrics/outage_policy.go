@@ -0,0 +1,108 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// FallbackValueAnnotation is the annotation of the autoscalers and the DatadogMetrics setting
+// the value of their external metrics served by the static-fallback outage policy
+const FallbackValueAnnotation = "external-metrics.datadoghq.com/fallback-value"
+
+// OutagePolicy is how the external metrics are served while Datadog can't be queried,
+// the zero value being the default one, OutagePolicyFailClosed
+type OutagePolicy string
+
+const (
+	// OutagePolicyFailClosed invalidates the external metrics, the autoscalers stop scaling on them
+	OutagePolicyFailClosed OutagePolicy = "fail-closed"
+	// OutagePolicyHoldLastValue serves the last valid value of the external metrics with its
+	// timestamp, until it is older than the max age of the outage policy
+	OutagePolicyHoldLastValue OutagePolicy = "hold-last-value"
+	// OutagePolicyStaticFallback serves the value set by the FallbackValueAnnotation annotation,
+	// the metrics without one being invalidated
+	OutagePolicyStaticFallback OutagePolicy = "static-fallback"
+)
+
+// ParseOutagePolicy parses an outage policy, an empty one being the default one
+func ParseOutagePolicy(value string) (OutagePolicy, error) {
+	switch policy := OutagePolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "", OutagePolicyFailClosed:
+		return OutagePolicyFailClosed, nil
+	case OutagePolicyHoldLastValue, OutagePolicyStaticFallback:
+		return policy, nil
+	}
+	return OutagePolicyFailClosed, fmt.Errorf("unknown outage policy %q, it must be one of fail-closed, hold-last-value or static-fallback", value)
+}
+
+// OutagePolicyConfig is the outage policy of the external metrics and the max age of the values
+// held by the hold-last-value policy
+type OutagePolicyConfig struct {
+	Policy OutagePolicy
+	MaxAge time.Duration
+}
+
+// GetOutagePolicyConfig returns the outage policy configured, an invalid one falling back to
+// the fail-closed policy
+func GetOutagePolicyConfig() OutagePolicyConfig {
+	policy, err := ParseOutagePolicy(config.Datadog.GetString("external_metrics_provider.outage_policy"))
+	if err != nil {
+		log.Errorf("Invalid external_metrics_provider.outage_policy, the external metrics are invalidated while Datadog can't be queried: %v", err)
+	}
+	return OutagePolicyConfig{
+		Policy: policy,
+		MaxAge: time.Duration(config.Datadog.GetInt64("external_metrics_provider.outage_max_age")) * time.Second,
+	}
+}
+
+// Serve returns the value of an external metric to serve while Datadog can't be queried and
+// its timestamp, from its last valid value and time or its fallback value, nil when it has
+// none. It returns false when the metric must be invalidated.
+func (c OutagePolicyConfig) Serve(lastValue float64, lastValidTime time.Time, fallbackValue *float64, now time.Time) (float64, time.Time, bool) {
+	switch c.Policy {
+	case OutagePolicyHoldLastValue:
+		if lastValidTime.IsZero() || c.Expired(OutagePolicyHoldLastValue, lastValidTime, now) {
+			return 0, time.Time{}, false
+		}
+		return lastValue, lastValidTime, true
+	case OutagePolicyStaticFallback:
+		if fallbackValue == nil {
+			return 0, time.Time{}, false
+		}
+		return *fallbackValue, now, true
+	}
+	return 0, time.Time{}, false
+}
+
+// Expired returns whether a value served by an outage policy with the given timestamp must not
+// be served anymore: the values held by the hold-last-value policy expire after its max age.
+func (c OutagePolicyConfig) Expired(policy OutagePolicy, timestamp time.Time, now time.Time) bool {
+	return policy == OutagePolicyHoldLastValue && now.Sub(timestamp) > c.MaxAge
+}
+
+// FallbackValueFromAnnotations returns the fallback value set by the annotations of an object,
+// nil when it has none or an invalid one
+func FallbackValueFromAnnotations(annotations map[string]string, kind, namespace, name string) *float64 {
+	raw, found := annotations[FallbackValueAnnotation]
+	if !found {
+		return nil
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		log.Warnf("Ignoring the annotation %s of the %s %s/%s: %v", FallbackValueAnnotation, kind, namespace, name, err)
+		return nil
+	}
+	return &value
+}
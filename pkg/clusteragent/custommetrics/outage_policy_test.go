@@ -0,0 +1,81 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutagePolicy(t *testing.T) {
+	for value, expected := range map[string]OutagePolicy{
+		"":                  OutagePolicyFailClosed,
+		"fail-closed":       OutagePolicyFailClosed,
+		" Hold-Last-Value ": OutagePolicyHoldLastValue,
+		"static-fallback":   OutagePolicyStaticFallback,
+	} {
+		policy, err := ParseOutagePolicy(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, policy, value)
+	}
+
+	policy, err := ParseOutagePolicy("fail-open")
+	assert.Error(t, err)
+	assert.Equal(t, OutagePolicyFailClosed, policy)
+}
+
+func TestOutagePolicyServe(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fallback := 3.0
+
+	hold := OutagePolicyConfig{Policy: OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute}
+	value, timestamp, ok := hold.Serve(10, now.Add(-10*time.Minute), &fallback, now)
+	assert.True(t, ok)
+	assert.Equal(t, 10.0, value)
+	// the held value keeps its original timestamp
+	assert.Equal(t, now.Add(-10*time.Minute), timestamp)
+	_, _, ok = hold.Serve(10, now.Add(-10*time.Minute-time.Second), &fallback, now)
+	assert.False(t, ok)
+	// a metric which was never valid has no value to hold
+	_, _, ok = hold.Serve(0, time.Time{}, &fallback, now)
+	assert.False(t, ok)
+
+	static := OutagePolicyConfig{Policy: OutagePolicyStaticFallback}
+	value, timestamp, ok = static.Serve(10, now.Add(-time.Hour), &fallback, now)
+	assert.True(t, ok)
+	assert.Equal(t, 3.0, value)
+	assert.Equal(t, now, timestamp)
+	_, _, ok = static.Serve(10, now, nil, now)
+	assert.False(t, ok)
+
+	_, _, ok = OutagePolicyConfig{Policy: OutagePolicyFailClosed}.Serve(10, now, &fallback, now)
+	assert.False(t, ok)
+}
+
+func TestOutagePolicyExpired(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	config := OutagePolicyConfig{Policy: OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute}
+
+	assert.False(t, config.Expired(OutagePolicyHoldLastValue, now.Add(-10*time.Minute), now))
+	assert.True(t, config.Expired(OutagePolicyHoldLastValue, now.Add(-11*time.Minute), now))
+	// only the held values expire
+	assert.False(t, config.Expired(OutagePolicyStaticFallback, now.Add(-time.Hour), now))
+	assert.False(t, config.Expired("", now.Add(-time.Hour), now))
+}
+
+func TestFallbackValueFromAnnotations(t *testing.T) {
+	assert.Nil(t, FallbackValueFromAnnotations(nil, "HorizontalPodAutoscaler", "default", "foo"))
+	value := FallbackValueFromAnnotations(map[string]string{FallbackValueAnnotation: " 2.5"}, "HorizontalPodAutoscaler", "default", "foo")
+	require.NotNil(t, value)
+	assert.Equal(t, 2.5, *value)
+	// the invalid values are ignored
+	assert.Nil(t, FallbackValueFromAnnotations(map[string]string{FallbackValueAnnotation: "high"}, "HorizontalPodAutoscaler", "default", "foo"))
+}
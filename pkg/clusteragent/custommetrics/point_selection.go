@@ -0,0 +1,53 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// PointSelectionAnnotation is the annotation of the autoscalers and the DatadogMetrics
+// selecting the point of the query window reported as the value of their external metrics
+const PointSelectionAnnotation = "external-metrics.datadoghq.com/point-selection"
+
+// PointSelection selects the value of an external metric among the points of its query window,
+// the zero value being the default one, PointSelectionLast
+type PointSelection string
+
+const (
+	// PointSelectionLast reports the most recent point
+	PointSelectionLast PointSelection = "last"
+	// PointSelectionMax reports the highest point, so that a single low point doesn't scale down
+	PointSelectionMax PointSelection = "max"
+	// PointSelectionMin reports the lowest point
+	PointSelectionMin PointSelection = "min"
+	// PointSelectionAvg reports the average of the points
+	PointSelectionAvg PointSelection = "avg"
+)
+
+// ParsePointSelection parses a point selection, an empty one being the default one
+func ParsePointSelection(value string) (PointSelection, error) {
+	switch selection := PointSelection(strings.ToLower(strings.TrimSpace(value))); selection {
+	case "", PointSelectionLast, PointSelectionMax, PointSelectionMin, PointSelectionAvg:
+		return selection, nil
+	}
+	return "", fmt.Errorf("unknown point selection %q, it must be one of last, max, min or avg", value)
+}
+
+// PointSelectionFromAnnotations returns the point selection set by the annotations of an
+// object, the invalid ones falling back to the default one
+func PointSelectionFromAnnotations(annotations map[string]string, kind, namespace, name string) PointSelection {
+	selection, err := ParsePointSelection(annotations[PointSelectionAnnotation])
+	if err != nil {
+		log.Warnf("Ignoring the annotation %s of the %s %s/%s: %v", PointSelectionAnnotation, kind, namespace, name, err)
+	}
+	return selection
+}
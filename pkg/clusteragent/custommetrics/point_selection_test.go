@@ -0,0 +1,42 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package custommetrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePointSelection(t *testing.T) {
+	for value, expected := range map[string]PointSelection{
+		"":      "",
+		"last":  PointSelectionLast,
+		"max":   PointSelectionMax,
+		" Min ": PointSelectionMin,
+		"AVG":   PointSelectionAvg,
+	} {
+		selection, err := ParsePointSelection(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, selection, value)
+	}
+
+	for _, value := range []string{"mean", "p95", "max,min"} {
+		selection, err := ParsePointSelection(value)
+		assert.Error(t, err, value)
+		assert.Equal(t, PointSelection(""), selection, value)
+	}
+}
+
+func TestPointSelectionFromAnnotations(t *testing.T) {
+	assert.Equal(t, PointSelection(""), PointSelectionFromAnnotations(nil, "HorizontalPodAutoscaler", "default", "foo"))
+	assert.Equal(t, PointSelectionMax, PointSelectionFromAnnotations(map[string]string{PointSelectionAnnotation: "max"}, "HorizontalPodAutoscaler", "default", "foo"))
+	// the invalid values fall back to the default point selection
+	assert.Equal(t, PointSelection(""), PointSelectionFromAnnotations(map[string]string{PointSelectionAnnotation: "median"}, "HorizontalPodAutoscaler", "default", "foo"))
+}
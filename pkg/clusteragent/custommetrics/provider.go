@@ -45,16 +45,18 @@ type datadogProvider struct {
 	isServing       bool
 	timestamp       int64
 	maxAge          int64
+	outagePolicy    OutagePolicyConfig
 }
 
 // NewDatadogProvider creates a Custom Metrics and External Metrics Provider.
 func NewDatadogProvider(ctx context.Context, client dynamic.Interface, mapper apimeta.RESTMapper, store Store) provider.MetricsProvider {
 	maxAge := config.Datadog.GetInt64("external_metrics_provider.local_copy_refresh_rate")
 	d := &datadogProvider{
-		client: client,
-		mapper: mapper,
-		store:  store,
-		maxAge: maxAge,
+		client:       client,
+		mapper:       mapper,
+		store:        store,
+		maxAge:       maxAge,
+		outagePolicy: GetOutagePolicyConfig(),
 	}
 	go d.externalMetricsSetter(ctx)
 	return d
@@ -83,6 +85,11 @@ func (p *datadogProvider) externalMetricsSetter(ctx context.Context) {
 				if !metric.Valid {
 					continue
 				}
+				// The values held while Datadog can't be queried are not served past the max age of the outage policy,
+				// even before the next refresh invalidates them.
+				if p.outagePolicy.Expired(metric.Outage, time.Unix(metric.Timestamp, 0), time.Now()) {
+					continue
+				}
 				var extMetric externalMetric
 				extMetric.info = provider.ExternalMetricInfo{
 					Metric: metric.MetricName,
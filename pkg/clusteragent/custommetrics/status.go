@@ -8,7 +8,10 @@
 package custommetrics
 
 import (
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"sort"
 
 	"k8s.io/client-go/kubernetes"
 
@@ -24,6 +27,20 @@ func GetStatus(apiCl kubernetes.Interface) map[string]interface{} {
 		return status
 	}
 
+	if rateLimit := getRateLimitStatus(); rateLimit != nil {
+		status["RateLimit"] = rateLimit
+	}
+
+	if limits := getMetricLimitsStatus(); limits != nil {
+		status["Limits"] = limits
+	}
+
+	if queryCosts := getQueryCostsStatus(); queryCosts != nil {
+		status["QueryCosts"] = queryCosts
+	}
+
+	status["Outage"] = getOutageStatus()
+
 	if config.Datadog.GetBool("external_metrics_provider.use_datadogmetric_crd") {
 		status["NoStatus"] = "External metrics provider uses DatadogMetric - Check status directly from Kubernetes with: `kubectl get datadogmetric`"
 		return status
@@ -59,3 +76,115 @@ func GetStatus(apiCl kubernetes.Interface) map[string]interface{} {
 
 	return status
 }
+
+// getRateLimitStatus returns the state of the guard pausing the queries to Datadog before the
+// rate limit is exhausted, read from its expvar as the autoscalers package depends on this one.
+func getRateLimitStatus() map[string]interface{} {
+	rateLimitVar := expvar.Get("external-metrics-rate-limit")
+	if rateLimitVar == nil {
+		return nil
+	}
+	rateLimit := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(rateLimitVar.String()), &rateLimit); err != nil {
+		return nil
+	}
+	return rateLimit
+}
+
+// getMetricLimitsStatus returns the limits on the number of external metrics served, nil when none is set,
+// and the number of metrics served and over the limits read from the expvar of the autoscalers package.
+func getMetricLimitsStatus() map[string]interface{} {
+	maxMetrics := config.Datadog.GetInt("external_metrics_provider.max_metrics")
+	maxPerNamespace := config.Datadog.GetInt("external_metrics_provider.max_metrics_per_namespace")
+	if maxMetrics <= 0 && maxPerNamespace <= 0 {
+		return nil
+	}
+	limits := map[string]interface{}{
+		"MaxMetrics":             maxMetrics,
+		"MaxMetricsPerNamespace": maxPerNamespace,
+	}
+
+	limitsVar := expvar.Get("external-metrics-limits")
+	if limitsVar == nil {
+		return limits
+	}
+	counts := make(map[string]int64)
+	if err := json.Unmarshal([]byte(limitsVar.String()), &counts); err == nil {
+		limits["Served"] = counts["Served"]
+		limits["Rejected"] = counts["Rejected"]
+	}
+	return limits
+}
+
+// getOutageStatus returns the outage policy of the external metrics, and whether it is applied as
+// Datadog can't be queried, read from the expvar of the autoscalers package once the metrics were
+// refreshed.
+func getOutageStatus() map[string]interface{} {
+	policy := GetOutagePolicyConfig()
+	outage := map[string]interface{}{
+		"Policy": string(policy.Policy),
+	}
+	if policy.Policy == OutagePolicyHoldLastValue {
+		outage["MaxAge"] = policy.MaxAge.String()
+	}
+
+	outageVar := expvar.Get("external-metrics-outage")
+	if outageVar == nil {
+		return outage
+	}
+	state := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(outageVar.String()), &state); err == nil {
+		if active, _ := state["Active"].(float64); active == 1 {
+			outage["Active"] = true
+			outage["Since"] = state["Since"]
+			outage["Served"] = state["Served"]
+		}
+	}
+	return outage
+}
+
+// maxQueryCostsStatus is the number of metrics with the most API calls shown in the status
+const maxQueryCostsStatus = 10
+
+// metricQueryCost is the usage of the Datadog API attributed to an external metric
+type metricQueryCost struct {
+	Metric      string   `json:"metric"`
+	Queries     int64    `json:"queries"`
+	APICalls    float64  `json:"api_calls"`
+	Autoscalers []string `json:"autoscalers"`
+}
+
+// getQueryCostsStatus returns the metrics with the most calls to the query API attributed, read from
+// the expvar of the autoscalers package, and the total of the calls.
+func getQueryCostsStatus() map[string]interface{} {
+	queryCostsVar := expvar.Get("external-metrics-query-costs")
+	if queryCostsVar == nil {
+		return nil
+	}
+	costs := make(map[string]metricQueryCost)
+	if err := json.Unmarshal([]byte(queryCostsVar.String()), &costs); err != nil || len(costs) == 0 {
+		return nil
+	}
+
+	top := make([]metricQueryCost, 0, len(costs))
+	var totalCalls float64
+	for metric, cost := range costs {
+		cost.Metric = metric
+		top = append(top, cost)
+		totalCalls += cost.APICalls
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].APICalls != top[j].APICalls {
+			return top[i].APICalls > top[j].APICalls
+		}
+		return top[i].Metric < top[j].Metric
+	})
+	if len(top) > maxQueryCostsStatus {
+		top = top[:maxQueryCostsStatus]
+	}
+	return map[string]interface{}{
+		"TotalCalls": totalCalls,
+		"Metrics":    len(costs),
+		"Top":        top,
+	}
+}
@@ -91,11 +91,37 @@ func (c *configMapStore) SetExternalMetricValues(added map[string]ExternalMetric
 	if c.cm == nil {
 		return errNotInitialized
 	}
+	c.setData(added, false)
+	err := c.updateConfigMap()
+	if !errors.IsConflict(err) {
+		return err
+	}
+
+	// Another replica updated the configmap since it was read, which happens when two of them briefly
+	// believe they are the leader. Merge with its values instead of overwriting the newer ones.
+	log.Infof("The configmap %s was updated concurrently, merging the external metrics", c.name)
+	if err = c.getConfigMap(); err != nil {
+		return err
+	}
+	c.setData(added, true)
+	return c.updateConfigMap()
+}
+
+// setData writes the external metrics in the local copy of the configmap. With onlyNewer, the metrics
+// already stored with a more recent timestamp are kept.
+func (c *configMapStore) setData(added map[string]ExternalMetricValue, onlyNewer bool) {
 	if c.cm.Data == nil {
 		// Don't panic "assignment to entry in nil map" at init
 		c.cm.Data = make(map[string]string)
 	}
 	for key, m := range added {
+		if onlyNewer {
+			stored := ExternalMetricValue{}
+			if raw, found := c.cm.Data[key]; found && json.Unmarshal([]byte(raw), &stored) == nil && stored.Timestamp > m.Timestamp {
+				log.Debugf("Keeping the more recent value of the external metric %s stored by another replica", key)
+				continue
+			}
+		}
 		toStore, err := json.Marshal(m)
 		if err != nil {
 			log.Debugf("Could not marshal the external metric %v: %v", m, err)
@@ -103,7 +129,6 @@ func (c *configMapStore) SetExternalMetricValues(added map[string]ExternalMetric
 		}
 		c.cm.Data[key] = string(toStore)
 	}
-	return c.updateConfigMap()
 }
 
 // DeleteExternalMetricValues deletes the external metrics from the store.
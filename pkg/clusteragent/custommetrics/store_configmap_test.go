@@ -17,8 +17,12 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
 )
 
 func TestNewConfigMapStore(t *testing.T) {
@@ -314,6 +318,45 @@ func TestConfigMapStoreExternalMetrics(t *testing.T) {
 	}
 }
 
+func TestConfigMapStoreConcurrentLeaders(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	leader, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+	formerLeader, err := NewConfigMapStore(client, "default", "foo")
+	require.NoError(t, err)
+
+	ref := ObjectReference{Type: "horizontal", Name: "foo", Namespace: "default"}
+	requests := ExternalMetricValue{MetricName: "requests_per_s", Ref: ref, Value: 2, Timestamp: 200, Valid: true}
+	require.NoError(t, leader.SetExternalMetricValues(map[string]ExternalMetricValue{
+		ExternalMetricValueKeyFunc(requests): requests,
+	}))
+
+	// the former leader still holds the configmap it read before the update of the new leader
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action core.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "foo", fmt.Errorf("stale resource version"))
+	})
+
+	staleRequests := requests
+	staleRequests.Value = 1
+	staleRequests.Timestamp = 100
+	latency := ExternalMetricValue{MetricName: "latency", Ref: ref, Value: 3, Timestamp: 100, Valid: true}
+	require.NoError(t, formerLeader.SetExternalMetricValues(map[string]ExternalMetricValue{
+		ExternalMetricValueKeyFunc(staleRequests): staleRequests,
+		ExternalMetricValueKeyFunc(latency):       latency,
+	}))
+	assert.Equal(t, 1, conflicts)
+
+	// the more recent value of the new leader is kept
+	bundle, err := leader.ListAllExternalMetricValues()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ExternalMetricValue{requests, latency}, bundle.External)
+}
+
 func TestExternalMetricValueKeyFunc(t *testing.T) {
 	test := []struct {
 		desc   string
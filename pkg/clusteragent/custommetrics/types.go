@@ -14,6 +14,24 @@ type ExternalMetricValue struct {
 	Ref        ObjectReference   `json:"reference"`
 	Value      float64           `json:"value"`
 	Valid      bool              `json:"valid"`
+	// Conversion is the unit conversion applied to Value, nil if the metric has none
+	Conversion *UnitConversion `json:"conversion,omitempty"`
+	// PointSelection selects Value among the points of the query window, the last one if empty
+	PointSelection PointSelection `json:"pointSelection,omitempty"`
+	// ValueTimestamp is the timestamp of the point Value was selected from, Timestamp being the
+	// end of the query window
+	ValueTimestamp int64 `json:"valueTs,omitempty"`
+	// FallbackValue is the value served by the static-fallback outage policy, nil if the metric has none
+	FallbackValue *float64 `json:"fallbackValue,omitempty"`
+	// Outage is the outage policy Value is served by while Datadog can't be queried, empty otherwise
+	Outage OutagePolicy `json:"outage,omitempty"`
+}
+
+// UnitConversion records the unit conversion applied to the value of an external metric.
+type UnitConversion struct {
+	Spec     string  `json:"spec"`
+	Factor   float64 `json:"factor"`
+	RawValue float64 `json:"rawValue"`
 }
 
 type DeprecatedExternalMetricValue struct {
@@ -31,6 +49,9 @@ type ObjectReference struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
 	UID       string `json:"uid"`
+	// CreationTimestamp is the creation time of the autoscaler in seconds, it orders the metrics
+	// admitted when the number of external metrics served is limited
+	CreationTimestamp int64 `json:"creationTimestamp,omitempty"`
 }
 
 type MetricsBundle struct {
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 
 	datadoghq "github.com/DataDog/datadog-operator/api/v1alpha1"
@@ -52,6 +53,9 @@ type DatadogMetricController struct {
 	store     *DatadogMetricsInternalStore
 	isLeader  func() bool
 	context   context.Context
+	// errorStatusUpdateInterval is the minimum interval between two status updates of a DatadogMetric
+	// whose status didn't change while it stays invalid, as its update time changes on each refresh
+	errorStatusUpdateInterval time.Duration
 }
 
 // NewDatadogMetricController returns a new AutoscalersController
@@ -68,6 +72,8 @@ func NewDatadogMetricController(client dynamic.Interface, informer dynamicinform
 		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultItemBasedRateLimiter(), "datadogmetrics"),
 		store:     store,
 		isLeader:  isLeader,
+
+		errorStatusUpdateInterval: time.Duration(config.Datadog.GetInt("external_metrics_provider.error_status_update_interval")) * time.Second,
 	}
 
 	datadogMetricsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -270,6 +276,9 @@ func (c *DatadogMetricController) syncDatadogMetric(ns, name, datadogMetricKey s
 	// Spec source of truth is Kubernetes object
 	// Status source of truth is our local store
 	datadogMetricInternal.UpdateFrom(datadogMetric.Spec)
+	datadogMetricInternal.UpdatePointSelectionFrom(datadogMetric.ObjectMeta)
+	datadogMetricInternal.UpdateFallbackValueFrom(datadogMetric.ObjectMeta)
+	datadogMetricInternal.CreationTime = datadogMetric.CreationTimestamp.Time
 	defer c.store.UnlockSet(datadogMetricInternal.ID, *datadogMetricInternal, ddmControllerStoreID)
 
 	if datadogMetricInternal.IsNewerThan(datadogMetric.Status) {
@@ -320,6 +329,10 @@ func (c *DatadogMetricController) createDatadogMetric(ns, name string, datadogMe
 
 func (c *DatadogMetricController) updateDatadogMetric(ns, name string, datadogMetricInternal *model.DatadogMetricInternal, datadogMetric *datadoghq.DatadogMetric) error {
 	newStatus := datadogMetricInternal.BuildStatus(&datadogMetric.Status)
+	if newStatus != nil && c.shouldSkipStatusUpdate(datadogMetricInternal, &datadogMetric.Status, newStatus, time.Now()) {
+		log.Debugf("Status of invalid DatadogMetric: %s/%s didn't change, not updating it", ns, name)
+		return nil
+	}
 	if newStatus != nil {
 		log.Debugf("Updating status of DatadogMetric: %s/%s", ns, name)
 		datadogMetric := &datadoghq.DatadogMetric{
@@ -347,6 +360,39 @@ func (c *DatadogMetricController) updateDatadogMetric(ns, name string, datadogMe
 	return nil
 }
 
+// shouldSkipStatusUpdate returns whether the status of an invalid DatadogMetric can be left as is, because
+// only the update times of its conditions changed since it was last updated less than errorStatusUpdateInterval ago
+func (c *DatadogMetricController) shouldSkipStatusUpdate(datadogMetricInternal *model.DatadogMetricInternal, currentStatus, newStatus *datadoghq.DatadogMetricStatus, now time.Time) bool {
+	if datadogMetricInternal.Valid || c.errorStatusUpdateInterval <= 0 || statusContentChanged(currentStatus, newStatus) {
+		return false
+	}
+	for _, condition := range currentStatus.Conditions {
+		if condition.Type == datadoghq.DatadogMetricConditionTypeUpdated {
+			return now.Sub(condition.LastUpdateTime.Time) < c.errorStatusUpdateInterval
+		}
+	}
+	return false
+}
+
+// statusContentChanged returns whether two statuses differ by more than the update and transition times of their conditions
+func statusContentChanged(currentStatus, newStatus *datadoghq.DatadogMetricStatus) bool {
+	if currentStatus.Value != newStatus.Value ||
+		currentStatus.AutoscalerReferences != newStatus.AutoscalerReferences ||
+		len(currentStatus.Conditions) != len(newStatus.Conditions) {
+		return true
+	}
+	for i := range newStatus.Conditions {
+		current, updated := &currentStatus.Conditions[i], &newStatus.Conditions[i]
+		if current.Type != updated.Type ||
+			current.Status != updated.Status ||
+			current.Reason != updated.Reason ||
+			current.Message != updated.Message {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *DatadogMetricController) deleteDatadogMetric(ns, name string) error {
 	log.Infof("Deleting DatadogMetric: %s/%s", ns, name)
 	err := c.clientSet.Resource(gvrDDM).Namespace(ns).Delete(context.TODO(), name, metav1.DeleteOptions{})
@@ -178,6 +178,7 @@ func TestLeaderHandlingNewMetric(t *testing.T) {
 				Status:             corev1.ConditionFalse,
 				LastTransitionTime: updateTimeKube,
 				LastUpdateTime:     updateTimeKube,
+				Message:            "Query: metric query0",
 			},
 			{
 				Type:               datadoghq.DatadogMetricConditionTypeUpdated,
@@ -737,3 +738,102 @@ func TestFollower(t *testing.T) {
 	ddm.SetQueries("metric query1")
 	assert.Equal(t, &ddm, f.store.Get("default/autogen-1"))
 }
+
+// Scenario: The background process failed again with the same error
+// We check that the status of the invalid DatadogMetric isn't updated again before errorStatusUpdateInterval
+func TestLeaderNoUpdateRepeatedError(t *testing.T) {
+	f := newFixture(t)
+
+	prevUpdateTime := time.Now().Add(-10 * time.Second)
+	prevUpdateTimeKube := metav1.NewTime(prevUpdateTime)
+	metric, metricTyped := newFakeDatadogMetric("default", "dd-metric-0", "metric query0", datadoghq.DatadogMetricStatus{
+		Value: "0",
+		Conditions: []datadoghq.DatadogMetricCondition{
+			{
+				Type:               datadoghq.DatadogMetricConditionTypeActive,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: prevUpdateTimeKube,
+				LastUpdateTime:     prevUpdateTimeKube,
+			},
+			{
+				Type:               datadoghq.DatadogMetricConditionTypeValid,
+				Status:             corev1.ConditionFalse,
+				LastTransitionTime: prevUpdateTimeKube,
+				LastUpdateTime:     prevUpdateTimeKube,
+				Message:            "Query: metric query0",
+			},
+			{
+				Type:               datadoghq.DatadogMetricConditionTypeUpdated,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: prevUpdateTimeKube,
+				LastUpdateTime:     prevUpdateTimeKube,
+			},
+			{
+				Type:               datadoghq.DatadogMetricConditionTypeError,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: prevUpdateTimeKube,
+				LastUpdateTime:     prevUpdateTimeKube,
+				Reason:             model.DatadogMetricErrorConditionReason,
+				Message:            "No data from backend, query: metric query0",
+			},
+		},
+	})
+
+	f.datadogMetricLister = append(f.datadogMetricLister, metric)
+	f.objects = append(f.objects, metricTyped)
+	ddm := model.DatadogMetricInternal{
+		ID:         "default/dd-metric-0",
+		Active:     true,
+		Valid:      false,
+		UpdateTime: time.Now(),
+		Error:      fmt.Errorf("No data from backend, query: metric query0"),
+	}
+	ddm.SetQueries("metric query0")
+	f.store.Set("default/dd-metric-0", ddm, "utest")
+
+	f.runControllerSync(true, "default/dd-metric-0", nil)
+}
+
+func TestShouldSkipStatusUpdate(t *testing.T) {
+	c := &DatadogMetricController{errorStatusUpdateInterval: time.Minute}
+	now := time.Now()
+	prevUpdateTime := now.Add(-10 * time.Second)
+
+	ddm := model.DatadogMetricInternal{
+		ID:            "default/dd-metric-0",
+		Active:        true,
+		UpdateTime:    prevUpdateTime,
+		Error:         fmt.Errorf("No data from backend, query: metric query0"),
+		LastValidTime: now.Add(-time.Hour),
+	}
+	ddm.SetQueries("metric query0")
+	currentStatus := ddm.BuildStatus(nil)
+
+	// only the update times changed
+	ddm.UpdateTime = now
+	newStatus := ddm.BuildStatus(currentStatus)
+	assert.False(t, statusContentChanged(currentStatus, newStatus))
+	assert.True(t, c.shouldSkipStatusUpdate(&ddm, currentStatus, newStatus, now))
+	// until the last update is older than the interval
+	assert.False(t, c.shouldSkipStatusUpdate(&ddm, currentStatus, newStatus, now.Add(time.Minute)))
+
+	// the error changed
+	ddm.Error = fmt.Errorf("Outdated result from backend, query: metric query0")
+	newStatus = ddm.BuildStatus(currentStatus)
+	assert.True(t, statusContentChanged(currentStatus, newStatus))
+	assert.False(t, c.shouldSkipStatusUpdate(&ddm, currentStatus, newStatus, now))
+
+	// the DatadogMetric is valid again
+	ddm.Error = nil
+	ddm.Valid = true
+	newStatus = ddm.BuildStatus(currentStatus)
+	assert.True(t, statusContentChanged(currentStatus, newStatus))
+	assert.False(t, c.shouldSkipStatusUpdate(&ddm, currentStatus, newStatus, now))
+
+	// the valid DatadogMetrics are always updated, their update time is the timestamp of their value
+	currentStatus = newStatus
+	ddm.UpdateTime = now.Add(time.Second)
+	newStatus = ddm.BuildStatus(currentStatus)
+	assert.False(t, statusContentChanged(currentStatus, newStatus))
+	assert.False(t, c.shouldSkipStatusUpdate(&ddm, currentStatus, newStatus, now))
+}
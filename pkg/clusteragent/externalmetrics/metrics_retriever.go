@@ -11,9 +11,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/autoscalers"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
@@ -21,6 +24,8 @@ const (
 	invalidMetricOutdatedErrorMessage string = "Outdated result from backend, query: %s"
 	invalidMetricNoDataErrorMessage   string = "No data from backend, query: %s"
 	invalidMetricGlobalErrorMessage   string = "Global error (all queries) from backend"
+	outageMetricErrorMessage          string = "Global error (all queries) from backend, value served by the %s outage policy"
+	limitExceededErrorMessage         string = "Not served, over %s"
 	metricRetrieverStoreID            string = "mr"
 )
 
@@ -30,6 +35,11 @@ type MetricsRetriever struct {
 	processor     autoscalers.ProcessorInterface
 	store         *DatadogMetricsInternalStore
 	isLeader      func() bool
+	retryPolicy   *retryPolicy
+	outagePolicy  custommetrics.OutagePolicyConfig
+	// overLimits holds the DatadogMetrics over the limits on the number of external metrics
+	// served at the last refresh
+	overLimits map[string]struct{}
 }
 
 func NewMetricsRetriever(refreshPeriod, metricsMaxAge int64, processor autoscalers.ProcessorInterface, isLeader func() bool, store *DatadogMetricsInternalStore) (*MetricsRetriever, error) {
@@ -39,6 +49,8 @@ func NewMetricsRetriever(refreshPeriod, metricsMaxAge int64, processor autoscale
 		processor:     processor,
 		store:         store,
 		isLeader:      isLeader,
+		retryPolicy:   newRetryPolicy(time.Duration(refreshPeriod) * time.Second),
+		outagePolicy:  custommetrics.GetOutagePolicyConfig(),
 	}, nil
 }
 
@@ -60,12 +72,31 @@ func (mr *MetricsRetriever) Run(stopCh <-chan struct{}) {
 
 func (mr *MetricsRetriever) retrieveMetricsValues() {
 	// We only update active DatadogMetrics
-	datadogMetrics := mr.store.GetFiltered(func(datadogMetric model.DatadogMetricInternal) bool { return datadogMetric.Active })
-	if len(datadogMetrics) == 0 {
+	activeDatadogMetrics := mr.store.GetFiltered(func(datadogMetric model.DatadogMetricInternal) bool { return datadogMetric.Active })
+	mr.retryPolicy.cleanup(activeDatadogMetrics)
+	defer mr.retryPolicy.updateExpvars()
+	// the DatadogMetrics over the limits are invalid and not queried
+	activeDatadogMetrics = mr.admitDatadogMetrics(activeDatadogMetrics)
+	// the query costs of the DatadogMetrics which aren't refreshed anymore aren't reported
+	autoscalers.PruneQueryCosts(getUniqueQueries(activeDatadogMetrics))
+	if len(activeDatadogMetrics) == 0 {
 		log.Debugf("No active DatadogMetric, nothing to refresh")
 		return
 	}
 
+	// Invalid DatadogMetrics are only queried when their retry is due
+	now := time.Now().UTC()
+	datadogMetrics := make([]model.DatadogMetricInternal, 0, len(activeDatadogMetrics))
+	for _, datadogMetric := range activeDatadogMetrics {
+		if mr.retryPolicy.shouldQuery(datadogMetric, now) {
+			datadogMetrics = append(datadogMetrics, datadogMetric)
+		}
+	}
+	if len(datadogMetrics) == 0 {
+		log.Debugf("No DatadogMetric to refresh, %d invalid DatadogMetrics are waiting for their next retry", len(activeDatadogMetrics))
+		return
+	}
+
 	queries := getUniqueQueries(datadogMetrics)
 	log.Debugf("Starting refreshing external metrics with: %d queries", len(queries))
 
@@ -79,6 +110,8 @@ func (mr *MetricsRetriever) retrieveMetricsValues() {
 
 	// Update store with current results
 	currentTime := time.Now().UTC()
+	served := 0
+	defer func() { autoscalers.ReportOutage(mr.outagePolicy, globalError, served, currentTime) }()
 	for _, datadogMetric := range datadogMetrics {
 		datadogMetricFromStore := mr.store.LockRead(datadogMetric.ID, false)
 		if datadogMetricFromStore == nil {
@@ -87,38 +120,57 @@ func (mr *MetricsRetriever) retrieveMetricsValues() {
 			continue
 		}
 
+		// the values served by the outage policy are replaced as soon as Datadog can be queried again
+		servedByOutagePolicy := datadogMetricFromStore.Outage
+		datadogMetricFromStore.Outage = ""
+
 		query := datadogMetric.Query()
 		if queryResult, found := results[query]; found {
 			log.Debugf("QueryResult from DD for %q: %v", query, queryResult)
 
 			if queryResult.Valid {
-				datadogMetricFromStore.Value = queryResult.Value
+				// the freshness is checked from the end of the query window, whatever the point selected
+				selected := queryResult.Select(datadogMetric.PointSelection)
+				datadogMetricFromStore.Value = selected.Value
 
 				// If we get a valid but old metric, flag it as invalid
 				maxAge := datadogMetric.MaxAge
 				if maxAge == 0 {
 					maxAge = time.Duration(mr.metricsMaxAge) * time.Second
 				}
+				// the point is expected to be older when the query window accounts for the ingestion lag
+				maxAge += time.Duration(queryResult.IngestionDelay) * time.Second
 
 				if time.Duration(currentTime.Unix()-queryResult.Timestamp)*time.Second <= maxAge {
+					mr.retryPolicy.recordSuccess(datadogMetric.ID)
 					datadogMetricFromStore.Valid = true
 					datadogMetricFromStore.Error = nil
 					datadogMetricFromStore.UpdateTime = time.Unix(queryResult.Timestamp, 0).UTC()
+					datadogMetricFromStore.LastValidTime = datadogMetricFromStore.UpdateTime
+					datadogMetricFromStore.ValueTime = time.Unix(selected.Timestamp, 0).UTC()
 				} else {
 					datadogMetricFromStore.Valid = false
 					datadogMetricFromStore.Error = fmt.Errorf(invalidMetricOutdatedErrorMessage, query)
 					datadogMetricFromStore.UpdateTime = currentTime
 				}
 			} else {
+				mr.retryPolicy.recordFailure(datadogMetric, currentTime)
 				datadogMetricFromStore.Valid = false
-				datadogMetricFromStore.Error = fmt.Errorf(invalidMetricBackendErrorMessage, query)
+				if queryResult.Error != nil {
+					datadogMetricFromStore.Error = queryResult.Error
+				} else {
+					datadogMetricFromStore.Error = fmt.Errorf(invalidMetricBackendErrorMessage, query)
+				}
 				datadogMetricFromStore.UpdateTime = currentTime
 			}
+		} else if globalError && mr.serveDuringOutage(datadogMetricFromStore, servedByOutagePolicy, currentTime) {
+			served++
 		} else {
 			datadogMetricFromStore.Valid = false
 			if globalError {
 				datadogMetricFromStore.Error = fmt.Errorf(invalidMetricGlobalErrorMessage)
 			} else {
+				mr.retryPolicy.recordFailure(datadogMetric, currentTime)
 				datadogMetricFromStore.Error = fmt.Errorf(invalidMetricNoDataErrorMessage, query)
 			}
 			datadogMetricFromStore.UpdateTime = currentTime
@@ -128,6 +180,65 @@ func (mr *MetricsRetriever) retrieveMetricsValues() {
 	}
 }
 
+// admitDatadogMetrics returns the DatadogMetrics within the limits on the number of external
+// metrics served, the ones over the limits being flagged as invalid.
+func (mr *MetricsRetriever) admitDatadogMetrics(datadogMetrics []model.DatadogMetricInternal) []model.DatadogMetricInternal {
+	metrics := make([]autoscalers.LimitedMetric, 0, len(datadogMetrics))
+	for _, datadogMetric := range datadogMetrics {
+		ns, name, _ := cache.SplitMetaNamespaceKey(datadogMetric.ID)
+		metrics = append(metrics, autoscalers.LimitedMetric{ID: datadogMetric.ID, Namespace: ns, Name: name, CreationTimestamp: datadogMetric.CreationTime.Unix()})
+	}
+	rejected := autoscalers.RejectMetricsOverLimits(metrics)
+
+	previous := mr.overLimits
+	mr.overLimits = make(map[string]struct{}, len(rejected))
+	admitted := make([]model.DatadogMetricInternal, 0, len(datadogMetrics))
+	currentTime := time.Now().UTC()
+	for _, datadogMetric := range datadogMetrics {
+		limit, found := rejected[datadogMetric.ID]
+		if !found {
+			admitted = append(admitted, datadogMetric)
+			continue
+		}
+		mr.overLimits[datadogMetric.ID] = struct{}{}
+		if _, found := previous[datadogMetric.ID]; !found {
+			log.Warnf("The DatadogMetric %s is not served, it is over %s", datadogMetric.ID, limit)
+		}
+
+		datadogMetricFromStore := mr.store.LockRead(datadogMetric.ID, false)
+		if datadogMetricFromStore == nil {
+			continue
+		}
+		datadogMetricFromStore.Valid = false
+		datadogMetricFromStore.Outage = ""
+		datadogMetricFromStore.Error = fmt.Errorf(limitExceededErrorMessage, limit)
+		datadogMetricFromStore.UpdateTime = currentTime
+		mr.store.UnlockSet(datadogMetric.ID, *datadogMetricFromStore, metricRetrieverStoreID)
+	}
+	return admitted
+}
+
+// serveDuringOutage sets the value served by the outage policy while Datadog can't be queried, and
+// returns false when the DatadogMetric must be invalidated. The value held by the hold-last-value
+// policy keeps the time of the last valid value, so that it expires after the max age of the policy
+// however long the outage lasts.
+func (mr *MetricsRetriever) serveDuringOutage(datadogMetric *model.DatadogMetricInternal, servedBy custommetrics.OutagePolicy, currentTime time.Time) bool {
+	var lastValidTime time.Time
+	if datadogMetric.Valid && servedBy != custommetrics.OutagePolicyStaticFallback {
+		lastValidTime = datadogMetric.LastValidTime
+	}
+	value, _, ok := mr.outagePolicy.Serve(datadogMetric.Value, lastValidTime, datadogMetric.FallbackValue, currentTime)
+	if !ok {
+		return false
+	}
+	datadogMetric.Valid = true
+	datadogMetric.Value = value
+	datadogMetric.Outage = mr.outagePolicy.Policy
+	datadogMetric.Error = fmt.Errorf(outageMetricErrorMessage, mr.outagePolicy.Policy)
+	datadogMetric.UpdateTime = currentTime
+	return true
+}
+
 func getUniqueQueries(datadogMetrics []model.DatadogMetricInternal) []string {
 	queries := make([]string, 0, len(datadogMetrics))
 	unique := make(map[string]struct{}, len(queries))
@@ -14,14 +14,17 @@ import (
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
+	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/autoscalers"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockedProcessor struct {
-	points map[string]autoscalers.Point
-	err    error
+	points  map[string]autoscalers.Point
+	err     error
+	queried [][]string
 }
 
 func (p *mockedProcessor) UpdateExternalMetrics(emList map[string]custommetrics.ExternalMetricValue) map[string]custommetrics.ExternalMetricValue {
@@ -29,6 +32,7 @@ func (p *mockedProcessor) UpdateExternalMetrics(emList map[string]custommetrics.
 }
 
 func (p *mockedProcessor) QueryExternalMetric(queries []string) (map[string]autoscalers.Point, error) {
+	p.queried = append(p.queried, queries)
 	return p.points, p.err
 }
 
@@ -135,23 +139,27 @@ func TestRetrieveMetricsBasic(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric0",
 				},
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric1",
-						Active:     true,
-						Value:      11.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric1",
+						Active:        true,
+						Value:         11.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric1",
 				},
@@ -166,6 +174,142 @@ func TestRetrieveMetricsBasic(t *testing.T) {
 	}
 }
 
+func TestRetrieveMetricsPointSelection(t *testing.T) {
+	defaultTestTime := time.Now().Add(time.Duration(-1) * time.Second).UTC().Truncate(time.Second)
+	defaultPreviousUpdateTime := time.Now().Add(time.Duration(-11) * time.Second).UTC().Truncate(time.Second)
+	// the highest point is older than the max age, the end of the window being recent
+	highestPointTime := defaultTestTime.Add(-time.Minute)
+
+	fixture := metricsFixture{
+		maxAge: 30,
+		desc:   "Test the value selected among the points of the query window",
+		storeContent: []ddmWithQuery{
+			{
+				ddm: model.DatadogMetricInternal{
+					ID:             "metric0",
+					Active:         true,
+					UpdateTime:     defaultPreviousUpdateTime,
+					PointSelection: custommetrics.PointSelectionMax,
+				},
+				query: "query-metric0",
+			},
+			{
+				ddm: model.DatadogMetricInternal{
+					ID:         "metric1",
+					Active:     true,
+					UpdateTime: defaultPreviousUpdateTime,
+				},
+				query: "query-metric1",
+			},
+		},
+		queryResults: map[string]autoscalers.Point{
+			"query-metric0": {
+				Value:     10.0,
+				Timestamp: defaultTestTime.Unix(),
+				Valid:     true,
+				Window: []autoscalers.WindowPoint{
+					{Value: 30.0, Timestamp: highestPointTime.Unix()},
+					{Value: 10.0, Timestamp: defaultTestTime.Unix()},
+				},
+			},
+			"query-metric1": {
+				Value:     10.0,
+				Timestamp: defaultTestTime.Unix(),
+				Valid:     true,
+				Window: []autoscalers.WindowPoint{
+					{Value: 30.0, Timestamp: highestPointTime.Unix()},
+					{Value: 10.0, Timestamp: defaultTestTime.Unix()},
+				},
+			},
+		},
+		expected: []ddmWithQuery{
+			{
+				ddm: model.DatadogMetricInternal{
+					ID:             "metric0",
+					Active:         true,
+					Value:          30.0,
+					UpdateTime:     defaultTestTime,
+					LastValidTime:  defaultTestTime,
+					ValueTime:      highestPointTime,
+					Valid:          true,
+					PointSelection: custommetrics.PointSelectionMax,
+				},
+				query: "query-metric0",
+			},
+			{
+				ddm: model.DatadogMetricInternal{
+					ID:            "metric1",
+					Active:        true,
+					Value:         10.0,
+					UpdateTime:    defaultTestTime,
+					LastValidTime: defaultTestTime,
+					ValueTime:     defaultTestTime,
+					Valid:         true,
+				},
+				query: "query-metric1",
+			},
+		},
+	}
+	fixture.run(t, defaultTestTime)
+}
+
+func TestRetrieveMetricsLimits(t *testing.T) {
+	mockConfig := config.Mock()
+	mockConfig.Set("external_metrics_provider.max_metrics_per_namespace", 1)
+	defer mockConfig.Set("external_metrics_provider.max_metrics_per_namespace", 0)
+
+	defaultTestTime := time.Now().Add(time.Duration(-1) * time.Second).UTC().Truncate(time.Second)
+	defaultPreviousUpdateTime := time.Now().Add(time.Duration(-11) * time.Second).UTC().Truncate(time.Second)
+	created := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	storedMetric := func(id string, creationTime time.Time) model.DatadogMetricInternal {
+		return model.DatadogMetricInternal{ID: id, Active: true, UpdateTime: defaultPreviousUpdateTime, CreationTime: creationTime}
+	}
+	validMetric := func(id string, creationTime time.Time) model.DatadogMetricInternal {
+		return model.DatadogMetricInternal{
+			ID:            id,
+			Active:        true,
+			Valid:         true,
+			Value:         10.0,
+			UpdateTime:    defaultTestTime,
+			LastValidTime: defaultTestTime,
+			ValueTime:     defaultTestTime,
+			CreationTime:  creationTime,
+		}
+	}
+	result := autoscalers.Point{Value: 10.0, Timestamp: defaultTestTime.Unix(), Valid: true}
+
+	fixture := metricsFixture{
+		maxAge: 30,
+		desc:   "Test the DatadogMetrics over the limits on the number of external metrics served",
+		storeContent: []ddmWithQuery{
+			{ddm: storedMetric("shop/recent", created.Add(time.Minute)), query: "query-recent"},
+			{ddm: storedMetric("shop/old", created), query: "query-old"},
+			{ddm: storedMetric("payments/other", created.Add(time.Minute)), query: "query-other"},
+		},
+		queryResults: map[string]autoscalers.Point{
+			"query-recent": result,
+			"query-old":    result,
+			"query-other":  result,
+		},
+		expected: []ddmWithQuery{
+			{ddm: validMetric("shop/old", created), query: "query-old"},
+			{ddm: validMetric("payments/other", created.Add(time.Minute)), query: "query-other"},
+			{
+				ddm: model.DatadogMetricInternal{
+					ID:           "shop/recent",
+					Active:       true,
+					Valid:        false,
+					Error:        fmt.Errorf(limitExceededErrorMessage, "the limit of 1 external metrics in the namespace shop"),
+					CreationTime: created.Add(time.Minute),
+				},
+				query: "query-recent",
+			},
+		},
+	}
+	fixture.run(t, defaultTestTime)
+}
+
 func TestRetrieveMetricsErrorCases(t *testing.T) {
 	// At the end we'll check that update time has been updated, giving 10s to run the tests
 	// We truncate down to the second as that's the granularity we have from backend
@@ -214,12 +358,14 @@ func TestRetrieveMetricsErrorCases(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric0",
 				},
@@ -279,13 +425,15 @@ func TestRetrieveMetricsErrorCases(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
-						MaxAge:     20 * time.Second,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
+						MaxAge:        20 * time.Second,
 					},
 					query: "query-metric0",
 				},
@@ -346,12 +494,14 @@ func TestRetrieveMetricsErrorCases(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric0",
 				},
@@ -460,12 +610,14 @@ func TestRetrieveMetricsErrorCases(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric0",
 				},
@@ -539,12 +691,14 @@ func TestRetrieveMetricsNotActive(t *testing.T) {
 			expected: []ddmWithQuery{
 				{
 					ddm: model.DatadogMetricInternal{
-						ID:         "metric0",
-						Active:     true,
-						Value:      10.0,
-						UpdateTime: defaultTestTime,
-						Valid:      true,
-						Error:      nil,
+						ID:            "metric0",
+						Active:        true,
+						Value:         10.0,
+						UpdateTime:    defaultTestTime,
+						LastValidTime: defaultTestTime,
+						ValueTime:     defaultTestTime,
+						Valid:         true,
+						Error:         nil,
 					},
 					query: "query-metric0",
 				},
@@ -629,3 +783,99 @@ func TestRetrieveMetricsNotActive(t *testing.T) {
 		})
 	}
 }
+
+func TestRetrieveMetricsRetryBackoff(t *testing.T) {
+	store := NewDatadogMetricsInternalStore()
+	datadogMetric := model.DatadogMetricInternal{
+		ID:                   "metric0",
+		Active:               true,
+		AutoscalerReferences: "default/hpa0",
+	}
+	datadogMetric.SetQueries("query-metric0")
+	store.Set(datadogMetric.ID, datadogMetric, "utest")
+
+	processor := mockedProcessor{points: map[string]autoscalers.Point{}}
+	metricsRetriever, err := NewMetricsRetriever(30, 120, &processor, getIsLeaderFunction(true), &store)
+	assert.Nil(t, err)
+
+	// New invalid metrics are queried at every refresh
+	for i := 0; i < newMetricRetries; i++ {
+		metricsRetriever.retrieveMetricsValues()
+	}
+	assert.Len(t, processor.queried, newMetricRetries)
+
+	// Then the retry is delayed
+	metricsRetriever.retryPolicy.metrics["metric0"].nextRetry = time.Now().Add(time.Hour)
+	metricsRetriever.retrieveMetricsValues()
+	assert.Len(t, processor.queried, newMetricRetries)
+	assert.Equal(t, map[string]int64{retryTierNew: 1, retryTierBackoff: 0, retryTierMax: 0}, metricsRetriever.retryPolicy.tierCounts())
+
+	// Until an autoscaler referencing the metric is added
+	datadogMetric.AutoscalerReferences = "default/hpa0,default/hpa1"
+	store.Set(datadogMetric.ID, datadogMetric, "utest")
+	metricsRetriever.retrieveMetricsValues()
+	assert.Len(t, processor.queried, newMetricRetries+1)
+	assert.Equal(t, []string{"query-metric0"}, processor.queried[newMetricRetries])
+	assert.Equal(t, 1, metricsRetriever.retryPolicy.metrics["metric0"].failures)
+}
+
+func TestRetrieveMetricsOutagePolicy(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	fallback := 3.0
+	store := NewDatadogMetricsInternalStore()
+	for _, datadogMetric := range []model.DatadogMetricInternal{
+		{ID: "held", Active: true, Valid: true, Value: 10, UpdateTime: now.Add(-time.Minute), LastValidTime: now.Add(-time.Minute)},
+		{ID: "expired", Active: true, Valid: true, Value: 5, UpdateTime: now.Add(-time.Hour), LastValidTime: now.Add(-time.Hour)},
+		{ID: "fallback", Active: true, FallbackValue: &fallback},
+	} {
+		datadogMetric.SetQueries("query-" + datadogMetric.ID)
+		store.Set(datadogMetric.ID, datadogMetric, "utest")
+	}
+
+	processor := mockedProcessor{err: fmt.Errorf("networking Error, timeout")}
+	metricsRetriever, err := NewMetricsRetriever(30, 120, &processor, getIsLeaderFunction(true), &store)
+	require.NoError(t, err)
+	metricsRetriever.outagePolicy = custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute}
+
+	// the last valid values are held until they are older than the max age
+	metricsRetriever.retrieveMetricsValues()
+	held := store.Get("held")
+	assert.True(t, held.Valid)
+	assert.Equal(t, 10.0, held.Value)
+	assert.Equal(t, custommetrics.OutagePolicyHoldLastValue, held.Outage)
+	assert.Equal(t, fmt.Errorf(outageMetricErrorMessage, custommetrics.OutagePolicyHoldLastValue), held.Error)
+	externalMetric, err := held.ToExternalMetricFormat("held")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Minute), externalMetric.Timestamp.Time.UTC())
+	expired := store.Get("expired")
+	assert.False(t, expired.Valid)
+	assert.Empty(t, expired.Outage)
+	assert.Equal(t, fmt.Errorf(invalidMetricGlobalErrorMessage), expired.Error)
+	assert.False(t, store.Get("fallback").Valid)
+	// the outage doesn't delay the retries of the metrics
+	assert.Empty(t, metricsRetriever.retryPolicy.metrics)
+
+	// the static fallback values are served to the metrics which have one
+	metricsRetriever.outagePolicy = custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyStaticFallback}
+	metricsRetriever.retrieveMetricsValues()
+	served := store.Get("fallback")
+	assert.True(t, served.Valid)
+	assert.Equal(t, 3.0, served.Value)
+	assert.Equal(t, custommetrics.OutagePolicyStaticFallback, served.Outage)
+	assert.False(t, store.Get("held").Valid)
+
+	// the live values are served as soon as Datadog can be queried again
+	processor.err = nil
+	processor.points = map[string]autoscalers.Point{}
+	for _, id := range []string{"held", "expired", "fallback"} {
+		processor.points["query-"+id] = autoscalers.Point{Value: 42, Timestamp: now.Unix(), Valid: true}
+	}
+	metricsRetriever.retrieveMetricsValues()
+	for _, id := range []string{"held", "expired", "fallback"} {
+		datadogMetric := store.Get(id)
+		assert.True(t, datadogMetric.Valid, id)
+		assert.Equal(t, 42.0, datadogMetric.Value, id)
+		assert.Empty(t, datadogMetric.Outage, id)
+		assert.Nil(t, datadogMetric.Error, id)
+	}
+}
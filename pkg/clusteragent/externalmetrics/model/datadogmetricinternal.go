@@ -10,8 +10,11 @@ package model
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 	datadoghq "github.com/DataDog/datadog-operator/api/v1alpha1"
 
@@ -23,9 +26,14 @@ import (
 
 // exported for testing purposes
 const (
-	DatadogMetricErrorConditionReason string = "Unable to fetch data from Datadog"
+	DatadogMetricErrorConditionReason  string = "Unable to fetch data from Datadog"
+	DatadogMetricMaxErrorMessageLength int    = 1024
 )
 
+// lastValidTimeMessage precedes the time of the last valid value in the message of the Valid
+// condition of an invalid `DatadogMetric`
+const lastValidTimeMessage = ", last valid value at "
+
 // DatadogMetricInternal is a flatten, easier to use, representation of `DatadogMetric` CRD
 type DatadogMetricInternal struct {
 	ID                   string
@@ -41,6 +49,22 @@ type DatadogMetricInternal struct {
 	UpdateTime           time.Time
 	Error                error
 	MaxAge               time.Duration
+	// LastValidTime is the timestamp of the last valid value received by this Cluster Agent
+	LastValidTime time.Time
+	// PointSelection selects Value among the points of the query window, set by the
+	// custommetrics.PointSelectionAnnotation annotation of the `DatadogMetric`
+	PointSelection custommetrics.PointSelection
+	// ValueTime is the timestamp of the point Value was selected from, UpdateTime and LastValidTime
+	// being the end of the query window
+	ValueTime time.Time
+	// FallbackValue is the value served by the static-fallback outage policy, set by the
+	// custommetrics.FallbackValueAnnotation annotation of the `DatadogMetric`, nil if it has none
+	FallbackValue *float64
+	// Outage is the outage policy Value is served by while Datadog can't be queried, empty otherwise
+	Outage custommetrics.OutagePolicy
+	// CreationTime is the creation time of the `DatadogMetric`, the DatadogMetrics being served in
+	// this order when the number of external metrics served is limited
+	CreationTime time.Time
 }
 
 // NewDatadogMetricInternal returns a `DatadogMetricInternal` object from a `DatadogMetric` CRD Object
@@ -55,6 +79,7 @@ func NewDatadogMetricInternal(id string, datadogMetric datadoghq.DatadogMetric)
 		Autogen:              false,
 		AutoscalerReferences: datadogMetric.Status.AutoscalerReferences,
 		MaxAge:               datadogMetric.Spec.MaxAge.Duration,
+		CreationTime:         datadogMetric.CreationTimestamp.Time,
 	}
 
 	if len(datadogMetric.Spec.ExternalMetricName) > 0 {
@@ -62,10 +87,13 @@ func NewDatadogMetricInternal(id string, datadogMetric datadoghq.DatadogMetric)
 		internal.ExternalMetricName = datadogMetric.Spec.ExternalMetricName
 	}
 
+	var invalidMessage string
 	for _, condition := range datadogMetric.Status.Conditions {
 		switch {
 		case condition.Type == datadoghq.DatadogMetricConditionTypeValid && condition.Status == corev1.ConditionTrue:
 			internal.Valid = true
+		case condition.Type == datadoghq.DatadogMetricConditionTypeValid:
+			invalidMessage = condition.Message
 		case condition.Type == datadoghq.DatadogMetricConditionTypeActive && condition.Status == corev1.ConditionTrue:
 			internal.Active = true
 		case condition.Type == datadoghq.DatadogMetricConditionTypeUpdated && condition.Status == corev1.ConditionTrue:
@@ -75,7 +103,17 @@ func NewDatadogMetricInternal(id string, datadogMetric datadoghq.DatadogMetric)
 		}
 	}
 
+	// The time of the last valid value, set by the leader, is the update time of a valid `DatadogMetric`
+	// and is reported in the message of an invalid one, so that it's kept when the leader changes
+	if internal.Valid {
+		internal.LastValidTime = internal.UpdateTime
+	} else {
+		internal.LastValidTime = parseLastValidTime(invalidMessage)
+	}
+
 	internal.resolveQuery(internal.query)
+	internal.UpdatePointSelectionFrom(datadogMetric.ObjectMeta)
+	internal.UpdateFallbackValueFrom(datadogMetric.ObjectMeta)
 
 	// If UpdateTime is not set, it means it's a newly created DatadogMetric
 	// We'll need a proper update time to generate status, so setting to current time
@@ -109,6 +147,7 @@ func NewDatadogMetricInternalFromExternalMetric(id, query, metricName, autoscale
 		ExternalMetricName:   metricName,
 		AutoscalerReferences: autoscalerReference,
 		UpdateTime:           time.Now().UTC(),
+		CreationTime:         time.Now().UTC(),
 	}
 }
 
@@ -134,6 +173,18 @@ func (d *DatadogMetricInternal) UpdateFrom(currentSpec datadoghq.DatadogMetricSp
 	d.MaxAge = currentSpec.MaxAge.Duration
 }
 
+// UpdatePointSelectionFrom updates the point selection of the `DatadogMetricInternal` from the
+// annotations of the `DatadogMetric`
+func (d *DatadogMetricInternal) UpdatePointSelectionFrom(meta metav1.ObjectMeta) {
+	d.PointSelection = custommetrics.PointSelectionFromAnnotations(meta.Annotations, "DatadogMetric", meta.Namespace, meta.Name)
+}
+
+// UpdateFallbackValueFrom updates the fallback value of the `DatadogMetricInternal` from the
+// annotations of the `DatadogMetric`
+func (d *DatadogMetricInternal) UpdateFallbackValueFrom(meta metav1.ObjectMeta) {
+	d.FallbackValue = custommetrics.FallbackValueFromAnnotations(meta.Annotations, "DatadogMetric", meta.Namespace, meta.Name)
+}
+
 // shouldResolveQuery returns whether we should try to resolve a new query
 func (d *DatadogMetricInternal) shouldResolveQuery(spec datadoghq.DatadogMetricSpec) bool {
 	return d.resolvedQuery == nil || d.query != spec.Query
@@ -183,7 +234,10 @@ func (d *DatadogMetricInternal) BuildStatus(currentStatus *datadoghq.DatadogMetr
 	errorCondition := d.newCondition(d.Error != nil, updateTime, datadoghq.DatadogMetricConditionTypeError, existingConditions[datadoghq.DatadogMetricConditionTypeError])
 	if d.Error != nil {
 		errorCondition.Reason = DatadogMetricErrorConditionReason
-		errorCondition.Message = d.Error.Error()
+		errorCondition.Message = truncateMessage(d.Error.Error(), DatadogMetricMaxErrorMessageLength)
+	}
+	if !d.Valid {
+		validCondition.Message = d.invalidMessage()
 	}
 
 	newStatus := datadoghq.DatadogMetricStatus{
@@ -206,14 +260,59 @@ func (d *DatadogMetricInternal) ToExternalMetricFormat(externalMetricName string
 		return nil, err
 	}
 
+	// the value held while Datadog can't be queried keeps the timestamp it was received with
+	timestamp := d.UpdateTime
+	switch {
+	case d.Outage == custommetrics.OutagePolicyHoldLastValue:
+		timestamp = d.LastValidTime
+	case d.Outage == "" && !d.ValueTime.IsZero():
+		timestamp = d.ValueTime
+	}
+
 	return &external_metrics.ExternalMetricValue{
 		MetricName:   externalMetricName,
 		MetricLabels: nil,
 		Value:        quantity,
-		Timestamp:    metav1.NewTime(d.UpdateTime),
+		Timestamp:    metav1.NewTime(timestamp),
 	}, nil
 }
 
+// invalidMessage describes the query sent to Datadog and the time of its last valid value, to
+// troubleshoot an invalid DatadogMetric
+func (d *DatadogMetricInternal) invalidMessage() string {
+	message := "Query: " + d.Query()
+	if !d.LastValidTime.IsZero() {
+		message += lastValidTimeMessage + d.LastValidTime.UTC().Format(time.RFC3339)
+	}
+	return message
+}
+
+// parseLastValidTime returns the time of the last valid value reported by invalidMessage, if any
+func parseLastValidTime(message string) time.Time {
+	i := strings.LastIndex(message, lastValidTimeMessage)
+	if i < 0 {
+		return time.Time{}
+	}
+	lastValidTime, err := time.Parse(time.RFC3339, message[i+len(lastValidTimeMessage):])
+	if err != nil {
+		return time.Time{}
+	}
+	return lastValidTime.UTC()
+}
+
+// truncateMessage truncates a message longer than maxLength bytes, on a rune boundary
+func truncateMessage(message string, maxLength int) string {
+	if len(message) <= maxLength {
+		return message
+	}
+	const ellipsis = "..."
+	end := maxLength - len(ellipsis)
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+	return message[:end] + ellipsis
+}
+
 func (d *DatadogMetricInternal) newCondition(status bool, updateTime metav1.Time, conditionType datadoghq.DatadogMetricConditionType, prevCondition *datadoghq.DatadogMetricCondition) datadoghq.DatadogMetricCondition {
 	condition := datadoghq.DatadogMetricCondition{
 		Type:           conditionType,
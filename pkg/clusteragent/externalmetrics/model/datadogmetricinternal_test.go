@@ -10,8 +10,10 @@ package model
 import (
 	"errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	datadoghq "github.com/DataDog/datadog-operator/api/v1alpha1"
 
@@ -228,3 +230,73 @@ func TestDatadogMetricInternal_resolveQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestDatadogMetricInternal_BuildStatusInvalid(t *testing.T) {
+	lastValidTime := time.Date(2021, 4, 2, 8, 39, 16, 0, time.UTC)
+	d := DatadogMetricInternal{
+		ID:         "default/dd-metric-0",
+		Active:     true,
+		UpdateTime: time.Now().UTC(),
+		Error:      errors.New(strings.Repeat("x", 2*DatadogMetricMaxErrorMessageLength)),
+	}
+	d.SetQueries(resolvedQuery)
+
+	status := d.BuildStatus(nil)
+	for _, condition := range status.Conditions {
+		switch condition.Type {
+		case datadoghq.DatadogMetricConditionTypeValid:
+			assert.Equal(t, "Query: "+resolvedQuery, condition.Message)
+		case datadoghq.DatadogMetricConditionTypeError:
+			assert.Len(t, condition.Message, DatadogMetricMaxErrorMessageLength)
+			assert.True(t, strings.HasSuffix(condition.Message, "..."))
+		}
+	}
+
+	// the time of the last valid value is reported once known, and the query isn't once valid
+	d.LastValidTime = lastValidTime
+	status = d.BuildStatus(status)
+	assert.Equal(t, "Query: "+resolvedQuery+", last valid value at 2021-04-02T08:39:16Z", status.Conditions[1].Message)
+	d.Valid = true
+	d.Error = nil
+	status = d.BuildStatus(status)
+	assert.Empty(t, status.Conditions[1].Message)
+	assert.Empty(t, status.Conditions[3].Message)
+}
+
+func TestNewDatadogMetricInternalLastValidTime(t *testing.T) {
+	lastValidTime := time.Date(2021, 4, 2, 8, 39, 16, 0, time.UTC)
+	d := DatadogMetricInternal{
+		ID:            "default/dd-metric-0",
+		Active:        true,
+		UpdateTime:    lastValidTime.Add(time.Hour),
+		Error:         errors.New("query timed out"),
+		LastValidTime: lastValidTime,
+	}
+	d.SetQueries(simpleQuery)
+	datadogMetric := datadoghq.DatadogMetric{
+		Spec: datadoghq.DatadogMetricSpec{Query: simpleQuery},
+	}
+
+	// a new leader reads the time of the last valid value of an invalid DatadogMetric from its status
+	datadogMetric.Status = *d.BuildStatus(nil)
+	assert.Equal(t, lastValidTime, NewDatadogMetricInternal("default/dd-metric-0", datadogMetric).LastValidTime)
+
+	// and it's the update time of a valid one
+	d.Valid = true
+	d.Error = nil
+	datadogMetric.Status = *d.BuildStatus(&datadogMetric.Status)
+	assert.Equal(t, d.UpdateTime, NewDatadogMetricInternal("default/dd-metric-0", datadogMetric).LastValidTime)
+
+	// a DatadogMetric never valid has none
+	datadogMetric.Status = datadoghq.DatadogMetricStatus{}
+	assert.True(t, NewDatadogMetricInternal("default/dd-metric-0", datadogMetric).LastValidTime.IsZero())
+}
+
+func TestTruncateMessage(t *testing.T) {
+	assert.Equal(t, "short", truncateMessage("short", 10))
+	assert.Equal(t, "abcdefg...", truncateMessage("abcdefghijklmnop", 10))
+	// the multi-byte runes aren't split
+	truncated := truncateMessage(strings.Repeat("é", 10), 10)
+	assert.Equal(t, "ééé...", truncated)
+	assert.True(t, utf8.ValidString(truncated))
+}
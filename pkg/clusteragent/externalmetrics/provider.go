@@ -12,12 +12,14 @@ import (
 	"fmt"
 	"math"
 	"strings"
+	"time"
 
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver"
 	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/common"
@@ -34,6 +36,7 @@ type datadogMetricProvider struct {
 	apiCl            *apiserver.APIClient
 	store            DatadogMetricsInternalStore
 	autogenNamespace string
+	outagePolicy     custommetrics.OutagePolicyConfig
 }
 
 func NewDatadogMetricProvider(ctx context.Context, apiCl *apiserver.APIClient) (provider.ExternalMetricsProvider, error) {
@@ -58,6 +61,7 @@ func NewDatadogMetricProvider(ctx context.Context, apiCl *apiserver.APIClient) (
 		apiCl:            apiCl,
 		store:            NewDatadogMetricsInternalStore(),
 		autogenNamespace: autogenNamespace,
+		outagePolicy:     custommetrics.GetOutagePolicyConfig(),
 	}
 
 	// Start MetricsRetriever, only leader will do refresh metrics
@@ -133,6 +137,12 @@ func (p *datadogMetricProvider) getExternalMetric(namespace string, metricSelect
 		return nil, fmt.Errorf("DatadogMetric not found for metric name: %s, datadogmetricid: %s", info.Metric, datadogMetricID)
 	}
 
+	// The values held while Datadog can't be queried are not served past the max age of the outage policy,
+	// even before the next refresh invalidates them.
+	if p.outagePolicy.Expired(datadogMetric.Outage, datadogMetric.LastValidTime, time.Now()) {
+		return nil, fmt.Errorf("DatadogMetric value held while Datadog can't be queried is older than %s, datadogmetricid: %s", p.outagePolicy.MaxAge, datadogMetricID)
+	}
+
 	externalMetric, err := datadogMetric.ToExternalMetricFormat(info.Metric)
 	if err != nil {
 		return nil, err
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
 
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
@@ -203,6 +204,38 @@ func TestGetExternalMetrics(t *testing.T) {
 	}
 }
 
+func TestGetExternalMetricsHeldValueExpiry(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	datadogMetricProvider := datadogMetricProvider{
+		store:            NewDatadogMetricsInternalStore(),
+		autogenNamespace: "default",
+		outagePolicy:     custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute},
+	}
+	datadogMetric := model.DatadogMetricInternal{
+		ID:            "ns/metric0",
+		UpdateTime:    now,
+		LastValidTime: now.Add(-5 * time.Minute),
+		Valid:         true,
+		Value:         42.0,
+		Outage:        custommetrics.OutagePolicyHoldLastValue,
+	}
+	datadogMetric.SetQueries("query-metric0")
+	datadogMetricProvider.store.Set(datadogMetric.ID, datadogMetric, "utest")
+
+	// the held value is served with the time it was received
+	externalMetrics, err := datadogMetricProvider.getExternalMetric("", labels.Set(nil).AsSelector(), provider.ExternalMetricInfo{Metric: "datadogmetric@ns:metric0"})
+	require.NoError(t, err)
+	require.Len(t, externalMetrics.Items, 1)
+	assert.Equal(t, now.Add(-5*time.Minute), externalMetrics.Items[0].Timestamp.Time.UTC())
+
+	// it isn't served past the max age, even before the next refresh invalidates it
+	datadogMetric.LastValidTime = now.Add(-11 * time.Minute)
+	datadogMetricProvider.store.Set(datadogMetric.ID, datadogMetric, "utest")
+	externalMetrics, err = datadogMetricProvider.getExternalMetric("", labels.Set(nil).AsSelector(), provider.ExternalMetricInfo{Metric: "datadogmetric@ns:metric0"})
+	assert.Error(t, err)
+	assert.Nil(t, externalMetrics)
+}
+
 func TestListAllExternalMetrics(t *testing.T) {
 	defaultUpdateTime := time.Now().UTC()
 
@@ -0,0 +1,169 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package externalmetrics
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
+)
+
+const (
+	// newMetricRetries is the number of consecutive invalid results for which a metric keeps being queried
+	// at every refresh, to cover the delay between the creation of a metric and its availability in queries.
+	newMetricRetries = 10
+	// maxRetryInterval caps the interval between two queries of a metric which has been invalid for long.
+	maxRetryInterval = 30 * time.Minute
+
+	retryTierNew     = "new"
+	retryTierBackoff = "backoff"
+	retryTierMax     = "max"
+)
+
+var (
+	retryTiersExpvars = expvar.NewMap("external-metrics-retry-tiers")
+	retryTiers        = map[string]*expvar.Int{
+		retryTierNew:     {},
+		retryTierBackoff: {},
+		retryTierMax:     {},
+	}
+)
+
+func init() {
+	for tier, count := range retryTiers {
+		retryTiersExpvars.Set(tier, count)
+	}
+}
+
+// invalidMetricRetry holds the retry state of a DatadogMetric which was invalid the last time it was queried.
+// The references and query are those of the DatadogMetric when it became invalid, a change means the
+// autoscalers or the DatadogMetric were updated and the metric should be retried right away.
+type invalidMetricRetry struct {
+	autoscalerReferences string
+	query                string
+	failures             int
+	interval             time.Duration
+	nextRetry            time.Time
+}
+
+// retryPolicy decides when the DatadogMetrics returning invalid results are queried again.
+// They are retried at every refresh for a few cycles, then the interval between retries doubles
+// up to maxRetryInterval. It saves rate limit on metrics which don't exist anymore while
+// still picking up metrics that take some time to appear.
+type retryPolicy struct {
+	refreshPeriod time.Duration
+	metrics       map[string]*invalidMetricRetry
+}
+
+func newRetryPolicy(refreshPeriod time.Duration) *retryPolicy {
+	return &retryPolicy{
+		refreshPeriod: refreshPeriod,
+		metrics:       make(map[string]*invalidMetricRetry),
+	}
+}
+
+// shouldQuery returns whether the DatadogMetric should be queried at this refresh.
+func (p *retryPolicy) shouldQuery(datadogMetric model.DatadogMetricInternal, now time.Time) bool {
+	retry, found := p.metrics[datadogMetric.ID]
+	if !found {
+		return true
+	}
+	if retry.autoscalerReferences != datadogMetric.AutoscalerReferences || retry.query != datadogMetric.Query() {
+		delete(p.metrics, datadogMetric.ID)
+		return true
+	}
+	return !now.Before(retry.nextRetry)
+}
+
+// recordSuccess resets the retry state of a DatadogMetric which returned a valid result.
+func (p *retryPolicy) recordSuccess(id string) {
+	delete(p.metrics, id)
+}
+
+// recordFailure schedules the next query of a DatadogMetric which returned an invalid result.
+func (p *retryPolicy) recordFailure(datadogMetric model.DatadogMetricInternal, now time.Time) {
+	retry, found := p.metrics[datadogMetric.ID]
+	if !found {
+		retry = &invalidMetricRetry{
+			autoscalerReferences: datadogMetric.AutoscalerReferences,
+			query:                datadogMetric.Query(),
+		}
+		p.metrics[datadogMetric.ID] = retry
+	}
+
+	retry.failures++
+	retry.interval = p.retryInterval(retry.failures)
+	if retry.failures <= newMetricRetries {
+		// Queried again at the next refresh
+		retry.nextRetry = time.Time{}
+		return
+	}
+	// Queries happen on a ticker, half a period of slack avoids skipping a refresh because of jitter
+	retry.nextRetry = now.Add(retry.interval - p.refreshPeriod/2)
+}
+
+func (p *retryPolicy) retryInterval(failures int) time.Duration {
+	if failures <= newMetricRetries {
+		return p.refreshPeriod
+	}
+
+	interval := p.refreshPeriod
+	for i := newMetricRetries; i < failures && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxRetryInterval {
+		interval = maxRetryInterval
+	}
+	return interval
+}
+
+// cleanup forgets the DatadogMetrics which are not active anymore, they will be retried
+// right away if they are activated again.
+func (p *retryPolicy) cleanup(activeMetrics []model.DatadogMetricInternal) {
+	active := make(map[string]struct{}, len(activeMetrics))
+	for _, datadogMetric := range activeMetrics {
+		active[datadogMetric.ID] = struct{}{}
+	}
+	for id := range p.metrics {
+		if _, found := active[id]; !found {
+			delete(p.metrics, id)
+		}
+	}
+}
+
+// tier returns the retry tier of an invalid DatadogMetric, for observability.
+func (p *retryPolicy) tier(retry *invalidMetricRetry) string {
+	switch {
+	case retry.failures <= newMetricRetries:
+		return retryTierNew
+	case retry.interval < maxRetryInterval:
+		return retryTierBackoff
+	default:
+		return retryTierMax
+	}
+}
+
+// tierCounts returns the number of invalid DatadogMetrics in each retry tier.
+func (p *retryPolicy) tierCounts() map[string]int64 {
+	counts := map[string]int64{
+		retryTierNew:     0,
+		retryTierBackoff: 0,
+		retryTierMax:     0,
+	}
+	for _, retry := range p.metrics {
+		counts[p.tier(retry)]++
+	}
+	return counts
+}
+
+func (p *retryPolicy) updateExpvars() {
+	for tier, count := range p.tierCounts() {
+		retryTiers[tier].Set(count)
+	}
+}
@@ -0,0 +1,120 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package externalmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/externalmetrics/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDatadogMetric(id, query, references string) model.DatadogMetricInternal {
+	datadogMetric := model.DatadogMetricInternal{
+		ID:                   id,
+		Active:               true,
+		AutoscalerReferences: references,
+	}
+	datadogMetric.SetQueries(query)
+	return datadogMetric
+}
+
+func TestRetryInterval(t *testing.T) {
+	p := newRetryPolicy(30 * time.Second)
+
+	for failures := 1; failures <= newMetricRetries; failures++ {
+		assert.Equal(t, 30*time.Second, p.retryInterval(failures))
+	}
+	assert.Equal(t, time.Minute, p.retryInterval(newMetricRetries+1))
+	assert.Equal(t, 2*time.Minute, p.retryInterval(newMetricRetries+2))
+	assert.Equal(t, 16*time.Minute, p.retryInterval(newMetricRetries+5))
+	assert.Equal(t, maxRetryInterval, p.retryInterval(newMetricRetries+6))
+	assert.Equal(t, maxRetryInterval, p.retryInterval(newMetricRetries+1000))
+}
+
+func TestRetryPolicyMetricAppearsAfter10Minutes(t *testing.T) {
+	refreshPeriod := 30 * time.Second
+	p := newRetryPolicy(refreshPeriod)
+	datadogMetric := newTestDatadogMetric("default/dd-metric-0", "avg:nginx.net.request_per_s{kube_service:nginx}", "default/nginx-hpa")
+
+	start := time.Now()
+	appearsAt := start.Add(10 * time.Minute)
+
+	var queries int
+	var foundAt time.Time
+	for now := start; now.Before(start.Add(time.Hour)); now = now.Add(refreshPeriod) {
+		if !p.shouldQuery(datadogMetric, now) {
+			continue
+		}
+		queries++
+		if now.Before(appearsAt) {
+			p.recordFailure(datadogMetric, now)
+		} else {
+			p.recordSuccess(datadogMetric.ID)
+			foundAt = now
+			break
+		}
+	}
+
+	assert.False(t, foundAt.IsZero())
+	// The metric is picked up shortly after appearing...
+	assert.True(t, foundAt.Sub(appearsAt) <= 2*time.Minute, "found %v after appearing", foundAt.Sub(appearsAt))
+	// ...with far fewer queries than querying it at every refresh
+	assert.True(t, queries < int(10*time.Minute/refreshPeriod), "%d queries", queries)
+	assert.Empty(t, p.metrics)
+}
+
+func TestRetryPolicyDeletedMetricReachesMaxInterval(t *testing.T) {
+	refreshPeriod := 30 * time.Second
+	p := newRetryPolicy(refreshPeriod)
+	datadogMetric := newTestDatadogMetric("default/dd-metric-0", "avg:deleted.metric{*}", "default/nginx-hpa")
+
+	start := time.Now()
+	var queries int
+	for now := start; now.Before(start.Add(6 * time.Hour)); now = now.Add(refreshPeriod) {
+		if p.shouldQuery(datadogMetric, now) {
+			queries++
+			p.recordFailure(datadogMetric, now)
+		}
+	}
+
+	assert.Equal(t, map[string]int64{retryTierNew: 0, retryTierBackoff: 0, retryTierMax: 1}, p.tierCounts())
+	// 10 new metric retries, 5 backoff steps, then every 30 minutes
+	assert.True(t, queries < 30, "%d queries", queries)
+}
+
+func TestRetryPolicyReset(t *testing.T) {
+	p := newRetryPolicy(30 * time.Second)
+	now := time.Now()
+	datadogMetric := newTestDatadogMetric("default/dd-metric-0", "avg:deleted.metric{*}", "default/nginx-hpa")
+
+	for i := 0; i < newMetricRetries+3; i++ {
+		p.recordFailure(datadogMetric, now)
+	}
+	assert.False(t, p.shouldQuery(datadogMetric, now))
+	assert.Equal(t, map[string]int64{retryTierNew: 0, retryTierBackoff: 1, retryTierMax: 0}, p.tierCounts())
+
+	// An autoscaler referencing the metric is added
+	updated := newTestDatadogMetric("default/dd-metric-0", "avg:deleted.metric{*}", "default/nginx-hpa,default/nginx-hpa-2")
+	assert.True(t, p.shouldQuery(updated, now))
+	assert.Empty(t, p.metrics)
+
+	// The query of the DatadogMetric is updated
+	for i := 0; i < newMetricRetries+3; i++ {
+		p.recordFailure(datadogMetric, now)
+	}
+	updated = newTestDatadogMetric("default/dd-metric-0", "avg:fixed.metric{*}", "default/nginx-hpa")
+	assert.True(t, p.shouldQuery(updated, now))
+
+	// Inactive metrics are forgotten
+	p.recordFailure(datadogMetric, now)
+	p.cleanup(nil)
+	assert.Empty(t, p.metrics)
+}
@@ -79,6 +79,9 @@ type InstanceConfig struct {
 	Profile               string            `yaml:"profile"`
 	UseGlobalMetrics      bool              `yaml:"use_global_metrics"`
 	CollectDeviceMetadata *Boolean          `yaml:"collect_device_metadata"`
+	// UseSessionPool makes the check reuse the sessions of the SNMP listener, the v3 devices skipping
+	// the engine discovery exchange of each run
+	UseSessionPool Boolean `yaml:"use_session_pool"`
 
 	// ExtraTags is a workaround to pass tags from snmp listener to snmp integration via AD template
 	// (see cmd/agent/dist/conf.d/snmp.d/auto_conf.yaml) that only works with strings.
@@ -136,6 +139,7 @@ type CheckConfig struct {
 	ExtraTags             []string
 	InstanceTags          []string
 	CollectDeviceMetadata bool
+	UseSessionPool        bool
 	DeviceID              string
 	DeviceIDTags          []string
 	ResolvedSubnetName    string
@@ -279,6 +283,8 @@ func NewCheckConfig(rawInstance integration.Data, rawInitConfig integration.Data
 		c.CollectDeviceMetadata = bool(initConfig.CollectDeviceMetadata)
 	}
 
+	c.UseSessionPool = bool(instance.UseSessionPool)
+
 	if instance.ExtraTags != "" {
 		c.ExtraTags = strings.Split(instance.ExtraTags, ",")
 	}
@@ -538,6 +544,7 @@ func (c *CheckConfig) Copy() *CheckConfig {
 	newConfig.ExtraTags = common.CopyStrings(c.ExtraTags)
 	newConfig.InstanceTags = common.CopyStrings(c.InstanceTags)
 	newConfig.CollectDeviceMetadata = c.CollectDeviceMetadata
+	newConfig.UseSessionPool = c.UseSessionPool
 	newConfig.DeviceID = c.DeviceID
 
 	newConfig.DeviceIDTags = common.CopyStrings(c.DeviceIDTags)
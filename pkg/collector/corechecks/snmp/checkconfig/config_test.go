@@ -999,6 +999,27 @@ collect_device_metadata: true
 	assert.Equal(t, false, config.CollectDeviceMetadata)
 }
 
+func Test_buildConfig_useSessionPool(t *testing.T) {
+	// language=yaml
+	rawInstanceConfig := []byte(`
+ip_address: 1.2.3.4
+community_string: "abc"
+`)
+	config, err := NewCheckConfig(rawInstanceConfig, []byte(``))
+	assert.Nil(t, err)
+	assert.Equal(t, false, config.UseSessionPool)
+
+	// language=yaml
+	rawInstanceConfig = []byte(`
+ip_address: 1.2.3.4
+community_string: "abc"
+use_session_pool: "true"
+`)
+	config, err = NewCheckConfig(rawInstanceConfig, []byte(``))
+	assert.Nil(t, err)
+	assert.Equal(t, true, config.UseSessionPool)
+}
+
 func Test_buildConfig_namespace(t *testing.T) {
 	defer coreconfig.Datadog.Set("network_devices.namespace", "default")
 
@@ -1414,6 +1435,7 @@ func TestCheckConfig_Copy(t *testing.T) {
 		ExtraTags:             []string{"ExtraTags:tag"},
 		InstanceTags:          []string{"InstanceTags:tag"},
 		CollectDeviceMetadata: true,
+		UseSessionPool:        true,
 		DeviceID:              "123",
 		DeviceIDTags:          []string{"DeviceIDTags:tag"},
 		ResolvedSubnetName:    "1.2.3.4/28",
@@ -1451,6 +1473,7 @@ func TestCheckConfig_Copy(t *testing.T) {
 	assertNotSameButEqualElements(t, config.ExtraTags, configCopy.ExtraTags)
 	assertNotSameButEqualElements(t, config.InstanceTags, configCopy.InstanceTags)
 	assert.Equal(t, config.CollectDeviceMetadata, configCopy.CollectDeviceMetadata)
+	assert.Equal(t, config.UseSessionPool, configCopy.UseSessionPool)
 	assert.Equal(t, config.DeviceID, configCopy.DeviceID)
 	assertNotSameButEqualElements(t, config.DeviceIDTags, configCopy.DeviceIDTags)
 	assert.Equal(t, config.ResolvedSubnetName, configCopy.ResolvedSubnetName)
@@ -210,3 +210,26 @@ func getOidPatternSpecificity(pattern string) ([]int, error) {
 	}
 	return parts, nil
 }
+
+// GetProfileOIDCount returns the number of OIDs collected by the default profile matching a
+// sysObjectID, the scalar and column OIDs of its metrics and metric tags, including the ones of the
+// profiles it extends
+func GetProfileOIDCount(sysObjectID string) (int, error) {
+	profiles, err := loadDefaultProfiles()
+	if err != nil {
+		return 0, err
+	}
+	profile, err := GetProfileForSysObjectID(profiles, sysObjectID)
+	if err != nil {
+		return 0, err
+	}
+	definition := profiles[profile]
+	oids := make(map[string]struct{})
+	for _, oid := range parseScalarOids(definition.Metrics, definition.MetricTags) {
+		oids[oid] = struct{}{}
+	}
+	for _, oid := range parseColumnOids(definition.Metrics) {
+		oids[oid] = struct{}{}
+	}
+	return len(oids), nil
+}
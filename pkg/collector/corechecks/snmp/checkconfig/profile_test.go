@@ -364,3 +364,16 @@ func Test_loadDefaultProfiles_validAndInvalidProfiles(t *testing.T) {
 	assert.Equal(t, 1, strings.Count(logs, "[WARN] loadProfiles: failed to read profile definition `f5-big-ip-invalid`"), logs)
 	assert.Equal(t, mockProfilesDefinitions(), defaultProfiles)
 }
+
+func Test_GetProfileOIDCount(t *testing.T) {
+	SetConfdPathAndCleanProfiles()
+
+	// the metric tags, metrics and table columns of f5-big-ip and of the profiles it extends,
+	// the sysName tag of both f5-big-ip and _base counting once
+	count, err := GetProfileOIDCount("1.3.6.1.4.1.3375.2.1.3.4.43")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, count)
+
+	_, err = GetProfileOIDCount("1.3.6.1.4.1.9.1.1")
+	assert.Error(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/cihub/seelog"
 	"github.com/gosnmp/gosnmp"
 
+	"github.com/DataDog/datadog-agent/pkg/snmp"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 
 	"github.com/DataDog/datadog-agent/pkg/collector/corechecks/snmp/checkconfig"
@@ -33,31 +34,79 @@ type Session interface {
 // GosnmpSession is used to connect to a snmp device
 type GosnmpSession struct {
 	gosnmpInst gosnmp.GoSNMP
+
+	// pool is the session pool the session is taken from, nil when the check doesn't use it
+	pool *snmp.SessionPool
+	// pooled is the session taken from the pool while connected
+	pooled *snmp.PooledSession
+	// lastErr is the error of the last request of the pooled session
+	lastErr error
 }
 
 // Connect is used to create a new connection
 func (s *GosnmpSession) Connect() error {
-	return s.gosnmpInst.Connect()
+	if s.pool == nil {
+		return s.gosnmpInst.Connect()
+	}
+	// the pool keeps the parameters it is given, a copy is given for each connection so that the
+	// engine learnt by a v3 session is only reused through the pool
+	params := s.gosnmpInst
+	if params.SecurityParameters != nil {
+		params.SecurityParameters = params.SecurityParameters.Copy()
+	}
+	pooled, err := s.pool.Connect(&params)
+	if err != nil {
+		return err
+	}
+	s.pooled = pooled
+	s.lastErr = nil
+	return nil
 }
 
 // Close is used to close the connection
 func (s *GosnmpSession) Close() error {
+	if s.pooled != nil {
+		s.pooled.Release(s.lastErr)
+		s.pooled = nil
+		return nil
+	}
 	return s.gosnmpInst.Conn.Close()
 }
 
+// connected returns the gosnmp instance of the connection, the one of the pooled session if any
+func (s *GosnmpSession) connected() *gosnmp.GoSNMP {
+	if s.pooled != nil {
+		return s.pooled.GoSNMP
+	}
+	return &s.gosnmpInst
+}
+
+// recordErr records the error of a request, for the health of the pooled session
+func (s *GosnmpSession) recordErr(err error) {
+	if s.pooled != nil {
+		s.lastErr = err
+	}
+}
+
 // Get will send a SNMPGET command
 func (s *GosnmpSession) Get(oids []string) (result *gosnmp.SnmpPacket, err error) {
-	return s.gosnmpInst.Get(oids)
+	result, err = s.connected().Get(oids)
+	s.recordErr(err)
+	return result, err
 }
 
 // GetBulk will send a SNMP BULKGET command
 func (s *GosnmpSession) GetBulk(oids []string, bulkMaxRepetitions uint32) (result *gosnmp.SnmpPacket, err error) {
-	return s.gosnmpInst.GetBulk(oids, 0, bulkMaxRepetitions)
+	result, err = s.connected().GetBulk(oids, 0, bulkMaxRepetitions)
+	s.recordErr(err)
+	return result, err
 }
 
 // GetNext will send a SNMP GETNEXT command
 func (s *GosnmpSession) GetNext(oids []string) (result *gosnmp.SnmpPacket, err error) {
-	return s.gosnmpInst.GetNext(oids)
+	result, err = s.connected().GetNext(oids)
+	s.recordErr(err)
+	return result, err
 }
 
 // GetVersion returns the snmp version used
@@ -119,6 +168,9 @@ func NewGosnmpSession(config *checkconfig.CheckConfig) (Session, error) {
 	s.gosnmpInst.Port = config.Port
 	s.gosnmpInst.Timeout = time.Duration(config.Timeout) * time.Second
 	s.gosnmpInst.Retries = config.Retries
+	if config.UseSessionPool {
+		s.pool = snmp.SharedSessionPool()
+	}
 
 	lvl, err := log.GetLogLevel()
 	if err != nil {
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/DataDog/datadog-agent/pkg/snmp"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 
 	"github.com/DataDog/datadog-agent/pkg/collector/corechecks/snmp/checkconfig"
@@ -291,3 +292,30 @@ func Test_snmpSession_Connect_Logger(t *testing.T) {
 	assert.NotEqual(t, logger, gosnmpSess.gosnmpInst.Logger)
 	assert.Equal(t, logger2, gosnmpSess.gosnmpInst.Logger)
 }
+
+func Test_snmpSession_Connect_SessionPool(t *testing.T) {
+	config := checkconfig.CheckConfig{
+		IPAddress:       "127.0.0.1",
+		Port:            uint16(1161),
+		CommunityString: "abc",
+		UseSessionPool:  true,
+	}
+	s, err := NewGosnmpSession(&config)
+	require.NoError(t, err)
+	gosnmpSess := s.(*GosnmpSession)
+	gosnmpSess.pool = snmp.NewSessionPool(1)
+
+	require.NoError(t, s.Connect())
+	require.NotNil(t, gosnmpSess.pooled)
+	assert.Equal(t, "127.0.0.1", gosnmpSess.connected().Target)
+	// the parameters of the session aren't shared with the pool
+	assert.NotSame(t, &gosnmpSess.gosnmpInst, gosnmpSess.connected())
+	localAddr := gosnmpSess.connected().Conn.LocalAddr().String()
+	require.NoError(t, s.Close())
+	assert.Nil(t, gosnmpSess.pooled)
+
+	// the session is reused by the next run
+	require.NoError(t, s.Connect())
+	assert.Equal(t, localAddr, gosnmpSess.connected().Conn.LocalAddr().String())
+	require.NoError(t, s.Close())
+}
@@ -61,6 +61,22 @@ const (
 	// It is also the maximum possible size of a single event. Events exceeding this limit are dropped.
 	DefaultBatchMaxContentSize = 1000000
 
+	// DefaultServerlessBatchMaxSize is the default max number of logs in a batch of the serverless agent, the max
+	// number of entries of a payload accepted by the intake
+	DefaultServerlessBatchMaxSize = 1000
+
+	// DefaultServerlessBatchMaxContentSize is the default max content size (before compression) of a batch of logs of
+	// the serverless agent, the max payload size accepted by the intake
+	DefaultServerlessBatchMaxContentSize = 5000000
+
+	// DefaultServerlessBatchMaxCompressedSize is the default max compressed size of a batch of logs of the serverless
+	// agent, the batches compressed over it are split
+	DefaultServerlessBatchMaxCompressedSize = 5000000
+
+	// DefaultServerlessBatchMaxConcurrentSend is the default number of batches of logs the serverless agent sends
+	// concurrently
+	DefaultServerlessBatchMaxConcurrentSend = 4
+
 	// DefaultAuditorTTL is the default logs auditor TTL in hours
 	DefaultAuditorTTL = 23
 
@@ -515,11 +531,31 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("kubelet_auth_token_path", "")
 	config.BindEnvAndSetDefault("kubelet_client_crt", "")
 	config.BindEnvAndSetDefault("kubelet_client_key", "")
+	config.BindEnvAndSetDefault("kubelet_cgroup_driver", "cgroupfs") // cgroupfs or systemd, as configured on the kubelet
+	config.BindEnvAndSetDefault("kubelet_cgroup_root", "kubepods")
 
 	config.BindEnvAndSetDefault("kubernetes_pod_expiration_duration", 15*60) // in seconds, default 15 minutes
 	config.BindEnvAndSetDefault("kubelet_wait_on_missing_container", 0)
 	config.BindEnvAndSetDefault("kubelet_cache_pods_duration", 5)       // Polling frequency in seconds of the agent to the kubelet "/pods" endpoint
 	config.BindEnvAndSetDefault("kubelet_listener_polling_interval", 5) // Polling frequency in seconds of the pod watcher to detect new pods/containers (affected by kubelet_cache_pods_duration setting)
+	// polling or streaming, how the workloadmeta store gets the pod updates from the kubelet
+	config.BindEnvAndSetDefault("kubelet_pod_watcher_source", "polling")
+	// glob patterns of the pod annotations and labels, and of the container environment variables, kept or
+	// dropped by the workloadmeta store. The ad.datadoghq.com/*, service-discovery.datadoghq.com/* and
+	// tags.datadoghq.com/* ones, DD_ENV, DD_SERVICE and DD_VERSION, and the *_as_tags keys are always kept
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_annotations_include", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_annotations_exclude", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_labels_include", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_labels_exclude", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_env_vars_include", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_env_vars_exclude", []string{})
+	config.BindEnvAndSetDefault("kubelet_workloadmeta_collect_env_vars", true)
+	// the messages of the pod conditions kept by the workloadmeta store are truncated to this length (0 disables)
+	config.BindEnvAndSetDefault("kubelet_pod_condition_message_max_length", 1024)
+	// the pod lists returned by the kubelet with more than this fraction of running pods without container
+	// statuses, or unchanged over this number of pulls while new pods have a cgroup, are ignored (0 disables)
+	config.BindEnvAndSetDefault("kubelet_pod_list_empty_statuses_threshold", 0.5)
+	config.BindEnvAndSetDefault("kubelet_pod_list_stale_pulls", 6)
 	config.BindEnvAndSetDefault("kubernetes_collect_metadata_tags", true)
 	config.BindEnvAndSetDefault("kubernetes_metadata_tag_update_freq", 60) // Polling frequency of the Agent to the DCA in seconds (gets the local cache if the DCA is disabled)
 	config.BindEnvAndSetDefault("kubernetes_apiserver_client_timeout", 10)
@@ -541,11 +577,23 @@ func InitConfig(config Config) {
 	config.SetKnown("snmp_listener.discovery_interval")
 	config.SetKnown("snmp_listener.allowed_failures")
 	config.SetKnown("snmp_listener.discovery_allowed_failures")
+	config.SetKnown("snmp_listener.health_check_interval")
+	config.SetKnown("snmp_listener.discovery_probe_oids")
 	config.SetKnown("snmp_listener.collect_device_metadata")
 	config.SetKnown("snmp_listener.workers")
 	config.SetKnown("snmp_listener.configs")
 	config.SetKnown("snmp_listener.loader")
 	config.SetKnown("snmp_listener.min_collection_interval")
+	config.SetKnown("snmp_listener.secret_refresh_interval")
+	config.SetKnown("snmp_listener.config_reload_interval")
+	config.SetKnown("snmp_listener.max_devices_per_agent")
+	config.SetKnown("snmp_listener.device_priority")
+	config.SetKnown("snmp_listener.profile_priorities")
+	config.SetKnown("snmp_listener.profile_oid_counts")
+	config.SetKnown("snmp_listener.interface_count_threshold")
+	config.SetKnown("snmp_listener.interface_count_interval_factor")
+	config.SetKnown("snmp_listener.discovery_memory_budget")
+	config.SetKnown("snmp_listener.discovery_device_latency")
 
 	config.BindEnvAndSetDefault("snmp_traps_enabled", false)
 	config.BindEnvAndSetDefault("snmp_traps_config.port", 162)
@@ -777,6 +825,35 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("kubernetes_informers_resync_period", 60*5)               // value in seconds. Default to 5 minutes
 	config.BindEnvAndSetDefault("external_metrics_provider.config", map[string]string{})  // list of options that can be used to configure the external metrics server
 	config.BindEnvAndSetDefault("external_metrics_provider.local_copy_refresh_rate", 30)  // value in seconds
+	// Send an event when an external metric of an autoscaler becomes invalid or valid again,
+	// at most one event per metric and interval (value in seconds)
+	config.BindEnvAndSetDefault("external_metrics_provider.invalid_metric_events", false)
+	config.BindEnvAndSetDefault("external_metrics_provider.invalid_metric_events_interval", 60*10)
+	// value in seconds. Minimum interval between two updates of the status of a DatadogMetric which stays invalid with the same error, 0 updates it on each refresh
+	config.BindEnvAndSetDefault("external_metrics_provider.error_status_update_interval", 60*5)
+	// Pause the queries to Datadog until the rate limit resets when fewer requests remain, 0 disables it
+	config.BindEnvAndSetDefault("external_metrics_provider.min_remaining_requests", 0)
+	// Shift the query window back to account for the ingestion lag of the metrics (value in seconds),
+	// by default and by metric name
+	config.BindEnvAndSetDefault("external_metrics_provider.ingestion_delay", 0)
+	config.BindEnvAndSetDefault("external_metrics_provider.metric_ingestion_delays", map[string]string{})
+	config.BindEnvAndSetDefault("external_metrics_provider.metric_unit_conversions", map[string]string{})
+	// Evaluate the DatadogMetric queries starting with `formula:` with the v2 scalar query API
+	config.BindEnvAndSetDefault("external_metrics_provider.enable_v2_formulas", false)
+	// Maximum number of formula queries sent in parallel to the v2 scalar query API
+	config.BindEnvAndSetDefault("external_metrics_provider.max_parallel_formulas", 5)
+	// Maximum number of external metrics of the autoscalers served, in total and per namespace, 0 disables the limit.
+	// The metrics of the most recently created autoscalers over the limits are invalid and not queried.
+	config.BindEnvAndSetDefault("external_metrics_provider.max_metrics", 0)
+	config.BindEnvAndSetDefault("external_metrics_provider.max_metrics_per_namespace", 0)
+	// How the external metrics are served while Datadog can't be queried: fail-closed invalidates them,
+	// hold-last-value serves their last valid value up to outage_max_age (value in seconds) after it was
+	// received, static-fallback serves the value of the external-metrics.datadoghq.com/fallback-value annotation
+	config.BindEnvAndSetDefault("external_metrics_provider.outage_policy", "fail-closed")
+	config.BindEnvAndSetDefault("external_metrics_provider.outage_max_age", 60*10)
+	// Expose the value, validity and age of the external metrics served to the autoscalers in the Prometheus
+	// text format on /metrics/external on the metrics_port
+	config.BindEnvAndSetDefault("external_metrics_provider.prometheus_endpoint", false)
 	// Cluster check Autodiscovery
 	config.BindEnvAndSetDefault("cluster_checks.enabled", false)
 	config.BindEnvAndSetDefault("cluster_checks.node_expiration_timeout", 30) // value in seconds
@@ -919,6 +996,16 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("runtime_security_config.syscall_monitor.enabled", false)
 	config.BindEnvAndSetDefault("runtime_security_config.events_stats.polling_interval", 20)
 	config.BindEnvAndSetDefault("runtime_security_config.events_stats.tags_cardinality", "high")
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_distributions", false)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_tags_cardinality", "")
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_diagnostics.loss_rate", 0.0)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_diagnostics.cooldown", 3600)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_slo.targets", map[string]float64{})
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_slo.short_window", 300)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_slo.long_window", 3600)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_kernel_stats_maps", []string{})
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_loss_listeners.cooldown", 60)
+	config.BindEnvAndSetDefault("runtime_security_config.events_stats.perf_buffer_throughput.half_life", 60)
 	config.BindEnvAndSetDefault("runtime_security_config.run_path", defaultRunPath)
 	config.BindEnvAndSetDefault("runtime_security_config.event_server.burst", 40)
 	config.BindEnvAndSetDefault("runtime_security_config.event_server.retention", 6)
@@ -926,6 +1013,7 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("runtime_security_config.load_controller.events_count_threshold", 20000)
 	config.BindEnvAndSetDefault("runtime_security_config.load_controller.discarder_timeout", 10)
 	config.BindEnvAndSetDefault("runtime_security_config.load_controller.control_period", 2)
+	config.BindEnvAndSetDefault("runtime_security_config.load_controller.discarded_event_types", 0)
 	config.BindEnvAndSetDefault("runtime_security_config.pid_cache_size", 10000)
 	config.BindEnvAndSetDefault("runtime_security_config.cookie_cache_size", 100)
 	config.BindEnvAndSetDefault("runtime_security_config.agent_monitoring_events", true)
@@ -934,9 +1022,39 @@ func InitConfig(config Config) {
 	config.BindEnvAndSetDefault("runtime_security_config.log_patterns", []string{})
 	bindEnvAndSetLogsConfigKeys(config, "runtime_security_config.endpoints.")
 	config.BindEnvAndSetDefault("runtime_security_config.self_test.enabled", true)
+	config.BindEnvAndSetDefault("runtime_security_config.self_test.strict", false)
 
 	// Serverless Agent
 	config.BindEnvAndSetDefault("serverless.logs_enabled", true)
+	config.BindEnvAndSetDefault("serverless.retry_buffer_size", 5*1024*1024)
+	config.BindEnvAndSetDefault("serverless.inactivity_flush_timeout", 0)
+	config.BindEnvAndSetDefault("serverless.warmup_payload_path", "source")
+	config.BindEnvAndSetDefault("serverless.warmup_payload_value", "serverless-plugin-warmup")
+	config.BindEnvAndSetDefault("serverless.logs_structured_parsing", true)
+	config.BindEnvAndSetDefault("serverless.logs_structured_max_size", 64*1024)
+	// Number of log messages held until they can be attributed to an invocation, such as the logs of the init phase
+	config.BindEnvAndSetDefault("serverless.logs_pending_buffer_size", 1000)
+	// Batches of logs sent by the serverless agent, compressed once for all the endpoints and sent concurrently
+	config.BindEnvAndSetDefault("serverless.logs_batch_max_size", DefaultServerlessBatchMaxSize)
+	config.BindEnvAndSetDefault("serverless.logs_batch_max_content_size", DefaultServerlessBatchMaxContentSize)
+	config.BindEnvAndSetDefault("serverless.logs_batch_max_compressed_size", DefaultServerlessBatchMaxCompressedSize)
+	config.BindEnvAndSetDefault("serverless.logs_batch_max_concurrent_send", DefaultServerlessBatchMaxConcurrentSend)
+	// Estimated memory of the metrics aggregated between two flushes (value in bytes, 0 disables
+	// them): they are flushed early above the soft limit, new contexts are dropped above the hard limit
+	config.BindEnvAndSetDefault("serverless.metrics_memory_soft_limit", 4*1024*1024)
+	config.BindEnvAndSetDefault("serverless.metrics_memory_hard_limit", 16*1024*1024)
+	// Tag the spans of the invocations with their event and their response, flattened up to the
+	// max depth once redacted by the default rules and the payload_redaction_rules
+	config.BindEnvAndSetDefault("serverless.capture_lambda_payload", false, "DD_CAPTURE_LAMBDA_PAYLOAD")
+	config.BindEnvAndSetDefault("serverless.capture_lambda_payload_max_depth", 10, "DD_CAPTURE_LAMBDA_PAYLOAD_MAX_DEPTH")
+	config.BindEnv("serverless.payload_redaction_rules")
+	config.SetEnvKeyTransformer("serverless.payload_redaction_rules", func(in string) interface{} {
+		var out []map[string]string
+		if err := json.Unmarshal([]byte(in), &out); err != nil {
+			log.Warnf(`"serverless.payload_redaction_rules" can not be parsed: %v`, err)
+		}
+		return out
+	})
 	config.BindEnvAndSetDefault("enhanced_metrics", true)
 
 	// command line options
@@ -955,6 +1073,12 @@ func GetProxies() *Proxy {
 	return proxies
 }
 
+// LoadProxyFromEnv loads the proxy settings from the environment variables, for the agents
+// creating their HTTP clients before loading a configuration file, if any
+func LoadProxyFromEnv() {
+	loadProxyFromEnv(Datadog)
+}
+
 // loadProxyFromEnv overrides the proxy settings with environment variables
 func loadProxyFromEnv(config Config) {
 	// Viper doesn't handle mixing nested variables from files and set
@@ -1071,9 +1195,14 @@ func findUnknownKeys(config Config) []string {
 	return unknownKeys
 }
 
-func load(config Config, origin string, loadSecret bool) (*Warnings, error) {
-	warnings := Warnings{}
+// LoadCustom reads the config file of a config initialized with InitConfig the way Load does for the
+// main config, the environment features being those detected when the main config was loaded
+func LoadCustom(config Config, origin string, loadSecret bool) (*Warnings, error) {
+	defer applyOverrideFuncs(config)
+	return loadCustom(config, origin, loadSecret)
+}
 
+func load(config Config, origin string, loadSecret bool) (*Warnings, error) {
 	// Feature detection running in a defer func as it always  need to run (whether config load has been successful or not)
 	// Because some Agents (e.g. trace-agent) will run even if config file does not exist
 	defer func() {
@@ -1083,6 +1212,12 @@ func load(config Config, origin string, loadSecret bool) (*Warnings, error) {
 		applyOverrideFuncs(config)
 	}()
 
+	return loadCustom(config, origin, loadSecret)
+}
+
+func loadCustom(config Config, origin string, loadSecret bool) (*Warnings, error) {
+	warnings := Warnings{}
+
 	if err := config.ReadInConfig(); err != nil {
 		if errors.Is(err, os.ErrPermission) {
 			log.Warnf("Error loading config: %v (check config file permissions for dd-agent user)", err)
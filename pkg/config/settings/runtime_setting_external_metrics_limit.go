@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package settings
+
+import (
+	"fmt"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+)
+
+// ExternalMetricsLimitRuntimeSetting wraps operations to change a limit on the number of external metrics
+// served by the Cluster Agent at runtime, ConfigKey being the key of the limit.
+type ExternalMetricsLimitRuntimeSetting struct {
+	ConfigKey string
+}
+
+// Description returns the runtime setting's description
+func (l ExternalMetricsLimitRuntimeSetting) Description() string {
+	return "Set/get a limit on the number of external metrics served, 0 disables it."
+}
+
+// Hidden returns whether or not this setting is hidden from the list of runtime settings
+func (l ExternalMetricsLimitRuntimeSetting) Hidden() bool {
+	return false
+}
+
+// Name returns the name of the runtime setting
+func (l ExternalMetricsLimitRuntimeSetting) Name() string {
+	return l.ConfigKey
+}
+
+// Get returns the current value of the runtime setting
+func (l ExternalMetricsLimitRuntimeSetting) Get() (interface{}, error) {
+	return config.Datadog.GetInt(l.ConfigKey), nil
+}
+
+// Set changes the value of the runtime setting
+func (l ExternalMetricsLimitRuntimeSetting) Set(v interface{}) error {
+	limit, err := GetInt(v)
+	if err != nil {
+		return fmt.Errorf("ExternalMetricsLimitRuntimeSetting: %v", err)
+	}
+	if limit < 0 {
+		return fmt.Errorf("ExternalMetricsLimitRuntimeSetting: the limit %d must be positive, or 0 to disable it", limit)
+	}
+
+	config.Datadog.Set(l.ConfigKey, limit)
+	return nil
+}
@@ -121,6 +121,28 @@ func TestProfiling(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestExternalMetricsLimit(t *testing.T) {
+	cleanRuntimeSetting()
+	config.Mock()
+
+	limit := ExternalMetricsLimitRuntimeSetting{ConfigKey: "external_metrics_provider.max_metrics"}
+	assert.Equal(t, "external_metrics_provider.max_metrics", limit.Name())
+
+	err := limit.Set("100")
+	assert.Nil(t, err)
+
+	v, err := limit.Get()
+	assert.Equal(t, 100, v)
+	assert.Nil(t, err)
+
+	err = limit.Set("-1")
+	assert.NotNil(t, err)
+
+	v, err = limit.Get()
+	assert.Equal(t, 100, v)
+	assert.Nil(t, err)
+}
+
 func TestGetInt(t *testing.T) {
 	cases := []struct {
 		v   interface{}
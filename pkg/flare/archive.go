@@ -26,6 +26,7 @@ import (
 
 	"github.com/DataDog/datadog-agent/pkg/api/security"
 	apiutil "github.com/DataDog/datadog-agent/pkg/api/util"
+	"github.com/DataDog/datadog-agent/pkg/autodiscovery/listeners"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/diagnose"
 	"github.com/DataDog/datadog-agent/pkg/secrets"
@@ -206,6 +207,11 @@ func createArchive(confSearchPaths SearchPaths, local bool, zipFilePath string,
 		if err != nil {
 			log.Errorf("Could not zip tagger list: %s", err)
 		}
+
+		err = zipSNMPDiscovery(tempDir, hostname)
+		if err != nil {
+			log.Errorf("Could not zip SNMP discovery: %s", err)
+		}
 	}
 
 	// auth token permissions info (only if existing)
@@ -704,6 +710,34 @@ func writeConfigCheck(tempDir, hostname string, data []byte) error {
 // Used for testing mock HTTP server
 var taggerListURL string
 
+// zipSNMPDiscovery dumps the state of the SNMP discovery, if any subnet is configured
+func zipSNMPDiscovery(tempDir, hostname string) error {
+	subnets := listeners.GetSNMPDiscoveryStatus()
+	if len(subnets) == 0 {
+		return nil
+	}
+
+	f := filepath.Join(tempDir, hostname, "snmp-discovery.json")
+	err := ensureParentDirsExist(f)
+	if err != nil {
+		return err
+	}
+
+	w, err := newRedactingWriter(f, os.ModePerm, true)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	data, err := json.MarshalIndent(subnets, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
 func zipTaggerList(tempDir, hostname string) error {
 	f := filepath.Join(tempDir, hostname, "tagger-list.json")
 	err := ensureParentDirsExist(f)
@@ -19,6 +19,10 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+// perfBufferDiagnosticsFile is the file the runtime security module writes its perf buffer diagnostics to, in
+// its run directory
+const perfBufferDiagnosticsFile = "runtime-security-perf-buffer-diagnostics.json"
+
 // CreateSecurityAgentArchive packages up the files
 func CreateSecurityAgentArchive(local bool, logFilePath string, runtimeStatus map[string]interface{}) (string, error) {
 	zipFilePath := getArchivePath()
@@ -74,6 +78,11 @@ func CreateSecurityAgentArchive(local bool, logFilePath string, runtimeStatus ma
 		return "", err
 	}
 
+	err = zipPerfBufferDiagnostics(tempDir, hostname, permsInfos)
+	if err != nil {
+		log.Infof("Error while getting the perf buffer diagnostics: %s", err)
+	}
+
 	err = zipExpVar(tempDir, hostname)
 	if err != nil {
 		return "", err
@@ -203,3 +212,18 @@ func zipRuntimeFiles(tempDir, hostname string, permsInfos permissionsInfos) erro
 
 	return err
 }
+
+// zipPerfBufferDiagnostics adds the last diagnostics dump written by the runtime security module on a severe
+// perf buffer event loss, if any
+func zipPerfBufferDiagnostics(tempDir, hostname string, permsInfos permissionsInfos) error {
+	src := filepath.Join(config.Datadog.GetString("runtime_security_config.run_path"), perfBufferDiagnosticsFile)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	if permsInfos != nil {
+		permsInfos.add(src)
+	}
+
+	return util.CopyFileAll(src, filepath.Join(tempDir, hostname, perfBufferDiagnosticsFile))
+}
@@ -24,6 +24,7 @@ func TestCreateSecurityAgentArchive(t *testing.T) {
 	common.SetupConfig("./test")
 	mockConfig := config.Mock()
 	mockConfig.Set("compliance_config.dir", "./test/compliance.d")
+	mockConfig.Set("runtime_security_config.run_path", "./test/run")
 	logFilePath := "./test/logs/agent.log"
 
 	tests := []struct {
@@ -37,6 +38,7 @@ func TestCreateSecurityAgentArchive(t *testing.T) {
 			expectedFiles: []string{
 				"compliance.d/cis-docker.yaml",
 				"logs/agent.log",
+				"runtime-security-perf-buffer-diagnostics.json",
 			},
 		},
 		{
@@ -45,6 +47,7 @@ func TestCreateSecurityAgentArchive(t *testing.T) {
 			expectedFiles: []string{
 				"compliance.d/cis-docker.yaml",
 				"logs/agent.log",
+				"runtime-security-perf-buffer-diagnostics.json",
 				"security-agent-status.log",
 			},
 		},
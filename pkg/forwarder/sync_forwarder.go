@@ -3,6 +3,7 @@ package forwarder
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
@@ -10,11 +11,29 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
+// RetryHandler receives the transactions the SyncForwarder failed to send.
+type RetryHandler func(t *transaction.HTTPTransaction)
+
+// EndpointStats counts the transactions sent to a domain, and the ones which failed
+// to be sent after the second attempt.
+type EndpointStats struct {
+	Sent   int64
+	Errors int64
+}
+
 // SyncForwarder is a very simple Forwarder synchronously sending
-// the data to the intake.
+// the data to the intake. The transactions of each domain are sent
+// concurrently, so that a slow or failing domain doesn't delay the others.
 type SyncForwarder struct {
 	defaultForwarder *DefaultForwarder
 	client           *http.Client
+	retryHandler     RetryHandler
+
+	statsMu       sync.Mutex
+	endpointStats map[string]*EndpointStats
+
+	// keysMu guards the API keys of the default forwarder, which can be updated
+	keysMu sync.RWMutex
 }
 
 // NewSyncForwarder returns a new synchronous forwarder.
@@ -23,11 +42,35 @@ func NewSyncForwarder(keysPerDomains map[string][]string, timeout time.Duration)
 		defaultForwarder: NewDefaultForwarder(NewOptions(keysPerDomains)),
 		client: &http.Client{
 			Timeout:   timeout,
-			Transport: utilhttp.CreateHTTPTransport(),
+			Transport: utilhttp.WithProxyErrors(utilhttp.CreateHTTPTransport()),
 		},
+		endpointStats: make(map[string]*EndpointStats),
 	}
 }
 
+// UpdateAPIKey replaces oldKey by newKey in the API keys of every domain, such as when the key was
+// resolved again after it changed.
+func (f *SyncForwarder) UpdateAPIKey(oldKey, newKey string) {
+	f.keysMu.Lock()
+	defer f.keysMu.Unlock()
+	for domain, apiKeys := range f.defaultForwarder.keysPerDomains {
+		updated := make([]string, 0, len(apiKeys))
+		for _, apiKey := range apiKeys {
+			if apiKey == oldKey {
+				apiKey = newKey
+			}
+			updated = append(updated, apiKey)
+		}
+		f.defaultForwarder.keysPerDomains[domain] = updated
+	}
+}
+
+func (f *SyncForwarder) createHTTPTransactions(endpoint transaction.Endpoint, payloads Payloads, apiKeyInQueryString bool, extra http.Header) []*transaction.HTTPTransaction {
+	f.keysMu.RLock()
+	defer f.keysMu.RUnlock()
+	return f.defaultForwarder.createHTTPTransactions(endpoint, payloads, apiKeyInQueryString, extra)
+}
+
 // Start starts the sync forwarder: nothing to do.
 func (f *SyncForwarder) Start() error {
 	return nil
@@ -37,33 +80,131 @@ func (f *SyncForwarder) Start() error {
 func (f *SyncForwarder) Stop() {
 }
 
+// SetRetryHandler sets the handler receiving the retryable transactions which
+// failed to be sent after the second attempt, or after the first one when the
+// intake asked to wait with a Retry-After header. Without handler, they are dropped.
+func (f *SyncForwarder) SetRetryHandler(handler RetryHandler) {
+	f.retryHandler = handler
+}
+
+// Retry synchronously sends transactions which previously failed to be sent.
+func (f *SyncForwarder) Retry(transactions []*transaction.HTTPTransaction) error {
+	return f.sendHTTPTransactions(transactions)
+}
+
+// TakeEndpointStats returns the stats of each domain since the previous call, and resets them.
+func (f *SyncForwarder) TakeEndpointStats() map[string]EndpointStats {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	stats := make(map[string]EndpointStats, len(f.endpointStats))
+	for domain, s := range f.endpointStats {
+		stats[domain] = *s
+	}
+	f.endpointStats = make(map[string]*EndpointStats)
+	return stats
+}
+
 func (f *SyncForwarder) sendHTTPTransactions(transactions []*transaction.HTTPTransaction) error {
+	perDomain := make(map[string][]*transaction.HTTPTransaction)
+	for _, t := range transactions {
+		perDomain[t.Domain] = append(perDomain[t.Domain], t)
+	}
+
+	var wg sync.WaitGroup
+	failedChan := make(chan []*transaction.HTTPTransaction, len(perDomain))
+	for domain, domainTransactions := range perDomain {
+		wg.Add(1)
+		go func(domain string, domainTransactions []*transaction.HTTPTransaction) {
+			defer wg.Done()
+			failedChan <- f.sendDomainTransactions(domain, domainTransactions)
+		}(domain, domainTransactions)
+	}
+	wg.Wait()
+	close(failedChan)
+
+	// the handler is called once all the domains are done, so that it doesn't have to be thread safe
+	for failed := range failedChan {
+		for _, t := range failed {
+			if f.retryHandler != nil {
+				f.retryHandler(t)
+			}
+		}
+	}
+	log.Debugf("SyncForwarder has flushed %d transactions", len(transactions))
+	return nil
+}
+
+// sendDomainTransactions sends the transactions of a domain, and returns the ones which failed
+func (f *SyncForwarder) sendDomainTransactions(domain string, transactions []*transaction.HTTPTransaction) []*transaction.HTTPTransaction {
+	var failed []*transaction.HTTPTransaction
+	var sent, errorCount int64
 	for _, t := range transactions {
-		if err := t.Process(context.Background(), f.client); err != nil {
+		statusCode, err := f.processTransaction(t)
+		if err != nil && t.RetryAfter > 0 {
+			// the intake asked to wait before sending it again
+			log.Errorf("SyncForwarder.sendHTTPTransactions: %s, retrying after %s", err, t.RetryAfter)
+			failed = append(failed, t)
+			errorCount++
+			continue
+		}
+		if err != nil {
 			log.Debugf("SyncForwarder.sendHTTPTransactions first attempt: %s", err)
 			// Retry once after error
 			// The intake may have closed the connection between Lambda invocations.
 			// If so, the first attempt will fail because the closed connection will still be cached.
 			log.Debug("Retrying transaction")
-			if err := t.Process(context.Background(), f.client); err != nil {
+			if statusCode, err = f.processTransaction(t); err != nil {
 				log.Errorf("SyncForwarder.sendHTTPTransactions final attempt: %s", err)
+				failed = append(failed, t)
+				errorCount++
+				continue
 			}
 		}
+		// the transactions rejected by the intake, such as with an invalid API key, are dropped
+		if statusCode >= 400 {
+			errorCount++
+		} else {
+			sent++
+		}
 	}
-	log.Debugf("SyncForwarder has flushed %d transactions", len(transactions))
-	return nil
+
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	stats, found := f.endpointStats[domain]
+	if !found {
+		stats = &EndpointStats{}
+		f.endpointStats[domain] = stats
+	}
+	stats.Sent += sent
+	stats.Errors += errorCount
+	return failed
+}
+
+// processTransaction sends a transaction, and returns the status code of the intake
+func (f *SyncForwarder) processTransaction(t *transaction.HTTPTransaction) (int, error) {
+	var statusCode int
+	completionHandler := t.CompletionHandler
+	t.CompletionHandler = func(t *transaction.HTTPTransaction, code int, body []byte, err error) {
+		statusCode = code
+		if completionHandler != nil {
+			completionHandler(t, code, body, err)
+		}
+	}
+	defer func() { t.CompletionHandler = completionHandler }()
+	err := t.Process(context.Background(), f.client)
+	return statusCode, err
 }
 
 // SubmitV1Series will send timeserie to v1 endpoint (this will be remove once
 // the backend handles v2 endpoints).
 func (f *SyncForwarder) SubmitV1Series(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(v1SeriesEndpoint, payload, true, extra)
+	transactions := f.createHTTPTransactions(v1SeriesEndpoint, payload, true, extra)
 	return f.sendHTTPTransactions(transactions)
 }
 
 // SubmitV1Intake will send payloads to the universal `/intake/` endpoint used by Agent v.5
 func (f *SyncForwarder) SubmitV1Intake(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(v1IntakeEndpoint, payload, true, extra)
+	transactions := f.createHTTPTransactions(v1IntakeEndpoint, payload, true, extra)
 	// the intake endpoint requires the Content-Type header to be set
 	for _, t := range transactions {
 		t.Headers.Set("Content-Type", "application/json")
@@ -74,25 +215,25 @@ func (f *SyncForwarder) SubmitV1Intake(payload Payloads, extra http.Header) erro
 // SubmitV1CheckRuns will send service checks to v1 endpoint (this will be removed once
 // the backend handles v2 endpoints).
 func (f *SyncForwarder) SubmitV1CheckRuns(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(v1CheckRunsEndpoint, payload, true, extra)
+	transactions := f.createHTTPTransactions(v1CheckRunsEndpoint, payload, true, extra)
 	return f.sendHTTPTransactions(transactions)
 }
 
 // SubmitEvents will send an event type payload to Datadog backend.
 func (f *SyncForwarder) SubmitEvents(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(eventsEndpoint, payload, false, extra)
+	transactions := f.createHTTPTransactions(eventsEndpoint, payload, false, extra)
 	return f.sendHTTPTransactions(transactions)
 }
 
 // SubmitServiceChecks will send a service check type payload to Datadog backend.
 func (f *SyncForwarder) SubmitServiceChecks(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(serviceChecksEndpoint, payload, false, extra)
+	transactions := f.createHTTPTransactions(serviceChecksEndpoint, payload, false, extra)
 	return f.sendHTTPTransactions(transactions)
 }
 
 // SubmitSketchSeries will send payloads to Datadog backend - PROTOTYPE FOR PERCENTILE
 func (f *SyncForwarder) SubmitSketchSeries(payload Payloads, extra http.Header) error {
-	transactions := f.defaultForwarder.createHTTPTransactions(sketchSeriesEndpoint, payload, true, extra)
+	transactions := f.createHTTPTransactions(sketchSeriesEndpoint, payload, true, extra)
 	return f.sendHTTPTransactions(transactions)
 }
 
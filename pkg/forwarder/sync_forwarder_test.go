@@ -0,0 +1,85 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
+)
+
+func TestSyncForwarderAdditionalEndpoints(t *testing.T) {
+	var primaryRequests, secondaryRequests int64
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&primaryRequests, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&secondaryRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer secondary.Close()
+
+	f := NewSyncForwarder(map[string][]string{
+		primary.URL:   {"api-key-1"},
+		secondary.URL: {"api-key-2"},
+	}, 5*time.Second)
+	var retried []*transaction.HTTPTransaction
+	f.SetRetryHandler(func(t *transaction.HTTPTransaction) {
+		retried = append(retried, t)
+	})
+
+	data := []byte("data payload")
+	transactions := f.defaultForwarder.createHTTPTransactions(transaction.Endpoint{Route: "/api/foo", Name: "foo"}, Payloads{&data}, false, nil)
+	require.Len(t, transactions, 2)
+	require.NoError(t, f.sendHTTPTransactions(transactions))
+
+	// the failing endpoint doesn't prevent the payload from reaching the other one
+	assert.Equal(t, int64(1), atomic.LoadInt64(&primaryRequests))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&secondaryRequests))
+	require.Len(t, retried, 1)
+	assert.Equal(t, secondary.URL, retried[0].Domain)
+
+	assert.Equal(t, map[string]EndpointStats{
+		primary.URL:   {Sent: 1},
+		secondary.URL: {Errors: 1},
+	}, f.TakeEndpointStats())
+	assert.Empty(t, f.TakeEndpointStats())
+}
+
+func TestSyncForwarderRejectedTransaction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	f := NewSyncForwarder(map[string][]string{ts.URL: {"invalid-api-key"}}, 5*time.Second)
+	retries := 0
+	f.SetRetryHandler(func(t *transaction.HTTPTransaction) {
+		retries++
+	})
+
+	data := []byte("data payload")
+	transactions := f.defaultForwarder.createHTTPTransactions(transaction.Endpoint{Route: "/api/foo", Name: "foo"}, Payloads{&data}, false, nil)
+	var statusCode int
+	transactions[0].CompletionHandler = func(t *transaction.HTTPTransaction, code int, body []byte, err error) {
+		statusCode = code
+	}
+	require.NoError(t, f.sendHTTPTransactions(transactions))
+
+	// the rejected transactions are dropped, the completion handler of the transaction is still called
+	assert.Equal(t, 0, retries)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, map[string]EndpointStats{ts.URL: {Errors: 1}}, f.TakeEndpointStats())
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	httputils "github.com/DataDog/datadog-agent/pkg/util/http"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
@@ -175,6 +176,9 @@ type HTTPTransaction struct {
 	Payload *[]byte
 	// ErrorCount is the number of times this HTTPTransaction failed to be processed.
 	ErrorCount int
+	// RetryAfter is the delay the intake asked to wait before sending this HTTPTransaction again,
+	// from the Retry-After header of its last response, 0 if none.
+	RetryAfter time.Duration
 
 	CreatedAt time.Time
 	// Retryable indicates whether this transaction can be retried
@@ -300,6 +304,7 @@ func (t *HTTPTransaction) internalProcess(ctx context.Context, client *http.Clie
 	}
 	req = req.WithContext(ctx)
 	req.Header = t.Headers
+	t.RetryAfter = 0
 	resp, err := client.Do(req)
 
 	if err != nil {
@@ -348,6 +353,7 @@ func (t *HTTPTransaction) internalProcess(ctx context.Context, client *http.Clie
 		return resp.StatusCode, body, nil
 	} else if resp.StatusCode > 400 {
 		t.ErrorCount++
+		t.RetryAfter = httputils.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 		transactionsErrors.Add(1)
 		tlmTxErrors.Inc(t.Domain, transactionEndpointName, "gt_400")
 		return resp.StatusCode, body, fmt.Errorf("error %q while sending transaction to %q, rescheduling it", resp.Status, logURL)
@@ -162,6 +162,11 @@ func (a *Agent) Flush(ctx context.Context) {
 	a.pipelineProvider.Flush(ctx)
 }
 
+// UpdateAPIKey replaces the API key used to send the logs when it is oldKey.
+func (a *Agent) UpdateAPIKey(oldKey, newKey string) {
+	a.pipelineProvider.UpdateAPIKey(oldKey, newKey)
+}
+
 // Stop stops all the elements of the data pipeline
 // in the right order to prevent data loss
 func (a *Agent) Stop() {
@@ -18,3 +18,18 @@ func NewDestinations(main Destination, additionals []Destination) *Destinations
 		Additionals: additionals,
 	}
 }
+
+// APIKeyUpdater is implemented by the destinations whose API key can be updated while they run
+type APIKeyUpdater interface {
+	UpdateAPIKey(oldKey, newKey string)
+}
+
+// UpdateAPIKey replaces the API key of the destinations using oldKey, the destinations which don't
+// send an API key being left unchanged.
+func (d *Destinations) UpdateAPIKey(oldKey, newKey string) {
+	for _, destination := range append([]Destination{d.Main}, d.Additionals...) {
+		if updater, ok := destination.(APIKeyUpdater); ok {
+			updater.UpdateAPIKey(oldKey, newKey)
+		}
+	}
+}
@@ -51,6 +51,11 @@ func (c *GzipContentEncoding) name() string {
 	return "gzip"
 }
 
+// Encode compresses a payload, so that it is compressed once for all the destinations sending it as is
+func (c *GzipContentEncoding) Encode(payload []byte) ([]byte, error) {
+	return c.encode(payload)
+}
+
 func (c *GzipContentEncoding) encode(payload []byte) ([]byte, error) {
 	var compressedPayload bytes.Buffer
 	gzipWriter, err := gzip.NewWriterLevel(&compressedPayload, c.level)
@@ -71,3 +76,16 @@ func (c *GzipContentEncoding) encode(payload []byte) ([]byte, error) {
 	}
 	return compressedPayload.Bytes(), nil
 }
+
+// precompressedGzipContentEncoding sends the payloads already compressed with gzip as is
+var precompressedGzipContentEncoding ContentEncoding = &precompressedGzipContentType{}
+
+type precompressedGzipContentType struct{}
+
+func (c *precompressedGzipContentType) name() string {
+	return "gzip"
+}
+
+func (c *precompressedGzipContentType) encode(payload []byte) ([]byte, error) {
+	return payload, nil
+}
@@ -56,3 +56,18 @@ func decompress(payload []byte) ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+func TestPrecompressedGzipContentEncoding(t *testing.T) {
+	compressedPayload, err := NewGzipContentEncoding(gzip.BestCompression).Encode([]byte("my payload"))
+	assert.Nil(t, err)
+
+	// the payload compressed once is sent as is, as a gzip payload
+	encodedPayload, err := precompressedGzipContentEncoding.encode(compressedPayload)
+	assert.Nil(t, err)
+	assert.Equal(t, compressedPayload, encodedPayload)
+	assert.Equal(t, "gzip", precompressedGzipContentEncoding.name())
+
+	decompressedPayload, err := decompress(encodedPayload)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("my payload"), decompressedPayload)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/logs/client"
@@ -40,7 +41,7 @@ var emptyPayload []byte
 // Destination sends a payload over HTTP.
 type Destination struct {
 	url                 string
-	apiKey              string
+	apiKey              atomic.Value // string
 	contentType         string
 	host                string
 	contentEncoding     ContentEncoding
@@ -64,6 +65,14 @@ func NewDestination(endpoint config.Endpoint, contentType string, destinationsCo
 	return newDestination(endpoint, contentType, destinationsContext, time.Second*10, maxConcurrentBackgroundSends)
 }
 
+// NewPrecompressedDestination returns a new Destination sending payloads already compressed with gzip, such as the
+// batches compressed once for all the destinations, regardless of the compression settings of the endpoint.
+func NewPrecompressedDestination(endpoint config.Endpoint, contentType string, destinationsContext *client.DestinationsContext, maxConcurrentBackgroundSends int) *Destination {
+	destination := newDestination(endpoint, contentType, destinationsContext, time.Second*10, maxConcurrentBackgroundSends)
+	destination.contentEncoding = precompressedGzipContentEncoding
+	return destination
+}
+
 func newDestination(endpoint config.Endpoint, contentType string, destinationsContext *client.DestinationsContext, timeout time.Duration, maxConcurrentBackgroundSends int) *Destination {
 	if maxConcurrentBackgroundSends < 0 {
 		maxConcurrentBackgroundSends = 0
@@ -77,10 +86,9 @@ func newDestination(endpoint config.Endpoint, contentType string, destinationsCo
 		endpoint.RecoveryReset,
 	)
 
-	return &Destination{
+	destination := &Destination{
 		host:                endpoint.Host,
 		url:                 buildURL(endpoint),
-		apiKey:              endpoint.APIKey,
 		contentType:         contentType,
 		contentEncoding:     buildContentEncoding(endpoint),
 		client:              httputils.NewResetClient(endpoint.ConnectionResetInterval, httpClientFactory(timeout)),
@@ -90,6 +98,16 @@ func newDestination(endpoint config.Endpoint, contentType string, destinationsCo
 		protocol:            endpoint.Protocol,
 		origin:              endpoint.Origin,
 	}
+	destination.apiKey.Store(endpoint.APIKey)
+	return destination
+}
+
+// UpdateAPIKey replaces the API key of the destination if it is oldKey, such as when the key was resolved
+// again after it changed.
+func (d *Destination) UpdateAPIKey(oldKey, newKey string) {
+	if d.apiKey.Load().(string) == oldKey {
+		d.apiKey.Store(newKey)
+	}
 }
 
 func errorToTag(err error) string {
@@ -143,7 +161,7 @@ func (d *Destination) unconditionalSend(payload []byte) (err error) {
 		// this can happen when the method or the url are valid.
 		return err
 	}
-	req.Header.Set("DD-API-KEY", d.apiKey)
+	req.Header.Set("DD-API-KEY", d.apiKey.Load().(string))
 	req.Header.Set("Content-Type", d.contentType)
 	req.Header.Set("Content-Encoding", d.contentEncoding.name())
 	if d.protocol != "" {
@@ -232,7 +250,7 @@ func httpClientFactory(timeout time.Duration) func() *http.Client {
 		return &http.Client{
 			Timeout: timeout,
 			// reusing core agent HTTP transport to benefit from proxy settings.
-			Transport: httputils.CreateHTTPTransport(),
+			Transport: httputils.WithProxyErrors(httputils.CreateHTTPTransport()),
 		}
 	}
 }
@@ -172,3 +172,14 @@ func TestDestinationDoesntSendEmptyV2Protocol(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Empty(t, server.request.Header.Values("dd-protocol"))
 }
+
+func TestPrecompressedDestination(t *testing.T) {
+	server := NewHTTPServerTest(200)
+	defer server.httpServer.Close()
+
+	// the endpoint doesn't use compression, the payloads are compressed by the sender
+	destination := NewPrecompressedDestination(server.endpoint, JSONContentType, server.destCtx, 0)
+	err := destination.unconditionalSend([]byte("payload"))
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip", server.request.Header.Get("Content-Encoding"))
+}
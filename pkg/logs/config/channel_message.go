@@ -5,7 +5,10 @@
 
 package config
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // ChannelMessage represents a log line sent to datadog, with its metadata
 type ChannelMessage struct {
@@ -16,6 +19,18 @@ type ChannelMessage struct {
 	// Optional.
 	// Used in the Serverless Agent
 	Lambda *Lambda
+	// IsError sends the log with the error status instead of info
+	// Used in the Serverless Agent
+	IsError bool
+	// Status, when set, is the status of the log, it has precedence over IsError
+	// Used in the Serverless Agent
+	Status string
+	// Tags are added to the tags of the log
+	// Used in the Serverless Agent
+	Tags []string
+	// Service, when set, is the service of the log
+	// Used in the Serverless Agent
+	Service string
 }
 
 // Lambda is a struct storing information about the Lambda function and function execution.
@@ -23,6 +38,13 @@ type Lambda struct {
 	ARN          string
 	RequestID    string
 	FunctionName string
+	// TraceID and SpanID correlate the log with the trace of the execution, when known
+	TraceID string
+	SpanID  string
+	// Tags are the custom tags of the execution, added to the tags of the log
+	Tags []string
+	// Attributes are the fields of a structured log line whose message was extracted, sent along the message
+	Attributes map[string]json.RawMessage
 }
 
 // NewChannelMessageFromLambda construts a message with content and with the given timestamp and Lambda metadata
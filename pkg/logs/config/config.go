@@ -132,10 +132,30 @@ func BuildEndpointsWithConfig(logsConfig *LogsConfigKeys, endpointPrefix string,
 	return buildTCPEndpoints(logsConfig)
 }
 
-// BuildServerlessEndpoints returns the endpoints to send logs for the Serverless agent.
+// BuildServerlessEndpoints returns the endpoints to send logs for the Serverless agent. Its batches are bounded by the
+// serverless settings, tuned to send the logs of a chatty function in a few payloads within the flush timeout.
 func BuildServerlessEndpoints(intakeTrackType IntakeTrackType, intakeProtocol IntakeProtocol) (*Endpoints, error) {
 	coreConfig.SanitizeAPIKeyConfig(coreConfig.Datadog, "logs_config.api_key")
-	return BuildHTTPEndpointsWithConfig(defaultLogsConfigKeys(), serverlessHTTPEndpointPrefix, intakeTrackType, intakeProtocol, ServerlessIntakeOrigin)
+	endpoints, err := BuildHTTPEndpointsWithConfig(defaultLogsConfigKeys(), serverlessHTTPEndpointPrefix, intakeTrackType, intakeProtocol, ServerlessIntakeOrigin)
+	if err != nil {
+		return nil, err
+	}
+	endpoints.BatchMaxSize = serverlessBatchSetting("serverless.logs_batch_max_size", coreConfig.DefaultServerlessBatchMaxSize, 1)
+	endpoints.BatchMaxContentSize = serverlessBatchSetting("serverless.logs_batch_max_content_size", coreConfig.DefaultServerlessBatchMaxContentSize, 1)
+	endpoints.BatchMaxCompressedSize = serverlessBatchSetting("serverless.logs_batch_max_compressed_size", coreConfig.DefaultServerlessBatchMaxCompressedSize, 1)
+	endpoints.BatchMaxConcurrentSend = serverlessBatchSetting("serverless.logs_batch_max_concurrent_send", coreConfig.DefaultServerlessBatchMaxConcurrentSend, 0)
+	return endpoints, nil
+}
+
+// serverlessBatchSetting returns the value of a batch setting of the serverless agent, or its default value when it
+// is lower than min
+func serverlessBatchSetting(key string, defaultValue int, min int) int {
+	value := coreConfig.Datadog.GetInt(key)
+	if value < min {
+		log.Warnf("Invalid %s: %v should be >= %v, fallback on %v", key, value, min, defaultValue)
+		return defaultValue
+	}
+	return value
 }
 
 // ExpectedTagsDuration returns a duration of the time expected tags will be submitted for.
@@ -514,9 +514,10 @@ func (suite *ConfigTestSuite) TestBuildServerlessEndpoints() {
 			Origin:           "lambda-extension",
 			Protocol:         "test-proto",
 		},
-		BatchMaxSize:           coreConfig.DefaultBatchMaxSize,
-		BatchMaxContentSize:    coreConfig.DefaultBatchMaxContentSize,
-		BatchMaxConcurrentSend: coreConfig.DefaultBatchMaxConcurrentSend,
+		BatchMaxSize:           coreConfig.DefaultServerlessBatchMaxSize,
+		BatchMaxContentSize:    coreConfig.DefaultServerlessBatchMaxContentSize,
+		BatchMaxCompressedSize: coreConfig.DefaultServerlessBatchMaxCompressedSize,
+		BatchMaxConcurrentSend: coreConfig.DefaultServerlessBatchMaxConcurrentSend,
 	}
 
 	endpoints, err := BuildServerlessEndpoints("test-track", "test-proto")
@@ -524,3 +525,20 @@ func (suite *ConfigTestSuite) TestBuildServerlessEndpoints() {
 	suite.Nil(err)
 	suite.Equal(expectedEndpoints, endpoints)
 }
+
+func (suite *ConfigTestSuite) TestBuildServerlessEndpointsBatchSettings() {
+	suite.config.Set("api_key", "123")
+	suite.config.Set("serverless.logs_batch_max_size", 500)
+	suite.config.Set("serverless.logs_batch_max_compressed_size", 512*1024)
+	suite.config.Set("serverless.logs_batch_max_concurrent_send", 0)
+	// the invalid settings fall back on their default value
+	suite.config.Set("serverless.logs_batch_max_content_size", 0)
+
+	endpoints, err := BuildServerlessEndpoints("test-track", "test-proto")
+
+	suite.Nil(err)
+	suite.Equal(500, endpoints.BatchMaxSize)
+	suite.Equal(coreConfig.DefaultServerlessBatchMaxContentSize, endpoints.BatchMaxContentSize)
+	suite.Equal(512*1024, endpoints.BatchMaxCompressedSize)
+	suite.Equal(0, endpoints.BatchMaxConcurrentSend)
+}
@@ -64,6 +64,9 @@ type Endpoints struct {
 	BatchMaxConcurrentSend int
 	BatchMaxSize           int
 	BatchMaxContentSize    int
+	// BatchMaxCompressedSize bounds the compressed size of the batches compressed once for all the destinations,
+	// the batches compressed over it are split. 0 means unbounded.
+	BatchMaxCompressedSize int
 }
 
 // NewEndpoints returns a new endpoints composite with default batching settings
@@ -56,16 +56,37 @@ func (t *Tailer) run() {
 		origin := message.NewOrigin(t.source)
 		tags := origin.Tags()
 
-		origin.SetService(computeServiceName(logline.Lambda, os.Getenv(serviceEnvVar)))
+		if logline.Service != "" {
+			origin.SetService(logline.Service)
+		} else {
+			origin.SetService(computeServiceName(logline.Lambda, os.Getenv(serviceEnvVar)))
+		}
 
 		if len(t.source.Config.Tags) > 0 {
 			tags = append(tags, t.source.Config.Tags...)
 		}
+		if logline.Lambda != nil && len(logline.Lambda.Tags) > 0 {
+			tags = append(tags, logline.Lambda.Tags...)
+		}
+		if len(logline.Tags) > 0 {
+			tags = append(tags, logline.Tags...)
+		}
 		origin.SetTags(tags)
+		status := message.StatusInfo
+		if logline.IsError {
+			status = message.StatusError
+		}
+		if logline.Status != "" {
+			status = logline.Status
+		}
 		if logline.Lambda != nil {
-			t.outputChan <- message.NewMessageFromLambda(logline.Content, origin, message.StatusInfo, logline.Timestamp, logline.Lambda.ARN, logline.Lambda.RequestID, time.Now().UnixNano())
+			msg := message.NewMessageFromLambda(logline.Content, origin, status, logline.Timestamp, logline.Lambda.ARN, logline.Lambda.RequestID, time.Now().UnixNano())
+			msg.Lambda.TraceID = logline.Lambda.TraceID
+			msg.Lambda.SpanID = logline.Lambda.SpanID
+			msg.Lambda.Attributes = logline.Lambda.Attributes
+			t.outputChan <- msg
 		} else {
-			t.outputChan <- message.NewMessage(logline.Content, origin, message.StatusInfo, time.Now().UnixNano())
+			t.outputChan <- message.NewMessage(logline.Content, origin, status, time.Now().UnixNano())
 		}
 	}
 }
@@ -6,9 +6,12 @@
 package channel
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/logs/message"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,3 +22,61 @@ func TestComputeServiceName(t *testing.T) {
 	assert.Equal(t, "my-service-name", computeServiceName(lambdaConfig, "MY-SERVICE-NAME"))
 	assert.Equal(t, "", computeServiceName(lambdaConfig, ""))
 }
+
+func TestTailerStatus(t *testing.T) {
+	inputChan := make(chan *config.ChannelMessage, 3)
+	outputChan := make(chan *message.Message, 3)
+	tailer := NewTailer(config.NewLogSource("lambda", &config.LogsConfig{}), inputChan, outputChan)
+	tailer.Start()
+
+	inputChan <- config.NewChannelMessageFromLambda([]byte("hello"), time.Now().UTC(), "arn", "request-id")
+	errorMessage := config.NewChannelMessageFromLambda([]byte("crash"), time.Now().UTC(), "arn", "request-id")
+	errorMessage.IsError = true
+	inputChan <- errorMessage
+	warningMessage := config.NewChannelMessageFromLambda([]byte("retrying"), time.Now().UTC(), "arn", "request-id")
+	warningMessage.Status = message.StatusWarning
+	warningMessage.Lambda.Attributes = map[string]json.RawMessage{"attempt": json.RawMessage("2")}
+	inputChan <- warningMessage
+	tailer.WaitFlush()
+
+	assert.Equal(t, message.StatusInfo, (<-outputChan).GetStatus())
+	assert.Equal(t, message.StatusError, (<-outputChan).GetStatus())
+	warning := <-outputChan
+	assert.Equal(t, message.StatusWarning, warning.GetStatus())
+	assert.Equal(t, map[string]json.RawMessage{"attempt": json.RawMessage("2")}, warning.Lambda.Attributes)
+}
+
+func TestTailerLambdaTags(t *testing.T) {
+	inputChan := make(chan *config.ChannelMessage, 2)
+	outputChan := make(chan *message.Message, 2)
+	tailer := NewTailer(config.NewLogSource("lambda", &config.LogsConfig{}), inputChan, outputChan)
+	tailer.Start()
+
+	tagged := config.NewChannelMessageFromLambda([]byte("hello"), time.Now().UTC(), "arn", "request-1")
+	tagged.Lambda.Tags = []string{"tenant:acme"}
+	inputChan <- tagged
+	inputChan <- config.NewChannelMessageFromLambda([]byte("hello"), time.Now().UTC(), "arn", "request-2")
+	tailer.WaitFlush()
+
+	assert.Equal(t, []string{"tenant:acme"}, (<-outputChan).Origin.Tags())
+	// the custom tags are only added to the logs of their execution
+	assert.Empty(t, (<-outputChan).Origin.Tags())
+}
+
+func TestTailerContainerLogs(t *testing.T) {
+	inputChan := make(chan *config.ChannelMessage, 2)
+	outputChan := make(chan *message.Message, 2)
+	tailer := NewTailer(config.NewLogSource("serverless-init", &config.LogsConfig{}), inputChan, outputChan)
+	tailer.Start()
+
+	inputChan <- &config.ChannelMessage{Content: []byte("listening"), Tags: []string{"stream:stdout"}, Service: "web"}
+	inputChan <- &config.ChannelMessage{Content: []byte("hello")}
+	tailer.WaitFlush()
+
+	msg := <-outputChan
+	assert.Equal(t, []string{"stream:stdout"}, msg.Origin.Tags())
+	assert.Equal(t, "web", msg.Origin.Service())
+	msg = <-outputChan
+	assert.Empty(t, msg.Origin.Tags())
+	assert.Equal(t, "agent", msg.Origin.Service())
+}
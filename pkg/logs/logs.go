@@ -22,6 +22,7 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/logs/config"
 	"github.com/DataDog/datadog-agent/pkg/logs/diagnostic"
 	"github.com/DataDog/datadog-agent/pkg/logs/scheduler"
+	"github.com/DataDog/datadog-agent/pkg/logs/sender"
 	"github.com/DataDog/datadog-agent/pkg/logs/service"
 	"github.com/DataDog/datadog-agent/pkg/logs/status"
 )
@@ -198,6 +199,19 @@ func Flush(ctx context.Context) {
 	log.Debug("Flush in the logs-agent done.")
 }
 
+// UpdateAPIKey replaces the API key used by the running instance of the Logs Agent when it is oldKey,
+// such as when the key was resolved again after it changed.
+func UpdateAPIKey(oldKey, newKey string) {
+	if IsAgentRunning() && agent != nil {
+		agent.UpdateAPIKey(oldKey, newKey)
+	}
+}
+
+// TakeBatchStats returns the stats of the batches of logs sent by the serverless logs-agent since the previous call
+func TakeBatchStats() []sender.BatchStats {
+	return sender.TakeBatchStats()
+}
+
 // IsAgentRunning returns true if the logs-agent is running.
 func IsAgentRunning() bool {
 	return status.Get().IsRunning
@@ -7,6 +7,7 @@ package message
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/logs/config"
@@ -31,6 +32,11 @@ type Message struct {
 type Lambda struct {
 	ARN       string
 	RequestID string
+	// TraceID and SpanID correlate the log with the trace of the execution, when known
+	TraceID string
+	SpanID  string
+	// Attributes are the fields of a structured log line whose message was extracted, sent along the message
+	Attributes map[string]json.RawMessage
 }
 
 // NewMessageWithSource constructs message with content, status and log source.
@@ -24,6 +24,16 @@ var (
 	// TlmLogsProcessed is the total number of processed logs.
 	TlmLogsProcessed = telemetry.NewCounter("logs", "processed",
 		nil, "Total number of processed logs")
+	// LogsExcluded is the total number of logs excluded by a processing rule.
+	LogsExcluded = expvar.Int{}
+	// TlmLogsExcluded is the total number of logs excluded by a processing rule.
+	TlmLogsExcluded = telemetry.NewCounter("logs", "excluded",
+		nil, "Total number of logs excluded by a processing rule")
+	// LogsMasked is the total number of logs with at least one sequence masked by a processing rule.
+	LogsMasked = expvar.Int{}
+	// TlmLogsMasked is the total number of logs with at least one sequence masked by a processing rule.
+	TlmLogsMasked = telemetry.NewCounter("logs", "masked",
+		nil, "Total number of logs with at least one sequence masked by a processing rule")
 
 	// LogsSent is the total number of sent logs.
 	LogsSent = expvar.Int{}
@@ -64,6 +74,8 @@ func init() {
 	LogsExpvars = expvar.NewMap("logs-agent")
 	LogsExpvars.Set("LogsDecoded", &LogsDecoded)
 	LogsExpvars.Set("LogsProcessed", &LogsProcessed)
+	LogsExpvars.Set("LogsExcluded", &LogsExcluded)
+	LogsExpvars.Set("LogsMasked", &LogsMasked)
 	LogsExpvars.Set("LogsSent", &LogsSent)
 	LogsExpvars.Set("DestinationErrors", &DestinationErrors)
 	LogsExpvars.Set("DestinationLogsDropped", &DestinationLogsDropped)
@@ -33,6 +33,9 @@ func (p *mockProvider) Stop() {}
 // Flush does nothing
 func (p *mockProvider) Flush(ctx context.Context) {}
 
+// UpdateAPIKey does nothing
+func (p *mockProvider) UpdateAPIKey(oldKey, newKey string) {}
+
 // NextPipelineChan returns the next pipeline
 func (p *mockProvider) NextPipelineChan() chan *message.Message {
 	return p.msgChan
@@ -27,12 +27,19 @@ type Pipeline struct {
 
 // NewPipeline returns a new Pipeline
 func NewPipeline(outputChan chan *message.Message, processingRules []*config.ProcessingRule, endpoints *config.Endpoints, destinationsContext *client.DestinationsContext, diagnosticMessageReceiver diagnostic.MessageReceiver, serverless bool) *Pipeline {
+	// in serverless, the batches are compressed once for all the destinations
+	compressBatches := serverless && endpoints.UseHTTP && endpoints.Main.UseCompression
+
 	var destinations *client.Destinations
 	if endpoints.UseHTTP {
-		main := http.NewDestination(endpoints.Main, http.JSONContentType, destinationsContext, endpoints.BatchMaxConcurrentSend)
+		newDestination := http.NewDestination
+		if compressBatches {
+			newDestination = http.NewPrecompressedDestination
+		}
+		main := newDestination(endpoints.Main, http.JSONContentType, destinationsContext, endpoints.BatchMaxConcurrentSend)
 		additionals := []client.Destination{}
 		for _, endpoint := range endpoints.Additionals {
-			additionals = append(additionals, http.NewDestination(endpoint, http.JSONContentType, destinationsContext, endpoints.BatchMaxConcurrentSend))
+			additionals = append(additionals, newDestination(endpoint, http.JSONContentType, destinationsContext, endpoints.BatchMaxConcurrentSend))
 		}
 		destinations = client.NewDestinations(main, additionals)
 	} else {
@@ -47,7 +54,10 @@ func NewPipeline(outputChan chan *message.Message, processingRules []*config.Pro
 	senderChan := make(chan *message.Message, config.ChanSize)
 
 	var strategy sender.Strategy
-	if endpoints.UseHTTP || serverless {
+	if compressBatches {
+		compress := http.NewGzipContentEncoding(endpoints.Main.CompressionLevel).Encode
+		strategy = sender.NewCompressedBatchStrategy(sender.ArraySerializer, compress, endpoints.BatchWait, endpoints.BatchMaxConcurrentSend, endpoints.BatchMaxSize, endpoints.BatchMaxContentSize, endpoints.BatchMaxCompressedSize, "logs")
+	} else if endpoints.UseHTTP || serverless {
 		strategy = sender.NewBatchStrategy(sender.ArraySerializer, endpoints.BatchWait, endpoints.BatchMaxConcurrentSend, endpoints.BatchMaxSize, endpoints.BatchMaxContentSize, "logs")
 	} else {
 		strategy = sender.StreamStrategy
@@ -92,3 +102,8 @@ func (p *Pipeline) Flush(ctx context.Context) {
 	p.processor.Flush(ctx) // flush messages in the processor into the sender
 	p.sender.Flush(ctx)    // flush the sender
 }
+
+// UpdateAPIKey replaces the API key of the destinations of this pipeline using oldKey.
+func (p *Pipeline) UpdateAPIKey(oldKey, newKey string) {
+	p.sender.UpdateAPIKey(oldKey, newKey)
+}
@@ -25,6 +25,8 @@ type Provider interface {
 	NextPipelineChan() chan *message.Message
 	// Flush flushes all pipeline contained in this Provider
 	Flush(ctx context.Context)
+	// UpdateAPIKey replaces the API key of the destinations of all the pipelines using oldKey
+	UpdateAPIKey(oldKey, newKey string)
 }
 
 // provider implements providing logic
@@ -113,3 +115,10 @@ func (p *provider) Flush(ctx context.Context) {
 		}
 	}
 }
+
+// UpdateAPIKey replaces the API key of the destinations of all the pipelines using oldKey.
+func (p *provider) UpdateAPIKey(oldKey, newKey string) {
+	for _, p := range p.pipelines {
+		p.UpdateAPIKey(oldKey, newKey)
+	}
+}
@@ -227,3 +227,47 @@ func TestEncoderToValidUTF8(t *testing.T) {
 	assert.Equal(t, "a���z", toValidUtf8([]byte("a\xed\xa0\x80z")))
 	assert.Equal(t, "a����z", toValidUtf8([]byte("a\xf0\x8f\xbf\xbfz")))
 }
+
+func TestJsonServerlessEncoderTraceContext(t *testing.T) {
+	source := config.NewLogSource("", &config.LogsConfig{Source: "lambda"})
+	msg := message.NewMessageFromLambda([]byte("message"), message.NewOrigin(source), message.StatusInfo, time.Now().UTC(), "arn", "request-1", 0)
+	msg.Lambda.TraceID = "7043144561403045779"
+	msg.Lambda.SpanID = "6023947403358210776"
+
+	jsonMessage, err := JSONServerlessEncoder.Encode(msg, []byte("hello"))
+	assert.Nil(t, err)
+	log := &jsonServerlessPayload{}
+	assert.Nil(t, json.Unmarshal(jsonMessage, log))
+	assert.Equal(t, "request-1", log.Message.Lambda.RequestID)
+	assert.Equal(t, &jsonServerlessTrace{TraceID: "7043144561403045779", SpanID: "6023947403358210776"}, log.Message.DD)
+
+	// the trace context injected by the tracer wins
+	jsonMessage, err = JSONServerlessEncoder.Encode(msg, []byte(`{"message":"hello","dd.trace_id":"1234"}`))
+	assert.Nil(t, err)
+	log = &jsonServerlessPayload{}
+	assert.Nil(t, json.Unmarshal(jsonMessage, log))
+	assert.Nil(t, log.Message.DD)
+}
+
+func TestJsonServerlessEncoderAttributes(t *testing.T) {
+	source := config.NewLogSource("", &config.LogsConfig{Source: "lambda"})
+	msg := message.NewMessageFromLambda([]byte("order created"), message.NewOrigin(source), message.StatusInfo, time.Now().UTC(), "arn", "request-1", 0)
+	msg.Lambda.TraceID = "7043144561403045779"
+	msg.Lambda.Attributes = map[string]json.RawMessage{
+		"order_id": json.RawMessage(`"o-42"`),
+		"items":    json.RawMessage(`[1,2]`),
+		"lambda":   json.RawMessage(`"shadowed"`),
+	}
+
+	jsonMessage, err := JSONServerlessEncoder.Encode(msg, []byte("order created"))
+	assert.Nil(t, err)
+	var log struct {
+		Message map[string]json.RawMessage `json:"message"`
+	}
+	assert.Nil(t, json.Unmarshal(jsonMessage, &log))
+	assert.Equal(t, `"order created"`, string(log.Message["message"]))
+	assert.Equal(t, `"o-42"`, string(log.Message["order_id"]))
+	assert.Equal(t, `[1,2]`, string(log.Message["items"]))
+	assert.JSONEq(t, `{"arn":"arn","request_id":"request-1"}`, string(log.Message["lambda"]))
+	assert.JSONEq(t, `{"trace_id":"7043144561403045779"}`, string(log.Message["dd"]))
+}
@@ -6,6 +6,7 @@
 package processor
 
 import (
+	"bytes"
 	"encoding/json"
 	"time"
 
@@ -34,6 +35,29 @@ type jsonServerlessPayload struct {
 type jsonServerlessMessage struct {
 	Message string                `json:"message"`
 	Lambda  *jsonServerlessLambda `json:"lambda,omitempty"`
+	DD      *jsonServerlessTrace  `json:"dd,omitempty"`
+	// Attributes are sent along the message, the fields above win over the attributes with the same name
+	Attributes map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON merges the attributes with the fields of the message
+func (m jsonServerlessMessage) MarshalJSON() ([]byte, error) {
+	type message jsonServerlessMessage
+	if len(m.Attributes) == 0 {
+		return json.Marshal(message(m))
+	}
+	fields := make(map[string]interface{}, len(m.Attributes)+3)
+	for name, value := range m.Attributes {
+		fields[name] = value
+	}
+	fields["message"] = m.Message
+	if m.Lambda != nil {
+		fields["lambda"] = m.Lambda
+	}
+	if m.DD != nil {
+		fields["dd"] = m.DD
+	}
+	return json.Marshal(fields)
 }
 
 type jsonServerlessLambda struct {
@@ -41,6 +65,15 @@ type jsonServerlessLambda struct {
 	RequestID string `json:"request_id,omitempty"`
 }
 
+// jsonServerlessTrace holds the attributes correlating the log with a trace
+type jsonServerlessTrace struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id,omitempty"`
+}
+
+// ddTraceIDAttribute is the attribute injected by the tracers in the logs of a traced execution
+var ddTraceIDAttribute = []byte("dd.trace_id")
+
 // Encode encodes a message into a JSON byte array.
 func (j *jsonServerlessEncoder) Encode(msg *message.Message, redactedMsg []byte) ([]byte, error) {
 	ts := time.Now().UTC()
@@ -50,17 +83,29 @@ func (j *jsonServerlessEncoder) Encode(msg *message.Message, redactedMsg []byte)
 
 	// add lambda metadata
 	var lambdaPart *jsonServerlessLambda
+	var tracePart *jsonServerlessTrace
+	var attributes map[string]json.RawMessage
 	if l := msg.Lambda; l != nil {
+		attributes = l.Attributes
 		lambdaPart = &jsonServerlessLambda{
 			ARN:       l.ARN,
 			RequestID: l.RequestID,
 		}
+		// the trace context injected by the tracer in the log wins over the one of the execution
+		if l.TraceID != "" && !bytes.Contains(redactedMsg, ddTraceIDAttribute) {
+			tracePart = &jsonServerlessTrace{
+				TraceID: l.TraceID,
+				SpanID:  l.SpanID,
+			}
+		}
 	}
 
 	return json.Marshal(jsonServerlessPayload{
 		Message: jsonServerlessMessage{
-			Message: toValidUtf8(redactedMsg),
-			Lambda:  lambdaPart,
+			Message:    toValidUtf8(redactedMsg),
+			Lambda:     lambdaPart,
+			DD:         tracePart,
+			Attributes: attributes,
 		},
 		Status:    msg.GetStatus(),
 		Timestamp: ts.UnixNano() / nanoToMillis,
@@ -6,6 +6,7 @@
 package processor
 
 import (
+	"bytes"
 	"context"
 	"sync"
 
@@ -104,23 +105,38 @@ func (p *Processor) processMessage(msg *message.Message) {
 }
 
 // applyRedactingRules returns given a message if we should process it or not,
-// and a copy of the message with some fields redacted, depending on config
+// and a copy of the message with some fields redacted, depending on config.
+// The rules are applied in order, the global ones first.
 func (p *Processor) applyRedactingRules(msg *message.Message) (bool, []byte) {
 	content := msg.Content
+	masked := false
 	rules := append(p.processingRules, msg.Origin.LogSource.Config.ProcessingRules...)
 	for _, rule := range rules {
 		switch rule.Type {
 		case config.ExcludeAtMatch:
 			if rule.Regex.Match(content) {
+				metrics.LogsExcluded.Add(1)
+				metrics.TlmLogsExcluded.Inc()
 				return false, nil
 			}
 		case config.IncludeAtMatch:
 			if !rule.Regex.Match(content) {
+				metrics.LogsExcluded.Add(1)
+				metrics.TlmLogsExcluded.Inc()
 				return false, nil
 			}
 		case config.MaskSequences:
-			content = rule.Regex.ReplaceAll(content, rule.Placeholder)
+			// a single pass, the content is masked when a sequence is replaced with a different one
+			replaced := rule.Regex.ReplaceAll(content, rule.Placeholder)
+			if !bytes.Equal(replaced, content) {
+				masked = true
+			}
+			content = replaced
 		}
 	}
+	if masked {
+		metrics.LogsMasked.Add(1)
+		metrics.TlmLogsMasked.Inc()
+	}
 	return true, content
 }
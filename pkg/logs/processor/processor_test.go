@@ -6,11 +6,13 @@
 package processor
 
 import (
+	"bytes"
 	"regexp"
 	"testing"
 
 	"github.com/DataDog/datadog-agent/pkg/logs/config"
 	"github.com/DataDog/datadog-agent/pkg/logs/message"
+	"github.com/DataDog/datadog-agent/pkg/logs/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -138,6 +140,72 @@ func TestTruncate(t *testing.T) {
 	assert.Equal(t, []byte("hello"), redactedMessage)
 }
 
+func TestProcessingRulesOrder(t *testing.T) {
+	mask := newProcessingRule("mask_sequences", "api_key=[masked]", "api_key=[a-f0-9]{32}")
+	exclude := newProcessingRule("exclude_at_match", "", "api_key=[a-f0-9]{32}")
+	content := []byte("calling the API with api_key=0123456789abcdef0123456789abcdef")
+	source := config.NewLogSource("", &config.LogsConfig{})
+
+	// masked before the exclusion is evaluated
+	p := &Processor{processingRules: []*config.ProcessingRule{mask, exclude}}
+	shouldProcess, redactedMessage := p.applyRedactingRules(newMessage(content, source, ""))
+	assert.True(t, shouldProcess)
+	assert.Equal(t, []byte("calling the API with api_key=[masked]"), redactedMessage)
+
+	// excluded before being masked
+	p = &Processor{processingRules: []*config.ProcessingRule{exclude, mask}}
+	shouldProcess, _ = p.applyRedactingRules(newMessage(content, source, ""))
+	assert.False(t, shouldProcess)
+
+	// the global rules are applied before the rules of the source
+	sourceWithRules := newSource("mask_sequences", "[masked_again]", "\\[masked\\]")
+	p = &Processor{processingRules: []*config.ProcessingRule{mask}}
+	shouldProcess, redactedMessage = p.applyRedactingRules(newMessage(content, &sourceWithRules, ""))
+	assert.True(t, shouldProcess)
+	assert.Equal(t, []byte("calling the API with api_key=[masked_again]"), redactedMessage)
+}
+
+func TestProcessingRulesLargeMessage(t *testing.T) {
+	p := &Processor{processingRules: []*config.ProcessingRule{
+		newProcessingRule("mask_sequences", "api_key=[masked]", "api_key=[a-f0-9]{32}"),
+		newProcessingRule("exclude_at_match", "", "DEBUG"),
+	}}
+	source := config.NewLogSource("", &config.LogsConfig{})
+	secret := "api_key=0123456789abcdef0123456789abcdef"
+
+	// a line close to the size cap of the logs, with the sequence to mask at its very end
+	content := append(bytes.Repeat([]byte("a"), 256*1000-len(secret)), secret...)
+	shouldProcess, redactedMessage := p.applyRedactingRules(newMessage(content, source, ""))
+	assert.True(t, shouldProcess)
+	assert.Equal(t, 256*1000-len(secret)+len("api_key=[masked]"), len(redactedMessage))
+	assert.True(t, bytes.HasSuffix(redactedMessage, []byte("aaaapi_key=[masked]")))
+
+	content = append(bytes.Repeat([]byte("a"), 256*1000-len("DEBUG")), "DEBUG"...)
+	shouldProcess, _ = p.applyRedactingRules(newMessage(content, source, ""))
+	assert.False(t, shouldProcess)
+}
+
+func TestProcessingRulesCounters(t *testing.T) {
+	p := &Processor{processingRules: []*config.ProcessingRule{
+		newProcessingRule("mask_sequences", "[masked]", "secret"),
+		newProcessingRule("exclude_at_match", "", "DEBUG"),
+	}}
+	source := config.NewLogSource("", &config.LogsConfig{})
+	excluded, masked := metrics.LogsExcluded.Value(), metrics.LogsMasked.Value()
+
+	p.applyRedactingRules(newMessage([]byte("hello"), source, ""))
+	p.applyRedactingRules(newMessage([]byte("a secret and another secret"), source, ""))
+	p.applyRedactingRules(newMessage([]byte("DEBUG hello"), source, ""))
+	// a sequence replaced with the same content doesn't mask the log
+	p.applyRedactingRules(newMessage([]byte("already [masked]"), &config.LogSource{Config: &config.LogsConfig{
+		ProcessingRules: []*config.ProcessingRule{newProcessingRule("mask_sequences", "[masked]", `\[masked\]`)},
+	}}, ""))
+
+	assert.Equal(t, excluded+1, metrics.LogsExcluded.Value())
+	// a log is counted once whatever the number of sequences masked
+	assert.Equal(t, masked+1, metrics.LogsMasked.Value())
+}
+
 func newProcessingRule(ruleType, replacePlaceholder, pattern string) *config.ProcessingRule {
 	return &config.ProcessingRule{
 		Type:               ruleType,
@@ -0,0 +1,54 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package sender
+
+import (
+	"sync"
+)
+
+// maxPendingBatchStats bounds the number of batch stats kept until they are taken, the stats of the batches sent
+// once it is reached are dropped
+const maxPendingBatchStats = 1024
+
+// BatchStats describes a batch of logs compressed once for all the destinations
+type BatchStats struct {
+	// Entries is the number of logs of the batch
+	Entries int
+	// ContentSize and CompressedSize are the size of the payload of the batch before and after compression
+	ContentSize    int
+	CompressedSize int
+}
+
+// CompressionRatio returns the ratio of the size of the payload before compression over its compressed size
+func (b BatchStats) CompressionRatio() float64 {
+	if b.CompressedSize == 0 {
+		return 0
+	}
+	return float64(b.ContentSize) / float64(b.CompressedSize)
+}
+
+var pendingBatchStats struct {
+	sync.Mutex
+	stats []BatchStats
+}
+
+// recordBatchStats keeps the stats of a batch sent until they are taken
+func recordBatchStats(stats BatchStats) {
+	pendingBatchStats.Lock()
+	defer pendingBatchStats.Unlock()
+	if len(pendingBatchStats.stats) < maxPendingBatchStats {
+		pendingBatchStats.stats = append(pendingBatchStats.stats, stats)
+	}
+}
+
+// TakeBatchStats returns the stats of the batches compressed once for all the destinations since the previous call
+func TakeBatchStats() []BatchStats {
+	pendingBatchStats.Lock()
+	defer pendingBatchStats.Unlock()
+	stats := pendingBatchStats.stats
+	pendingBatchStats.stats = nil
+	return stats
+}
@@ -0,0 +1,195 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package sender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/logs/message"
+)
+
+func gzipCompress(payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// entriesRecorder records the entries of the compressed payloads sent, the payloads being arrays of integers
+type entriesRecorder struct {
+	sync.Mutex
+	t        *testing.T
+	payloads int
+	entries  []int
+}
+
+func (r *entriesRecorder) send(payload []byte) error {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	require.NoError(r.t, err)
+	decompressed, err := ioutil.ReadAll(reader)
+	require.NoError(r.t, err)
+	var entries []int
+	require.NoError(r.t, json.Unmarshal(decompressed, &entries))
+
+	r.Lock()
+	defer r.Unlock()
+	r.payloads++
+	r.entries = append(r.entries, entries...)
+	return nil
+}
+
+func (r *entriesRecorder) sortedEntries() []int {
+	r.Lock()
+	defer r.Unlock()
+	entries := append([]int{}, r.entries...)
+	sort.Ints(entries)
+	return entries
+}
+
+func expectedEntries(n int) []int {
+	entries := make([]int, n)
+	for i := range entries {
+		entries[i] = i
+	}
+	return entries
+}
+
+func sendEntries(input chan *message.Message, from int, to int) {
+	for i := from; i < to; i++ {
+		input <- message.NewMessage([]byte(strconv.Itoa(i)), nil, "", 0)
+	}
+}
+
+func TestCompressedBatchStrategyEntriesSentOnce(t *testing.T) {
+	TakeBatchStats()
+	input := make(chan *message.Message)
+	output := make(chan *message.Message, 100)
+	recorder := &entriesRecorder{t: t}
+
+	// the batches of 4 logs are sent concurrently, the flush timer doesn't trigger during the test
+	strategy := NewCompressedBatchStrategy(ArraySerializer, gzipCompress, time.Hour, 2, 4, 1000, 1000, "test")
+	done := make(chan bool)
+	go func() {
+		strategy.Send(input, output, recorder.send)
+		close(done)
+	}()
+
+	sendEntries(input, 0, 10)
+	// a flush canceled before it starts, such as after the flush timeout, leaves the partial batch in place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	strategy.Flush(ctx)
+	sendEntries(input, 10, 25)
+
+	// the flush forces the partial batch out and waits for the concurrent sends
+	strategy.Flush(context.Background())
+	assert.Equal(t, expectedEntries(25), recorder.sortedEntries())
+	assert.Equal(t, 7, recorder.payloads)
+	assert.Len(t, output, 25)
+
+	stats := TakeBatchStats()
+	require.Len(t, stats, 7)
+	var entries int
+	for _, batch := range stats {
+		assert.LessOrEqual(t, batch.Entries, 4)
+		assert.Greater(t, batch.ContentSize, 0)
+		assert.Greater(t, batch.CompressedSize, 0)
+		entries += batch.Entries
+	}
+	assert.Equal(t, 25, entries)
+
+	// the messages of the last flush aren't sent again when the strategy stops
+	close(input)
+	<-done
+	assert.Equal(t, expectedEntries(25), recorder.sortedEntries())
+	assert.Len(t, output, 25)
+}
+
+func TestCompressedBatchStrategySplitsOverCompressedSize(t *testing.T) {
+	TakeBatchStats()
+	input := make(chan *message.Message)
+	output := make(chan *message.Message, 100)
+	recorder := &entriesRecorder{t: t}
+
+	// no compressed payload fits, the batches are split down to a single log
+	strategy := NewCompressedBatchStrategy(ArraySerializer, gzipCompress, time.Hour, 0, 10, 1000, 1, "test")
+	done := make(chan bool)
+	go func() {
+		strategy.Send(input, output, recorder.send)
+		close(done)
+	}()
+
+	sendEntries(input, 0, 23)
+	close(input)
+	<-done
+
+	assert.Equal(t, expectedEntries(23), recorder.sortedEntries())
+	assert.Equal(t, 23, recorder.payloads)
+	assert.Len(t, output, 23)
+	for _, batch := range TakeBatchStats() {
+		assert.Equal(t, 1, batch.Entries)
+	}
+}
+
+func TestCompressedBatchStrategyCompressionError(t *testing.T) {
+	TakeBatchStats()
+	input := make(chan *message.Message)
+	output := make(chan *message.Message, 10)
+	sent := 0
+	send := func(payload []byte) error {
+		sent++
+		return nil
+	}
+	failingCompress := func(payload []byte) ([]byte, error) {
+		return nil, assert.AnError
+	}
+
+	strategy := NewCompressedBatchStrategy(ArraySerializer, failingCompress, time.Hour, 0, 2, 1000, 1000, "test")
+	done := make(chan bool)
+	go func() {
+		strategy.Send(input, output, send)
+		close(done)
+	}()
+	sendEntries(input, 0, 3)
+	close(input)
+	<-done
+
+	// the logs whose payload can't be compressed are counted as dropped, but the pipeline doesn't block
+	assert.Equal(t, 0, sent)
+	assert.Len(t, output, 3)
+	assert.Empty(t, TakeBatchStats())
+}
+
+func TestBatchStatsCompressionRatio(t *testing.T) {
+	assert.Equal(t, 4.0, BatchStats{Entries: 10, ContentSize: 1000, CompressedSize: 250}.CompressionRatio())
+	assert.Equal(t, 0.0, BatchStats{}.CompressionRatio())
+}
+
+func TestTakeBatchStatsBounded(t *testing.T) {
+	TakeBatchStats()
+	for i := 0; i < maxPendingBatchStats+10; i++ {
+		recordBatchStats(BatchStats{Entries: 1})
+	}
+	assert.Len(t, TakeBatchStats(), maxPendingBatchStats)
+	assert.Empty(t, TakeBatchStats())
+}
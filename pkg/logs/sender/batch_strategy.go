@@ -18,7 +18,8 @@ import (
 )
 
 var (
-	tlmDroppedTooLarge = telemetry.NewCounter("logs_sender_batch_strategy", "dropped_too_large", []string{"pipeline"}, "Number of payloads dropped due to being too large")
+	tlmDroppedTooLarge         = telemetry.NewCounter("logs_sender_batch_strategy", "dropped_too_large", []string{"pipeline"}, "Number of payloads dropped due to being too large")
+	tlmDroppedCompressionError = telemetry.NewCounter("logs_sender_batch_strategy", "dropped_compression_error", []string{"pipeline"}, "Number of logs dropped because their payload couldn't be compressed")
 )
 
 // batchStrategy contains all the logic to send logs in batch.
@@ -32,6 +33,10 @@ type batchStrategy struct {
 	pendingSends     sync.WaitGroup // waitgroup for concurrent sends
 	syncFlushTrigger chan struct{}  // trigger a synchronous flush
 	syncFlushDone    chan struct{}  // wait for a synchronous flush to finish
+	// compress compresses the payloads once for all the destinations, nil when they compress the payloads themselves
+	compress func(payload []byte) ([]byte, error)
+	// maxCompressedSize bounds the size of the compressed payloads, the batches compressed over it are split
+	maxCompressedSize int
 }
 
 // NewBatchStrategy returns a new batch concurrent strategy with the specified batch & content size limits
@@ -53,6 +58,16 @@ func NewBatchStrategy(serializer Serializer, batchWait time.Duration, maxConcurr
 
 }
 
+// NewCompressedBatchStrategy returns a new batch concurrent strategy compressing each batch once for all the
+// destinations, which must send the payloads as is. A batch compressed over `maxCompressedSize` is split in halves
+// until they fit, if `maxCompressedSize` > 0. The stats of the batches sent are kept until TakeBatchStats is called.
+func NewCompressedBatchStrategy(serializer Serializer, compress func(payload []byte) ([]byte, error), batchWait time.Duration, maxConcurrent int, maxBatchSize int, maxContentSize int, maxCompressedSize int, pipelineName string) Strategy {
+	strategy := NewBatchStrategy(serializer, batchWait, maxConcurrent, maxBatchSize, maxContentSize, pipelineName).(*batchStrategy)
+	strategy.compress = compress
+	strategy.maxCompressedSize = maxCompressedSize
+	return strategy
+}
+
 func (s *batchStrategy) Flush(ctx context.Context) {
 	select {
 	case <-ctx.Done():
@@ -148,7 +163,29 @@ func (s *batchStrategy) flushBuffer(outputChan chan *message.Message, send func(
 }
 
 func (s *batchStrategy) sendMessages(messages []*message.Message, outputChan chan *message.Message, send func([]byte) error) {
-	err := send(s.serializer.Serialize(messages))
+	payload := s.serializer.Serialize(messages)
+	if s.compress != nil {
+		compressedPayload, err := s.compress(payload)
+		if err != nil {
+			// the destination expects a compressed payload, the logs are dropped but still passed to the
+			// auditor so that the pipeline doesn't block
+			log.Warnf("Could not compress payload, dropping %d logs: %v", len(messages), err)
+			tlmDroppedCompressionError.Add(float64(len(messages)), s.pipelineName)
+			s.forwardMessages(messages, outputChan)
+			return
+		}
+		if s.maxCompressedSize > 0 && len(compressedPayload) > s.maxCompressedSize && len(messages) > 1 {
+			// each half is compressed and split again until it fits, every message is sent in a single payload
+			half := len(messages) / 2
+			s.sendMessages(messages[:half], outputChan, send)
+			s.sendMessages(messages[half:], outputChan, send)
+			return
+		}
+		recordBatchStats(BatchStats{Entries: len(messages), ContentSize: len(payload), CompressedSize: len(compressedPayload)})
+		payload = compressedPayload
+	}
+
+	err := send(payload)
 	if err != nil {
 		if shouldStopSending(err) {
 			return
@@ -159,6 +196,11 @@ func (s *batchStrategy) sendMessages(messages []*message.Message, outputChan cha
 	metrics.LogsSent.Add(int64(len(messages)))
 	metrics.TlmLogsSent.Add(float64(len(messages)))
 
+	s.forwardMessages(messages, outputChan)
+}
+
+// forwardMessages forwards the messages handled to the next stage of the pipeline
+func (s *batchStrategy) forwardMessages(messages []*message.Message, outputChan chan *message.Message) {
 	for _, message := range messages {
 		outputChan <- message
 	}
@@ -57,6 +57,11 @@ func (s *Sender) Flush(ctx context.Context) {
 	s.strategy.Flush(ctx)
 }
 
+// UpdateAPIKey replaces the API key of the destinations of this sender using oldKey.
+func (s *Sender) UpdateAPIKey(oldKey, newKey string) {
+	s.destinations.UpdateAPIKey(oldKey, newKey)
+}
+
 func (s *Sender) run() {
 	defer func() {
 		s.done <- struct{}{}
@@ -197,6 +197,19 @@ func Decrypt(data []byte, origin string) ([]byte, error) {
 	return finalConfig, nil
 }
 
+// Refresh fetches the given secret handles from "secret_backend_command" again, bypassing the
+// cache, so that the secrets rotated since they were decrypted are picked up. The cache is
+// updated with the new values.
+func Refresh(handles []string, origin string) (map[string]string, error) {
+	if secretBackendCommand == "" {
+		return nil, fmt.Errorf("No secret_backend_command set: secrets feature is not enabled")
+	}
+	if len(handles) == 0 {
+		return map[string]string{}, nil
+	}
+	return secretFetcher(handles, origin)
+}
+
 // GetDebugInfo exposes debug informations about secrets to be included in a flare
 func GetDebugInfo() (*SecretInfo, error) {
 	if secretBackendCommand == "" {
@@ -340,3 +340,28 @@ func TestDebugInfo(t *testing.T) {
 		"pass3": {"test2"},
 	}, handles)
 }
+
+func TestRefreshBypassesCache(t *testing.T) {
+	secretBackendCommand = "some_command"
+	secretCache["pass1"] = "password1"
+	defer func() {
+		secretBackendCommand = ""
+		secretCache = map[string]string{}
+		secretOrigin = map[string]common.StringSet{}
+		secretFetcher = fetchSecret
+	}()
+
+	secretFetcher = func(secrets []string, origin string) (map[string]string, error) {
+		assert.Equal(t, []string{"pass1"}, secrets)
+		return map[string]string{"pass1": "rotated"}, nil
+	}
+
+	secrets, err := Refresh([]string{"pass1"}, "test")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"pass1": "rotated"}, secrets)
+}
+
+func TestRefreshNoCommand(t *testing.T) {
+	_, err := Refresh([]string{"pass1"}, "test")
+	require.NotNil(t, err)
+}
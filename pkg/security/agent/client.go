@@ -54,6 +54,17 @@ func (c *RuntimeSecurityClient) RunSelfTest() (*api.SecuritySelfTestResultMessag
 	return response, nil
 }
 
+// SetKernelStats instructs the system probe to enable or disable the collection of the kernel stats of a perf map
+func (c *RuntimeSecurityClient) SetKernelStats(perfMap string, enabled bool) (*api.SecuritySetKernelStatsMessage, error) {
+	apiClient := api.NewSecurityModuleClient(c.conn)
+
+	response, err := apiClient.SetKernelStats(context.Background(), &api.SetKernelStatsParams{Map: perfMap, Enabled: enabled})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
 // Close closes the connection
 func (c *RuntimeSecurityClient) Close() {
 	c.conn.Close()
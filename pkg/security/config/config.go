@@ -7,12 +7,15 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/DataDog/datadog-agent/cmd/system-probe/config"
 	aconfig "github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/ebpf"
 	"github.com/DataDog/datadog-agent/pkg/security/utils"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
 // Policy represents a policy file in the configuration file
@@ -60,10 +63,37 @@ type Config struct {
 	// LoadControllerControlPeriod defines the period at which the load controller will empty the user space counter used
 	// to evaluate the amount of events brought back to user space
 	LoadControllerControlPeriod time.Duration
+	// LoadControllerDiscardedEventTypes is the number of event types the noisiest process is discarded for, the ones
+	// with the highest throughput read from the perf buffers. 0 discards every event type.
+	LoadControllerDiscardedEventTypes int
 	// StatsPollingInterval determines how often metrics should be polled
 	StatsPollingInterval time.Duration
 	// StatsTagsCardinality determines the cardinality level of the tags added to the exported metrics
 	StatsTagsCardinality string
+	// StatsPerfBufferDistributions determines if the per CPU perf buffer throughput is also submitted as distributions
+	StatsPerfBufferDistributions bool
+	// StatsPerfBufferTagsCardinality overrides the tags of the perf buffer metrics: off, low (event type) or high (event type and cpu)
+	StatsPerfBufferTagsCardinality string
+	// StatsPerfBufferDiagnosticsLossRate is the loss rate over a stats interval past which a perf buffer diagnostics
+	// dump is written, 0 disables the dumps
+	StatsPerfBufferDiagnosticsLossRate float64
+	// StatsPerfBufferDiagnosticsCooldown is the minimum period between two perf buffer diagnostics dumps
+	StatsPerfBufferDiagnosticsCooldown time.Duration
+	// StatsPerfBufferDiagnosticsFile is the file the perf buffer diagnostics dump is written to, in the run directory
+	StatsPerfBufferDiagnosticsFile string
+	// StatsPerfBufferSLOTargets is the target loss ratio of the event types whose loss SLO is tracked, by event type
+	StatsPerfBufferSLOTargets map[string]float64
+	// StatsPerfBufferSLOShortWindow and StatsPerfBufferSLOLongWindow are the windows the loss ratio of the SLOs is
+	// computed on, the SLO is breached when the loss ratio of the long window exceeds its target
+	StatsPerfBufferSLOShortWindow time.Duration
+	StatsPerfBufferSLOLongWindow  time.Duration
+	// StatsPerfBufferKernelStatsMaps lists the perf maps whose kernel stats are collected, all of them when empty
+	StatsPerfBufferKernelStatsMaps []string
+	// StatsPerfBufferLossCooldown is the minimum period between two notifications of a perf buffer loss listener
+	StatsPerfBufferLossCooldown time.Duration
+	// StatsPerfBufferThroughputHalfLife is the half-life of the moving average of the throughput of each event type
+	// read from the perf buffers, the average isn't computed when it is zero
+	StatsPerfBufferThroughputHalfLife time.Duration
 	// StatsdAddr defines the statsd address
 	StatsdAddr string
 	// AgentMonitoringEvents determines if the monitoring events of the agent should be sent to Datadog
@@ -86,6 +116,9 @@ type Config struct {
 	LogPatterns []string
 	// SelfTestEnabled defines if the self tester should be enabled (useful for tests for example)
 	SelfTestEnabled bool
+	// SelfTestStrict defines if the self test fails when the event types of the eBPF programs don't match the ones
+	// of the agent
+	SelfTestStrict bool
 }
 
 // IsEnabled returns true if any feature is enabled. Has to be applied in config package too
@@ -114,8 +147,20 @@ func NewConfig(cfg *config.Config) (*Config, error) {
 		LoadControllerEventsCountThreshold: int64(aconfig.Datadog.GetInt("runtime_security_config.load_controller.events_count_threshold")),
 		LoadControllerDiscarderTimeout:     time.Duration(aconfig.Datadog.GetInt("runtime_security_config.load_controller.discarder_timeout")) * time.Second,
 		LoadControllerControlPeriod:        time.Duration(aconfig.Datadog.GetInt("runtime_security_config.load_controller.control_period")) * time.Second,
+		LoadControllerDiscardedEventTypes:  aconfig.Datadog.GetInt("runtime_security_config.load_controller.discarded_event_types"),
 		StatsPollingInterval:               time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.polling_interval")) * time.Second,
 		StatsTagsCardinality:               aconfig.Datadog.GetString("runtime_security_config.events_stats.tags_cardinality"),
+		StatsPerfBufferDistributions:       aconfig.Datadog.GetBool("runtime_security_config.events_stats.perf_buffer_distributions"),
+		StatsPerfBufferTagsCardinality:     aconfig.Datadog.GetString("runtime_security_config.events_stats.perf_buffer_tags_cardinality"),
+		StatsPerfBufferDiagnosticsLossRate: aconfig.Datadog.GetFloat64("runtime_security_config.events_stats.perf_buffer_diagnostics.loss_rate"),
+		StatsPerfBufferDiagnosticsCooldown: time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.perf_buffer_diagnostics.cooldown")) * time.Second,
+		StatsPerfBufferDiagnosticsFile:     filepath.Join(aconfig.Datadog.GetString("runtime_security_config.run_path"), "runtime-security-perf-buffer-diagnostics.json"),
+		StatsPerfBufferSLOTargets:          getPerfBufferSLOTargets(),
+		StatsPerfBufferSLOShortWindow:      time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.perf_buffer_slo.short_window")) * time.Second,
+		StatsPerfBufferSLOLongWindow:       time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.perf_buffer_slo.long_window")) * time.Second,
+		StatsPerfBufferKernelStatsMaps:     aconfig.Datadog.GetStringSlice("runtime_security_config.events_stats.perf_buffer_kernel_stats_maps"),
+		StatsPerfBufferLossCooldown:        time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.perf_buffer_loss_listeners.cooldown")) * time.Second,
+		StatsPerfBufferThroughputHalfLife:  time.Duration(aconfig.Datadog.GetInt("runtime_security_config.events_stats.perf_buffer_throughput.half_life")) * time.Second,
 		StatsdAddr:                         fmt.Sprintf("%s:%d", cfg.StatsdHost, cfg.StatsdPort),
 		AgentMonitoringEvents:              aconfig.Datadog.GetBool("runtime_security_config.agent_monitoring_events"),
 		CustomSensitiveWords:               aconfig.Datadog.GetStringSlice("runtime_security_config.custom_sensitive_words"),
@@ -125,6 +170,7 @@ func NewConfig(cfg *config.Config) (*Config, error) {
 		RemoteTaggerEnabled:                aconfig.Datadog.GetBool("runtime_security_config.remote_tagger"),
 		LogPatterns:                        aconfig.Datadog.GetStringSlice("runtime_security_config.log_patterns"),
 		SelfTestEnabled:                    aconfig.Datadog.GetBool("runtime_security_config.self_test.enabled"),
+		SelfTestStrict:                     aconfig.Datadog.GetBool("runtime_security_config.self_test.strict"),
 	}
 
 	// if runtime is enabled then we force fim
@@ -159,3 +205,26 @@ func NewConfig(cfg *config.Config) (*Config, error) {
 
 	return c, nil
 }
+
+// getPerfBufferSLOTargets returns the target loss ratio of the perf buffer SLOs by event type, the invalid targets
+// are ignored
+func getPerfBufferSLOTargets() map[string]float64 {
+	targets := make(map[string]float64)
+	for eventType, value := range aconfig.Datadog.GetStringMap("runtime_security_config.events_stats.perf_buffer_slo.targets") {
+		var target float64
+		switch value := value.(type) {
+		case float64:
+			target = value
+		case int:
+			target = float64(value)
+		case string:
+			target, _ = strconv.ParseFloat(value, 64)
+		}
+		if target <= 0 || target >= 1 {
+			log.Errorf("ignoring the perf buffer SLO target of %s: expected a loss ratio between 0 and 1, got %v", eventType, value)
+			continue
+		}
+		targets[eventType] = target
+	}
+	return targets
+}
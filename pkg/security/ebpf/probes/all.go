@@ -152,9 +152,8 @@ func AllBPFProbeWriteUserSections() []string {
 	}
 }
 
-// GetPerfBufferStatisticsMaps returns the list of maps used to monitor the performances of each perf buffers
+// GetPerfBufferStatisticsMaps returns the maps used to monitor the performances of the perf buffers whose statistics
+// map doesn't follow the <perf map>_stats naming convention, the other ones are discovered by the perf buffer monitor
 func GetPerfBufferStatisticsMaps() map[string]string {
-	return map[string]string{
-		"events": "events_stats",
-	}
+	return map[string]string{}
 }
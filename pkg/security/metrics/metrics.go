@@ -75,6 +75,11 @@ var (
 	// Tags: map
 	MetricPerfBufferLostRead = newRuntimeMetric(".perf_buffer.lost_events.read")
 
+	// MetricPerfBufferDroppedUserspace is the name of the metric used to count the number of events read from a
+	// perf buffer but dropped in user space by the event handler, before being dispatched
+	// Tags: event_type
+	MetricPerfBufferDroppedUserspace = newRuntimeMetric(".events.dropped_userspace")
+
 	// MetricPerfBufferEventsWrite is the name of the metric used to count the number of events written to a perf buffer
 	// Tags: map, event_type
 	MetricPerfBufferEventsWrite = newRuntimeMetric(".perf_buffer.events.write")
@@ -88,9 +93,54 @@ var (
 	// MetricPerfBufferBytesRead is the name of the metric used to count the number of bytes read from a perf buffer
 	// Tags: map
 	MetricPerfBufferBytesRead = newRuntimeMetric(".perf_buffer.bytes.read")
+	// MetricPerfBufferEventsReadPerCPU is the name of the distribution metric used to report the number of events read
+	// from a perf buffer by each CPU during a flush interval
+	// Tags: map, event_type (dropped when the tags cardinality is not high)
+	MetricPerfBufferEventsReadPerCPU = newRuntimeMetric(".perf_buffer.events.read_per_cpu")
+	// MetricPerfBufferBytesReadPerCPU is the name of the distribution metric used to report the number of bytes read
+	// from a perf buffer by each CPU during a flush interval
+	// Tags: map, event_type (dropped when the tags cardinality is not high)
+	MetricPerfBufferBytesReadPerCPU = newRuntimeMetric(".perf_buffer.bytes.read_per_cpu")
+	// MetricPerfBufferStatsDropped is the name of the metric used to report the number of perf buffer counts dropped
+	// because the statsd client was unavailable for too long
+	// Tags: -
+	MetricPerfBufferStatsDropped = newRuntimeMetric(".perf_buffer.stats_dropped")
+	// MetricPerfBufferDiagnosticsDump is the name of the metric used to count the diagnostics dumps written when
+	// the loss rate of the perf buffers crosses the severe threshold
+	// Tags: -
+	MetricPerfBufferDiagnosticsDump = newRuntimeMetric(".perf_buffer.diagnostics_dump")
+	// MetricPerfBufferSLOBurnRate is the name of the metric used to report the loss ratio of an event type over a
+	// window divided by its loss target, the SLO is consumed faster than allowed above 1
+	// Tags: event_type, window (short, long)
+	MetricPerfBufferSLOBurnRate = newRuntimeMetric(".perf_buffer.slo.burn_rate")
+	// MetricPerfBufferSLOBreached is the name of the metric used to report whether the loss ratio of an event type
+	// over the long window exceeds its loss target (1) or not (0)
+	// Tags: event_type
+	MetricPerfBufferSLOBreached = newRuntimeMetric(".perf_buffer.slo.breached")
+	// MetricPerfBufferKernelStatsEnabled is the name of the metric used to report whether the kernel stats of a perf
+	// map are collected (1) or not (0), in which case its write metrics aren't reported
+	// Tags: map
+	MetricPerfBufferKernelStatsEnabled = newRuntimeMetric(".perf_buffer.kernel_stats.enabled")
+	// MetricPerfBufferKernelStatsUnderflows is the name of the metric used to count the kernel counters found lower
+	// than on the previous collection, their statistics map having been cleared, in which case their value is
+	// reported as the count since the map was cleared
+	// Tags: map, event_type, cpu
+	MetricPerfBufferKernelStatsUnderflows = newRuntimeMetric(".perf_buffer.kernel_stats.underflows")
+	// MetricPerfBufferEventTypesMismatch is the name of the metric used to report whether the number of event types
+	// of the eBPF programs differs from the one of the agent (1) or not (0), in which case the kernel stats of the
+	// event types beyond the ones known by both are reported with the unknown event type
+	MetricPerfBufferEventTypesMismatch = newRuntimeMetric(".perf_buffer.event_types_mismatch")
+	// MetricPerfBufferSizeBytes is the name of the metric used to report the size of the ring buffer of a perf map
+	// on each CPU, in bytes
+	// Tags: map
+	MetricPerfBufferSizeBytes = newRuntimeMetric(".perf_buffer.size_bytes")
 	// MetricPerfBufferSortingError is the name of the metric used to report events reordering issues.
 	// Tags: map, event_type
 	MetricPerfBufferSortingError = newRuntimeMetric(".perf_buffer.sorting_error")
+	// MetricPerfBufferSortingMaxJump is the name of the metric used to report the maximum backwards jump (in ns)
+	// observed between two consecutive events of a perf buffer.
+	// Tags: map
+	MetricPerfBufferSortingMaxJump = newRuntimeMetric(".perf_buffer.sorting_max_jump")
 	// MetricPerfBufferSortingQueueSize is the name of the metric used to report reordering queue size.
 	// Tags: -
 	MetricPerfBufferSortingQueueSize = newRuntimeMetric(".perf_buffer.sorting_queue_size")
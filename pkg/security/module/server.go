@@ -220,6 +220,17 @@ func (a *APIServer) RunSelfTest(ctx context.Context, params *api.RunSelfTestPara
 		}, nil
 	}
 
+	// in strict mode, the eBPF programs must have the event types of the agent for the self test to pass
+	if a.cfg != nil && a.cfg.SelfTestStrict && a.probe != nil {
+		if err := a.probe.GetMonitor().GetPerfBufferMonitor().CheckEventTypes(); err != nil {
+			log.Errorf("self test failed: %v", err)
+			return &api.SecuritySelfTestResultMessage{
+				Ok:    false,
+				Error: err.Error(),
+			}, nil
+		}
+	}
+
 	if err := a.module.selfTester.RunSelfTest(); err != nil {
 		return &api.SecuritySelfTestResultMessage{
 			Ok:    false,
@@ -233,6 +244,25 @@ func (a *APIServer) RunSelfTest(ctx context.Context, params *api.RunSelfTestPara
 	}, nil
 }
 
+// SetKernelStats enables or disables the collection of the kernel stats of a perf map
+func (a *APIServer) SetKernelStats(ctx context.Context, params *api.SetKernelStatsParams) (*api.SecuritySetKernelStatsMessage, error) {
+	if a.probe == nil {
+		return nil, errors.New("failed to found probe in APIServer")
+	}
+
+	if err := a.probe.GetMonitor().GetPerfBufferMonitor().SetKernelStatsEnabled(params.GetMap(), params.GetEnabled()); err != nil {
+		return &api.SecuritySetKernelStatsMessage{
+			Ok:    false,
+			Error: err.Error(),
+		}, nil
+	}
+
+	return &api.SecuritySetKernelStatsMessage{
+		Ok:    true,
+		Error: "",
+	}, nil
+}
+
 // SendEvent forwards events sent by the runtime security module to Datadog
 func (a *APIServer) SendEvent(rule *rules.Rule, event Event, extTagsCb func() []string, service string) {
 	agentContext := &AgentContext{
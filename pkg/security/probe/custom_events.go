@@ -105,16 +105,19 @@ type EventLostRead struct {
 	Timestamp time.Time `json:"date"`
 	Name      string    `json:"map"`
 	Lost      float64   `json:"lost"`
+	// DroppedByHandler is the count of events read from the perf map but dropped by the event handler, per event type
+	DroppedByHandler map[string]uint64 `json:"dropped_by_handler,omitempty"`
 }
 
 // NewEventLostReadEvent returns the rule and a populated custom event for a lost_events_read event
-func NewEventLostReadEvent(mapName string, lost float64) (*rules.Rule, *CustomEvent) {
+func NewEventLostReadEvent(mapName string, lost float64, droppedByHandler map[string]uint64) (*rules.Rule, *CustomEvent) {
 	return newRule(&rules.RuleDefinition{
 			ID: LostEventsRuleID,
 		}), newCustomEvent(model.CustomLostReadEventType, EventLostRead{
-			Name:      mapName,
-			Lost:      lost,
-			Timestamp: time.Now(),
+			Name:             mapName,
+			Lost:             lost,
+			DroppedByHandler: droppedByHandler,
+			Timestamp:        time.Now(),
 		}.MarshalJSON)
 }
 
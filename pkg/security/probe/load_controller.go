@@ -41,8 +41,13 @@ type LoadController struct {
 	EventsCountThreshold int64
 	DiscarderTimeout     time.Duration
 	ControllerPeriod     time.Duration
+	// DiscardedEventTypes is the number of busiest event types the noisiest process is discarded for, 0 for all
+	DiscardedEventTypes int
 }
 
+// allEventTypes discards every event type of a process
+const allEventTypes = model.EventType(0xffffffffffffffff)
+
 // NewLoadController instantiates a new load controller
 func NewLoadController(probe *Probe, statsdClient *statsd.Client) (*LoadController, error) {
 	lru, err := simplelru.NewLRU(probe.config.PIDCacheSize, nil)
@@ -59,6 +64,7 @@ func NewLoadController(probe *Probe, statsdClient *statsd.Client) (*LoadControll
 		EventsCountThreshold: probe.config.LoadControllerEventsCountThreshold,
 		DiscarderTimeout:     probe.config.LoadControllerDiscarderTimeout,
 		ControllerPeriod:     probe.config.LoadControllerControlPeriod,
+		DiscardedEventTypes:  probe.config.LoadControllerDiscardedEventTypes,
 	}
 	return lc, nil
 }
@@ -130,10 +136,12 @@ func (lc *LoadController) discardNoisiestProcess() {
 	}
 
 	// push a temporary discarder on the noisiest process & event type tuple
-	seclog.Tracef("discarding events from pid %d for %s seconds", maxKey.Pid, lc.DiscarderTimeout)
-	if err := lc.probe.pidDiscarders.discardWithTimeout(0xffffffffffffffff, maxKey.Pid, lc.DiscarderTimeout.Nanoseconds()); err != nil {
-		log.Warnf("couldn't insert temporary discarder: %v", err)
-		return
+	for _, eventType := range lc.discardedEventTypes() {
+		seclog.Tracef("discarding %s events from pid %d for %s seconds", eventType, maxKey.Pid, lc.DiscarderTimeout)
+		if err := lc.probe.pidDiscarders.discardWithTimeout(eventType, maxKey.Pid, lc.DiscarderTimeout.Nanoseconds()); err != nil {
+			log.Warnf("couldn't insert temporary discarder: %v", err)
+			return
+		}
 	}
 
 	// update current total and remove biggest entry from cache
@@ -165,6 +173,29 @@ func (lc *LoadController) discardNoisiestProcess() {
 	}
 }
 
+// discardedEventTypes returns the event types the noisiest process is discarded for: the busiest event types which
+// accept discarders, from the throughput of the perf buffers, or all of them when the throughput isn't tracked
+func (lc *LoadController) discardedEventTypes() []model.EventType {
+	if lc.DiscardedEventTypes <= 0 || lc.probe.monitor == nil || lc.probe.monitor.perfBufferMonitor == nil {
+		return []model.EventType{allEventTypes}
+	}
+
+	eventTypes := make([]model.EventType, 0, lc.DiscardedEventTypes)
+	for _, eventType := range lc.probe.monitor.perfBufferMonitor.GetTopThroughputEventTypes(-1) {
+		if eventType < model.FirstDiscarderEventType || eventType > model.LastDiscarderEventType {
+			continue
+		}
+		eventTypes = append(eventTypes, eventType)
+		if len(eventTypes) == lc.DiscardedEventTypes {
+			break
+		}
+	}
+	if len(eventTypes) == 0 {
+		return []model.EventType{allEventTypes}
+	}
+	return eventTypes
+}
+
 // cleanupCounter resets the internal counter of the provided pid
 func (lc *LoadController) cleanupCounter(pid uint32, cookie uint32) {
 	lc.Lock()
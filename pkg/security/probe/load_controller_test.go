@@ -0,0 +1,51 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"testing"
+	"time"
+
+	manager "github.com/DataDog/ebpf-manager"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+func TestLoadControllerDiscardedEventTypes(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	start := time.Now()
+	pbm.throughput = newPerfBufferThroughputTracker(time.Minute, start)
+
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+	for eventType, count := range map[model.EventType]int{
+		model.FileOpenEventType:  30,
+		model.ExecEventType:      20,
+		model.FileChmodEventType: 10,
+		model.FileMkdirEventType: 5,
+	} {
+		for i := 0; i < count; i++ {
+			pbm.CountEvent(eventType, uint64(1000+i), 1, 100, perfMap, 0)
+		}
+	}
+	assert.NoError(t, pbm.sendEventsAndBytesReadStats(nil))
+	pbm.throughput.endInterval(start.Add(10 * time.Second))
+
+	lc := &LoadController{probe: &Probe{monitor: &Monitor{perfBufferMonitor: pbm}}}
+	assert.Equal(t, []model.EventType{allEventTypes}, lc.discardedEventTypes())
+
+	// the busiest event types which accept discarders
+	lc.DiscardedEventTypes = 2
+	assert.Equal(t, []model.EventType{model.FileOpenEventType, model.FileChmodEventType}, lc.discardedEventTypes())
+	lc.DiscardedEventTypes = 10
+	assert.Equal(t, []model.EventType{model.FileOpenEventType, model.FileChmodEventType, model.FileMkdirEventType}, lc.discardedEventTypes())
+
+	// every event type is discarded when the throughput isn't tracked
+	pbm.throughput = nil
+	assert.Equal(t, []model.EventType{allEventTypes}, lc.discardedEventTypes())
+}
@@ -0,0 +1,323 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/process/util"
+	"github.com/DataDog/datadog-agent/pkg/security/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// maxPerfBufferDiagnosticsSize is the maximum size of a diagnostics dump, the per CPU snapshot is left out of
+// the dumps which would be larger
+const maxPerfBufferDiagnosticsSize = 512 * 1024
+
+// eventTypeMix is the number of events of a type written to the perf buffers, and lost, during a stats interval
+type eventTypeMix struct {
+	Written uint64 `json:"written"`
+	Lost    uint64 `json:"lost"`
+}
+
+// cpuSoftirqStats is a snapshot of the softirq activity of a CPU, the times are in clock ticks since boot
+type cpuSoftirqStats struct {
+	CPU int `json:"cpu"`
+	// TotalTime is the time spent by the CPU in any state
+	TotalTime uint64 `json:"total_time"`
+	// SoftirqTime is the time spent by the CPU servicing softirqs
+	SoftirqTime uint64 `json:"softirq_time"`
+	// KSoftirqdTime is the CPU time of the ksoftirqd thread of the CPU, servicing the softirqs deferred to it
+	KSoftirqdTime uint64 `json:"ksoftirqd_time"`
+	// Softirqs is the number of softirqs serviced by the CPU since boot, per softirq type
+	Softirqs map[string]uint64 `json:"softirqs,omitempty"`
+}
+
+// perfBufferDiagnostics is the diagnostics dump written when the loss rate of the perf buffers is severe
+type perfBufferDiagnostics struct {
+	Timestamp time.Time `json:"timestamp"`
+	// LossRate is the ratio of events lost over the events written and lost during the last stats interval
+	LossRate  float64 `json:"loss_rate"`
+	Threshold float64 `json:"threshold"`
+	// PerfBufferSizes is the size of each perf buffer, per perf map
+	PerfBufferSizes map[string]float64 `json:"perf_buffer_sizes"`
+	// EventTypes is the event type mix of the last stats interval
+	EventTypes map[string]eventTypeMix `json:"event_types"`
+	CPUs       []cpuSoftirqStats       `json:"cpus,omitempty"`
+	// CPUsError is set when the softirq snapshot couldn't be collected
+	CPUsError string `json:"cpus_error,omitempty"`
+	// Truncated is true when the per CPU snapshot was left out to keep the dump within its maximum size
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// perfBufferDiagnosticsDumper writes a diagnostics dump when the loss rate over a stats interval crosses the
+// severe threshold, at most once per cooldown period
+type perfBufferDiagnosticsDumper struct {
+	sync.Mutex
+	threshold float64
+	cooldown  time.Duration
+	path      string
+	// procRoot is the procfs the softirq snapshot is read from
+	procRoot string
+	// eventTypes accumulates the event type mix of the current stats interval
+	eventTypes map[string]eventTypeMix
+	lastDump   time.Time
+	now        func() time.Time
+}
+
+func newPerfBufferDiagnosticsDumper(threshold float64, cooldown time.Duration, path string) *perfBufferDiagnosticsDumper {
+	return &perfBufferDiagnosticsDumper{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		path:       path,
+		procRoot:   util.HostProc(),
+		eventTypes: make(map[string]eventTypeMix),
+		now:        time.Now,
+	}
+}
+
+// countKernelStats adds the events written and lost by the kernel for an event type to the current interval
+func (d *perfBufferDiagnosticsDumper) countKernelStats(eventType string, written uint64, lost uint64) {
+	if written == 0 && lost == 0 {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	mix := d.eventTypes[eventType]
+	mix.Written += written
+	mix.Lost += lost
+	d.eventTypes[eventType] = mix
+}
+
+// endInterval resets the event type mix of the interval, and returns it with its loss rate
+func (d *perfBufferDiagnosticsDumper) endInterval() (map[string]eventTypeMix, float64) {
+	d.Lock()
+	defer d.Unlock()
+	eventTypes := d.eventTypes
+	d.eventTypes = make(map[string]eventTypeMix)
+
+	var written, lost uint64
+	for _, mix := range eventTypes {
+		written += mix.Written
+		lost += mix.Lost
+	}
+	if lost == 0 {
+		return eventTypes, 0
+	}
+	return eventTypes, float64(lost) / float64(written+lost)
+}
+
+// checkLossRate ends the stats interval, and writes a diagnostics dump if its loss rate is severe and the cooldown
+// period has elapsed since the previous dump. It returns true if a dump was written.
+func (d *perfBufferDiagnosticsDumper) checkLossRate(perfBufferSizes map[string]float64) (bool, error) {
+	eventTypes, lossRate := d.endInterval()
+	if lossRate == 0 || lossRate < d.threshold {
+		return false, nil
+	}
+	now := d.now()
+	if !d.lastDump.IsZero() && now.Sub(d.lastDump) < d.cooldown {
+		return false, nil
+	}
+	d.lastDump = now
+
+	diagnostics := perfBufferDiagnostics{
+		Timestamp:       now.UTC(),
+		LossRate:        lossRate,
+		Threshold:       d.threshold,
+		PerfBufferSizes: perfBufferSizes,
+		EventTypes:      eventTypes,
+	}
+	cpus, err := readCPUSoftirqStats(d.procRoot)
+	if err != nil {
+		diagnostics.CPUsError = err.Error()
+	}
+	diagnostics.CPUs = cpus
+
+	return true, d.write(diagnostics)
+}
+
+// write replaces the previous dump, so that the run directory holds a single bounded file
+func (d *perfBufferDiagnosticsDumper) write(diagnostics perfBufferDiagnostics) error {
+	data, err := json.MarshalIndent(diagnostics, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(data) > maxPerfBufferDiagnosticsSize {
+		diagnostics.CPUs = nil
+		diagnostics.Truncated = true
+		if data, err = json.MarshalIndent(diagnostics, "", "  "); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "couldn't write the perf buffer diagnostics")
+	}
+	return os.Rename(tmpPath, d.path)
+}
+
+// readCPUSoftirqStats reads the softirq time of each CPU, the CPU time of their ksoftirqd thread and their softirqs
+// from procfs
+func readCPUSoftirqStats(procRoot string) ([]cpuSoftirqStats, error) {
+	cpus, err := readCPUTimes(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	softirqs, err := readSoftirqs(procRoot)
+	if err != nil {
+		log.Debugf("couldn't read the softirqs: %v", err)
+	}
+	ksoftirqd := readKSoftirqdTimes(procRoot)
+	for i := range cpus {
+		cpus[i].Softirqs = softirqs[cpus[i].CPU]
+		cpus[i].KSoftirqdTime = ksoftirqd[cpus[i].CPU]
+	}
+	return cpus, nil
+}
+
+// readCPUTimes reads the total and softirq times of each CPU from /proc/stat
+func readCPUTimes(procRoot string) ([]cpuSoftirqStats, error) {
+	file, err := os.Open(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cpus []cpuSoftirqStats
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// cpuN user nice system idle iowait irq softirq steal guest guest_nice
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		cpu, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			continue
+		}
+		stats := cpuSoftirqStats{CPU: cpu}
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				// the guest times are already accounted in the user times
+				break
+			}
+			value, _ := strconv.ParseUint(field, 10, 64)
+			stats.TotalTime += value
+			if i == 6 {
+				stats.SoftirqTime = value
+			}
+		}
+		cpus = append(cpus, stats)
+	}
+	return cpus, scanner.Err()
+}
+
+// readSoftirqs reads the number of softirqs serviced by each CPU, per softirq type, from /proc/softirqs
+func readSoftirqs(procRoot string) (map[int]map[string]uint64, error) {
+	file, err := os.Open(filepath.Join(procRoot, "softirqs"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	softirqs := make(map[int]map[string]uint64)
+	var cpus []int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if cpus == nil {
+			// the header lists the CPUs, such as CPU0 CPU1
+			for _, field := range fields {
+				cpu, err := strconv.Atoi(strings.TrimPrefix(field, "CPU"))
+				if err != nil {
+					return nil, errors.Errorf("unexpected softirqs header: %s", scanner.Text())
+				}
+				cpus = append(cpus, cpu)
+			}
+			continue
+		}
+		softirq := strings.TrimSuffix(fields[0], ":")
+		for i, field := range fields[1:] {
+			if i >= len(cpus) {
+				break
+			}
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				continue
+			}
+			if softirqs[cpus[i]] == nil {
+				softirqs[cpus[i]] = make(map[string]uint64)
+			}
+			softirqs[cpus[i]][softirq] = value
+		}
+	}
+	return softirqs, scanner.Err()
+}
+
+// readKSoftirqdTimes reads the CPU time, user and system, of the ksoftirqd thread of each CPU
+func readKSoftirqdTimes(procRoot string) map[int]uint64 {
+	times := make(map[int]uint64)
+	statPaths, _ := filepath.Glob(filepath.Join(procRoot, "[0-9]*", "stat"))
+	for _, statPath := range statPaths {
+		data, err := ioutil.ReadFile(statPath)
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ... utime stime, the comm of the kernel threads can't hold parentheses
+		stat := string(data)
+		start, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if start < 0 || end < start || !strings.HasPrefix(stat[start+1:end], "ksoftirqd/") {
+			continue
+		}
+		cpu, err := strconv.Atoi(strings.TrimPrefix(stat[start+1:end], "ksoftirqd/"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 13 {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		times[cpu] = utime + stime
+	}
+	return times
+}
+
+// checkLossDiagnostics ends the diagnostics interval and counts the dumps written
+func (pbm *PerfBufferMonitor) checkLossDiagnostics(client statsd.ClientInterface) {
+	if pbm.diagnostics == nil {
+		return
+	}
+	dumped, err := pbm.diagnostics.checkLossRate(pbm.perfBufferSize)
+	if !dumped {
+		return
+	}
+	if err != nil {
+		log.Errorf("couldn't write the perf buffer diagnostics to %s: %v", pbm.diagnostics.path, err)
+		return
+	}
+	log.Warnf("severe perf buffer event loss, diagnostics written to %s", pbm.diagnostics.path)
+	pbm.sendCount(client, metrics.MetricPerfBufferDiagnosticsDump, 1, []string{})
+}
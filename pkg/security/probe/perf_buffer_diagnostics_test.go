@@ -0,0 +1,177 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/security/metrics"
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+// newFakeProcfs creates a procfs with two CPUs, their ksoftirqd threads and another process
+func newFakeProcfs(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"stat": `cpu  300 0 200 1000 10 0 60 0 0 0
+cpu0 100 0 100 500 5 0 50 0 7 0
+cpu1 200 0 100 500 5 0 10 0 0 0
+intr 12345
+ctxt 6789
+`,
+		"softirqs": `                    CPU0       CPU1
+          HI:          1          0
+      NET_RX:       4200        120
+      NET_TX:         30          2
+`,
+		"1/stat":  "1 (systemd) S 0 1 1 0 -1 4194560 1 2 3 4 500 600 0 0 20 0 1 0 10 1000 100\n",
+		"10/stat": "10 (ksoftirqd/0) S 2 0 0 0 -1 69238848 0 0 0 0 40 2 0 0 20 0 1 0 12 0 0\n",
+		"18/stat": "18 (ksoftirqd/1) S 2 0 0 0 -1 69238848 0 0 0 0 3 1 0 0 20 0 1 0 12 0 0\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+func TestReadCPUSoftirqStats(t *testing.T) {
+	cpus, err := readCPUSoftirqStats(newFakeProcfs(t))
+	require.NoError(t, err)
+	assert.Equal(t, []cpuSoftirqStats{
+		{
+			CPU:           0,
+			TotalTime:     755,
+			SoftirqTime:   50,
+			KSoftirqdTime: 42,
+			Softirqs:      map[string]uint64{"HI": 1, "NET_RX": 4200, "NET_TX": 30},
+		},
+		{
+			CPU:           1,
+			TotalTime:     815,
+			SoftirqTime:   10,
+			KSoftirqdTime: 4,
+			Softirqs:      map[string]uint64{"HI": 0, "NET_RX": 120, "NET_TX": 2},
+		},
+	}, cpus)
+
+	_, err = readCPUSoftirqStats(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestPerfBufferDiagnosticsDumper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diagnostics.json")
+	now := time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC)
+	d := newPerfBufferDiagnosticsDumper(0.2, time.Hour, path)
+	d.procRoot = newFakeProcfs(t)
+	d.now = func() time.Time { return now }
+	sizes := map[string]float64{"events": 262144}
+
+	// a loss rate below the threshold doesn't trigger a dump
+	d.countKernelStats("open", 900, 100)
+	dumped, err := d.checkLossRate(sizes)
+	assert.NoError(t, err)
+	assert.False(t, dumped)
+	assert.NoFileExists(t, path)
+
+	d.countKernelStats("open", 500, 300)
+	d.countKernelStats("exec", 100, 100)
+	dumped, err = d.checkLossRate(sizes)
+	assert.NoError(t, err)
+	assert.True(t, dumped)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var diagnostics perfBufferDiagnostics
+	require.NoError(t, json.Unmarshal(data, &diagnostics))
+	assert.Equal(t, now, diagnostics.Timestamp)
+	assert.InDelta(t, 0.4, diagnostics.LossRate, 1e-9)
+	assert.Equal(t, 0.2, diagnostics.Threshold)
+	assert.Equal(t, sizes, diagnostics.PerfBufferSizes)
+	assert.Equal(t, map[string]eventTypeMix{"open": {Written: 500, Lost: 300}, "exec": {Written: 100, Lost: 100}}, diagnostics.EventTypes)
+	assert.Len(t, diagnostics.CPUs, 2)
+	assert.False(t, diagnostics.Truncated)
+
+	// at most one dump per cooldown period
+	now = now.Add(30 * time.Minute)
+	d.countKernelStats("open", 0, 100)
+	dumped, err = d.checkLossRate(sizes)
+	assert.NoError(t, err)
+	assert.False(t, dumped)
+
+	// the next dump replaces the previous one
+	now = now.Add(time.Hour)
+	d.countKernelStats("open", 0, 100)
+	dumped, err = d.checkLossRate(sizes)
+	assert.NoError(t, err)
+	assert.True(t, dumped)
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &diagnostics))
+	assert.Equal(t, 1.0, diagnostics.LossRate)
+	assert.Equal(t, map[string]eventTypeMix{"open": {Lost: 100}}, diagnostics.EventTypes)
+}
+
+func TestPerfBufferDiagnosticsBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diagnostics.json")
+	d := newPerfBufferDiagnosticsDumper(0.2, time.Hour, path)
+
+	diagnostics := perfBufferDiagnostics{LossRate: 0.5, EventTypes: map[string]eventTypeMix{"open": {Lost: 1}}}
+	for cpu := 0; cpu < 4096; cpu++ {
+		diagnostics.CPUs = append(diagnostics.CPUs, cpuSoftirqStats{
+			CPU:      cpu,
+			Softirqs: map[string]uint64{"NET_RX": 1, "NET_TX": 1, "TIMER": 1, "SCHED": 1, "RCU": 1},
+		})
+	}
+	require.NoError(t, d.write(diagnostics))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(data), maxPerfBufferDiagnosticsSize)
+	var written perfBufferDiagnostics
+	require.NoError(t, json.Unmarshal(data, &written))
+	assert.True(t, written.Truncated)
+	assert.Empty(t, written.CPUs)
+	assert.Equal(t, diagnostics.EventTypes, written.EventTypes)
+}
+
+func TestPerfBufferMonitorLossDiagnostics(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	pbm.perfBufferSize = map[string]float64{"events": 262144}
+	pbm.diagnostics = newPerfBufferDiagnosticsDumper(0.2, time.Hour, filepath.Join(t.TempDir(), "diagnostics.json"))
+	pbm.diagnostics.procRoot = newFakeProcfs(t)
+	client := newFakeStatsdClient()
+
+	statsMap := fakeStatsMap{
+		0: {{}, {}},
+		1: {{Count: 60, Lost: 40}, {Count: 40}},
+	}
+	pbm.dumpStatsMap = statsMap.dump
+	_, err := pbm.collectKernelStats(client, "events", nil)
+	require.NoError(t, err)
+	pbm.checkLossDiagnostics(client)
+	assert.Equal(t, int64(1), client.counts[metrics.MetricPerfBufferDiagnosticsDump])
+	assert.FileExists(t, pbm.diagnostics.path)
+
+	// only the events of the new interval are accounted
+	statsMap[1][0].Count = 1060
+	_, err = pbm.collectKernelStats(client, "events", nil)
+	require.NoError(t, err)
+	eventTypes, lossRate := pbm.diagnostics.endInterval()
+	assert.Equal(t, map[string]eventTypeMix{model.EventType(1).String(): {Written: 1000}}, eventTypes)
+	assert.Equal(t, 0.0, lossRate)
+}
@@ -0,0 +1,271 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// maxPendingLossNotifications is the number of loss notifications queued for delivery, the next ones are dropped
+// until the listeners catch up
+const maxPendingLossNotifications = 64
+
+// LossListenerID identifies a loss listener, to deregister it
+type LossListenerID uint64
+
+// EventTypeLoss is the number of events of a type written to a perf buffer, and lost, during a stats interval
+type EventTypeLoss struct {
+	Written uint64
+	Lost    uint64
+}
+
+// LossNotification is delivered to a loss listener when the loss ratio of its perf map over a stats interval reaches
+// its threshold
+type LossNotification struct {
+	MapName string
+	// Window is the stats interval the loss ratio was computed on, ending at Timestamp
+	Window    time.Duration
+	Timestamp time.Time
+	// LossRatio is the ratio of events lost over the events written and lost during the window
+	LossRatio float64
+	// Threshold is the loss ratio the listener is notified from
+	Threshold float64
+	// EventTypes is the number of events written and lost during the window, per event type
+	EventTypes map[string]EventTypeLoss
+}
+
+// lossListener is a callback notified of the losses of a perf map
+type lossListener struct {
+	id           LossListenerID
+	mapName      string
+	threshold    float64
+	callback     func(LossNotification)
+	lastNotified time.Time
+}
+
+type lossDelivery struct {
+	listener     *lossListener
+	notification LossNotification
+}
+
+// perfBufferLossNotifier computes the loss ratio of the perf maps with listeners over each stats interval, and
+// delivers the notifications of the listeners whose threshold is reached from a dedicated goroutine, so that a slow
+// listener doesn't delay the flush of the metrics. A listener is notified at most once per cooldown period.
+type perfBufferLossNotifier struct {
+	sync.Mutex
+	cooldown  time.Duration
+	listeners map[LossListenerID]*lossListener
+	lastID    LossListenerID
+	// listenersCount is the number of listeners, read atomically so that the kernel stats aren't accumulated
+	// without listener
+	listenersCount int32
+	// current accumulates the event type mix of the current stats interval, per perf map
+	current       map[string]map[string]EventTypeLoss
+	intervalStart time.Time
+	deliveries    chan lossDelivery
+	// dropped is the number of notifications dropped because the delivery queue was full, accessed atomically
+	dropped uint64
+	now     func() time.Time
+}
+
+func newPerfBufferLossNotifier(cooldown time.Duration) *perfBufferLossNotifier {
+	n := &perfBufferLossNotifier{
+		cooldown:   cooldown,
+		listeners:  make(map[LossListenerID]*lossListener),
+		current:    make(map[string]map[string]EventTypeLoss),
+		deliveries: make(chan lossDelivery, maxPendingLossNotifications),
+		now:        time.Now,
+	}
+	n.intervalStart = n.now()
+	return n
+}
+
+// register adds a listener of the losses of a perf map
+func (n *perfBufferLossNotifier) register(mapName string, threshold float64, callback func(LossNotification)) LossListenerID {
+	n.Lock()
+	defer n.Unlock()
+	n.lastID++
+	n.listeners[n.lastID] = &lossListener{
+		id:        n.lastID,
+		mapName:   mapName,
+		threshold: threshold,
+		callback:  callback,
+	}
+	atomic.StoreInt32(&n.listenersCount, int32(len(n.listeners)))
+	return n.lastID
+}
+
+// deregister removes a listener, its pending notifications are dropped. It returns false if it isn't registered.
+func (n *perfBufferLossNotifier) deregister(id LossListenerID) bool {
+	n.Lock()
+	defer n.Unlock()
+	if _, found := n.listeners[id]; !found {
+		return false
+	}
+	delete(n.listeners, id)
+	atomic.StoreInt32(&n.listenersCount, int32(len(n.listeners)))
+	return true
+}
+
+// isRegistered returns whether a listener is still registered
+func (n *perfBufferLossNotifier) isRegistered(id LossListenerID) bool {
+	n.Lock()
+	defer n.Unlock()
+	_, found := n.listeners[id]
+	return found
+}
+
+// countKernelStats adds the events written and lost by the kernel for an event type of a perf map to the current
+// interval
+func (n *perfBufferLossNotifier) countKernelStats(mapName string, eventType string, written uint64, lost uint64) {
+	if (written == 0 && lost == 0) || atomic.LoadInt32(&n.listenersCount) == 0 {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	eventTypes := n.current[mapName]
+	if eventTypes == nil {
+		eventTypes = make(map[string]EventTypeLoss)
+		n.current[mapName] = eventTypes
+	}
+	loss := eventTypes[eventType]
+	loss.Written += written
+	loss.Lost += lost
+	eventTypes[eventType] = loss
+}
+
+// endInterval ends the stats interval, and queues the notifications of the listeners whose threshold is reached
+// and whose cooldown period has elapsed. It never blocks: the notifications are dropped when the queue is full.
+func (n *perfBufferLossNotifier) endInterval() {
+	now := n.now()
+	n.Lock()
+	defer n.Unlock()
+	intervals := n.current
+	n.current = make(map[string]map[string]EventTypeLoss)
+	window := now.Sub(n.intervalStart)
+	n.intervalStart = now
+
+	// the listeners are notified in the order they registered
+	listeners := make([]*lossListener, 0, len(n.listeners))
+	for _, listener := range n.listeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].id < listeners[j].id })
+
+	for _, listener := range listeners {
+		eventTypes := intervals[listener.mapName]
+		lossRatio := eventTypesLossRatio(eventTypes)
+		if lossRatio == 0 || lossRatio < listener.threshold {
+			continue
+		}
+		if !listener.lastNotified.IsZero() && now.Sub(listener.lastNotified) < n.cooldown {
+			continue
+		}
+
+		notification := LossNotification{
+			MapName:    listener.mapName,
+			Window:     window,
+			Timestamp:  now,
+			LossRatio:  lossRatio,
+			Threshold:  listener.threshold,
+			EventTypes: make(map[string]EventTypeLoss, len(eventTypes)),
+		}
+		for eventType, loss := range eventTypes {
+			notification.EventTypes[eventType] = loss
+		}
+
+		select {
+		case n.deliveries <- lossDelivery{listener: listener, notification: notification}:
+			listener.lastNotified = now
+		default:
+			if atomic.AddUint64(&n.dropped, 1) == 1 {
+				log.Warnf("the perf buffer loss listeners are too slow, their notifications are dropped")
+			}
+		}
+	}
+}
+
+// eventTypesLossRatio returns the ratio of events lost over the events written and lost
+func eventTypesLossRatio(eventTypes map[string]EventTypeLoss) float64 {
+	var written, lost uint64
+	for _, loss := range eventTypes {
+		written += loss.Written
+		lost += loss.Lost
+	}
+	if lost == 0 {
+		return 0
+	}
+	return float64(lost) / float64(written+lost)
+}
+
+// getStatus returns the number of listeners per perf map and of dropped notifications, as reported in the monitor
+// status
+func (n *perfBufferLossNotifier) getStatus() map[string]interface{} {
+	n.Lock()
+	defer n.Unlock()
+	perMap := make(map[string]int)
+	for _, listener := range n.listeners {
+		perMap[listener.mapName]++
+	}
+	return map[string]interface{}{
+		"listeners":             perMap,
+		"dropped_notifications": atomic.LoadUint64(&n.dropped),
+	}
+}
+
+// Start delivers the queued notifications to their listeners until the context is cancelled
+func (n *perfBufferLossNotifier) Start(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case delivery := <-n.deliveries:
+			if n.isRegistered(delivery.listener.id) {
+				delivery.listener.callback(delivery.notification)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RegisterLossListener registers a callback notified when the ratio of events lost by a perf map over a stats
+// interval reaches threshold, between 0 and 1. The notifications are delivered from a dedicated goroutine after
+// SendStats, at most once per cooldown period for each listener.
+func (pbm *PerfBufferMonitor) RegisterLossListener(mapName string, threshold float64, callback func(LossNotification)) (LossListenerID, error) {
+	if _, found := pbm.kernelStats[mapName]; !found {
+		return 0, errors.Errorf("unknown perf map %s", mapName)
+	}
+	if threshold < 0 || threshold > 1 {
+		return 0, errors.Errorf("invalid loss threshold %f, expected a ratio between 0 and 1", threshold)
+	}
+	if callback == nil {
+		return 0, errors.New("a loss listener needs a callback")
+	}
+	if !pbm.isKernelStatsEnabled(mapName) {
+		log.Warnf("the kernel stats of perf map %s aren't collected, its loss listeners won't be notified until they are", mapName)
+	}
+	return pbm.lossNotifier.register(mapName, threshold, callback), nil
+}
+
+// DeregisterLossListener removes a loss listener, it isn't notified once this returns, apart from a notification
+// being delivered
+func (pbm *PerfBufferMonitor) DeregisterLossListener(id LossListenerID) error {
+	if !pbm.lossNotifier.deregister(id) {
+		return errors.Errorf("unknown loss listener %d", id)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+// newTestLossNotifier adds a loss notifier to a test monitor, with a clock advanced by the caller
+func newTestLossNotifier(t *testing.T, pbm *PerfBufferMonitor, cooldown time.Duration) *time.Time {
+	now := time.Date(2021, 11, 2, 10, 0, 0, 0, time.UTC)
+	pbm.lossNotifier = newPerfBufferLossNotifier(cooldown)
+	pbm.lossNotifier.now = func() time.Time { return now }
+	pbm.lossNotifier.intervalStart = now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pbm.lossNotifier.Start(ctx, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return &now
+}
+
+// collectNotifications returns a loss listener callback and a function returning the notifications received by the
+// callback, waiting for count of them
+func collectNotifications() (func(LossNotification), func(t *testing.T, count int) []LossNotification) {
+	received := make(chan LossNotification, 16)
+	callback := func(notification LossNotification) { received <- notification }
+	wait := func(t *testing.T, count int) []LossNotification {
+		var notifications []LossNotification
+		for len(notifications) < count {
+			select {
+			case notification := <-received:
+				notifications = append(notifications, notification)
+			case <-time.After(5 * time.Second):
+				require.Failf(t, "missing loss notifications", "got %d of %d", len(notifications), count)
+			}
+		}
+		select {
+		case notification := <-received:
+			require.Failf(t, "unexpected loss notification", "%+v", notification)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return notifications
+	}
+	return callback, wait
+}
+
+// countLoss feeds the kernel stats of an interval to the monitor, and ends the interval
+func countLoss(t *testing.T, pbm *PerfBufferMonitor, now *time.Time, perfMap string, written uint64, lost uint64) {
+	*now = now.Add(20 * time.Second)
+	assert.NoError(t, pbm.processKernelStats(perfMap, uint32(model.ExecEventType), []PerfMapStats{{Count: written, Lost: lost}}, make(perfBufferCounters), map[string]uint64{}))
+	assert.NoError(t, pbm.processKernelStats(perfMap, uint32(model.FileOpenEventType), []PerfMapStats{{Count: written}}, make(perfBufferCounters), map[string]uint64{}))
+	// the kernel stats are cumulative
+	pbm.kernelStats[perfMap] = make([][model.MaxEventType]PerfMapStats, pbm.numCPU)
+	pbm.lossNotifier.endInterval()
+}
+
+func TestPerfBufferLossListenersThresholds(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events", "mountpoints_events")
+	now := newTestLossNotifier(t, pbm, time.Minute)
+
+	lowCallback, waitLow := collectNotifications()
+	highCallback, waitHigh := collectNotifications()
+	otherCallback, waitOther := collectNotifications()
+	_, err := pbm.RegisterLossListener("events", 0.01, lowCallback)
+	require.NoError(t, err)
+	_, err = pbm.RegisterLossListener("events", 0.25, highCallback)
+	require.NoError(t, err)
+	_, err = pbm.RegisterLossListener("mountpoints_events", 0.01, otherCallback)
+	require.NoError(t, err)
+
+	// 10 of the 200 events of the interval are lost, only the low threshold is reached
+	countLoss(t, pbm, now, "events", 95, 10)
+	notifications := waitLow(t, 1)
+	assert.Equal(t, LossNotification{
+		MapName:   "events",
+		Window:    20 * time.Second,
+		Timestamp: *now,
+		LossRatio: 0.05,
+		Threshold: 0.01,
+		EventTypes: map[string]EventTypeLoss{
+			model.ExecEventType.String():     {Written: 95, Lost: 10},
+			model.FileOpenEventType.String(): {Written: 95},
+		},
+	}, notifications[0])
+	waitHigh(t, 0)
+	waitOther(t, 0)
+
+	// both thresholds are reached, the low threshold listener is in its cooldown period
+	countLoss(t, pbm, now, "events", 50, 100)
+	notifications = waitHigh(t, 1)
+	assert.Equal(t, 0.5, notifications[0].LossRatio)
+	assert.Equal(t, 0.25, notifications[0].Threshold)
+	waitLow(t, 0)
+
+	// once the cooldown period has elapsed, the listeners whose threshold is reached are notified again
+	countLoss(t, pbm, now, "events", 0, 0)
+	countLoss(t, pbm, now, "events", 0, 0)
+	countLoss(t, pbm, now, "events", 50, 100)
+	waitLow(t, 1)
+	waitHigh(t, 1)
+	waitOther(t, 0)
+
+	assert.Equal(t, map[string]int{"events": 2, "mountpoints_events": 1}, pbm.GetStats()["loss_listeners"].(map[string]interface{})["listeners"])
+}
+
+func TestPerfBufferLossListenersDeregister(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	now := newTestLossNotifier(t, pbm, 0)
+
+	callback, wait := collectNotifications()
+	id, err := pbm.RegisterLossListener("events", 0.01, callback)
+	require.NoError(t, err)
+	countLoss(t, pbm, now, "events", 50, 50)
+	wait(t, 1)
+
+	require.NoError(t, pbm.DeregisterLossListener(id))
+	countLoss(t, pbm, now, "events", 50, 50)
+	wait(t, 0)
+	assert.Error(t, pbm.DeregisterLossListener(id))
+
+	// the kernel stats aren't accumulated without listener
+	assert.NoError(t, pbm.processKernelStats("events", uint32(model.ExecEventType), []PerfMapStats{{Count: 10, Lost: 10}}, make(perfBufferCounters), map[string]uint64{}))
+	assert.Empty(t, pbm.lossNotifier.current)
+}
+
+func TestPerfBufferLossListenersSlowListener(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	now := newTestLossNotifier(t, pbm, 0)
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	_, err := pbm.RegisterLossListener("events", 0.01, func(LossNotification) { <-unblock })
+	require.NoError(t, err)
+
+	// the intervals end without waiting for the listener, the notifications past the queue size are dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < maxPendingLossNotifications+10; i++ {
+			countLoss(t, pbm, now, "events", 50, 50)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "a slow loss listener blocks the stats intervals")
+	}
+	assert.NotZero(t, pbm.GetStats()["loss_listeners"].(map[string]interface{})["dropped_notifications"])
+}
+
+func TestPerfBufferLossListenersRegister(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	newTestLossNotifier(t, pbm, time.Minute)
+	callback := func(LossNotification) {}
+
+	_, err := pbm.RegisterLossListener("unknown", 0.01, callback)
+	assert.Error(t, err)
+	_, err = pbm.RegisterLossListener("events", 1.5, callback)
+	assert.Error(t, err)
+	_, err = pbm.RegisterLossListener("events", 0.01, nil)
+	assert.Error(t, err)
+
+	first, err := pbm.RegisterLossListener("events", 0.01, callback)
+	assert.NoError(t, err)
+	second, err := pbm.RegisterLossListener("events", 0.01, callback)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
@@ -9,17 +9,25 @@ package probe
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	manager "github.com/DataDog/ebpf-manager"
 	lib "github.com/cilium/ebpf"
 	"github.com/pkg/errors"
 
+	"github.com/DataDog/datadog-agent/pkg/security/config"
+	"github.com/DataDog/datadog-agent/pkg/security/ebpf/kernel"
 	"github.com/DataDog/datadog-agent/pkg/security/ebpf/probes"
 	"github.com/DataDog/datadog-agent/pkg/security/metrics"
 	"github.com/DataDog/datadog-agent/pkg/security/model"
 	"github.com/DataDog/datadog-agent/pkg/security/utils"
+	"github.com/DataDog/datadog-agent/pkg/tagger/collectors"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
@@ -41,17 +49,73 @@ func (s *PerfMapStats) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// statsBatchSize is the number of statistics map entries read at once with the batch lookup API
+const statsBatchSize = 64
+
+// statsMapWalkFunc is called for each entry of a statistics map, with the per cpu values of the entry
+type statsMapWalkFunc func(id uint32, cpuStats []PerfMapStats) error
+
+// perf buffer tags cardinalities, they select the tags of the perf buffer counters on top of the map
+const (
+	// perfBufferTagsOff doesn't add any tag
+	perfBufferTagsOff = "off"
+	// perfBufferTagsLow adds the event type
+	perfBufferTagsLow = "low"
+	// perfBufferTagsHigh adds the event type and the cpu
+	perfBufferTagsHigh = "high"
+)
+
+// perfBufferCounterKey identifies a perf buffer counter once aggregated at the level of the perf buffer tags
+// cardinality. An empty event type and a cpu of -1 mean that the counter isn't tagged with them.
+type perfBufferCounterKey struct {
+	metric    string
+	eventType string
+	cpu       int
+}
+
+// maxPendingCounts is the maximum number of counts, one per metric and tag set, kept until the statsd client recovers
+const maxPendingCounts = 4096
+
+// pendingCountKey identifies a count kept until the statsd client recovers, the tags are joined with a comma
+type pendingCountKey struct {
+	metric string
+	tags   string
+}
+
+// kernelStatsResetState tracks the underflows of the kernel counters of a perf map, which happen when its statistics
+// map is cleared. The fields are accessed atomically.
+type kernelStatsResetState struct {
+	// underflows is the cumulative count of kernel counters found lower than on the previous collection
+	underflows uint64
+	// baselinesReset is 1 when the programs were reloaded since the last collection, the underflows are then expected
+	baselinesReset uint32
+	// underflowLogged is 1 once an unexpected underflow was logged, until the next reload of the programs
+	underflowLogged uint32
+}
+
+// perfBufferCounters accumulates the counters of a perf map, so that each tag set is submitted once per flush
+type perfBufferCounters map[perfBufferCounterKey]int64
+
 // PerfBufferMonitor holds statistics about the number of lost and received events
 //nolint:structcheck,unused
 type PerfBufferMonitor struct {
 	// probe is a pointer to the Probe
 	probe *Probe
-	// statsdClient is a pointer to the statsdClient used to report the metrics of the perf buffer monitor
-	statsdClient *statsd.Client
+	// statsdClient is the statsd client used to report the metrics of the perf buffer monitor, nil if there is none
+	statsdClient statsd.ClientInterface
+	// pendingCounts holds the counts which couldn't be submitted, because there is no statsd client or it returned
+	// an error, to be submitted again on the next flush. It is only accessed by the flushes.
+	pendingCounts map[pendingCountKey]int64
+	// droppedCounts is the number of counts dropped because pendingCounts was full, reported once the client recovers
+	droppedCounts int64
 	// numCPU holds the current count of CPU
 	numCPU int
 	// perfBufferStatsMaps holds the pointers to the statistics kernel maps
 	perfBufferStatsMaps map[string]*lib.Map
+	// kernelStatsEnabled holds whether the kernel stats of each perf map are collected, 1 when they are. The flags are
+	// accessed atomically so that SetKernelStatsEnabled takes effect on the next flush, a perf map without a flag is
+	// collected.
+	kernelStatsEnabled map[string]*uint32
 	// perfBufferSize holds the size of each perf buffer, indexed by the name of the perf buffer
 	perfBufferSize map[string]float64
 
@@ -59,18 +123,73 @@ type PerfBufferMonitor struct {
 	perfBufferMapNameToStatsMapsName map[string]string
 	// statsMapsNamePerfBufferMapName maps a statistic map to its perf buffer
 	statsMapsNameToPerfBufferMapName map[string]string
+	// dumpStatsMap walks all the entries of a statistics map, with the batch lookup API when available
+	dumpStatsMap func(statsMap *lib.Map, walkFn statsMapWalkFunc) error
+	// cpuStats, batchKeys and batchValues are the buffers used to read the statistics maps, reused across flushes
+	cpuStats    []PerfMapStats
+	batchKeys   []uint32
+	batchValues []PerfMapStats
 
 	// stats holds the collected user space metrics
 	stats map[string][][model.MaxEventType]PerfMapStats
 	// kernelStats holds the aggregated kernel space metrics
 	kernelStats map[string][][model.MaxEventType]PerfMapStats
+	// kernelStatsResets tracks the underflows of the kernel stats of each perf map
+	kernelStatsResets map[string]*kernelStatsResetState
+	// kernelMaxEventType is the number of event types of the eBPF programs, read from the size of their statistics
+	// maps, 0 until it is read. Only the kernel stats of the event types known by both the kernel and the model are
+	// attributed to their event type.
+	kernelMaxEventType uint32
+	// unknownKernelStats holds the kernel stats of the statistics map entries beyond the event types known by both
+	// the kernel and the model, per perf map, per entry and per cpu. They are protected by unknownKernelStatsLock.
+	unknownKernelStats     map[string]map[uint32][]PerfMapStats
+	unknownKernelStatsLock sync.Mutex
 	// readLostEvents is the count of lost events, collected by reading the perf buffer
 	readLostEvents map[string][]uint64
-	// sortingErrorStats holds the count of events that indicate that at least 1 event is miss ordered
-	sortingErrorStats map[string][model.MaxEventType]*int64
-
-	// lastTimestamp is used to track the timestamp of the last event retrieved from the perf map
+	// sortingErrorStats holds the count of events that indicate that at least 1 event is miss ordered, per cpu
+	sortingErrorStats map[string][][model.MaxEventType]int64
+	// sortingErrorTotals holds the cumulative count of sorting errors per cpu, as reported in the monitor status
+	sortingErrorTotals map[string][]int64
+	// sortingMaxJump holds the maximum backwards jump (in ns) observed since the last flush, per map
+	sortingMaxJump map[string]*uint64
+	// sortingMaxJumpTotal holds the maximum backwards jump (in ns) observed since startup, per map
+	sortingMaxJumpTotal map[string]*uint64
+	// droppedByHandler holds the count of events read from the perf buffers but dropped by the event handler
+	// since the last flush, per event type
+	droppedByHandler [model.MaxEventType]uint64
+	// droppedByHandlerTotals holds the cumulative count of events dropped by the event handler, per event type, as
+	// reported in the monitor status
+	droppedByHandlerTotals [model.MaxEventType]uint64
+	// sortingErrorLogged is used to log only the first sorting error of each flush interval
+	sortingErrorLogged uint64
+	// clockSource holds the clock source of the host, used to diagnose sorting errors
+	clockSource string
+	// distributions is true when the per CPU read throughput is also submitted as distributions
+	distributions bool
+	// distributionsPerEventType is true when the distributions are tagged with the event type, which is
+	// only the case with a high tags cardinality
+	distributionsPerEventType bool
+	// tagsCardinality is the perf buffer tags cardinality of the counters
+	tagsCardinality string
+	// diagnostics writes a diagnostics dump when the loss rate is severe, nil if it is disabled
+	diagnostics *perfBufferDiagnosticsDumper
+	// slo tracks the loss ratio of the event types with a loss target, nil if none is configured
+	slo *perfBufferSLOTracker
+	// sloStatus is the state of the SLOs as of the last flush, protected by sloStatusLock
+	sloStatus     []perfBufferSLOStatus
+	sloStatusLock sync.Mutex
+	// lossNotifier notifies the loss listeners registered by the other components
+	lossNotifier *perfBufferLossNotifier
+	// throughput computes the moving average of the throughput of each event type, nil if it is disabled
+	throughput *perfBufferThroughputTracker
+
+	// lastTimestamp is used to track the timestamp of the last event retrieved from the perf map, the events
+	// of each cpu being read concurrently it is only accessed atomically, as are lastEventType and lastCPU
 	lastTimestamp uint64
+	// lastEventType is the type of the last event retrieved from the perf map
+	lastEventType uint64
+	// lastCPU is the cpu of the last event retrieved from the perf map
+	lastCPU int64
 	// shouldBumpGeneration is used to track if the dentry cache generations should be bumped
 	shouldBumpGeneration uint64
 }
@@ -79,73 +198,367 @@ type PerfBufferMonitor struct {
 func NewPerfBufferMonitor(p *Probe, client *statsd.Client) (*PerfBufferMonitor, error) {
 	pbm := PerfBufferMonitor{
 		probe:               p,
-		statsdClient:        client,
+		pendingCounts:       make(map[pendingCountKey]int64),
 		perfBufferStatsMaps: make(map[string]*lib.Map),
+		kernelStatsEnabled:  make(map[string]*uint32),
 		perfBufferSize:      make(map[string]float64),
 
-		perfBufferMapNameToStatsMapsName: probes.GetPerfBufferStatisticsMaps(),
+		perfBufferMapNameToStatsMapsName: make(map[string]string),
 		statsMapsNameToPerfBufferMapName: make(map[string]string),
 
-		stats:             make(map[string][][model.MaxEventType]PerfMapStats),
-		kernelStats:       make(map[string][][model.MaxEventType]PerfMapStats),
-		readLostEvents:    make(map[string][]uint64),
-		sortingErrorStats: make(map[string][model.MaxEventType]*int64),
+		stats:               make(map[string][][model.MaxEventType]PerfMapStats),
+		kernelStats:         make(map[string][][model.MaxEventType]PerfMapStats),
+		kernelStatsResets:   make(map[string]*kernelStatsResetState),
+		readLostEvents:      make(map[string][]uint64),
+		sortingErrorStats:   make(map[string][][model.MaxEventType]int64),
+		sortingErrorTotals:  make(map[string][]int64),
+		sortingMaxJump:      make(map[string]*uint64),
+		sortingMaxJumpTotal: make(map[string]*uint64),
+	}
+	// a nil client is kept as a nil interface, the counts are then kept up to maxPendingCounts
+	if client != nil {
+		pbm.statsdClient = client
 	}
 	numCPU, err := utils.NumCPU()
 	if err != nil {
 		return nil, errors.Wrapf(err, "couldn't fetch the host CPU count")
 	}
 	pbm.numCPU = numCPU
+	pbm.allocateStatsBuffers()
+
+	// the batch lookup API is available from kernel 5.6
+	pbm.dumpStatsMap = pbm.iterateStatsMap
+	if p.kernelVersion != nil && p.kernelVersion.Code >= kernel.Kernel5_6 {
+		pbm.dumpStatsMap = pbm.batchLookupStatsMap
+	}
+
+	if p.config.StatsPerfBufferDistributions {
+		pbm.distributions = true
+		pbm.distributionsPerEventType = p.config.StatsTagsCardinality == collectors.HighCardinalityString
+	}
+
+	pbm.tagsCardinality = getPerfBufferTagsCardinality(p.config)
 
-	// compute statsMapPerfMap
-	for perfMap, statsMap := range pbm.perfBufferMapNameToStatsMapsName {
-		pbm.statsMapsNameToPerfBufferMapName[statsMap] = perfMap
+	if p.config.StatsPerfBufferDiagnosticsLossRate > 0 {
+		pbm.diagnostics = newPerfBufferDiagnosticsDumper(p.config.StatsPerfBufferDiagnosticsLossRate,
+			p.config.StatsPerfBufferDiagnosticsCooldown, p.config.StatsPerfBufferDiagnosticsFile)
 	}
 
-	// Select perf buffer statistics maps
-	for perfMapName, statsMapName := range pbm.perfBufferMapNameToStatsMapsName {
-		stats, ok, err := p.manager.GetMap(statsMapName)
+	pbm.lossNotifier = newPerfBufferLossNotifier(p.config.StatsPerfBufferLossCooldown)
+
+	pbm.throughput = newPerfBufferThroughputTracker(p.config.StatsPerfBufferThroughputHalfLife, time.Now())
+
+	pbm.slo = newPerfBufferSLOTracker(getPerfBufferSLOTargets(p.config.StatsPerfBufferSLOTargets), p.config.StatsPollingInterval,
+		p.config.StatsPerfBufferSLOShortWindow, p.config.StatsPerfBufferSLOLongWindow)
+
+	if pbm.clockSource, err = utils.ClockSource(); err != nil {
+		log.Debugf("couldn't fetch the host clock source: %v", err)
+		pbm.clockSource = "unknown"
+	}
+
+	if err = pbm.selectStatsMaps(p.manager, p.manager.PerfMaps, probes.GetPerfBufferStatisticsMaps()); err != nil {
+		return nil, err
+	}
+	pbm.setPerfBufferSizes(p.managerOptions.DefaultPerfRingBufferSize, p.manager.PerfMaps)
+	pbm.selectKernelStatsMaps(p.config.StatsPerfBufferKernelStatsMaps)
+
+	// the statistics maps have one entry per event type of the eBPF programs
+	for _, statsMap := range pbm.perfBufferStatsMaps {
+		if pbm.kernelMaxEventType == 0 || statsMap.MaxEntries() < pbm.kernelMaxEventType {
+			pbm.kernelMaxEventType = statsMap.MaxEntries()
+		}
+	}
+	pbm.checkKernelEventTypes()
+
+	// Prepare user space counters, every perf map gets them whether it has a statistics map or not
+	for _, m := range p.manager.PerfMaps {
+		pbm.allocateUserSpaceCounters(m.Name)
+	}
+	log.Infof("monitoring perf ring buffer on %d CPU, %d events, clock source %s, ring buffer sizes: %s",
+		pbm.numCPU, model.MaxEventType, pbm.clockSource, pbm.describePerfBufferSizes())
+	pbm.sendPerfBufferSizes(pbm.statsdClient)
+	pbm.sendEventTypesMismatch(pbm.statsdClient)
+	return &pbm, nil
+}
+
+// statsMapGetter looks up the maps of the eBPF manager, the perf buffer monitor discovers the statistics maps with it
+type statsMapGetter interface {
+	GetMap(name string) (*lib.Map, bool, error)
+}
+
+// statsMapSuffix is appended to the name of a perf map to get the name of its statistics map, unless it has an
+// explicit one
+const statsMapSuffix = "_stats"
+
+// selectStatsMaps discovers the statistics map of each perf map, so that the perf maps added by new features are
+// monitored without being declared: the statistics map explicitly mapped to the perf map if there is one, the one
+// following the <perf map>_stats naming convention otherwise. An explicitly mapped statistics map must exist, the
+// perf maps without a statistics map only get the user space counters.
+func (pbm *PerfBufferMonitor) selectStatsMaps(maps statsMapGetter, perfMaps []*manager.PerfMap, explicit map[string]string) error {
+	for perfMapName, statsMapName := range explicit {
+		statsMap, ok, err := maps.GetMap(statsMapName)
 		if !ok {
-			return nil, errors.Errorf("map %s not found", statsMapName)
+			return errors.Errorf("map %s not found", statsMapName)
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
+		pbm.addStatsMap(perfMapName, statsMapName, statsMap)
+	}
 
-		pbm.perfBufferStatsMaps[perfMapName] = stats
-		// set default perf buffer size, it will be readjusted in the next loop if needed
-		pbm.perfBufferSize[perfMapName] = float64(p.managerOptions.DefaultPerfRingBufferSize)
+	for _, m := range perfMaps {
+		if _, found := explicit[m.Name]; found {
+			continue
+		}
+		statsMapName := m.Name + statsMapSuffix
+		statsMap, ok, err := maps.GetMap(statsMapName)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Debugf("perf map %s doesn't have a statistics map, only its user space stats are collected", m.Name)
+			continue
+		}
+		pbm.addStatsMap(m.Name, statsMapName, statsMap)
 	}
+	return nil
+}
 
-	// Prepare user space counters
-	for _, m := range p.manager.PerfMaps {
-		var stats, kernelStats [][model.MaxEventType]PerfMapStats
-		var usrLostEvents []uint64
-		var sortingErrorStats [model.MaxEventType]*int64
+// addStatsMap registers the statistics map of a perf map
+func (pbm *PerfBufferMonitor) addStatsMap(perfMapName string, statsMapName string, statsMap *lib.Map) {
+	pbm.perfBufferMapNameToStatsMapsName[perfMapName] = statsMapName
+	pbm.statsMapsNameToPerfBufferMapName[statsMapName] = perfMapName
+	pbm.perfBufferStatsMaps[perfMapName] = statsMap
+}
+
+// allocateUserSpaceCounters allocates the per cpu user space counters of a perf map
+func (pbm *PerfBufferMonitor) allocateUserSpaceCounters(perfMapName string) {
+	pbm.stats[perfMapName] = make([][model.MaxEventType]PerfMapStats, pbm.numCPU)
+	pbm.kernelStats[perfMapName] = make([][model.MaxEventType]PerfMapStats, pbm.numCPU)
+	pbm.kernelStatsResets[perfMapName] = &kernelStatsResetState{}
+	pbm.readLostEvents[perfMapName] = make([]uint64, pbm.numCPU)
+	pbm.sortingErrorStats[perfMapName] = make([][model.MaxEventType]int64, pbm.numCPU)
+	pbm.sortingErrorTotals[perfMapName] = make([]int64, pbm.numCPU)
+	pbm.sortingMaxJump[perfMapName] = new(uint64)
+	pbm.sortingMaxJumpTotal[perfMapName] = new(uint64)
+}
+
+// eventTypesMismatch returns whether the number of event types of the eBPF programs differs from the one of the model
+func (pbm *PerfBufferMonitor) eventTypesMismatch() bool {
+	return pbm.kernelMaxEventType != 0 && pbm.kernelMaxEventType != uint32(model.MaxEventType)
+}
+
+// attributedEventTypes returns the number of event types whose kernel stats are attributed, the ones known by both
+// the kernel and the model
+func (pbm *PerfBufferMonitor) attributedEventTypes() uint32 {
+	if pbm.kernelMaxEventType == 0 || pbm.kernelMaxEventType > uint32(model.MaxEventType) {
+		return uint32(model.MaxEventType)
+	}
+	return pbm.kernelMaxEventType
+}
+
+// checkKernelEventTypes logs the mismatch between the event types of the eBPF programs and the ones of the model, the
+// eBPF programs being older or newer than the agent
+func (pbm *PerfBufferMonitor) checkKernelEventTypes() {
+	if !pbm.eventTypesMismatch() {
+		return
+	}
+	log.Errorf("the eBPF programs have %d event types but the agent has %d, they weren't built from the same version: the kernel stats of the event types from %d are reported as unknown",
+		pbm.kernelMaxEventType, model.MaxEventType, pbm.attributedEventTypes())
+}
+
+// CheckEventTypes returns an error if the number of event types of the eBPF programs differs from the one of the agent
+func (pbm *PerfBufferMonitor) CheckEventTypes() error {
+	if pbm.eventTypesMismatch() {
+		return errors.Errorf("the eBPF programs have %d event types but the agent has %d", pbm.kernelMaxEventType, model.MaxEventType)
+	}
+	return nil
+}
+
+// sendEventTypesMismatch submits whether the event types of the eBPF programs differ from the ones of the model
+func (pbm *PerfBufferMonitor) sendEventTypesMismatch(client statsd.ClientInterface) {
+	if client == nil || pbm.kernelMaxEventType == 0 {
+		return
+	}
+	var value float64
+	if pbm.eventTypesMismatch() {
+		value = 1
+	}
+	_ = client.Gauge(metrics.MetricPerfBufferEventTypesMismatch, value, []string{}, 1.0)
+}
+
+// setPerfBufferSizes sets the ring buffer size of each perf map, the default size unless the perf map sets its own
+func (pbm *PerfBufferMonitor) setPerfBufferSizes(defaultSize int, perfMaps []*manager.PerfMap) {
+	for perfMapName := range pbm.perfBufferMapNameToStatsMapsName {
+		pbm.perfBufferSize[perfMapName] = float64(defaultSize)
+	}
+	for _, m := range perfMaps {
+		size := defaultSize
+		if m.PerfRingBufferSize != 0 {
+			size = m.PerfRingBufferSize
+		}
+		pbm.perfBufferSize[m.Name] = float64(size)
+	}
+}
+
+// describePerfBufferSizes lists the ring buffer size of each perf map, sorted by name
+func (pbm *PerfBufferMonitor) describePerfBufferSizes() string {
+	sizes := make([]string, 0, len(pbm.perfBufferSize))
+	for perfMapName, size := range pbm.perfBufferSize {
+		sizes = append(sizes, fmt.Sprintf("%s=%d", perfMapName, int64(size)))
+	}
+	sort.Strings(sizes)
+	return strings.Join(sizes, " ")
+}
+
+// sendPerfBufferSizes submits the current ring buffer size of each perf map, so that the losses can be correlated
+// with the sizing
+func (pbm *PerfBufferMonitor) sendPerfBufferSizes(client statsd.ClientInterface) {
+	if client == nil {
+		return
+	}
+	for perfMapName, size := range pbm.perfBufferSize {
+		_ = client.Gauge(metrics.MetricPerfBufferSizeBytes, size, []string{fmt.Sprintf("map:%s", perfMapName)}, 1.0)
+	}
+}
 
-		for i := 0; i < pbm.numCPU; i++ {
-			stats = append(stats, [model.MaxEventType]PerfMapStats{})
-			kernelStats = append(kernelStats, [model.MaxEventType]PerfMapStats{})
-			usrLostEvents = append(usrLostEvents, 0)
+// selectKernelStatsMaps enables the collection of the kernel stats of the given perf maps only, or of all of them when
+// none is given
+func (pbm *PerfBufferMonitor) selectKernelStatsMaps(perfMapNames []string) {
+	selected := make(map[string]bool, len(perfMapNames))
+	for _, name := range perfMapNames {
+		if _, found := pbm.perfBufferStatsMaps[name]; !found {
+			log.Warnf("unknown perf map %s in the perf maps whose kernel stats are collected", name)
 		}
+		selected[name] = true
+	}
+	for perfMapName := range pbm.perfBufferStatsMaps {
+		enabled := new(uint32)
+		if len(selected) == 0 || selected[perfMapName] {
+			*enabled = 1
+		}
+		pbm.kernelStatsEnabled[perfMapName] = enabled
+	}
+}
+
+// isKernelStatsEnabled returns whether the kernel stats of a perf map are collected
+func (pbm *PerfBufferMonitor) isKernelStatsEnabled(perfMapName string) bool {
+	enabled, found := pbm.kernelStatsEnabled[perfMapName]
+	return !found || atomic.LoadUint32(enabled) == 1
+}
+
+// SetKernelStatsEnabled enables or disables the collection of the kernel stats of a perf map, the change takes
+// effect on the next call to SendStats
+func (pbm *PerfBufferMonitor) SetKernelStatsEnabled(mapName string, enabled bool) error {
+	flag, found := pbm.kernelStatsEnabled[mapName]
+	if !found {
+		return errors.Errorf("unknown perf map %s", mapName)
+	}
+	var value uint32
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapUint32(flag, value) != value {
+		log.Infof("kernel stats collection of perf map %s set to %t", mapName, enabled)
+	}
+	return nil
+}
 
-		for i := 0; i < int(model.MaxEventType); i++ {
-			zero := int64(0)
-			sortingErrorStats[i] = &zero
+// getPerfBufferTagsCardinality returns the perf buffer tags cardinality of the configuration. Without override, the
+// counters are tagged with the event type, whatever the tags cardinality.
+func getPerfBufferTagsCardinality(cfg *config.Config) string {
+	switch cfg.StatsPerfBufferTagsCardinality {
+	case perfBufferTagsOff, perfBufferTagsLow, perfBufferTagsHigh:
+		return cfg.StatsPerfBufferTagsCardinality
+	case "":
+	default:
+		log.Warnf("invalid perf buffer tags cardinality %s, expected one of off, low or high", cfg.StatsPerfBufferTagsCardinality)
+	}
+	return perfBufferTagsLow
+}
+
+// count adds value to a counter, aggregated at the level of the perf buffer tags cardinality. An empty event type
+// is used by the counters that aren't tracked per event type.
+func (pbm *PerfBufferMonitor) count(counters perfBufferCounters, metric string, eventType string, cpu int, value int64) {
+	if value <= 0 {
+		return
+	}
+
+	key := perfBufferCounterKey{metric: metric, cpu: -1}
+	if pbm.tagsCardinality != perfBufferTagsOff {
+		key.eventType = eventType
+	}
+	// the sorting errors are always tagged with the cpu, to tell the cpus whose clock drifts
+	if pbm.tagsCardinality == perfBufferTagsHigh || metric == metrics.MetricPerfBufferSortingError {
+		key.cpu = cpu
+	}
+	counters[key] += value
+}
+
+// sendCounters submits the aggregated counters of a perf map, an empty map tag is used by the counters that
+// aren't tracked per perf map
+func (pbm *PerfBufferMonitor) sendCounters(client statsd.ClientInterface, mapTag string, counters perfBufferCounters) {
+	for key, value := range counters {
+		tags := []string{pbm.probe.config.StatsTagsCardinality}
+		if mapTag != "" {
+			tags = append(tags, mapTag)
+		}
+		if key.eventType != "" {
+			tags = append(tags, fmt.Sprintf("event_type:%s", key.eventType))
+		}
+		if key.cpu >= 0 {
+			tags = append(tags, fmt.Sprintf("cpu:%d", key.cpu))
 		}
 
-		pbm.stats[m.Name] = stats
-		pbm.kernelStats[m.Name] = kernelStats
-		pbm.readLostEvents[m.Name] = usrLostEvents
-		pbm.sortingErrorStats[m.Name] = sortingErrorStats
+		pbm.sendCount(client, key.metric, value, tags)
+	}
+}
 
-		// update perf buffer size if needed
-		if m.PerfRingBufferSize != 0 {
-			pbm.perfBufferSize[m.Name] = float64(m.PerfRingBufferSize)
+// sendCount submits a count, or keeps it to submit it on the next flush if there is no client or it fails
+func (pbm *PerfBufferMonitor) sendCount(client statsd.ClientInterface, metric string, value int64, tags []string) {
+	if client != nil {
+		if err := client.Count(metric, value, tags, 1.0); err == nil {
+			return
 		}
 	}
-	log.Debugf("monitoring perf ring buffer on %d CPU, %d events", pbm.numCPU, model.MaxEventType)
-	return &pbm, nil
+	pbm.bufferCount(pendingCountKey{metric: metric, tags: strings.Join(tags, ",")}, value)
+}
+
+// bufferCount adds a count to the pending counts, it is dropped if they are full
+func (pbm *PerfBufferMonitor) bufferCount(key pendingCountKey, value int64) {
+	if pbm.pendingCounts == nil {
+		pbm.pendingCounts = make(map[pendingCountKey]int64)
+	}
+	if _, found := pbm.pendingCounts[key]; !found && len(pbm.pendingCounts) >= maxPendingCounts {
+		pbm.droppedCounts++
+		return
+	}
+	pbm.pendingCounts[key] += value
+}
+
+// flushPendingCounts submits the counts kept since the client failed, and then the number of counts dropped
+// meanwhile. The counts failing again are kept for the next flush.
+func (pbm *PerfBufferMonitor) flushPendingCounts(client statsd.ClientInterface) {
+	if client == nil {
+		return
+	}
+	for key, value := range pbm.pendingCounts {
+		var tags []string
+		if key.tags != "" {
+			tags = strings.Split(key.tags, ",")
+		}
+		if err := client.Count(key.metric, value, tags, 1.0); err != nil {
+			return
+		}
+		delete(pbm.pendingCounts, key)
+	}
+	if pbm.droppedCounts > 0 {
+		if err := client.Count(metrics.MetricPerfBufferStatsDropped, pbm.droppedCounts, []string{}, 1.0); err != nil {
+			return
+		}
+		log.Warnf("%d perf buffer counts were dropped while the statsd client was unavailable", pbm.droppedCounts)
+		pbm.droppedCounts = 0
+	}
 }
 
 // getLostCount is an internal function, it can segfault if its parameters are incorrect.
@@ -182,8 +595,8 @@ func (pbm *PerfBufferMonitor) GetAndResetKernelLostCount(perfMap string, cpu int
 	var total uint64
 	var shouldCount bool
 
-	// query the kernel maps
-	_ = pbm.collectAndSendKernelStats(nil)
+	// query the kernel maps, the counters read here must not be submitted on the next flush
+	_ = pbm.collectAllKernelStats(nil, true)
 
 	for cpuID := range pbm.kernelStats[perfMap] {
 		if cpu == -1 || cpu == cpuID {
@@ -302,8 +715,33 @@ func (pbm *PerfBufferMonitor) getAndResetEventBytes(eventType model.EventType, p
 }
 
 // getAndResetSortingErrorCount is an internal function, it can segfault if its parameters are incorrect.
-func (pbm *PerfBufferMonitor) getAndResetSortingErrorCount(eventType model.EventType, perfMap string) int64 {
-	return atomic.SwapInt64(pbm.sortingErrorStats[perfMap][eventType], 0)
+func (pbm *PerfBufferMonitor) getAndResetSortingErrorCount(eventType model.EventType, perfMap string, cpu int) int64 {
+	return atomic.SwapInt64(&pbm.sortingErrorStats[perfMap][cpu][eventType], 0)
+}
+
+// countSortingError records an event received jump nanoseconds older than the previous event of the perf map
+func (pbm *PerfBufferMonitor) countSortingError(eventType model.EventType, jump uint64, m *manager.PerfMap, cpu int) {
+	atomic.SwapUint64(&pbm.shouldBumpGeneration, 1)
+
+	// sanity check
+	if (pbm.sortingErrorStats[m.Name] == nil) || (len(pbm.sortingErrorStats[m.Name]) <= cpu) || (len(pbm.sortingErrorStats[m.Name][cpu]) <= int(eventType)) {
+		return
+	}
+	atomic.AddInt64(&pbm.sortingErrorStats[m.Name][cpu][eventType], 1)
+
+	for _, maxJump := range []*uint64{pbm.sortingMaxJump[m.Name], pbm.sortingMaxJumpTotal[m.Name]} {
+		for current := atomic.LoadUint64(maxJump); jump > current; current = atomic.LoadUint64(maxJump) {
+			if atomic.CompareAndSwapUint64(maxJump, current, jump) {
+				break
+			}
+		}
+	}
+
+	// only log the first sorting error of each flush interval
+	if atomic.CompareAndSwapUint64(&pbm.sortingErrorLogged, 0, 1) {
+		log.Infof("sorting error on %s: %s event on cpu %d is %dns older than the previous %s event on cpu %d (clock source: %s)",
+			m.Name, eventType, cpu, jump, model.EventType(atomic.LoadUint64(&pbm.lastEventType)), atomic.LoadInt64(&pbm.lastCPU), pbm.clockSource)
+	}
 }
 
 // CountLostEvent adds `count` to the counter of lost events
@@ -318,11 +756,17 @@ func (pbm *PerfBufferMonitor) CountLostEvent(count uint64, m *manager.PerfMap, c
 // CountEvent adds `count` to the counter of received events of the specified type
 func (pbm *PerfBufferMonitor) CountEvent(eventType model.EventType, timestamp uint64, count uint64, size uint64, m *manager.PerfMap, cpu int) {
 	// check event order
-	if timestamp < pbm.lastTimestamp && pbm.lastTimestamp != 0 {
-		atomic.AddInt64(pbm.sortingErrorStats[m.Name][eventType], 1)
-		atomic.SwapUint64(&pbm.shouldBumpGeneration, 1)
-	} else {
-		pbm.lastTimestamp = timestamp
+	for {
+		last := atomic.LoadUint64(&pbm.lastTimestamp)
+		if timestamp < last && last != 0 {
+			pbm.countSortingError(eventType, last-timestamp, m, cpu)
+			break
+		}
+		if atomic.CompareAndSwapUint64(&pbm.lastTimestamp, last, timestamp) {
+			atomic.StoreUint64(&pbm.lastEventType, uint64(eventType))
+			atomic.StoreInt64(&pbm.lastCPU, int64(cpu))
+			break
+		}
 	}
 
 	// sanity check
@@ -334,183 +778,519 @@ func (pbm *PerfBufferMonitor) CountEvent(eventType model.EventType, timestamp ui
 	atomic.AddUint64(&pbm.stats[m.Name][cpu][eventType].Bytes, size)
 }
 
-func (pbm *PerfBufferMonitor) sendEventsAndBytesReadStats(client *statsd.Client) error {
-	var count int64
-	var err error
+// CountDroppedByHandler adds `count` to the counter of events of the specified type read from a perf buffer, but
+// dropped by the event handler before being dispatched
+func (pbm *PerfBufferMonitor) CountDroppedByHandler(eventType model.EventType, count uint64) {
+	// sanity check
+	if eventType >= model.MaxEventType {
+		return
+	}
+	atomic.AddUint64(&pbm.droppedByHandler[eventType], count)
+	atomic.AddUint64(&pbm.droppedByHandlerTotals[eventType], count)
+}
+
+// sendDroppedByHandlerStats submits the events dropped by the event handler since the last flush, and returns them
+// per event type
+func (pbm *PerfBufferMonitor) sendDroppedByHandlerStats(client statsd.ClientInterface) map[string]uint64 {
+	perEvent := make(map[string]uint64)
+	counters := make(perfBufferCounters)
+	for eventType := range pbm.droppedByHandler {
+		if count := atomic.SwapUint64(&pbm.droppedByHandler[eventType], 0); count > 0 {
+			evtType := model.EventType(eventType).String()
+			pbm.count(counters, metrics.MetricPerfBufferDroppedUserspace, evtType, -1, int64(count))
+			perEvent[evtType] = count
+		}
+	}
+	pbm.sendCounters(client, "", counters)
+	return perEvent
+}
+
+// sendEventsAndBytesReadStats submits the events and bytes read from the perf buffers. A distribution or gauge
+// failing doesn't stop the submission, so that the counters swapped for the flush are submitted or kept.
+func (pbm *PerfBufferMonitor) sendEventsAndBytesReadStats(client statsd.ClientInterface) error {
+	var count, events, bytes int64
+	var cpuEvents, cpuBytes int64
+	var firstErr error
+	keepErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 	tags := []string{pbm.probe.config.StatsTagsCardinality, "", ""}
 
 	for m := range pbm.stats {
+		counters := make(perfBufferCounters)
 		tags[1] = fmt.Sprintf("map:%s", m)
 		for cpu := range pbm.stats[m] {
+			cpuEvents, cpuBytes = 0, 0
 			for eventType := range pbm.stats[m][cpu] {
 				evtType := model.EventType(eventType)
 				tags[2] = fmt.Sprintf("event_type:%s", evtType)
 
-				if count = int64(pbm.getAndResetEventCount(evtType, m, cpu)); count > 0 {
-					if err = client.Count(metrics.MetricPerfBufferEventsRead, count, tags, 1.0); err != nil {
-						return err
-					}
+				events = int64(pbm.getAndResetEventCount(evtType, m, cpu))
+				pbm.count(counters, metrics.MetricPerfBufferEventsRead, evtType.String(), cpu, events)
+
+				bytes = int64(pbm.getAndResetEventBytes(evtType, m, cpu))
+				pbm.count(counters, metrics.MetricPerfBufferBytesRead, evtType.String(), cpu, bytes)
+
+				if pbm.throughput != nil {
+					pbm.throughput.count(evtType, uint64(events), uint64(bytes))
 				}
 
-				if count = int64(pbm.getAndResetEventBytes(evtType, m, cpu)); count > 0 {
-					if err = client.Count(metrics.MetricPerfBufferBytesRead, count, tags, 1.0); err != nil {
-						return err
+				// the distributions reuse the swapped counters, so that they don't add any atomic operation
+				if pbm.distributions {
+					if pbm.distributionsPerEventType {
+						keepErr(pbm.sendReadDistributions(client, events, bytes, tags))
+					} else {
+						cpuEvents += events
+						cpuBytes += bytes
 					}
 				}
 
-				if count = pbm.getAndResetSortingErrorCount(evtType, m); count > 0 {
-					if err = pbm.statsdClient.Count(metrics.MetricPerfBufferSortingError, count, tags, 1.0); err != nil {
-						return err
-					}
+				if count = pbm.getAndResetSortingErrorCount(evtType, m, cpu); count > 0 {
+					atomic.AddInt64(&pbm.sortingErrorTotals[m][cpu], count)
+					pbm.count(counters, metrics.MetricPerfBufferSortingError, evtType.String(), cpu, count)
 				}
 			}
+
+			// without the event type, every CPU reports a value, idle ones included, so that
+			// the percentiles are computed over all the CPUs
+			if pbm.distributions && !pbm.distributionsPerEventType && client != nil {
+				keepErr(client.Distribution(metrics.MetricPerfBufferEventsReadPerCPU, float64(cpuEvents), tags[:2], 1.0))
+				keepErr(client.Distribution(metrics.MetricPerfBufferBytesReadPerCPU, float64(cpuBytes), tags[:2], 1.0))
+			}
+		}
+
+		pbm.sendCounters(client, tags[1], counters)
+
+		if maxJump := atomic.SwapUint64(pbm.sortingMaxJump[m], 0); maxJump > 0 && client != nil {
+			keepErr(client.Gauge(metrics.MetricPerfBufferSortingMaxJump, float64(maxJump), tags[:2], 1.0))
 		}
 	}
-	return nil
+	return firstErr
 }
 
-func (pbm *PerfBufferMonitor) sendLostEventsReadStats(client *statsd.Client) error {
-	tags := []string{pbm.probe.config.StatsTagsCardinality, ""}
+// sendReadDistributions submits the events and bytes read by a CPU for one event type during the last flush interval
+func (pbm *PerfBufferMonitor) sendReadDistributions(client statsd.ClientInterface, events int64, bytes int64, tags []string) error {
+	if client == nil || (events == 0 && bytes == 0) {
+		return nil
+	}
+	if err := client.Distribution(metrics.MetricPerfBufferEventsReadPerCPU, float64(events), tags, 1.0); err != nil {
+		return err
+	}
+	return client.Distribution(metrics.MetricPerfBufferBytesReadPerCPU, float64(bytes), tags, 1.0)
+}
 
+// sendLostEventsReadStats submits the events lost while reading the perf buffers. The events dropped by the event
+// handler are reported in the lost events read event of the perf map they were read from.
+func (pbm *PerfBufferMonitor) sendLostEventsReadStats(client statsd.ClientInterface, droppedByHandler map[string]uint64) error {
 	for m := range pbm.readLostEvents {
 		var total float64
-		tags[1] = fmt.Sprintf("map:%s", m)
+		counters := make(perfBufferCounters)
 
 		for cpu := range pbm.readLostEvents[m] {
 			if count := float64(pbm.getAndResetReadLostCount(m, cpu)); count > 0 {
-				if err := client.Count(metrics.MetricPerfBufferLostRead, int64(count), tags, 1.0); err != nil {
-					return err
-				}
+				pbm.count(counters, metrics.MetricPerfBufferLostRead, "", cpu, int64(count))
 				total += count
 			}
 		}
 
-		if total > 0 {
+		pbm.sendCounters(client, fmt.Sprintf("map:%s", m), counters)
+
+		var dropped map[string]uint64
+		if pbm.probe.perfMap != nil && pbm.probe.perfMap.Name == m {
+			dropped = droppedByHandler
+		}
+
+		if total > 0 || len(dropped) > 0 {
 			pbm.probe.DispatchCustomEvent(
-				NewEventLostReadEvent(m, total),
+				NewEventLostReadEvent(m, total, dropped),
 			)
 		}
 	}
 	return nil
 }
 
-func (pbm *PerfBufferMonitor) collectAndSendKernelStats(client *statsd.Client) error {
-	var (
-		id       uint32
-		iterator *lib.MapIterator
-		tmpCount uint64
-	)
-	cpuStats := make([]PerfMapStats, pbm.numCPU)
-	tags := []string{pbm.probe.config.StatsTagsCardinality, "", ""}
+// allocateStatsBuffers allocates the buffers used to read the statistics maps
+func (pbm *PerfBufferMonitor) allocateStatsBuffers() {
+	pbm.cpuStats = make([]PerfMapStats, pbm.numCPU)
+	pbm.batchKeys = make([]uint32, statsBatchSize)
+	pbm.batchValues = make([]PerfMapStats, statsBatchSize*pbm.numCPU)
+}
 
-	// loop through the statistics buffers of each perf map
-	for perfMapName, statsMap := range pbm.perfBufferStatsMaps {
-		// total and perEvent are used for alerting
-		var total uint64
-		perEvent := map[string]uint64{}
-		tags[1] = fmt.Sprintf("map:%s", perfMapName)
-
-		// loop through all the values of the active buffer
-		iterator = statsMap.Iterate()
-		for iterator.Next(&id, &cpuStats) {
-			if id == 0 {
-				// first event type is 1
-				continue
+// iterateStatsMap walks the entries of a statistics map one lookup at a time
+func (pbm *PerfBufferMonitor) iterateStatsMap(statsMap *lib.Map, walkFn statsMapWalkFunc) error {
+	var id uint32
+	iterator := statsMap.Iterate()
+	for iterator.Next(&id, &pbm.cpuStats) {
+		if err := walkFn(id, pbm.cpuStats); err != nil {
+			return err
+		}
+	}
+	return iterator.Err()
+}
+
+// batchLookupStatsMap walks the entries of a statistics map statsBatchSize entries at a time. It falls back
+// to iterateStatsMap for good if the batch lookup API turns out not to be supported.
+func (pbm *PerfBufferMonitor) batchLookupStatsMap(statsMap *lib.Map, walkFn statsMapWalkFunc) error {
+	var cursor, nextKey uint32
+	// prevKey is nil for the first batch
+	var prevKey interface{}
+	for {
+		count, err := statsMap.BatchLookup(prevKey, &nextKey, pbm.batchKeys, pbm.batchValues, nil)
+		if errors.Is(err, lib.ErrNotSupported) {
+			log.Debugf("eBPF map batch lookup not supported, falling back to the map iterator: %v", err)
+			pbm.dumpStatsMap = pbm.iterateStatsMap
+			return pbm.iterateStatsMap(statsMap, walkFn)
+		}
+
+		for i := 0; i < count; i++ {
+			if walkErr := walkFn(pbm.batchKeys[i], pbm.batchValues[i*pbm.numCPU:(i+1)*pbm.numCPU]); walkErr != nil {
+				return walkErr
 			}
+		}
 
-			// retrieve event type from key
-			evtType := model.EventType(id % uint32(model.MaxEventType))
-			tags[2] = fmt.Sprintf("event_type:%s", evtType)
-
-			// loop over each cpu entry
-			for cpu, stats := range cpuStats {
-				// sanity checks:
-				//   - check if the computed cpu id is below the current cpu count
-				//   - check if we collect some data on the provided perf map
-				//   - check if the computed event id is below the current max event id
-				if (pbm.stats[perfMapName] == nil) || (len(pbm.stats[perfMapName]) <= cpu) || (len(pbm.stats[perfMapName][cpu]) <= int(evtType)) {
-					return nil
-				}
+		if errors.Is(err, lib.ErrKeyNotExist) {
+			// the end of the map was reached
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cursor = nextKey
+		prevKey = &cursor
+	}
+}
 
-				// make sure perEvent is properly initialized
-				if _, ok := perEvent[evtType.String()]; !ok {
-					perEvent[evtType.String()] = 0
-				}
+// processKernelStats updates the kernel stats of a perf map with one entry of its statistics map, counts the
+// resulting metrics and accumulates the lost events per event type
+func (pbm *PerfBufferMonitor) processKernelStats(perfMapName string, id uint32, cpuStats []PerfMapStats, counters perfBufferCounters, perEvent map[string]uint64) error {
+	var underflow bool
 
-				// Update stats to avoid sending twice the same data points
-				if tmpCount = pbm.swapKernelEventBytes(evtType, perfMapName, cpu, stats.Bytes); tmpCount <= stats.Bytes {
-					stats.Bytes -= tmpCount
-				}
-				if tmpCount = pbm.swapKernelEventCount(evtType, perfMapName, cpu, stats.Count); tmpCount <= stats.Count {
-					stats.Count -= tmpCount
-				}
-				if tmpCount = pbm.swapKernelLostCount(evtType, perfMapName, cpu, stats.Lost); tmpCount <= stats.Lost {
-					stats.Lost -= tmpCount
-				}
+	if id == 0 {
+		// first event type is 1
+		return nil
+	}
 
-				// purge dentry resolver generation if needed
-				if evtType == model.FileRenameEventType || evtType == model.FileUnlinkEventType || evtType == model.FileRmdirEventType {
-					atomic.SwapUint64(&pbm.shouldBumpGeneration, 1)
-				}
+	// retrieve event type from key, the entries beyond the event types known by both the kernel and the model
+	// can't be attributed
+	evtType := model.UnknownEventType
+	if id < pbm.attributedEventTypes() {
+		evtType = model.EventType(id)
+	}
 
-				if client != nil {
-					if err := pbm.sendKernelStats(client, stats, tags); err != nil {
-						return err
-					}
-				}
-				total += stats.Lost
-				perEvent[evtType.String()] += stats.Lost
-			}
+	// loop over each cpu entry
+	for cpu, stats := range cpuStats {
+		// sanity checks:
+		//   - check if the computed cpu id is below the current cpu count
+		//   - check if we collect some data on the provided perf map
+		//   - check if the computed event id is below the current max event id
+		if (pbm.stats[perfMapName] == nil) || (len(pbm.stats[perfMapName]) <= cpu) || (len(pbm.stats[perfMapName][cpu]) <= int(evtType)) {
+			return nil
 		}
-		if iterator.Err() != nil {
-			return errors.Wrapf(iterator.Err(), "failed to dump the statistics buffer of map %s", perfMapName)
+
+		// make sure perEvent is properly initialized
+		if _, ok := perEvent[evtType.String()]; !ok {
+			perEvent[evtType.String()] = 0
 		}
 
-		// send an alert if events were lost
-		if total > 0 {
-			pbm.probe.DispatchCustomEvent(
-				NewEventLostWriteEvent(perfMapName, perEvent),
-			)
+		// Update stats to avoid sending twice the same data points
+		var underflows int64
+		previous := pbm.swapKernelStats(perfMapName, id, evtType, cpu, stats)
+		if stats.Bytes, underflow = kernelStatsDelta(previous.Bytes, stats.Bytes); underflow {
+			underflows++
+		}
+		if stats.Count, underflow = kernelStatsDelta(previous.Count, stats.Count); underflow {
+			underflows++
+		}
+		if stats.Lost, underflow = kernelStatsDelta(previous.Lost, stats.Lost); underflow {
+			underflows++
+		}
+		if underflows > 0 {
+			pbm.countKernelStatsUnderflows(counters, perfMapName, evtType, cpu, underflows)
+		}
+
+		// purge dentry resolver generation if needed
+		if evtType == model.FileRenameEventType || evtType == model.FileUnlinkEventType || evtType == model.FileRmdirEventType {
+			atomic.SwapUint64(&pbm.shouldBumpGeneration, 1)
+		}
+
+		pbm.count(counters, metrics.MetricPerfBufferEventsWrite, evtType.String(), cpu, int64(stats.Count))
+		pbm.count(counters, metrics.MetricPerfBufferBytesWrite, evtType.String(), cpu, int64(stats.Bytes))
+		pbm.count(counters, metrics.MetricPerfBufferLostWrite, evtType.String(), cpu, int64(stats.Lost))
+		perEvent[evtType.String()] += stats.Lost
+		if pbm.diagnostics != nil {
+			pbm.diagnostics.countKernelStats(evtType.String(), stats.Count, stats.Lost)
+		}
+		if pbm.slo != nil {
+			pbm.slo.countKernelStats(evtType, stats.Count, stats.Lost)
+		}
+		if pbm.lossNotifier != nil {
+			pbm.lossNotifier.countKernelStats(perfMapName, evtType.String(), stats.Count, stats.Lost)
 		}
 	}
 	return nil
 }
 
-func (pbm *PerfBufferMonitor) sendKernelStats(client *statsd.Client, stats PerfMapStats, tags []string) error {
-	if stats.Count > 0 {
-		if err := client.Count(metrics.MetricPerfBufferEventsWrite, int64(stats.Count), tags, 1.0); err != nil {
-			return err
+// swapKernelStats stores the kernel stats of a statistics map entry on a cpu, and returns their previous values. The
+// entries which aren't attributed share the unknown event type, their values are kept per entry.
+func (pbm *PerfBufferMonitor) swapKernelStats(perfMapName string, id uint32, evtType model.EventType, cpu int, stats PerfMapStats) PerfMapStats {
+	if evtType != model.UnknownEventType {
+		return PerfMapStats{
+			Bytes: pbm.swapKernelEventBytes(evtType, perfMapName, cpu, stats.Bytes),
+			Count: pbm.swapKernelEventCount(evtType, perfMapName, cpu, stats.Count),
+			Lost:  pbm.swapKernelLostCount(evtType, perfMapName, cpu, stats.Lost),
 		}
 	}
 
-	if stats.Bytes > 0 {
-		if err := client.Count(metrics.MetricPerfBufferBytesWrite, int64(stats.Bytes), tags, 1.0); err != nil {
-			return err
-		}
+	pbm.unknownKernelStatsLock.Lock()
+	defer pbm.unknownKernelStatsLock.Unlock()
+	if pbm.unknownKernelStats == nil {
+		pbm.unknownKernelStats = make(map[string]map[uint32][]PerfMapStats)
+	}
+	entries, found := pbm.unknownKernelStats[perfMapName]
+	if !found {
+		entries = make(map[uint32][]PerfMapStats)
+		pbm.unknownKernelStats[perfMapName] = entries
 	}
+	perCPU, found := entries[id]
+	if !found {
+		perCPU = make([]PerfMapStats, pbm.numCPU)
+		entries[id] = perCPU
+	}
+	previous := perCPU[cpu]
+	perCPU[cpu] = stats
+	return previous
+}
 
-	if stats.Lost > 0 {
-		if err := client.Count(metrics.MetricPerfBufferLostWrite, int64(stats.Lost), tags, 1.0); err != nil {
+// kernelStatsDelta returns the increase of a kernel counter since its previous value. A counter lower than its
+// previous value either wrapped around, or underflowed because its statistics map was cleared, in which case its
+// value is the increase since the map was cleared.
+func kernelStatsDelta(previous uint64, current uint64) (uint64, bool) {
+	if current >= previous {
+		return current - previous, false
+	}
+	// a counter going back by more than half of its range wrapped around, the difference is then the increase
+	if previous-current > math.MaxUint64/2 {
+		return current - previous, false
+	}
+	return current, true
+}
+
+// countKernelStatsUnderflows counts the underflows of the kernel counters of an event type on a cpu. The first
+// underflow of a perf map is logged, unless the programs were reloaded since the last collection.
+func (pbm *PerfBufferMonitor) countKernelStatsUnderflows(counters perfBufferCounters, perfMapName string, evtType model.EventType, cpu int, underflows int64) {
+	pbm.count(counters, metrics.MetricPerfBufferKernelStatsUnderflows, evtType.String(), cpu, underflows)
+
+	state, found := pbm.kernelStatsResets[perfMapName]
+	if !found {
+		return
+	}
+	atomic.AddUint64(&state.underflows, uint64(underflows))
+	if atomic.LoadUint32(&state.baselinesReset) == 1 {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&state.underflowLogged, 0, 1) {
+		log.Warnf("the kernel stats of perf map %s went backwards (event type %s, cpu %d), the statistics map was likely cleared: counting its values since then",
+			perfMapName, evtType, cpu)
+	}
+}
+
+// ResetKernelBaselines is called right after the eBPF programs are reloaded: the statistics maps may have been
+// cleared, the kernel counters found lower than on the previous collection are then counted from zero without
+// being logged, and the next unexpected underflow of each perf map is logged again.
+func (pbm *PerfBufferMonitor) ResetKernelBaselines() {
+	for _, state := range pbm.kernelStatsResets {
+		atomic.StoreUint32(&state.baselinesReset, 1)
+		atomic.StoreUint32(&state.underflowLogged, 0)
+	}
+}
+
+// collectKernelStats reads the statistics map of a perf map, submits the counters of the increase of its
+// kernel stats, and returns the number of lost events per event type since the previous collection
+func (pbm *PerfBufferMonitor) collectKernelStats(client statsd.ClientInterface, perfMapName string, statsMap *lib.Map) (map[string]uint64, error) {
+	perEvent, counters, err := pbm.updateKernelStats(perfMapName, statsMap)
+	if err != nil {
+		return nil, err
+	}
+	pbm.sendCounters(client, fmt.Sprintf("map:%s", perfMapName), counters)
+	return perEvent, nil
+}
+
+// updateKernelStats reads the statistics map of a perf map, and returns the number of lost events per event type
+// and the counters of the increase of its kernel stats since the previous collection
+func (pbm *PerfBufferMonitor) updateKernelStats(perfMapName string, statsMap *lib.Map) (map[string]uint64, perfBufferCounters, error) {
+	perEvent := map[string]uint64{}
+	counters := make(perfBufferCounters)
+
+	// loop through all the values of the active buffer
+	if err := pbm.dumpStatsMap(statsMap, func(id uint32, cpuStats []PerfMapStats) error {
+		return pbm.processKernelStats(perfMapName, id, cpuStats, counters, perEvent)
+	}); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to dump the statistics buffer of map %s", perfMapName)
+	}
+	// the first collection since the reload of the programs is over
+	if state, found := pbm.kernelStatsResets[perfMapName]; found {
+		atomic.StoreUint32(&state.baselinesReset, 0)
+	}
+	return perEvent, counters, nil
+}
+
+func (pbm *PerfBufferMonitor) collectAndSendKernelStats(client statsd.ClientInterface) error {
+	return pbm.collectAllKernelStats(client, false)
+}
+
+// collectAllKernelStats collects the kernel stats of each perf map. When collectOnly is true, the kernel stats are
+// updated without submitting their counters nor keeping them for the next flush.
+func (pbm *PerfBufferMonitor) collectAllKernelStats(client statsd.ClientInterface, collectOnly bool) error {
+	// loop through the statistics buffers of each perf map
+	for perfMapName, statsMap := range pbm.perfBufferStatsMaps {
+		enabled := pbm.isKernelStatsEnabled(perfMapName)
+		if client != nil {
+			var value float64
+			if enabled {
+				value = 1
+			}
+			_ = client.Gauge(metrics.MetricPerfBufferKernelStatsEnabled, value, []string{fmt.Sprintf("map:%s", perfMapName)}, 1.0)
+		}
+		if !enabled {
+			continue
+		}
+
+		// total and perEvent are used for alerting
+		var perEvent map[string]uint64
+		var err error
+		if collectOnly {
+			perEvent, _, err = pbm.updateKernelStats(perfMapName, statsMap)
+		} else {
+			perEvent, err = pbm.collectKernelStats(client, perfMapName, statsMap)
+		}
+		if err != nil {
 			return err
 		}
-	}
 
+		var total uint64
+		for _, lost := range perEvent {
+			total += lost
+		}
+
+		// send an alert if events were lost
+		if total > 0 {
+			pbm.probe.DispatchCustomEvent(
+				NewEventLostWriteEvent(perfMapName, perEvent),
+			)
+		}
+	}
 	return nil
 }
 
 // SendStats send event stats using the provided statsd client
 func (pbm *PerfBufferMonitor) SendStats() error {
+	// the counts which couldn't be submitted on the previous flushes go first
+	pbm.flushPendingCounts(pbm.statsdClient)
+
+	pbm.sendPerfBufferSizes(pbm.statsdClient)
+	pbm.sendEventTypesMismatch(pbm.statsdClient)
+
 	if err := pbm.collectAndSendKernelStats(pbm.statsdClient); err != nil {
 		return err
 	}
 
+	// the loss rate of the interval is computed from the kernel stats
+	pbm.checkLossDiagnostics(pbm.statsdClient)
+	pbm.sendSLOStats(pbm.statsdClient)
+	if pbm.lossNotifier != nil {
+		pbm.lossNotifier.endInterval()
+	}
+
 	if atomic.SwapUint64(&pbm.shouldBumpGeneration, 0) == 1 {
 		pbm.probe.resolvers.DentryResolver.BumpCacheGenerations()
 	}
 
-	if err := pbm.sendEventsAndBytesReadStats(pbm.statsdClient); err != nil {
+	// the counts are kept when the client fails, the distributions and gauges are lost but don't stop the flush
+	distributionsErr := pbm.sendEventsAndBytesReadStats(pbm.statsdClient)
+	if pbm.throughput != nil {
+		pbm.throughput.endInterval(time.Now())
+	}
+
+	// allow the next sorting error to be logged
+	atomic.StoreUint64(&pbm.sortingErrorLogged, 0)
+
+	droppedByHandler := pbm.sendDroppedByHandlerStats(pbm.statsdClient)
+
+	if err := pbm.sendLostEventsReadStats(pbm.statsdClient, droppedByHandler); err != nil {
 		return err
 	}
+	return distributionsErr
+}
 
-	return pbm.sendLostEventsReadStats(pbm.statsdClient)
+// GetStats returns the sorting errors diagnostics of each perf map and the events dropped by the event handler, as
+// reported in the monitor status
+func (pbm *PerfBufferMonitor) GetStats() map[string]interface{} {
+	perfMaps := make(map[string]interface{})
+	for m, totals := range pbm.sortingErrorTotals {
+		perCPU := make([]int64, len(totals))
+		for cpu := range totals {
+			perCPU[cpu] = atomic.LoadInt64(&totals[cpu])
+		}
+		mapStats := map[string]interface{}{
+			"sorting_errors":       perCPU,
+			"sorting_max_jump_ns":  atomic.LoadUint64(pbm.sortingMaxJumpTotal[m]),
+			"kernel_stats_enabled": pbm.isKernelStatsEnabled(m),
+		}
+		if state, found := pbm.kernelStatsResets[m]; found {
+			mapStats["kernel_stats_underflows"] = atomic.LoadUint64(&state.underflows)
+		}
+		perfMaps[m] = mapStats
+	}
+
+	droppedByHandler := make(map[string]uint64)
+	for eventType := range pbm.droppedByHandlerTotals {
+		if count := atomic.LoadUint64(&pbm.droppedByHandlerTotals[eventType]); count > 0 {
+			droppedByHandler[model.EventType(eventType).String()] = count
+		}
+	}
+
+	stats := map[string]interface{}{
+		"clock_source":       pbm.clockSource,
+		"maps":               perfMaps,
+		"dropped_by_handler": droppedByHandler,
+		"throughput_metrics": pbm.getThroughputMetricsStatus(),
+		"event_types": map[string]interface{}{
+			"kernel":     pbm.kernelMaxEventType,
+			"agent":      uint32(model.MaxEventType),
+			"attributed": pbm.attributedEventTypes(),
+			"mismatch":   pbm.eventTypesMismatch(),
+		},
+	}
+	if pbm.slo != nil {
+		stats["slo"] = pbm.getSLOStatus()
+	}
+	if pbm.lossNotifier != nil {
+		stats["loss_listeners"] = pbm.lossNotifier.getStatus()
+	}
+	if pbm.throughput != nil {
+		stats["throughput_ewma"] = pbm.getThroughputStatus()
+	}
+	return stats
+}
+
+// getThroughputMetricsStatus describes the metrics reporting the read throughput, so that support knows which ones to look at
+func (pbm *PerfBufferMonitor) getThroughputMetricsStatus() map[string]interface{} {
+	status := map[string]interface{}{
+		"mode":  "counts",
+		"count": []string{metrics.MetricPerfBufferEventsRead, metrics.MetricPerfBufferBytesRead},
+	}
+	if !pbm.distributions {
+		return status
+	}
+
+	status["mode"] = "counts_and_distributions"
+	status["distribution"] = []string{metrics.MetricPerfBufferEventsReadPerCPU, metrics.MetricPerfBufferBytesReadPerCPU}
+	if pbm.distributionsPerEventType {
+		status["distribution_tags"] = []string{"map", "event_type"}
+	} else {
+		status["distribution_tags"] = []string{"map"}
+	}
+	return status
 }
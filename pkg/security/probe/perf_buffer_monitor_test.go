@@ -0,0 +1,778 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	manager "github.com/DataDog/ebpf-manager"
+	lib "github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-agent/pkg/security/config"
+	"github.com/DataDog/datadog-agent/pkg/security/metrics"
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+	"github.com/DataDog/datadog-agent/pkg/security/rules"
+	"github.com/DataDog/datadog-agent/pkg/security/utils"
+)
+
+func newTestPerfBufferMonitor(numCPU int, perfMaps ...string) *PerfBufferMonitor {
+	pbm := &PerfBufferMonitor{
+		probe:               &Probe{config: &config.Config{StatsTagsCardinality: "high"}},
+		numCPU:              numCPU,
+		stats:               make(map[string][][model.MaxEventType]PerfMapStats),
+		kernelStats:         make(map[string][][model.MaxEventType]PerfMapStats),
+		kernelStatsResets:   make(map[string]*kernelStatsResetState),
+		readLostEvents:      make(map[string][]uint64),
+		sortingErrorStats:   make(map[string][][model.MaxEventType]int64),
+		sortingErrorTotals:  make(map[string][]int64),
+		sortingMaxJump:      make(map[string]*uint64),
+		sortingMaxJumpTotal: make(map[string]*uint64),
+		perfBufferSize:      make(map[string]float64),
+		clockSource:         "tsc",
+	}
+	for _, m := range perfMaps {
+		pbm.allocateUserSpaceCounters(m)
+	}
+	pbm.allocateStatsBuffers()
+	pbm.dumpStatsMap = pbm.iterateStatsMap
+	return pbm
+}
+
+func TestPerfBufferMonitorSortingErrors(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+
+	pbm.CountEvent(model.FileOpenEventType, 1000, 1, 10, perfMap, 0)
+	pbm.CountEvent(model.ExecEventType, 900, 1, 10, perfMap, 1)
+	pbm.CountEvent(model.ExecEventType, 400, 1, 10, perfMap, 1)
+	pbm.CountEvent(model.FileOpenEventType, 1100, 1, 10, perfMap, 0)
+	pbm.CountEvent(model.FileOpenEventType, 1050, 1, 10, perfMap, 0)
+
+	assert.Equal(t, int64(0), pbm.getAndResetSortingErrorCount(model.FileOpenEventType, "events", 1))
+	assert.Equal(t, int64(1), pbm.getAndResetSortingErrorCount(model.FileOpenEventType, "events", 0))
+	assert.Equal(t, int64(2), pbm.getAndResetSortingErrorCount(model.ExecEventType, "events", 1))
+	assert.Equal(t, uint64(600), *pbm.sortingMaxJump["events"])
+	assert.Equal(t, uint64(600), *pbm.sortingMaxJumpTotal["events"])
+	assert.Equal(t, uint64(1), pbm.sortingErrorLogged)
+	assert.Equal(t, uint64(1), pbm.shouldBumpGeneration)
+
+	stats := pbm.GetStats()
+	assert.Equal(t, "tsc", stats["clock_source"])
+	assert.Equal(t, uint64(600), stats["maps"].(map[string]interface{})["events"].(map[string]interface{})["sorting_max_jump_ns"])
+}
+
+func TestPerfBufferMonitorConcurrentCPUs(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(4, "events")
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+
+	// the events of each cpu are read concurrently, run with -race
+	var wg sync.WaitGroup
+	for cpu := 0; cpu < 4; cpu++ {
+		wg.Add(1)
+		go func(cpu int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				pbm.CountEvent(model.ExecEventType, uint64(1000+i), 1, 10, perfMap, cpu)
+			}
+		}(cpu)
+	}
+	wg.Wait()
+
+	// the last timestamp only moves forward
+	assert.Equal(t, uint64(1999), pbm.lastTimestamp)
+}
+
+// fakeStatsdClient records the counts and distributions submitted by the monitor
+type fakeStatsdClient struct {
+	statsd.ClientInterface
+	counts        map[string]int64
+	countTags     map[string]map[string]int64
+	distributions map[string][]float64
+	gauges        map[string]float64
+}
+
+func newFakeStatsdClient() *fakeStatsdClient {
+	return &fakeStatsdClient{
+		counts:        make(map[string]int64),
+		countTags:     make(map[string]map[string]int64),
+		distributions: make(map[string][]float64),
+		gauges:        make(map[string]float64),
+	}
+}
+
+func (c *fakeStatsdClient) Count(name string, value int64, tags []string, rate float64) error {
+	c.counts[name] += value
+	if c.countTags[name] == nil {
+		c.countTags[name] = make(map[string]int64)
+	}
+	c.countTags[name][strings.Join(tags, "|")] += value
+	return nil
+}
+
+func (c *fakeStatsdClient) Distribution(name string, value float64, tags []string, rate float64) error {
+	key := name
+	for _, tag := range tags[1:] {
+		key += "|" + tag
+	}
+	c.distributions[key] = append(c.distributions[key], value)
+	return nil
+}
+
+func (c *fakeStatsdClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	c.gauges[name+"|"+strings.Join(tags, "|")] = value
+	return nil
+}
+
+func TestPerfBufferMonitorReadDistributions(t *testing.T) {
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+	countEvents := func(pbm *PerfBufferMonitor) {
+		pbm.CountEvent(model.FileOpenEventType, 1000, 1, 10, perfMap, 0)
+		pbm.CountEvent(model.FileOpenEventType, 1001, 2, 20, perfMap, 0)
+		pbm.CountEvent(model.ExecEventType, 1002, 1, 50, perfMap, 0)
+	}
+	eventsKey := metrics.MetricPerfBufferEventsReadPerCPU + "|map:events"
+	bytesKey := metrics.MetricPerfBufferBytesReadPerCPU + "|map:events"
+
+	t.Run("disabled", func(t *testing.T) {
+		pbm := newTestPerfBufferMonitor(2, "events")
+		pbm.probe = &Probe{config: &config.Config{StatsTagsCardinality: "high"}}
+		countEvents(pbm)
+
+		client := newFakeStatsdClient()
+		assert.NoError(t, pbm.sendEventsAndBytesReadStats(client))
+		assert.Equal(t, int64(4), client.counts[metrics.MetricPerfBufferEventsRead])
+		assert.Empty(t, client.distributions)
+		assert.Equal(t, "counts", pbm.GetStats()["throughput_metrics"].(map[string]interface{})["mode"])
+	})
+
+	t.Run("per cpu", func(t *testing.T) {
+		pbm := newTestPerfBufferMonitor(2, "events")
+		pbm.probe = &Probe{config: &config.Config{StatsTagsCardinality: "orchestrator"}}
+		pbm.distributions = true
+		countEvents(pbm)
+
+		client := newFakeStatsdClient()
+		assert.NoError(t, pbm.sendEventsAndBytesReadStats(client))
+		// the counts are unchanged
+		assert.Equal(t, int64(4), client.counts[metrics.MetricPerfBufferEventsRead])
+		assert.Equal(t, int64(80), client.counts[metrics.MetricPerfBufferBytesRead])
+		// the idle CPU reports a zero value
+		assert.ElementsMatch(t, []float64{4, 0}, client.distributions[eventsKey])
+		assert.ElementsMatch(t, []float64{80, 0}, client.distributions[bytesKey])
+		assert.Len(t, client.distributions, 2)
+
+		status := pbm.GetStats()["throughput_metrics"].(map[string]interface{})
+		assert.Equal(t, "counts_and_distributions", status["mode"])
+		assert.Equal(t, []string{"map"}, status["distribution_tags"])
+	})
+
+	t.Run("per event type", func(t *testing.T) {
+		pbm := newTestPerfBufferMonitor(2, "events")
+		pbm.probe = &Probe{config: &config.Config{StatsTagsCardinality: "high"}}
+		pbm.distributions = true
+		pbm.distributionsPerEventType = true
+		countEvents(pbm)
+
+		client := newFakeStatsdClient()
+		assert.NoError(t, pbm.sendEventsAndBytesReadStats(client))
+		openKey := "|event_type:" + model.FileOpenEventType.String()
+		execKey := "|event_type:" + model.ExecEventType.String()
+		assert.Equal(t, []float64{3}, client.distributions[eventsKey+openKey])
+		assert.Equal(t, []float64{30}, client.distributions[bytesKey+openKey])
+		assert.Equal(t, []float64{1}, client.distributions[eventsKey+execKey])
+		assert.Equal(t, []float64{50}, client.distributions[bytesKey+execKey])
+		assert.Len(t, client.distributions, 4)
+
+		status := pbm.GetStats()["throughput_metrics"].(map[string]interface{})
+		assert.Equal(t, []string{"map", "event_type"}, status["distribution_tags"])
+	})
+}
+
+func TestPerfBufferMonitorTagsCardinality(t *testing.T) {
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+	open := "event_type:" + model.FileOpenEventType.String()
+	exec := "event_type:" + model.ExecEventType.String()
+
+	for _, test := range []struct {
+		name            string
+		config          config.Config
+		eventsRead      map[string]int64
+		lostRead        map[string]int64
+		sortingErrors   map[string]int64
+		tagsCardinality string
+	}{
+		{
+			// the tag sets submitted before the perf buffer tags cardinality was introduced, the sorting
+			// errors being always tagged with the cpu
+			name:            "default",
+			config:          config.Config{StatsTagsCardinality: "high"},
+			tagsCardinality: perfBufferTagsLow,
+			eventsRead:      map[string]int64{"high|map:events|" + open: 3, "high|map:events|" + exec: 2},
+			lostRead:        map[string]int64{"high|map:events": 5},
+			sortingErrors:   map[string]int64{"high|map:events|" + exec + "|cpu:1": 1},
+		},
+		{
+			// the counters keep the event type whatever the tags cardinality
+			name:            "low tags cardinality",
+			config:          config.Config{StatsTagsCardinality: "low"},
+			tagsCardinality: perfBufferTagsLow,
+			eventsRead:      map[string]int64{"low|map:events|" + open: 3, "low|map:events|" + exec: 2},
+			lostRead:        map[string]int64{"low|map:events": 5},
+			sortingErrors:   map[string]int64{"low|map:events|" + exec + "|cpu:1": 1},
+		},
+		{
+			name:            "high override",
+			config:          config.Config{StatsTagsCardinality: "high", StatsPerfBufferTagsCardinality: "high"},
+			tagsCardinality: perfBufferTagsHigh,
+			eventsRead: map[string]int64{
+				"high|map:events|" + open + "|cpu:0": 1,
+				"high|map:events|" + open + "|cpu:1": 2,
+				"high|map:events|" + exec + "|cpu:1": 2,
+			},
+			lostRead:      map[string]int64{"high|map:events|cpu:0": 2, "high|map:events|cpu:1": 3},
+			sortingErrors: map[string]int64{"high|map:events|" + exec + "|cpu:1": 1},
+		},
+		{
+			name:            "off override",
+			config:          config.Config{StatsTagsCardinality: "high", StatsPerfBufferTagsCardinality: "off"},
+			tagsCardinality: perfBufferTagsOff,
+			eventsRead:      map[string]int64{"high|map:events": 5},
+			lostRead:        map[string]int64{"high|map:events": 5},
+			sortingErrors:   map[string]int64{"high|map:events|cpu:1": 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.config
+			pbm := newTestPerfBufferMonitor(2, "events")
+			pbm.probe = &Probe{config: &cfg}
+			pbm.tagsCardinality = getPerfBufferTagsCardinality(&cfg)
+			assert.Equal(t, test.tagsCardinality, pbm.tagsCardinality)
+
+			pbm.CountEvent(model.FileOpenEventType, 1000, 1, 10, perfMap, 0)
+			pbm.CountEvent(model.FileOpenEventType, 1001, 2, 20, perfMap, 1)
+			pbm.CountEvent(model.ExecEventType, 1002, 1, 50, perfMap, 1)
+			pbm.CountEvent(model.ExecEventType, 999, 1, 50, perfMap, 1)
+			pbm.CountLostEvent(2, perfMap, 0)
+			pbm.CountLostEvent(3, perfMap, 1)
+
+			client := newFakeStatsdClient()
+			assert.NoError(t, pbm.sendEventsAndBytesReadStats(client))
+			assert.NoError(t, pbm.sendLostEventsReadStats(client, nil))
+			assert.Equal(t, test.eventsRead, client.countTags[metrics.MetricPerfBufferEventsRead])
+			assert.Equal(t, test.lostRead, client.countTags[metrics.MetricPerfBufferLostRead])
+			assert.Equal(t, test.sortingErrors, client.countTags[metrics.MetricPerfBufferSortingError])
+		})
+	}
+}
+
+// fakeEventHandler records the custom events dispatched by the probe
+type fakeEventHandler struct {
+	customEvents []*CustomEvent
+}
+
+func (h *fakeEventHandler) HandleEvent(event *Event) {}
+
+func (h *fakeEventHandler) HandleCustomEvent(rule *rules.Rule, event *CustomEvent) {
+	h.customEvents = append(h.customEvents, event)
+}
+
+func TestPerfBufferMonitorDroppedByHandler(t *testing.T) {
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+	handler := &fakeEventHandler{}
+	pbm := newTestPerfBufferMonitor(2, "events")
+	pbm.probe = &Probe{
+		config:  &config.Config{StatsTagsCardinality: "high", AgentMonitoringEvents: true},
+		perfMap: perfMap,
+		handler: handler,
+	}
+	pbm.tagsCardinality = perfBufferTagsLow
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				pbm.CountDroppedByHandler(model.ExecEventType, 1)
+			} else {
+				pbm.CountDroppedByHandler(model.FileOpenEventType, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// out of range event types are ignored
+	pbm.CountDroppedByHandler(model.MaxEventType, 1)
+
+	client := newFakeStatsdClient()
+	dropped := pbm.sendDroppedByHandlerStats(client)
+	assert.Equal(t, map[string]uint64{model.ExecEventType.String(): 25, model.FileOpenEventType.String(): 75}, dropped)
+	assert.Equal(t, map[string]int64{
+		"high|event_type:" + model.ExecEventType.String():     25,
+		"high|event_type:" + model.FileOpenEventType.String(): 75,
+	}, client.countTags[metrics.MetricPerfBufferDroppedUserspace])
+
+	// the dropped events are reported in the lost events read event of the perf map they were read from
+	assert.NoError(t, pbm.sendLostEventsReadStats(client, dropped))
+	assert.Len(t, handler.customEvents, 1)
+	payload, err := handler.customEvents[0].MarshalJSON()
+	assert.NoError(t, err)
+	var lostRead EventLostRead
+	assert.NoError(t, lostRead.UnmarshalJSON(payload))
+	assert.Equal(t, "events", lostRead.Name)
+	assert.Equal(t, float64(0), lostRead.Lost)
+	assert.Equal(t, dropped, lostRead.DroppedByHandler)
+
+	// the counters are reset on each flush, the status reports the totals
+	pbm.CountDroppedByHandler(model.ExecEventType, 5)
+	dropped = pbm.sendDroppedByHandlerStats(client)
+	assert.Equal(t, map[string]uint64{model.ExecEventType.String(): 5}, dropped)
+	assert.Equal(t, map[string]uint64{model.ExecEventType.String(): 30, model.FileOpenEventType.String(): 75}, pbm.GetStats()["dropped_by_handler"])
+}
+
+// failingStatsdClient fails to submit the counts while failing is set, as when the statsd socket is gone
+type failingStatsdClient struct {
+	*fakeStatsdClient
+	failing bool
+}
+
+func (c *failingStatsdClient) Count(name string, value int64, tags []string, rate float64) error {
+	if c.failing {
+		return errors.New("connection refused")
+	}
+	return c.fakeStatsdClient.Count(name, value, tags, rate)
+}
+
+func TestPerfBufferMonitorPendingCounts(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	pbm.tagsCardinality = perfBufferTagsLow
+	client := &failingStatsdClient{fakeStatsdClient: newFakeStatsdClient(), failing: true}
+	flush := func(client statsd.ClientInterface) {
+		pbm.flushPendingCounts(client)
+		pbm.sendDroppedByHandlerStats(client)
+	}
+
+	// the client fails for several intervals, the counts are kept
+	for i := 0; i < 3; i++ {
+		pbm.CountDroppedByHandler(model.ExecEventType, 10)
+		pbm.CountDroppedByHandler(model.FileOpenEventType, 1)
+		flush(client)
+	}
+	assert.Empty(t, client.counts)
+	assert.Len(t, pbm.pendingCounts, 2)
+
+	// without client, the counts are kept as well
+	pbm.CountDroppedByHandler(model.ExecEventType, 10)
+	flush(nil)
+	assert.Len(t, pbm.pendingCounts, 2)
+
+	// the client recovers, the totals are preserved
+	client.failing = false
+	pbm.CountDroppedByHandler(model.ExecEventType, 10)
+	flush(client)
+	assert.Empty(t, pbm.pendingCounts)
+	assert.Equal(t, map[string]int64{
+		"high|event_type:" + model.ExecEventType.String():     50,
+		"high|event_type:" + model.FileOpenEventType.String(): 3,
+	}, client.countTags[metrics.MetricPerfBufferDroppedUserspace])
+	assert.NotContains(t, client.counts, metrics.MetricPerfBufferStatsDropped)
+}
+
+func TestPerfBufferMonitorPendingCountsBounded(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	client := &failingStatsdClient{fakeStatsdClient: newFakeStatsdClient(), failing: true}
+
+	for i := 0; i < maxPendingCounts+10; i++ {
+		pbm.sendCount(client, metrics.MetricPerfBufferEventsRead, 1, []string{"high", fmt.Sprintf("cpu:%d", i)})
+	}
+	// the counts of the tag sets already kept are still added
+	pbm.sendCount(client, metrics.MetricPerfBufferEventsRead, 1, []string{"high", "cpu:0"})
+	assert.Len(t, pbm.pendingCounts, maxPendingCounts)
+	assert.Equal(t, int64(10), pbm.droppedCounts)
+
+	// the dropped counts are reported once the client recovers
+	client.failing = false
+	pbm.flushPendingCounts(client)
+	assert.Empty(t, pbm.pendingCounts)
+	assert.Equal(t, int64(maxPendingCounts+1), client.counts[metrics.MetricPerfBufferEventsRead])
+	assert.Equal(t, int64(2), client.countTags[metrics.MetricPerfBufferEventsRead]["high|cpu:0"])
+	assert.Equal(t, int64(10), client.counts[metrics.MetricPerfBufferStatsDropped])
+	assert.Equal(t, int64(0), pbm.droppedCounts)
+}
+
+// fakeStatsMap holds the per cpu values of a statistics map, indexed by key
+type fakeStatsMap map[uint32][]PerfMapStats
+
+func (m fakeStatsMap) dump(_ *lib.Map, walkFn statsMapWalkFunc) error {
+	for id := uint32(0); id < uint32(len(m)); id++ {
+		if err := walkFn(id, m[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPerfBufferMonitorCollectKernelStats(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	statsMap := fakeStatsMap{
+		0: {{Count: 100}, {Count: 100}},
+		1: {{Bytes: 100, Count: 10, Lost: 1}, {Bytes: 200, Count: 20}},
+		2: {{Bytes: 300, Count: 30}, {Bytes: 400, Count: 40, Lost: 4}},
+	}
+	pbm.dumpStatsMap = statsMap.dump
+	perEvent, err := pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{model.EventType(1).String(): 1, model.EventType(2).String(): 4}, perEvent)
+	assert.Equal(t, PerfMapStats{Bytes: 100, Count: 10, Lost: 1}, pbm.kernelStats["events"][0][1])
+	assert.Equal(t, PerfMapStats{Bytes: 400, Count: 40, Lost: 4}, pbm.kernelStats["events"][1][2])
+	// the first key doesn't match any event type
+	assert.Equal(t, PerfMapStats{}, pbm.kernelStats["events"][0][0])
+
+	// only the new lost events are reported
+	statsMap[2][1].Lost = 6
+	perEvent, err = pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{model.EventType(1).String(): 0, model.EventType(2).String(): 2}, perEvent)
+	assert.Equal(t, PerfMapStats{Bytes: 400, Count: 40, Lost: 6}, pbm.kernelStats["events"][1][2])
+
+	// unknown perf maps are ignored
+	perEvent, err = pbm.collectKernelStats(nil, "unknown", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, perEvent)
+}
+
+func TestPerfBufferMonitorGetAndResetKernelLostCount(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	pbm.perfBufferStatsMaps = map[string]*lib.Map{"events": nil}
+	pbm.kernelStatsEnabled = make(map[string]*uint32)
+	pbm.selectKernelStatsMaps(nil)
+	statsMap := fakeStatsMap{
+		0: {{}, {}},
+		1: {{Bytes: 100, Count: 10}, {Bytes: 200, Count: 20}},
+	}
+	pbm.dumpStatsMap = statsMap.dump
+
+	// the kernel stats are updated, but the counters read aren't kept for the next flush
+	assert.Equal(t, uint64(0), pbm.GetAndResetKernelLostCount("events", -1))
+	assert.Equal(t, PerfMapStats{Bytes: 200, Count: 20}, pbm.kernelStats["events"][1][1])
+	assert.Empty(t, pbm.pendingCounts)
+
+	// the next flush only submits the increase since then
+	statsMap[1][0].Count = 15
+	client := newFakeStatsdClient()
+	assert.NoError(t, pbm.collectAndSendKernelStats(client))
+	assert.Empty(t, pbm.pendingCounts)
+	assert.Equal(t, int64(5), client.counts[metrics.MetricPerfBufferEventsWrite])
+}
+
+func TestPerfBufferMonitorKernelStatsUnderflow(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	statsMap := fakeStatsMap{
+		1: {{Bytes: 1000, Count: 100, Lost: 10}},
+	}
+	pbm.dumpStatsMap = statsMap.dump
+	_, err := pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+
+	// the statistics map was cleared, the new values are the counts since then
+	statsMap[1][0] = PerfMapStats{Bytes: 300, Count: 30, Lost: 3}
+	perEvent, err := pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{model.EventType(1).String(): 3}, perEvent)
+	assert.Equal(t, PerfMapStats{Bytes: 300, Count: 30, Lost: 3}, pbm.kernelStats["events"][0][1])
+	assert.Equal(t, uint64(3), pbm.kernelStatsResets["events"].underflows)
+	assert.Equal(t, uint32(1), pbm.kernelStatsResets["events"].underflowLogged)
+
+	// the next collection reports the increase as usual
+	statsMap[1][0] = PerfMapStats{Bytes: 400, Count: 40, Lost: 5}
+	perEvent, err = pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{model.EventType(1).String(): 2}, perEvent)
+	assert.Equal(t, uint64(3), pbm.kernelStatsResets["events"].underflows)
+
+	// the underflows following a reload of the programs are expected, and the next unexpected one is logged again
+	pbm.ResetKernelBaselines()
+	assert.Equal(t, uint32(0), pbm.kernelStatsResets["events"].underflowLogged)
+	statsMap[1][0] = PerfMapStats{Bytes: 100, Count: 10, Lost: 1}
+	perEvent, err = pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{model.EventType(1).String(): 1}, perEvent)
+	assert.Equal(t, uint64(6), pbm.kernelStatsResets["events"].underflows)
+	assert.Equal(t, uint32(0), pbm.kernelStatsResets["events"].underflowLogged)
+	assert.Equal(t, uint32(0), pbm.kernelStatsResets["events"].baselinesReset)
+
+	assert.Equal(t, uint64(6), pbm.GetStats()["maps"].(map[string]interface{})["events"].(map[string]interface{})["kernel_stats_underflows"])
+}
+
+func TestPerfBufferMonitorKernelStatsWraparound(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	statsMap := fakeStatsMap{
+		1: {{Bytes: math.MaxUint64 - 9, Count: math.MaxUint64, Lost: 5}},
+	}
+	pbm.dumpStatsMap = statsMap.dump
+	_, err := pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+
+	// the counters wrapped around, their increase goes through the max uint64
+	statsMap[1][0] = PerfMapStats{Bytes: 20, Count: 4, Lost: 5}
+	_, err = pbm.collectKernelStats(nil, "events", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), pbm.kernelStatsResets["events"].underflows)
+
+	delta, underflow := kernelStatsDelta(math.MaxUint64-9, 20)
+	assert.Equal(t, uint64(30), delta)
+	assert.False(t, underflow)
+	delta, underflow = kernelStatsDelta(math.MaxUint64, 4)
+	assert.Equal(t, uint64(5), delta)
+	assert.False(t, underflow)
+	delta, underflow = kernelStatsDelta(1000, 300)
+	assert.Equal(t, uint64(300), delta)
+	assert.True(t, underflow)
+}
+
+func TestPerfBufferMonitorEventTypesMismatch(t *testing.T) {
+	maxEventType := uint32(model.MaxEventType)
+	for _, tc := range []struct {
+		name               string
+		kernelMaxEventType uint32
+		attributed         uint32
+		mismatch           bool
+	}{
+		{name: "equal", kernelMaxEventType: maxEventType, attributed: maxEventType},
+		{name: "kernel smaller", kernelMaxEventType: maxEventType - 2, attributed: maxEventType - 2, mismatch: true},
+		{name: "kernel larger", kernelMaxEventType: maxEventType + 3, attributed: maxEventType, mismatch: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pbm := newTestPerfBufferMonitor(1, "events")
+			pbm.kernelMaxEventType = tc.kernelMaxEventType
+			pbm.checkKernelEventTypes()
+			assert.Equal(t, tc.attributed, pbm.attributedEventTypes())
+			assert.Equal(t, tc.mismatch, pbm.CheckEventTypes() != nil)
+
+			// the kernel reports as many lost events as the id of each entry of the statistics map
+			statsMap := fakeStatsMap{}
+			for id := uint32(0); id < tc.kernelMaxEventType; id++ {
+				statsMap[id] = []PerfMapStats{{Count: 10, Lost: uint64(id)}}
+			}
+			pbm.dumpStatsMap = statsMap.dump
+			expected := make(map[string]uint64)
+			for id := uint32(1); id < tc.kernelMaxEventType; id++ {
+				if id < tc.attributed {
+					expected[model.EventType(id).String()] += uint64(id)
+				} else {
+					expected[model.UnknownEventType.String()] += uint64(id)
+				}
+			}
+			perEvent, err := pbm.collectKernelStats(nil, "events", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, perEvent)
+
+			// the entries which aren't attributed keep their own values, they don't alias the other event types
+			for id := range statsMap {
+				statsMap[id][0].Lost++
+			}
+			perEvent, err = pbm.collectKernelStats(nil, "events", nil)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(tc.kernelMaxEventType-tc.attributed), perEvent[model.UnknownEventType.String()])
+			for id := uint32(1); id < tc.attributed; id++ {
+				assert.Equal(t, uint64(id)+1, pbm.kernelStats["events"][0][id].Lost)
+			}
+			assert.Equal(t, uint64(0), pbm.kernelStatsResets["events"].underflows)
+
+			client := newFakeStatsdClient()
+			pbm.sendEventTypesMismatch(client)
+			expectedGauge := 0.0
+			if tc.mismatch {
+				expectedGauge = 1
+			}
+			assert.Equal(t, expectedGauge, client.gauges[metrics.MetricPerfBufferEventTypesMismatch+"|"])
+			assert.Equal(t, tc.mismatch, pbm.GetStats()["event_types"].(map[string]interface{})["mismatch"])
+		})
+	}
+
+	// the event types are attributed as usual until the eBPF programs are read
+	pbm := newTestPerfBufferMonitor(1, "events")
+	assert.Equal(t, maxEventType, pbm.attributedEventTypes())
+	assert.NoError(t, pbm.CheckEventTypes())
+	client := newFakeStatsdClient()
+	pbm.sendEventTypesMismatch(client)
+	assert.Empty(t, client.gauges)
+}
+
+// newBenchmarkStatsMap creates a statistics map with 60 event types, it requires the privileges to create eBPF maps
+func newBenchmarkStatsMap(b *testing.B, numCPU int) *lib.Map {
+	statsMap, err := lib.NewMap(&lib.MapSpec{
+		Type:       lib.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  24,
+		MaxEntries: 60,
+	})
+	if err != nil {
+		b.Skipf("couldn't create the statistics map: %v", err)
+	}
+
+	values := make([]PerfMapStats, numCPU)
+	for id := uint32(0); id < 60; id++ {
+		for cpu := range values {
+			values[cpu] = PerfMapStats{Bytes: uint64(id) * 100, Count: uint64(id), Lost: uint64(cpu)}
+		}
+		if err := statsMap.Put(id, values); err != nil {
+			b.Skipf("couldn't fill the statistics map: %v", err)
+		}
+	}
+	return statsMap
+}
+
+func BenchmarkPerfBufferMonitorCollectKernelStats(b *testing.B) {
+	numCPU, err := utils.NumCPU()
+	if err != nil {
+		b.Skipf("couldn't fetch the CPU count: %v", err)
+	}
+	statsMap := newBenchmarkStatsMap(b, numCPU)
+	defer statsMap.Close()
+
+	for _, bench := range []struct {
+		name  string
+		batch bool
+	}{
+		{name: "iterator"},
+		{name: "batch", batch: true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			pbm := newTestPerfBufferMonitor(numCPU, "events")
+			if bench.batch {
+				pbm.dumpStatsMap = pbm.batchLookupStatsMap
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := pbm.collectKernelStats(nil, "events", statsMap); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPerfBufferMonitorKernelStatsEnabled(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events", "mountpoints_events")
+	pbm.perfBufferStatsMaps = map[string]*lib.Map{"events": nil, "mountpoints_events": nil}
+	pbm.kernelStatsEnabled = make(map[string]*uint32)
+	var dumps int
+	pbm.dumpStatsMap = func(_ *lib.Map, walkFn statsMapWalkFunc) error {
+		dumps++
+		return nil
+	}
+
+	// only the selected perf maps are collected
+	pbm.selectKernelStatsMaps([]string{"events"})
+	client := newFakeStatsdClient()
+	assert.NoError(t, pbm.collectAndSendKernelStats(client))
+	assert.Equal(t, 1, dumps)
+	assert.Equal(t, 1.0, client.gauges[metrics.MetricPerfBufferKernelStatsEnabled+"|map:events"])
+	assert.Equal(t, 0.0, client.gauges[metrics.MetricPerfBufferKernelStatsEnabled+"|map:mountpoints_events"])
+
+	// the change takes effect on the next flush
+	assert.NoError(t, pbm.SetKernelStatsEnabled("events", false))
+	assert.NoError(t, pbm.SetKernelStatsEnabled("mountpoints_events", true))
+	assert.NoError(t, pbm.collectAndSendKernelStats(client))
+	assert.Equal(t, 2, dumps)
+	assert.Equal(t, 0.0, client.gauges[metrics.MetricPerfBufferKernelStatsEnabled+"|map:events"])
+	assert.Equal(t, 1.0, client.gauges[metrics.MetricPerfBufferKernelStatsEnabled+"|map:mountpoints_events"])
+	assert.Equal(t, false, pbm.GetStats()["maps"].(map[string]interface{})["events"].(map[string]interface{})["kernel_stats_enabled"])
+
+	assert.Error(t, pbm.SetKernelStatsEnabled("unknown", true))
+
+	// all the perf maps are collected by default
+	pbm.selectKernelStatsMaps(nil)
+	assert.NoError(t, pbm.collectAndSendKernelStats(client))
+	assert.Equal(t, 4, dumps)
+}
+
+func TestPerfBufferMonitorSizeGauges(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events", "custom")
+	pbm.perfBufferMapNameToStatsMapsName = map[string]string{"events": "events_stats", "custom": "custom_stats"}
+	pbm.setPerfBufferSizes(8*4096, []*manager.PerfMap{
+		{Map: manager.Map{Name: "events"}},
+		{Map: manager.Map{Name: "custom"}, PerfMapOptions: manager.PerfMapOptions{PerfRingBufferSize: 256 * 4096}},
+	})
+	assert.Equal(t, "custom=1048576 events=32768", pbm.describePerfBufferSizes())
+
+	client := newFakeStatsdClient()
+	pbm.sendPerfBufferSizes(client)
+	assert.Equal(t, map[string]float64{
+		metrics.MetricPerfBufferSizeBytes + "|map:events": 8 * 4096,
+		metrics.MetricPerfBufferSizeBytes + "|map:custom": 256 * 4096,
+	}, client.gauges)
+
+	// a resized perf map is reported with its new size on the next flush
+	pbm.perfBufferSize["custom"] = 512 * 4096
+	pbm.sendPerfBufferSizes(client)
+	assert.Equal(t, float64(512*4096), client.gauges[metrics.MetricPerfBufferSizeBytes+"|map:custom"])
+}
+
+// fakeStatsMapGetter holds the maps of a fake eBPF manager, by name
+type fakeStatsMapGetter map[string]*lib.Map
+
+func (m fakeStatsMapGetter) GetMap(name string) (*lib.Map, bool, error) {
+	statsMap, found := m[name]
+	return statsMap, found, nil
+}
+
+func TestPerfBufferMonitorSelectStatsMaps(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events", "mountpoints_events", "activity_dumps")
+	pbm.perfBufferStatsMaps = make(map[string]*lib.Map)
+	pbm.perfBufferMapNameToStatsMapsName = make(map[string]string)
+	pbm.statsMapsNameToPerfBufferMapName = make(map[string]string)
+	pbm.kernelStatsEnabled = make(map[string]*uint32)
+
+	eventsStats, mountStats, conventionalMountStats := &lib.Map{}, &lib.Map{}, &lib.Map{}
+	maps := fakeStatsMapGetter{
+		"events_stats":             eventsStats,
+		"mount_stats":              mountStats,
+		"mountpoints_events_stats": conventionalMountStats,
+	}
+	perfMaps := []*manager.PerfMap{
+		{Map: manager.Map{Name: "events"}},
+		{Map: manager.Map{Name: "mountpoints_events"}},
+		{Map: manager.Map{Name: "activity_dumps"}},
+	}
+	assert.NoError(t, pbm.selectStatsMaps(maps, perfMaps, map[string]string{"mountpoints_events": "mount_stats"}))
+
+	// the statistics map following the naming convention is discovered, the explicit mapping has precedence over it,
+	// and the perf map without a statistics map isn't monitored by the kernel
+	assert.Equal(t, map[string]*lib.Map{"events": eventsStats, "mountpoints_events": mountStats}, pbm.perfBufferStatsMaps)
+	assert.Equal(t, map[string]string{"events": "events_stats", "mountpoints_events": "mount_stats"}, pbm.perfBufferMapNameToStatsMapsName)
+	assert.Equal(t, map[string]string{"events_stats": "events", "mount_stats": "mountpoints_events"}, pbm.statsMapsNameToPerfBufferMapName)
+
+	// the kernel stats of the discovered statistics maps are collected
+	dumped := make(map[*lib.Map]int)
+	pbm.dumpStatsMap = func(statsMap *lib.Map, _ statsMapWalkFunc) error {
+		dumped[statsMap]++
+		return nil
+	}
+	pbm.selectKernelStatsMaps(nil)
+	assert.NoError(t, pbm.collectAndSendKernelStats(newFakeStatsdClient()))
+	assert.Equal(t, map[*lib.Map]int{eventsStats: 1, mountStats: 1}, dumped)
+
+	// the perf map without a statistics map still gets the user space counters
+	activityDumps := perfMaps[2]
+	pbm.CountEvent(model.FileOpenEventType, 1000, 3, 30, activityDumps, 1)
+	pbm.CountLostEvent(2, activityDumps, 1)
+	assert.Equal(t, uint64(3), pbm.getEventCount(model.FileOpenEventType, "activity_dumps", 1))
+	assert.Equal(t, uint64(2), pbm.getLostCount("activity_dumps", 1))
+
+	// an explicitly mapped statistics map must exist
+	assert.Error(t, pbm.selectStatsMaps(maps, perfMaps, map[string]string{"activity_dumps": "unknown_stats"}))
+}
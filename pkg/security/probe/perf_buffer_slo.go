@@ -0,0 +1,206 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+
+	"github.com/DataDog/datadog-agent/pkg/security/metrics"
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// maxPerfBufferSLOIntervals bounds the number of stats intervals the SLO windows are computed on
+const maxPerfBufferSLOIntervals = 4096
+
+// perfBufferSLOStatus is the state of the loss SLO of an event type, as reported in the monitor status
+type perfBufferSLOStatus struct {
+	EventType string  `json:"event_type"`
+	Target    float64 `json:"target"`
+	// ShortLossRatio and LongLossRatio are the ratios of events lost over the events written and lost during the
+	// short and the long windows
+	ShortLossRatio float64 `json:"short_loss_ratio"`
+	LongLossRatio  float64 `json:"long_loss_ratio"`
+	// ShortBurnRate and LongBurnRate are the loss ratios of the windows over the target, the SLO is consumed faster
+	// than allowed above 1
+	ShortBurnRate float64 `json:"short_burn_rate"`
+	LongBurnRate  float64 `json:"long_burn_rate"`
+	// Breached is true when the loss ratio of the long window exceeds the target
+	Breached bool `json:"breached"`
+}
+
+// perfBufferSLOTracker tracks the loss ratio of the event types with a loss target over a short and a long rolling
+// window. The windows are made of the event type mix of the last stats intervals, kept in a fixed size ring so that
+// they don't depend on the counters reset on each flush.
+type perfBufferSLOTracker struct {
+	sync.Mutex
+	// eventTypes are the tracked event types, sorted, and targets their target loss ratio
+	eventTypes []model.EventType
+	targets    []float64
+	// index maps a tracked event type to its position in eventTypes
+	index map[model.EventType]int
+	// shortIntervals and longIntervals are the number of stats intervals of each window
+	shortIntervals int
+	longIntervals  int
+	// current accumulates the event type mix of the current stats interval
+	current []eventTypeMix
+	// intervals holds the event type mix of the last stats intervals, next being the oldest one once it is full
+	intervals [][]eventTypeMix
+	next      int
+}
+
+// newPerfBufferSLOTracker returns a tracker of the loss targets by event type, nil when there are none. The windows
+// are rounded up to a number of stats intervals.
+func newPerfBufferSLOTracker(targets map[model.EventType]float64, statsInterval, shortWindow, longWindow time.Duration) *perfBufferSLOTracker {
+	if len(targets) == 0 || statsInterval <= 0 {
+		return nil
+	}
+
+	t := &perfBufferSLOTracker{
+		index:          make(map[model.EventType]int, len(targets)),
+		shortIntervals: windowIntervals(shortWindow, statsInterval),
+		longIntervals:  windowIntervals(longWindow, statsInterval),
+	}
+	if t.shortIntervals > t.longIntervals {
+		t.shortIntervals = t.longIntervals
+	}
+	for eventType := range targets {
+		t.eventTypes = append(t.eventTypes, eventType)
+	}
+	sort.Slice(t.eventTypes, func(i, j int) bool { return t.eventTypes[i] < t.eventTypes[j] })
+	for i, eventType := range t.eventTypes {
+		t.index[eventType] = i
+		t.targets = append(t.targets, targets[eventType])
+	}
+	t.current = make([]eventTypeMix, len(t.eventTypes))
+	t.intervals = make([][]eventTypeMix, 0, t.longIntervals)
+	return t
+}
+
+// windowIntervals returns the number of stats intervals covering a window, within the bounds of the ring
+func windowIntervals(window time.Duration, statsInterval time.Duration) int {
+	intervals := int((window + statsInterval - 1) / statsInterval)
+	if intervals < 1 {
+		return 1
+	}
+	if intervals > maxPerfBufferSLOIntervals {
+		return maxPerfBufferSLOIntervals
+	}
+	return intervals
+}
+
+// countKernelStats adds the events written and lost by the kernel for an event type to the current interval
+func (t *perfBufferSLOTracker) countKernelStats(eventType model.EventType, written uint64, lost uint64) {
+	i, tracked := t.index[eventType]
+	if !tracked || (written == 0 && lost == 0) {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.current[i].Written += written
+	t.current[i].Lost += lost
+}
+
+// endInterval adds the current interval to the windows, dropping the oldest one once the long window is full, and
+// returns the state of the SLO of each event type
+func (t *perfBufferSLOTracker) endInterval() []perfBufferSLOStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.intervals) < t.longIntervals {
+		t.intervals = append(t.intervals, t.current)
+	} else {
+		t.intervals[t.next] = t.current
+		t.next = (t.next + 1) % t.longIntervals
+	}
+	t.current = make([]eventTypeMix, len(t.eventTypes))
+
+	statuses := make([]perfBufferSLOStatus, 0, len(t.eventTypes))
+	for i, eventType := range t.eventTypes {
+		status := perfBufferSLOStatus{
+			EventType:      eventType.String(),
+			Target:         t.targets[i],
+			ShortLossRatio: t.lossRatio(i, t.shortIntervals),
+			LongLossRatio:  t.lossRatio(i, t.longIntervals),
+		}
+		status.ShortBurnRate = status.ShortLossRatio / status.Target
+		status.LongBurnRate = status.LongLossRatio / status.Target
+		status.Breached = status.LongLossRatio > status.Target
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// lossRatio returns the loss ratio of an event type over the last intervals, it must be called with the lock held
+func (t *perfBufferSLOTracker) lossRatio(i int, intervals int) float64 {
+	if intervals > len(t.intervals) {
+		intervals = len(t.intervals)
+	}
+	var written, lost uint64
+	// the newest interval is the one before next
+	for n := 1; n <= intervals; n++ {
+		mix := t.intervals[(t.next-n+len(t.intervals))%len(t.intervals)][i]
+		written += mix.Written
+		lost += mix.Lost
+	}
+	if lost == 0 {
+		return 0
+	}
+	return float64(lost) / float64(written+lost)
+}
+
+// getPerfBufferSLOTargets returns the loss targets of the configured event types, the unknown event types are ignored
+func getPerfBufferSLOTargets(targets map[string]float64) map[model.EventType]float64 {
+	eventTypes := make(map[model.EventType]float64, len(targets))
+	for name, target := range targets {
+		eventType := model.ParseEvalEventType(name)
+		if eventType == model.UnknownEventType {
+			log.Errorf("ignoring the perf buffer SLO of the unknown event type %s", name)
+			continue
+		}
+		eventTypes[eventType] = target
+	}
+	return eventTypes
+}
+
+// sendSLOStats ends the SLO interval and sends the burn rates of the windows and whether each SLO is breached
+func (pbm *PerfBufferMonitor) sendSLOStats(client statsd.ClientInterface) {
+	if pbm.slo == nil {
+		return
+	}
+	statuses := pbm.slo.endInterval()
+
+	pbm.sloStatusLock.Lock()
+	pbm.sloStatus = statuses
+	pbm.sloStatusLock.Unlock()
+
+	if client == nil {
+		return
+	}
+	for _, status := range statuses {
+		eventTypeTag := "event_type:" + status.EventType
+		_ = client.Gauge(metrics.MetricPerfBufferSLOBurnRate, status.ShortBurnRate, []string{eventTypeTag, "window:short"}, 1.0)
+		_ = client.Gauge(metrics.MetricPerfBufferSLOBurnRate, status.LongBurnRate, []string{eventTypeTag, "window:long"}, 1.0)
+		var breached float64
+		if status.Breached {
+			breached = 1
+		}
+		_ = client.Gauge(metrics.MetricPerfBufferSLOBreached, breached, []string{eventTypeTag}, 1.0)
+	}
+}
+
+// getSLOStatus returns the state of the SLOs as of the last flush, nil when no SLO is configured
+func (pbm *PerfBufferMonitor) getSLOStatus() []perfBufferSLOStatus {
+	pbm.sloStatusLock.Lock()
+	defer pbm.sloStatusLock.Unlock()
+	return pbm.sloStatus
+}
@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/security/metrics"
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+func TestPerfBufferSLOTrackerWindows(t *testing.T) {
+	// the windows hold 2 and 4 intervals of 20s
+	tracker := newPerfBufferSLOTracker(map[model.EventType]float64{model.ExecEventType: 0.01}, 20*time.Second, 30*time.Second, 80*time.Second)
+	require.NotNil(t, tracker)
+	assert.Equal(t, 2, tracker.shortIntervals)
+	assert.Equal(t, 4, tracker.longIntervals)
+
+	// the untracked event types aren't counted
+	tracker.countKernelStats(model.ExecEventType, 990, 10)
+	tracker.countKernelStats(model.FileOpenEventType, 0, 1000)
+	statuses := tracker.endInterval()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "exec", statuses[0].EventType)
+	assert.InDelta(t, 0.01, statuses[0].ShortLossRatio, 1e-9)
+	assert.InDelta(t, 1, statuses[0].ShortBurnRate, 1e-9)
+	assert.False(t, statuses[0].Breached)
+
+	tracker.countKernelStats(model.ExecEventType, 970, 30)
+	statuses = tracker.endInterval()
+	assert.InDelta(t, 0.02, statuses[0].ShortLossRatio, 1e-9)
+	assert.InDelta(t, 0.02, statuses[0].LongLossRatio, 1e-9)
+	assert.InDelta(t, 2, statuses[0].LongBurnRate, 1e-9)
+	assert.True(t, statuses[0].Breached)
+
+	// the lossy intervals leave the short window first, then the long window
+	for i := 0; i < 2; i++ {
+		tracker.countKernelStats(model.ExecEventType, 1000, 0)
+		statuses = tracker.endInterval()
+	}
+	assert.Equal(t, 0.0, statuses[0].ShortLossRatio)
+	assert.InDelta(t, 0.01, statuses[0].LongLossRatio, 1e-9)
+	assert.False(t, statuses[0].Breached)
+
+	for i := 0; i < 2; i++ {
+		tracker.countKernelStats(model.ExecEventType, 1000, 0)
+		statuses = tracker.endInterval()
+	}
+	assert.Equal(t, 0.0, statuses[0].LongLossRatio)
+	assert.Equal(t, 0.0, statuses[0].LongBurnRate)
+	// the ring doesn't grow past the long window
+	assert.Len(t, tracker.intervals, 4)
+}
+
+func TestPerfBufferSLOTrackerDisabled(t *testing.T) {
+	assert.Nil(t, newPerfBufferSLOTracker(nil, 20*time.Second, time.Minute, time.Hour))
+	assert.Nil(t, newPerfBufferSLOTracker(map[model.EventType]float64{model.ExecEventType: 0.01}, 0, time.Minute, time.Hour))
+}
+
+func TestPerfBufferSLOTrackerBoundedWindow(t *testing.T) {
+	tracker := newPerfBufferSLOTracker(map[model.EventType]float64{model.ExecEventType: 0.01}, time.Second, 2*time.Hour, 24*time.Hour)
+	assert.Equal(t, maxPerfBufferSLOIntervals, tracker.longIntervals)
+	assert.Equal(t, maxPerfBufferSLOIntervals, tracker.shortIntervals)
+}
+
+func TestGetPerfBufferSLOTargets(t *testing.T) {
+	targets := getPerfBufferSLOTargets(map[string]float64{"exec": 0.001, "open": 0.01, "unknown_event": 0.1})
+	assert.Equal(t, map[model.EventType]float64{model.ExecEventType: 0.001, model.FileOpenEventType: 0.01}, targets)
+}
+
+func TestPerfBufferMonitorSLOStats(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(1, "events")
+	pbm.slo = newPerfBufferSLOTracker(map[model.EventType]float64{model.ExecEventType: 0.001}, 20*time.Second, 5*time.Minute, time.Hour)
+	client := newFakeStatsdClient()
+
+	assert.NoError(t, pbm.processKernelStats("events", uint32(model.ExecEventType), []PerfMapStats{{Count: 998, Lost: 2}}, make(perfBufferCounters), map[string]uint64{}))
+	pbm.sendSLOStats(client)
+
+	assert.InDelta(t, 2, client.gauges[metrics.MetricPerfBufferSLOBurnRate+"|event_type:exec|window:short"], 1e-9)
+	assert.InDelta(t, 2, client.gauges[metrics.MetricPerfBufferSLOBurnRate+"|event_type:exec|window:long"], 1e-9)
+	assert.Equal(t, 1.0, client.gauges[metrics.MetricPerfBufferSLOBreached+"|event_type:exec"])
+
+	// the counters of the kernel stats are reset on each flush, the windows keep the previous intervals
+	assert.NoError(t, pbm.processKernelStats("events", uint32(model.ExecEventType), []PerfMapStats{{Count: 1998, Lost: 2}}, make(perfBufferCounters), map[string]uint64{}))
+	pbm.sendSLOStats(client)
+	assert.InDelta(t, 1, client.gauges[metrics.MetricPerfBufferSLOBurnRate+"|event_type:exec|window:long"], 1e-9)
+	assert.Equal(t, 0.0, client.gauges[metrics.MetricPerfBufferSLOBreached+"|event_type:exec"])
+
+	status := pbm.GetStats()["slo"].([]perfBufferSLOStatus)
+	require.Len(t, status, 1)
+	assert.Equal(t, 0.001, status[0].Target)
+}
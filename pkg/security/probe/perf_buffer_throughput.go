@@ -0,0 +1,165 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+// ThroughputEWMA is the exponentially weighted moving average of the throughput of an event type read from the perf
+// buffers
+type ThroughputEWMA struct {
+	EventsPerSec float64 `json:"events_per_sec"`
+	BytesPerSec  float64 `json:"bytes_per_sec"`
+}
+
+// perfBufferThroughputTracker computes the moving average of the events and bytes read per second of each event type.
+// The weight of a stats interval depends on its duration, so that a late flush or an idle gap decays the average as
+// much as the intervals it covers would have.
+type perfBufferThroughputTracker struct {
+	sync.RWMutex
+	// halfLife is the time after which the weight of an interval in the average is halved
+	halfLife time.Duration
+	// current accumulates the events and bytes read during the current interval, it is only accessed by the flushes
+	current [model.MaxEventType]PerfMapStats
+	// intervalStart is the start of the current interval
+	intervalStart time.Time
+	// seeded is false until the first interval ends, the averages then start from its throughput
+	seeded bool
+	ewma   [model.MaxEventType]ThroughputEWMA
+}
+
+// newPerfBufferThroughputTracker returns a tracker of the throughput of the event types starting at now, nil when the
+// half-life is not positive
+func newPerfBufferThroughputTracker(halfLife time.Duration, now time.Time) *perfBufferThroughputTracker {
+	if halfLife <= 0 {
+		return nil
+	}
+	return &perfBufferThroughputTracker{
+		halfLife:      halfLife,
+		intervalStart: now,
+	}
+}
+
+// count adds the events and bytes read for an event type to the current interval
+func (t *perfBufferThroughputTracker) count(eventType model.EventType, events uint64, bytes uint64) {
+	if eventType >= model.MaxEventType {
+		return
+	}
+	t.current[eventType].Count += events
+	t.current[eventType].Bytes += bytes
+}
+
+// endInterval ends the current interval at now and updates the averages with its throughput. An interval without
+// duration is merged in the next one.
+func (t *perfBufferThroughputTracker) endInterval(now time.Time) {
+	elapsed := now.Sub(t.intervalStart)
+	if elapsed <= 0 {
+		return
+	}
+	seconds := elapsed.Seconds()
+	// the weight of the previous average after the elapsed time
+	decay := math.Exp2(-seconds / t.halfLife.Seconds())
+
+	t.Lock()
+	for eventType := range t.current {
+		eventsPerSec := float64(t.current[eventType].Count) / seconds
+		bytesPerSec := float64(t.current[eventType].Bytes) / seconds
+		if !t.seeded {
+			t.ewma[eventType] = ThroughputEWMA{EventsPerSec: eventsPerSec, BytesPerSec: bytesPerSec}
+			continue
+		}
+		ewma := &t.ewma[eventType]
+		ewma.EventsPerSec = decay*ewma.EventsPerSec + (1-decay)*eventsPerSec
+		ewma.BytesPerSec = decay*ewma.BytesPerSec + (1-decay)*bytesPerSec
+	}
+	t.seeded = true
+	t.Unlock()
+
+	t.current = [model.MaxEventType]PerfMapStats{}
+	t.intervalStart = now
+}
+
+// get returns the average throughput of an event type
+func (t *perfBufferThroughputTracker) get(eventType model.EventType) ThroughputEWMA {
+	if eventType >= model.MaxEventType {
+		return ThroughputEWMA{}
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return t.ewma[eventType]
+}
+
+// snapshot returns the average throughput of the event types whose average isn't zero
+func (t *perfBufferThroughputTracker) snapshot() map[model.EventType]ThroughputEWMA {
+	t.RLock()
+	defer t.RUnlock()
+	snapshot := make(map[model.EventType]ThroughputEWMA)
+	for eventType, ewma := range t.ewma {
+		if ewma.EventsPerSec > 0 || ewma.BytesPerSec > 0 {
+			snapshot[model.EventType(eventType)] = ewma
+		}
+	}
+	return snapshot
+}
+
+// GetThroughputEWMA returns the moving average of the events and bytes read per second of an event type, as of the
+// last flush. It is zero when the throughput isn't tracked.
+func (pbm *PerfBufferMonitor) GetThroughputEWMA(eventType model.EventType) ThroughputEWMA {
+	if pbm.throughput == nil {
+		return ThroughputEWMA{}
+	}
+	return pbm.throughput.get(eventType)
+}
+
+// GetThroughputEWMASnapshot returns the moving average of the events and bytes read per second of every event type
+// read, as of the last flush. It is nil when the throughput isn't tracked.
+func (pbm *PerfBufferMonitor) GetThroughputEWMASnapshot() map[model.EventType]ThroughputEWMA {
+	if pbm.throughput == nil {
+		return nil
+	}
+	return pbm.throughput.snapshot()
+}
+
+// GetTopThroughputEventTypes returns up to n event types with the highest average number of events read per second,
+// the busiest first
+func (pbm *PerfBufferMonitor) GetTopThroughputEventTypes(n int) []model.EventType {
+	snapshot := pbm.GetThroughputEWMASnapshot()
+	eventTypes := make([]model.EventType, 0, len(snapshot))
+	for eventType := range snapshot {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Slice(eventTypes, func(i, j int) bool {
+		if snapshot[eventTypes[i]].EventsPerSec != snapshot[eventTypes[j]].EventsPerSec {
+			return snapshot[eventTypes[i]].EventsPerSec > snapshot[eventTypes[j]].EventsPerSec
+		}
+		return eventTypes[i] < eventTypes[j]
+	})
+	if n >= 0 && len(eventTypes) > n {
+		eventTypes = eventTypes[:n]
+	}
+	return eventTypes
+}
+
+// getThroughputStatus returns the moving average of the throughput of the event types read, as reported in the
+// monitor status
+func (pbm *PerfBufferMonitor) getThroughputStatus() map[string]interface{} {
+	perEventType := make(map[string]ThroughputEWMA)
+	for eventType, ewma := range pbm.GetThroughputEWMASnapshot() {
+		perEventType[eventType.String()] = ewma
+	}
+	return map[string]interface{}{
+		"half_life":   pbm.throughput.halfLife.String(),
+		"event_types": perEventType,
+	}
+}
@@ -0,0 +1,129 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package probe
+
+import (
+	"testing"
+	"time"
+
+	manager "github.com/DataDog/ebpf-manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/security/model"
+)
+
+func TestPerfBufferThroughputTrackerDecay(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newPerfBufferThroughputTracker(20*time.Second, start)
+	require.NotNil(t, tracker)
+
+	// the first interval seeds the average
+	tracker.count(model.ExecEventType, 2000, 200000)
+	tracker.endInterval(start.Add(20 * time.Second))
+	assert.InDelta(t, 100, tracker.get(model.ExecEventType).EventsPerSec, 1e-9)
+	assert.InDelta(t, 10000, tracker.get(model.ExecEventType).BytesPerSec, 1e-9)
+
+	// an idle interval of one half-life halves it
+	tracker.endInterval(start.Add(40 * time.Second))
+	assert.InDelta(t, 50, tracker.get(model.ExecEventType).EventsPerSec, 1e-9)
+	assert.InDelta(t, 5000, tracker.get(model.ExecEventType).BytesPerSec, 1e-9)
+
+	// an idle gap of three half-lives without any flush decays it as much as three idle intervals
+	tracker.endInterval(start.Add(100 * time.Second))
+	assert.InDelta(t, 6.25, tracker.get(model.ExecEventType).EventsPerSec, 1e-9)
+
+	// the average moves half way to the throughput of an interval of one half-life
+	tracker.count(model.ExecEventType, 20*106.25, 0)
+	tracker.endInterval(start.Add(120 * time.Second))
+	assert.InDelta(t, 56.25, tracker.get(model.ExecEventType).EventsPerSec, 1e-9)
+}
+
+func TestPerfBufferThroughputTrackerTimeWeighted(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	intervals := newPerfBufferThroughputTracker(time.Minute, start)
+	late := newPerfBufferThroughputTracker(time.Minute, start)
+	for _, tracker := range []*perfBufferThroughputTracker{intervals, late} {
+		tracker.count(model.FileOpenEventType, 1000, 0)
+		tracker.endInterval(start.Add(10 * time.Second))
+	}
+
+	// two intervals of 20s at 300 events/s and one late flush of 40s at the same throughput give the same average
+	intervals.count(model.FileOpenEventType, 6000, 0)
+	intervals.endInterval(start.Add(30 * time.Second))
+	intervals.count(model.FileOpenEventType, 6000, 0)
+	intervals.endInterval(start.Add(50 * time.Second))
+	late.count(model.FileOpenEventType, 12000, 0)
+	late.endInterval(start.Add(50 * time.Second))
+	assert.InDelta(t, intervals.get(model.FileOpenEventType).EventsPerSec, late.get(model.FileOpenEventType).EventsPerSec, 1e-9)
+	assert.Greater(t, late.get(model.FileOpenEventType).EventsPerSec, 100.0)
+	assert.Less(t, late.get(model.FileOpenEventType).EventsPerSec, 300.0)
+
+	// the counts of an interval without duration are kept for the next one
+	late.count(model.FileOpenEventType, 6000, 0)
+	late.endInterval(start.Add(50 * time.Second))
+	before := late.get(model.FileOpenEventType).EventsPerSec
+	late.endInterval(start.Add(70 * time.Second))
+	assert.Greater(t, late.get(model.FileOpenEventType).EventsPerSec, before)
+}
+
+func TestPerfBufferThroughputTrackerConverges(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newPerfBufferThroughputTracker(time.Minute, now)
+
+	// the average starts from an idle first interval and converges to a steady throughput
+	now = now.Add(20 * time.Second)
+	tracker.endInterval(now)
+	for i := 0; i < 100; i++ {
+		tracker.count(model.ForkEventType, 20*500, 20*64000)
+		now = now.Add(20 * time.Second)
+		tracker.endInterval(now)
+	}
+	assert.InDelta(t, 500, tracker.get(model.ForkEventType).EventsPerSec, 1e-3)
+	assert.InDelta(t, 64000, tracker.get(model.ForkEventType).BytesPerSec, 1e-1)
+	assert.Equal(t, ThroughputEWMA{}, tracker.get(model.ExecEventType))
+	assert.Equal(t, ThroughputEWMA{}, tracker.get(model.MaxEventType))
+}
+
+func TestPerfBufferThroughputTrackerDisabled(t *testing.T) {
+	assert.Nil(t, newPerfBufferThroughputTracker(0, time.Now()))
+
+	pbm := newTestPerfBufferMonitor(1, "events")
+	assert.Equal(t, ThroughputEWMA{}, pbm.GetThroughputEWMA(model.ExecEventType))
+	assert.Nil(t, pbm.GetThroughputEWMASnapshot())
+	assert.Empty(t, pbm.GetTopThroughputEventTypes(3))
+	assert.NotContains(t, pbm.GetStats(), "throughput_ewma")
+}
+
+func TestPerfBufferMonitorThroughputEWMA(t *testing.T) {
+	pbm := newTestPerfBufferMonitor(2, "events")
+	start := time.Now()
+	pbm.throughput = newPerfBufferThroughputTracker(time.Minute, start)
+
+	// the events read on every cpu are counted
+	perfMap := &manager.PerfMap{Map: manager.Map{Name: "events"}}
+	for i := uint64(0); i < 30; i++ {
+		pbm.CountEvent(model.FileOpenEventType, 1000+i, 1, 100, perfMap, int(i%2))
+	}
+	for i := uint64(0); i < 20; i++ {
+		pbm.CountEvent(model.ExecEventType, 2000+i, 1, 500, perfMap, 0)
+	}
+	pbm.CountEvent(model.ForkEventType, 3000, 1, 100, perfMap, 1)
+	assert.NoError(t, pbm.sendEventsAndBytesReadStats(nil))
+	pbm.throughput.endInterval(start.Add(10 * time.Second))
+
+	assert.InDelta(t, 3, pbm.GetThroughputEWMA(model.FileOpenEventType).EventsPerSec, 1e-9)
+	assert.InDelta(t, 1000, pbm.GetThroughputEWMA(model.ExecEventType).BytesPerSec, 1e-9)
+	assert.Len(t, pbm.GetThroughputEWMASnapshot(), 3)
+	assert.Equal(t, []model.EventType{model.FileOpenEventType, model.ExecEventType}, pbm.GetTopThroughputEventTypes(2))
+	assert.Equal(t, []model.EventType{model.FileOpenEventType, model.ExecEventType, model.ForkEventType}, pbm.GetTopThroughputEventTypes(10))
+
+	status := pbm.GetStats()["throughput_ewma"].(map[string]interface{})
+	assert.Equal(t, "1m0s", status["half_life"])
+	assert.InDelta(t, 2, status["event_types"].(map[string]ThroughputEWMA)["exec"].EventsPerSec, 1e-9)
+}
@@ -291,14 +291,23 @@ func (p *Probe) invalidateDentry(mountID uint32, inode uint64) {
 }
 
 func (p *Probe) handleEvent(CPU uint64, data []byte) {
+	// the events which can't be decoded or aren't supported are dropped, and counted once here
+	if eventType, err := p.processEvent(CPU, data); err != nil {
+		log.Error(err)
+		p.monitor.perfBufferMonitor.CountDroppedByHandler(eventType, 1)
+	}
+}
+
+// processEvent decodes an event read from the perf buffer, updates the resolvers with it and dispatches it. It returns
+// the type of the event, and an error when it was dropped.
+func (p *Probe) processEvent(CPU uint64, data []byte) (model.EventType, error) {
 	offset := 0
 	event := p.zeroEvent()
 	dataLen := uint64(len(data))
 
 	read, err := event.UnmarshalBinary(data)
 	if err != nil {
-		log.Errorf("failed to decode event: %s", err)
-		return
+		return model.UnknownEventType, fmt.Errorf("failed to decode event: %w", err)
 	}
 	offset += read
 
@@ -309,8 +318,7 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 	switch eventType {
 	case model.MountReleasedEventType:
 		if _, err = event.MountReleased.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode mount released event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode mount released event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		// Remove all dentry entries belonging to the mountID
@@ -324,39 +332,35 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		if err = p.resolvers.MountResolver.Delete(event.MountReleased.MountID); err != nil {
 			log.Warnf("failed to delete mount point %d from cache: %s", event.MountReleased.MountID, err)
 		}
-		return
+		return eventType, nil
 	case model.InvalidateDentryEventType:
 		if _, err = event.InvalidateDentry.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode invalidate dentry event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode invalidate dentry event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		p.invalidateDentry(event.InvalidateDentry.MountID, event.InvalidateDentry.Inode)
 
-		return
+		return eventType, nil
 	case model.ArgsEnvsEventType:
 		if _, err = event.ArgsEnvs.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode args envs event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode args envs event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		p.resolvers.ProcessResolver.UpdateArgsEnvs(&event.ArgsEnvs)
 
-		return
+		return eventType, nil
 	}
 
 	read, err = p.unmarshalProcessContainer(data[offset:], event)
 	if err != nil {
-		log.Errorf("failed to decode event `%s`: %s", eventType, err)
-		return
+		return eventType, fmt.Errorf("failed to decode event `%s`: %w", eventType, err)
 	}
 	offset += read
 
 	switch eventType {
 	case model.FileMountEventType:
 		if _, err = event.Mount.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode mount event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode mount event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		// Resolve mount point
@@ -378,23 +382,19 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		p.resolvers.DentryResolver.DelCacheEntries(event.Mount.MountID)
 	case model.FileUmountEventType:
 		if _, err = event.Umount.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode umount event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode umount event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileOpenEventType:
 		if _, err = event.Open.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode open event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode open event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileMkdirEventType:
 		if _, err = event.Mkdir.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode mkdir event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode mkdir event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileRmdirEventType:
 		if _, err = event.Rmdir.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode rmdir event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode rmdir event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		if event.Rmdir.Retval >= 0 {
@@ -403,8 +403,7 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		}
 	case model.FileUnlinkEventType:
 		if _, err = event.Unlink.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode unlink event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode unlink event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		if event.Unlink.Retval >= 0 {
@@ -413,8 +412,7 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		}
 	case model.FileRenameEventType:
 		if _, err = event.Rename.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode rename event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode rename event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		if event.Rename.Retval >= 0 {
@@ -423,38 +421,31 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		}
 	case model.FileChmodEventType:
 		if _, err = event.Chmod.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode chmod event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode chmod event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileChownEventType:
 		if _, err = event.Chown.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode chown event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode chown event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileUtimesEventType:
 		if _, err = event.Utimes.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode utime event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode utime event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileLinkEventType:
 		if _, err = event.Link.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode link event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode link event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileSetXAttrEventType:
 		if _, err = event.SetXAttr.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode setxattr event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode setxattr event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.FileRemoveXAttrEventType:
 		if _, err = event.RemoveXAttr.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode removexattr event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode removexattr event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 	case model.ForkEventType:
 		if _, err = event.UnmarshalProcess(data[offset:]); err != nil {
-			log.Errorf("failed to decode fork event: %s (offset %d, len %d)", err, offset, dataLen)
-			return
+			return eventType, fmt.Errorf("failed to decode fork event: %w (offset %d, len %d)", err, offset, dataLen)
 		}
 
 		p.resolvers.ProcessResolver.ApplyBootTime(event.processCacheEntry)
@@ -463,8 +454,7 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 	case model.ExecEventType:
 		// unmarshal and fill event.processCacheEntry
 		if _, err = event.UnmarshalProcess(data[offset:]); err != nil {
-			log.Errorf("failed to decode exec event: %s (offset %d, len %d)", err, offset, len(data))
-			return
+			return eventType, fmt.Errorf("failed to decode exec event: %w (offset %d, len %d)", err, offset, len(data))
 		}
 		p.resolvers.ProcessResolver.SetProcessArgs(event.processCacheEntry)
 		p.resolvers.ProcessResolver.SetProcessEnvs(event.processCacheEntry)
@@ -489,30 +479,25 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 		defer p.resolvers.ProcessResolver.DeleteEntry(event.ProcessContext.Pid, event.ResolveEventTimestamp())
 	case model.SetuidEventType:
 		if _, err = event.SetUID.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode setuid event: %s (offset %d, len %d)", err, offset, len(data))
-			return
+			return eventType, fmt.Errorf("failed to decode setuid event: %w (offset %d, len %d)", err, offset, len(data))
 		}
 		defer p.resolvers.ProcessResolver.UpdateUID(event.ProcessContext.Pid, event)
 	case model.SetgidEventType:
 		if _, err = event.SetGID.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode setgid event: %s (offset %d, len %d)", err, offset, len(data))
-			return
+			return eventType, fmt.Errorf("failed to decode setgid event: %w (offset %d, len %d)", err, offset, len(data))
 		}
 		defer p.resolvers.ProcessResolver.UpdateGID(event.ProcessContext.Pid, event)
 	case model.CapsetEventType:
 		if _, err = event.Capset.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode capset event: %s (offset %d, len %d)", err, offset, len(data))
-			return
+			return eventType, fmt.Errorf("failed to decode capset event: %w (offset %d, len %d)", err, offset, len(data))
 		}
 		defer p.resolvers.ProcessResolver.UpdateCapset(event.ProcessContext.Pid, event)
 	case model.SELinuxEventType:
 		if _, err = event.SELinux.UnmarshalBinary(data[offset:]); err != nil {
-			log.Errorf("failed to decode selinux event: %s (offset %d, len %d)", err, offset, len(data))
-			return
+			return eventType, fmt.Errorf("failed to decode selinux event: %w (offset %d, len %d)", err, offset, len(data))
 		}
 	default:
-		log.Errorf("unsupported event type %d", eventType)
-		return
+		return eventType, fmt.Errorf("unsupported event type %d", eventType)
 	}
 
 	// resolve event context
@@ -534,6 +519,7 @@ func (p *Probe) handleEvent(CPU uint64, data []byte) {
 
 	// flush exited process
 	p.resolvers.ProcessResolver.DequeueExited()
+	return eventType, nil
 }
 
 // OnRuleMatch is called when a rule matches just before sending
@@ -681,7 +667,15 @@ func (p *Probe) SelectProbes(rs *rules.RuleSet) error {
 		return errors.Wrap(err, "failed to set enabled events")
 	}
 
-	return p.manager.UpdateActivatedProbes(activatedProbes)
+	if err := p.manager.UpdateActivatedProbes(activatedProbes); err != nil {
+		return err
+	}
+
+	// the kernel stats collected next are counted from the reload of the programs
+	if p.monitor != nil && p.monitor.perfBufferMonitor != nil {
+		p.monitor.perfBufferMonitor.ResetKernelBaselines()
+	}
+	return nil
 }
 
 // FlushDiscarders removes all the discarders
@@ -75,10 +75,11 @@ func (m *Monitor) GetPerfBufferMonitor() *PerfBufferMonitor {
 
 // Start triggers the goroutine of all the underlying controllers and monitors of the Monitor
 func (m *Monitor) Start(ctx context.Context, wg *sync.WaitGroup) error {
-	wg.Add(2)
+	wg.Add(3)
 
 	go m.loadController.Start(ctx, wg)
 	go m.reordererMonitor.Start(ctx, wg)
+	go m.perfBufferMonitor.lossNotifier.Start(ctx, wg)
 	return nil
 }
 
@@ -122,7 +123,7 @@ func (m *Monitor) GetStats() (map[string]interface{}, error) {
 	}
 
 	stats["events"] = map[string]interface{}{
-		"perf_buffer": 0,
+		"perf_buffer": m.perfBufferMonitor.GetStats(),
 		"syscalls":    syscalls,
 	}
 	return stats, err
@@ -199,6 +199,8 @@ func (r *ReOrderer) Start(wg *sync.WaitGroup) {
 		case data := <-r.queue:
 			if len(data) > 0 {
 				if cpu, tm, err = r.extractInfo(data); err != nil {
+					// the event can't be ordered, the handler fails to decode it as well and reports it
+					r.handler(cpu, data)
 					continue
 				}
 			} else {
@@ -131,3 +131,35 @@ func TestOrderRate(t *testing.T) {
 
 	cancel()
 }
+
+func TestOrderExtractInfoError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handled := make(chan []byte, 1)
+	reOrderer := NewReOrderer(ctx, func(cpu uint64, data []byte) {
+		handled <- data
+	},
+		ExtractEventInfo,
+		ReOrdererOpts{
+			QueueSize:  100,
+			Rate:       time.Second,
+			Retention:  5,
+			MetricRate: time.Second,
+		})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go reOrderer.Start(&wg)
+	defer cancel()
+
+	// the truncated events are handed to the handler right away, so that it reports them as dropped
+	reOrderer.HandleEvent(0, []byte{1, 2, 3}, nil, nil)
+	select {
+	case data := <-handled:
+		assert.Equal(t, []byte{1, 2, 3}, data)
+	case <-time.After(time.Second):
+		t.Fatal("the truncated event wasn't handled")
+	}
+}
@@ -0,0 +1,24 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build linux
+
+package utils
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+const currentClockSourcePath = "/sys/devices/system/clocksource/clocksource0/current_clocksource"
+
+// ClockSource returns the clock source currently used by the kernel (tsc, hpet, xen ...)
+func ClockSource() (string, error) {
+	data, err := ioutil.ReadFile(currentClockSourcePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,290 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// appsecIntakePath is the path of the appsec events intake behind the appsec proxy of the trace agent
+	appsecIntakePath = "/appsec/proxy/api/v2/appsecevts"
+
+	// appsecProtocolVersion is the version of the batch format of the appsec events
+	appsecProtocolVersion = 1
+
+	// appsecContextVersion is the version of the trace, span and tags contexts of an appsec event
+	appsecContextVersion = "0.1.0"
+
+	// maxPendingAppSecEvents bounds the number of appsec events kept until the next flush
+	maxPendingAppSecEvents = 1000
+
+	// traceIDHeader and parentIDHeader carry the trace context of the invocation the appsec events
+	// of the library belong to
+	traceIDHeader  = "X-Datadog-Trace-Id"
+	parentIDHeader = "X-Datadog-Parent-Id"
+)
+
+// appsecBatch is the payload of the AppSec route, in the batch format of the appsec intake
+type appsecBatch struct {
+	ProtocolVersion int                      `json:"protocol_version"`
+	IdempotencyKey  string                   `json:"idempotency_key"`
+	Events          []map[string]interface{} `json:"events"`
+}
+
+// parseAppSecBatch parses a batch of appsec events, the numbers being kept as is
+func parseAppSecBatch(payload []byte) (appsecBatch, error) {
+	var batch appsecBatch
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&batch); err != nil {
+		return batch, fmt.Errorf("invalid appsec events batch: %v", err)
+	}
+	if batch.ProtocolVersion != appsecProtocolVersion {
+		return batch, fmt.Errorf("unsupported appsec events protocol version %d", batch.ProtocolVersion)
+	}
+	if len(batch.Events) == 0 {
+		return batch, errors.New("no appsec events in the batch")
+	}
+	for _, event := range batch.Events {
+		if event == nil {
+			return batch, errors.New("the appsec events must be JSON objects")
+		}
+	}
+	return batch, nil
+}
+
+// AppSec is the route on which the App & API Protection library running in the function sends
+// its security events, to forward them to the appsec intake on the next flush instead of calling
+// it on its own.
+type AppSec struct {
+	daemon *Daemon
+}
+
+// ServeHTTP - see type AppSec comment.
+// Returns 202 once the events are queued, 413 when the payload is over the max payload size of
+// appsec, 400 when it isn't a valid batch, and 405 when appsec is disabled.
+func (a *AppSec) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	forwarder := a.daemon.appsec
+	if forwarder == nil {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("appsec disabled by configuration"))
+		return
+	}
+	if r.ContentLength > forwarder.maxPayloadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	// one byte more than the max payload size is read to detect the payloads without a content length over it
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, forwarder.maxPayloadSize+1))
+	if err != nil {
+		log.Debugf("Unable to read the appsec events: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > forwarder.maxPayloadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	batch, err := parseAppSecBatch(body)
+	if err != nil {
+		log.Debugf("Rejected the appsec events: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	a.daemon.HandleAppSecEvents(r.Header.Get(requestIDHeader), r.Header.Get(traceIDHeader), r.Header.Get(parentIDHeader), batch.Events)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleAppSecEvents queues the appsec events of the invocation with the given request ID, or the
+// last one when the request ID isn't known, until the next flush. They are tagged with the global
+// tags and the request ID, and attached to the given trace context, or to the X-Ray context of the
+// invocation when the library didn't send one. The events keep the context they already have.
+func (d *Daemon) HandleAppSecEvents(requestID string, traceID string, spanID string, events []map[string]interface{}) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	if invocation := d.ExecutionContext.FindInvocation(requestID); traceID == "" && invocation != nil {
+		traceID = invocation.XRayTraceID
+		spanID = invocation.XRaySpanID
+	}
+	d.invocationsMutex.Unlock()
+
+	tags := append(append([]string{}, d.ExtraTags.Tags...), "request_id:"+requestID)
+	for _, event := range events {
+		attachAppSecContext(event, tags, traceID, spanID)
+	}
+	if dropped := d.appsec.add(events); dropped > 0 {
+		log.Debugf("Dropped %d appsec events of invocation %q, %d events are already waiting for the next flush", dropped, requestID, maxPendingAppSecEvents)
+	}
+}
+
+// attachAppSecContext adds the tags to the tags context of an appsec event, and sets its trace
+// and span contexts when it doesn't have them
+func attachAppSecContext(event map[string]interface{}, tags []string, traceID string, spanID string) {
+	eventContext, _ := event["context"].(map[string]interface{})
+	if eventContext == nil {
+		eventContext = make(map[string]interface{})
+		event["context"] = eventContext
+	}
+
+	tagsContext, _ := eventContext["tags"].(map[string]interface{})
+	if tagsContext == nil {
+		tagsContext = map[string]interface{}{"context_version": appsecContextVersion}
+		eventContext["tags"] = tagsContext
+	}
+	values, _ := tagsContext["values"].([]interface{})
+	for _, tag := range tags {
+		values = append(values, tag)
+	}
+	tagsContext["values"] = values
+
+	for key, id := range map[string]string{"trace": traceID, "span": spanID} {
+		if id == "" {
+			continue
+		}
+		if _, found := eventContext[key]; !found {
+			eventContext[key] = map[string]interface{}{"context_version": appsecContextVersion, "id": id}
+		}
+	}
+}
+
+// appsecForwarder keeps the appsec events until the next flush, and sends them to the appsec
+// intake through the appsec proxy of the trace agent
+type appsecForwarder struct {
+	url            string
+	client         *http.Client
+	maxPayloadSize int64
+
+	// events are the events waiting for the next flush, protected by mu
+	mu     sync.Mutex
+	events []map[string]interface{}
+}
+
+// newAppSecForwarder returns a forwarder sending the events to the given URL
+func newAppSecForwarder(url string, maxPayloadSize int64) *appsecForwarder {
+	return &appsecForwarder{
+		url:            url,
+		client:         &http.Client{Timeout: FlushTimeout},
+		maxPayloadSize: maxPayloadSize,
+	}
+}
+
+// newAppSecForwarderFromConfig returns a forwarder sending the events to the trace agent running
+// in the extension, nil when appsec is disabled
+func newAppSecForwarderFromConfig() *appsecForwarder {
+	if !config.Datadog.GetBool("appsec_config.enabled") {
+		return nil
+	}
+	maxPayloadSize := config.Datadog.GetInt64("appsec_config.max_payload_size")
+	if maxPayloadSize <= 0 {
+		maxPayloadSize = config.DefaultAppSecMaxPayloadSize
+	}
+	url := fmt.Sprintf("http://localhost:%d%s", config.Datadog.GetInt("apm_config.receiver_port"), appsecIntakePath)
+	return newAppSecForwarder(url, maxPayloadSize)
+}
+
+// add queues the events until the next flush, and returns the number of events dropped because
+// too many are waiting
+func (f *appsecForwarder) add(events []map[string]interface{}) int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	room := maxPendingAppSecEvents - len(f.events)
+	if room < 0 {
+		room = 0
+	}
+	if len(events) <= room {
+		f.events = append(f.events, events...)
+		return 0
+	}
+	f.events = append(f.events, events[:room]...)
+	return len(events) - room
+}
+
+// pending returns the number of events waiting for the next flush
+func (f *appsecForwarder) pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+// flush sends the events waiting since the last flush in a single batch. The events of a batch
+// which can't be sent are dropped, the library doesn't send them again either.
+func (f *appsecForwarder) flush(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	events := f.events
+	f.events = nil
+	f.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(appsecBatch{
+		ProtocolVersion: appsecProtocolVersion,
+		IdempotencyKey:  newIdempotencyKey(),
+		Events:          events,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode %d appsec events: %v", len(events), err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := f.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to send %d appsec events: %v", len(events), err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body) //nolint:errcheck
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unable to send %d appsec events: the intake responded %s", len(events), response.Status)
+	}
+	return nil
+}
+
+// newIdempotencyKey returns a random key identifying a batch of appsec events, so that the intake
+// doesn't process it twice
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		log.Debugf("Unable to generate the idempotency key of the appsec events: %s", err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// flushAppSec sends the appsec events received since the last flush to the appsec intake.
+// It is protected by a mutex to ensure only one appsec flush can be in progress at any given time.
+func (d *Daemon) flushAppSec(ctx context.Context, wg *sync.WaitGroup) {
+	d.appsecFlushMutex.Lock()
+	if err := d.appsec.flush(ctx); err != nil {
+		log.Errorf("Unable to flush the appsec events: %s", err)
+	}
+	wg.Done()
+	d.appsecFlushMutex.Unlock()
+}
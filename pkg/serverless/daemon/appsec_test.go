@@ -0,0 +1,214 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+)
+
+const appsecTestBatch = `{"protocol_version":1,"idempotency_key":"key","events":[{"event_type":"appsec","event_version":"1.0.0","rule":{"id":"crs-942-100"},"context":{"span":{"context_version":"0.1.0","id":"42"}}}]}`
+
+func newAppSecTestDaemon(url string) *Daemon {
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{Tags: []string{"function_name:my-function"}},
+		appsec:           newAppSecForwarder(url, 1024),
+	}
+	d.SetExecutionContext("arn", "request-1")
+	return d
+}
+
+// postAppSecEvents sends the payload to the AppSec route and returns the status code
+func postAppSecEvents(d *Daemon, payload string, headers map[string]string) int {
+	request := httptest.NewRequest(http.MethodPost, "/lambda/appsec", strings.NewReader(payload))
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	(&AppSec{d}).ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+// eventContext returns the context of the pending appsec event at the given index
+func eventContext(d *Daemon, index int) map[string]interface{} {
+	d.appsec.mu.Lock()
+	defer d.appsec.mu.Unlock()
+	return d.appsec.events[index]["context"].(map[string]interface{})
+}
+
+func TestAppSecRoute(t *testing.T) {
+	d := newAppSecTestDaemon("")
+
+	status := postAppSecEvents(d, appsecTestBatch, map[string]string{
+		requestIDHeader: "request-1",
+		traceIDHeader:   "1234",
+		parentIDHeader:  "5678",
+	})
+	assert.Equal(t, http.StatusAccepted, status)
+	require.Equal(t, 1, d.appsec.pending())
+	context := eventContext(d, 0)
+	assert.Equal(t, map[string]interface{}{"context_version": "0.1.0", "id": "1234"}, context["trace"])
+	// the span context of the event is kept
+	assert.Equal(t, map[string]interface{}{"context_version": "0.1.0", "id": "42"}, context["span"])
+	assert.Equal(t, map[string]interface{}{
+		"context_version": "0.1.0",
+		"values":          []interface{}{"function_name:my-function", "request_id:request-1"},
+	}, context["tags"])
+}
+
+func TestAppSecRouteOutsideOfInvocation(t *testing.T) {
+	d := newAppSecTestDaemon("")
+	invocation := d.ExecutionContext.Invocation("request-1")
+	invocation.XRayTraceID = "1111"
+	invocation.XRaySpanID = "2222"
+
+	// the events are attributed to the last request ID, and to the X-Ray context of its invocation
+	assert.Equal(t, http.StatusAccepted, postAppSecEvents(d, `{"protocol_version":1,"events":[{"event_type":"appsec"}]}`, nil))
+	context := eventContext(d, 0)
+	assert.Equal(t, map[string]interface{}{"context_version": "0.1.0", "id": "1111"}, context["trace"])
+	assert.Equal(t, map[string]interface{}{"context_version": "0.1.0", "id": "2222"}, context["span"])
+	assert.Contains(t, context["tags"].(map[string]interface{})["values"], "request_id:request-1")
+
+	// the X-Ray context of an invocation isn't attached to the events of another one
+	assert.Equal(t, http.StatusAccepted, postAppSecEvents(d, `{"protocol_version":1,"events":[{"event_type":"appsec"}]}`, map[string]string{requestIDHeader: "request-0"}))
+	context = eventContext(d, 1)
+	assert.NotContains(t, context, "trace")
+	assert.Contains(t, context["tags"].(map[string]interface{})["values"], "request_id:request-0")
+}
+
+func TestAppSecRouteInvalidPayloads(t *testing.T) {
+	d := newAppSecTestDaemon("")
+	for _, payload := range []string{
+		``,
+		`not json`,
+		`{"protocol_version":2,"events":[{"event_type":"appsec"}]}`,
+		`{"protocol_version":1,"events":[]}`,
+		`{"protocol_version":1,"events":[null]}`,
+		`{"protocol_version":1,"events":["appsec"]}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, postAppSecEvents(d, payload, nil), payload)
+	}
+	assert.Equal(t, 0, d.appsec.pending())
+}
+
+func TestAppSecRoutePayloadSize(t *testing.T) {
+	d := newAppSecTestDaemon("")
+	large := `{"protocol_version":1,"events":[{"padding":"` + strings.Repeat("a", 1024) + `"}]}`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postAppSecEvents(d, large, nil))
+
+	// the payloads without a content length are bounded too
+	request := httptest.NewRequest(http.MethodPost, "/lambda/appsec", ioutil.NopCloser(strings.NewReader(large)))
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	(&AppSec{d}).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Equal(t, 0, d.appsec.pending())
+}
+
+func TestAppSecRouteDisabled(t *testing.T) {
+	d := newAppSecTestDaemon("")
+	d.appsec = nil
+	assert.Equal(t, http.StatusMethodNotAllowed, postAppSecEvents(d, appsecTestBatch, nil))
+}
+
+func TestAppSecPendingEventsBounded(t *testing.T) {
+	forwarder := newAppSecForwarder("", 1024)
+	events := make([]map[string]interface{}, maxPendingAppSecEvents-1)
+	assert.Equal(t, 0, forwarder.add(events))
+	assert.Equal(t, 2, forwarder.add([]map[string]interface{}{{}, {}, {}}))
+	assert.Equal(t, 1, forwarder.add([]map[string]interface{}{{}}))
+	assert.Equal(t, maxPendingAppSecEvents, forwarder.pending())
+}
+
+// stubAppSecIntake records the batches of appsec events it receives, answering with the given status
+type stubAppSecIntake struct {
+	mu      sync.Mutex
+	paths   []string
+	batches []appsecBatch
+	status  int
+}
+
+func (s *stubAppSecIntake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var batch appsecBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err == nil {
+		s.paths = append(s.paths, r.URL.Path)
+		s.batches = append(s.batches, batch)
+	}
+	w.WriteHeader(s.status)
+}
+
+// received returns the batches received since the last call, and the paths they were sent to
+func (s *stubAppSecIntake) received() ([]appsecBatch, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batches, paths := s.batches, s.paths
+	s.batches, s.paths = nil, nil
+	return batches, paths
+}
+
+func (s *stubAppSecIntake) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func TestAppSecFlush(t *testing.T) {
+	intake := &stubAppSecIntake{status: http.StatusAccepted}
+	server := httptest.NewServer(intake)
+	defer server.Close()
+
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+	d.appsec = newAppSecForwarder(server.URL+appsecIntakePath, 1024)
+	d.ExtraTags.Tags = []string{"function_name:my-function"}
+	d.SetExecutionContext("arn", "request-1")
+
+	request := httptest.NewRequest(http.MethodPost, "/lambda/appsec", strings.NewReader(appsecTestBatch))
+	request.Header.Set(requestIDHeader, "request-1")
+	recorder := httptest.NewRecorder()
+	d.mux.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusAccepted, recorder.Code)
+	// the events are only sent on the flush
+	batches, _ := intake.received()
+	assert.Empty(t, batches)
+
+	d.TriggerFlush(false)
+	batches, paths := intake.received()
+	require.Len(t, batches, 1)
+	assert.Equal(t, []string{appsecIntakePath}, paths)
+	assert.Equal(t, appsecProtocolVersion, batches[0].ProtocolVersion)
+	assert.Len(t, batches[0].IdempotencyKey, 32)
+	require.Len(t, batches[0].Events, 1)
+	assert.Equal(t, map[string]interface{}{"id": "crs-942-100"}, batches[0].Events[0]["rule"])
+	tags := batches[0].Events[0]["context"].(map[string]interface{})["tags"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"function_name:my-function", "request_id:request-1"}, tags["values"])
+
+	// nothing is sent when no event was received since the last flush
+	d.TriggerFlush(false)
+	batches, _ = intake.received()
+	assert.Empty(t, batches)
+
+	// the events which can't be sent are dropped
+	intake.setStatus(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusAccepted, postAppSecEvents(d, appsecTestBatch, nil))
+	d.TriggerFlush(false)
+	batches, _ = intake.received()
+	assert.Len(t, batches, 1)
+	assert.Equal(t, 0, d.appsec.pending())
+}
@@ -0,0 +1,107 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxRegisteredClients is the maximum number of distinct client libraries kept in the registry.
+const maxRegisteredClients = 10
+
+// unknownClientLibrary is the library name of the clients calling the hello route without describing themselves.
+const unknownClientLibrary = "unknown"
+
+// errRegistryClosed is returned when a client registers after the shutdown of the daemon started.
+var errRegistryClosed = errors.New("the daemon is shutting down")
+
+// RegisteredClient is a client library which called the hello route
+type RegisteredClient struct {
+	Library      string    `json:"library"`
+	Version      string    `json:"version"`
+	RegisteredAt time.Time `json:"registered_at"`
+	// Calls is the number of calls to the hello route by this library and version
+	Calls int `json:"calls"`
+
+	// reported is true once the registration has been sent as an enhanced metric
+	reported bool
+}
+
+// clientRegistry keeps the client libraries which called the hello route, several of them can be
+// layered in the same function (e.g. a tracing library and a profiler). Its size is bounded, the
+// registrations of additional libraries are only counted.
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients []*RegisteredClient
+	dropped int
+	closed  bool
+}
+
+// register records a call to the hello route by the given library and version. It returns true
+// for the first call of a library and version.
+func (r *clientRegistry) register(library, version string, now time.Time) (bool, error) {
+	if library == "" {
+		library = unknownClientLibrary
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false, errRegistryClosed
+	}
+	for _, client := range r.clients {
+		if client.Library == library && client.Version == version {
+			client.Calls++
+			return false, nil
+		}
+	}
+	if len(r.clients) >= maxRegisteredClients {
+		r.dropped++
+		return true, nil
+	}
+	r.clients = append(r.clients, &RegisteredClient{
+		Library:      library,
+		Version:      version,
+		RegisteredAt: now,
+		Calls:        1,
+	})
+	return true, nil
+}
+
+// close rejects the registrations from now on
+func (r *clientRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// list returns a copy of the registered clients and the number of registrations which didn't fit in the registry
+func (r *clientRegistry) list() ([]RegisteredClient, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]RegisteredClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, *client)
+	}
+	return clients, r.dropped
+}
+
+// takeUnreported returns the clients not reported yet, and marks them as reported
+func (r *clientRegistry) takeUnreported() []RegisteredClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unreported []RegisteredClient
+	for _, client := range r.clients {
+		if !client.reported {
+			client.reported = true
+			unreported = append(unreported, *client)
+		}
+	}
+	return unreported
+}
@@ -0,0 +1,119 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func callHello(d *Daemon, body string) int {
+	request := httptest.NewRequest(http.MethodPost, "/lambda/hello", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	(&Hello{d}).ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestHelloRegistersClients(t *testing.T) {
+	d := &Daemon{}
+
+	assert.Equal(t, 200, callHello(d, ""))
+	assert.Equal(t, 200, callHello(d, `{"library":"datadog-lambda-js","version":"4.66.0"}`))
+	assert.Equal(t, 200, callHello(d, `{"library":"datadog-lambda-js","version":"4.66.0"}`))
+	assert.Equal(t, 200, callHello(d, `not json`))
+	assert.True(t, d.clientLibReady)
+
+	clients, dropped := d.clients.list()
+	assert.Equal(t, 0, dropped)
+	assert.Len(t, clients, 2)
+	assert.Equal(t, unknownClientLibrary, clients[0].Library)
+	assert.Equal(t, 2, clients[0].Calls)
+	assert.Equal(t, "datadog-lambda-js", clients[1].Library)
+	assert.Equal(t, "4.66.0", clients[1].Version)
+	assert.Equal(t, 2, clients[1].Calls)
+
+	// the registrations are reported once
+	assert.Len(t, d.clients.takeUnreported(), 2)
+	assert.Len(t, d.clients.takeUnreported(), 0)
+	callHello(d, `{"library":"dd-trace-py","version":"0.50.0"}`)
+	unreported := d.clients.takeUnreported()
+	assert.Len(t, unreported, 1)
+	assert.Equal(t, "dd-trace-py", unreported[0].Library)
+}
+
+func TestHelloConcurrentRegistrations(t *testing.T) {
+	d := &Daemon{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"library":"library-%d","version":"1.0.0"}`, i%20)
+			assert.Equal(t, 200, callHello(d, body))
+		}(i)
+	}
+	wg.Wait()
+
+	clients, dropped := d.clients.list()
+	assert.Len(t, clients, maxRegisteredClients)
+	// 20 distinct libraries called the route, the ones not fitting in the registry are counted on each call
+	calls := 0
+	for _, client := range clients {
+		calls += client.Calls
+	}
+	assert.Equal(t, 50, calls+dropped)
+	assert.True(t, d.clientLibReady)
+}
+
+func TestHelloRegistrationRacingWithStop(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- callHello(d, `{"library":"datadog-lambda-go","version":"1.0.0"}`)
+		}()
+	}
+	d.Stop()
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Contains(t, []int{200, 503}, code)
+	}
+	// no registration is accepted once the shutdown started
+	assert.Equal(t, 503, callHello(d, `{"library":"datadog-lambda-go","version":"1.0.0"}`))
+}
+
+func TestStatusRoute(t *testing.T) {
+	d := &Daemon{}
+	d.clients.register("datadog-lambda-python", "3.40.0", time.Now())
+
+	recorder := httptest.NewRecorder()
+	(&Status{d}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/lambda/status", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	var status statusPayload
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.ClientReady)
+	assert.Equal(t, 0, status.DroppedClients)
+	assert.Len(t, status.Clients, 1)
+	assert.Equal(t, "datadog-lambda-python", status.Clients[0].Library)
+	assert.Equal(t, "3.40.0", status.Clients[0].Version)
+	assert.Equal(t, 1, status.Clients[0].Calls)
+}
@@ -8,18 +8,26 @@ package daemon
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
 	"github.com/DataDog/datadog-agent/pkg/logs"
 	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
 	"github.com/DataDog/datadog-agent/pkg/serverless/flush"
 	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
 	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/serverless/proxy"
+	"github.com/DataDog/datadog-agent/pkg/serverless/spanpointers"
 	"github.com/DataDog/datadog-agent/pkg/serverless/tags"
 	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
+	"github.com/DataDog/datadog-agent/pkg/trace/writer"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
@@ -33,12 +41,28 @@ const shutdownDelay time.Duration = 1 * time.Second
 // FlushTimeout is the amount of time to wait for a flush to complete.
 const FlushTimeout time.Duration = 5 * time.Second
 
+// requestIDHeader is the header used by the Lambda libraries to tell which invocation
+// a call to the flush route belongs to.
+const requestIDHeader = "Lambda-Runtime-Aws-Request-Id"
+
+// anonymousInvocation is the request ID of the single invocation slot used when the
+// request ID isn't known.
+const anonymousInvocation = ""
+
+// maxRequestIDHistory is the maximum number of request IDs kept in the execution context.
+const maxRequestIDHistory = 10
+
 // Daemon is the communcation server for between the runtime and the serverless Agent.
 // The name "daemon" is just in order to avoid serverless.StartServer ...
 type Daemon struct {
 	httpServer *http.Server
 	mux        *http.ServeMux
 
+	// transports are the transports the HTTP server listens on, and socketPath the path of its
+	// unix socket, empty when it doesn't listen on one
+	transports []string
+	socketPath string
+
 	MetricAgent *metrics.ServerlessMetricAgent
 
 	TraceAgent *trace.ServerlessTraceAgent
@@ -47,6 +71,9 @@ type Daemon struct {
 	// interval of invocation of the function.
 	lastInvocations []time.Time
 
+	// lastInvocationsMutex protects lastInvocations, updated when a warm-up request is detected
+	lastInvocationsMutex sync.Mutex
+
 	// flushStrategy is the currently selected flush strategy, defaulting to the
 	// the "flush at the end" naive strategy.
 	flushStrategy flush.Strategy
@@ -59,7 +86,11 @@ type Daemon struct {
 	// and called the /hello route on the agent
 	clientLibReady bool
 
-	// stopped represents whether the Daemon has been stopped
+	// clients keeps the client libraries which called the /hello route, at least one
+	// of them registered when clientLibReady is true
+	clients clientRegistry
+
+	// stopped represents whether the Daemon has been stopped, it is protected by invocationsMutex
 	stopped bool
 
 	// InvcWg is used to keep track of whether the daemon is doing any pending work
@@ -70,9 +101,21 @@ type Daemon struct {
 
 	ExecutionContext *serverlessLog.ExecutionContext
 
-	// finishInvocationOnce assert that FinishedInvocation will be called only once (at the end of the function OR after a timeout)
-	// this should be reset before each invocation
-	finishInvocationOnce sync.Once
+	// invocations stores the request IDs of the invocations which have been started
+	// and not finished yet. Each of them holds one count of InvcWg, released only once
+	// by FinishInvocation (at the end of the function OR after a timeout).
+	invocations map[string]struct{}
+
+	// lastStartedInvocation is the request ID of the last started invocation, finished
+	// when FinishInvocation is called without a request ID.
+	lastStartedInvocation string
+
+	// invocationTags are the custom tags of the invocation in progress set on the InvocationTags
+	// route, by key, also kept as an array in ExecutionContext. They are protected by invocationsMutex.
+	invocationTags map[string]string
+
+	// invocationsMutex protects invocations, lastStartedInvocation, invocationTags and ExecutionContext updates
+	invocationsMutex sync.Mutex
 
 	// metricsFlushMutex ensures that only one metrics flush can be underway at a given time
 	metricsFlushMutex sync.Mutex
@@ -82,15 +125,103 @@ type Daemon struct {
 
 	// logsFlushMutex ensures that only one logs flush can be underway at a given time
 	logsFlushMutex sync.Mutex
+
+	// appsecFlushMutex ensures that only one appsec events flush can be underway at a given time
+	appsecFlushMutex sync.Mutex
+
+	// appsec keeps the appsec events received on the AppSec route until the next flush, nil when
+	// appsec is disabled
+	appsec *appsecForwarder
+
+	// metricsRetryQueue and tracesRetryQueue keep the payloads which failed to be sent to
+	// the intake, they are retried before new data on the next flush
+	metricsRetryQueue *RetryQueue
+	tracesRetryQueue  *RetryQueue
+
+	// inactivityFlushTimeout is how long the daemon waits for a new invocation after the
+	// last one finished before flushing on its own, 0 disables the inactivity flush.
+	// It is meant for environments where the process is never frozen between invocations.
+	inactivityFlushTimeout time.Duration
+
+	// inactivityFlushTimer is armed by FinishInvocation and stopped by StartInvocation,
+	// it is protected by invocationsMutex
+	inactivityFlushTimer *time.Timer
+
+	// flushesInProgress counts the flushes currently underway, accessed atomically
+	flushesInProgress int32
+
+	// inactivityFlushes counts the flushes triggered by inactivity, accessed atomically
+	inactivityFlushes int32
+
+	// earlyFlushPending is set while a flush triggered by the memory soft limit of the metrics
+	// is underway, and earlyFlushes counts these flushes, both accessed atomically
+	earlyFlushPending int32
+	earlyFlushes      int32
+
+	// mixedTriggerSources counts the invocations whose event held records of several resources
+	// since the last flush, by resource of their first record, protected by invocationsMutex
+	mixedTriggerSources map[string]int64
+
+	// enhancedMetricsEnabled tells whether the enhanced metrics computed by the daemon are sent
+	enhancedMetricsEnabled bool
+
+	// postRuntime correlates the end of the runtime with the next call to /next to measure
+	// the time spent by the extension after each invocation
+	postRuntime *postRuntimeTracker
+
+	// runtimeTags are the runtime and architecture tags of the function, detected at startup
+	runtimeTags map[string]string
+
+	// functionLogs keeps the last logs of the function, sent with the report of a crash of the runtime
+	functionLogs *serverlessLog.FunctionLogBuffer
+
+	// logsChan and logsEnabled are the logs channel and whether the logs are sent, set up
+	// with the log collection handler
+	logsChan    chan *logConfig.ChannelMessage
+	logsEnabled bool
+
+	// lastCrashRequestID is the request ID of the last invocation during which the runtime
+	// crashed, protected by invocationsMutex
+	lastCrashRequestID string
+
+	// warmup detects the warm-up requests from the event of the invocations, nil when disabled
+	warmup *warmupMatcher
+
+	// payloadTagger tags the spans with the redacted event and response of the invocations,
+	// nil when they aren't captured
+	payloadTagger *payloadTagger
+
+	// routes counts the hits on the routes of the daemon, summarized on each flush
+	routes *routeRegistry
+
+	// logsRoute is the log collection route, holding the logs received before they can be attributed
+	logsRoute *serverlessLog.PendingLogsRoute
+
+	// restorePending is set when the execution environment of a SnapStart function was restored
+	// from its snapshot and no invocation started since, and globalTagsOutdated when the global tags
+	// must be computed again, both protected by invocationsMutex
+	restorePending     bool
+	globalTagsOutdated bool
+
+	// restoreHook is called after each restore of the execution environment from its snapshot, in
+	// the background, the flushes waiting for restoreHooks
+	restoreHook  func() (apiKey string)
+	restoreHooks sync.WaitGroup
 }
 
-// StartDaemon starts an HTTP server to receive messages from the runtime.
+// LogsCollectionRoute is the route on which the Logs API sends the logs of the function, registered
+// as soon as the daemon starts to receive the logs of the init phase
+const LogsCollectionRoute = "/lambda/logs"
+
+// StartDaemon starts an HTTP server to receive messages from the runtime, on the TCP address
+// and on the unix socket path, either of them being disabled when empty. The same routes are
+// served on both.
 // The DogStatsD server is provided when ready (slightly later), to have the
 // hello route available as soon as possible. However, the HELLO route is blocking
 // to have a way for the runtime function to know when the Serverless Agent is ready.
 // If the Flush route is called before the statsd server has been set, a 503
 // is returned by the HTTP route.
-func StartDaemon(addr string) *Daemon {
+func StartDaemon(addr string, socketPath string) *Daemon {
 	log.Debug("Starting daemon to receive messages from runtime...")
 	mux := http.NewServeMux()
 
@@ -103,19 +234,42 @@ func StartDaemon(addr string) *Daemon {
 		clientLibReady:    false,
 		flushStrategy:     &flush.AtTheEnd{},
 		ExtraTags:         &serverlessLog.Tags{},
-		ExecutionContext:  &serverlessLog.ExecutionContext{},
+		ExecutionContext:  &serverlessLog.ExecutionContext{SnapStart: isSnapStart()},
+		invocations:       make(map[string]struct{}),
 		metricsFlushMutex: sync.Mutex{},
 		tracesFlushMutex:  sync.Mutex{},
 		logsFlushMutex:    sync.Mutex{},
+		metricsRetryQueue: NewRetryQueue(config.Datadog.GetInt("serverless.retry_buffer_size")),
+		tracesRetryQueue:  NewRetryQueue(config.Datadog.GetInt("serverless.retry_buffer_size")),
+
+		inactivityFlushTimeout: time.Duration(config.Datadog.GetInt("serverless.inactivity_flush_timeout")) * time.Second,
+		enhancedMetricsEnabled: config.Datadog.GetBool("enhanced_metrics"),
+		postRuntime:            newPostRuntimeTracker(),
+		runtimeTags:            tags.DetectRuntimeTags(),
+		functionLogs:           &serverlessLog.FunctionLogBuffer{},
+		warmup: newWarmupMatcher(
+			config.Datadog.GetString("serverless.warmup_payload_path"),
+			config.Datadog.GetString("serverless.warmup_payload_value"),
+		),
+		payloadTagger: newPayloadTaggerFromConfig(),
+		appsec:        newAppSecForwarderFromConfig(),
+		routes:        &routeRegistry{},
+		logsRoute:     serverlessLog.NewPendingLogsRoute(config.Datadog.GetInt("serverless.logs_pending_buffer_size")),
 	}
 
-	mux.Handle("/lambda/hello", &Hello{daemon})
-	mux.Handle("/lambda/flush", &Flush{daemon})
+	mux.Handle("/lambda/hello", daemon.routes.handle("/lambda/hello", maxHelloPayloadSize, &Hello{daemon}))
+	mux.Handle("/lambda/flush", daemon.routes.handle("/lambda/flush", 0, &Flush{daemon}))
+	mux.Handle("/lambda/start-invocation", daemon.routes.handle("/lambda/start-invocation", maxEventPayloadSize, &StartInvocation{daemon}))
+	mux.Handle("/lambda/end-invocation", daemon.routes.handle("/lambda/end-invocation", maxResponsePayloadSize, &EndInvocation{daemon}))
+	mux.Handle("/lambda/status", daemon.routes.handle("/lambda/status", 0, &Status{daemon}))
+	mux.Handle(LogsCollectionRoute, daemon.routes.handle(LogsCollectionRoute, 0, daemon.logsRoute))
+	// the AppSec route bounds its body to the max payload size of appsec on its own, to reject the larger ones
+	mux.Handle("/lambda/appsec", daemon.routes.handle("/lambda/appsec", 0, &AppSec{daemon}))
+	// the InvocationTags route bounds its body on its own too, to reject the larger ones
+	mux.Handle("/lambda/tags", daemon.routes.handle("/lambda/tags", 0, &InvocationTags{daemon}))
 
 	// start the HTTP server used to communicate with the clients
-	go func() {
-		_ = daemon.httpServer.ListenAndServe()
-	}()
+	daemon.listen(addr, socketPath)
 
 	return daemon
 }
@@ -126,11 +280,79 @@ type Hello struct {
 	daemon *Daemon
 }
 
+// helloPayload is the optional body of the Hello route, describing the client library
+type helloPayload struct {
+	Library string `json:"library"`
+	Version string `json:"version"`
+}
+
+// maxHelloPayloadSize bounds the size of the body read on the Hello route
+const maxHelloPayloadSize = 4096
+
 // ServeHTTP - see type Hello comment.
+// Several client libraries can call it, each of them is registered. Responds with the transports
+// the daemon listens on, for the libraries to pick one. Returns 503 once the daemon is shutting down.
 func (h *Hello) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Hit on the serverless.Hello route.")
+	var hello helloPayload
+	// the older libraries don't describe themselves
+	if body, err := ioutil.ReadAll(r.Body); err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &hello); err != nil {
+			log.Debugf("Unable to parse the payload of the hello route: %s", err)
+		}
+	}
+
+	first, err := h.daemon.clients.register(hello.Library, hello.Version, time.Now())
+	if err != nil {
+		w.WriteHeader(503)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if first {
+		log.Debugf("Client library %q version %q registered with the extension", hello.Library, hello.Version)
+	}
 	// if the DogStatsD daemon isn't ready, wait for it.
 	h.daemon.SetClientReady(true)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(helloResponse{Transports: h.daemon.transports, SocketPath: h.daemon.socketPath}); err != nil {
+		log.Debugf("Unable to write the response of the hello route: %s", err)
+	}
+}
+
+// Status is the route exposing the client libraries registered with the Hello route.
+type Status struct {
+	daemon *Daemon
+}
+
+// statusPayload is the response of the Status route
+type statusPayload struct {
+	ClientReady    bool                  `json:"client_ready"`
+	Clients        []RegisteredClient    `json:"clients"`
+	DroppedClients int                   `json:"dropped_clients"`
+	MetricsMemory  *metrics.MemoryUsage  `json:"metrics_memory,omitempty"`
+	Routes         map[string]RouteStats `json:"routes,omitempty"`
+	// DroppedPendingLogs counts the logs dropped before the log collection was ready
+	DroppedPendingLogs int `json:"dropped_pending_logs"`
+	// Proxy is the proxy the metrics, traces and logs are sent through, if any
+	Proxy *ProxySettings `json:"proxy,omitempty"`
+}
+
+// ServeHTTP - see type Status comment.
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clients, dropped := s.daemon.clients.list()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statusPayload{
+		ClientReady:    len(clients) > 0 || dropped > 0,
+		Clients:        clients,
+		DroppedClients: dropped,
+		MetricsMemory:  s.daemon.metricsMemoryUsage(),
+		Routes:         s.daemon.routes.stats(),
+
+		DroppedPendingLogs: s.daemon.logsRoute.Dropped(),
+		Proxy:              GetProxySettings(),
+	}); err != nil {
+		log.Debugf("Unable to write the status: %s", err)
+	}
 }
 
 // Flush is the route to call to do an immediate flush on the serverless agent.
@@ -141,20 +363,22 @@ type Flush struct {
 
 // ServeHTTP - see type Flush comment.
 func (f *Flush) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Hit on the serverless.Flush route.")
-	if !f.daemon.ShouldFlush(flush.Stopping, time.Now()) {
-		log.Debugf("The flush strategy %s has decided to not flush at moment: %s", f.daemon.LogFlushStategy(), flush.Stopping)
-		f.daemon.FinishInvocation()
+	requestID := r.Header.Get(requestIDHeader)
+	// the runtime is done when the route is hit, not once the flush below is done
+	runtimeDoneTime := time.Now()
+	if !f.daemon.ShouldFlush(flush.Stopping, runtimeDoneTime) {
+		log.Tracef("The flush strategy %s has decided to not flush at moment: %s", f.daemon.LogFlushStategy(), flush.Stopping)
+		f.daemon.finishInvocation(requestID, runtimeDoneTime)
 		return
 	}
 
-	log.Debugf("The flush strategy %s has decided to flush at moment: %s", f.daemon.LogFlushStategy(), flush.Stopping)
+	log.Tracef("The flush strategy %s has decided to flush at moment: %s", f.daemon.LogFlushStategy(), flush.Stopping)
 
 	// if the DogStatsD daemon isn't ready, wait for it.
 	if !f.daemon.MetricAgent.IsReady() {
 		w.WriteHeader(503)
 		w.Write([]byte("DogStatsD server not ready"))
-		f.daemon.FinishInvocation()
+		f.daemon.finishInvocation(requestID, runtimeDoneTime)
 		return
 	}
 
@@ -162,11 +386,62 @@ func (f *Flush) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// want the flush to be canceled if the client is closing the request.
 	go func() {
 		f.daemon.TriggerFlush(false)
-		f.daemon.FinishInvocation()
+		f.daemon.finishInvocation(requestID, runtimeDoneTime)
 	}()
 
 }
 
+// StartInvocation is the route on which the Lambda libraries forward the event of an
+// invocation at its start, to find its trigger.
+type StartInvocation struct {
+	daemon *Daemon
+}
+
+// ServeHTTP - see type StartInvocation comment.
+func (s *StartInvocation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(requestIDHeader)
+	// the body is bounded by the route, the trigger is described before the body of large events
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Debugf("Unable to read the invocation event: %s", err)
+	}
+	if s.daemon.warmup.matches(payload) {
+		s.daemon.HandleWarmup(requestID)
+		return
+	}
+	if trigger, found := parseInvocationTrigger(payload); found {
+		s.daemon.SetInvocationTrigger(requestID, trigger)
+	}
+	if pointers := spanpointers.FromEvent(payload, maxSpanPointers); len(pointers) > 0 {
+		s.daemon.SetInvocationSpanPointers(requestID, pointers)
+	}
+	s.daemon.HandleInvocationEvent(requestID, payload)
+}
+
+// EndInvocation is the route on which the Lambda libraries forward the response of the
+// function at the end of an invocation, with the X-Amz-Function-Error header when the
+// function returned an error.
+type EndInvocation struct {
+	daemon *Daemon
+}
+
+// ServeHTTP - see type EndInvocation comment.
+func (e *EndInvocation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(requestIDHeader)
+	// the body is bounded by the route, the error is at the start of large responses
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Debugf("Unable to read the function response: %s", err)
+	}
+	if invocationError, isError := parseInvocationError(r.Header.Get(functionErrorHeader), payload); isError {
+		e.daemon.HandleInvocationError(requestID, invocationError)
+	}
+	if statusCode, found := parseResponseStatusCode(payload); found {
+		e.daemon.SetInvocationStatusCode(requestID, statusCode)
+	}
+	e.daemon.HandleInvocationResponse(requestID, payload)
+}
+
 // SetClientReady indicates that the client library has initialised and called the /hello route on the agent
 func (d *Daemon) SetClientReady(isReady bool) {
 	d.clientLibReady = isReady
@@ -182,27 +457,57 @@ func (d *Daemon) LogFlushStategy() string {
 	return d.flushStrategy.String()
 }
 
-//SetupLogCollectionHandler configures the log collection route handler
-func (d *Daemon) SetupLogCollectionHandler(route string, logsChan chan *logConfig.ChannelMessage, logsEnabled bool, enhancedMetricsEnabled bool) {
-	d.mux.Handle(route, &serverlessLog.CollectionRouteInfo{
+// SetupLogCollectionHandler configures the log collection route handler, replaying the logs received
+// since the daemon started once they can be attributed
+func (d *Daemon) SetupLogCollectionHandler(logsChan chan *logConfig.ChannelMessage, logsEnabled bool, enhancedMetricsEnabled bool) {
+	d.logsChan = logsChan
+	d.logsEnabled = logsEnabled
+	d.logsRoute.SetRoute(&serverlessLog.CollectionRouteInfo{
 		ExtraTags:              d.ExtraTags,
 		ExecutionContext:       d.ExecutionContext,
 		LogChannel:             logsChan,
 		MetricChannel:          d.MetricAgent.GetMetricChannel(),
 		LogsEnabled:            logsEnabled,
 		EnhancedMetricsEnabled: enhancedMetricsEnabled,
+		RuntimeDoneHandler:     d.HandleRuntimeDone,
+		RuntimeCrashHandler:    d.HandleRuntimeCrash,
+		RestoreHandler:         d.HandleRestore,
+		FunctionLogs:           d.functionLogs,
+		StructuredLogsMaxSize:  structuredLogsMaxSize(),
+		ExecutionContextMutex:  &d.invocationsMutex,
 	})
 }
 
+// structuredLogsMaxSize returns the size under which the function logs are parsed as JSON, 0 when disabled.
+// The parsing is disabled when processing rules are configured: they are applied to the message of the
+// logs, and wouldn't apply to the fields of the structured logs promoted to attributes.
+func structuredLogsMaxSize() int {
+	if !config.Datadog.GetBool("serverless.logs_structured_parsing") {
+		return 0
+	}
+	if rules, err := logConfig.GlobalProcessingRules(); err != nil || len(rules) > 0 {
+		log.Info("Processing rules are configured, the structured function logs are sent unparsed")
+		return 0
+	}
+	return config.Datadog.GetInt("serverless.logs_structured_max_size")
+}
+
 // SetStatsdServer sets the DogStatsD server instance running when it is ready.
 func (d *Daemon) SetStatsdServer(metricAgent *metrics.ServerlessMetricAgent) {
 	d.MetricAgent = metricAgent
 	d.MetricAgent.SetExtraTags(d.ExtraTags.Tags)
+	d.MetricAgent.SetRetryHandler(func(t *transaction.HTTPTransaction) {
+		d.metricsRetryQueue.Add(metricsRetryPayload{t})
+	})
+	d.MetricAgent.SetSoftLimitHandler(d.handleMetricsSoftLimit)
 }
 
 // SetTraceAgent sets the Agent instance for submitting traces
 func (d *Daemon) SetTraceAgent(traceAgent *trace.ServerlessTraceAgent) {
 	d.TraceAgent = traceAgent
+	d.TraceAgent.SetRetryHandler(func(p *writer.FailedPayload) {
+		d.tracesRetryQueue.Add(p)
+	})
 }
 
 // SetFlushStrategy sets the flush strategy to use.
@@ -217,22 +522,58 @@ func (d *Daemon) UseAdaptiveFlush(enabled bool) {
 	d.useAdaptiveFlush = enabled
 }
 
-// TriggerFlush triggers a flush of the aggregated metrics, traces and logs.
+// TriggerFlush triggers a flush of the aggregated metrics, traces and logs, and of the appsec events.
 // If the flush times out, the daemon will stop waiting for the flush to complete, but the
 // flush may be continued on the next invocation.
 // In some circumstances, it may switch to another flush strategy after the flush.
 func (d *Daemon) TriggerFlush(isLastFlushBeforeShutdown bool) {
 	d.InvcWg.Add(1)
 	defer d.InvcWg.Done()
+	atomic.AddInt32(&d.flushesInProgress, 1)
+	defer atomic.AddInt32(&d.flushesInProgress, -1)
+	if !isLastFlushBeforeShutdown {
+		d.postRuntime.flushStarted(time.Now())
+	}
+	d.routes.logSummary()
+
+	if d.TraceAgent != nil && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		d.TraceAgent.SendSamplingMetrics(d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+	}
+	if d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		// the payloads of the previous flushes, shipped to the main and additional endpoints
+		metrics.SendEndpointMetrics("metrics", d.MetricAgent.TakeEndpointCounts(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		metrics.SendDroppedContextsMetric(d.MetricAgent.TakeDroppedSamples(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		metrics.SendMixedTriggerSourcesMetric(d.takeMixedTriggerSources(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		metrics.SendRetryDroppedBytesMetric("metrics", d.metricsRetryQueue.TakeDroppedBytes(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		metrics.SendRetryDroppedBytesMetric("traces", d.tracesRetryQueue.TakeDroppedBytes(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		if d.TraceAgent != nil {
+			metrics.SendEndpointMetrics("traces", d.TraceAgent.TakeEndpointCounts(), d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		}
+	}
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		// the tags are known from the first invocation, the registrations are sent once
+		for _, client := range d.clients.takeUnreported() {
+			metrics.SendClientLibraryEnhancedMetric(client.Library, client.Version, d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+		}
+	}
+
+	// the API key may be resolved again after a restore
+	if waitWithTimeout(&d.restoreHooks, FlushTimeout) {
+		log.Debug("Timed out while waiting for the restore hook, flushing with the previous API key")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
 
 	wg := sync.WaitGroup{}
-	wg.Add(3)
+	wg.Add(4)
 
-	go d.flushMetrics(&wg)
-	go d.flushTraces(&wg)
-	go d.flushLogs(ctx, &wg)
+	// the enhanced metrics of the batches of logs are sent once the logs are flushed, the last flush before
+	// shutdown waits for them so that the batches of the final logs flush are reported
+	logsFlushed := make(chan struct{})
+	go d.flushMetrics(ctx, &wg, isLastFlushBeforeShutdown, logsFlushed)
+	go d.flushTraces(&wg, isLastFlushBeforeShutdown)
+	go d.flushLogs(ctx, &wg, logsFlushed)
+	go d.flushAppSec(ctx, &wg)
 
 	timedOut := waitWithTimeout(&wg, FlushTimeout)
 	if timedOut {
@@ -247,42 +588,71 @@ func (d *Daemon) TriggerFlush(isLastFlushBeforeShutdown bool) {
 	}
 }
 
-// flushMetrics flushes aggregated metrics to the intake.
+// flushMetrics flushes aggregated metrics to the intake, after retrying the payloads which previously failed.
+// The last flush before shutdown retries them regardless of their backoff and drops those still failing.
 // It is protected by a mutex to ensure only one metrics flush can be in progress at any given time.
-func (d *Daemon) flushMetrics(wg *sync.WaitGroup) {
+func (d *Daemon) flushMetrics(ctx context.Context, wg *sync.WaitGroup, isLastFlushBeforeShutdown bool, logsFlushed <-chan struct{}) {
+	if isLastFlushBeforeShutdown {
+		select {
+		case <-logsFlushed:
+		case <-ctx.Done():
+		}
+	}
 	d.metricsFlushMutex.Lock()
 	flushStartTime := time.Now().Unix()
 	log.Debugf("Beginning metrics flush at time %d", flushStartTime)
 	if d.MetricAgent != nil {
+		d.metricsRetryQueue.Flush(time.Now(), isLastFlushBeforeShutdown, func(payloads []RetryPayload) {
+			d.MetricAgent.Retry(metricsTransactions(payloads))
+		})
 		d.MetricAgent.Flush()
+		if isLastFlushBeforeShutdown {
+			d.metricsRetryQueue.Drop()
+		}
 	}
 	log.Debugf("Finished metrics flush that was started at time %d", flushStartTime)
 	wg.Done()
 	d.metricsFlushMutex.Unlock()
 }
 
-// flushTraces flushes aggregated traces to the intake.
+// flushTraces flushes aggregated traces to the intake, after retrying the payloads which previously failed.
+// The last flush before shutdown retries them regardless of their backoff and drops those still failing.
 // It is protected by a mutex to ensure only one traces flush can be in progress at any given time.
-func (d *Daemon) flushTraces(wg *sync.WaitGroup) {
+func (d *Daemon) flushTraces(wg *sync.WaitGroup, isLastFlushBeforeShutdown bool) {
 	d.tracesFlushMutex.Lock()
 	flushStartTime := time.Now().Unix()
 	log.Debugf("Beginning traces flush at time %d", flushStartTime)
 	if d.TraceAgent != nil && d.TraceAgent.Get() != nil {
+		d.tracesRetryQueue.Flush(time.Now(), isLastFlushBeforeShutdown, func(payloads []RetryPayload) {
+			for _, p := range payloads {
+				p.(*writer.FailedPayload).Retry()
+			}
+		})
 		d.TraceAgent.Get().FlushSync()
+		if isLastFlushBeforeShutdown {
+			d.tracesRetryQueue.Drop()
+		}
 	}
 	log.Debugf("Finished traces flush that was started at time %d", flushStartTime)
 	wg.Done()
 	d.tracesFlushMutex.Unlock()
 }
 
-// flushLogs flushes aggregated logs to the intake.
+// flushLogs flushes aggregated logs to the intake, then sends the enhanced metrics of the batches of logs sent
+// and closes logsFlushed.
 // It is protected by a mutex to ensure only one logs flush can be in progress at any given time.
-func (d *Daemon) flushLogs(ctx context.Context, wg *sync.WaitGroup) {
+func (d *Daemon) flushLogs(ctx context.Context, wg *sync.WaitGroup, logsFlushed chan<- struct{}) {
 	d.logsFlushMutex.Lock()
 	flushStartTime := time.Now().Unix()
 	log.Debugf("Beginning logs flush at time %d", flushStartTime)
 	logs.Flush(ctx)
 	log.Debugf("Finished logs flush that was started at time %d", flushStartTime)
+	// the batches are taken even when they aren't reported
+	logsBatches := logs.TakeBatchStats()
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		metrics.SendLogsBatchEnhancedMetrics(logsBatches, d.ExtraTags.Tags, d.MetricAgent.GetMetricChannel())
+	}
+	close(logsFlushed)
 	wg.Done()
 	d.logsFlushMutex.Unlock()
 }
@@ -293,11 +663,16 @@ func (d *Daemon) Stop() {
 	// Can't shut down before starting
 	// If the DogStatsD daemon isn't ready, wait for it.
 
+	d.invocationsMutex.Lock()
 	if d.stopped {
+		d.invocationsMutex.Unlock()
 		log.Debug("Daemon.Stop() was called, but Daemon was already stopped")
 		return
 	}
 	d.stopped = true
+	d.invocationsMutex.Unlock()
+	d.clients.close()
+	d.stopInactivityFlushTimer()
 
 	// Wait for any remaining logs to arrive via the logs API before shutting down the HTTP server
 	log.Debug("Waiting to shut down HTTP server")
@@ -308,6 +683,7 @@ func (d *Daemon) Stop() {
 	if err != nil {
 		log.Error("Error shutting down HTTP server")
 	}
+	d.removeSocket()
 
 	// Once the HTTP server is shut down, it is safe to shut down the agents
 	// Otherwise, we might try to handle API calls after the agent has already been shut down
@@ -326,20 +702,119 @@ func (d *Daemon) Stop() {
 	log.Debug("Serverless agent shutdown complete")
 }
 
-// StartInvocation tells the daemon the invocation began
-func (d *Daemon) StartInvocation() {
-	d.finishInvocationOnce = sync.Once{}
+// StartInvocation tells the daemon the invocation with the given request ID began.
+// Invocations are tracked independently so that overlapping ones don't corrupt each
+// other. An empty request ID uses a single anonymous invocation slot.
+func (d *Daemon) StartInvocation(requestID string) {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
+	d.lastStartedInvocation = requestID
+	if _, found := d.invocations[requestID]; found {
+		log.Debugf("Invocation %q has already been started", requestID)
+		return
+	}
+	d.invocations[requestID] = struct{}{}
 	d.InvcWg.Add(1)
+	if d.inactivityFlushTimer != nil {
+		d.inactivityFlushTimer.Stop()
+		d.inactivityFlushTimer = nil
+	}
+	if d.TraceAgent != nil {
+		d.TraceAgent.StartInvocation()
+	}
 }
 
-// FinishInvocation finishes the current invocation
-func (d *Daemon) FinishInvocation() {
-	d.finishInvocationOnce.Do(func() {
-		d.InvcWg.Done()
-	})
+// FinishInvocation finishes the invocation with the given request ID. It can be called
+// several times (at the end of the function AND after a timeout), only the first call is
+// taken into account. An empty request ID finishes the anonymous invocation if any, or
+// the last started one otherwise.
+func (d *Daemon) FinishInvocation(requestID string) {
+	d.finishInvocation(requestID, time.Now())
+}
+
+// finishInvocation finishes the invocation with the given request ID, whose runtime was
+// done at the given time, and clears its custom tags.
+func (d *Daemon) finishInvocation(requestID string, runtimeDoneTime time.Time) {
+	if requestID, finished := d.removeInvocation(requestID); finished {
+		d.clearInvocationTags(requestID)
+		d.HandleRuntimeDone(requestID, runtimeDoneTime)
+	}
 }
 
-// WaitForDaemon waits until invocation finished any pending work
+// removeInvocation removes the invocation with the given request ID from the pending ones,
+// and returns its actual request ID if it was in progress.
+func (d *Daemon) removeInvocation(requestID string) (string, bool) {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
+	if requestID == anonymousInvocation {
+		if _, found := d.invocations[anonymousInvocation]; !found {
+			requestID = d.lastStartedInvocation
+		}
+	}
+	if _, found := d.invocations[requestID]; !found {
+		log.Debugf("Invocation %q is not in progress, nothing to finish", requestID)
+		return requestID, false
+	}
+	delete(d.invocations, requestID)
+	d.InvcWg.Done()
+	d.armInactivityFlushTimer()
+	return requestID, true
+}
+
+// armInactivityFlushTimer (re)starts the inactivity flush timer once no invocation is
+// in progress anymore. The caller must hold invocationsMutex.
+func (d *Daemon) armInactivityFlushTimer() {
+	if d.inactivityFlushTimeout <= 0 || d.stopped || len(d.invocations) > 0 {
+		return
+	}
+	if d.inactivityFlushTimer != nil {
+		d.inactivityFlushTimer.Stop()
+	}
+	d.inactivityFlushTimer = time.AfterFunc(d.inactivityFlushTimeout, d.inactivityFlush)
+}
+
+// stopInactivityFlushTimer stops the inactivity flush timer, if armed.
+func (d *Daemon) stopInactivityFlushTimer() {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
+	if d.inactivityFlushTimer != nil {
+		d.inactivityFlushTimer.Stop()
+		d.inactivityFlushTimer = nil
+	}
+}
+
+// inactivityFlush flushes the data of the last invocations when no new invocation
+// started within the inactivity flush timeout.
+func (d *Daemon) inactivityFlush() {
+	d.invocationsMutex.Lock()
+	if d.stopped || len(d.invocations) > 0 {
+		d.invocationsMutex.Unlock()
+		return
+	}
+	if atomic.LoadInt32(&d.flushesInProgress) > 0 {
+		// don't overlap with the ongoing flush, but still flush what comes after it
+		log.Debug("A flush is in progress, delaying the inactivity flush")
+		d.armInactivityFlushTimer()
+		d.invocationsMutex.Unlock()
+		return
+	}
+	d.inactivityFlushTimer = nil
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("No invocation since %s, flushing", d.inactivityFlushTimeout)
+	atomic.AddInt32(&d.inactivityFlushes, 1)
+	d.TriggerFlush(false)
+}
+
+// pendingInvocations returns the number of invocations started and not finished yet.
+func (d *Daemon) pendingInvocations() int {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
+	return len(d.invocations)
+}
+
+// WaitForDaemon waits until all the pending invocations are finished and the daemon
+// completed any pending work
 func (d *Daemon) WaitForDaemon() {
 	if d.clientLibReady {
 		d.InvcWg.Wait()
@@ -362,11 +837,19 @@ func (d *Daemon) WaitUntilClientReady(timeout time.Duration) bool {
 
 // ComputeGlobalTags extracts tags from the ARN, merges them with any user-defined tags and adds them to traces, logs and metrics
 func (d *Daemon) ComputeGlobalTags(configTags []string) {
-	if len(d.ExtraTags.Tags) == 0 {
+	d.invocationsMutex.Lock()
+	outdated := d.globalTagsOutdated
+	d.globalTagsOutdated = false
+	d.invocationsMutex.Unlock()
+	if len(d.ExtraTags.Tags) == 0 || outdated {
 		tagMap := tags.BuildTagMap(d.ExecutionContext.ARN, configTags)
+		tagMap = tags.AddRuntimeTags(tagMap, d.runtimeTags)
 		tagArray := tags.BuildTagsFromMap(tagMap)
 		if d.MetricAgent != nil {
-			d.MetricAgent.SetExtraTags(tagArray)
+			d.invocationsMutex.Lock()
+			metricTags := d.metricExtraTags(tagArray)
+			d.invocationsMutex.Unlock()
+			d.MetricAgent.SetExtraTags(metricTags)
 		}
 		d.setTraceTags(tagMap)
 		d.ExtraTags.Tags = tagArray
@@ -375,6 +858,11 @@ func (d *Daemon) ComputeGlobalTags(configTags []string) {
 			source.Config.Tags = tagArray
 		}
 	}
+	// the logs received before the execution context was known can be attributed now, without
+	// waiting for the logs agent to consume them
+	if d.logsRoute != nil {
+		go d.logsRoute.Replay()
+	}
 }
 
 // setTraceTags tries to set extra tags to the Trace agent.
@@ -387,11 +875,24 @@ func (d *Daemon) setTraceTags(tagMap map[string]string) bool {
 	return false
 }
 
-// SetExecutionContext sets the current context to the daemon
+// SetExecutionContext sets the current context to the daemon, keeping the request IDs
+// of the previous invocations in a bounded history
 func (d *Daemon) SetExecutionContext(arn string, requestID string) {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
 	d.ExecutionContext.ARN = arn
 	d.ExecutionContext.LastRequestID = requestID
-	if len(d.ExecutionContext.ColdstartRequestID) == 0 {
+	d.ExecutionContext.RequestIDHistory = append(d.ExecutionContext.RequestIDHistory, requestID)
+	if len(d.ExecutionContext.RequestIDHistory) > maxRequestIDHistory {
+		d.ExecutionContext.RequestIDHistory = d.ExecutionContext.RequestIDHistory[len(d.ExecutionContext.RequestIDHistory)-maxRequestIDHistory:]
+	}
+	// the start time finds the invocation restored when the restore is reported once it started
+	d.ExecutionContext.Invocation(requestID).StartTime = time.Now()
+	d.ExecutionContext.Restore = false
+	if d.restorePending {
+		d.restorePending = false
+		d.setRestoredInvocation(requestID)
+	} else if len(d.ExecutionContext.ColdstartRequestID) == 0 {
 		d.ExecutionContext.Coldstart = true
 		d.ExecutionContext.ColdstartRequestID = requestID
 	} else {
@@ -399,9 +900,239 @@ func (d *Daemon) SetExecutionContext(arn string, requestID string) {
 	}
 }
 
+// SetXRayContext parses the X-Ray tracing header of the invocation with the given request ID,
+// set when the function has X-Ray active tracing enabled, so that the invocation span is
+// tagged with the X-Ray IDs and the logs of the invocation are correlated with its trace.
+// The X-Ray context is kept until the logs of the invocation are processed.
+func (d *Daemon) SetXRayContext(requestID string, tracingHeader string) {
+	var xrayContext trace.XRayContext
+	if tracingHeader != "" {
+		var err error
+		if xrayContext, err = trace.ParseXRayTraceHeader(tracingHeader); err != nil {
+			log.Debugf("Unable to parse the X-Ray tracing header of the invocation: %v", err)
+		}
+	}
+
+	if xrayContext.DDTraceID != 0 {
+		d.invocationsMutex.Lock()
+		if requestID == "" {
+			requestID = d.ExecutionContext.LastRequestID
+		}
+		invocation := d.ExecutionContext.Invocation(requestID)
+		invocation.XRayTraceID = strconv.FormatUint(xrayContext.DDTraceID, 10)
+		invocation.XRaySpanID = strconv.FormatUint(xrayContext.DDParentID, 10)
+		d.invocationsMutex.Unlock()
+	}
+
+	if xrayContext.DDTraceID != 0 && d.TraceAgent != nil {
+		d.TraceAgent.SetXRayContext(requestID, xrayContext)
+	}
+}
+
+// SetInvocationTrigger records the trigger of the invocation with the given request ID, or the
+// last one when the request ID isn't known, to tag its span and the enhanced metrics of its
+// report.
+func (d *Daemon) SetInvocationTrigger(requestID string, trigger invocationTrigger) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	d.ExecutionContext.Invocation(requestID).TriggerTags = trigger.metricTags()
+	if trigger.mixedSources {
+		if d.mixedTriggerSources == nil {
+			d.mixedTriggerSources = make(map[string]int64)
+		}
+		d.mixedTriggerSources[trigger.resource]++
+	}
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("Invocation %q triggered by %s", requestID, trigger.eventSource)
+	if trigger.mixedSources {
+		log.Debugf("The records of the event of invocation %q come from several resources, tagging it with the first one %s", requestID, trigger.eventSourceARN)
+	}
+
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetTriggerTags(requestID, trigger.spanTags())
+	}
+}
+
+// takeMixedTriggerSources returns the invocations whose event held records of several resources
+// since the previous call, by resource of their first record
+func (d *Daemon) takeMixedTriggerSources() map[string]int64 {
+	d.invocationsMutex.Lock()
+	defer d.invocationsMutex.Unlock()
+	counts := d.mixedTriggerSources
+	d.mixedTriggerSources = nil
+	return counts
+}
+
+// SetInvocationSpanPointers links the span of the invocation with the given request ID, or the
+// last one when the request ID isn't known, to the operations which produced the objects or the
+// items of its S3 or DynamoDB stream event.
+func (d *Daemon) SetInvocationSpanPointers(requestID string, pointers []spanpointers.SpanPointer) {
+	if requestID == "" {
+		d.invocationsMutex.Lock()
+		requestID = d.ExecutionContext.LastRequestID
+		d.invocationsMutex.Unlock()
+	}
+
+	log.Debugf("Invocation %q linked to %d span pointers", requestID, len(pointers))
+
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetTriggerTags(requestID, map[string]string{spanpointers.SpanLinksTag: spanpointers.SpanLinks(pointers)})
+	}
+}
+
+// SetInvocationStatusCode adds the status code of the response of the invocation with the given
+// request ID, or the last one when the request ID isn't known, to the tags of its trigger. It is
+// ignored if the invocation wasn't triggered by a function URL or an ALB target group.
+func (d *Daemon) SetInvocationStatusCode(requestID string, statusCode string) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	invocation := d.ExecutionContext.FindInvocation(requestID)
+	if invocation == nil || invocation.TriggerTags == nil {
+		d.invocationsMutex.Unlock()
+		return
+	}
+	invocation.TriggerTags = append(invocation.TriggerTags, "http.status_code:"+statusCode)
+	d.invocationsMutex.Unlock()
+
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetTriggerTags(requestID, map[string]string{"http.status_code": statusCode})
+	}
+}
+
+// CapturesPayloads returns whether the spans of the invocations are tagged with their event
+// and their response
+func (d *Daemon) CapturesPayloads() bool {
+	return d.payloadTagger != nil
+}
+
+// HandleInvocationEvent tags the span of the invocation with the given request ID, or the last
+// one when the request ID isn't known, with its redacted event when the payloads are captured.
+// The events are received from the Lambda libraries or from the runtime API proxy.
+func (d *Daemon) HandleInvocationEvent(requestID string, payload []byte) {
+	d.setPayloadTags(requestID, requestPayloadTag, payload)
+}
+
+// HandleInvocationResponse tags the span of the invocation with the given request ID, or the
+// last one when the request ID isn't known, with its redacted response when the payloads are
+// captured. The responses are received from the Lambda libraries or from the runtime API proxy.
+func (d *Daemon) HandleInvocationResponse(requestID string, payload []byte) {
+	d.setPayloadTags(requestID, responsePayloadTag, payload)
+}
+
+func (d *Daemon) setPayloadTags(requestID string, prefix string, payload []byte) {
+	if d.payloadTagger == nil || d.TraceAgent == nil {
+		return
+	}
+	tags := d.payloadTagger.tags(prefix, payload)
+	if len(tags) == 0 {
+		return
+	}
+	if requestID == "" {
+		d.invocationsMutex.Lock()
+		requestID = d.ExecutionContext.LastRequestID
+		d.invocationsMutex.Unlock()
+	}
+	d.TraceAgent.SetTriggerTags(requestID, tags)
+}
+
+// HandleInvocationError reports the error returned by the function for the invocation with
+// the given request ID, or the last one when the request ID isn't known: it sends the
+// aws.lambda.enhanced.errors metric, tags the invocation span with the error and marks the
+// execution context so that the report of the invocation is tagged as failed.
+func (d *Daemon) HandleInvocationError(requestID string, invocationError invocationError) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	initTags := d.ExecutionContext.InitTags(requestID)
+	d.ExecutionContext.FailedRequestID = requestID
+	d.ExecutionContext.FunctionError = invocationError.functionError
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("Invocation %q failed with a %s error of type %s", requestID, invocationError.functionError, invocationError.errorType)
+
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetInvocationError(requestID, invocationError.errorType, invocationError.errorMessage)
+	}
+
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		metricTags := append(append([]string{}, d.ExtraTags.Tags...), initTags...)
+		metricTags = append(metricTags,
+			fmt.Sprintf("error_type:%s", invocationError.errorType),
+			fmt.Sprintf("function_error:%s", invocationError.functionError),
+		)
+		metrics.SendErrorsEnhancedMetric(metricTags, d.MetricAgent.GetMetricChannel())
+	}
+}
+
+// HandleRuntimeResponse sends the enhanced metrics of the response of an invocation proxied to
+// the runtime API. It is only called by the runtime API proxy, the metrics aren't sent when it is
+// disabled.
+func (d *Daemon) HandleRuntimeResponse(stats proxy.ResponseStats) {
+	d.invocationsMutex.Lock()
+	initTags := d.ExecutionContext.InitTags(stats.RequestID)
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("The runtime API acknowledged the response of %q (%d bytes) in %v, %v spent in the proxy", stats.RequestID, stats.Size, stats.Latency, stats.Overhead)
+
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		metricTags := append(append([]string{}, d.ExtraTags.Tags...), initTags...)
+		metrics.SendRuntimeResponseEnhancedMetrics(stats.Latency, stats.Overhead, stats.Size, metricTags, d.MetricAgent.GetMetricChannel())
+	}
+}
+
+// HandleRuntimeDone records that the runtime finished the invocation with the given request ID
+// at the given time, as reported by FinishInvocation or by the runtimeDone log. The earliest
+// report is kept, they can arrive before or after the next call to /next.
+func (d *Daemon) HandleRuntimeDone(requestID string, doneTime time.Time) {
+	if requestID == anonymousInvocation {
+		return
+	}
+	if postRuntime, ok := d.postRuntime.runtimeDone(requestID, doneTime); ok {
+		d.sendPostRuntimeDuration(requestID, postRuntime)
+	}
+}
+
+// HandleNextCall records that the extension called /next at the given time, ending the work
+// done after the last started invocation. It must only be called for the INVOKE events, before
+// the new invocation is started: the time spent before the shutdown isn't measured.
+func (d *Daemon) HandleNextCall(callTime time.Time) {
+	d.invocationsMutex.Lock()
+	requestID := d.lastStartedInvocation
+	d.invocationsMutex.Unlock()
+
+	if requestID == anonymousInvocation {
+		return
+	}
+	if postRuntime, ok := d.postRuntime.nextCall(requestID, callTime); ok {
+		d.sendPostRuntimeDuration(requestID, postRuntime)
+	}
+}
+
+// sendPostRuntimeDuration sends the post-runtime duration of the invocation with the given request ID
+func (d *Daemon) sendPostRuntimeDuration(requestID string, postRuntime postRuntimeDuration) {
+	log.Debugf("The extension spent %v after the runtime of %q (flushed: %t)", postRuntime.duration, requestID, postRuntime.flushed)
+
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		d.invocationsMutex.Lock()
+		initTags := d.ExecutionContext.InitTags(requestID)
+		d.invocationsMutex.Unlock()
+
+		metricTags := append(append([]string{}, d.ExtraTags.Tags...), initTags...)
+		metrics.SendPostRuntimeDurationEnhancedMetric(postRuntime.duration, postRuntime.flushed, postRuntime.end, metricTags, d.MetricAgent.GetMetricChannel())
+	}
+}
+
 // SaveCurrentExecutionContext stores the current context to a file
 func (d *Daemon) SaveCurrentExecutionContext() error {
+	d.invocationsMutex.Lock()
 	file, err := json.Marshal(d.ExecutionContext)
+	d.invocationsMutex.Unlock()
 	if err != nil {
 		return err
 	}
@@ -427,6 +1158,10 @@ func (d *Daemon) RestoreCurrentStateFromFile() error {
 	d.ExecutionContext.LastRequestID = restoredExecutionContext.LastRequestID
 	d.ExecutionContext.LastLogRequestID = restoredExecutionContext.LastLogRequestID
 	d.ExecutionContext.ColdstartRequestID = restoredExecutionContext.ColdstartRequestID
+	d.ExecutionContext.RestoreRequestID = restoredExecutionContext.RestoreRequestID
 	d.ExecutionContext.StartTime = restoredExecutionContext.StartTime
+	d.ExecutionContext.RequestIDHistory = restoredExecutionContext.RequestIDHistory
+	d.ExecutionContext.FailedRequestID = restoredExecutionContext.FailedRequestID
+	d.ExecutionContext.FunctionError = restoredExecutionContext.FunctionError
 	return nil
 }
@@ -6,19 +6,22 @@
 package daemon
 
 import (
+	"fmt"
 	"os"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/config"
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
 	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWaitForDaemonBlocking(t *testing.T) {
 	assert := assert.New(t)
-	d := StartDaemon("http://localhost:8124")
+	d := StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
 
 	// WaitForDaemon doesn't block if the client library hasn't
@@ -29,13 +32,13 @@ func TestWaitForDaemonBlocking(t *testing.T) {
 	// WaitForDaemon blocks if the client library has registered with the extension's /hello route
 	d.clientLibReady = true
 
-	d.StartInvocation()
+	d.StartInvocation("request-1")
 
 	complete := false
 	go func() {
 		<-time.After(100 * time.Millisecond)
 		complete = true
-		d.FinishInvocation()
+		d.FinishInvocation("request-1")
 	}()
 	d.WaitForDaemon()
 	assert.Equal(complete, true, "daemon didn't block until FinishInvocation")
@@ -43,47 +46,177 @@ func TestWaitForDaemonBlocking(t *testing.T) {
 
 func TestWaitUntilReady(t *testing.T) {
 	assert := assert.New(t)
-	d := StartDaemon("http://localhost:8124")
+	d := StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
 
 	ready := d.WaitUntilClientReady(50 * time.Millisecond)
 	assert.Equal(ready, false, "client was ready")
 }
 
-func GetValueSyncOnce(so *sync.Once) uint64 {
-	return reflect.ValueOf(so).Elem().FieldByName("done").Uint()
+func TestFinishInvocationStartOnly(t *testing.T) {
+	assert := assert.New(t)
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+
+	d.StartInvocation("request-1")
+	assert.Equal(1, d.pendingInvocations())
+}
+
+func TestFinishInvocationStartAndEnd(t *testing.T) {
+	assert := assert.New(t)
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+
+	d.StartInvocation("request-1")
+	d.FinishInvocation("request-1")
+
+	assert.Equal(0, d.pendingInvocations())
 }
 
-func TestFinishInvocationOnceStartOnly(t *testing.T) {
+func TestFinishInvocationStartAndEndAndTimeout(t *testing.T) {
 	assert := assert.New(t)
-	d := StartDaemon("http://localhost:8124")
+	d := StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
 
-	d.StartInvocation()
-	assert.Equal(uint64(0), GetValueSyncOnce(&d.finishInvocationOnce))
+	d.StartInvocation("request-1")
+	d.FinishInvocation("request-1")
+	// would panic with a negative WaitGroup counter if it wasn't ignored
+	d.FinishInvocation("request-1")
+
+	assert.Equal(0, d.pendingInvocations())
 }
 
-func TestFinishInvocationOnceStartAndEnd(t *testing.T) {
+func TestFinishInvocationAnonymous(t *testing.T) {
 	assert := assert.New(t)
-	d := StartDaemon("http://localhost:8124")
+	d := StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
 
-	d.StartInvocation()
-	d.FinishInvocation()
+	d.StartInvocation("")
+	d.StartInvocation("")
+	assert.Equal(1, d.pendingInvocations())
+	d.FinishInvocation("")
+	d.FinishInvocation("")
+	assert.Equal(0, d.pendingInvocations())
+
+	// without request ID, the last started invocation is finished
+	d.StartInvocation("request-1")
+	d.StartInvocation("request-2")
+	d.FinishInvocation("")
+	assert.Equal(1, d.pendingInvocations())
+	d.FinishInvocation("request-1")
+	assert.Equal(0, d.pendingInvocations())
+}
+
+func TestOverlappingInvocations(t *testing.T) {
+	assert := assert.New(t)
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+	d.clientLibReady = true
+
+	d.StartInvocation("request-1")
+	d.StartInvocation("request-2")
+
+	finished := make(chan string, 2)
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		finished <- "request-1"
+		d.FinishInvocation("request-1")
+		// a late timeout of the first invocation doesn't finish the second one
+		d.FinishInvocation("request-1")
+		<-time.After(50 * time.Millisecond)
+		finished <- "request-2"
+		d.FinishInvocation("request-2")
+	}()
+	d.WaitForDaemon()
+	close(finished)
 
-	assert.Equal(uint64(1), GetValueSyncOnce(&d.finishInvocationOnce))
+	var order []string
+	for requestID := range finished {
+		order = append(order, requestID)
+	}
+	assert.Equal([]string{"request-1", "request-2"}, order, "daemon didn't wait for all the invocations")
+	assert.Equal(0, d.pendingInvocations())
 }
 
-func TestFinishInvocationOnceStartAndEndAndTimeout(t *testing.T) {
+func TestConcurrentInvocations(t *testing.T) {
 	assert := assert.New(t)
-	d := StartDaemon("http://localhost:8124")
+	d := StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
+	d.clientLibReady = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(requestID string) {
+			defer wg.Done()
+			d.StartInvocation(requestID)
+			d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:my-function", requestID)
+			// end of the function and timeout racing each other
+			go d.FinishInvocation(requestID)
+			d.FinishInvocation(requestID)
+		}(fmt.Sprintf("request-%d", i))
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		d.WaitForDaemon()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("daemon is still waiting for finished invocations")
+	}
+	assert.Equal(0, d.pendingInvocations())
+	assert.Len(d.ExecutionContext.RequestIDHistory, maxRequestIDHistory)
+}
 
-	d.StartInvocation()
-	d.FinishInvocation()
-	d.FinishInvocation()
+func TestSetExecutionContextHistory(t *testing.T) {
+	assert := assert.New(t)
+	d := Daemon{ExecutionContext: &serverlessLog.ExecutionContext{}}
 
-	assert.Equal(uint64(1), GetValueSyncOnce(&d.finishInvocationOnce))
+	for i := 0; i < maxRequestIDHistory+2; i++ {
+		d.SetExecutionContext("arn", fmt.Sprintf("request-%d", i))
+	}
+	assert.Equal("request-11", d.ExecutionContext.LastRequestID)
+	assert.Equal("request-0", d.ExecutionContext.ColdstartRequestID)
+	assert.Len(d.ExecutionContext.RequestIDHistory, maxRequestIDHistory)
+	assert.Equal("request-2", d.ExecutionContext.RequestIDHistory[0])
+	assert.Equal("request-11", d.ExecutionContext.RequestIDHistory[maxRequestIDHistory-1])
+}
+
+func TestSetXRayContext(t *testing.T) {
+	assert := assert.New(t)
+	d := Daemon{ExecutionContext: &serverlessLog.ExecutionContext{}}
+
+	d.SetXRayContext("request-1", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	invocation := d.ExecutionContext.FindInvocation("request-1")
+	assert.NotNil(invocation)
+	assert.Equal("7043144561403045779", invocation.XRayTraceID)
+	assert.Equal("6023947403358210776", invocation.XRaySpanID)
+
+	// an invalid header or an invocation without X-Ray context has no X-Ray context, the one of
+	// the previous invocation being kept for its late logs
+	d.SetXRayContext("request-2", "Root=invalid")
+	assert.Nil(d.ExecutionContext.FindInvocation("request-2"))
+	d.SetXRayContext("request-3", "")
+	assert.Nil(d.ExecutionContext.FindInvocation("request-3"))
+	assert.Equal("7043144561403045779", d.ExecutionContext.FindInvocation("request-1").XRayTraceID)
+}
+
+func TestComputeGlobalTagsRuntimeTags(t *testing.T) {
+	d := Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:my-function"},
+		ExtraTags:        &serverlessLog.Tags{},
+		runtimeTags:      map[string]string{"runtime": "nodejs18.x", "runtime_version": "18.x", "architecture": "arm64"},
+	}
+	d.ComputeGlobalTags([]string{"architecture:x86_64"})
+	assert.Contains(t, d.ExtraTags.Tags, "runtime:nodejs18.x")
+	assert.Contains(t, d.ExtraTags.Tags, "runtime_version:18.x")
+	// the tags set by the user win
+	assert.Contains(t, d.ExtraTags.Tags, "architecture:x86_64")
+	assert.NotContains(t, d.ExtraTags.Tags, "architecture:arm64")
 }
 
 func TestSetTraceTagNoop(t *testing.T) {
@@ -120,3 +253,93 @@ func TestSetTraceTagOk(t *testing.T) {
 	}
 	assert.True(t, d.setTraceTags(tagsMap))
 }
+
+func TestInactivityFlushDisabled(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+
+	d.StartInvocation("myRequestID")
+	d.FinishInvocation("myRequestID")
+	assert.Nil(t, d.inactivityFlushTimer)
+}
+
+func TestInactivityFlush(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+	d.inactivityFlushTimeout = 50 * time.Millisecond
+
+	d.StartInvocation("myRequestID")
+	d.FinishInvocation("myRequestID")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&d.inactivityFlushes) == 1 }, time.Second, 10*time.Millisecond)
+
+	// only one flush per inactivity period
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.inactivityFlushes))
+}
+
+func TestInactivityFlushResetByInvocation(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+	d.inactivityFlushTimeout = 100 * time.Millisecond
+
+	d.StartInvocation("myRequestID1")
+	d.FinishInvocation("myRequestID1")
+	time.Sleep(50 * time.Millisecond)
+	d.StartInvocation("myRequestID2")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&d.inactivityFlushes))
+
+	d.FinishInvocation("myRequestID2")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&d.inactivityFlushes) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestInactivityFlushDelayedByFlushInProgress(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+	d.inactivityFlushTimeout = 50 * time.Millisecond
+
+	atomic.AddInt32(&d.flushesInProgress, 1)
+	d.StartInvocation("myRequestID")
+	d.FinishInvocation("myRequestID")
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&d.inactivityFlushes))
+
+	atomic.AddInt32(&d.flushesInProgress, -1)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&d.inactivityFlushes) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestInactivityFlushStoppedByStop(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	d.inactivityFlushTimeout = 50 * time.Millisecond
+
+	d.StartInvocation("myRequestID")
+	d.FinishInvocation("myRequestID")
+	d.Stop()
+	assert.Nil(t, d.inactivityFlushTimer)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&d.inactivityFlushes))
+}
+
+func TestMetricsSoftLimitFlush(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+
+	d.handleMetricsSoftLimit()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&d.earlyFlushes) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&d.earlyFlushPending) == 0 }, time.Second, 10*time.Millisecond)
+
+	// a single early flush runs at a time
+	atomic.StoreInt32(&d.earlyFlushPending, 1)
+	d.handleMetricsSoftLimit()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.earlyFlushes))
+}
+
+func TestStructuredLogsMaxSize(t *testing.T) {
+	defer config.Datadog.Set("logs_config.processing_rules", nil)
+	assert.Equal(t, 64*1024, structuredLogsMaxSize())
+
+	// the promoted attributes would bypass the processing rules
+	config.Datadog.Set("logs_config.processing_rules", `[{"type":"mask_sequences","name":"mask_tokens","replace_placeholder":"[masked]","pattern":"token=\\w+"}]`)
+	assert.Equal(t, 0, structuredLogsMaxSize())
+}
@@ -20,6 +20,9 @@ const maxInvocationsStored = 10
 // When trying to store a new point, if it is older than the last one stored, it is ignored.
 // Returns if the point has been stored.
 func (d *Daemon) StoreInvocationTime(t time.Time) bool {
+	d.lastInvocationsMutex.Lock()
+	defer d.lastInvocationsMutex.Unlock()
+
 	// ignore points older than the last stored one
 	if len(d.lastInvocations) > 0 && d.lastInvocations[len(d.lastInvocations)-1].After(t) {
 		return false
@@ -34,9 +37,22 @@ func (d *Daemon) StoreInvocationTime(t time.Time) bool {
 	return true
 }
 
+// discardLastInvocationTime removes the last stored invocation time, used when the
+// invocation turns out to be a warm-up request which would skew the invocation interval.
+func (d *Daemon) discardLastInvocationTime() {
+	d.lastInvocationsMutex.Lock()
+	defer d.lastInvocationsMutex.Unlock()
+	if len(d.lastInvocations) > 0 {
+		d.lastInvocations = d.lastInvocations[:len(d.lastInvocations)-1]
+	}
+}
+
 // InvocationInterval computes the invocation interval of the current function.
 // This function returns 0 if not enough invocations were done.
 func (d *Daemon) InvocationInterval() time.Duration {
+	d.lastInvocationsMutex.Lock()
+	defer d.lastInvocationsMutex.Unlock()
+
 	// with less than 3 invocations, we don't have enough data to compute
 	// something reliable.
 	if len(d.lastInvocations) < 3 {
@@ -0,0 +1,111 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// functionErrorHeader tells whether the response of the function is an error, its value
+// is "Handled" or "Unhandled" as in the response of the Lambda Invoke API
+const functionErrorHeader = "X-Amz-Function-Error"
+
+// maxResponsePayloadSize is the maximum size of the function response read to find
+// its error, larger responses are truncated before being parsed
+const maxResponsePayloadSize = 64 * 1024
+
+// maxErrorMessageSize is the maximum size of the error message set on the invocation span
+const maxErrorMessageSize = 1024
+
+const (
+	functionErrorHandled   = "handled"
+	functionErrorUnhandled = "unhandled"
+	functionErrorUnknown   = "unknown"
+	unknownErrorType       = "Unknown"
+)
+
+// invocationError is the error returned by the function in its response
+type invocationError struct {
+	errorType    string
+	errorMessage string
+	// functionError is handled, unhandled or unknown when the header isn't provided
+	functionError string
+}
+
+// parseInvocationError returns the error of a function response, from the value of the
+// X-Amz-Function-Error header and the response payload. The payload of an error looks like
+// {"errorType": "...", "errorMessage": "...", "stackTrace": [...]}. It is parsed as a stream
+// so that the type and message are still found when the payload has been truncated.
+func parseInvocationError(functionErrorHeaderValue string, payload []byte) (invocationError, bool) {
+	errorType, errorMessage := parseErrorPayload(payload)
+
+	var functionError string
+	switch strings.ToLower(functionErrorHeaderValue) {
+	case functionErrorHandled:
+		functionError = functionErrorHandled
+	case functionErrorUnhandled:
+		functionError = functionErrorUnhandled
+	case "":
+		// without the header, only a payload shaped like an error tells the invocation failed
+		if errorType == "" {
+			return invocationError{}, false
+		}
+		functionError = functionErrorUnknown
+	default:
+		functionError = functionErrorUnknown
+	}
+
+	if errorType == "" {
+		errorType = unknownErrorType
+	}
+	if len(errorMessage) > maxErrorMessageSize {
+		errorMessage = errorMessage[:maxErrorMessageSize] + "..."
+	}
+	return invocationError{
+		errorType:     errorType,
+		errorMessage:  errorMessage,
+		functionError: functionError,
+	}, true
+}
+
+// parseErrorPayload returns the errorType and errorMessage fields of a response payload,
+// empty if the payload isn't a JSON object or doesn't have them
+func parseErrorPayload(payload []byte) (errorType string, errorMessage string) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", ""
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		key, _ := token.(string)
+		switch key {
+		case "errorType", "errorMessage":
+			var value string
+			if err := decoder.Decode(&value); err != nil {
+				return
+			}
+			if key == "errorType" {
+				errorType = value
+			} else {
+				errorMessage = value
+			}
+		default:
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return
+			}
+		}
+		if errorType != "" && errorMessage != "" {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInvocationError(t *testing.T) {
+	assert := assert.New(t)
+	errorPayload := []byte(`{"errorType":"TypeError","errorMessage":"undefined is not a function","stackTrace":["at handler (index.js:3:9)"]}`)
+
+	invocationError, isError := parseInvocationError("Unhandled", errorPayload)
+	assert.True(isError)
+	assert.Equal(invocationError{errorType: "TypeError", errorMessage: "undefined is not a function", functionError: "unhandled"}, invocationError)
+
+	invocationError, isError = parseInvocationError("Handled", []byte(`"not an error object"`))
+	assert.True(isError)
+	assert.Equal(invocationError{errorType: "Unknown", functionError: "handled"}, invocationError)
+
+	// without the header, the payload tells whether the invocation failed
+	invocationError, isError = parseInvocationError("", errorPayload)
+	assert.True(isError)
+	assert.Equal("unknown", invocationError.functionError)
+
+	_, isError = parseInvocationError("", []byte(`{"statusCode":200,"body":"ok"}`))
+	assert.False(isError)
+	_, isError = parseInvocationError("", nil)
+	assert.False(isError)
+}
+
+func TestParseInvocationErrorTruncatedPayload(t *testing.T) {
+	assert := assert.New(t)
+	payload := `{"errorType":"MemoryError","errorMessage":"` + strings.Repeat("x", 2*maxErrorMessageSize) + `","stackTrace":["` + strings.Repeat("y", maxResponsePayloadSize)
+	truncated := []byte(payload[:maxResponsePayloadSize])
+
+	invocationError, isError := parseInvocationError("Unhandled", truncated)
+	assert.True(isError)
+	assert.Equal("MemoryError", invocationError.errorType)
+	assert.Len(invocationError.errorMessage, maxErrorMessageSize+len("..."))
+}
+
+func TestEndInvocationRoute(t *testing.T) {
+	assert := assert.New(t)
+	d := &Daemon{ExecutionContext: &serverlessLog.ExecutionContext{}, ExtraTags: &serverlessLog.Tags{}}
+	d.SetExecutionContext("arn", "request-1")
+	d.SetExecutionContext("arn", "request-2")
+
+	request := httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(`{"statusCode":200}`))
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Empty(d.ExecutionContext.FailedRequestID)
+
+	request = httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(`{"errorType":"Error","errorMessage":"boom"}`))
+	request.Header.Set(functionErrorHeader, "Handled")
+	request.Header.Set(requestIDHeader, "request-1")
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal("request-1", d.ExecutionContext.FailedRequestID)
+	assert.Equal("handled", d.ExecutionContext.FunctionError)
+
+	// the last invocation is used when the request ID isn't known
+	request = httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(`{"errorType":"Error","errorMessage":"boom"}`))
+	request.Header.Set(functionErrorHeader, "Unhandled")
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal("request-2", d.ExecutionContext.FailedRequestID)
+	assert.Equal("unhandled", d.ExecutionContext.FunctionError)
+}
@@ -0,0 +1,200 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// maxInvocationTagsPayloadSize bounds the size of the body read on the InvocationTags route
+	maxInvocationTagsPayloadSize = 8192
+
+	// maxInvocationTags bounds the number of custom tags of an invocation
+	maxInvocationTags = 20
+
+	// maxInvocationTagKeyLength and maxInvocationTagValueLength bound the length of the keys and
+	// the values of the custom tags of an invocation
+	maxInvocationTagKeyLength   = 100
+	maxInvocationTagValueLength = 200
+)
+
+// reservedInvocationTags are the keys of the tags set by the extension which the custom tags
+// of an invocation can't override
+var reservedInvocationTags = map[string]bool{
+	"service":      true,
+	"env":          true,
+	"version":      true,
+	"function_arn": true,
+}
+
+// parseInvocationTags parses the custom tags of an invocation, a JSON object of string values
+func parseInvocationTags(payload []byte) (map[string]string, error) {
+	var invocationTags map[string]string
+	if err := json.Unmarshal(payload, &invocationTags); err != nil {
+		return nil, fmt.Errorf("invalid invocation tags, they must be a JSON object of strings: %v", err)
+	}
+	if len(invocationTags) == 0 {
+		return nil, fmt.Errorf("no invocation tags")
+	}
+	if len(invocationTags) > maxInvocationTags {
+		return nil, fmt.Errorf("too many invocation tags: %d, the maximum is %d", len(invocationTags), maxInvocationTags)
+	}
+	for key, value := range invocationTags {
+		if err := validateInvocationTag(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return invocationTags, nil
+}
+
+// validateInvocationTag returns an error if the custom tag of an invocation is invalid or
+// conflicts with a reserved tag
+func validateInvocationTag(key string, value string) error {
+	switch {
+	case key == "" || strings.TrimSpace(key) != key:
+		return fmt.Errorf("invalid invocation tag key %q", key)
+	case strings.Contains(key, ":"):
+		return fmt.Errorf("invalid invocation tag key %q, it can't contain a colon", key)
+	case len(key) > maxInvocationTagKeyLength:
+		return fmt.Errorf("invocation tag key %q is longer than %d characters", key, maxInvocationTagKeyLength)
+	case len(value) > maxInvocationTagValueLength:
+		return fmt.Errorf("value of the invocation tag %q is longer than %d characters", key, maxInvocationTagValueLength)
+	case reservedInvocationTags[strings.ToLower(key)]:
+		return fmt.Errorf("invocation tag %q conflicts with a reserved tag", key)
+	}
+	return nil
+}
+
+// InvocationTags is the route on which the function sets custom tags, such as a tenant ID,
+// attached to the metrics, the span and the logs of the invocation in progress.
+type InvocationTags struct {
+	daemon *Daemon
+}
+
+// ServeHTTP - see type InvocationTags comment.
+// Returns 202 once the tags are set, 413 when the payload is too large, and 400 when the tags
+// are invalid or conflict with a reserved tag.
+func (i *InvocationTags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > maxInvocationTagsPayloadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	// one byte more than the max payload size is read to detect the payloads without a content length over it
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInvocationTagsPayloadSize+1))
+	if err != nil {
+		log.Debugf("Unable to read the invocation tags: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxInvocationTagsPayloadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	invocationTags, err := parseInvocationTags(body)
+	if err != nil {
+		log.Debugf("Rejected the invocation tags: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := i.daemon.SetInvocationTags(r.Header.Get(requestIDHeader), invocationTags); err != nil {
+		log.Debugf("Rejected the invocation tags: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SetInvocationTags adds custom tags to the ones of the invocation with the given request ID,
+// or the last one when the request ID isn't known. They tag its span and its logs, and the metrics
+// received by DogStatsD until the invocation finishes. It returns an error when the tags of
+// the invocation would be over the maximum number of tags.
+func (d *Daemon) SetInvocationTags(requestID string, invocationTags map[string]string) error {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	merged := make(map[string]string, len(invocationTags))
+	if requestID == d.ExecutionContext.InvocationTagsRequestID {
+		for key, value := range d.invocationTags {
+			merged[key] = value
+		}
+	}
+	for key, value := range invocationTags {
+		merged[key] = value
+	}
+	if len(merged) > maxInvocationTags {
+		d.invocationsMutex.Unlock()
+		return fmt.Errorf("too many invocation tags: %d, the maximum is %d", len(merged), maxInvocationTags)
+	}
+	d.invocationTags = merged
+	d.ExecutionContext.InvocationTagsRequestID = requestID
+	d.ExecutionContext.InvocationTags = buildInvocationTagArray(merged)
+	// the logs of the invocation are received asynchronously, they keep its tags until they are processed
+	d.ExecutionContext.Invocation(requestID).Tags = d.ExecutionContext.InvocationTags
+	metricTags := d.metricExtraTags(d.ExtraTags.Tags)
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("Invocation %q tagged with %d custom tags", requestID, len(merged))
+
+	if d.MetricAgent != nil {
+		d.MetricAgent.SetExtraTags(metricTags)
+	}
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetTriggerTags(requestID, invocationTags)
+	}
+	return nil
+}
+
+// clearInvocationTags removes the custom tags of the invocation with the given request ID once it
+// is finished, so that they aren't attached to the data of the next invocations. The anonymous
+// invocation clears the tags of any invocation.
+func (d *Daemon) clearInvocationTags(requestID string) {
+	d.invocationsMutex.Lock()
+	if d.ExecutionContext.InvocationTags == nil ||
+		(requestID != anonymousInvocation && requestID != d.ExecutionContext.InvocationTagsRequestID) {
+		d.invocationsMutex.Unlock()
+		return
+	}
+	d.invocationTags = nil
+	d.ExecutionContext.InvocationTagsRequestID = ""
+	d.ExecutionContext.InvocationTags = nil
+	metricTags := d.ExtraTags.Tags
+	d.invocationsMutex.Unlock()
+
+	if d.MetricAgent != nil {
+		d.MetricAgent.SetExtraTags(metricTags)
+	}
+}
+
+// metricExtraTags returns the given global tags followed by the custom tags of the invocation in
+// progress, if any. The caller must hold invocationsMutex.
+func (d *Daemon) metricExtraTags(globalTags []string) []string {
+	if len(d.ExecutionContext.InvocationTags) == 0 {
+		return globalTags
+	}
+	return append(globalTags[:len(globalTags):len(globalTags)], d.ExecutionContext.InvocationTags...)
+}
+
+// buildInvocationTagArray returns the custom tags of an invocation as key:value tags, sorted by key
+func buildInvocationTagArray(invocationTags map[string]string) []string {
+	tagArray := make([]string, 0, len(invocationTags))
+	for key, value := range invocationTags {
+		tagArray = append(tagArray, key+":"+value)
+	}
+	sort.Strings(tagArray)
+	return tagArray
+}
@@ -0,0 +1,154 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+)
+
+func newInvocationTagsTestDaemon() *Daemon {
+	return &Daemon{
+		InvcWg:           &sync.WaitGroup{},
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{Tags: []string{"function_name:my-function"}},
+		invocations:      make(map[string]struct{}),
+		postRuntime:      newPostRuntimeTracker(),
+	}
+}
+
+// postInvocationTags sends the payload to the InvocationTags route and returns the status code
+func postInvocationTags(d *Daemon, payload string, requestID string) int {
+	request := httptest.NewRequest(http.MethodPost, "/lambda/tags", strings.NewReader(payload))
+	if requestID != "" {
+		request.Header.Set(requestIDHeader, requestID)
+	}
+	recorder := httptest.NewRecorder()
+	(&InvocationTags{d}).ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestInvocationTagsRoute(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+	d.SetExecutionContext("arn", "request-1")
+	d.StartInvocation("request-1")
+
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"tenant":"acme"}`, "request-1"))
+	// the tags of several calls are merged, the last value of a key wins
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"cohort":"beta","tenant":"globex"}`, ""))
+	assert.Equal(t, "request-1", d.ExecutionContext.InvocationTagsRequestID)
+	assert.Equal(t, []string{"cohort:beta", "tenant:globex"}, d.ExecutionContext.InvocationTags)
+	assert.Equal(t, []string{"function_name:my-function", "cohort:beta", "tenant:globex"}, d.metricExtraTags(d.ExtraTags.Tags))
+	// the global tags aren't modified
+	assert.Equal(t, []string{"function_name:my-function"}, d.ExtraTags.Tags)
+}
+
+func TestInvocationTagsRouteInvalidPayloads(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+	d.SetExecutionContext("arn", "request-1")
+
+	tooMany := make([]string, 0, maxInvocationTags+1)
+	for i := 0; i <= maxInvocationTags; i++ {
+		tooMany = append(tooMany, fmt.Sprintf(`"key%d":"value"`, i))
+	}
+	for _, payload := range []string{
+		``,
+		`not json`,
+		`{}`,
+		`["tenant:acme"]`,
+		`{"tenant":42}`,
+		`{"":"acme"}`,
+		`{"tenant:id":"acme"}`,
+		`{" tenant":"acme"}`,
+		`{"` + strings.Repeat("k", maxInvocationTagKeyLength+1) + `":"acme"}`,
+		`{"tenant":"` + strings.Repeat("v", maxInvocationTagValueLength+1) + `"}`,
+		`{` + strings.Join(tooMany, ",") + `}`,
+		// the reserved tags are set by the extension
+		`{"service":"other"}`,
+		`{"ENV":"prod"}`,
+		`{"version":"2"}`,
+		`{"function_arn":"arn"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, postInvocationTags(d, payload, ""), payload)
+	}
+	assert.Nil(t, d.ExecutionContext.InvocationTags)
+}
+
+func TestInvocationTagsRouteMaxTags(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+	d.SetExecutionContext("arn", "request-1")
+
+	for i := 0; i < maxInvocationTags; i++ {
+		assert.Equal(t, http.StatusAccepted, postInvocationTags(d, fmt.Sprintf(`{"key%d":"value"}`, i), ""))
+	}
+	// the tags merged over several calls are bounded too
+	assert.Equal(t, http.StatusBadRequest, postInvocationTags(d, `{"tenant":"acme"}`, ""))
+	assert.Len(t, d.ExecutionContext.InvocationTags, maxInvocationTags)
+	// updating a tag already set is still possible
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"key0":"updated"}`, ""))
+}
+
+func TestInvocationTagsRoutePayloadSize(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+	large := `{"tenant":"` + strings.Repeat("a", maxInvocationTagsPayloadSize) + `"}`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postInvocationTags(d, large, ""))
+
+	// the payloads without a content length are bounded too
+	request := httptest.NewRequest(http.MethodPost, "/lambda/tags", ioutil.NopCloser(strings.NewReader(large)))
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	(&InvocationTags{d}).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+}
+
+func TestInvocationTagsScopedToInvocation(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+
+	d.SetExecutionContext("arn", "request-1")
+	d.StartInvocation("request-1")
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"tenant":"acme"}`, "request-1"))
+	assert.Equal(t, []string{"tenant:acme"}, d.ExecutionContext.InvocationTags)
+	d.FinishInvocation("request-1")
+	// the logs of the invocation, received asynchronously, keep its tags
+	assert.Equal(t, []string{"tenant:acme"}, d.ExecutionContext.FindInvocation("request-1").Tags)
+
+	// the tags of the previous invocation aren't attached to the logs and the metrics of the next one
+	d.SetExecutionContext("arn", "request-2")
+	d.StartInvocation("request-2")
+	assert.Empty(t, d.ExecutionContext.InvocationTagsRequestID)
+	assert.Nil(t, d.ExecutionContext.InvocationTags)
+	assert.Equal(t, []string{"function_name:my-function"}, d.metricExtraTags(d.ExtraTags.Tags))
+
+	// nor merged with its own tags
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"cohort":"beta"}`, "request-2"))
+	assert.Equal(t, []string{"cohort:beta"}, d.ExecutionContext.InvocationTags)
+
+	// the end of another invocation doesn't clear them
+	d.FinishInvocation("request-1")
+	assert.Equal(t, []string{"cohort:beta"}, d.ExecutionContext.InvocationTags)
+	d.FinishInvocation("request-2")
+	assert.Nil(t, d.ExecutionContext.InvocationTags)
+}
+
+func TestInvocationTagsClearedByAnonymousInvocation(t *testing.T) {
+	d := newInvocationTagsTestDaemon()
+
+	d.SetExecutionContext("arn", "request-1")
+	d.StartInvocation(anonymousInvocation)
+	assert.Equal(t, http.StatusAccepted, postInvocationTags(d, `{"tenant":"acme"}`, ""))
+	assert.Equal(t, "request-1", d.ExecutionContext.InvocationTagsRequestID)
+	d.FinishInvocation(anonymousInvocation)
+	assert.Nil(t, d.ExecutionContext.InvocationTags)
+}
@@ -0,0 +1,44 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// handleMetricsSoftLimit flushes early when the memory used by the metrics aggregated since
+// the last flush reaches the soft limit. It is called by the aggregator and doesn't block,
+// a single early flush runs at a time.
+func (d *Daemon) handleMetricsSoftLimit() {
+	if !atomic.CompareAndSwapInt32(&d.earlyFlushPending, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&d.earlyFlushPending, 0)
+		d.invocationsMutex.Lock()
+		stopped := d.stopped
+		d.invocationsMutex.Unlock()
+		if stopped {
+			return
+		}
+		log.Debug("The aggregated metrics reached the memory soft limit, flushing early")
+		atomic.AddInt32(&d.earlyFlushes, 1)
+		d.TriggerFlush(false)
+	}()
+}
+
+// metricsMemoryUsage returns the estimated memory used by the aggregated metrics, nil when
+// the DogStatsD server isn't ready
+func (d *Daemon) metricsMemoryUsage() *metrics.MemoryUsage {
+	if d.MetricAgent == nil || !d.MetricAgent.IsReady() {
+		return nil
+	}
+	usage := d.MetricAgent.MemoryUsage()
+	return &usage
+}
@@ -0,0 +1,296 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	traceConfig "github.com/DataDog/datadog-agent/pkg/trace/config"
+	"github.com/DataDog/datadog-agent/pkg/trace/traceutil"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// requestPayloadTag and responsePayloadTag prefix the tags of the event and the response of an invocation
+	requestPayloadTag  = "function.request"
+	responsePayloadTag = "function.response"
+
+	// redactedValue replaces the values of the secrets found in the payloads
+	redactedValue = "redacted"
+
+	// maxPayloadSize is the maximum size of the payloads flattened into tags, larger payloads
+	// are truncated by the routes and the proxy and can't be parsed
+	maxPayloadSize = maxEventPayloadSize
+
+	// maxPayloadTags is the maximum number of tags set from a payload, the next ones are dropped
+	maxPayloadTags = 128
+
+	// maxPayloadTagValueSize is the maximum size of the value of a tag set from a payload, the
+	// values are truncated once redacted
+	maxPayloadTagValueSize = 1024
+)
+
+// secretKeys are the parts of the keys whose values are redacted whatever the rules, once
+// lowercased and stripped of their dashes and underscores: the Authorization headers, the
+// cookies and the usual names of the secrets
+var secretKeys = []string{
+	"authorization",
+	"cookie",
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"apikey",
+	"accesskey",
+	"privatekey",
+	"credential",
+	"signature",
+}
+
+// defaultPayloadRules redact the secrets found in the values themselves, such as the tokens
+// of the query strings and of the form bodies or the credentials of the Authorization header
+// forwarded under another name. They apply before the configured rules.
+var defaultPayloadRules = []*traceConfig.ReplaceRule{
+	{
+		Name:    "*",
+		Pattern: `(?i)\b(bearer|basic|digest)\s+[^\s,;"]+`,
+		Repl:    "${1} " + redactedValue,
+	},
+	{
+		Name:    "*",
+		Pattern: `(?i)((?:^|[?&;\s])[\w.\-\[\]]*(?:authorization|cookie|password|passwd|secret|token|api[_\-]?key|access[_\-]?key|private[_\-]?key|credential|signature)[\w.\-\[\]]*=)[^&;\s]*`,
+		Repl:    "${1}" + redactedValue,
+	},
+}
+
+// payloadRule redacts the values found at the paths of a payload matching its path
+type payloadRule struct {
+	// path holds the keys of the path, * matching any key or index. A rule anchored at the
+	// root of the payload only matches its whole path, otherwise it matches its end.
+	path     []string
+	anchored bool
+	// re is matched against the leaf values and replaced with repl, when nil the whole
+	// value is replaced, including the objects and the arrays
+	re   *regexp.Regexp
+	repl string
+}
+
+// newPayloadRule compiles a rule in the format of apm_config.replace_tags, its name being
+// the path of the values it redacts in the payload, such as $.headers.x-auth or
+// body.*.ssn. The pattern is optional, the whole value is redacted without one.
+func newPayloadRule(rule *traceConfig.ReplaceRule) (*payloadRule, error) {
+	name := strings.TrimSpace(rule.Name)
+	if name == "" {
+		return nil, errors.New(`all rules must have a "name" property (use "*" to target all)`)
+	}
+	r := &payloadRule{repl: rule.Repl}
+	if strings.HasPrefix(name, "$.") {
+		r.anchored = true
+		name = strings.TrimPrefix(name, "$.")
+	}
+	r.path = strings.Split(name, ".")
+	if rule.Pattern != "" {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", rule.Name, err)
+		}
+		r.re = re
+	} else if r.repl == "" {
+		r.repl = redactedValue
+	}
+	return r, nil
+}
+
+// matches returns whether the rule targets the value at the given path
+func (r *payloadRule) matches(path []string) bool {
+	if len(path) < len(r.path) || (r.anchored && len(path) != len(r.path)) {
+		return false
+	}
+	suffix := path[len(path)-len(r.path):]
+	for i, key := range r.path {
+		if key != "*" && !strings.EqualFold(key, suffix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAll returns whether the rule targets all the values, including a payload which
+// is a single value
+func (r *payloadRule) matchesAll() bool {
+	return len(r.path) == 1 && r.path[0] == "*"
+}
+
+// payloadTagger flattens the events and the responses of the invocations into tags of their
+// span, such as function.request.headers.host, after redacting their secrets. The same tagger
+// handles the payloads received on the routes of the daemon and through the runtime API proxy.
+type payloadTagger struct {
+	// maxDepth is the maximum depth of the values flattened, the deeper ones are dropped
+	// as they aren't inspected by the rules
+	maxDepth int
+	rules    []*payloadRule
+}
+
+// newPayloadTagger returns a tagger applying the default rules and the given ones, the
+// invalid rules are ignored
+func newPayloadTagger(maxDepth int, rules []*traceConfig.ReplaceRule) *payloadTagger {
+	t := &payloadTagger{maxDepth: maxDepth}
+	for _, rule := range append(append([]*traceConfig.ReplaceRule{}, defaultPayloadRules...), rules...) {
+		r, err := newPayloadRule(rule)
+		if err != nil {
+			log.Errorf("Ignoring the payload redaction rule %q: %s", rule.Name, err)
+			continue
+		}
+		t.rules = append(t.rules, r)
+	}
+	return t
+}
+
+// newPayloadTaggerFromConfig returns the payload tagger configured, nil when the payloads
+// aren't captured
+func newPayloadTaggerFromConfig() *payloadTagger {
+	if !config.Datadog.GetBool("serverless.capture_lambda_payload") {
+		return nil
+	}
+	var rules []*traceConfig.ReplaceRule
+	if k := "serverless.payload_redaction_rules"; config.Datadog.IsSet(k) {
+		if err := config.Datadog.UnmarshalKey(k, &rules); err != nil {
+			log.Errorf(`Bad format for %q it should be of the form '[{"name": "path.of.value","pattern":"pattern","repl":"replace_str"}]', error: %v`, k, err)
+		}
+	}
+	return newPayloadTagger(config.Datadog.GetInt("serverless.capture_lambda_payload_max_depth"), rules)
+}
+
+// tags returns the tags of a JSON payload, prefixed by the given tag. It returns nil when
+// the payload isn't valid JSON, such as a truncated one.
+func (t *payloadTagger) tags(prefix string, payload []byte) map[string]string {
+	if t == nil || len(payload) == 0 || len(payload) > maxPayloadSize {
+		return nil
+	}
+	value, ok := decodePayload(payload)
+	if !ok {
+		return nil
+	}
+	tags := make(map[string]string)
+	t.flatten(tags, prefix, nil, value)
+	return tags
+}
+
+// flatten adds the tags of a value found at the given path, redacting it first
+func (t *payloadTagger) flatten(tags map[string]string, tag string, path []string, value interface{}) {
+	if len(tags) >= maxPayloadTags || len(path) > t.maxDepth {
+		return
+	}
+	if redacted, found := t.redactNode(path); found {
+		tags[tag] = redacted
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if encoded, _ := v["isBase64Encoded"].(bool); encoded {
+			// the body of the HTTP events may be encoded, its secrets must be found once decoded
+			if body, ok := v["body"].(string); ok {
+				if decoded, err := base64.StdEncoding.DecodeString(body); err == nil && utf8.Valid(decoded) {
+					v["body"] = string(decoded)
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			t.flatten(tags, tag+"."+key, append(path[:len(path):len(path)], key), v[key])
+		}
+	case []interface{}:
+		for i, item := range v {
+			index := strconv.Itoa(i)
+			t.flatten(tags, tag+"."+index, append(path[:len(path):len(path)], index), item)
+		}
+	case string:
+		// the bodies and the messages of the events are often JSON documents themselves
+		if embedded, ok := decodeEmbeddedPayload(v); ok {
+			t.flatten(tags, tag, path, embedded)
+			return
+		}
+		tags[tag] = traceutil.TruncateUTF8(t.redactLeaf(path, v), maxPayloadTagValueSize)
+	case json.Number:
+		tags[tag] = t.redactLeaf(path, v.String())
+	case bool:
+		tags[tag] = t.redactLeaf(path, strconv.FormatBool(v))
+	}
+}
+
+// redactNode returns the replacement of a value entirely redacted, the values of the secret
+// keys and of the rules without pattern
+func (t *payloadTagger) redactNode(path []string) (string, bool) {
+	if len(path) > 0 && isSecretKey(path[len(path)-1]) {
+		return redactedValue, true
+	}
+	for _, r := range t.rules {
+		if r.re == nil && r.matches(path) {
+			return r.repl, true
+		}
+	}
+	return "", false
+}
+
+// redactLeaf applies the patterns of the rules matching the path of a leaf value
+func (t *payloadTagger) redactLeaf(path []string, value string) string {
+	for _, r := range t.rules {
+		if r.re != nil && (r.matchesAll() || r.matches(path)) {
+			value = r.re.ReplaceAllString(value, r.repl)
+		}
+	}
+	return value
+}
+
+// isSecretKey returns whether the values of a key are secrets
+func isSecretKey(key string) bool {
+	key = strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePayload decodes a JSON payload, keeping its numbers as they were sent
+func decodePayload(payload []byte) (interface{}, bool) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	// a single JSON value is expected
+	if _, err := decoder.Token(); err == nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// decodeEmbeddedPayload decodes a string holding a JSON object or array
+func decodeEmbeddedPayload(s string) (interface{}, bool) {
+	trimmed := strings.TrimSpace(s)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	return decodePayload([]byte(trimmed))
+}
@@ -0,0 +1,197 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
+	traceConfig "github.com/DataDog/datadog-agent/pkg/trace/config"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+)
+
+// assertNoLeak checks that none of the secrets of the fixtures, all starting with leak-, is in the tags
+func assertNoLeak(t *testing.T, tags map[string]string) {
+	for k, v := range tags {
+		assert.NotContains(t, k, "leak", k)
+		assert.NotContains(t, v, "leak", k)
+	}
+}
+
+func TestPayloadTaggerAPIGatewayEvent(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/payload/api_gateway.json")
+	require.NoError(t, err)
+
+	tags := newPayloadTagger(10, nil).tags(requestPayloadTag, payload)
+	assertNoLeak(t, tags)
+	for k, v := range map[string]string{
+		"function.request.httpMethod":                                   "POST",
+		"function.request.path":                                         "/users/42",
+		"function.request.headers.Accept":                               "application/json",
+		"function.request.headers.Authorization":                        "redacted",
+		"function.request.headers.Cookie":                               "redacted",
+		"function.request.headers.X-Api-Key":                            "redacted",
+		"function.request.headers.X-Amz-Security-Token":                 "redacted",
+		"function.request.headers.X-Forwarded-Auth":                     "Basic redacted",
+		"function.request.multiValueHeaders.Authorization":              "redacted",
+		"function.request.multiValueHeaders.Accept.0":                   "application/json",
+		"function.request.queryStringParameters.access_token":           "redacted",
+		"function.request.queryStringParameters.page":                   "2",
+		"function.request.requestContext.identity.accessKey":            "redacted",
+		"function.request.requestContext.identity.sourceIp":             "203.0.113.17",
+		"function.request.requestContext.authorizer.integrationLatency": "12",
+		"function.request.body.username":                                "jdoe",
+		"function.request.body.password":                                "redacted",
+		"function.request.body.profile.client_secret":                   "redacted",
+		"function.request.body.profile.age":                             "42",
+		"function.request.body.callback":                                "https://example.com/cb?id_token=redacted&state=1",
+		"function.request.body.note":                                    "sent with Bearer redacted",
+		"function.request.isBase64Encoded":                              "false",
+	} {
+		assert.Equal(t, v, tags[k], k)
+	}
+}
+
+func TestPayloadTaggerEncodedBody(t *testing.T) {
+	event := fmt.Sprintf(`{"httpMethod":"POST","body":%q,"isBase64Encoded":true}`, base64.StdEncoding.EncodeToString([]byte("user=jdoe&password=leak-password&remember=1")))
+
+	tags := newPayloadTagger(10, nil).tags(requestPayloadTag, []byte(event))
+	assertNoLeak(t, tags)
+	assert.Equal(t, "user=jdoe&password=redacted&remember=1", tags["function.request.body"])
+}
+
+func TestPayloadTaggerResponse(t *testing.T) {
+	response := `{"statusCode":302,"headers":{"Location":"/home","Set-Cookie":"session=leak-session"},"body":""}`
+
+	tags := newPayloadTagger(10, nil).tags(responsePayloadTag, []byte(response))
+	assertNoLeak(t, tags)
+	assert.Equal(t, map[string]string{
+		"function.response.statusCode":         "302",
+		"function.response.headers.Location":   "/home",
+		"function.response.headers.Set-Cookie": "redacted",
+		"function.response.body":               "",
+	}, tags)
+
+	// the responses which aren't objects are tagged too
+	assert.Equal(t, map[string]string{"function.response": "done"}, newPayloadTagger(10, nil).tags(responsePayloadTag, []byte(`"done"`)))
+}
+
+func TestPayloadTaggerRules(t *testing.T) {
+	tagger := newPayloadTagger(10, []*traceConfig.ReplaceRule{
+		// anchored at the root of the payload, without pattern the whole value is redacted
+		{Name: "$.user.ssn"},
+		// matching the end of the path, * matching any key or index
+		{Name: "cards.*.number", Pattern: `\d{12}(\d{4})`, Repl: "xxxx${1}"},
+		// in the format of apm_config.replace_tags, applying to all the values
+		{Name: "*", Pattern: "internal", Repl: "?"},
+		{Name: "address", Repl: "hidden"},
+		// invalid rules are ignored
+		{Name: "", Pattern: "x"},
+		{Name: "user.name", Pattern: "("},
+	})
+
+	tags := tagger.tags(requestPayloadTag, []byte(`{
+		"user": {"name": "jdoe", "ssn": "078-05-1120", "address": {"city": "Paris"}},
+		"order": {"user": {"ssn": "219-09-9999"}},
+		"cards": [{"number": "4111111111111111"}, {"number": "5500000000000004", "label": "internal card"}]
+	}`))
+	assert.Equal(t, map[string]string{
+		"function.request.user.name":      "jdoe",
+		"function.request.user.ssn":       "redacted",
+		"function.request.user.address":   "hidden",
+		"function.request.order.user.ssn": "219-09-9999",
+		"function.request.cards.0.number": "xxxx1111",
+		"function.request.cards.1.number": "xxxx0004",
+		"function.request.cards.1.label":  "? card",
+	}, tags)
+}
+
+func TestPayloadTaggerLimits(t *testing.T) {
+	// the values deeper than the max depth are dropped, they aren't inspected
+	tags := newPayloadTagger(2, nil).tags(requestPayloadTag, []byte(`{"a":{"b":{"c":"deep"},"d":"shallow"},"e":"top"}`))
+	assert.Equal(t, map[string]string{
+		"function.request.a.d": "shallow",
+		"function.request.e":   "top",
+	}, tags)
+
+	// the embedded documents count in the depth
+	tags = newPayloadTagger(2, nil).tags(requestPayloadTag, []byte(`{"body":"{\"a\":{\"b\":\"deep\"},\"c\":1}"}`))
+	assert.Equal(t, map[string]string{"function.request.body.c": "1"}, tags)
+
+	// the number of tags and the size of their values are bounded
+	var items []string
+	for i := 0; i < 2*maxPayloadTags; i++ {
+		items = append(items, fmt.Sprintf(`"item-%d"`, i))
+	}
+	tags = newPayloadTagger(10, nil).tags(requestPayloadTag, []byte(`{"items":[`+strings.Join(items, ",")+`],"a_long":"`+strings.Repeat("x", 2*maxPayloadTagValueSize)+`"}`))
+	assert.Len(t, tags, maxPayloadTags)
+	for _, v := range tags {
+		assert.LessOrEqual(t, len(v), maxPayloadTagValueSize)
+	}
+
+	// the truncated payloads and the ones which aren't JSON are ignored
+	payload, err := ioutil.ReadFile("testdata/payload/api_gateway.json")
+	require.NoError(t, err)
+	assert.Nil(t, newPayloadTagger(10, nil).tags(requestPayloadTag, payload[:len(payload)/2]))
+	assert.Nil(t, newPayloadTagger(10, nil).tags(requestPayloadTag, []byte("plain text")))
+	assert.Nil(t, newPayloadTagger(10, nil).tags(requestPayloadTag, bytes.Repeat([]byte(" "), maxPayloadSize+1)))
+}
+
+func TestPayloadTagsOnSpans(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/payload/api_gateway.json")
+	require.NoError(t, err)
+
+	agent := &trace.ServerlessTraceAgent{}
+	os.Setenv("DD_API_KEY", "x")
+	defer os.Unsetenv("DD_API_KEY")
+	agent.Start(true, &trace.LoadConfig{Path: "/does-not-exist.yml"})
+	defer agent.Stop()
+	d := &Daemon{
+		TraceAgent:       agent,
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{},
+		payloadTagger:    newPayloadTagger(10, nil),
+	}
+	response := `{"statusCode":200,"headers":{"Set-Cookie":"session=leak-session"},"body":"{\"token\":\"leak-response-token\"}"}`
+
+	// request-1 is received on the routes of the daemon
+	request := httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", bytes.NewReader(payload))
+	request.Header.Set(requestIDHeader, "request-1")
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	request = httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(response))
+	request.Header.Set(requestIDHeader, "request-1")
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+
+	// request-2 through the runtime API proxy
+	d.HandleInvocationEvent("request-2", payload)
+	d.HandleInvocationResponse("request-2", []byte(response))
+
+	tagSpan := func(requestID string) map[string]string {
+		span := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": requestID}}
+		agent.Get().ModifySpan(span)
+		delete(span.Meta, "request_id")
+		return span.Meta
+	}
+	routeTags, proxyTags := tagSpan("request-1"), tagSpan("request-2")
+	assertNoLeak(t, routeTags)
+	assert.Equal(t, "redacted", routeTags["function.request.headers.Authorization"])
+	assert.Equal(t, "redacted", routeTags["function.response.body.token"])
+	assert.Equal(t, "200", routeTags["function.response.statusCode"])
+	// the payloads are redacted the same way on both paths
+	assert.Equal(t, routeTags, proxyTags)
+}
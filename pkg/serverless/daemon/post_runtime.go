@@ -0,0 +1,112 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// postRuntimeInvocation holds what is known of the end of an invocation to compute its post-runtime duration
+type postRuntimeInvocation struct {
+	// runtimeDone is the earliest time the runtime was reported done, by FinishInvocation or the runtimeDone log
+	runtimeDone time.Time
+	// nextCall is the time the extension called /next after the invocation
+	nextCall time.Time
+	// lastFlush is the start time of the last flush before nextCall
+	lastFlush time.Time
+	// sent is true once the post-runtime duration of the invocation has been computed
+	sent bool
+}
+
+// postRuntimeDuration is the time spent by the extension between the end of the runtime and the next call to /next
+type postRuntimeDuration struct {
+	duration time.Duration
+	flushed  bool
+	end      time.Time
+}
+
+// postRuntimeTracker correlates the end of the runtime with the next call to /next per request ID. Both can
+// be reported in any order: the runtimeDone logs are delivered asynchronously by the Logs API, usually after
+// the extension called /next. The number of tracked invocations is bounded, the oldest are dropped first.
+type postRuntimeTracker struct {
+	mu          sync.Mutex
+	invocations map[string]*postRuntimeInvocation
+	order       []string
+	lastFlush   time.Time
+}
+
+func newPostRuntimeTracker() *postRuntimeTracker {
+	return &postRuntimeTracker{
+		invocations: make(map[string]*postRuntimeInvocation),
+	}
+}
+
+// get returns the invocation with the given request ID, tracking it if needed. The caller must hold mu.
+func (t *postRuntimeTracker) get(requestID string) *postRuntimeInvocation {
+	if invocation, found := t.invocations[requestID]; found {
+		return invocation
+	}
+	if len(t.order) >= maxRequestIDHistory {
+		delete(t.invocations, t.order[0])
+		t.order = t.order[1:]
+	}
+	invocation := &postRuntimeInvocation{}
+	t.invocations[requestID] = invocation
+	t.order = append(t.order, requestID)
+	return invocation
+}
+
+// runtimeDone records that the runtime finished the invocation with the given request ID at the given time,
+// and returns its post-runtime duration if the next call to /next is already known
+func (t *postRuntimeTracker) runtimeDone(requestID string, doneTime time.Time) (postRuntimeDuration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	invocation := t.get(requestID)
+	if invocation.sent {
+		// late report of an invocation already measured
+		return postRuntimeDuration{}, false
+	}
+	if invocation.runtimeDone.IsZero() || doneTime.Before(invocation.runtimeDone) {
+		invocation.runtimeDone = doneTime
+	}
+	return invocation.complete()
+}
+
+// nextCall records that the extension called /next at the given time after the invocation with the given
+// request ID, and returns its post-runtime duration if the end of the runtime is already known
+func (t *postRuntimeTracker) nextCall(requestID string, callTime time.Time) (postRuntimeDuration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	invocation := t.get(requestID)
+	if invocation.sent || !invocation.nextCall.IsZero() {
+		return postRuntimeDuration{}, false
+	}
+	invocation.nextCall = callTime
+	invocation.lastFlush = t.lastFlush
+	return invocation.complete()
+}
+
+// flushStarted records the start time of a flush
+func (t *postRuntimeTracker) flushStarted(startTime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastFlush = startTime
+}
+
+// complete returns the post-runtime duration of the invocation once both its ends are known, only once.
+// The caller must hold the mutex of the tracker.
+func (i *postRuntimeInvocation) complete() (postRuntimeDuration, bool) {
+	if i.runtimeDone.IsZero() || i.nextCall.IsZero() || i.nextCall.Before(i.runtimeDone) {
+		return postRuntimeDuration{}, false
+	}
+	i.sent = true
+	return postRuntimeDuration{
+		duration: i.nextCall.Sub(i.runtimeDone),
+		flushed:  !i.lastFlush.IsZero() && !i.lastFlush.Before(i.runtimeDone),
+		end:      i.nextCall,
+	}, true
+}
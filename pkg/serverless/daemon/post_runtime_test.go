@@ -0,0 +1,128 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostRuntimeRuntimeDoneFirst(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	_, ok := tracker.runtimeDone("request-1", now)
+	assert.False(t, ok)
+	postRuntime, ok := tracker.nextCall("request-1", now.Add(30*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, postRuntimeDuration{duration: 30 * time.Millisecond, end: now.Add(30 * time.Millisecond)}, postRuntime)
+
+	// the late runtimeDone log of an invocation already measured is ignored
+	_, ok = tracker.runtimeDone("request-1", now.Add(-time.Millisecond))
+	assert.False(t, ok)
+}
+
+func TestPostRuntimeLateRuntimeDoneLog(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	// the runtimeDone log is delivered after the extension called /next
+	_, ok := tracker.nextCall("request-1", now.Add(50*time.Millisecond))
+	assert.False(t, ok)
+	postRuntime, ok := tracker.runtimeDone("request-1", now)
+	assert.True(t, ok)
+	assert.Equal(t, 50*time.Millisecond, postRuntime.duration)
+	assert.False(t, postRuntime.flushed)
+
+	// a second call to /next for the same invocation is ignored
+	_, ok = tracker.nextCall("request-1", now.Add(time.Second))
+	assert.False(t, ok)
+}
+
+func TestPostRuntimeOutOfOrderLogs(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	_, ok := tracker.nextCall("request-1", now.Add(10*time.Millisecond))
+	assert.False(t, ok)
+	_, ok = tracker.nextCall("request-2", now.Add(120*time.Millisecond))
+	assert.False(t, ok)
+
+	// the logs of both invocations are delivered in the same batch, the last one first
+	postRuntime, ok := tracker.runtimeDone("request-2", now.Add(100*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, postRuntime.duration)
+	postRuntime, ok = tracker.runtimeDone("request-1", now)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, postRuntime.duration)
+}
+
+func TestPostRuntimeEarliestRuntimeDone(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	// FinishInvocation is reported after the runtimeDone log
+	_, ok := tracker.runtimeDone("request-1", now)
+	assert.False(t, ok)
+	_, ok = tracker.runtimeDone("request-1", now.Add(5*time.Millisecond))
+	assert.False(t, ok)
+	postRuntime, ok := tracker.nextCall("request-1", now.Add(20*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, postRuntime.duration)
+}
+
+func TestPostRuntimeFlushed(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	// the flush at the start of the invocation doesn't count
+	tracker.flushStarted(now.Add(-time.Second))
+	tracker.runtimeDone("request-1", now)
+	postRuntime, ok := tracker.nextCall("request-1", now.Add(10*time.Millisecond))
+	assert.True(t, ok)
+	assert.False(t, postRuntime.flushed)
+
+	tracker.runtimeDone("request-2", now.Add(time.Second))
+	tracker.flushStarted(now.Add(time.Second + time.Millisecond))
+	postRuntime, ok = tracker.nextCall("request-2", now.Add(time.Second+300*time.Millisecond))
+	assert.True(t, ok)
+	assert.True(t, postRuntime.flushed)
+
+	// the flush is taken into account even when the runtimeDone log comes after a new flush
+	_, ok = tracker.nextCall("request-3", now.Add(3*time.Second))
+	assert.False(t, ok)
+	tracker.flushStarted(now.Add(4 * time.Second))
+	postRuntime, ok = tracker.runtimeDone("request-3", now.Add(2*time.Second))
+	assert.True(t, ok)
+	assert.False(t, postRuntime.flushed)
+}
+
+func TestPostRuntimeBounded(t *testing.T) {
+	tracker := newPostRuntimeTracker()
+	now := time.Now()
+
+	for i := 0; i < 2*maxRequestIDHistory; i++ {
+		tracker.nextCall(string(rune('a'+i)), now)
+	}
+	assert.Len(t, tracker.invocations, maxRequestIDHistory)
+	assert.Len(t, tracker.order, maxRequestIDHistory)
+}
+
+func TestHandleNextCall(t *testing.T) {
+	d := StartDaemon("http://localhost:8124", "")
+	defer d.Stop()
+
+	// nothing to measure before the first invocation
+	d.HandleNextCall(time.Now())
+	assert.Empty(t, d.postRuntime.invocations)
+
+	d.StartInvocation("request-1")
+	d.FinishInvocation("request-1")
+	d.HandleNextCall(time.Now())
+	assert.True(t, d.postRuntime.invocations["request-1"].sent)
+}
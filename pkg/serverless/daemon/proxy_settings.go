@@ -0,0 +1,41 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	httputils "github.com/DataDog/datadog-agent/pkg/util/http"
+)
+
+// ProxySettings describes the proxies the metrics, traces and logs are sent through, without
+// their credentials
+type ProxySettings struct {
+	HTTP    string   `json:"http,omitempty"`
+	HTTPS   string   `json:"https,omitempty"`
+	NoProxy []string `json:"no_proxy,omitempty"`
+}
+
+// GetProxySettings returns the proxy settings resolved from the environment variables, such as
+// DD_PROXY_HTTPS or HTTPS_PROXY, and the configuration file. It returns nil without proxy.
+func GetProxySettings() *ProxySettings {
+	p := config.GetProxies()
+	if p == nil || (p.HTTP == "" && p.HTTPS == "") {
+		return nil
+	}
+	return &ProxySettings{
+		HTTP:    httputils.SafeProxyURL(p.HTTP),
+		HTTPS:   httputils.SafeProxyURL(p.HTTPS),
+		NoProxy: p.NoProxy,
+	}
+}
+
+// String returns the proxy settings as they are logged
+func (s *ProxySettings) String() string {
+	return fmt.Sprintf("https: %q, http: %q, no_proxy: %q", s.HTTPS, s.HTTP, strings.Join(s.NoProxy, ","))
+}
@@ -0,0 +1,166 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
+	"github.com/DataDog/datadog-agent/pkg/util/backoff"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// retryBackoffPolicy computes how long a failed payload waits before being retried, from its error count
+var retryBackoffPolicy = backoff.NewPolicy(2, 1, 30, 0, false)
+
+// RetryPayload is a payload which failed to be sent to the intake, such as a metrics transaction or
+// a traces payload
+type RetryPayload interface {
+	// Size returns the size of the payload in bytes
+	Size() int
+	// Attempts returns the number of times the payload failed to be sent
+	Attempts() int
+	// RetryAfter returns the delay the intake asked to wait before sending the payload again, 0 if none
+	RetryAfter() time.Duration
+	// Drop is called when the payload is dropped from the queue without being sent
+	Drop()
+}
+
+// metricsRetryPayload is a metrics transaction which failed to be sent to the intake
+type metricsRetryPayload struct {
+	*transaction.HTTPTransaction
+}
+
+func (p metricsRetryPayload) Size() int                 { return p.GetPayloadSize() }
+func (p metricsRetryPayload) Attempts() int             { return p.ErrorCount }
+func (p metricsRetryPayload) RetryAfter() time.Duration { return p.HTTPTransaction.RetryAfter }
+
+// Drop does nothing, the forwarder already counted the transaction as failed
+func (p metricsRetryPayload) Drop() {}
+
+// metricsTransactions returns the transactions of metrics payloads
+func metricsTransactions(payloads []RetryPayload) []*transaction.HTTPTransaction {
+	transactions := make([]*transaction.HTTPTransaction, 0, len(payloads))
+	for _, p := range payloads {
+		transactions = append(transactions, p.(metricsRetryPayload).HTTPTransaction)
+	}
+	return transactions
+}
+
+type retryEntry struct {
+	payload   RetryPayload
+	notBefore time.Time
+}
+
+// RetryQueue keeps in memory the payloads which failed to be sent to the intake (429 or 5xx
+// responses), so they can be retried on the next flush instead of being lost when the sandbox
+// is frozen. A payload waits for its backoff, or longer if the intake asked so with a Retry-After
+// header. Its size is bounded, the oldest payloads are dropped first.
+type RetryQueue struct {
+	mu           sync.Mutex
+	entries      []retryEntry
+	size         int
+	maxSize      int
+	droppedBytes int64 // since the previous call to TakeDroppedBytes
+}
+
+// NewRetryQueue returns a RetryQueue holding at most maxSize bytes of payloads
+func NewRetryQueue(maxSize int) *RetryQueue {
+	return &RetryQueue{
+		maxSize: maxSize,
+	}
+}
+
+// Add queues a failed payload, dropping the oldest ones if the queue is full
+func (q *RetryQueue) Add(p RetryPayload) {
+	payloadSize := p.Size()
+	delay := retryBackoffPolicy.GetBackoffDuration(p.Attempts())
+	if retryAfter := p.RetryAfter(); retryAfter > delay {
+		delay = retryAfter
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if payloadSize > q.maxSize {
+		log.Debugf("Dropping a payload of %d bytes bigger than the retry buffer", payloadSize)
+		q.droppedBytes += int64(payloadSize)
+		p.Drop()
+		return
+	}
+
+	for q.size+payloadSize > q.maxSize && len(q.entries) > 0 {
+		oldest := q.entries[0].payload
+		oldestSize := oldest.Size()
+		log.Debugf("Retry buffer full, dropping the oldest payload of %d bytes", oldestSize)
+		q.entries = q.entries[1:]
+		q.size -= oldestSize
+		q.droppedBytes += int64(oldestSize)
+		oldest.Drop()
+	}
+
+	q.entries = append(q.entries, retryEntry{
+		payload:   p,
+		notBefore: time.Now().Add(delay),
+	})
+	q.size += payloadSize
+}
+
+// Flush sends the queued payloads whose backoff elapsed, oldest first. If force is set, the
+// backoff is ignored. Payloads failing again are expected to be queued back by the caller.
+func (q *RetryQueue) Flush(now time.Time, force bool, send func([]RetryPayload)) {
+	q.mu.Lock()
+	var ready []RetryPayload
+	pending := make([]retryEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		if force || !now.Before(entry.notBefore) {
+			ready = append(ready, entry.payload)
+			q.size -= entry.payload.Size()
+		} else {
+			pending = append(pending, entry)
+		}
+	}
+	q.entries = pending
+	q.mu.Unlock()
+
+	if len(ready) > 0 {
+		log.Debugf("Retrying %d payloads which previously failed to be sent", len(ready))
+		send(ready)
+	}
+}
+
+// Drop empties the queue, counting the queued payloads as dropped
+func (q *RetryQueue) Drop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size > 0 {
+		log.Warnf("Dropping %d payloads (%d bytes) which couldn't be sent to the intake", len(q.entries), q.size)
+	}
+	q.droppedBytes += int64(q.size)
+	for _, entry := range q.entries {
+		entry.payload.Drop()
+	}
+	q.entries = nil
+	q.size = 0
+}
+
+// Size returns the total size of the queued payloads
+func (q *RetryQueue) Size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// TakeDroppedBytes returns the total size of the payloads dropped since the previous call
+func (q *RetryQueue) TakeDroppedBytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dropped := q.droppedBytes
+	q.droppedBytes = 0
+	return dropped
+}
@@ -0,0 +1,171 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-agent/pkg/forwarder"
+	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
+)
+
+func newTestTransaction(payload string) metricsRetryPayload {
+	t := transaction.NewHTTPTransaction()
+	p := []byte(payload)
+	t.Payload = &p
+	return metricsRetryPayload{t}
+}
+
+// testRetryPayload is a payload recording whether it was dropped
+type testRetryPayload struct {
+	size       int
+	retryAfter time.Duration
+	dropped    bool
+}
+
+func (p *testRetryPayload) Size() int                 { return p.size }
+func (p *testRetryPayload) Attempts() int             { return 1 }
+func (p *testRetryPayload) RetryAfter() time.Duration { return p.retryAfter }
+func (p *testRetryPayload) Drop()                     { p.dropped = true }
+
+func TestRetryQueueDropsOldestFirst(t *testing.T) {
+	q := NewRetryQueue(10)
+
+	first := newTestTransaction("aaaa")
+	q.Add(first)
+	q.Add(newTestTransaction("bbbb"))
+	q.Add(newTestTransaction("cccc"))
+	assert.Equal(t, 8, q.Size())
+	assert.Equal(t, int64(4), q.TakeDroppedBytes())
+
+	// bigger than the whole queue
+	q.Add(newTestTransaction("ddddddddddd"))
+	assert.Equal(t, 8, q.Size())
+	assert.Equal(t, int64(11), q.TakeDroppedBytes())
+	assert.Equal(t, int64(0), q.TakeDroppedBytes())
+
+	var sent []*transaction.HTTPTransaction
+	q.Flush(time.Now(), true, func(ps []RetryPayload) { sent = metricsTransactions(ps) })
+	assert.Len(t, sent, 2)
+	assert.NotContains(t, sent, first.HTTPTransaction)
+	assert.Equal(t, 0, q.Size())
+}
+
+func TestRetryQueueDropsPayloads(t *testing.T) {
+	q := NewRetryQueue(10)
+	oldest := &testRetryPayload{size: 6}
+	newest := &testRetryPayload{size: 6}
+	q.Add(oldest)
+	q.Add(newest)
+	assert.True(t, oldest.dropped)
+	assert.False(t, newest.dropped)
+
+	q.Drop()
+	assert.True(t, newest.dropped)
+	assert.Equal(t, int64(12), q.TakeDroppedBytes())
+}
+
+func TestRetryQueueRetryAfter(t *testing.T) {
+	q := NewRetryQueue(10)
+	q.Add(&testRetryPayload{size: 4, retryAfter: 2 * time.Minute})
+
+	sent := 0
+	send := func(ps []RetryPayload) { sent += len(ps) }
+
+	// the backoff of a single attempt elapsed, but not the delay asked by the intake
+	q.Flush(time.Now().Add(time.Minute), false, send)
+	assert.Equal(t, 0, sent)
+	q.Flush(time.Now().Add(3*time.Minute), false, send)
+	assert.Equal(t, 1, sent)
+}
+
+func TestRetryQueueBackoff(t *testing.T) {
+	q := NewRetryQueue(10)
+	tr := newTestTransaction("aaaa")
+	tr.ErrorCount = 2
+	q.Add(tr)
+
+	sent := 0
+	send := func(ps []RetryPayload) { sent += len(ps) }
+
+	q.Flush(time.Now(), false, send)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 4, q.Size())
+
+	q.Flush(time.Now().Add(time.Minute), false, send)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 0, q.Size())
+
+	q.Add(tr)
+	q.Drop()
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, int64(4), q.TakeDroppedBytes())
+}
+
+func TestRetryQueueSurvives429(t *testing.T) {
+	var statusCode int32 = http.StatusTooManyRequests
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := int(atomic.LoadInt32(&statusCode))
+		if code == http.StatusOK {
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, "series", string(body))
+			atomic.AddInt32(&received, 1)
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	q := NewRetryQueue(1024)
+	f := forwarder.NewSyncForwarder(map[string][]string{server.URL: {"api_key"}}, time.Second)
+	f.SetRetryHandler(func(t *transaction.HTTPTransaction) { q.Add(metricsRetryPayload{t}) })
+
+	// first invocation: the intake rate limits the flush
+	payload := []byte("series")
+	assert.NoError(t, f.SubmitV1Series(forwarder.Payloads{&payload}, nil))
+	assert.Equal(t, len(payload), q.Size())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&received))
+
+	// next invocation: the payload is sent before new data
+	atomic.StoreInt32(&statusCode, http.StatusOK)
+	q.Flush(time.Now().Add(time.Minute), false, func(ps []RetryPayload) {
+		assert.NoError(t, f.Retry(metricsTransactions(ps)))
+	})
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+	assert.Equal(t, int64(0), q.TakeDroppedBytes())
+}
+
+func TestRetryQueueHonoursRetryAfter(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	q := NewRetryQueue(1024)
+	f := forwarder.NewSyncForwarder(map[string][]string{server.URL: {"api_key"}}, time.Second)
+	f.SetRetryHandler(func(t *transaction.HTTPTransaction) { q.Add(metricsRetryPayload{t}) })
+
+	// the payload isn't sent again right away, nor before the delay asked by the intake
+	payload := []byte("series")
+	assert.NoError(t, f.SubmitV1Series(forwarder.Payloads{&payload}, nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	sent := 0
+	q.Flush(time.Now().Add(time.Minute), false, func(ps []RetryPayload) { sent += len(ps) })
+	assert.Equal(t, 0, sent)
+	q.Flush(time.Now().Add(3*time.Minute), false, func(ps []RetryPayload) { sent += len(ps) })
+	assert.Equal(t, 1, sent)
+}
@@ -0,0 +1,183 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// routeHandlingTimesWindow is the number of the last handling times of a route its percentile is computed on
+const routeHandlingTimesWindow = 512
+
+// RouteStats are the counters of a route of the daemon, exposed on the Status route. The hits and
+// errors are counted since the start, the p95 handling time is the one of the last
+// routeHandlingTimesWindow hits.
+type RouteStats struct {
+	Hits              int64   `json:"hits"`
+	Errors            int64   `json:"errors"`
+	P95HandlingTimeMs float64 `json:"p95_handling_time_ms"`
+}
+
+// routeStats counts the hits on a route of the daemon. The hits are summarized once per
+// flush instead of being logged, only the first one is logged in detail.
+type routeStats struct {
+	route string
+
+	// hits and errors are counted since the start, firstHitLogged is set once the first
+	// hit is logged, all accessed atomically
+	hits           int64
+	errors         int64
+	firstHitLogged int32
+
+	// handlingTimes holds the last handling times of the route, next being the oldest one
+	// once it is full. summarizedHits and summarizedErrors are the counters as of the
+	// last summary. They are protected by mu.
+	mu               sync.Mutex
+	handlingTimes    []time.Duration
+	next             int
+	summarizedHits   int64
+	summarizedErrors int64
+}
+
+// record counts a hit on the route
+func (s *routeStats) record(handlingTime time.Duration, failed bool) {
+	atomic.AddInt64(&s.hits, 1)
+	if failed {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.handlingTimes) < routeHandlingTimesWindow {
+		s.handlingTimes = append(s.handlingTimes, handlingTime)
+		return
+	}
+	s.handlingTimes[s.next] = handlingTime
+	s.next = (s.next + 1) % routeHandlingTimesWindow
+}
+
+// p95HandlingTime returns the 95th percentile of the last handling times, it must be called with mu held
+func (s *routeStats) p95HandlingTime() time.Duration {
+	if len(s.handlingTimes) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(s.handlingTimes))
+	copy(sorted, s.handlingTimes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+}
+
+// stats returns the counters of the route since the start, and the p95 of its last handling times
+func (s *routeStats) stats() RouteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RouteStats{
+		Hits:              atomic.LoadInt64(&s.hits),
+		Errors:            atomic.LoadInt64(&s.errors),
+		P95HandlingTimeMs: float64(s.p95HandlingTime()) / float64(time.Millisecond),
+	}
+}
+
+// logSummary logs the hits on the route since the last summary, if any. The p95 handling time
+// doesn't restart with the summary, it is the one of the last routeHandlingTimesWindow hits.
+func (s *routeStats) logSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hits := atomic.LoadInt64(&s.hits)
+	errors := atomic.LoadInt64(&s.errors)
+	if hits == s.summarizedHits {
+		return
+	}
+	log.Debugf("Route %s: %d hits, %d errors since the last flush, p95 handling time of the last %d hits %s",
+		s.route, hits-s.summarizedHits, errors-s.summarizedErrors, len(s.handlingTimes), s.p95HandlingTime())
+	s.summarizedHits = hits
+	s.summarizedErrors = errors
+}
+
+// routeRegistry keeps the counters of the routes of the daemon
+type routeRegistry struct {
+	mu     sync.Mutex
+	routes []*routeStats
+}
+
+// handle wraps the handler of a route to count its hits and measure their handling time, and to
+// bound the size of the request body it reads to maxBodySize bytes, 0 leaving it unbounded
+func (r *routeRegistry) handle(route string, maxBodySize int64, handler http.Handler) http.Handler {
+	stats := &routeStats{route: route}
+	r.mu.Lock()
+	r.routes = append(r.routes, stats)
+	r.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.CompareAndSwapInt32(&stats.firstHitLogged, 0, 1) {
+			log.Debugf("First hit on the %s route: %s from %q, content length %d, request ID %q",
+				route, req.Method, req.UserAgent(), req.ContentLength, req.Header.Get(requestIDHeader))
+		}
+		if maxBodySize > 0 {
+			req.Body = limitedBody{io.LimitReader(req.Body, maxBodySize), req.Body}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler.ServeHTTP(recorder, req)
+		stats.record(time.Since(start), recorder.status >= http.StatusBadRequest)
+	})
+}
+
+// stats returns the counters of the routes, by route
+func (r *routeRegistry) stats() map[string]RouteStats {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]RouteStats, len(r.routes))
+	for _, route := range r.routes {
+		stats[route.route] = route.stats()
+	}
+	return stats
+}
+
+// logSummary logs the hits on the routes since the last summary
+func (r *routeRegistry) logSummary() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, route := range r.routes {
+		route.logSummary()
+	}
+}
+
+// limitedBody is a request body whose reads are bounded, closing the original body
+type limitedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// Close closes the original body
+func (b limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before writing it
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,105 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteHandleCountsHits(t *testing.T) {
+	registry := &routeRegistry{}
+	var status int
+	handler := registry.handle("/lambda/test", 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lambda/test", nil))
+	status = http.StatusServiceUnavailable
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lambda/test", nil))
+	status = http.StatusAccepted
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lambda/test", nil))
+
+	stats := registry.stats()
+	require.Contains(t, stats, "/lambda/test")
+	assert.Equal(t, int64(3), stats["/lambda/test"].Hits)
+	assert.Equal(t, int64(1), stats["/lambda/test"].Errors)
+	assert.Equal(t, int32(1), registry.routes[0].firstHitLogged)
+}
+
+func TestRouteHandleLimitsBody(t *testing.T) {
+	registry := &routeRegistry{}
+	var body []byte
+	read := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	})
+
+	registry.handle("/lambda/limited", 4, read).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lambda/limited", strings.NewReader("0123456789")))
+	assert.Equal(t, "0123", string(body))
+
+	registry.handle("/lambda/unlimited", 0, read).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/lambda/unlimited", strings.NewReader("0123456789")))
+	assert.Equal(t, "0123456789", string(body))
+}
+
+func TestRouteStatsP95HandlingTime(t *testing.T) {
+	stats := &routeStats{route: "/lambda/test"}
+	assert.Equal(t, 0.0, stats.stats().P95HandlingTimeMs)
+
+	for i := 1; i <= 100; i++ {
+		stats.record(time.Duration(i)*time.Millisecond, false)
+	}
+	assert.Equal(t, 95.0, stats.stats().P95HandlingTimeMs)
+
+	// only the last handling times are kept
+	for i := 0; i < routeHandlingTimesWindow; i++ {
+		stats.record(time.Millisecond, false)
+	}
+	assert.Len(t, stats.handlingTimes, routeHandlingTimesWindow)
+	assert.Equal(t, 1.0, stats.stats().P95HandlingTimeMs)
+	assert.Equal(t, int64(100+routeHandlingTimesWindow), stats.stats().Hits)
+}
+
+func TestRouteStatsLogSummary(t *testing.T) {
+	stats := &routeStats{route: "/lambda/test"}
+	stats.record(time.Millisecond, false)
+	stats.record(time.Millisecond, true)
+
+	stats.logSummary()
+	assert.Equal(t, int64(2), stats.summarizedHits)
+	assert.Equal(t, int64(1), stats.summarizedErrors)
+
+	// the counters since the start are kept for the status
+	stats.record(time.Millisecond, false)
+	stats.logSummary()
+	assert.Equal(t, int64(3), stats.summarizedHits)
+	assert.Equal(t, int64(3), stats.stats().Hits)
+	assert.Equal(t, int64(1), stats.stats().Errors)
+}
+
+func TestStatusRouteStats(t *testing.T) {
+	d := &Daemon{routes: &routeRegistry{}}
+	handler := d.routes.handle("/lambda/status", 0, &Status{d})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lambda/status", nil))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/lambda/status", nil))
+
+	var status statusPayload
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	// the hit being served isn't counted yet
+	assert.Equal(t, int64(1), status.Routes["/lambda/status"].Hits)
+	assert.Equal(t, int64(0), status.Routes["/lambda/status"].Errors)
+}
@@ -0,0 +1,77 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"strings"
+	"time"
+
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// runtimeCrashOutOfMemory is the error type of a crash of the runtime after it ran out of memory
+	runtimeCrashOutOfMemory = "oom"
+	// runtimeCrash is the error type of any other crash of the runtime (segfault, abort, ...)
+	runtimeCrash = "crash"
+)
+
+// classifyRuntimeCrash returns the error type of a crash of the runtime, from the reason
+// reported by the platform and the last logs of the function
+func classifyRuntimeCrash(reason string, lines []string) string {
+	if metrics.ContainsOutOfMemoryError(reason) {
+		return runtimeCrashOutOfMemory
+	}
+	for _, line := range lines {
+		if metrics.ContainsOutOfMemoryError(line) {
+			return runtimeCrashOutOfMemory
+		}
+	}
+	return runtimeCrash
+}
+
+// HandleRuntimeCrash reports that the runtime crashed during the invocation with the given
+// request ID, or the last one when the request ID isn't known. The invocation is marked as
+// failed with an unhandled error, and an error log holding the reason of the crash and the last
+// logs of the function is sent so that the diagnostics aren't lost with the runtime.
+// A crash is only reported once per invocation, as it may be detected by both the platform
+// logs and the runtime API proxy.
+func (d *Daemon) HandleRuntimeCrash(requestID string, reason string) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	if requestID == d.lastCrashRequestID {
+		d.invocationsMutex.Unlock()
+		return
+	}
+	d.lastCrashRequestID = requestID
+	arn := d.ExecutionContext.ARN
+	d.invocationsMutex.Unlock()
+
+	lines := d.functionLogs.Take()
+	crashType := classifyRuntimeCrash(reason, lines)
+	log.Debugf("The runtime crashed during the invocation %q (%s): %s", requestID, crashType, reason)
+
+	d.HandleInvocationError(requestID, invocationError{
+		errorType:     crashType,
+		errorMessage:  reason,
+		functionError: functionErrorUnhandled,
+	})
+
+	if !d.logsEnabled || d.logsChan == nil {
+		return
+	}
+	content := "The runtime crashed: " + reason
+	if len(lines) > 0 {
+		content += "\nLast function logs:\n" + strings.Join(lines, "\n")
+	}
+	message := logConfig.NewChannelMessageFromLambda([]byte(content), time.Now().UTC(), arn, requestID)
+	message.IsError = true
+	d.logsChan <- message
+}
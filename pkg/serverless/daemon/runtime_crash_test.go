@@ -0,0 +1,61 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"testing"
+
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyRuntimeCrash(t *testing.T) {
+	assert.Equal(t, "oom", classifyRuntimeCrash("RequestId: abc-123 Error: Runtime exited with error: signal: killed", nil))
+	assert.Equal(t, "oom", classifyRuntimeCrash("Process exited before completing request", []string{"starting", "fatal error: runtime: out of memory"}))
+	assert.Equal(t, "crash", classifyRuntimeCrash("RequestId: abc-123 Error: Runtime exited with error: signal: segmentation fault", []string{"starting"}))
+}
+
+func TestHandleRuntimeCrash(t *testing.T) {
+	assert := assert.New(t)
+	logsChan := make(chan *logConfig.ChannelMessage, 2)
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{},
+		functionLogs:     &serverlessLog.FunctionLogBuffer{},
+		logsChan:         logsChan,
+		logsEnabled:      true,
+	}
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-1")
+	d.functionLogs.Add("segfault incoming")
+
+	d.HandleRuntimeCrash("", "Runtime exited with error: signal: segmentation fault")
+	assert.Equal("request-1", d.ExecutionContext.FailedRequestID)
+	assert.Equal("unhandled", d.ExecutionContext.FunctionError)
+	require.Len(t, logsChan, 1)
+	message := <-logsChan
+	assert.True(message.IsError)
+	assert.Equal("request-1", message.Lambda.RequestID)
+	assert.Contains(string(message.Content), "signal: segmentation fault")
+	assert.Contains(string(message.Content), "segfault incoming")
+
+	// the same crash reported by the runtime API proxy isn't sent twice
+	d.HandleRuntimeCrash("request-1", "the runtime asked for the next invocation without responding to the previous one")
+	assert.Len(logsChan, 0)
+}
+
+func TestHandleRuntimeCrashLogsDisabled(t *testing.T) {
+	logsChan := make(chan *logConfig.ChannelMessage, 1)
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{},
+		logsChan:         logsChan,
+	}
+	d.HandleRuntimeCrash("request-1", "Runtime exited with error: signal: killed")
+	assert.Equal(t, "request-1", d.ExecutionContext.FailedRequestID)
+	assert.Len(t, logsChan, 0)
+}
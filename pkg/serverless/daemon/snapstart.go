@@ -0,0 +1,110 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"os"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/logs"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// initializationTypeEnvVar is the environment variable set by AWS with the initialization type
+	// of the execution environment
+	initializationTypeEnvVar = "AWS_LAMBDA_INITIALIZATION_TYPE"
+	// initializationTypeSnapStart is the initialization type of the functions using SnapStart
+	initializationTypeSnapStart = "snap-start"
+)
+
+// isSnapStart returns whether the function uses SnapStart, its execution environments being
+// restored from a snapshot taken after the init phase
+func isSnapStart() bool {
+	return os.Getenv(initializationTypeEnvVar) == initializationTypeSnapStart
+}
+
+// SetRestoreHook sets the function called after each restore of the execution environment from
+// its snapshot, used to resolve again what may be stale in the snapshot such as the API key. It
+// returns the API key resolved, empty when it didn't change.
+func (d *Daemon) SetRestoreHook(hook func() (apiKey string)) {
+	d.restoreHook = hook
+}
+
+// HandleRestore reports that the execution environment of a SnapStart function was restored from
+// its snapshot at the given time. The first invocation started after the restore is tagged as the
+// first one after the restore rather than as a cold start, and the global tags are computed again
+// with it. It is ignored when the function doesn't use SnapStart.
+//
+// It is called while the logs are processed, which is asynchronous: the invocation may already have
+// started, in which case it is found by its start time, and the restore hook runs in the background
+// until the next flush so that the logs aren't held while the API key is resolved.
+func (d *Daemon) HandleRestore(restoreTime time.Time) {
+	d.invocationsMutex.Lock()
+	if !d.ExecutionContext.SnapStart {
+		d.invocationsMutex.Unlock()
+		return
+	}
+	d.globalTagsOutdated = true
+	if requestID := d.firstInvocationStartedAfter(restoreTime); requestID != "" {
+		d.setRestoredInvocation(requestID)
+	} else {
+		d.restorePending = true
+	}
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("The execution environment was restored from its snapshot at %v", restoreTime)
+
+	if d.restoreHook != nil {
+		// the API key used until now is the one the metrics, traces and logs are sent with
+		oldAPIKey := config.Datadog.GetString("api_key")
+		d.restoreHooks.Add(1)
+		go func() {
+			defer d.restoreHooks.Done()
+			if apiKey := d.restoreHook(); apiKey != "" && apiKey != oldAPIKey {
+				d.updateAPIKey(oldAPIKey, apiKey)
+			}
+		}()
+	}
+}
+
+// firstInvocationStartedAfter returns the request ID of the first invocation started after the given
+// time, empty when none is known. The caller must hold invocationsMutex.
+func (d *Daemon) firstInvocationStartedAfter(t time.Time) string {
+	for _, requestID := range d.ExecutionContext.RequestIDHistory {
+		if invocation := d.ExecutionContext.FindInvocation(requestID); invocation != nil && !invocation.StartTime.Before(t) {
+			return requestID
+		}
+	}
+	return ""
+}
+
+// setRestoredInvocation tags the invocation as the first one after a restore, which isn't a cold start
+// even when the snapshot was taken before any invocation. The caller must hold invocationsMutex.
+func (d *Daemon) setRestoredInvocation(requestID string) {
+	d.ExecutionContext.RestoreRequestID = requestID
+	if len(d.ExecutionContext.ColdstartRequestID) == 0 {
+		d.ExecutionContext.ColdstartRequestID = requestID
+	}
+	if requestID == d.ExecutionContext.LastRequestID {
+		d.ExecutionContext.Restore = true
+		d.ExecutionContext.Coldstart = false
+	}
+}
+
+// updateAPIKey replaces the API key the metrics, traces and logs are sent with
+func (d *Daemon) updateAPIKey(oldAPIKey string, apiKey string) {
+	log.Info("The API key changed after the restore, updating the metrics, traces and logs endpoints")
+	config.Datadog.Set("api_key", apiKey)
+	if d.MetricAgent != nil {
+		d.MetricAgent.UpdateAPIKey(oldAPIKey, apiKey)
+	}
+	if d.TraceAgent != nil {
+		d.TraceAgent.UpdateAPIKey(oldAPIKey, apiKey)
+	}
+	logs.UpdateAPIKey(oldAPIKey, apiKey)
+}
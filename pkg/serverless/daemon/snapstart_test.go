@@ -0,0 +1,114 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSnapStart(t *testing.T) {
+	t.Setenv(initializationTypeEnvVar, "snap-start")
+	assert.True(t, isSnapStart())
+	t.Setenv(initializationTypeEnvVar, "on-demand")
+	assert.False(t, isSnapStart())
+}
+
+func TestHandleRestore(t *testing.T) {
+	assert := assert.New(t)
+	hookCalls := 0
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{SnapStart: true},
+		ExtraTags:        &serverlessLog.Tags{},
+		restoreHook:      func() string { hookCalls++; return "" },
+	}
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-1")
+	assert.True(d.ExecutionContext.Coldstart)
+
+	d.HandleRestore(time.Now())
+	d.restoreHooks.Wait()
+	assert.Equal(1, hookCalls)
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-2")
+	assert.False(d.ExecutionContext.Coldstart)
+	assert.True(d.ExecutionContext.Restore)
+	assert.Equal([]string{"cold_start:false", "restore:true"}, d.ExecutionContext.LastInvocationInitTags())
+	assert.Equal([]string{"cold_start:true", "restore:false"}, d.ExecutionContext.InitTags("request-1"))
+
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-3")
+	assert.False(d.ExecutionContext.Restore)
+	assert.Equal([]string{"cold_start:false", "restore:false"}, d.ExecutionContext.LastInvocationInitTags())
+}
+
+func TestHandleRestoreBeforeAnyInvocation(t *testing.T) {
+	d := &Daemon{ExecutionContext: &serverlessLog.ExecutionContext{SnapStart: true}}
+	d.HandleRestore(time.Now())
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-1")
+	assert.Equal(t, []string{"cold_start:false", "restore:true"}, d.ExecutionContext.LastInvocationInitTags())
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-2")
+	assert.Equal(t, []string{"cold_start:false", "restore:false"}, d.ExecutionContext.LastInvocationInitTags())
+}
+
+func TestHandleRestoreAfterInvocationStarted(t *testing.T) {
+	assert := assert.New(t)
+	d := &Daemon{ExecutionContext: &serverlessLog.ExecutionContext{SnapStart: true}}
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-1")
+	restoreTime := time.Now()
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-2")
+
+	// the restore is only reported once the logs of the restored invocation are processed
+	d.HandleRestore(restoreTime)
+	assert.Equal("request-2", d.ExecutionContext.RestoreRequestID)
+	assert.Equal([]string{"cold_start:false", "restore:true"}, d.ExecutionContext.LastInvocationInitTags())
+	assert.Equal([]string{"cold_start:true", "restore:false"}, d.ExecutionContext.InitTags("request-1"))
+
+	// the next invocation isn't tagged as restored
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-3")
+	assert.Equal([]string{"cold_start:false", "restore:false"}, d.ExecutionContext.LastInvocationInitTags())
+}
+
+func TestHandleRestoreUpdatesAPIKey(t *testing.T) {
+	config.Datadog.Set("api_key", "old-key")
+	defer config.Datadog.Set("api_key", "")
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{SnapStart: true},
+		restoreHook:      func() string { return "new-key" },
+	}
+	d.HandleRestore(time.Now())
+	d.restoreHooks.Wait()
+	assert.Equal(t, "new-key", config.Datadog.GetString("api_key"))
+}
+
+func TestHandleRestoreNotSnapStart(t *testing.T) {
+	hookCalls := 0
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		restoreHook:      func() string { hookCalls++; return "" },
+	}
+	d.HandleRestore(time.Now())
+	d.restoreHooks.Wait()
+	d.SetExecutionContext("arn:aws:lambda:us-east-1:123456789012:function:test-function", "request-1")
+	assert.Equal(t, 0, hookCalls)
+	assert.True(t, d.ExecutionContext.Coldstart)
+	assert.Equal(t, []string{"cold_start:true"}, d.ExecutionContext.LastInvocationInitTags())
+}
+
+func TestComputeGlobalTagsAfterRestore(t *testing.T) {
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:old-function", SnapStart: true},
+		ExtraTags:        &serverlessLog.Tags{},
+	}
+	d.ComputeGlobalTags(nil)
+	assert.Contains(t, d.ExtraTags.Tags, "functionname:old-function")
+
+	d.HandleRestore(time.Now())
+	d.ExecutionContext.ARN = "arn:aws:lambda:us-east-1:123456789012:function:new-function"
+	d.ComputeGlobalTags(nil)
+	assert.Contains(t, d.ExtraTags.Tags, "functionname:new-function")
+}
@@ -0,0 +1,95 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// transportTCP and transportUnix are the transports the daemon can listen on, advertised
+	// to the client libraries by the Hello route
+	transportTCP  = "tcp"
+	transportUnix = "unix"
+
+	// socketFileMode restricts the unix socket to the sandbox user, which runs the runtime and
+	// the extensions
+	socketFileMode = 0600
+)
+
+// helloResponse is the response of the Hello route, telling the client libraries the transports
+// the daemon listens on
+type helloResponse struct {
+	Transports []string `json:"transports"`
+	SocketPath string   `json:"socket_path,omitempty"`
+}
+
+// listen starts serving the routes of the daemon on the TCP address and on the unix socket,
+// either of them being disabled when empty. A unix socket which can't be listened on is
+// reported and skipped, the routes staying available over TCP when enabled.
+func (d *Daemon) listen(addr, socketPath string) {
+	if socketPath != "" {
+		listener, err := listenUnixSocket(socketPath)
+		if err != nil {
+			log.Errorf("Unable to listen on the unix socket %s: %s", socketPath, err)
+		} else {
+			d.socketPath = socketPath
+			d.transports = append(d.transports, transportUnix)
+			go func() {
+				_ = d.httpServer.Serve(listener)
+			}()
+		}
+	}
+
+	if addr != "" {
+		d.transports = append(d.transports, transportTCP)
+		go func() {
+			_ = d.httpServer.ListenAndServe()
+		}()
+	}
+
+	if len(d.transports) == 0 {
+		log.Error("The daemon isn't listening on any transport, the client libraries can't reach it")
+	}
+}
+
+// listenUnixSocket listens on a unix socket only accessible to the sandbox user. A socket left
+// at the same path, by a previous run of the extension, is replaced.
+func listenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and isn't a unix socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// nothing is served on the socket before its permissions are restricted
+	if err := os.Chmod(path, socketFileMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeSocket removes the unix socket of the daemon once its HTTP server is shut down
+func (d *Daemon) removeSocket() {
+	if d.socketPath == "" {
+		return
+	}
+	if err := os.Remove(d.socketPath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove the unix socket %s: %s", d.socketPath, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+)
+
+// freeTCPAddr returns a local TCP address nothing listens on
+func freeTCPAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// unixClient returns an HTTP client connecting to the unix socket whatever the host of the URL
+func unixClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+// waitForRoute waits for the daemon to serve the status route through the client
+func waitForRoute(t *testing.T, client *http.Client, url string) {
+	require.Eventually(t, func() bool {
+		resp, err := client.Get(url + "/lambda/status")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == 200
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDaemonTransports(t *testing.T) {
+	addr := freeTCPAddr(t)
+	socketPath := filepath.Join(t.TempDir(), "extension.sock")
+	d := StartDaemon(addr, socketPath)
+	d.MetricAgent = &metrics.ServerlessMetricAgent{}
+	stopped := false
+	defer func() {
+		if !stopped {
+			d.Stop()
+		}
+	}()
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(socketFileMode), info.Mode().Perm())
+
+	tcpClient, socketClient := http.DefaultClient, unixClient(socketPath)
+	waitForRoute(t, tcpClient, "http://"+addr)
+	waitForRoute(t, socketClient, "http://extension")
+
+	// the hello route advertises both transports
+	resp, err := socketClient.Post("http://extension/lambda/hello", "application/json", strings.NewReader(`{"library":"datadog-lambda-js","version":"4.66.0"}`))
+	require.NoError(t, err)
+	var hello helloResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&hello))
+	resp.Body.Close()
+	assert.ElementsMatch(t, []string{transportTCP, transportUnix}, hello.Transports)
+	assert.Equal(t, socketPath, hello.SocketPath)
+
+	// the flush route is served on both transports at the same time, the DogStatsD server not being ready
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, target := range []struct {
+			client *http.Client
+			url    string
+		}{{tcpClient, "http://" + addr}, {socketClient, "http://extension"}} {
+			wg.Add(1)
+			go func(client *http.Client, url string) {
+				defer wg.Done()
+				resp, err := client.Post(url+"/lambda/flush", "application/json", nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Equal(t, 503, resp.StatusCode)
+				assert.Equal(t, "DogStatsD server not ready", string(body))
+			}(target.client, target.url)
+		}
+	}
+	wg.Wait()
+
+	// the socket is removed on stop
+	d.Stop()
+	stopped = true
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDaemonUnixSocketOnly(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "extension.sock")
+	// a socket left by a previous run is replaced
+	previous, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	previous.(*net.UnixListener).SetUnlinkOnClose(false)
+	previous.Close()
+
+	d := StartDaemon("", socketPath)
+	defer d.Stop()
+	assert.Equal(t, []string{transportUnix}, d.transports)
+	waitForRoute(t, unixClient(socketPath), "http://extension")
+}
+
+func TestListenUnixSocketExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extension.sock")
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+
+	_, err := listenUnixSocket(path)
+	assert.Error(t, err)
+	// the file isn't a socket, it is kept
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -0,0 +1,285 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// maxEventPayloadSize is the maximum size of the invocation event read to find its trigger,
+// larger events are truncated before being parsed
+const maxEventPayloadSize = 64 * 1024
+
+// maxSpanPointers is the maximum number of span pointers linking an invocation to the records
+// of its event, the next records aren't linked
+const maxSpanPointers = 50
+
+const (
+	functionURLEventSource = "lambda-function-url"
+	albEventSource         = "application-load-balancer"
+	sqsEventSource         = "sqs"
+	snsEventSource         = "sns"
+	s3EventSource          = "s3"
+	kinesisEventSource     = "kinesis"
+	dynamoDBEventSource    = "dynamodb"
+
+	// functionURLDomain is in the domain name of the function URLs,
+	// <url-id>.lambda-url.<region>.on.aws
+	functionURLDomain = ".lambda-url."
+)
+
+// invocationTrigger describes the trigger of an invocation: the HTTP request of the function
+// URLs and the ALB target groups, or the resource of the records of the SQS, SNS, S3, Kinesis
+// and DynamoDB stream events
+type invocationTrigger struct {
+	eventSource    string
+	method         string
+	route          string
+	eventSourceARN string
+	// resource is the name of the queue, topic, bucket, stream or table of the records
+	resource string
+	// mixedSources is set when the records of the event don't all come from the same
+	// resource, the trigger being the one of the first record
+	mixedSources bool
+}
+
+// spanTags returns the tags of the invocation span describing the trigger, the empty ones
+// are dropped when the span is tagged
+func (t invocationTrigger) spanTags() map[string]string {
+	tags := map[string]string{
+		"function_trigger.event_source": t.eventSource,
+		"http.method":                   t.method,
+		"http.route":                    t.route,
+		"trigger_resource":              t.resource,
+	}
+	if t.eventSourceARN != "" {
+		tags["function_trigger.event_source_arn"] = t.eventSourceARN
+	}
+	return tags
+}
+
+// metricTags returns the tags of the enhanced metrics describing the trigger, the route is
+// left out as it is the raw path of the request
+func (t invocationTrigger) metricTags() []string {
+	tags := []string{"function_trigger.event_source:" + t.eventSource}
+	if t.method != "" {
+		tags = append(tags, "http.method:"+strings.ToLower(t.method))
+	}
+	if t.eventSourceARN != "" {
+		tags = append(tags, "function_trigger.event_source_arn:"+t.eventSourceARN)
+	}
+	if t.resource != "" {
+		tags = append(tags, "trigger_resource:"+t.resource)
+	}
+	return tags
+}
+
+// triggerEvent holds the fields of the events of the HTTP triggers:
+// - the Lambda function URLs, with their request in requestContext.http
+// - the ALB target groups, with their ARN in requestContext.elb and the request at the top level
+type triggerEvent struct {
+	RequestContext struct {
+		DomainName string `json:"domainName"`
+		HTTP       struct {
+			Method string `json:"method"`
+			Path   string `json:"path"`
+		} `json:"http"`
+		ELB struct {
+			TargetGroupARN string `json:"targetGroupArn"`
+		} `json:"elb"`
+	} `json:"requestContext"`
+	HTTPMethod string `json:"httpMethod"`
+	Path       string `json:"path"`
+}
+
+// triggerRecord holds the fields of the records of the SQS, SNS, S3, Kinesis and DynamoDB
+// stream events identifying their resource. The records of the SNS events have an
+// EventSource field, matched by eventSource as the JSON keys are case insensitive.
+type triggerRecord struct {
+	EventSource    string `json:"eventSource"`
+	EventSourceARN string `json:"eventSourceARN"`
+	SNS            struct {
+		TopicARN string `json:"TopicArn"`
+	} `json:"Sns"`
+	S3 struct {
+		Bucket struct {
+			Name string `json:"name"`
+			ARN  string `json:"arn"`
+		} `json:"bucket"`
+	} `json:"s3"`
+}
+
+// trigger returns the trigger described by a record, if it comes from a known source
+func (r triggerRecord) trigger() (invocationTrigger, bool) {
+	switch r.EventSource {
+	case "aws:sqs":
+		// arn:aws:sqs:<region>:<account>:<queue>
+		return recordTrigger(sqsEventSource, r.EventSourceARN, arnResource(r.EventSourceARN, ":", ""))
+	case "aws:sns":
+		// arn:aws:sns:<region>:<account>:<topic>
+		return recordTrigger(snsEventSource, r.SNS.TopicARN, arnResource(r.SNS.TopicARN, ":", ""))
+	case "aws:kinesis":
+		// arn:aws:kinesis:<region>:<account>:stream/<stream>, followed by /consumer/<consumer>
+		// for the enhanced fan-out consumers
+		return recordTrigger(kinesisEventSource, r.EventSourceARN, arnResource(r.EventSourceARN, ":stream/", "/"))
+	case "aws:dynamodb":
+		// arn:aws:dynamodb:<region>:<account>:table/<table>/stream/<label>
+		return recordTrigger(dynamoDBEventSource, r.EventSourceARN, arnResource(r.EventSourceARN, ":table/", "/"))
+	case "aws:s3":
+		arn := r.S3.Bucket.ARN
+		if arn == "" && r.S3.Bucket.Name != "" {
+			arn = "arn:aws:s3:::" + r.S3.Bucket.Name
+		}
+		return recordTrigger(s3EventSource, arn, r.S3.Bucket.Name)
+	}
+	return invocationTrigger{}, false
+}
+
+// recordTrigger returns the trigger of a record from the ARN and the name of its resource,
+// the records without resource are ignored
+func recordTrigger(eventSource, arn, resource string) (invocationTrigger, bool) {
+	if resource == "" {
+		return invocationTrigger{}, false
+	}
+	return invocationTrigger{eventSource: eventSource, eventSourceARN: arn, resource: resource}, true
+}
+
+// arnResource returns the name of the resource of an ARN, following the last occurrence of
+// prefix and ending at the given separator, if any
+func arnResource(arn, prefix, separator string) string {
+	i := strings.LastIndex(arn, prefix)
+	if i < 0 {
+		return ""
+	}
+	resource := arn[i+len(prefix):]
+	if separator != "" {
+		if j := strings.Index(resource, separator); j >= 0 {
+			resource = resource[:j]
+		}
+	}
+	return resource
+}
+
+// decodeRecordsTrigger returns the trigger of the first record of an event, decoding the
+// next records to find out whether they all come from the same resource. The records are
+// decoded one by one so that the first ones are still found when the event has been truncated.
+func decodeRecordsTrigger(decoder *json.Decoder) (invocationTrigger, bool) {
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return invocationTrigger{}, false
+	}
+	var first invocationTrigger
+	found := false
+	for decoder.More() {
+		var record triggerRecord
+		if err := decoder.Decode(&record); err != nil {
+			break
+		}
+		trigger, ok := record.trigger()
+		switch {
+		case !found:
+			if !ok {
+				return invocationTrigger{}, false
+			}
+			first, found = trigger, true
+		case !ok || trigger.eventSource != first.eventSource || trigger.eventSourceARN != first.eventSourceARN:
+			first.mixedSources = true
+		}
+	}
+	return first, found
+}
+
+// parseInvocationTrigger returns the trigger of an invocation from its event, if it is a
+// Lambda function URL, an ALB target group or the first record of an SQS, SNS, S3, Kinesis or
+// DynamoDB stream event. Other events are ignored. The event is parsed as a stream so that the
+// request context is still found when the event has been truncated, it is before the body in
+// both HTTP events.
+func parseInvocationTrigger(payload []byte) (invocationTrigger, bool) {
+	var event triggerEvent
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return invocationTrigger{}, false
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		key, _ := token.(string)
+		var value interface{}
+		switch key {
+		case "requestContext":
+			value = &event.RequestContext
+		case "httpMethod":
+			value = &event.HTTPMethod
+		case "path":
+			value = &event.Path
+		case "Records":
+			return decodeRecordsTrigger(decoder)
+		default:
+			value = &json.RawMessage{}
+		}
+		if err := decoder.Decode(value); err != nil {
+			break
+		}
+	}
+
+	switch {
+	case event.RequestContext.ELB.TargetGroupARN != "":
+		return invocationTrigger{
+			eventSource:    albEventSource,
+			method:         event.HTTPMethod,
+			route:          event.Path,
+			eventSourceARN: event.RequestContext.ELB.TargetGroupARN,
+		}, true
+	case event.RequestContext.HTTP.Method != "" && strings.Contains(event.RequestContext.DomainName, functionURLDomain):
+		return invocationTrigger{
+			eventSource: functionURLEventSource,
+			method:      event.RequestContext.HTTP.Method,
+			route:       event.RequestContext.HTTP.Path,
+		}, true
+	}
+	return invocationTrigger{}, false
+}
+
+// parseResponseStatusCode returns the statusCode field of a function response, as returned to
+// the function URLs and the ALB target groups, when it is a JSON object with one
+func parseResponseStatusCode(payload []byte) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", false
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		if key, _ := token.(string); key != "statusCode" {
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return "", false
+			}
+			continue
+		}
+		var statusCode interface{}
+		if err := decoder.Decode(&statusCode); err != nil {
+			return "", false
+		}
+		switch code := statusCode.(type) {
+		case json.Number:
+			return code.String(), true
+		case string:
+			if _, err := strconv.Atoi(code); err == nil {
+				return code, true
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
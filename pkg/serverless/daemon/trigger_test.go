@@ -0,0 +1,278 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInvocationTrigger(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected invocationTrigger
+		found    bool
+	}{
+		{
+			fixture:  "function_url.json",
+			expected: invocationTrigger{eventSource: "lambda-function-url", method: "POST", route: "/orders"},
+			found:    true,
+		},
+		{
+			fixture:  "function_url_base64.json",
+			expected: invocationTrigger{eventSource: "lambda-function-url", method: "PUT", route: "/upload"},
+			found:    true,
+		},
+		{
+			fixture: "alb.json",
+			expected: invocationTrigger{
+				eventSource:    "application-load-balancer",
+				method:         "GET",
+				route:          "/orders/42",
+				eventSourceARN: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/lambda-orders/6d0ecf831eec9f09",
+			},
+			found: true,
+		},
+		{
+			fixture: "alb_base64.json",
+			expected: invocationTrigger{
+				eventSource:    "application-load-balancer",
+				method:         "POST",
+				route:          "/upload",
+				eventSourceARN: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/lambda-upload/73e2d6bc24d8a067",
+			},
+			found: true,
+		},
+		{
+			fixture: "sqs.json",
+			expected: invocationTrigger{
+				eventSource:    "sqs",
+				eventSourceARN: "arn:aws:sqs:us-east-1:123456789012:my-queue",
+				resource:       "my-queue",
+			},
+			found: true,
+		},
+		{
+			fixture: "sns.json",
+			expected: invocationTrigger{
+				eventSource:    "sns",
+				eventSourceARN: "arn:aws:sns:us-east-1:123456789012:orders-topic",
+				resource:       "orders-topic",
+			},
+			found: true,
+		},
+		{
+			fixture: "s3.json",
+			expected: invocationTrigger{
+				eventSource:    "s3",
+				eventSourceARN: "arn:aws:s3:::some-bucket",
+				resource:       "some-bucket",
+			},
+			found: true,
+		},
+		{
+			fixture: "kinesis.json",
+			expected: invocationTrigger{
+				eventSource:    "kinesis",
+				eventSourceARN: "arn:aws:kinesis:us-east-1:123456789012:stream/clickstream",
+				resource:       "clickstream",
+			},
+			found: true,
+		},
+		{
+			fixture: "dynamodb.json",
+			expected: invocationTrigger{
+				eventSource:    "dynamodb",
+				eventSourceARN: "arn:aws:dynamodb:us-east-1:123456789012:table/some-table/stream/2024-09-20T14:12:22.518",
+				resource:       "some-table",
+			},
+			found: true,
+		},
+		{
+			// the records of several queues are attributed to the first one
+			fixture: "sqs_mixed.json",
+			expected: invocationTrigger{
+				eventSource:    "sqs",
+				eventSourceARN: "arn:aws:sqs:us-east-1:123456789012:my-queue",
+				resource:       "my-queue",
+				mixedSources:   true,
+			},
+			found: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			payload, err := ioutil.ReadFile("testdata/trigger/" + test.fixture)
+			require.NoError(t, err)
+			trigger, found := parseInvocationTrigger(payload)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.expected, trigger)
+		})
+	}
+}
+
+func TestParseInvocationTriggerIgnoredEvents(t *testing.T) {
+	for _, payload := range []string{
+		``,
+		`"event"`,
+		`[{"requestContext":{"elb":{"targetGroupArn":"arn"}}}]`,
+		`{"requestContext":"unexpected"}`,
+		`{"Records":[]}`,
+		`{"Records":[{"eventSource":"aws:ses"}]}`,
+		`{"Records":[{"eventSource":"aws:sqs","eventSourceARN":""}]}`,
+		// the HTTP APIs of API Gateway share the shape of the function URLs
+		`{"requestContext":{"domainName":"id.execute-api.us-east-1.amazonaws.com","http":{"method":"GET","path":"/"}}}`,
+	} {
+		_, found := parseInvocationTrigger([]byte(payload))
+		assert.False(t, found, payload)
+	}
+}
+
+func TestParseInvocationTriggerTruncatedEvent(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/trigger/function_url.json")
+	require.NoError(t, err)
+	// the body of a large event is cut
+	truncated := payload[:bytes.Index(payload, []byte(`"body"`))+len(`"body": "{\"ite`)]
+
+	trigger, found := parseInvocationTrigger(truncated)
+	assert.True(t, found)
+	assert.Equal(t, "/orders", trigger.route)
+}
+
+func TestParseInvocationTriggerRecords(t *testing.T) {
+	// the S3 events without bucket ARN and the Kinesis enhanced fan-out consumers
+	trigger, found := parseInvocationTrigger([]byte(`{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"uploads"}}}]}`))
+	assert.True(t, found)
+	assert.Equal(t, "arn:aws:s3:::uploads", trigger.eventSourceARN)
+	trigger, found = parseInvocationTrigger([]byte(`{"Records":[{"eventSource":"aws:kinesis","eventSourceARN":"arn:aws:kinesis:us-east-1:123456789012:stream/clickstream/consumer/app:1545084650"}]}`))
+	assert.True(t, found)
+	assert.Equal(t, "clickstream", trigger.resource)
+
+	// the records of different sources are mixed, whatever their order
+	trigger, found = parseInvocationTrigger([]byte(`{"Records":[{"eventSource":"aws:sqs","eventSourceARN":"arn:aws:sqs:us-east-1:123456789012:q"},{"eventSource":"aws:sns","Sns":{"TopicArn":"arn:aws:sns:us-east-1:123456789012:q"}}]}`))
+	assert.True(t, found)
+	assert.Equal(t, "q", trigger.resource)
+	assert.True(t, trigger.mixedSources)
+
+	// the first records of a truncated event are found
+	payload, err := ioutil.ReadFile("testdata/trigger/sqs_mixed.json")
+	require.NoError(t, err)
+	trigger, found = parseInvocationTrigger(payload[:bytes.Index(payload, []byte(`"second"`))])
+	assert.True(t, found)
+	assert.Equal(t, "my-queue", trigger.resource)
+	assert.False(t, trigger.mixedSources)
+}
+
+func TestParseResponseStatusCode(t *testing.T) {
+	assert := assert.New(t)
+	statusCode, found := parseResponseStatusCode([]byte(`{"statusCode":201,"body":"eyJpZCI6NDJ9","isBase64Encoded":true}`))
+	assert.True(found)
+	assert.Equal("201", statusCode)
+
+	statusCode, found = parseResponseStatusCode([]byte(`{"body":"ok","statusCode":"404"}`))
+	assert.True(found)
+	assert.Equal("404", statusCode)
+
+	for _, payload := range []string{``, `"ok"`, `{"body":"ok"}`, `{"statusCode":"ok"}`, `{"statusCode":{}}`} {
+		_, found = parseResponseStatusCode([]byte(payload))
+		assert.False(found, payload)
+	}
+}
+
+func TestInvocationTriggerRoutes(t *testing.T) {
+	assert := assert.New(t)
+	d := &Daemon{ExecutionContext: &serverlessLog.ExecutionContext{}, ExtraTags: &serverlessLog.Tags{}}
+	d.SetExecutionContext("arn", "request-1")
+
+	payload, err := ioutil.ReadFile("testdata/trigger/alb.json")
+	require.NoError(t, err)
+	request := httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", bytes.NewReader(payload))
+	request.Header.Set(requestIDHeader, "request-1")
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.NotEmpty(invocationTriggerTags(d, "request-1"))
+
+	request = httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(`{"statusCode":200,"body":"ok"}`))
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal([]string{
+		"function_trigger.event_source:application-load-balancer",
+		"http.method:get",
+		"function_trigger.event_source_arn:arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/lambda-orders/6d0ecf831eec9f09",
+		"http.status_code:200",
+	}, invocationTriggerTags(d, "request-1"))
+
+	// the invocations with another trigger are left untouched
+	d.SetExecutionContext("arn", "request-2")
+	payload, err = ioutil.ReadFile("testdata/payload/api_gateway.json")
+	require.NoError(t, err)
+	request = httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", bytes.NewReader(payload))
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	request = httptest.NewRequest(http.MethodPost, "/lambda/end-invocation", strings.NewReader(`{"statusCode":500}`))
+	(&EndInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Len(invocationTriggerTags(d, "request-1"), 4)
+	assert.Empty(invocationTriggerTags(d, "request-2"))
+}
+
+func TestInvocationTriggerRecords(t *testing.T) {
+	assert := assert.New(t)
+	d := &Daemon{ExecutionContext: &serverlessLog.ExecutionContext{}, ExtraTags: &serverlessLog.Tags{}}
+	d.SetExecutionContext("arn", "request-1")
+
+	payload, err := ioutil.ReadFile("testdata/trigger/sqs.json")
+	require.NoError(t, err)
+	request := httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", bytes.NewReader(payload))
+	request.Header.Set(requestIDHeader, "request-1")
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Equal([]string{
+		"function_trigger.event_source:sqs",
+		"function_trigger.event_source_arn:arn:aws:sqs:us-east-1:123456789012:my-queue",
+		"trigger_resource:my-queue",
+	}, invocationTriggerTags(d, "request-1"))
+	assert.Empty(d.mixedTriggerSources)
+
+	// the batches mixing several queues are counted
+	d.SetExecutionContext("arn", "request-2")
+	payload, err = ioutil.ReadFile("testdata/trigger/sqs_mixed.json")
+	require.NoError(t, err)
+	request = httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", bytes.NewReader(payload))
+	request.Header.Set(requestIDHeader, "request-2")
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.Contains(invocationTriggerTags(d, "request-2"), "trigger_resource:my-queue")
+	// the trigger of the previous invocation is kept until its report is processed
+	assert.Len(invocationTriggerTags(d, "request-1"), 3)
+	assert.Equal(map[string]int64{"my-queue": 1}, d.takeMixedTriggerSources())
+	assert.Empty(d.takeMixedTriggerSources())
+}
+
+func TestInvocationTriggerSpanTags(t *testing.T) {
+	trigger := invocationTrigger{
+		eventSource:    "kinesis",
+		eventSourceARN: "arn:aws:kinesis:us-east-1:123456789012:stream/clickstream",
+		resource:       "clickstream",
+	}
+	assert.Equal(t, map[string]string{
+		"function_trigger.event_source":     "kinesis",
+		"function_trigger.event_source_arn": "arn:aws:kinesis:us-east-1:123456789012:stream/clickstream",
+		"trigger_resource":                  "clickstream",
+		"http.method":                       "",
+		"http.route":                        "",
+	}, trigger.spanTags())
+}
+
+// invocationTriggerTags returns the trigger tags of the invocation with the given request ID
+func invocationTriggerTags(d *Daemon, requestID string) []string {
+	if invocation := d.ExecutionContext.FindInvocation(requestID); invocation != nil {
+		return invocation.TriggerTags
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// warmupMatcher detects the invocations sent by a warm-up plugin from their event, by
+// comparing the value found at a path of the JSON object of the event with the expected one
+type warmupMatcher struct {
+	path  []string
+	value string
+}
+
+// newWarmupMatcher returns a matcher comparing the value at the given dot-separated path
+// of the event with the given value. It returns nil when the path is empty, disabling
+// the detection.
+func newWarmupMatcher(path string, value string) *warmupMatcher {
+	if path == "" {
+		return nil
+	}
+	return &warmupMatcher{path: strings.Split(path, "."), value: value}
+}
+
+// matches returns whether the given event is a warm-up request. The events which aren't
+// JSON objects are ignored without being decoded.
+func (m *warmupMatcher) matches(payload []byte) bool {
+	if m == nil {
+		return false
+	}
+	payload = bytes.TrimLeft(payload, " \t\r\n")
+	if len(payload) == 0 || payload[0] != '{' {
+		return false
+	}
+	raw := json.RawMessage(payload)
+	for _, key := range m.path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return false
+		}
+		var found bool
+		if raw, found = object[key]; !found {
+			return false
+		}
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value == m.value
+	}
+	// booleans and numbers are compared with their JSON representation
+	return string(bytes.TrimSpace(raw)) == m.value
+}
+
+// HandleWarmup marks the invocation with the given request ID, or the last one when the
+// request ID isn't known, as a warm-up request: its span is dropped, the enhanced metrics
+// of its report aren't sent and its start isn't used to compute the invocation interval.
+// The aws.lambda.enhanced.warmup metric is sent instead.
+func (d *Daemon) HandleWarmup(requestID string) {
+	d.invocationsMutex.Lock()
+	if requestID == "" {
+		requestID = d.ExecutionContext.LastRequestID
+	}
+	initTags := d.ExecutionContext.InitTags(requestID)
+	d.ExecutionContext.Invocation(requestID).Warmup = true
+	d.invocationsMutex.Unlock()
+
+	log.Debugf("Invocation %q is a warm-up request", requestID)
+
+	// the invocation time is stored when the event is received, before it is known to be a warm-up
+	d.discardLastInvocationTime()
+
+	if d.TraceAgent != nil {
+		d.TraceAgent.SetWarmup(requestID)
+	}
+
+	if d.enhancedMetricsEnabled && d.MetricAgent != nil && d.MetricAgent.IsReady() {
+		metricTags := append(append([]string{}, d.ExtraTags.Tags...), initTags...)
+		metrics.SendWarmupEnhancedMetric(metricTags, d.MetricAgent.GetMetricChannel())
+	}
+}
@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package daemon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	serverlessLog "github.com/DataDog/datadog-agent/pkg/serverless/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmupMatcherDefault(t *testing.T) {
+	m := newWarmupMatcher("source", "serverless-plugin-warmup")
+	for _, payload := range []string{
+		`{"source":"serverless-plugin-warmup"}`,
+		"\n  {\"source\": \"serverless-plugin-warmup\"}",
+		`{"concurrency":3,"source":"serverless-plugin-warmup","warmer":true}`,
+		`{"body":{"source":"aws.events"},"source":"serverless-plugin-warmup"}`,
+	} {
+		assert.True(t, m.matches([]byte(payload)), payload)
+	}
+	for _, payload := range []string{
+		``,
+		`null`,
+		`"{\"source\":\"serverless-plugin-warmup\"}"`,
+		`["serverless-plugin-warmup"]`,
+		`{"source":"aws.events","detail-type":"Scheduled Event"}`,
+		`{"detail":{"source":"serverless-plugin-warmup"}}`,
+		`{"source":"serverless-plugin-warmup"`,
+	} {
+		assert.False(t, m.matches([]byte(payload)), payload)
+	}
+}
+
+func TestWarmupMatcherCustomPath(t *testing.T) {
+	// lambda-warmer
+	m := newWarmupMatcher("warmer", "true")
+	assert.True(t, m.matches([]byte(`{"warmer":true,"concurrency":2}`)))
+	assert.False(t, m.matches([]byte(`{"warmer":false}`)))
+	assert.False(t, m.matches([]byte(`{"source":"serverless-plugin-warmup"}`)))
+
+	// custom payload of the warm-up plugin
+	m = newWarmupMatcher("detail.warmup.origin", "scheduler")
+	assert.True(t, m.matches([]byte(`{"detail":{"warmup":{"origin":"scheduler"}}}`)))
+	assert.False(t, m.matches([]byte(`{"detail":{"warmup":"scheduler"}}`)))
+	assert.False(t, m.matches([]byte(`{"detail":{"warmup":{"origin":"api"}}}`)))
+}
+
+func TestWarmupMatcherDisabled(t *testing.T) {
+	m := newWarmupMatcher("", "serverless-plugin-warmup")
+	assert.Nil(t, m)
+	assert.False(t, m.matches([]byte(`{"source":"serverless-plugin-warmup"}`)))
+}
+
+func TestHandleWarmup(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	d := &Daemon{
+		ExecutionContext: &serverlessLog.ExecutionContext{},
+		ExtraTags:        &serverlessLog.Tags{},
+		lastInvocations:  []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute), now},
+		warmup:           newWarmupMatcher("source", "serverless-plugin-warmup"),
+	}
+	d.SetExecutionContext("arn", "request-1")
+
+	request := httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", strings.NewReader(`{"source":"serverless-plugin-warmup"}`))
+	request.Header.Set(requestIDHeader, "request-1")
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.True(d.ExecutionContext.FindInvocation("request-1").Warmup)
+	assert.Equal([]time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute)}, d.lastInvocations)
+
+	// the other invocations are left untouched
+	d.SetExecutionContext("arn", "request-2")
+	request = httptest.NewRequest(http.MethodPost, "/lambda/start-invocation", strings.NewReader(`{"key":"value"}`))
+	(&StartInvocation{d}).ServeHTTP(httptest.NewRecorder(), request)
+	assert.True(d.ExecutionContext.FindInvocation("request-1").Warmup)
+	assert.Nil(d.ExecutionContext.FindInvocation("request-2"))
+	assert.Len(d.lastInvocations, 2)
+}
@@ -0,0 +1,61 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// maxBufferedFunctionLogs is the number of function log lines kept to give context to a crash of the runtime
+	maxBufferedFunctionLogs = 20
+	// maxBufferedFunctionLogSize is the maximum size of a buffered function log line, longer lines are truncated
+	maxBufferedFunctionLogSize = 1024
+)
+
+// FunctionLogBuffer keeps the last function log lines, so that they can be sent along with the error log
+// of a crash of the runtime. Its zero value is ready to use and a nil buffer doesn't keep anything.
+type FunctionLogBuffer struct {
+	sync.Mutex
+	lines []string
+	// next is the index of the next line to overwrite once the buffer is full
+	next int
+}
+
+// Add buffers a function log line, overwriting the oldest one when the buffer is full
+func (b *FunctionLogBuffer) Add(line string) {
+	if b == nil {
+		return
+	}
+	line = strings.TrimRight(line, "\n")
+	if len(line) > maxBufferedFunctionLogSize {
+		line = line[:maxBufferedFunctionLogSize] + "..."
+	}
+	b.Lock()
+	defer b.Unlock()
+	if len(b.lines) < maxBufferedFunctionLogs {
+		b.lines = append(b.lines, line)
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % maxBufferedFunctionLogs
+}
+
+// Take returns the buffered function log lines, the oldest first, and empties the buffer
+func (b *FunctionLogBuffer) Take() []string {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	lines := make([]string, 0, len(b.lines))
+	lines = append(lines, b.lines[b.next:]...)
+	lines = append(lines, b.lines[:b.next]...)
+	b.lines = nil
+	b.next = 0
+	return lines
+}
@@ -0,0 +1,73 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import "time"
+
+// maxInvocationContexts bounds the number of invocations whose context is kept until their logs are processed
+const maxInvocationContexts = 10
+
+// InvocationContext is what is known about an invocation to attribute its logs. The logs of an
+// invocation are received asynchronously from the Logs API, possibly once the next invocation
+// started, so it is kept until the report log of the invocation is processed.
+type InvocationContext struct {
+	// XRayTraceID and XRaySpanID are the Datadog IDs converted from the X-Ray context of the
+	// invocation, when X-Ray active tracing is enabled, to correlate its logs with its trace
+	XRayTraceID string
+	XRaySpanID  string
+	// TriggerTags are the tags of the trigger of the invocation found in its event, the enhanced
+	// metrics of its report are tagged with them
+	TriggerTags []string
+	// Warmup is true when the invocation was detected as a warm-up request, the enhanced metrics
+	// of its logs aren't sent
+	Warmup bool
+	// Tags are the custom tags set by the function during the invocation, its logs are tagged
+	// with them
+	Tags []string
+	// StartTime is when the invocation started, to find the invocation restored from a snapshot
+	StartTime time.Time
+}
+
+// Invocation returns the context of the invocation with the given request ID, created if it isn't
+// known yet. The context of the oldest invocation is forgotten when too many of them are kept. The
+// caller must hold the lock of the execution context.
+func (ec *ExecutionContext) Invocation(requestID string) *InvocationContext {
+	if invocation, found := ec.invocations[requestID]; found {
+		return invocation
+	}
+	if ec.invocations == nil {
+		ec.invocations = make(map[string]*InvocationContext)
+	}
+	if len(ec.invocationOrder) >= maxInvocationContexts {
+		delete(ec.invocations, ec.invocationOrder[0])
+		ec.invocationOrder = ec.invocationOrder[1:]
+	}
+	invocation := &InvocationContext{}
+	ec.invocations[requestID] = invocation
+	ec.invocationOrder = append(ec.invocationOrder, requestID)
+	return invocation
+}
+
+// FindInvocation returns the context of the invocation with the given request ID, nil if it isn't
+// known. The caller must hold the lock of the execution context.
+func (ec *ExecutionContext) FindInvocation(requestID string) *InvocationContext {
+	return ec.invocations[requestID]
+}
+
+// forgetInvocation removes the context of the invocation with the given request ID once its logs
+// are processed. The caller must hold the lock of the execution context.
+func (ec *ExecutionContext) forgetInvocation(requestID string) {
+	if _, found := ec.invocations[requestID]; !found {
+		return
+	}
+	delete(ec.invocations, requestID)
+	for i, id := range ec.invocationOrder {
+		if id == requestID {
+			ec.invocationOrder = append(ec.invocationOrder[:i], ec.invocationOrder[i+1:]...)
+			break
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
@@ -35,6 +36,51 @@ type ExecutionContext struct {
 	LastLogRequestID   string
 	Coldstart          bool
 	StartTime          time.Time
+	// RequestIDHistory holds the request IDs of the last invocations, the most recent last
+	RequestIDHistory []string
+	// FailedRequestID is the request ID of the last invocation which returned an error,
+	// the enhanced metrics of its report are tagged with FunctionError
+	FailedRequestID string
+	// FunctionError tells whether the error of FailedRequestID was handled or unhandled
+	FunctionError string
+	// InvocationTagsRequestID is the request ID of the invocation in progress whose function set
+	// custom tags, the metrics received by DogStatsD are tagged with InvocationTags until it
+	// finishes. Its logs are tagged with the tags of its invocation context.
+	InvocationTagsRequestID string
+	InvocationTags          []string
+	// SnapStart is true when the function uses SnapStart, its execution environments being
+	// restored from a snapshot. Restore is true when the last invocation is the first one after
+	// a restore, RestoreRequestID being its request ID, and RestoreStartTime is the time of the
+	// last restoreStart log.
+	SnapStart        bool
+	Restore          bool
+	RestoreRequestID string
+	RestoreStartTime time.Time
+	// invocations are the contexts of the last invocations by request ID, kept until their logs
+	// are processed, invocationOrder holding their request IDs, the oldest first
+	invocations     map[string]*InvocationContext
+	invocationOrder []string
+}
+
+// InitTags returns the cold_start tag of the invocation with the given request ID, and its
+// restore tag when the function uses SnapStart
+func (ec *ExecutionContext) InitTags(requestID string) []string {
+	restore := requestID != "" && requestID == ec.RestoreRequestID
+	return ec.initTags(requestID == ec.ColdstartRequestID && !restore, restore)
+}
+
+// LastInvocationInitTags returns the cold_start tag of the last invocation, and its restore tag
+// when the function uses SnapStart
+func (ec *ExecutionContext) LastInvocationInitTags() []string {
+	return ec.initTags(ec.Coldstart, ec.Restore)
+}
+
+func (ec *ExecutionContext) initTags(coldStart bool, restore bool) []string {
+	initTags := tags.AddColdStartTag(nil, coldStart)
+	if ec.SnapStart {
+		initTags = tags.AddRestoreTag(initTags, restore)
+	}
+	return initTags
 }
 
 // CollectionRouteInfo is the route on which the AWS environment is sending the logs
@@ -47,6 +93,21 @@ type CollectionRouteInfo struct {
 	ExecutionContext       *ExecutionContext
 	LogsEnabled            bool
 	EnhancedMetricsEnabled bool
+	// RuntimeDoneHandler, when set, is called with the request ID and the time of each runtimeDone log
+	RuntimeDoneHandler func(requestID string, doneTime time.Time)
+	// RuntimeCrashHandler, when set, is called with the request ID, empty if unknown, and the record
+	// of each fault log, reporting that the runtime process died during an invocation
+	RuntimeCrashHandler func(requestID string, reason string)
+	// RestoreHandler, when set, is called with the time of each restoreStart log, reporting that
+	// the execution environment of a SnapStart function was restored from its snapshot
+	RestoreHandler func(restoreTime time.Time)
+	// FunctionLogs, when set, keeps the last function log lines
+	FunctionLogs *FunctionLogBuffer
+	// ExecutionContextMutex, when set, protects ExecutionContext which is shared with the daemon
+	ExecutionContextMutex *sync.Mutex
+	// StructuredLogsMaxSize is the size under which the function log lines are parsed as JSON
+	// to promote their level, message, timestamp and trace context, 0 disables the parsing
+	StructuredLogsMaxSize int
 }
 
 // platformObjectRecord contains additional information found in Platform log messages
@@ -98,8 +159,20 @@ const (
 	logTypePlatformExtension = "platform.extension"
 	// logTypePlatformRuntimeDone is received when the runtime (customer's code) has returned (success or error)
 	logTypePlatformRuntimeDone = "platform.runtimeDone"
+	// logTypePlatformFault is received when the runtime process exited during an invocation, such as after
+	// running out of memory or a native crash
+	logTypePlatformFault = "platform.fault"
+	// logTypePlatformRestoreStart is received when the execution environment of a SnapStart function starts
+	// being restored from its snapshot
+	logTypePlatformRestoreStart = "platform.restoreStart"
+	// logTypePlatformRestoreRuntimeDone is received when the runtime hooks run after the restore are done
+	logTypePlatformRestoreRuntimeDone = "platform.restoreRuntimeDone"
 )
 
+// faultRequestIDPrefix prefixes the request ID in the record of a fault log, such as
+// RequestId: 8f5f5f5f-... Process exited before completing request
+const faultRequestIDPrefix = "RequestId: "
+
 // logMessage is a log message sent by the AWS API.
 type logMessage struct {
 	time    time.Time
@@ -138,9 +211,26 @@ func (l *logMessage) UnmarshalJSON(data []byte) error {
 	switch typ {
 	case logTypePlatformLogsSubscription, logTypePlatformExtension:
 		l.logType = typ
+	case logTypePlatformFault:
+		l.logType = typ
+		if record, ok := j["record"].(string); ok {
+			l.stringRecord = record
+			l.objectRecord.requestID = parseFaultRequestID(record)
+		}
 	case logTypeFunction, logTypeExtension:
 		l.logType = typ
 		l.stringRecord = j["record"].(string)
+	case logTypePlatformRestoreStart:
+		l.logType = typ
+		l.stringRecord = "RESTORE_START"
+	case logTypePlatformRestoreRuntimeDone:
+		l.logType = typ
+		l.stringRecord = "RESTORE_RUNTIME_DONE"
+		if objectRecord, ok := j["record"].(map[string]interface{}); ok {
+			if status, ok := objectRecord["status"].(string); ok {
+				l.stringRecord += " Status: " + status
+			}
+		}
 	case logTypePlatformStart, logTypePlatformEnd, logTypePlatformReport, logTypePlatformRuntimeDone:
 		l.logType = typ
 		if objectRecord, ok := j["record"].(map[string]interface{}); ok {
@@ -201,6 +291,19 @@ func (l *logMessage) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// parseFaultRequestID returns the request ID in the record of a fault log, empty if not found
+func parseFaultRequestID(record string) string {
+	i := strings.Index(record, faultRequestIDPrefix)
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(record[i+len(faultRequestIDPrefix):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
 // shouldProcessLog returns whether or not the log should be further processed.
 func shouldProcessLog(executionContext *ExecutionContext, message logMessage) bool {
 	// If the global request ID or ARN variable isn't set at this point, do not process further
@@ -278,48 +381,151 @@ func (c *CollectionRouteInfo) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 func processLogMessages(c *CollectionRouteInfo, messages []logMessage) {
 	for _, message := range messages {
-		processMessage(message, c.ExecutionContext, c.EnhancedMetricsEnabled, c.ExtraTags.Tags, c.MetricChannel)
+		// the execution context is shared with the daemon, it is only read and updated under its lock,
+		// the metrics and the logs being sent once it is released
+		c.lockExecutionContext()
+		var traceID, spanID string
+		var invocationTags []string
+		if invocation := c.ExecutionContext.FindInvocation(logRequestID(message, c.ExecutionContext)); invocation != nil {
+			traceID = invocation.XRayTraceID
+			spanID = invocation.XRaySpanID
+			invocationTags = invocation.Tags
+		}
+		metricsContext, sendMetrics := updateExecutionContext(message, c.ExecutionContext, c.EnhancedMetricsEnabled, c.ExtraTags.Tags)
+		arn := c.ExecutionContext.ARN
+		lastRequestID := c.ExecutionContext.LastRequestID
+		c.unlockExecutionContext()
+
+		if sendMetrics {
+			generateEnhancedMetrics(message, metricsContext, c.MetricChannel)
+		}
+		if message.logType == logTypePlatformRuntimeDone && c.RuntimeDoneHandler != nil {
+			c.RuntimeDoneHandler(message.objectRecord.requestID, message.time)
+		}
+		if message.logType == logTypeFunction {
+			c.FunctionLogs.Add(message.stringRecord)
+		}
+		if message.logType == logTypePlatformFault && c.RuntimeCrashHandler != nil {
+			c.RuntimeCrashHandler(message.objectRecord.requestID, message.stringRecord)
+		}
+		if message.logType == logTypePlatformRestoreStart && c.RestoreHandler != nil {
+			c.RestoreHandler(message.time)
+		}
 		// We always collect and process logs for the purpose of extracting enhanced metrics.
 		// However, if logs are not enabled, we do not send them to the intake.
 		if c.LogsEnabled {
-			logMessage := logConfig.NewChannelMessageFromLambda([]byte(message.stringRecord), message.time, c.ExecutionContext.ARN, c.ExecutionContext.LastRequestID)
+			logMessage := logConfig.NewChannelMessageFromLambda([]byte(message.stringRecord), message.time, arn, lastRequestID)
+			logMessage.Lambda.TraceID = traceID
+			logMessage.Lambda.SpanID = spanID
+			logMessage.Lambda.Tags = invocationTags
+			if message.logType == logTypeFunction {
+				promoteStructuredLog(logMessage, message.stringRecord, c.StructuredLogsMaxSize)
+			}
 			c.LogChannel <- logMessage
 		}
 	}
 }
 
-// processMessage performs logic about metrics and tags on the message
-func processMessage(message logMessage, executionContext *ExecutionContext, enhancedMetricsEnabled bool, metricTags []string, metricsChan chan []metrics.MetricSample) {
+// lockExecutionContext locks the execution context when it is shared with the daemon
+func (c *CollectionRouteInfo) lockExecutionContext() {
+	if c.ExecutionContextMutex != nil {
+		c.ExecutionContextMutex.Lock()
+	}
+}
+
+// unlockExecutionContext unlocks the execution context when it is shared with the daemon
+func (c *CollectionRouteInfo) unlockExecutionContext() {
+	if c.ExecutionContextMutex != nil {
+		c.ExecutionContextMutex.Unlock()
+	}
+}
+
+// logRequestID returns the request ID of the invocation a message belongs to, the one of the last
+// start log for the messages without request ID
+func logRequestID(message logMessage, executionContext *ExecutionContext) string {
+	if message.objectRecord.requestID != "" {
+		return message.objectRecord.requestID
+	}
+	return executionContext.LastLogRequestID
+}
+
+// isWarmupMessage returns whether the message belongs to an invocation detected as a warm-up request
+func isWarmupMessage(message logMessage, executionContext *ExecutionContext) bool {
+	invocation := executionContext.FindInvocation(logRequestID(message, executionContext))
+	return invocation != nil && invocation.Warmup
+}
+
+// enhancedMetricsContext is what the enhanced metrics of a log message are generated with, taken
+// from the execution context
+type enhancedMetricsContext struct {
+	tags             []string
+	startTime        time.Time
+	restoreStartTime time.Time
+}
+
+// updateExecutionContext updates the execution context with the message, and returns the context of
+// its enhanced metrics and whether they must be generated. It must be called with the lock of the
+// execution context held.
+func updateExecutionContext(message logMessage, executionContext *ExecutionContext, enhancedMetricsEnabled bool, metricTags []string) (enhancedMetricsContext, bool) {
+	if message.logType == logTypePlatformLogsDropped {
+		log.Debug("Logs were dropped by the AWS Lambda Logs API")
+	}
+
 	// Do not send logs or metrics if we can't associate them with an ARN or Request ID
 	if !shouldProcessLog(executionContext, message) {
-		return
+		return enhancedMetricsContext{}, false
 	}
 
 	if message.logType == logTypePlatformStart {
 		executionContext.LastLogRequestID = message.objectRecord.requestID
 		executionContext.StartTime = message.time
 	}
+	if message.logType == logTypePlatformRestoreStart {
+		executionContext.RestoreStartTime = message.time
+	}
+	// the report is the last log of an invocation
+	if message.logType == logTypePlatformReport {
+		defer executionContext.forgetInvocation(message.objectRecord.requestID)
+	}
 
-	if enhancedMetricsEnabled {
-		tags := tags.AddColdStartTag(metricTags, executionContext.LastLogRequestID == executionContext.ColdstartRequestID)
-		if message.logType == logTypeFunction {
-			serverlessMetrics.GenerateEnhancedMetricsFromFunctionLog(message.stringRecord, message.time, tags, metricsChan)
-		}
-		if message.logType == logTypePlatformReport {
-			serverlessMetrics.GenerateEnhancedMetricsFromReportLog(
-				message.objectRecord.reportLogItem.initDurationMs,
-				message.objectRecord.reportLogItem.durationMs,
-				message.objectRecord.reportLogItem.billedDurationMs,
-				message.objectRecord.reportLogItem.memorySizeMB,
-				message.objectRecord.reportLogItem.maxMemoryUsedMB,
-				message.time, tags, metricsChan)
+	if !enhancedMetricsEnabled || isWarmupMessage(message, executionContext) {
+		return enhancedMetricsContext{}, false
+	}
+
+	tags := append(metricTags[:len(metricTags):len(metricTags)], executionContext.InitTags(executionContext.LastLogRequestID)...)
+	if message.logType == logTypePlatformReport {
+		if message.objectRecord.requestID != "" && message.objectRecord.requestID == executionContext.FailedRequestID {
+			tags = append(tags[:len(tags):len(tags)], "function_error:"+executionContext.FunctionError)
+			executionContext.FailedRequestID = ""
+			executionContext.FunctionError = ""
 		}
-		if message.logType == logTypePlatformRuntimeDone {
-			serverlessMetrics.GenerateRuntimeDurationMetric(executionContext.StartTime, message.time, message.objectRecord.runtimeDoneItem.status, tags, metricsChan)
+		if invocation := executionContext.FindInvocation(message.objectRecord.requestID); invocation != nil {
+			tags = append(tags[:len(tags):len(tags)], invocation.TriggerTags...)
 		}
 	}
+	return enhancedMetricsContext{
+		tags:             tags,
+		startTime:        executionContext.StartTime,
+		restoreStartTime: executionContext.RestoreStartTime,
+	}, true
+}
 
-	if message.logType == logTypePlatformLogsDropped {
-		log.Debug("Logs were dropped by the AWS Lambda Logs API")
+// generateEnhancedMetrics sends the enhanced metrics of the message
+func generateEnhancedMetrics(message logMessage, metricsContext enhancedMetricsContext, metricsChan chan []metrics.MetricSample) {
+	switch message.logType {
+	case logTypeFunction:
+		serverlessMetrics.GenerateEnhancedMetricsFromFunctionLog(message.stringRecord, message.time, metricsContext.tags, metricsChan)
+	case logTypePlatformReport:
+		serverlessMetrics.GenerateEnhancedMetricsFromReportLog(
+			message.objectRecord.reportLogItem.initDurationMs,
+			message.objectRecord.reportLogItem.durationMs,
+			message.objectRecord.reportLogItem.billedDurationMs,
+			message.objectRecord.reportLogItem.memorySizeMB,
+			message.objectRecord.reportLogItem.maxMemoryUsedMB,
+			message.time, metricsContext.tags, metricsChan)
+	case logTypePlatformRuntimeDone:
+		serverlessMetrics.GenerateRuntimeDurationMetric(metricsContext.startTime, message.time, message.objectRecord.runtimeDoneItem.status, metricsContext.tags, metricsChan)
+	case logTypePlatformRestoreRuntimeDone:
+		serverlessMetrics.GenerateRestoreDurationMetric(metricsContext.restoreStartTime, message.time, metricsContext.tags, metricsChan)
 	}
 }
@@ -8,9 +8,11 @@ package logs
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -216,6 +218,140 @@ func TestProcessMessageValid(t *testing.T) {
 	}
 }
 
+func TestProcessMessageReportOfFailedInvocation(t *testing.T) {
+	failedRequestID := "8286a188-ba32-4475-8077-530cd35c09a9"
+	message := logMessage{
+		logType: logTypePlatformReport,
+		time:    time.Now(),
+		objectRecord: platformObjectRecord{
+			requestID: failedRequestID,
+			reportLogItem: reportLogMetrics{
+				durationMs:       1000.0,
+				billedDurationMs: 800.0,
+				memorySizeMB:     1024.0,
+				maxMemoryUsedMB:  256.0,
+			},
+		},
+	}
+	arn := "arn:aws:lambda:us-east-1:123456789012:function:test-function"
+	metricTags := []string{"functionname:test-function"}
+	executionContext := &ExecutionContext{
+		ARN:             arn,
+		LastRequestID:   failedRequestID,
+		FailedRequestID: failedRequestID,
+		FunctionError:   "unhandled",
+	}
+
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	received := <-metricsChan
+	for _, metric := range received {
+		assert.Contains(t, metric.Tags, "function_error:unhandled")
+	}
+	assert.Equal(t, []string{"functionname:test-function"}, metricTags)
+	assert.Empty(t, executionContext.FailedRequestID)
+
+	// the report of the next invocation isn't tagged
+	message.objectRecord.requestID = "9f8e7d6c-ba32-4475-8077-530cd35c09a9"
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	received = <-metricsChan
+	for _, metric := range received {
+		assert.NotContains(t, metric.Tags, "function_error:unhandled")
+	}
+}
+
+func TestProcessMessageReportOfHTTPTriggeredInvocation(t *testing.T) {
+	requestID := "8286a188-ba32-4475-8077-530cd35c09a9"
+	message := logMessage{
+		logType: logTypePlatformReport,
+		time:    time.Now(),
+		objectRecord: platformObjectRecord{
+			requestID: requestID,
+			reportLogItem: reportLogMetrics{
+				durationMs:       1000.0,
+				billedDurationMs: 800.0,
+				memorySizeMB:     1024.0,
+				maxMemoryUsedMB:  256.0,
+			},
+		},
+	}
+	metricTags := []string{"functionname:test-function"}
+	triggerTags := []string{"function_trigger.event_source:lambda-function-url", "http.method:post", "http.status_code:201"}
+	executionContext := &ExecutionContext{
+		ARN:           "arn:aws:lambda:us-east-1:123456789012:function:test-function",
+		LastRequestID: "9f8e7d6c-ba32-4475-8077-530cd35c09a9",
+	}
+	executionContext.Invocation(requestID).TriggerTags = triggerTags
+	// the next invocation started before the report of the previous one was received
+	executionContext.Invocation("9f8e7d6c-ba32-4475-8077-530cd35c09a9").TriggerTags = []string{"function_trigger.event_source:sqs"}
+
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	received := <-metricsChan
+	for _, metric := range received {
+		assert.Subset(t, metric.Tags, triggerTags)
+		assert.NotContains(t, metric.Tags, "function_trigger.event_source:sqs")
+	}
+	assert.Equal(t, []string{"functionname:test-function"}, metricTags)
+	assert.Nil(t, executionContext.FindInvocation(requestID))
+
+	// the report of the next invocation is tagged with its own trigger
+	message.objectRecord.requestID = "9f8e7d6c-ba32-4475-8077-530cd35c09a9"
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	received = <-metricsChan
+	for _, metric := range received {
+		assert.NotContains(t, metric.Tags, "http.status_code:201")
+		assert.Contains(t, metric.Tags, "function_trigger.event_source:sqs")
+	}
+}
+
+func TestProcessMessageReportOfWarmupInvocation(t *testing.T) {
+	requestID := "8286a188-ba32-4475-8077-530cd35c09a9"
+	message := logMessage{
+		logType: logTypePlatformReport,
+		time:    time.Now(),
+		objectRecord: platformObjectRecord{
+			requestID: requestID,
+			reportLogItem: reportLogMetrics{
+				durationMs:       10.0,
+				billedDurationMs: 10.0,
+				memorySizeMB:     1024.0,
+				maxMemoryUsedMB:  256.0,
+			},
+		},
+	}
+	metricTags := []string{"functionname:test-function"}
+	nextRequestID := "9f8e7d6c-ba32-4475-8077-530cd35c09a9"
+	executionContext := &ExecutionContext{
+		ARN:              "arn:aws:lambda:us-east-1:123456789012:function:test-function",
+		LastLogRequestID: requestID,
+		StartTime:        time.Now().Add(-time.Second),
+	}
+	executionContext.Invocation(requestID).Warmup = true
+	// a real invocation started right after the warm-up request
+	executionContext.LastRequestID = nextRequestID
+	executionContext.Invocation(nextRequestID).TriggerTags = []string{"function_trigger.event_source:sqs"}
+
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	runtimeDone := logMessage{
+		logType: logTypePlatformRuntimeDone,
+		time:    time.Now(),
+		objectRecord: platformObjectRecord{
+			requestID:       requestID,
+			runtimeDoneItem: runtimeDoneItem{status: "success"},
+		},
+	}
+	processMessage(runtimeDone, executionContext, true, metricTags, metricsChan)
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	assert.Len(t, metricsChan, 0)
+	assert.Nil(t, executionContext.FindInvocation(requestID))
+
+	// the report of the next invocation generates the enhanced metrics
+	message.objectRecord.requestID = nextRequestID
+	processMessage(message, executionContext, true, metricTags, metricsChan)
+	assert.Len(t, metricsChan, 1)
+}
+
 func TestProcessMessageStartValid(t *testing.T) {
 	message := logMessage{
 		logType: logTypePlatformStart,
@@ -316,12 +452,9 @@ func TestProcessLogMessageLogsEnabled(t *testing.T) {
 	logChannel := make(chan *config.ChannelMessage)
 
 	logCollection := &CollectionRouteInfo{
-		ExecutionContext: &ExecutionContext{
-			ARN:           "myARN",
-			LastRequestID: "myRequestID",
-		},
-		LogsEnabled: true,
-		LogChannel:  logChannel,
+		ExecutionContext: newXRayExecutionContext("myRequestID", "7043144561403045779", "6023947403358210776"),
+		LogsEnabled:      true,
+		LogChannel:       logChannel,
 		ExtraTags: &Tags{
 			Tags: []string{"tag0:value0,tag1:value1"},
 		},
@@ -345,6 +478,8 @@ func TestProcessLogMessageLogsEnabled(t *testing.T) {
 		assert.NotNil(t, received)
 		assert.Equal(t, "myARN", received.Lambda.ARN)
 		assert.Equal(t, "myRequestID", received.Lambda.RequestID)
+		assert.Equal(t, "7043144561403045779", received.Lambda.TraceID)
+		assert.Equal(t, "6023947403358210776", received.Lambda.SpanID)
 	case <-time.After(100 * time.Millisecond):
 		assert.Fail(t, "We should have received logs")
 	}
@@ -563,3 +698,233 @@ func TestUnmarshalPlatformRuntimeDoneLogNotFatal(t *testing.T) {
 	err := logMessage.UnmarshalJSON(raw)
 	assert.Nil(t, err)
 }
+
+func TestProcessLogMessagesRuntimeDone(t *testing.T) {
+	doneTimes := make(map[string]time.Time)
+	c := &CollectionRouteInfo{
+		ExtraTags:        &Tags{},
+		ExecutionContext: &ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:test-function", LastRequestID: "request-2"},
+		RuntimeDoneHandler: func(requestID string, doneTime time.Time) {
+			doneTimes[requestID] = doneTime
+		},
+	}
+	now := time.Now()
+	processLogMessages(c, []logMessage{{
+		logType:      logTypePlatformRuntimeDone,
+		time:         now,
+		objectRecord: platformObjectRecord{requestID: "request-2"},
+	}, {
+		logType:      logTypeFunction,
+		time:         now,
+		stringRecord: "hello",
+	}, {
+		logType:      logTypePlatformRuntimeDone,
+		time:         now.Add(-time.Second),
+		objectRecord: platformObjectRecord{requestID: "request-1"},
+	}})
+
+	assert.Equal(t, map[string]time.Time{"request-1": now.Add(-time.Second), "request-2": now}, doneTimes)
+}
+
+func TestProcessLogMessagesInvocationTags(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 4)
+	c := &CollectionRouteInfo{
+		ExtraTags:        &Tags{},
+		ExecutionContext: &ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:test-function", LastRequestID: "request-1", LastLogRequestID: "request-1"},
+		LogChannel:       logChannel,
+		LogsEnabled:      true,
+	}
+	c.ExecutionContext.Invocation("request-1").Tags = []string{"tenant:acme"}
+	processLogMessages(c, []logMessage{{logType: logTypeFunction, time: time.Now(), stringRecord: "hello"}})
+	assert.Equal(t, []string{"tenant:acme"}, (<-logChannel).Lambda.Tags)
+
+	// the next invocation started before the last logs of the previous one were received, they
+	// keep the tags of their own invocation, which aren't attached to the logs of the next one
+	c.ExecutionContext.LastRequestID = "request-2"
+	processLogMessages(c, []logMessage{
+		{logType: logTypeFunction, time: time.Now(), stringRecord: "late log"},
+		{logType: logTypePlatformReport, time: time.Now(), objectRecord: platformObjectRecord{requestID: "request-1"}},
+		{logType: logTypePlatformStart, time: time.Now(), objectRecord: platformObjectRecord{requestID: "request-2"}},
+		{logType: logTypeFunction, time: time.Now(), stringRecord: "hello"},
+	})
+	assert.Equal(t, []string{"tenant:acme"}, (<-logChannel).Lambda.Tags)
+	assert.Equal(t, []string{"tenant:acme"}, (<-logChannel).Lambda.Tags)
+	assert.Empty(t, (<-logChannel).Lambda.Tags)
+	assert.Empty(t, (<-logChannel).Lambda.Tags)
+	assert.Nil(t, c.ExecutionContext.FindInvocation("request-1"))
+}
+
+func TestUnmarshalPlatformFaultLog(t *testing.T) {
+	raw := []byte(`{"time":"2021-05-19T18:11:22.478Z","type":"platform.fault","record":"RequestId: 13dee504-0d50-4c86-8d82-efd20693afc9 Process exited before completing request"}`)
+	var message logMessage
+	err := json.Unmarshal(raw, &message)
+	require.NoError(t, err)
+
+	assert.Equal(t, logTypePlatformFault, message.logType)
+	assert.Equal(t, "13dee504-0d50-4c86-8d82-efd20693afc9", message.objectRecord.requestID)
+	assert.Equal(t, "RequestId: 13dee504-0d50-4c86-8d82-efd20693afc9 Process exited before completing request", message.stringRecord)
+}
+
+func TestParseFaultRequestID(t *testing.T) {
+	assert.Equal(t, "abc-123", parseFaultRequestID("RequestId: abc-123 Error: Runtime exited with error: signal: segmentation fault"))
+	assert.Equal(t, "", parseFaultRequestID("Runtime exited with error: signal: killed"))
+	assert.Equal(t, "", parseFaultRequestID("RequestId: "))
+}
+
+func TestProcessLogMessagesFault(t *testing.T) {
+	var crashes []string
+	c := &CollectionRouteInfo{
+		ExtraTags:        &Tags{},
+		ExecutionContext: &ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:test-function", LastRequestID: "request-1"},
+		FunctionLogs:     &FunctionLogBuffer{},
+		RuntimeCrashHandler: func(requestID string, reason string) {
+			crashes = append(crashes, requestID)
+		},
+	}
+	now := time.Now()
+	processLogMessages(c, []logMessage{{
+		logType:      logTypeFunction,
+		time:         now,
+		stringRecord: "allocating\n",
+	}, {
+		logType:      logTypePlatformFault,
+		time:         now,
+		stringRecord: "RequestId: request-1 Error: Runtime exited with error: signal: killed",
+		objectRecord: platformObjectRecord{requestID: "request-1"},
+	}})
+
+	assert.Equal(t, []string{"request-1"}, crashes)
+	assert.Equal(t, []string{"allocating"}, c.FunctionLogs.Take())
+}
+
+func TestFunctionLogBuffer(t *testing.T) {
+	buffer := &FunctionLogBuffer{}
+	for i := 0; i < maxBufferedFunctionLogs+2; i++ {
+		buffer.Add(fmt.Sprintf("line %d", i))
+	}
+	lines := buffer.Take()
+	assert.Len(t, lines, maxBufferedFunctionLogs)
+	assert.Equal(t, "line 2", lines[0])
+	assert.Equal(t, fmt.Sprintf("line %d", maxBufferedFunctionLogs+1), lines[maxBufferedFunctionLogs-1])
+	assert.Empty(t, buffer.Take())
+
+	buffer.Add(strings.Repeat("x", 2*maxBufferedFunctionLogSize))
+	assert.Len(t, buffer.Take()[0], maxBufferedFunctionLogSize+len("..."))
+
+	var nilBuffer *FunctionLogBuffer
+	nilBuffer.Add("ignored")
+	assert.Nil(t, nilBuffer.Take())
+}
+
+func TestUnmarshalJSONLogTypePlatformRestore(t *testing.T) {
+	var message logMessage
+	err := json.Unmarshal([]byte(`{"time":"2022-11-28T10:00:00.000Z","type":"platform.restoreStart","record":{"runtimeVersion":"java11.v15"}}`), &message)
+	require.NoError(t, err)
+	assert.Equal(t, logTypePlatformRestoreStart, message.logType)
+	assert.Equal(t, "RESTORE_START", message.stringRecord)
+
+	err = json.Unmarshal([]byte(`{"time":"2022-11-28T10:00:00.350Z","type":"platform.restoreRuntimeDone","record":{"status":"success"}}`), &message)
+	require.NoError(t, err)
+	assert.Equal(t, logTypePlatformRestoreRuntimeDone, message.logType)
+	assert.Equal(t, "RESTORE_RUNTIME_DONE Status: success", message.stringRecord)
+}
+
+func TestProcessLogMessagesRestore(t *testing.T) {
+	var restoreTimes []time.Time
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	c := &CollectionRouteInfo{
+		ExtraTags:              &Tags{Tags: []string{"functionname:test-function"}},
+		ExecutionContext:       &ExecutionContext{ARN: "arn:aws:lambda:us-east-1:123456789012:function:test-function", SnapStart: true},
+		MetricChannel:          metricsChan,
+		EnhancedMetricsEnabled: true,
+		RestoreHandler: func(restoreTime time.Time) {
+			restoreTimes = append(restoreTimes, restoreTime)
+		},
+	}
+	restoreStart := time.Date(2022, 11, 28, 10, 0, 0, 0, time.UTC)
+	processLogMessages(c, []logMessage{{
+		logType:      logTypePlatformRestoreStart,
+		time:         restoreStart,
+		stringRecord: "RESTORE_START",
+	}, {
+		logType:      logTypePlatformRestoreRuntimeDone,
+		time:         restoreStart.Add(350 * time.Millisecond),
+		stringRecord: "RESTORE_RUNTIME_DONE",
+	}})
+	assert.Equal(t, []time.Time{restoreStart}, restoreTimes)
+	require.Len(t, metricsChan, 1)
+	samples := <-metricsChan
+	require.Len(t, samples, 1)
+	assert.Equal(t, "aws.lambda.enhanced.restore_duration", samples[0].Name)
+	assert.Equal(t, 350.0, samples[0].Value)
+	assert.Contains(t, samples[0].Tags, "restore:false")
+}
+
+func TestExecutionContextInitTags(t *testing.T) {
+	ec := &ExecutionContext{ColdstartRequestID: "request-1"}
+	assert.Equal(t, []string{"cold_start:true"}, ec.InitTags("request-1"))
+	assert.Equal(t, []string{"cold_start:false"}, ec.InitTags("request-2"))
+
+	// the first invocation after a restore isn't a cold start
+	ec = &ExecutionContext{ColdstartRequestID: "request-1", RestoreRequestID: "request-1", SnapStart: true}
+	assert.Equal(t, []string{"cold_start:false", "restore:true"}, ec.InitTags("request-1"))
+	assert.Equal(t, []string{"cold_start:false", "restore:false"}, ec.InitTags("request-2"))
+}
+
+// processMessage updates the execution context with the message and generates its enhanced metrics,
+// as the log collection route does
+func processMessage(message logMessage, executionContext *ExecutionContext, enhancedMetricsEnabled bool, metricTags []string, metricsChan chan []metrics.MetricSample) {
+	if metricsContext, sendMetrics := updateExecutionContext(message, executionContext, enhancedMetricsEnabled, metricTags); sendMetrics {
+		generateEnhancedMetrics(message, metricsContext, metricsChan)
+	}
+}
+
+// newXRayExecutionContext returns the execution context of an invocation in progress with an X-Ray context
+func newXRayExecutionContext(requestID string, traceID string, spanID string) *ExecutionContext {
+	ec := &ExecutionContext{ARN: "myARN", LastRequestID: requestID, LastLogRequestID: requestID}
+	invocation := ec.Invocation(requestID)
+	invocation.XRayTraceID = traceID
+	invocation.XRaySpanID = spanID
+	return ec
+}
+
+func TestProcessLogMessagesLateLogsKeepTheirXRayContext(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 3)
+	ec := newXRayExecutionContext("request-1", "1111", "2222")
+	c := &CollectionRouteInfo{
+		ExecutionContext: ec,
+		LogsEnabled:      true,
+		LogChannel:       logChannel,
+		ExtraTags:        &Tags{},
+	}
+	// the next invocation started before the logs of the previous one were received
+	ec.LastRequestID = "request-2"
+	ec.Invocation("request-2").XRayTraceID = "3333"
+
+	processLogMessages(c, []logMessage{
+		{logType: logTypeFunction, time: time.Now(), stringRecord: "late log"},
+		{logType: logTypePlatformReport, time: time.Now(), objectRecord: platformObjectRecord{requestID: "request-1"}},
+		{logType: logTypePlatformStart, time: time.Now(), objectRecord: platformObjectRecord{requestID: "request-2"}},
+	})
+	assert.Equal(t, "1111", (<-logChannel).Lambda.TraceID)
+	assert.Equal(t, "1111", (<-logChannel).Lambda.TraceID)
+	assert.Equal(t, "3333", (<-logChannel).Lambda.TraceID)
+	// the context of an invocation is forgotten once its report is processed
+	assert.Nil(t, ec.FindInvocation("request-1"))
+	assert.NotNil(t, ec.FindInvocation("request-2"))
+}
+
+func TestExecutionContextInvocationsBounded(t *testing.T) {
+	ec := &ExecutionContext{}
+	for i := 0; i < maxInvocationContexts+2; i++ {
+		ec.Invocation(fmt.Sprintf("request-%d", i)).XRayTraceID = "1111"
+	}
+	assert.Len(t, ec.invocations, maxInvocationContexts)
+	assert.Len(t, ec.invocationOrder, maxInvocationContexts)
+	assert.Nil(t, ec.FindInvocation("request-0"))
+	assert.Equal(t, "1111", ec.FindInvocation(fmt.Sprintf("request-%d", maxInvocationContexts+1)).XRayTraceID)
+
+	ec.forgetInvocation("request-5")
+	assert.Nil(t, ec.FindInvocation("request-5"))
+	assert.Len(t, ec.invocationOrder, maxInvocationContexts-1)
+}
@@ -0,0 +1,145 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// PendingLogsRoute is the log collection route registered as soon as the daemon starts, before the
+// Logs API subscription is done. The log messages it receives before they can be attributed, that is
+// before the collection route is set up and the execution context and tags of the first invocation
+// are known, such as the logs of the init phase, are held in a bounded queue. The oldest messages are
+// dropped once it is full, the others are replayed through the collection route once it is ready.
+type PendingLogsRoute struct {
+	sync.Mutex
+	route      *CollectionRouteInfo
+	pending    []logMessage
+	maxPending int
+	// dropped counts the messages dropped from the full queue
+	dropped int
+}
+
+// NewPendingLogsRoute returns a route holding at most maxPending log messages until they can be attributed
+func NewPendingLogsRoute(maxPending int) *PendingLogsRoute {
+	return &PendingLogsRoute{maxPending: maxPending}
+}
+
+// ServeHTTP - see type PendingLogsRoute comment.
+func (p *PendingLogsRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	messages, err := parseLogsAPIPayload(data)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	p.process(messages)
+	w.WriteHeader(200)
+}
+
+// SetRoute sets up the collection route the messages are processed with, and replays the pending
+// messages when the execution context is already known
+func (p *PendingLogsRoute) SetRoute(route *CollectionRouteInfo) {
+	p.Lock()
+	defer p.Unlock()
+	p.route = route
+	if p.ready() {
+		p.replay()
+	}
+}
+
+// Replay processes the pending messages once they can be attributed, it does nothing otherwise
+func (p *PendingLogsRoute) Replay() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.ready() {
+		p.replay()
+	}
+}
+
+// Dropped returns the number of messages dropped because the queue was full
+func (p *PendingLogsRoute) Dropped() int {
+	if p == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.dropped
+}
+
+// process processes the messages after the pending ones when they can be attributed, and queues them otherwise
+func (p *PendingLogsRoute) process(messages []logMessage) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.ready() {
+		p.queue(messages)
+		return
+	}
+	p.replay()
+	processLogMessages(p.route, messages)
+}
+
+// ready returns whether the messages can be attributed to the function and an invocation, it must be
+// called with the lock held. The execution context shared with the daemon is read under its own lock.
+func (p *PendingLogsRoute) ready() bool {
+	if p.route == nil {
+		return false
+	}
+	p.route.lockExecutionContext()
+	defer p.route.unlockExecutionContext()
+	return len(p.route.ExecutionContext.ARN) > 0 &&
+		len(p.route.ExecutionContext.LastRequestID) > 0 &&
+		len(p.route.ExtraTags.Tags) > 0
+}
+
+// queue adds messages to the pending ones, dropping the oldest ones when the queue is full, it must be
+// called with the lock held
+func (p *PendingLogsRoute) queue(messages []logMessage) {
+	for _, message := range messages {
+		if p.maxPending <= 0 {
+			p.dropped++
+			continue
+		}
+		if len(p.pending) >= p.maxPending {
+			copy(p.pending, p.pending[1:])
+			p.pending = p.pending[:len(p.pending)-1]
+			p.dropped++
+		}
+		p.pending = append(p.pending, message)
+	}
+}
+
+// replay processes the pending messages, it must be called with the lock held once the messages can be attributed
+func (p *PendingLogsRoute) replay() {
+	if len(p.pending) == 0 {
+		return
+	}
+	if p.dropped > 0 {
+		log.Warnf("%d log messages received before the log collection was ready were dropped", p.dropped)
+	}
+	log.Debugf("Replaying %d log messages received before the log collection was ready", len(p.pending))
+	// the messages received before the first start log belong to the init phase of the cold start
+	// invocation, or to the restore phase of the first invocation after a SnapStart restore
+	p.route.lockExecutionContext()
+	if p.route.ExecutionContext.LastLogRequestID == "" {
+		p.route.ExecutionContext.LastLogRequestID = p.route.ExecutionContext.ColdstartRequestID
+		if p.route.ExecutionContext.RestoreRequestID != "" {
+			p.route.ExecutionContext.LastLogRequestID = p.route.ExecutionContext.RestoreRequestID
+		}
+	}
+	p.route.unlockExecutionContext()
+	pending := p.pending
+	p.pending = nil
+	processLogMessages(p.route, pending)
+}
@@ -0,0 +1,148 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postFunctionLogs sends function log lines to the route as the Logs API would
+func postFunctionLogs(p *PendingLogsRoute, records ...string) int {
+	var items []string
+	for _, record := range records {
+		items = append(items, fmt.Sprintf(`{"time":"2020-08-20T12:31:32.123Z","type":"function","record":%q}`, record))
+	}
+	request := httptest.NewRequest("POST", "/lambda/logs", strings.NewReader("["+strings.Join(items, ",")+"]"))
+	response := httptest.NewRecorder()
+	p.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestPendingLogsReplayedWithExecutionContext(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 10)
+	executionContext := &ExecutionContext{}
+	extraTags := &Tags{}
+	p := NewPendingLogsRoute(10)
+
+	// the logs of the init phase are received before the collection route is set up
+	assert.Equal(t, 200, postFunctionLogs(p, "init log 0"))
+	p.SetRoute(&CollectionRouteInfo{
+		LogChannel:       logChannel,
+		ExecutionContext: executionContext,
+		ExtraTags:        extraTags,
+		LogsEnabled:      true,
+	})
+	// and before the execution context of the first invocation is known
+	assert.Equal(t, 200, postFunctionLogs(p, "init log 1"))
+	p.Replay()
+	assert.Len(t, logChannel, 0)
+
+	executionContext.ARN = "myARN"
+	executionContext.LastRequestID = "coldstartRequestID"
+	executionContext.ColdstartRequestID = "coldstartRequestID"
+	extraTags.Tags = []string{"functionname:my-function"}
+	p.Replay()
+
+	require.Len(t, logChannel, 2)
+	for _, record := range []string{"init log 0", "init log 1"} {
+		received := <-logChannel
+		assert.Equal(t, record, string(received.Content))
+		assert.Equal(t, "myARN", received.Lambda.ARN)
+		assert.Equal(t, "coldstartRequestID", received.Lambda.RequestID)
+	}
+	// the init phase is attributed to the cold start invocation
+	assert.Equal(t, "coldstartRequestID", executionContext.LastLogRequestID)
+
+	// the logs received once the context is known are processed right away
+	assert.Equal(t, 200, postFunctionLogs(p, "invocation log"))
+	require.Len(t, logChannel, 1)
+	assert.Equal(t, "invocation log", string((<-logChannel).Content))
+	assert.Equal(t, 0, p.Dropped())
+}
+
+func TestPendingLogsReplayedOnSetRoute(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 10)
+	p := NewPendingLogsRoute(10)
+	assert.Equal(t, 200, postFunctionLogs(p, "init log"))
+
+	// the execution context may be known before the collection route is set up
+	p.SetRoute(&CollectionRouteInfo{
+		LogChannel:       logChannel,
+		ExecutionContext: &ExecutionContext{ARN: "myARN", LastRequestID: "myRequestID", ColdstartRequestID: "myRequestID"},
+		ExtraTags:        &Tags{Tags: []string{"functionname:my-function"}},
+		LogsEnabled:      true,
+	})
+	require.Len(t, logChannel, 1)
+	assert.Equal(t, "myRequestID", (<-logChannel).Lambda.RequestID)
+}
+
+func TestPendingLogsReplayedUnderTheExecutionContextLock(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 10)
+	executionContext := &ExecutionContext{}
+	executionContextMutex := &sync.Mutex{}
+	p := NewPendingLogsRoute(10)
+	assert.Equal(t, 200, postFunctionLogs(p, "init log"))
+	p.SetRoute(&CollectionRouteInfo{
+		LogChannel:            logChannel,
+		ExecutionContext:      executionContext,
+		ExecutionContextMutex: executionContextMutex,
+		ExtraTags:             &Tags{Tags: []string{"functionname:my-function"}},
+		LogsEnabled:           true,
+	})
+
+	// the daemon sets the execution context while the logs are replayed
+	replayed := make(chan struct{})
+	go func() {
+		defer close(replayed)
+		for len(logChannel) == 0 {
+			p.Replay()
+		}
+	}()
+	executionContextMutex.Lock()
+	executionContext.ARN = "myARN"
+	executionContext.LastRequestID = "coldstartRequestID"
+	executionContext.ColdstartRequestID = "coldstartRequestID"
+	executionContextMutex.Unlock()
+	<-replayed
+
+	require.Len(t, logChannel, 1)
+	assert.Equal(t, "coldstartRequestID", (<-logChannel).Lambda.RequestID)
+}
+
+func TestPendingLogsDropOldest(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage, 10)
+	p := NewPendingLogsRoute(2)
+	assert.Equal(t, 200, postFunctionLogs(p, "init log 0", "init log 1", "init log 2"))
+	assert.Equal(t, 200, postFunctionLogs(p, "init log 3"))
+	assert.Equal(t, 2, p.Dropped())
+
+	p.SetRoute(&CollectionRouteInfo{
+		LogChannel:       logChannel,
+		ExecutionContext: &ExecutionContext{ARN: "myARN", LastRequestID: "myRequestID"},
+		ExtraTags:        &Tags{Tags: []string{"functionname:my-function"}},
+		LogsEnabled:      true,
+	})
+	require.Len(t, logChannel, 2)
+	assert.Equal(t, "init log 2", string((<-logChannel).Content))
+	assert.Equal(t, "init log 3", string((<-logChannel).Content))
+}
+
+func TestPendingLogsInvalidPayload(t *testing.T) {
+	p := NewPendingLogsRoute(10)
+	request := httptest.NewRequest("POST", "/lambda/logs", strings.NewReader("not json"))
+	response := httptest.NewRecorder()
+	p.ServeHTTP(response, request)
+	assert.Equal(t, 400, response.Code)
+	assert.Equal(t, 0, p.Dropped())
+}
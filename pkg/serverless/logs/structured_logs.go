@@ -0,0 +1,194 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/logs/message"
+)
+
+// the fields of a structured log line promoted to the log record, by order of precedence
+var (
+	structuredStatusFields    = []string{"level", "status"}
+	structuredMessageFields   = []string{"message", "msg", "event"}
+	structuredTimestampFields = []string{"timestamp", "time"}
+)
+
+const (
+	// structuredTraceField is the object holding the trace context injected by the tracers
+	structuredTraceField = "dd"
+	// structuredTraceIDField and structuredSpanIDField hold the trace context when injected as flat fields
+	structuredTraceIDField = "dd.trace_id"
+	structuredSpanIDField  = "dd.span_id"
+
+	// epochMillisThreshold separates the numeric timestamps in seconds from the ones in milliseconds,
+	// it is year 5138 in seconds and 1973 in milliseconds
+	epochMillisThreshold = 1e11
+)
+
+// structuredLogStatuses maps the levels of the common loggers to the log statuses
+var structuredLogStatuses = map[string]string{
+	"trace":       message.StatusDebug,
+	"debug":       message.StatusDebug,
+	"info":        message.StatusInfo,
+	"information": message.StatusInfo,
+	"notice":      message.StatusNotice,
+	"warn":        message.StatusWarning,
+	"warning":     message.StatusWarning,
+	"error":       message.StatusError,
+	"err":         message.StatusError,
+	"critical":    message.StatusCritical,
+	"crit":        message.StatusCritical,
+	"fatal":       message.StatusCritical,
+	"alert":       message.StatusAlert,
+	"emergency":   message.StatusEmergency,
+	"emerg":       message.StatusEmergency,
+}
+
+// promoteStructuredLog parses a function log line shorter than maxSize bytes as a JSON object, and promotes its
+// level, message, timestamp and trace context to the log record. The other fields are sent as attributes of the
+// message, unless the line has no message field, in which case the whole line is kept as the message. A line
+// which isn't a JSON object is left untouched. A maxSize of 0 disables the parsing.
+func promoteStructuredLog(logMessage *logConfig.ChannelMessage, line string, maxSize int) {
+	if maxSize <= 0 || len(line) >= maxSize {
+		return
+	}
+	trimmed := bytes.TrimSpace([]byte(line))
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return
+	}
+
+	for _, name := range structuredStatusFields {
+		if status, found := parseStructuredStatus(fields[name]); found {
+			logMessage.Status = status
+			delete(fields, name)
+			break
+		}
+	}
+	for _, name := range structuredTimestampFields {
+		if timestamp, found := parseStructuredTimestamp(fields[name]); found {
+			logMessage.Timestamp = timestamp
+			delete(fields, name)
+			break
+		}
+	}
+	if traceID, spanID := parseStructuredTrace(fields); traceID != "" {
+		logMessage.Lambda.TraceID = traceID
+		logMessage.Lambda.SpanID = spanID
+	}
+
+	for _, name := range structuredMessageFields {
+		var text string
+		if raw, found := fields[name]; found && json.Unmarshal(raw, &text) == nil {
+			delete(fields, name)
+			logMessage.Content = []byte(text)
+			if len(fields) > 0 {
+				logMessage.Lambda.Attributes = fields
+			}
+			return
+		}
+	}
+}
+
+// parseStructuredStatus returns the status of a level, either a name or a pino numeric level
+func parseStructuredStatus(raw json.RawMessage) (string, bool) {
+	if len(raw) == 0 {
+		return "", false
+	}
+	var level string
+	if err := json.Unmarshal(raw, &level); err == nil {
+		status, found := structuredLogStatuses[strings.ToLower(strings.TrimSpace(level))]
+		return status, found
+	}
+	var number float64
+	if err := json.Unmarshal(raw, &number); err != nil {
+		return "", false
+	}
+	switch {
+	case number <= 20:
+		return message.StatusDebug, true
+	case number <= 30:
+		return message.StatusInfo, true
+	case number <= 40:
+		return message.StatusWarning, true
+	case number <= 50:
+		return message.StatusError, true
+	default:
+		return message.StatusCritical, true
+	}
+}
+
+// parseStructuredTimestamp returns the time of an RFC 3339 timestamp, or of an epoch timestamp in seconds or milliseconds
+func parseStructuredTimestamp(raw json.RawMessage) (time.Time, bool) {
+	if len(raw) == 0 {
+		return time.Time{}, false
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		timestamp, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return timestamp.UTC(), true
+	}
+	var epoch float64
+	if err := json.Unmarshal(raw, &epoch); err != nil || epoch <= 0 {
+		return time.Time{}, false
+	}
+	if epoch < epochMillisThreshold {
+		epoch *= 1000
+	}
+	millis := math.Floor(epoch)
+	return time.Unix(0, int64(millis)*int64(time.Millisecond)+int64((epoch-millis)*float64(time.Millisecond))).UTC(), true
+}
+
+// parseStructuredTrace returns the trace context injected by the tracers, in a dd object or as flat fields.
+// The flat fields are kept in the attributes, the backend extracting them from the line as well.
+func parseStructuredTrace(fields map[string]json.RawMessage) (string, string) {
+	var dd map[string]json.RawMessage
+	if raw, found := fields[structuredTraceField]; found && json.Unmarshal(raw, &dd) == nil {
+		if traceID := structuredID(dd["trace_id"]); traceID != "" {
+			delete(fields, structuredTraceField)
+			return traceID, structuredID(dd["span_id"])
+		}
+	}
+	if traceID := structuredID(fields[structuredTraceIDField]); traceID != "" {
+		return traceID, structuredID(fields[structuredSpanIDField])
+	}
+	return "", ""
+}
+
+// structuredID returns an ID written either as a string or as a number
+func structuredID(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var number json.Number
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&number); err != nil {
+		return ""
+	}
+	if _, err := strconv.ParseUint(number.String(), 10, 64); err != nil {
+		return ""
+	}
+	return number.String()
+}
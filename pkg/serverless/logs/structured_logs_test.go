@@ -0,0 +1,183 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package logs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/logs/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testStructuredLogsMaxSize = 64 * 1024
+
+var testLogTime = time.Date(2021, 10, 18, 14, 0, 0, 0, time.UTC)
+
+func newStructuredLogMessage(line string) *config.ChannelMessage {
+	logMessage := config.NewChannelMessageFromLambda([]byte(line), testLogTime, "myARN", "myRequestID")
+	logMessage.Lambda.TraceID = "xray-trace"
+	logMessage.Lambda.SpanID = "xray-span"
+	return logMessage
+}
+
+func readStructuredLog(t *testing.T, name string) string {
+	raw, err := ioutil.ReadFile("./testdata/" + name)
+	require.NoError(t, err)
+	return strings.TrimSpace(string(raw))
+}
+
+func attributeKeys(attributes map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestPromoteStructuredLogPino(t *testing.T) {
+	logMessage := newStructuredLogMessage(readStructuredLog(t, "structured_log_pino.json"))
+	promoteStructuredLog(logMessage, string(logMessage.Content), testStructuredLogsMaxSize)
+
+	assert.Equal(t, "payment failed", string(logMessage.Content))
+	assert.Equal(t, message.StatusError, logMessage.Status)
+	assert.Equal(t, time.Unix(1634567890, 123*int64(time.Millisecond)).UTC(), logMessage.Timestamp)
+	assert.Equal(t, "7043144561403045779", logMessage.Lambda.TraceID)
+	assert.Equal(t, "6023947403358210776", logMessage.Lambda.SpanID)
+	assert.ElementsMatch(t, []string{"pid", "hostname", "orderId"}, attributeKeys(logMessage.Lambda.Attributes))
+	assert.Equal(t, json.RawMessage("42"), logMessage.Lambda.Attributes["orderId"])
+}
+
+func TestPromoteStructuredLogWinston(t *testing.T) {
+	logMessage := newStructuredLogMessage(readStructuredLog(t, "structured_log_winston.json"))
+	promoteStructuredLog(logMessage, string(logMessage.Content), testStructuredLogsMaxSize)
+
+	assert.Equal(t, "slow downstream call", string(logMessage.Content))
+	assert.Equal(t, message.StatusWarning, logMessage.Status)
+	assert.Equal(t, time.Date(2021, 10, 18, 14, 38, 10, 123*int(time.Millisecond), time.UTC), logMessage.Timestamp)
+	assert.Equal(t, "1234567890", logMessage.Lambda.TraceID)
+	assert.Equal(t, "987654321", logMessage.Lambda.SpanID)
+	assert.ElementsMatch(t, []string{"durationMs", "dd.trace_id", "dd.span_id"}, attributeKeys(logMessage.Lambda.Attributes))
+}
+
+func TestPromoteStructuredLogStructlog(t *testing.T) {
+	logMessage := newStructuredLogMessage(readStructuredLog(t, "structured_log_structlog.json"))
+	promoteStructuredLog(logMessage, string(logMessage.Content), testStructuredLogsMaxSize)
+
+	assert.Equal(t, "user logged in", string(logMessage.Content))
+	assert.Equal(t, message.StatusInfo, logMessage.Status)
+	assert.Equal(t, time.Date(2021, 10, 18, 12, 38, 10, 500*int(time.Millisecond), time.UTC), logMessage.Timestamp)
+	// the X-Ray context is kept without trace context in the line
+	assert.Equal(t, "xray-trace", logMessage.Lambda.TraceID)
+	assert.Equal(t, "xray-span", logMessage.Lambda.SpanID)
+	assert.ElementsMatch(t, []string{"user_id", "logger"}, attributeKeys(logMessage.Lambda.Attributes))
+}
+
+func TestPromoteStructuredLogUntouched(t *testing.T) {
+	for name, line := range map[string]string{
+		"plain text":   "START RequestId: 8476a536-e9f4-11e8-9739-2dfe598c3fcd Version: $LATEST",
+		"invalid JSON": `{"level":"error","msg":"truncated`,
+		"JSON array":   `["error","payment failed"]`,
+		"too large":    `{"level":"error","msg":"` + strings.Repeat("a", testStructuredLogsMaxSize) + `"}`,
+	} {
+		logMessage := newStructuredLogMessage(line)
+		promoteStructuredLog(logMessage, line, testStructuredLogsMaxSize)
+
+		assert.Equal(t, line, string(logMessage.Content), name)
+		assert.Equal(t, "", logMessage.Status, name)
+		assert.Equal(t, testLogTime, logMessage.Timestamp, name)
+		assert.Equal(t, "xray-trace", logMessage.Lambda.TraceID, name)
+		assert.Nil(t, logMessage.Lambda.Attributes, name)
+	}
+}
+
+func TestPromoteStructuredLogDisabled(t *testing.T) {
+	line := readStructuredLog(t, "structured_log_pino.json")
+	logMessage := newStructuredLogMessage(line)
+	promoteStructuredLog(logMessage, line, 0)
+
+	assert.Equal(t, line, string(logMessage.Content))
+	assert.Equal(t, "", logMessage.Status)
+	assert.Equal(t, "xray-trace", logMessage.Lambda.TraceID)
+	assert.Nil(t, logMessage.Lambda.Attributes)
+}
+
+func TestPromoteStructuredLogWithoutMessage(t *testing.T) {
+	line := `{"level":"ERROR","time":1634567890,"dd":{"trace_id":123,"span_id":456},"error":"timeout"}`
+	logMessage := newStructuredLogMessage(line)
+	promoteStructuredLog(logMessage, line, testStructuredLogsMaxSize)
+
+	// the line is kept as is, its level, time and trace context are still promoted
+	assert.Equal(t, line, string(logMessage.Content))
+	assert.Equal(t, message.StatusError, logMessage.Status)
+	assert.Equal(t, time.Unix(1634567890, 0).UTC(), logMessage.Timestamp)
+	assert.Equal(t, "123", logMessage.Lambda.TraceID)
+	assert.Equal(t, "456", logMessage.Lambda.SpanID)
+	assert.Nil(t, logMessage.Lambda.Attributes)
+}
+
+func TestPromoteStructuredLogUnknownFields(t *testing.T) {
+	line := `{"level":"verbose","timestamp":"yesterday","msg":42,"message":"done"}`
+	logMessage := newStructuredLogMessage(line)
+	promoteStructuredLog(logMessage, line, testStructuredLogsMaxSize)
+
+	assert.Equal(t, "done", string(logMessage.Content))
+	assert.Equal(t, "", logMessage.Status)
+	assert.Equal(t, testLogTime, logMessage.Timestamp)
+	assert.ElementsMatch(t, []string{"level", "timestamp", "msg"}, attributeKeys(logMessage.Lambda.Attributes))
+}
+
+func TestParseStructuredStatusPinoLevels(t *testing.T) {
+	for level, expected := range map[string]string{
+		"10": message.StatusDebug,
+		"20": message.StatusDebug,
+		"30": message.StatusInfo,
+		"40": message.StatusWarning,
+		"50": message.StatusError,
+		"60": message.StatusCritical,
+	} {
+		status, found := parseStructuredStatus(json.RawMessage(level))
+		assert.True(t, found, level)
+		assert.Equal(t, expected, status, level)
+	}
+}
+
+func TestProcessLogMessageStructuredLog(t *testing.T) {
+	logChannel := make(chan *config.ChannelMessage)
+
+	logCollection := &CollectionRouteInfo{
+		ExecutionContext: newXRayExecutionContext("myRequestID", "7043144561403045779", "6023947403358210776"),
+		LogsEnabled:      true,
+		LogChannel:       logChannel,
+		ExtraTags: &Tags{
+			Tags: []string{"tag0:value0,tag1:value1"},
+		},
+		StructuredLogsMaxSize: testStructuredLogsMaxSize,
+	}
+
+	logMessages := []logMessage{
+		{
+			logType:      logTypeFunction,
+			stringRecord: readStructuredLog(t, "structured_log_winston.json"),
+		},
+	}
+	go processLogMessages(logCollection, logMessages)
+
+	select {
+	case received := <-logChannel:
+		assert.Equal(t, "slow downstream call", string(received.Content))
+		assert.Equal(t, message.StatusWarning, received.Status)
+		assert.Equal(t, "1234567890", received.Lambda.TraceID)
+		assert.Contains(t, received.Lambda.Attributes, "durationMs")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "We should have received logs")
+	}
+}
@@ -0,0 +1,64 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+const endpointPayloadsMetric = "datadog.serverless.endpoint.payloads"
+
+// EndpointCounts is the number of payloads sent to an endpoint, and the number of payloads which failed to be sent
+type EndpointCounts struct {
+	Sent   int64
+	Errors int64
+}
+
+// SendEndpointMetrics sends the number of payloads of a data type, such as metrics or traces, sent to each endpoint
+// and failed. They are only sent when the data is shipped to additional endpoints, a single endpoint is already
+// monitored by the intake.
+func SendEndpointMetrics(dataType string, counts map[string]EndpointCounts, tags []string, metricsChan chan []metrics.MetricSample) {
+	if len(counts) < 2 {
+		return
+	}
+	endpoints := make([]string, 0, len(counts))
+	for endpoint := range counts {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	timestamp := float64(time.Now().UnixNano())
+	var samples []metrics.MetricSample
+	for _, endpoint := range endpoints {
+		endpointTags := append(append([]string{}, tags...), "data_type:"+dataType, "endpoint:"+endpointHost(endpoint))
+		for _, status := range []struct {
+			name  string
+			count int64
+		}{{"sent", counts[endpoint].Sent}, {"error", counts[endpoint].Errors}} {
+			samples = append(samples, metrics.MetricSample{
+				Name:       endpointPayloadsMetric,
+				Value:      float64(status.count),
+				Mtype:      metrics.CountType,
+				Tags:       append(append([]string{}, endpointTags...), "status:"+status.name),
+				SampleRate: 1,
+				Timestamp:  timestamp,
+			})
+		}
+	}
+	metricsChan <- samples
+}
+
+// endpointHost returns the host of an endpoint, which is a URL for the metrics and a host for the traces
+func endpointHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
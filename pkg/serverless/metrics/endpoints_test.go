@@ -0,0 +1,40 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+func TestSendEndpointMetrics(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	SendEndpointMetrics("metrics", map[string]EndpointCounts{
+		"https://7-33-0-app.agent.datadoghq.com": {Sent: 3},
+		"https://7-33-0-app.agent.datadoghq.eu":  {Sent: 1, Errors: 2},
+	}, []string{"functionname:my-function"}, metricsChan)
+
+	samples := <-metricsChan
+	require.Len(t, samples, 4)
+	for _, sample := range samples {
+		assert.Equal(t, "datadog.serverless.endpoint.payloads", sample.Name)
+		assert.Equal(t, metrics.CountType, sample.Mtype)
+	}
+	assert.Equal(t, 3.0, samples[0].Value)
+	assert.Equal(t, []string{"functionname:my-function", "data_type:metrics", "endpoint:7-33-0-app.agent.datadoghq.com", "status:sent"}, samples[0].Tags)
+	assert.Equal(t, 2.0, samples[3].Value)
+	assert.Equal(t, []string{"functionname:my-function", "data_type:metrics", "endpoint:7-33-0-app.agent.datadoghq.eu", "status:error"}, samples[3].Tags)
+}
+
+func TestSendEndpointMetricsSingleEndpoint(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	SendEndpointMetrics("traces", map[string]EndpointCounts{"trace.agent.datadoghq.com": {Sent: 1}}, nil, metricsChan)
+	assert.Len(t, metricsChan, 0)
+}
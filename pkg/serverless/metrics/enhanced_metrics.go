@@ -6,10 +6,12 @@
 package metrics
 
 import (
+	"fmt"
 	"math"
 	"strings"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/logs/sender"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
@@ -50,21 +52,46 @@ func GenerateRuntimeDurationMetric(start time.Time, end time.Time, status string
 	}
 }
 
-// GenerateEnhancedMetricsFromFunctionLog generates enhanced metrics from a LogTypeFunction message
-func GenerateEnhancedMetricsFromFunctionLog(logString string, time time.Time, tags []string, metricsChan chan []metrics.MetricSample) {
+// GenerateRestoreDurationMetric generates the restore duration metric of a SnapStart function, from
+// the start of the restore to the end of the runtime hooks run after it
+func GenerateRestoreDurationMetric(start time.Time, end time.Time, tags []string, metricsChan chan []metrics.MetricSample) {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		log.Debug("Impossible to compute aws.lambda.enhanced.restore_duration due to an invalid interval")
+		return
+	}
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.restore_duration",
+		Value:      float64(end.Sub(start).Milliseconds()),
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(end.UnixNano()),
+	}}
+}
+
+// ContainsOutOfMemoryError returns whether the given function log reports that the runtime ran out of memory
+func ContainsOutOfMemoryError(logString string) bool {
 	for _, substring := range getOutOfMemorySubstrings() {
 		if strings.Contains(logString, substring) {
-			metricsChan <- []metrics.MetricSample{{
-				Name:       "aws.lambda.enhanced.out_of_memory",
-				Value:      1.0,
-				Mtype:      metrics.DistributionType,
-				Tags:       tags,
-				SampleRate: 1,
-				Timestamp:  float64(time.UnixNano()),
-			}}
-			return
+			return true
 		}
 	}
+	return false
+}
+
+// GenerateEnhancedMetricsFromFunctionLog generates enhanced metrics from a LogTypeFunction message
+func GenerateEnhancedMetricsFromFunctionLog(logString string, time time.Time, tags []string, metricsChan chan []metrics.MetricSample) {
+	if !ContainsOutOfMemoryError(logString) {
+		return
+	}
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.out_of_memory",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(time.UnixNano()),
+	}}
 }
 
 // GenerateEnhancedMetricsFromReportLog generates enhanced metrics from a LogTypePlatformReport log message
@@ -134,6 +161,121 @@ func SendTimeoutEnhancedMetric(tags []string, metricsChan chan []metrics.MetricS
 	}}
 }
 
+// SendErrorsEnhancedMetric sends an enhanced metric representing an invocation which returned an error
+func SendErrorsEnhancedMetric(tags []string, metricsChan chan []metrics.MetricSample) {
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.errors",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(time.Now().UnixNano()),
+	}}
+}
+
+// SendWarmupEnhancedMetric sends an enhanced metric representing a warm-up request, whose
+// other enhanced metrics aren't sent
+func SendWarmupEnhancedMetric(tags []string, metricsChan chan []metrics.MetricSample) {
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.warmup",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(time.Now().UnixNano()),
+	}}
+}
+
+// SendRuntimeResponseEnhancedMetrics sends the enhanced metrics of the response of an invocation
+// proxied to the runtime API: the time the runtime API took to acknowledge it, its size and the
+// time spent in the proxy
+func SendRuntimeResponseEnhancedMetrics(latency time.Duration, overhead time.Duration, size int64, tags []string, metricsChan chan []metrics.MetricSample) {
+	timestamp := float64(time.Now().UnixNano())
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.response_latency",
+		Value:      float64(latency.Microseconds()) / 1000,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}, {
+		Name:       "aws.lambda.enhanced.response_size",
+		Value:      float64(size),
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}, {
+		Name:       "aws.lambda.enhanced.proxy_overhead",
+		Value:      float64(overhead.Microseconds()) / 1000,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}}
+}
+
+// SendPostRuntimeDurationEnhancedMetric sends the time spent by the extension between the end of the
+// runtime and its next call to /next, tagged with whether a flush occurred meanwhile
+func SendPostRuntimeDurationEnhancedMetric(duration time.Duration, flushed bool, end time.Time, tags []string, metricsChan chan []metrics.MetricSample) {
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.post_runtime_duration",
+		Value:      float64(duration.Microseconds()) / 1000,
+		Mtype:      metrics.DistributionType,
+		Tags:       append(tags[:len(tags):len(tags)], fmt.Sprintf("flushed:%t", flushed)),
+		SampleRate: 1,
+		Timestamp:  float64(end.UnixNano()),
+	}}
+}
+
+// SendClientLibraryEnhancedMetric sends an enhanced metric representing the registration of a client
+// library with the extension, tagged with its name and version
+func SendClientLibraryEnhancedMetric(library string, version string, tags []string, metricsChan chan []metrics.MetricSample) {
+	metricsChan <- []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.client_library",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       append(tags[:len(tags):len(tags)], "library:"+library, "library_version:"+version),
+		SampleRate: 1,
+		Timestamp:  float64(time.Now().UnixNano()),
+	}}
+}
+
+// SendLogsBatchEnhancedMetrics sends the enhanced metrics of the batches of logs sent since the previous flush: the
+// number of logs of each batch, its compressed size and its compression ratio
+func SendLogsBatchEnhancedMetrics(batches []sender.BatchStats, tags []string, metricsChan chan []metrics.MetricSample) {
+	if len(batches) == 0 {
+		return
+	}
+	timestamp := float64(time.Now().UnixNano())
+	samples := make([]metrics.MetricSample, 0, 3*len(batches))
+	for _, batch := range batches {
+		samples = append(samples, metrics.MetricSample{
+			Name:       "aws.lambda.enhanced.logs_batch_entries",
+			Value:      float64(batch.Entries),
+			Mtype:      metrics.DistributionType,
+			Tags:       tags,
+			SampleRate: 1,
+			Timestamp:  timestamp,
+		}, metrics.MetricSample{
+			Name:       "aws.lambda.enhanced.logs_batch_size",
+			Value:      float64(batch.CompressedSize),
+			Mtype:      metrics.DistributionType,
+			Tags:       tags,
+			SampleRate: 1,
+			Timestamp:  timestamp,
+		}, metrics.MetricSample{
+			Name:       "aws.lambda.enhanced.logs_compression_ratio",
+			Value:      batch.CompressionRatio(),
+			Mtype:      metrics.DistributionType,
+			Tags:       tags,
+			SampleRate: 1,
+			Timestamp:  timestamp,
+		})
+	}
+	metricsChan <- samples
+}
+
 // calculateEstimatedCost returns the estimated cost in USD of a Lambda invocation
 func calculateEstimatedCost(billedDurationMs float64, memorySizeMb float64) float64 {
 	billedDurationSeconds := billedDurationMs / 1000.0
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/logs/sender"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
 	"github.com/stretchr/testify/assert"
 )
@@ -159,6 +160,77 @@ func TestSendTimeoutEnhancedMetric(t *testing.T) {
 	}})
 }
 
+func TestSendWarmupEnhancedMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample)
+	tags := []string{"functionname:test-function"}
+
+	go SendWarmupEnhancedMetric(tags, metricsChan)
+
+	generatedMetrics := <-metricsChan
+
+	assert.Equal(t, generatedMetrics, []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.warmup",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		// compare the generated timestamp to itself because we can't know its value
+		Timestamp: generatedMetrics[0].Timestamp,
+	}})
+}
+
+func TestSendErrorsEnhancedMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample)
+	tags := []string{"functionname:test-function", "error_type:TypeError"}
+
+	go SendErrorsEnhancedMetric(tags, metricsChan)
+
+	generatedMetrics := <-metricsChan
+
+	assert.Equal(t, generatedMetrics, []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.errors",
+		Value:      1.0,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		// compare the generated timestamp to itself because we can't know its value
+		Timestamp: generatedMetrics[0].Timestamp,
+	}})
+}
+
+func TestSendRuntimeResponseEnhancedMetrics(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample)
+	tags := []string{"functionname:test-function", "cold_start:true"}
+
+	go SendRuntimeResponseEnhancedMetrics(1500*time.Microsecond, 250*time.Microsecond, 2048, tags, metricsChan)
+
+	generatedMetrics := <-metricsChan
+	timestamp := generatedMetrics[0].Timestamp
+
+	assert.Equal(t, generatedMetrics, []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.response_latency",
+		Value:      1.5,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}, {
+		Name:       "aws.lambda.enhanced.response_size",
+		Value:      2048,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}, {
+		Name:       "aws.lambda.enhanced.proxy_overhead",
+		Value:      0.25,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  timestamp,
+	}})
+}
+
 func TestCalculateEstimatedCost(t *testing.T) {
 	// Latest Lambda pricing and billing examples from https://aws.amazon.com/lambda/pricing/
 	const freeTierComputeCost = lambdaPricePerGbSecond * 400000
@@ -221,3 +293,87 @@ func TestGenerateRuntimeDurationMetricOK(t *testing.T) {
 	}})
 
 }
+
+func TestSendPostRuntimeDurationEnhancedMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample)
+	tags := []string{"functionname:test-function", "cold_start:false"}
+	end := time.Now()
+
+	go SendPostRuntimeDurationEnhancedMetric(2500*time.Microsecond, true, end, tags, metricsChan)
+
+	generatedMetrics := <-metricsChan
+
+	assert.Equal(t, generatedMetrics, []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.post_runtime_duration",
+		Value:      2.5,
+		Mtype:      metrics.DistributionType,
+		Tags:       []string{"functionname:test-function", "cold_start:false", "flushed:true"},
+		SampleRate: 1,
+		Timestamp:  float64(end.UnixNano()),
+	}})
+	// the tags of the caller are left untouched
+	assert.Len(t, tags, 2)
+}
+
+func TestSendClientLibraryEnhancedMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample)
+	tags := []string{"functionname:test-function"}
+
+	go SendClientLibraryEnhancedMetric("datadog-lambda-js", "4.66.0", tags, metricsChan)
+
+	generatedMetrics := <-metricsChan
+
+	assert.Len(t, generatedMetrics, 1)
+	assert.Equal(t, "aws.lambda.enhanced.client_library", generatedMetrics[0].Name)
+	assert.Equal(t, 1.0, generatedMetrics[0].Value)
+	assert.Equal(t, []string{"functionname:test-function", "library:datadog-lambda-js", "library_version:4.66.0"}, generatedMetrics[0].Tags)
+	// the tags of the caller are left untouched
+	assert.Len(t, tags, 1)
+}
+
+func TestSendLogsBatchEnhancedMetrics(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	tags := []string{"functionname:test-function"}
+
+	// nothing is sent without batches
+	SendLogsBatchEnhancedMetrics(nil, tags, metricsChan)
+	assert.Len(t, metricsChan, 0)
+
+	SendLogsBatchEnhancedMetrics([]sender.BatchStats{
+		{Entries: 1000, ContentSize: 400000, CompressedSize: 50000},
+		{Entries: 12, ContentSize: 3000, CompressedSize: 1000},
+	}, tags, metricsChan)
+	generatedMetrics := <-metricsChan
+
+	values := make(map[string][]float64)
+	for _, sample := range generatedMetrics {
+		assert.Equal(t, metrics.DistributionType, sample.Mtype)
+		assert.Equal(t, tags, sample.Tags)
+		values[sample.Name] = append(values[sample.Name], sample.Value)
+	}
+	assert.Equal(t, map[string][]float64{
+		"aws.lambda.enhanced.logs_batch_entries":     {1000, 12},
+		"aws.lambda.enhanced.logs_batch_size":        {50000, 1000},
+		"aws.lambda.enhanced.logs_compression_ratio": {8, 3},
+	}, values)
+}
+
+func TestGenerateRestoreDurationMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	tags := []string{"functionname:test-function", "restore:true"}
+	startTime := time.Date(2022, 11, 28, 10, 0, 0, 0, time.UTC)
+	endTime := startTime.Add(350 * time.Millisecond)
+	GenerateRestoreDurationMetric(startTime, endTime, tags, metricsChan)
+	assert.Equal(t, []metrics.MetricSample{{
+		Name:       "aws.lambda.enhanced.restore_duration",
+		Value:      350,
+		Mtype:      metrics.DistributionType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(endTime.UnixNano()),
+	}}, <-metricsChan)
+
+	// no restoreStart log received
+	GenerateRestoreDurationMetric(time.Time{}, endTime, tags, metricsChan)
+	assert.Len(t, metricsChan, 0)
+}
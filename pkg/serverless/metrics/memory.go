@@ -0,0 +1,162 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+const droppedContextsMetric = "datadog.serverless.metrics.dropped_contexts"
+
+// contextOverheadBytes estimates the memory used by a context in the aggregator on top of
+// its name and tags: the context itself, its sampler entry and its serie in the payload
+const contextOverheadBytes = 128
+
+// MemoryUsage is the estimated memory used by the contexts aggregated since the last flush
+type MemoryUsage struct {
+	Contexts  int   `json:"contexts"`
+	Bytes     int64 `json:"bytes"`
+	SoftLimit int64 `json:"soft_limit"`
+	HardLimit int64 `json:"hard_limit"`
+	// Dropped is the number of samples of new contexts dropped and not reported yet
+	Dropped int64 `json:"dropped"`
+}
+
+// MemoryLimiter accounts the contexts aggregated between two flushes. Once their estimated
+// size reaches the soft limit, the soft limit handler is called for the metrics to be flushed
+// early, and the samples of new contexts are dropped once it reaches the hard limit.
+// A limit of 0 disables it.
+type MemoryLimiter struct {
+	softLimit int64
+	hardLimit int64
+
+	mu               sync.Mutex
+	contexts         map[uint64]struct{}
+	bytes            int64
+	dropped          int64
+	softLimitReached bool
+	onSoftLimit      func()
+}
+
+// NewMemoryLimiter returns a limiter with the given soft and hard limits in bytes
+func NewMemoryLimiter(softLimit int64, hardLimit int64) *MemoryLimiter {
+	return &MemoryLimiter{
+		softLimit: softLimit,
+		hardLimit: hardLimit,
+		contexts:  make(map[uint64]struct{}),
+	}
+}
+
+// SetSoftLimitHandler sets the function called once per flush when the soft limit is reached,
+// it must not block
+func (m *MemoryLimiter) SetSoftLimitHandler(handler func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onSoftLimit = handler
+}
+
+// Accept accounts the context of the sample and returns whether it can be aggregated. The
+// enhanced metrics and the metrics of the extension itself are never dropped.
+func (m *MemoryLimiter) Accept(sample *metrics.MetricSample) bool {
+	key, size := sampleContext(sample)
+
+	m.mu.Lock()
+	if _, found := m.contexts[key]; found {
+		m.mu.Unlock()
+		return true
+	}
+	if m.hardLimit > 0 && m.bytes+size > m.hardLimit && !isInternalMetric(sample.Name) {
+		m.dropped++
+		m.mu.Unlock()
+		return false
+	}
+	m.contexts[key] = struct{}{}
+	m.bytes += size
+	var onSoftLimit func()
+	if m.softLimit > 0 && m.bytes >= m.softLimit && !m.softLimitReached {
+		m.softLimitReached = true
+		onSoftLimit = m.onSoftLimit
+	}
+	m.mu.Unlock()
+
+	if onSoftLimit != nil {
+		onSoftLimit()
+	}
+	return true
+}
+
+// Reset forgets the contexts once they have been flushed
+func (m *MemoryLimiter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.contexts = make(map[uint64]struct{})
+	m.bytes = 0
+	m.softLimitReached = false
+}
+
+// TakeDropped returns the number of samples dropped since the previous call
+func (m *MemoryLimiter) TakeDropped() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dropped := m.dropped
+	m.dropped = 0
+	return dropped
+}
+
+// Usage returns the current usage of the limiter
+func (m *MemoryLimiter) Usage() MemoryUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemoryUsage{
+		Contexts:  len(m.contexts),
+		Bytes:     m.bytes,
+		SoftLimit: m.softLimit,
+		HardLimit: m.hardLimit,
+		Dropped:   m.dropped,
+	}
+}
+
+// sampleContext returns a key identifying the context of the sample, regardless of the order
+// of its tags, and its estimated size
+func sampleContext(sample *metrics.MetricSample) (uint64, int64) {
+	h := fnv.New64a()
+	h.Write([]byte(sample.Name)) //nolint:errcheck
+	key := h.Sum64()
+	size := int64(len(sample.Name)) + contextOverheadBytes
+	for _, tag := range sample.Tags {
+		h.Reset()
+		h.Write([]byte(tag)) //nolint:errcheck
+		key += h.Sum64()
+		size += int64(len(tag))
+	}
+	return key, size
+}
+
+// isInternalMetric returns whether the metric is an enhanced metric or a metric of the extension
+func isInternalMetric(name string) bool {
+	return strings.HasPrefix(name, "aws.lambda.enhanced.") || strings.HasPrefix(name, "datadog.serverless.")
+}
+
+// SendDroppedContextsMetric sends the number of samples dropped because the memory used by the
+// aggregated contexts reached the hard limit
+func SendDroppedContextsMetric(dropped int64, tags []string, metricsChan chan []metrics.MetricSample) {
+	if dropped == 0 {
+		return
+	}
+	metricsChan <- []metrics.MetricSample{{
+		Name:       droppedContextsMetric,
+		Value:      float64(dropped),
+		Mtype:      metrics.CountType,
+		Tags:       tags,
+		SampleRate: 1,
+		Timestamp:  float64(time.Now().UnixNano()),
+	}}
+}
@@ -0,0 +1,98 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func syntheticSample(i int) *metrics.MetricSample {
+	return &metrics.MetricSample{
+		Name:  "my.custom.metric",
+		Value: 1,
+		Mtype: metrics.GaugeType,
+		Tags:  []string{"env:prod", fmt.Sprintf("user_id:%08d", i)},
+	}
+}
+
+func TestMemoryLimiterSoftLimit(t *testing.T) {
+	_, size := sampleContext(syntheticSample(0))
+	m := NewMemoryLimiter(10*size, 0)
+	var softLimitCalls int
+	m.SetSoftLimitHandler(func() { softLimitCalls++ })
+
+	for i := 0; i < 9; i++ {
+		assert.True(t, m.Accept(syntheticSample(i)))
+	}
+	assert.Equal(t, 0, softLimitCalls)
+	for i := 0; i < 100; i++ {
+		assert.True(t, m.Accept(syntheticSample(i)))
+	}
+	// the handler is called once until the next flush
+	assert.Equal(t, 1, softLimitCalls)
+	assert.Equal(t, MemoryUsage{Contexts: 100, Bytes: 100 * size, SoftLimit: 10 * size}, m.Usage())
+
+	m.Reset()
+	assert.Equal(t, 0, m.Usage().Contexts)
+	for i := 0; i < 10; i++ {
+		m.Accept(syntheticSample(i))
+	}
+	assert.Equal(t, 2, softLimitCalls)
+}
+
+func TestMemoryLimiterHardLimit(t *testing.T) {
+	_, size := sampleContext(syntheticSample(0))
+	m := NewMemoryLimiter(0, 10*size)
+
+	for i := 0; i < 50; i++ {
+		m.Accept(syntheticSample(i))
+	}
+	usage := m.Usage()
+	assert.Equal(t, 10, usage.Contexts)
+	assert.Equal(t, 10*size, usage.Bytes)
+	assert.Equal(t, int64(40), usage.Dropped)
+
+	// the samples of the known contexts are still aggregated
+	assert.True(t, m.Accept(syntheticSample(3)))
+	assert.False(t, m.Accept(syntheticSample(30)))
+	// the enhanced metrics aren't dropped
+	assert.True(t, m.Accept(&metrics.MetricSample{Name: "aws.lambda.enhanced.invocations", Tags: []string{"functionname:test"}}))
+
+	assert.Equal(t, int64(41), m.TakeDropped())
+	assert.Equal(t, int64(0), m.TakeDropped())
+
+	// the new contexts are accepted again once the aggregated ones are flushed
+	m.Reset()
+	assert.True(t, m.Accept(syntheticSample(30)))
+}
+
+func TestSampleContextTagsOrder(t *testing.T) {
+	key1, size1 := sampleContext(&metrics.MetricSample{Name: "metric", Tags: []string{"a:1", "b:2"}})
+	key2, size2 := sampleContext(&metrics.MetricSample{Name: "metric", Tags: []string{"b:2", "a:1"}})
+	key3, _ := sampleContext(&metrics.MetricSample{Name: "metric", Tags: []string{"a:1", "b:3"}})
+	assert.Equal(t, key1, key2)
+	assert.Equal(t, size1, size2)
+	assert.NotEqual(t, key1, key3)
+}
+
+func TestSendDroppedContextsMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	SendDroppedContextsMetric(0, nil, metricsChan)
+	assert.Len(t, metricsChan, 0)
+
+	SendDroppedContextsMetric(12, []string{"functionname:test"}, metricsChan)
+	require.Len(t, metricsChan, 1)
+	samples := <-metricsChan
+	require.Len(t, samples, 1)
+	assert.Equal(t, "datadog.serverless.metrics.dropped_contexts", samples[0].Name)
+	assert.Equal(t, 12.0, samples[0].Value)
+	assert.Equal(t, metrics.CountType, samples[0].Mtype)
+}
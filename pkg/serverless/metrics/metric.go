@@ -12,6 +12,7 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/dogstatsd"
 	"github.com/DataDog/datadog-agent/pkg/forwarder"
+	"github.com/DataDog/datadog-agent/pkg/forwarder/transaction"
 	"github.com/DataDog/datadog-agent/pkg/metrics"
 	"github.com/DataDog/datadog-agent/pkg/serializer"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
@@ -21,6 +22,9 @@ import (
 type ServerlessMetricAgent struct {
 	dogStatDServer *dogstatsd.Server
 	aggregator     *aggregator.BufferedAggregator
+	forwarder      *forwarder.SyncForwarder
+	memory         *MemoryLimiter
+	pendingTags    *PendingTagsBuffer
 }
 
 // MetricConfig abstacts the config package
@@ -56,9 +60,18 @@ func (c *ServerlessMetricAgent) Start(forwarderTimeout time.Duration, multipleEn
 	// prevents any UDP packets from being stuck in the buffer and not parsed during the current invocation
 	// by setting this option to 1ms, all packets received will directly be sent to the parser
 	config.Datadog.Set("dogstatsd_packet_buffer_flush_timeout", 1*time.Millisecond)
-	aggregatorInstance := buildBufferedAggregator(multipleEndpointConfig, forwarderTimeout)
+	aggregatorInstance, forwarderInstance := buildBufferedAggregator(multipleEndpointConfig, forwarderTimeout)
 
 	if aggregatorInstance != nil {
+		memory := NewMemoryLimiter(
+			config.Datadog.GetInt64("serverless.metrics_memory_soft_limit"),
+			config.Datadog.GetInt64("serverless.metrics_memory_hard_limit"),
+		)
+		// the samples received before the global tags are known are aggregated once they are
+		pendingTags := NewPendingTagsBuffer(maxPendingSamples)
+		aggregatorInstance.AcceptSample = func(sample *metrics.MetricSample) bool {
+			return pendingTags.Accept(sample) && memory.Accept(sample)
+		}
 		statsd, err := dogstatFactory.NewServer(aggregatorInstance, nil)
 		if err != nil {
 			log.Errorf("Unable to start the DogStatsD server: %s", err)
@@ -66,6 +79,9 @@ func (c *ServerlessMetricAgent) Start(forwarderTimeout time.Duration, multipleEn
 			statsd.ServerlessMode = true // we're running in a serverless environment (will removed host field from samples)
 			c.dogStatDServer = statsd
 			c.aggregator = aggregatorInstance
+			c.forwarder = forwarderInstance
+			c.memory = memory
+			c.pendingTags = pendingTags
 		}
 	}
 }
@@ -79,7 +95,33 @@ func (c *ServerlessMetricAgent) IsReady() bool {
 func (c *ServerlessMetricAgent) Flush() {
 	if c.IsReady() {
 		c.dogStatDServer.Flush()
+		c.memory.Reset()
+	}
+}
+
+// SetSoftLimitHandler sets the function called when the memory used by the contexts aggregated
+// since the last flush reaches the soft limit, it must not block
+func (c *ServerlessMetricAgent) SetSoftLimitHandler(handler func()) {
+	if c.IsReady() {
+		c.memory.SetSoftLimitHandler(handler)
+	}
+}
+
+// MemoryUsage returns the estimated memory used by the contexts aggregated since the last flush
+func (c *ServerlessMetricAgent) MemoryUsage() MemoryUsage {
+	if c.IsReady() {
+		return c.memory.Usage()
+	}
+	return MemoryUsage{}
+}
+
+// TakeDroppedSamples returns the number of samples dropped because of the hard memory limit
+// since the previous call
+func (c *ServerlessMetricAgent) TakeDroppedSamples() int64 {
+	if c.IsReady() {
+		return c.memory.TakeDropped()
 	}
+	return 0
 }
 
 // Stop stops the DogStatsD server
@@ -89,11 +131,51 @@ func (c *ServerlessMetricAgent) Stop() {
 	}
 }
 
-// SetExtraTags sets extra tags on the DogStatsD server
+// SetRetryHandler sets the handler receiving the payloads which failed to be sent to the intake
+func (c *ServerlessMetricAgent) SetRetryHandler(handler forwarder.RetryHandler) {
+	if c.IsReady() {
+		c.forwarder.SetRetryHandler(handler)
+	}
+}
+
+// Retry synchronously sends payloads which previously failed to be sent to the intake
+func (c *ServerlessMetricAgent) Retry(transactions []*transaction.HTTPTransaction) {
+	if c.IsReady() {
+		c.forwarder.Retry(transactions) //nolint:errcheck
+	}
+}
+
+// SetExtraTags sets extra tags on the DogStatsD server. The first time they are set, the samples
+// received before are aggregated with them.
 func (c *ServerlessMetricAgent) SetExtraTags(tagArray []string) {
 	if c.IsReady() {
 		c.dogStatDServer.SetExtraTags(tagArray)
+		if len(tagArray) == 0 {
+			return
+		}
+		if samples := c.pendingTags.Release(tagArray); len(samples) > 0 {
+			log.Debugf("Tagging %d metric samples received before the function tags were known", len(samples))
+			c.GetMetricChannel() <- samples
+		}
+	}
+}
+
+// UpdateAPIKey replaces the API key used to send the metrics when it is oldKey
+func (c *ServerlessMetricAgent) UpdateAPIKey(oldKey, newKey string) {
+	if c.IsReady() {
+		c.forwarder.UpdateAPIKey(oldKey, newKey)
+	}
+}
+
+// TakeEndpointCounts returns the payloads sent to each endpoint since the previous call
+func (c *ServerlessMetricAgent) TakeEndpointCounts() map[string]EndpointCounts {
+	counts := make(map[string]EndpointCounts)
+	if c.IsReady() {
+		for domain, stats := range c.forwarder.TakeEndpointStats() {
+			counts[domain] = EndpointCounts{Sent: stats.Sent, Errors: stats.Errors}
+		}
 	}
+	return counts
 }
 
 // GetMetricChannel returns a channel where metrics can be sent to
@@ -101,15 +183,15 @@ func (c *ServerlessMetricAgent) GetMetricChannel() chan []metrics.MetricSample {
 	return c.aggregator.GetBufferedMetricsWithTsChannel()
 }
 
-func buildBufferedAggregator(multipleEndpointConfig MultipleEndpointConfig, forwarderTimeout time.Duration) *aggregator.BufferedAggregator {
+func buildBufferedAggregator(multipleEndpointConfig MultipleEndpointConfig, forwarderTimeout time.Duration) (*aggregator.BufferedAggregator, *forwarder.SyncForwarder) {
 	log.Debugf("Using a SyncForwarder with a %v timeout", forwarderTimeout)
 	keysPerDomain, err := multipleEndpointConfig.GetMultipleEndpoints()
 	if err != nil {
 		log.Errorf("Misconfiguration of agent endpoints: %s", err)
-		return nil
+		return nil, nil
 	}
 	f := forwarder.NewSyncForwarder(keysPerDomain, forwarderTimeout)
 	f.Start() //nolint:errcheck
 	serializer := serializer.NewSerializer(f, nil)
-	return aggregator.InitAggregator(serializer, nil, "serverless")
+	return aggregator.InitAggregator(serializer, nil, "serverless"), f
 }
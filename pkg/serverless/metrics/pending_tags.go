@@ -0,0 +1,90 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// maxPendingSamples is the maximum number of samples held until the global tags are known, the
+// next ones are aggregated without them
+const maxPendingSamples = 4096
+
+// PendingTagsBuffer holds the samples received before the global tags are computed, which
+// happens once the ARN of the function is known, so that they are aggregated with the same
+// tags as the samples received afterwards.
+type PendingTagsBuffer struct {
+	mu        sync.Mutex
+	tagsKnown bool
+	samples   []metrics.MetricSample
+	maxSize   int
+	overflow  bool
+}
+
+// NewPendingTagsBuffer returns a buffer holding at most maxSize samples
+func NewPendingTagsBuffer(maxSize int) *PendingTagsBuffer {
+	return &PendingTagsBuffer{maxSize: maxSize}
+}
+
+// Accept returns whether the sample can be aggregated, which is the case once the global tags
+// are known. The sample is held otherwise, unless the buffer is full.
+func (b *PendingTagsBuffer) Accept(sample *metrics.MetricSample) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tagsKnown {
+		return true
+	}
+	if len(b.samples) >= b.maxSize {
+		if !b.overflow {
+			b.overflow = true
+			log.Warnf("More than %d metric samples were received before the function tags were known, the next ones won't have them", b.maxSize)
+		}
+		return true
+	}
+	// the sample belongs to a batch which goes back to the pool once aggregated
+	held := *sample
+	held.Tags = append([]string(nil), sample.Tags...)
+	if held.Timestamp == 0 {
+		held.Timestamp = float64(time.Now().UnixNano())
+	}
+	b.samples = append(b.samples, held)
+	return false
+}
+
+// Release adds the global tags to the samples held so far and returns them, the next samples
+// are no longer held. The tags already set on a sample are not duplicated, so that it has the
+// same context as the samples tagged with the global tags when they were received.
+func (b *PendingTagsBuffer) Release(globalTags []string) []metrics.MetricSample {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tagsKnown = true
+	samples := b.samples
+	b.samples = nil
+	for i := range samples {
+		samples[i].Tags = mergeTags(samples[i].Tags, globalTags)
+	}
+	return samples
+}
+
+// mergeTags returns the tags of a sample with the global tags it doesn't have yet
+func mergeTags(sampleTags []string, globalTags []string) []string {
+	seen := make(map[string]struct{}, len(sampleTags)+len(globalTags))
+	merged := make([]string, 0, len(sampleTags)+len(globalTags))
+	for _, tags := range [][]string{sampleTags, globalTags} {
+		for _, tag := range tags {
+			if _, found := seen[tag]; found {
+				continue
+			}
+			seen[tag] = struct{}{}
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
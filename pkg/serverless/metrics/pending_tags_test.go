@@ -0,0 +1,60 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+func TestPendingTagsBufferTagsSamplesBeforeAndAfter(t *testing.T) {
+	globalTags := []string{"env:prod", "service:api", "function_arn:arn:aws:lambda:us-east-1:123456789012:function:my-function"}
+	buffer := NewPendingTagsBuffer(10)
+
+	before := []*metrics.MetricSample{
+		{Name: "custom.metric", Value: 1, Mtype: metrics.CountType, Tags: []string{"team:a"}},
+		// a tag set by the function as well as in the global tags isn't duplicated
+		{Name: "custom.metric", Value: 2, Mtype: metrics.CountType, Tags: []string{"env:prod", "team:a"}},
+	}
+	for _, sample := range before {
+		assert.False(t, buffer.Accept(sample))
+	}
+
+	released := buffer.Release(globalTags)
+	require.Len(t, released, 2)
+	assert.Equal(t, float64(1), released[0].Value)
+	assert.NotZero(t, released[0].Timestamp)
+
+	// the samples received afterwards are tagged by the DogStatsD server
+	after := &metrics.MetricSample{Name: "custom.metric", Value: 3, Mtype: metrics.CountType, Tags: append([]string{"team:a"}, globalTags...)}
+	assert.True(t, buffer.Accept(after))
+
+	for _, sample := range released {
+		assert.ElementsMatch(t, after.Tags, sample.Tags)
+	}
+	// the released samples go through the buffer again on their way to the aggregator
+	assert.True(t, buffer.Accept(&released[0]))
+	assert.Empty(t, buffer.Release(globalTags))
+}
+
+func TestPendingTagsBufferBounded(t *testing.T) {
+	buffer := NewPendingTagsBuffer(2)
+	sample := &metrics.MetricSample{Name: "custom.metric", Value: 1, Mtype: metrics.GaugeType, Tags: []string{"team:a"}}
+	assert.False(t, buffer.Accept(sample))
+	assert.False(t, buffer.Accept(sample))
+	// the samples past the limit are aggregated without the global tags
+	assert.True(t, buffer.Accept(sample))
+
+	released := buffer.Release([]string{"env:prod"})
+	require.Len(t, released, 2)
+	assert.Equal(t, []string{"team:a", "env:prod"}, released[0].Tags)
+	// the held samples don't share the tags of the received ones
+	assert.Equal(t, []string{"team:a"}, sample.Tags)
+}
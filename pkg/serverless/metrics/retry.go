@@ -0,0 +1,30 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+const retryDroppedBytesMetric = "datadog.serverless.retry.dropped_bytes"
+
+// SendRetryDroppedBytesMetric sends the size of the payloads of a data type, such as metrics or traces,
+// which failed to be sent to the intake and were dropped from the retry buffer
+func SendRetryDroppedBytesMetric(dataType string, droppedBytes int64, tags []string, metricsChan chan []metrics.MetricSample) {
+	if droppedBytes == 0 {
+		return
+	}
+	metricsChan <- []metrics.MetricSample{{
+		Name:       retryDroppedBytesMetric,
+		Value:      float64(droppedBytes),
+		Mtype:      metrics.CountType,
+		Tags:       append(append([]string{}, tags...), "data_type:"+dataType),
+		SampleRate: 1,
+		Timestamp:  float64(time.Now().UnixNano()),
+	}}
+}
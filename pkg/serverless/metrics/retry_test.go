@@ -0,0 +1,30 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+func TestSendRetryDroppedBytesMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	SendRetryDroppedBytesMetric("traces", 0, nil, metricsChan)
+	assert.Len(t, metricsChan, 0)
+
+	SendRetryDroppedBytesMetric("traces", 2048, []string{"functionname:test"}, metricsChan)
+	require.Len(t, metricsChan, 1)
+	samples := <-metricsChan
+	require.Len(t, samples, 1)
+	assert.Equal(t, "datadog.serverless.retry.dropped_bytes", samples[0].Name)
+	assert.Equal(t, 2048.0, samples[0].Value)
+	assert.Equal(t, metrics.CountType, samples[0].Mtype)
+	assert.Equal(t, []string{"functionname:test", "data_type:traces"}, samples[0].Tags)
+}
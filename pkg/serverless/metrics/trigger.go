@@ -0,0 +1,49 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+const mixedTriggerSourcesMetric = "datadog.serverless.trigger.mixed_sources"
+
+// SendMixedTriggerSourcesMetric sends the number of invocations whose event held records of
+// several queues, topics, buckets, streams or tables, by resource of their first record, each
+// count being tagged with its resource
+func SendMixedTriggerSourcesMetric(counts map[string]int64, tags []string, metricsChan chan []metrics.MetricSample) {
+	resources := make([]string, 0, len(counts))
+	for resource, count := range counts {
+		if count > 0 {
+			resources = append(resources, resource)
+		}
+	}
+	if len(resources) == 0 {
+		return
+	}
+	sort.Strings(resources)
+
+	now := float64(time.Now().UnixNano())
+	samples := make([]metrics.MetricSample, 0, len(resources))
+	for _, resource := range resources {
+		sampleTags := append([]string{}, tags...)
+		if resource != "" {
+			sampleTags = append(sampleTags, "trigger_resource:"+resource)
+		}
+		samples = append(samples, metrics.MetricSample{
+			Name:       mixedTriggerSourcesMetric,
+			Value:      float64(counts[resource]),
+			Mtype:      metrics.CountType,
+			Tags:       sampleTags,
+			SampleRate: 1,
+			Timestamp:  now,
+		})
+	}
+	metricsChan <- samples
+}
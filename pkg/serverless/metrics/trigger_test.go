@@ -0,0 +1,35 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+)
+
+func TestSendMixedTriggerSourcesMetric(t *testing.T) {
+	metricsChan := make(chan []metrics.MetricSample, 1)
+	SendMixedTriggerSourcesMetric(nil, nil, metricsChan)
+	SendMixedTriggerSourcesMetric(map[string]int64{"my-queue": 0}, nil, metricsChan)
+	assert.Len(t, metricsChan, 0)
+
+	SendMixedTriggerSourcesMetric(map[string]int64{"orders": 3, "my-queue": 1}, []string{"functionname:test"}, metricsChan)
+	require.Len(t, metricsChan, 1)
+	samples := <-metricsChan
+	require.Len(t, samples, 2)
+	for _, sample := range samples {
+		assert.Equal(t, "datadog.serverless.trigger.mixed_sources", sample.Name)
+		assert.Equal(t, metrics.CountType, sample.Mtype)
+	}
+	assert.Equal(t, 1.0, samples[0].Value)
+	assert.Equal(t, []string{"functionname:test", "trigger_resource:my-queue"}, samples[0].Tags)
+	assert.Equal(t, 3.0, samples[1].Value)
+	assert.Equal(t, []string{"functionname:test", "trigger_resource:orders"}, samples[1].Tags)
+}
@@ -0,0 +1,287 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	invocationRoutePrefix = "/2018-06-01/runtime/invocation/"
+	nextRoute             = invocationRoutePrefix + "next"
+	responseRouteSuffix   = "/response"
+	errorRouteSuffix      = "/error"
+	// requestIDHeader is the header of the request ID of the invocation returned by /next
+	requestIDHeader = "Lambda-Runtime-Aws-Request-Id"
+	// maxCapturedPayloadSize is the maximum size of the events and the responses captured,
+	// larger payloads are truncated
+	maxCapturedPayloadSize = 64 * 1024
+)
+
+// ResponseStats describes how the response of an invocation went through the proxy
+type ResponseStats struct {
+	RequestID string
+	// Latency is the time between the proxy receiving the response from the runtime
+	// and the runtime API acknowledging it
+	Latency time.Duration
+	// Overhead is the time spent in the proxy, outside of the call to the runtime API
+	Overhead time.Duration
+	// Size is the size in bytes of the response body
+	Size int64
+}
+
+// ResponseHandler receives the stats of the responses proxied to the runtime API
+type ResponseHandler interface {
+	HandleRuntimeResponse(stats ResponseStats)
+	// HandleRuntimeCrash is called when the runtime lost an invocation without responding to it,
+	// the runtime process most likely died during the invocation
+	HandleRuntimeCrash(requestID string, reason string)
+}
+
+// PayloadHandler receives the events and the responses of the invocations proxied to the
+// runtime API, when the ResponseHandler implements it and CapturesPayloads returns true. The
+// payloads are truncated to 64KB.
+type PayloadHandler interface {
+	CapturesPayloads() bool
+	HandleInvocationEvent(requestID string, payload []byte)
+	HandleInvocationResponse(requestID string, payload []byte)
+}
+
+// runtimeAPIProxy forwards the calls of the runtime to the Lambda runtime API, and
+// times the responses of the invocations
+type runtimeAPIProxy struct {
+	reverseProxy *httputil.ReverseProxy
+	handler      ResponseHandler
+	// payloadHandler receives the payloads of the invocations, nil when they aren't captured
+	payloadHandler PayloadHandler
+
+	// pendingRequestID is the request ID of the invocation returned by /next, until the
+	// runtime sends its response or error
+	pendingRequestID string
+	pendingMu        sync.Mutex
+}
+
+// roundTripKey is the context key of the roundTrip of a proxied response
+type roundTripKey struct{}
+
+// roundTrip holds when the call to the runtime API started and was acknowledged
+type roundTrip struct {
+	start time.Time
+	end   time.Time
+}
+
+// timedTransport records the roundTrip of the requests carrying one in their context
+type timedTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, _ := req.Context().Value(roundTripKey{}).(*roundTrip)
+	if rt != nil {
+		rt.start = time.Now()
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if rt != nil && err == nil {
+		rt.end = time.Now()
+	}
+	return resp, err
+}
+
+// countingReader counts the bytes read from the body of a request
+type countingReader struct {
+	io.ReadCloser
+	size int64
+	// err is the error which interrupted the read of the body, if any
+	err error
+	// capture receives the bytes read when the body is captured
+	capture *limitedBuffer
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	if r.capture != nil {
+		r.capture.Write(p[:n]) //nolint:errcheck
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// capturingWriter keeps the body of a response written through it
+type capturingWriter struct {
+	http.ResponseWriter
+	capture *limitedBuffer
+}
+
+func (w *capturingWriter) Write(p []byte) (int, error) {
+	w.capture.Write(p) //nolint:errcheck
+	return w.ResponseWriter.Write(p)
+}
+
+// limitedBuffer keeps the first bytes written to it, up to maxCapturedPayloadSize
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+// Write implements io.Writer, it never fails
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxCapturedPayloadSize - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Start starts a proxy of the runtime API listening on addr and forwarding the calls to
+// runtimeAPIAddr, the host:port of the runtime API. The runtime must be configured to use addr
+// as its AWS_LAMBDA_RUNTIME_API.
+func Start(addr string, runtimeAPIAddr string, handler ResponseHandler) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: newRuntimeAPIProxy(runtimeAPIAddr, handler),
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error while serving the runtime API proxy: %s", err)
+		}
+	}()
+	return server
+}
+
+func newRuntimeAPIProxy(runtimeAPIAddr string, handler ResponseHandler) *runtimeAPIProxy {
+	reverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: runtimeAPIAddr})
+	reverseProxy.Transport = timedTransport{http.DefaultTransport}
+	p := &runtimeAPIProxy{
+		reverseProxy: reverseProxy,
+		handler:      handler,
+	}
+	if payloadHandler, ok := handler.(PayloadHandler); ok && payloadHandler.CapturesPayloads() {
+		p.payloadHandler = payloadHandler
+	}
+	return p
+}
+
+// ServeHTTP implements http.Handler
+func (p *runtimeAPIProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == nextRoute {
+		p.serveNext(w, r)
+		return
+	}
+	if requestID, isError := parseInvocationRoute(r, errorRouteSuffix); isError {
+		p.resolvePending(requestID)
+		p.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+	requestID, isResponse := parseResponseRoute(r)
+	if !isResponse {
+		p.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+	p.resolvePending(requestID)
+
+	start := time.Now()
+	rt := &roundTrip{}
+	body := &countingReader{ReadCloser: r.Body}
+	if p.payloadHandler != nil {
+		body.capture = &limitedBuffer{}
+	}
+	r.Body = body
+	r = r.WithContext(context.WithValue(r.Context(), roundTripKey{}, rt))
+
+	p.reverseProxy.ServeHTTP(w, r)
+
+	if body.capture != nil && body.err == nil {
+		// handled after the stats, so that the overhead of the proxy doesn't include it
+		defer p.payloadHandler.HandleInvocationResponse(requestID, body.capture.Bytes())
+	}
+
+	if rt.end.IsZero() {
+		// the runtime API didn't acknowledge the response
+		if body.err != nil {
+			p.handler.HandleRuntimeCrash(requestID, "the runtime closed the connection before sending its full response")
+		}
+		return
+	}
+	p.handler.HandleRuntimeResponse(ResponseStats{
+		RequestID: requestID,
+		Latency:   rt.end.Sub(start),
+		Overhead:  time.Since(start) - rt.end.Sub(rt.start),
+		Size:      body.size,
+	})
+}
+
+// serveNext proxies a call of the runtime to /next. A runtime asking for the next invocation
+// without having responded to the previous one lost it: it was restarted after crashing.
+func (p *runtimeAPIProxy) serveNext(w http.ResponseWriter, r *http.Request) {
+	p.pendingMu.Lock()
+	lostRequestID := p.pendingRequestID
+	p.pendingRequestID = ""
+	p.pendingMu.Unlock()
+	if lostRequestID != "" {
+		p.handler.HandleRuntimeCrash(lostRequestID, "the runtime asked for the next invocation without responding to the previous one")
+	}
+
+	var event *limitedBuffer
+	if p.payloadHandler != nil {
+		event = &limitedBuffer{}
+		w = &capturingWriter{ResponseWriter: w, capture: event}
+	}
+	p.reverseProxy.ServeHTTP(w, r)
+
+	// the reverse proxy copied the headers of the response of the runtime API
+	if requestID := w.Header().Get(requestIDHeader); requestID != "" {
+		p.pendingMu.Lock()
+		p.pendingRequestID = requestID
+		p.pendingMu.Unlock()
+		if event != nil {
+			p.payloadHandler.HandleInvocationEvent(requestID, event.Bytes())
+		}
+	}
+}
+
+// resolvePending marks the invocation with the given request ID as responded
+func (p *runtimeAPIProxy) resolvePending(requestID string) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	if p.pendingRequestID == requestID {
+		p.pendingRequestID = ""
+	}
+}
+
+// parseResponseRoute returns the request ID of the invocation if r sends its response,
+// on POST /2018-06-01/runtime/invocation/{requestID}/response
+func parseResponseRoute(r *http.Request) (string, bool) {
+	return parseInvocationRoute(r, responseRouteSuffix)
+}
+
+// parseInvocationRoute returns the request ID of the invocation if r is a POST on the
+// route of the invocation with the given suffix, such as /2018-06-01/runtime/invocation/{requestID}/error
+func parseInvocationRoute(r *http.Request, suffix string) (string, bool) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, invocationRoutePrefix) || !strings.HasSuffix(r.URL.Path, suffix) {
+		return "", false
+	}
+	requestID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, invocationRoutePrefix), suffix)
+	if requestID == "" || strings.Contains(requestID, "/") {
+		return "", false
+	}
+	return requestID, true
+}
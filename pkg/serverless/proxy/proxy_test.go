@@ -0,0 +1,238 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResponseHandler struct {
+	sync.Mutex
+	stats   []ResponseStats
+	crashes []string
+}
+
+func (h *fakeResponseHandler) HandleRuntimeResponse(stats ResponseStats) {
+	h.Lock()
+	defer h.Unlock()
+	h.stats = append(h.stats, stats)
+}
+
+func (h *fakeResponseHandler) HandleRuntimeCrash(requestID string, reason string) {
+	h.Lock()
+	defer h.Unlock()
+	h.crashes = append(h.crashes, requestID)
+}
+
+func (h *fakeResponseHandler) getCrashes() []string {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string{}, h.crashes...)
+}
+
+func (h *fakeResponseHandler) getStats() []ResponseStats {
+	h.Lock()
+	defer h.Unlock()
+	return append([]ResponseStats{}, h.stats...)
+}
+
+func newTestProxy(t *testing.T, runtimeAPI http.HandlerFunc) (*httptest.Server, *fakeResponseHandler) {
+	runtimeAPIServer := httptest.NewServer(runtimeAPI)
+	t.Cleanup(runtimeAPIServer.Close)
+	runtimeAPIURL, err := url.Parse(runtimeAPIServer.URL)
+	require.NoError(t, err)
+
+	handler := &fakeResponseHandler{}
+	proxyServer := httptest.NewServer(newRuntimeAPIProxy(runtimeAPIURL.Host, handler))
+	t.Cleanup(proxyServer.Close)
+	return proxyServer, handler
+}
+
+func TestProxyResponse(t *testing.T) {
+	proxyServer, handler := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, `{"statusCode":200}`, string(body))
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	resp, err := http.Post(proxyServer.URL+"/2018-06-01/runtime/invocation/abc-123/response", "application/json", strings.NewReader(`{"statusCode":200}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// the stats are sent once the response has been proxied
+	require.Eventually(t, func() bool { return len(handler.getStats()) == 1 }, time.Second, time.Millisecond)
+	stats := handler.getStats()[0]
+	assert.Equal(t, "abc-123", stats.RequestID)
+	assert.Equal(t, int64(18), stats.Size)
+	assert.GreaterOrEqual(t, int64(stats.Latency), int64(10*time.Millisecond))
+	assert.Less(t, int64(stats.Overhead), int64(stats.Latency))
+}
+
+func TestProxyOtherRoutes(t *testing.T) {
+	proxyServer, handler := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2018-06-01/runtime/invocation/next", r.URL.Path)
+		w.Header().Set("Lambda-Runtime-Aws-Request-Id", "abc-123")
+		w.Write([]byte(`{}`))
+	})
+
+	resp, err := http.Get(proxyServer.URL + "/2018-06-01/runtime/invocation/next")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "abc-123", resp.Header.Get("Lambda-Runtime-Aws-Request-Id"))
+	assert.Len(t, handler.getStats(), 0)
+	assert.Len(t, handler.getCrashes(), 0)
+}
+
+func TestProxyLostInvocation(t *testing.T) {
+	requestIDs := []string{"abc-123", "def-456", "ghi-789"}
+	var next int
+	proxyServer, handler := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2018-06-01/runtime/invocation/next" {
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", requestIDs[next])
+			next++
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	get := func(path string) {
+		resp, err := http.Get(proxyServer.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	post := func(path string) {
+		resp, err := http.Post(proxyServer.URL+path, "application/json", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// abc-123 is responded to, def-456 is reported as an error
+	get("/2018-06-01/runtime/invocation/next")
+	post("/2018-06-01/runtime/invocation/abc-123/response")
+	get("/2018-06-01/runtime/invocation/next")
+	post("/2018-06-01/runtime/invocation/def-456/error")
+	assert.Len(t, handler.getCrashes(), 0)
+
+	// the runtime restarted without responding to ghi-789
+	get("/2018-06-01/runtime/invocation/next")
+	assert.Len(t, handler.getCrashes(), 0)
+	requestIDs = append(requestIDs, "jkl-012")
+	get("/2018-06-01/runtime/invocation/next")
+	assert.Equal(t, []string{"ghi-789"}, handler.getCrashes())
+}
+
+// fakePayloadHandler captures the payloads of the invocations
+type fakePayloadHandler struct {
+	fakeResponseHandler
+	capture   bool
+	events    map[string]string
+	responses map[string]string
+}
+
+func (h *fakePayloadHandler) CapturesPayloads() bool {
+	return h.capture
+}
+
+func (h *fakePayloadHandler) HandleInvocationEvent(requestID string, payload []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.events[requestID] = string(payload)
+}
+
+func (h *fakePayloadHandler) HandleInvocationResponse(requestID string, payload []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.responses[requestID] = string(payload)
+}
+
+func TestProxyCapturesPayloads(t *testing.T) {
+	largeEvent := `{"data":"` + strings.Repeat("x", maxCapturedPayloadSize) + `"}`
+	runtimeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2018-06-01/runtime/invocation/next" {
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", r.URL.Query().Get("id"))
+			if r.URL.Query().Get("id") == "large" {
+				w.Write([]byte(largeEvent))
+			} else {
+				w.Write([]byte(`{"headers":{"Authorization":"Bearer abc"}}`))
+			}
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, `{"statusCode":201}`, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer runtimeAPIServer.Close()
+	runtimeAPIURL, err := url.Parse(runtimeAPIServer.URL)
+	require.NoError(t, err)
+
+	for _, capture := range []bool{true, false} {
+		handler := &fakePayloadHandler{capture: capture, events: make(map[string]string), responses: make(map[string]string)}
+		proxyServer := httptest.NewServer(newRuntimeAPIProxy(runtimeAPIURL.Host, handler))
+
+		for _, id := range []string{"abc-123", "large"} {
+			resp, err := http.Get(proxyServer.URL + "/2018-06-01/runtime/invocation/next?id=" + id)
+			require.NoError(t, err)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			// the runtime receives the whole event
+			assert.NotEmpty(t, body)
+			if id == "large" {
+				assert.Equal(t, largeEvent, string(body))
+			}
+		}
+		resp, err := http.Post(proxyServer.URL+"/2018-06-01/runtime/invocation/abc-123/response", "application/json", strings.NewReader(`{"statusCode":201}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		proxyServer.Close()
+
+		handler.Lock()
+		if capture {
+			assert.Equal(t, `{"headers":{"Authorization":"Bearer abc"}}`, handler.events["abc-123"])
+			assert.Equal(t, largeEvent[:maxCapturedPayloadSize], handler.events["large"])
+			assert.Equal(t, map[string]string{"abc-123": `{"statusCode":201}`}, handler.responses)
+		} else {
+			assert.Empty(t, handler.events)
+			assert.Empty(t, handler.responses)
+		}
+		handler.Unlock()
+	}
+}
+
+func TestProxyRuntimeAPIUnavailable(t *testing.T) {
+	handler := &fakeResponseHandler{}
+	proxyServer := httptest.NewServer(newRuntimeAPIProxy("127.0.0.1:1", handler))
+	defer proxyServer.Close()
+
+	resp, err := http.Post(proxyServer.URL+"/2018-06-01/runtime/invocation/abc-123/response", "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Len(t, handler.getStats(), 0)
+}
+
+func TestParseResponseRoute(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/2018-06-01/runtime/invocation/abc-123/response": "abc-123",
+		"/2018-06-01/runtime/invocation/abc-123/error":    "",
+		"/2018-06-01/runtime/invocation/next":             "",
+		"/2018-06-01/runtime/invocation//response":        "",
+		"/2018-06-01/runtime/init/error":                  "",
+	} {
+		requestID, ok := parseResponseRoute(httptest.NewRequest(http.MethodPost, path, nil))
+		assert.Equal(t, expected, requestID, path)
+		assert.Equal(t, expected != "", ok, path)
+	}
+}
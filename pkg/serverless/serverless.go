@@ -21,7 +21,7 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/serverless/flush"
 	"github.com/DataDog/datadog-agent/pkg/serverless/metrics"
 	"github.com/DataDog/datadog-agent/pkg/serverless/registration"
-	"github.com/DataDog/datadog-agent/pkg/serverless/tags"
+	"github.com/DataDog/datadog-agent/pkg/serverless/trace"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
@@ -60,6 +60,8 @@ const (
 
 	// Timeout is one of the possible ShutdownReasons
 	Timeout ShutdownReason = "timeout"
+	// Failure is one of the possible ShutdownReasons, the runtime exited unexpectedly
+	Failure ShutdownReason = "failure"
 )
 
 // ShutdownReason is an AWS Shutdown reason
@@ -92,6 +94,13 @@ type Payload struct {
 	InvokedFunctionArn string         `json:"invokedFunctionArn"`
 	ShutdownReason     ShutdownReason `json:"shutdownReason"`
 	RequestID          string         `json:"requestId"`
+	Tracing            Tracing        `json:"tracing"`
+}
+
+// Tracing is the tracing header of an invocation, set when X-Ray active tracing is enabled.
+type Tracing struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
 }
 
 // ReportInitError reports an init error to the environment.
@@ -145,6 +154,7 @@ func WaitForNextInvocation(stopCh chan struct{}, daemon *daemon.Daemon, id regis
 
 	// make a blocking HTTP call to wait for the next event from AWS
 	client := &http.Client{Timeout: 0} // this one should never timeout
+	nextCallTime := time.Now()
 	if response, err = client.Do(request); err != nil {
 		return fmt.Errorf("WaitForNextInvocation: while GET next route: %v", err)
 	}
@@ -163,16 +173,27 @@ func WaitForNextInvocation(stopCh chan struct{}, daemon *daemon.Daemon, id regis
 	}
 
 	if payload.EventType == Invoke {
+		// the call to /next ended the work done after the previous invocation
+		daemon.HandleNextCall(nextCallTime)
+		var xrayHeader string
+		if payload.Tracing.Type == trace.XRayTracingType {
+			xrayHeader = payload.Tracing.Value
+		}
+		daemon.SetXRayContext(payload.RequestID, xrayHeader)
 		callInvocationHandler(daemon, payload.InvokedFunctionArn, payload.DeadlineMs, safetyBufferTimeout, payload.RequestID, handleInvocation)
 	}
 	if payload.EventType == Shutdown {
 		log.Debug("Received shutdown event. Reason: " + payload.ShutdownReason)
 		isTimeout := strings.ToLower(payload.ShutdownReason.String()) == Timeout.String()
 		if isTimeout {
-			metricTags := tags.AddColdStartTag(daemon.ExtraTags.Tags, daemon.ExecutionContext.Coldstart)
+			metricTags := append(append([]string{}, daemon.ExtraTags.Tags...), daemon.ExecutionContext.LastInvocationInitTags()...)
 			metricsChan := daemon.MetricAgent.GetMetricChannel()
 			metrics.SendTimeoutEnhancedMetric(metricTags, metricsChan)
 		}
+		if strings.ToLower(payload.ShutdownReason.String()) == Failure.String() {
+			// reported before the final flush so that the last logs of the function are sent
+			daemon.HandleRuntimeCrash("", "the runtime exited, shutdown reason: "+payload.ShutdownReason.String())
+		}
 		daemon.Stop()
 		stopCh <- struct{}{}
 	}
@@ -193,7 +214,7 @@ func callInvocationHandler(daemon *daemon.Daemon, arn string, deadlineMs int64,
 		if err != nil {
 			log.Debug("Unable to save the current state")
 		}
-		daemon.FinishInvocation()
+		daemon.FinishInvocation(requestID)
 		return
 	case <-doneChannel:
 		return
@@ -201,11 +222,11 @@ func callInvocationHandler(daemon *daemon.Daemon, arn string, deadlineMs int64,
 }
 
 func handleInvocation(doneChannel chan bool, daemon *daemon.Daemon, arn string, requestID string) {
-	daemon.StartInvocation()
+	daemon.StartInvocation(requestID)
 	log.Debug("Received invocation event...")
 	daemon.SetExecutionContext(arn, requestID)
 	daemon.ComputeGlobalTags(config.GetConfiguredTags(true))
-	if daemon.ExecutionContext.Coldstart {
+	if daemon.ExecutionContext.Coldstart || daemon.ExecutionContext.Restore {
 		ready := daemon.WaitUntilClientReady(clientReadyTimeout)
 		if ready {
 			log.Debug("Client library registered with extension")
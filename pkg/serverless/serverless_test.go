@@ -16,13 +16,13 @@ import (
 )
 
 func TestHandleInvocationShouldSetExtraTags(t *testing.T) {
-	d := daemon.StartDaemon("http://localhost:8124")
+	d := daemon.StartDaemon("http://localhost:8124", "")
 	defer d.Stop()
 
 	d.SetClientReady(false)
 	d.WaitForDaemon()
 
-	d.StartInvocation()
+	d.StartInvocation("myRequestID")
 
 	//deadline = current time + 20 ms
 	deadlineMs := (time.Now().UnixNano())/1000000 + 20
@@ -0,0 +1,281 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// Package spanpointers computes the span pointers linking the invocations of a function
+// triggered asynchronously by S3 or DynamoDB to the operations which produced their event,
+// without trace context. The producer and the consumer of an object or an item compute the
+// same hash, so the algorithm must be the same in every tracer library:
+// the hash is the first 32 hexadecimal characters of the SHA-256 of the components of the
+// pointer joined by `|`.
+package spanpointers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// S3ObjectKind is the kind of the pointers to an S3 object, identified by its bucket,
+	// key and ETag
+	S3ObjectKind = "aws.s3.object"
+	// DynamoDBItemKind is the kind of the pointers to a DynamoDB item, identified by its
+	// table and primary key
+	DynamoDBItemKind = "aws.dynamodb.item"
+
+	// DirectionUpstream is the direction of the pointers of a consumer to its producer
+	DirectionUpstream = "u"
+	// DirectionDownstream is the direction of the pointers of a producer to its consumers
+	DirectionDownstream = "d"
+
+	// SpanLinksTag is the tag holding the span links of a span, encoded in JSON
+	SpanLinksTag = "_dd.span_links"
+
+	hashLength = 32
+	linkKind   = "span-pointer"
+)
+
+// SpanPointer points to the operation on an object or an item, from its producer or consumer
+type SpanPointer struct {
+	Kind      string
+	Direction string
+	Hash      string
+}
+
+// Hash returns the hash of the components of a pointer
+func Hash(components ...[]byte) string {
+	h := sha256.New()
+	for i, component := range components {
+		if i > 0 {
+			h.Write([]byte("|")) //nolint:errcheck
+		}
+		h.Write(component) //nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))[:hashLength]
+}
+
+// S3ObjectHash returns the hash of the pointer to an S3 object, the quotes of the ETag as
+// returned by the S3 API are ignored
+func S3ObjectHash(bucket, key, eTag string) string {
+	eTag = strings.Trim(eTag, `"`)
+	return Hash([]byte(bucket), []byte(key), []byte(eTag))
+}
+
+// DynamoDBAttributeValue is the value of an attribute of the primary key of a DynamoDB
+// item, one of a string, a number or a binary
+type DynamoDBAttributeValue struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+	B []byte  `json:"B,omitempty"`
+}
+
+// bytes returns the value of the attribute as hashed, the number as written
+func (v DynamoDBAttributeValue) bytes() ([]byte, error) {
+	switch {
+	case v.S != nil:
+		return []byte(*v.S), nil
+	case v.N != nil:
+		return []byte(*v.N), nil
+	case v.B != nil:
+		return v.B, nil
+	}
+	return nil, fmt.Errorf("the primary key attributes must be strings, numbers or binaries")
+}
+
+// DynamoDBItemHash returns the hash of the pointer to a DynamoDB item from the attributes of
+// its primary key, the partition key and the optional sort key. The attributes are hashed
+// ordered by name, an empty name and value standing for the missing sort key.
+func DynamoDBItemHash(table string, keys map[string]DynamoDBAttributeValue) (string, error) {
+	if len(keys) == 0 || len(keys) > 2 {
+		return "", fmt.Errorf("the primary key must have 1 or 2 attributes, not %d", len(keys))
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	components := [][]byte{[]byte(table)}
+	for _, name := range names {
+		value, err := keys[name].bytes()
+		if err != nil {
+			return "", fmt.Errorf("attribute %q: %s", name, err)
+		}
+		components = append(components, []byte(name), value)
+	}
+	if len(names) == 1 {
+		components = append(components, nil, nil)
+	}
+	return Hash(components...), nil
+}
+
+// eventRecord holds the fields of the records of the S3 and DynamoDB stream events
+type eventRecord struct {
+	EventSource    string `json:"eventSource"`
+	EventSourceARN string `json:"eventSourceARN"`
+	S3             struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			ETag string `json:"eTag"`
+		} `json:"object"`
+	} `json:"s3"`
+	DynamoDB struct {
+		Keys map[string]DynamoDBAttributeValue `json:"Keys"`
+	} `json:"dynamodb"`
+}
+
+// FromEvent returns the upstream pointers of an invocation triggered by S3 or DynamoDB
+// streams, one per record of its event up to maxPointers. The records are read as a stream
+// so that the ones before the truncation of a large event are still found. Other events
+// have no pointer.
+func FromEvent(payload []byte, maxPointers int) []SpanPointer {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if key, _ := token.(string); key != "Records" {
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return nil
+			}
+			continue
+		}
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return nil
+		}
+		var pointers []SpanPointer
+		for decoder.More() && len(pointers) < maxPointers {
+			var record eventRecord
+			if err := decoder.Decode(&record); err != nil {
+				break
+			}
+			if pointer, ok := recordPointer(record); ok {
+				pointers = append(pointers, pointer)
+			}
+		}
+		return pointers
+	}
+	return nil
+}
+
+// recordPointer returns the upstream pointer of a record of an S3 or DynamoDB stream event
+func recordPointer(record eventRecord) (SpanPointer, bool) {
+	switch record.EventSource {
+	case "aws:s3":
+		// the object keys are URL encoded in the events
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil || record.S3.Bucket.Name == "" || record.S3.Object.ETag == "" {
+			return SpanPointer{}, false
+		}
+		return SpanPointer{
+			Kind:      S3ObjectKind,
+			Direction: DirectionUpstream,
+			Hash:      S3ObjectHash(record.S3.Bucket.Name, key, record.S3.Object.ETag),
+		}, true
+	case "aws:dynamodb":
+		table := dynamoDBTableName(record.EventSourceARN)
+		if table == "" {
+			return SpanPointer{}, false
+		}
+		hash, err := DynamoDBItemHash(table, record.DynamoDB.Keys)
+		if err != nil {
+			return SpanPointer{}, false
+		}
+		return SpanPointer{Kind: DynamoDBItemKind, Direction: DirectionUpstream, Hash: hash}, true
+	}
+	return SpanPointer{}, false
+}
+
+// dynamoDBTableName returns the name of the table of a stream from its ARN,
+// arn:aws:dynamodb:<region>:<account>:table/<table>/stream/<label>
+func dynamoDBTableName(streamARN string) string {
+	parts := strings.SplitN(streamARN, ":table/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return strings.SplitN(parts[1], "/", 2)[0]
+}
+
+type spanLink struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// SpanLinks returns the value of the span links tag holding the pointers, the links of the
+// pointers have no trace and span ID
+func SpanLinks(pointers []SpanPointer) string {
+	links := make([]spanLink, 0, len(pointers))
+	for _, pointer := range pointers {
+		links = append(links, spanLink{
+			TraceID: strings.Repeat("0", 32),
+			SpanID:  strings.Repeat("0", 16),
+			Attributes: map[string]string{
+				"link.kind": linkKind,
+				"ptr.kind":  pointer.Kind,
+				"ptr.dir":   pointer.Direction,
+				"ptr.hash":  pointer.Hash,
+			},
+		})
+	}
+	encoded, _ := json.Marshal(links)
+	return string(encoded)
+}
+
+// MergeSpanLinks returns the value of the span links tag holding the links already set on a
+// span, such as by the tracer, followed by the given ones which aren't among them. The links
+// already set are kept as is, they are only replaced when they aren't a valid JSON array.
+func MergeSpanLinks(current, links string) string {
+	var currentLinks, newLinks []json.RawMessage
+	if err := json.Unmarshal([]byte(current), &currentLinks); err != nil || len(currentLinks) == 0 {
+		return links
+	}
+	if err := json.Unmarshal([]byte(links), &newLinks); err != nil || len(newLinks) == 0 {
+		return current
+	}
+
+	pointers := make(map[string]struct{}, len(currentLinks))
+	for _, link := range currentLinks {
+		if key, ok := pointerKey(link); ok {
+			pointers[key] = struct{}{}
+		}
+	}
+	merged := currentLinks
+	for _, link := range newLinks {
+		if key, ok := pointerKey(link); ok {
+			if _, found := pointers[key]; found {
+				continue
+			}
+		}
+		merged = append(merged, link)
+	}
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return current
+	}
+	return string(encoded)
+}
+
+// pointerKey identifies the span pointer of a link, if it is one
+func pointerKey(link json.RawMessage) (string, bool) {
+	var decoded spanLink
+	if err := json.Unmarshal(link, &decoded); err != nil || decoded.Attributes["link.kind"] != linkKind {
+		return "", false
+	}
+	return decoded.Attributes["ptr.kind"] + "|" + decoded.Attributes["ptr.dir"] + "|" + decoded.Attributes["ptr.hash"], true
+}
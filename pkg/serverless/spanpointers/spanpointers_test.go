@@ -0,0 +1,126 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package spanpointers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the hashes are shared with the tracer libraries, they must not change
+
+func TestS3ObjectHash(t *testing.T) {
+	assert.Equal(t, "e721375466d4116ab551213fdea08413", S3ObjectHash("some-bucket", "some-key.data", "ab12ef34"))
+	// the ETags returned by the S3 API are quoted
+	assert.Equal(t, "e721375466d4116ab551213fdea08413", S3ObjectHash("some-bucket", "some-key.data", `"ab12ef34"`))
+}
+
+func TestDynamoDBItemHash(t *testing.T) {
+	value := "some-value"
+	hash, err := DynamoDBItemHash("some-table", map[string]DynamoDBAttributeValue{"some-key": {S: &value}})
+	require.NoError(t, err)
+	assert.Equal(t, "7f1aee721472bcb48701d45c7c7f7821", hash)
+
+	_, err = DynamoDBItemHash("some-table", map[string]DynamoDBAttributeValue{"some-key": {}})
+	assert.Error(t, err)
+	_, err = DynamoDBItemHash("some-table", nil)
+	assert.Error(t, err)
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return payload
+}
+
+func TestFromEvent(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected []SpanPointer
+	}{
+		{
+			fixture: "s3.json",
+			expected: []SpanPointer{
+				{Kind: S3ObjectKind, Direction: DirectionUpstream, Hash: "e721375466d4116ab551213fdea08413"},
+				// the key `reports/2024 Q3+final.csv` is URL encoded in the event
+				{Kind: S3ObjectKind, Direction: DirectionUpstream, Hash: "6e6ca74cad35a46f51457c4d0a9d3a11"},
+			},
+		},
+		{
+			fixture: "dynamodb.json",
+			expected: []SpanPointer{
+				{Kind: DynamoDBItemKind, Direction: DirectionUpstream, Hash: "7f1aee721472bcb48701d45c7c7f7821"},
+				// the attributes of a composite primary key are ordered by name, the binary one decoded
+				{Kind: DynamoDBItemKind, Direction: DirectionUpstream, Hash: "4adf23ac393d44db4f84690b0fe64f38"},
+			},
+		},
+		{
+			fixture: "sqs.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FromEvent(readFixture(t, tt.fixture), 10))
+		})
+	}
+}
+
+func TestFromEventBounded(t *testing.T) {
+	payload := readFixture(t, "dynamodb.json")
+	pointers := FromEvent(payload, 1)
+	require.Len(t, pointers, 1)
+	assert.Equal(t, "7f1aee721472bcb48701d45c7c7f7821", pointers[0].Hash)
+
+	// the records before the truncation of the event are found
+	truncated := payload[:len(payload)-300]
+	pointers = FromEvent(truncated, 10)
+	require.Len(t, pointers, 1)
+	assert.Equal(t, "7f1aee721472bcb48701d45c7c7f7821", pointers[0].Hash)
+
+	assert.Empty(t, FromEvent([]byte("not json"), 10))
+}
+
+func TestSpanLinks(t *testing.T) {
+	links := SpanLinks([]SpanPointer{{Kind: S3ObjectKind, Direction: DirectionUpstream, Hash: "e721375466d4116ab551213fdea08413"}})
+	assert.JSONEq(t, `[{
+		"trace_id": "00000000000000000000000000000000",
+		"span_id": "0000000000000000",
+		"attributes": {
+			"link.kind": "span-pointer",
+			"ptr.kind": "aws.s3.object",
+			"ptr.dir": "u",
+			"ptr.hash": "e721375466d4116ab551213fdea08413"
+		}
+	}]`, links)
+}
+
+func TestMergeSpanLinks(t *testing.T) {
+	pointer := SpanPointer{Kind: S3ObjectKind, Direction: DirectionUpstream, Hash: "e721375466d4116ab551213fdea08413"}
+	other := SpanPointer{Kind: DynamoDBItemKind, Direction: DirectionUpstream, Hash: "7f1aee721472bcb48701d45c7c7f7821"}
+	tracerLink := `{"trace_id":"0af7651916cd43dd8448eb211c80319c","span_id":"b7ad6b7169203331","tracestate":"dd=s:1","flags":1}`
+
+	// the links of the tracer are kept, followed by the pointers it didn't set
+	merged := MergeSpanLinks("["+tracerLink+"]", SpanLinks([]SpanPointer{pointer}))
+	var links []json.RawMessage
+	require.NoError(t, json.Unmarshal([]byte(merged), &links))
+	require.Len(t, links, 2)
+	assert.JSONEq(t, tracerLink, string(links[0]))
+	assert.JSONEq(t, SpanLinks([]SpanPointer{pointer}), "["+string(links[1])+"]")
+
+	// the pointers already set aren't duplicated
+	merged = MergeSpanLinks(merged, SpanLinks([]SpanPointer{pointer, other}))
+	require.NoError(t, json.Unmarshal([]byte(merged), &links))
+	assert.Len(t, links, 3)
+
+	// invalid or empty links are replaced
+	assert.Equal(t, SpanLinks([]SpanPointer{pointer}), MergeSpanLinks("not json", SpanLinks([]SpanPointer{pointer})))
+	assert.Equal(t, SpanLinks([]SpanPointer{pointer}), MergeSpanLinks("[]", SpanLinks([]SpanPointer{pointer})))
+}
@@ -0,0 +1,409 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package serverless
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+	"github.com/DataDog/datadog-agent/pkg/serverless/daemon"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// DefaultTerminationGracePeriod is the time left by Cloud Run and Container Apps between
+	// the SIGTERM sent to a container and its SIGKILL
+	DefaultTerminationGracePeriod = 10 * time.Second
+
+	// shutdownExitMargin is kept at the end of the termination grace period for the process to exit
+	shutdownExitMargin = 500 * time.Millisecond
+
+	// maxChildLogLineSize is the size after which a line written by the child is split in several logs
+	maxChildLogLineSize = 256 * 1024
+
+	// childOutputDrainTimeout is how long the output of the child is still read after it exited, the
+	// processes it started in the background keeping its stdout and stderr open
+	childOutputDrainTimeout = time.Second
+
+	// exitCodeCannotExecute and exitCodeNotFound are the exit codes of a command which can't be
+	// started, as returned by the shells
+	exitCodeCannotExecute = 126
+	exitCodeNotFound      = 127
+
+	stdoutStreamTag = "stream:stdout"
+	stderrStreamTag = "stream:stderr"
+)
+
+// periodicFlushInterval is the interval of the flushes of the telemetry while the child runs
+var periodicFlushInterval = 10 * time.Second
+
+// Flusher flushes the telemetry collected by the serverless agent
+type Flusher interface {
+	TriggerFlush(isLastFlushBeforeShutdown bool)
+}
+
+// ChildLogs is where the logs written by the child process are sent
+type ChildLogs struct {
+	// Channel receives the lines written by the child on its stdout and stderr
+	Channel chan *logConfig.ChannelMessage
+	// Tags are added to the logs, along with the tag of their stream
+	Tags []string
+	// Service is the service of the logs
+	Service string
+	// Stdout and Stderr receive a copy of the output of the child, so that the platform still
+	// collects it, nil discarding it
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ChildProcess is the command of the user run by the serverless agent acting as the init process of
+// a container. It isn't restarted once it exits.
+type ChildProcess struct {
+	cmd      *exec.Cmd
+	done     chan struct{}
+	exitCode int
+	// reaped receives the exit status of the child when the zombie processes are reaped by the
+	// serverless agent, nil when the child is waited for by its command
+	reaped <-chan syscall.WaitStatus
+}
+
+// StartChildProcess starts the command in args as a child process, the lines it writes to its
+// stdout and stderr being sent to the logs channel. When the serverless agent is the init process of
+// the container, it also reaps the orphaned processes, which are re-parented to it.
+func StartChildProcess(args []string, logs ChildLogs) (*ChildProcess, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no command to run")
+	}
+
+	// the pipes are created here rather than by the command, so that waiting for the child doesn't
+	// wait for its output to be closed by the processes it started in the background
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	err = cmd.Start()
+	// the writers are only kept open by the child and its own children
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, err
+	}
+	log.Debugf("Started the child process %d: %v", cmd.Process.Pid, args)
+
+	c := &ChildProcess{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	if os.Getpid() == 1 {
+		c.reaped = reapZombies(cmd.Process.Pid)
+	}
+
+	scanners := sync.WaitGroup{}
+	scanners.Add(2)
+	go func() {
+		defer scanners.Done()
+		scanChildOutput(stdout, logs, logs.Stdout, stdoutStreamTag, false)
+	}()
+	go func() {
+		defer scanners.Done()
+		scanChildOutput(stderr, logs, logs.Stderr, stderrStreamTag, true)
+	}()
+
+	go func() {
+		if c.reaped != nil {
+			c.exitCode = waitStatusExitCode(<-c.reaped)
+		} else {
+			c.exitCode = exitCode(cmd.Wait())
+		}
+		log.Debugf("The child process %d exited with code %d", cmd.Process.Pid, c.exitCode)
+		drainChildOutput(&scanners, childOutputDrainTimeout, stdout, stderr)
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+// Signal forwards a signal to the child process, it does nothing once it exited
+func (c *ChildProcess) Signal(sig os.Signal) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if err := c.cmd.Process.Signal(sig); err != nil {
+		log.Debugf("Could not forward the signal %s to the child process: %s", sig, err)
+	}
+}
+
+// Done is closed once the child process exited and its output was read, or it stopped being read
+// after childOutputDrainTimeout
+func (c *ChildProcess) Done() <-chan struct{} {
+	return c.done
+}
+
+// ExitCode returns the exit code of the child process once it is done. A child killed by a
+// signal exits with 128 plus the signal number, like in a shell.
+func (c *ChildProcess) ExitCode() int {
+	<-c.done
+	return c.exitCode
+}
+
+// exitCode returns the exit code of a child process from the error returned by its Wait
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Errorf("Could not wait for the child process: %s", err)
+		return exitCodeCannotExecute
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// waitStatusExitCode returns the exit code of a child process from its wait status
+func waitStatusExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// reapZombies waits for the processes which exit, as the init process of a container must: the
+// orphaned processes are re-parented to it and stay zombies until it waits for them. The exit
+// status of the child with the given PID is sent to the returned channel since the child can't be
+// waited for by its command anymore.
+func reapZombies(childPid int) <-chan syscall.WaitStatus {
+	childStatus := make(chan syscall.WaitStatus, 1)
+	exited := make(chan os.Signal, 1)
+	signal.Notify(exited, syscall.SIGCHLD)
+	go func() {
+		for {
+			// the processes which exited before the signal was caught are reaped as well
+			for {
+				var status syscall.WaitStatus
+				pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+				if err == syscall.EINTR {
+					continue
+				}
+				if err != nil || pid <= 0 {
+					break
+				}
+				if pid == childPid {
+					childStatus <- status
+				} else {
+					log.Debugf("Reaped the orphaned process %d", pid)
+				}
+			}
+			<-exited
+		}
+	}()
+	return childStatus
+}
+
+// drainChildOutput waits for the output of the exited child to be read until the end, for at most the
+// given timeout, then closes the pipes
+func drainChildOutput(scanners *sync.WaitGroup, timeout time.Duration, outputs ...*os.File) {
+	scanned := make(chan struct{})
+	go func() {
+		scanners.Wait()
+		close(scanned)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-scanned:
+	case <-timer.C:
+		log.Debugf("The output of the child process is still open after %s, it stops being read", timeout)
+	}
+	for _, output := range outputs {
+		output.Close()
+	}
+	// the scanners stop once the pipes are closed, nothing is sent to the logs channel afterwards
+	<-scanned
+}
+
+// startErrorExitCode returns the exit code of a command which couldn't be started
+func startErrorExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return exitCodeNotFound
+	}
+	return exitCodeCannotExecute
+}
+
+// scanChildOutput sends each line of an output of the child to the logs channel, copying it to
+// the given writer. The lines longer than maxChildLogLineSize are split.
+func scanChildOutput(output io.Reader, logs ChildLogs, copyTo io.Writer, streamTag string, isError bool) {
+	tags := make([]string, 0, len(logs.Tags)+1)
+	tags = append(tags, logs.Tags...)
+	tags = append(tags, streamTag)
+
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxChildLogLineSize)
+	scanner.Split(scanLinesSplittingLongOnes)
+	for scanner.Scan() {
+		// the line is only valid until the next scan
+		line := append([]byte(nil), scanner.Bytes()...)
+		if copyTo != nil {
+			copyTo.Write(append(line, '\n')) //nolint:errcheck
+		}
+		if logs.Channel == nil || len(line) == 0 {
+			continue
+		}
+		logs.Channel <- &logConfig.ChannelMessage{
+			Content:   line,
+			Timestamp: time.Now().UTC(),
+			IsError:   isError,
+			Tags:      tags,
+			Service:   logs.Service,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Debugf("Stopped reading the %s of the child process: %s", streamTag, err)
+		// the child must not block writing to a pipe nobody reads
+		io.Copy(ioutil.Discard, output) //nolint:errcheck
+	}
+}
+
+// scanLinesSplittingLongOnes is bufio.ScanLines returning the lines which don't fit in the
+// buffer of the scanner in several tokens
+func scanLinesSplittingLongOnes(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= maxChildLogLineSize {
+		return maxChildLogLineSize, data[:maxChildLogLineSize], nil
+	}
+	return advance, bytes.TrimSuffix(token, []byte{'\r'}), err
+}
+
+// shutdownDeadlines returns how long the child process is waited for after a SIGTERM received at
+// the given time, and when the flush of the telemetry must be done, for the process to exit within
+// the termination grace period.
+func shutdownDeadlines(terminatedAt time.Time, gracePeriod time.Duration) (childDeadline time.Time, flushDeadline time.Time) {
+	flushDeadline = terminatedAt.Add(gracePeriod - shutdownExitMargin)
+	flushDuration := (gracePeriod - shutdownExitMargin) / 2
+	if flushDuration > daemon.FlushTimeout {
+		flushDuration = daemon.FlushTimeout
+	}
+	if flushDuration < 0 {
+		flushDuration = 0
+	}
+	return flushDeadline.Add(-flushDuration), flushDeadline
+}
+
+// flushBefore triggers the last flush of the telemetry, it returns false if the flush is still in
+// progress at the deadline
+func flushBefore(flusher Flusher, deadline time.Time) bool {
+	flushed := make(chan struct{})
+	go func() {
+		flusher.TriggerFlush(true)
+		close(flushed)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-flushed:
+		return true
+	case <-timer.C:
+		log.Warn("Timed out while flushing before the end of the termination grace period")
+		return false
+	}
+}
+
+// flushPeriodically flushes the telemetry every interval until stop is closed, the child process of a
+// container running for as long as it is up
+func flushPeriodically(flusher Flusher, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flusher.TriggerFlush(false)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunInit runs the command in args as the child process of the serverless agent acting as the init
+// process of a container, until it exits, and returns the exit code of the agent. The telemetry is
+// flushed periodically while the child runs. The signals received are forwarded to the child. Once a SIGTERM or an interrupt is received, the child is waited for
+// until there is just enough time left in the termination grace period to flush the telemetry, then
+// it is killed. The telemetry is flushed once before returning the exit code of the child.
+func RunInit(args []string, flusher Flusher, logs ChildLogs, signals <-chan os.Signal, gracePeriod time.Duration) int {
+	child, err := StartChildProcess(args, logs)
+	if err != nil {
+		log.Errorf("Could not start %v: %s", args, err)
+		flushBefore(flusher, time.Now().Add(daemon.FlushTimeout))
+		return startErrorExitCode(err)
+	}
+
+	stopFlushes := make(chan struct{})
+	go flushPeriodically(flusher, periodicFlushInterval, stopFlushes)
+
+	var childTimeout <-chan time.Time
+	flushDeadline := time.Now().Add(daemon.FlushTimeout)
+	for {
+		select {
+		case sig := <-signals:
+			child.Signal(sig)
+			if childTimeout == nil && (sig == syscall.SIGTERM || sig == os.Interrupt) {
+				log.Infof("Received signal '%s', waiting for the child process to exit", sig)
+				var childDeadline time.Time
+				childDeadline, flushDeadline = shutdownDeadlines(time.Now(), gracePeriod)
+				childTimeout = time.After(time.Until(childDeadline))
+			}
+			continue
+		case <-childTimeout:
+			log.Warnf("The child process didn't exit within the termination grace period, killing it")
+			child.Signal(os.Kill)
+			// the output of a killed child may be held open by its own children
+			select {
+			case <-child.Done():
+			case <-time.After(time.Until(flushDeadline) / 2):
+			}
+		case <-child.Done():
+		}
+		break
+	}
+
+	close(stopFlushes)
+	flushBefore(flusher, flushDeadline)
+
+	select {
+	case <-child.Done():
+		return child.ExitCode()
+	default:
+		return 128 + int(syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,236 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package serverless
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	logConfig "github.com/DataDog/datadog-agent/pkg/logs/config"
+)
+
+type fakeFlusher struct {
+	sync.Mutex
+	flushes  []bool
+	flushed  time.Time
+	duration time.Duration
+}
+
+func (f *fakeFlusher) TriggerFlush(isLastFlushBeforeShutdown bool) {
+	time.Sleep(f.duration)
+	f.Lock()
+	defer f.Unlock()
+	f.flushes = append(f.flushes, isLastFlushBeforeShutdown)
+	f.flushed = time.Now()
+}
+
+// collectLogs returns the logs sent to a channel until it is closed
+func collectLogs(logsChan chan *logConfig.ChannelMessage) <-chan []*logConfig.ChannelMessage {
+	collected := make(chan []*logConfig.ChannelMessage, 1)
+	go func() {
+		var logs []*logConfig.ChannelMessage
+		for msg := range logsChan {
+			logs = append(logs, msg)
+		}
+		collected <- logs
+	}()
+	return collected
+}
+
+func TestRunInitChildLogsAndExitCode(t *testing.T) {
+	logsChan := make(chan *logConfig.ChannelMessage)
+	collected := collectLogs(logsChan)
+	var stdout, stderr bytes.Buffer
+	flusher := &fakeFlusher{}
+
+	code := RunInit(
+		[]string{"sh", "-c", "echo starting; echo 'cannot connect' >&2; echo stopping; exit 3"},
+		flusher,
+		ChildLogs{Channel: logsChan, Tags: []string{"env:prod"}, Service: "web", Stdout: &stdout, Stderr: &stderr},
+		make(chan os.Signal),
+		DefaultTerminationGracePeriod,
+	)
+	close(logsChan)
+	logs := <-collected
+
+	assert.Equal(t, 3, code)
+	assert.Equal(t, []bool{true}, flusher.flushes)
+	assert.Equal(t, "starting\nstopping\n", stdout.String())
+	assert.Equal(t, "cannot connect\n", stderr.String())
+
+	require.Len(t, logs, 3)
+	byContent := make(map[string]*logConfig.ChannelMessage)
+	for _, msg := range logs {
+		byContent[string(msg.Content)] = msg
+		assert.Equal(t, "web", msg.Service)
+		assert.False(t, msg.Timestamp.IsZero())
+	}
+	require.Contains(t, byContent, "starting")
+	assert.False(t, byContent["starting"].IsError)
+	assert.Equal(t, []string{"env:prod", "stream:stdout"}, byContent["starting"].Tags)
+	require.Contains(t, byContent, "cannot connect")
+	assert.True(t, byContent["cannot connect"].IsError)
+	assert.Equal(t, []string{"env:prod", "stream:stderr"}, byContent["cannot connect"].Tags)
+}
+
+func TestRunInitForwardsSIGTERM(t *testing.T) {
+	logsChan := make(chan *logConfig.ChannelMessage, 10)
+	signals := make(chan os.Signal, 1)
+	flusher := &fakeFlusher{}
+
+	child := "trap 'echo terminating; exit 42' TERM; echo ready; while true; do sleep 0.05; done"
+	done := make(chan int)
+	go func() {
+		done <- RunInit([]string{"sh", "-c", child}, flusher, ChildLogs{Channel: logsChan}, signals, DefaultTerminationGracePeriod)
+	}()
+
+	require.Equal(t, "ready", string((<-logsChan).Content))
+	signals <- syscall.SIGTERM
+
+	select {
+	case code := <-done:
+		assert.Equal(t, 42, code)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the child process didn't exit on SIGTERM")
+	}
+	assert.Equal(t, "terminating", string((<-logsChan).Content))
+	assert.Equal(t, []bool{true}, flusher.flushes)
+}
+
+func TestRunInitKillsChildBeforeTheEndOfTheGracePeriod(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	flusher := &fakeFlusher{duration: 100 * time.Millisecond}
+	gracePeriod := 2 * time.Second
+
+	// the child ignores the SIGTERM
+	child := "trap '' TERM; while true; do sleep 0.05; done"
+	done := make(chan int)
+	go func() {
+		done <- RunInit([]string{"sh", "-c", child}, flusher, ChildLogs{}, signals, gracePeriod)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	terminatedAt := time.Now()
+	signals <- syscall.SIGTERM
+
+	select {
+	case code := <-done:
+		assert.Equal(t, 128+int(syscall.SIGKILL), code)
+	case <-time.After(2 * gracePeriod):
+		require.Fail(t, "the child process wasn't killed")
+	}
+	assert.Equal(t, []bool{true}, flusher.flushes)
+	// the telemetry is flushed within the grace period
+	assert.WithinDuration(t, terminatedAt.Add(gracePeriod/2), flusher.flushed, gracePeriod/2-shutdownExitMargin)
+}
+
+func TestRunInitBackgroundProcessHoldingOutput(t *testing.T) {
+	logsChan := make(chan *logConfig.ChannelMessage, 10)
+	flusher := &fakeFlusher{}
+
+	// the background process inherits the stdout of the child and keeps it open after it exits
+	child := "sleep 30 & echo started; exit 4"
+	done := make(chan int)
+	go func() {
+		done <- RunInit([]string{"sh", "-c", child}, flusher, ChildLogs{Channel: logsChan}, make(chan os.Signal), DefaultTerminationGracePeriod)
+	}()
+
+	select {
+	case code := <-done:
+		assert.Equal(t, 4, code)
+	case <-time.After(childOutputDrainTimeout + 5*time.Second):
+		require.Fail(t, "RunInit didn't return once the child process exited")
+	}
+	assert.Equal(t, "started", string((<-logsChan).Content))
+	assert.Equal(t, []bool{true}, flusher.flushes)
+}
+
+func TestRunInitCommandNotFound(t *testing.T) {
+	flusher := &fakeFlusher{}
+	code := RunInit([]string{"/nonexistent/command"}, flusher, ChildLogs{}, make(chan os.Signal), DefaultTerminationGracePeriod)
+	assert.Equal(t, exitCodeNotFound, code)
+	assert.Equal(t, []bool{true}, flusher.flushes)
+}
+
+func TestChildProcessLongLines(t *testing.T) {
+	logsChan := make(chan *logConfig.ChannelMessage, 10)
+	child, err := StartChildProcess([]string{"sh", "-c", "head -c 300000 /dev/zero | tr '\\0' a; echo; echo short"}, ChildLogs{Channel: logsChan})
+	require.NoError(t, err)
+	assert.Equal(t, 0, child.ExitCode())
+	close(logsChan)
+
+	var lines []string
+	for msg := range logsChan {
+		lines = append(lines, string(msg.Content))
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, strings.Repeat("a", maxChildLogLineSize), lines[0])
+	assert.Equal(t, strings.Repeat("a", 300000-maxChildLogLineSize), lines[1])
+	assert.Equal(t, "short", lines[2])
+}
+
+func TestShutdownDeadlines(t *testing.T) {
+	terminatedAt := time.Unix(1625000000, 0)
+
+	// half of the time left is kept to flush
+	childDeadline, flushDeadline := shutdownDeadlines(terminatedAt, 10*time.Second)
+	assert.Equal(t, terminatedAt.Add(4750*time.Millisecond), childDeadline)
+	assert.Equal(t, terminatedAt.Add(9500*time.Millisecond), flushDeadline)
+
+	// no more than the flush timeout is kept to flush
+	childDeadline, flushDeadline = shutdownDeadlines(terminatedAt, 20*time.Second)
+	assert.Equal(t, terminatedAt.Add(14500*time.Millisecond), childDeadline)
+	assert.Equal(t, terminatedAt.Add(19500*time.Millisecond), flushDeadline)
+
+	childDeadline, flushDeadline = shutdownDeadlines(terminatedAt, 2500*time.Millisecond)
+	assert.Equal(t, terminatedAt.Add(time.Second), childDeadline)
+	assert.Equal(t, terminatedAt.Add(2*time.Second), flushDeadline)
+
+	childDeadline, flushDeadline = shutdownDeadlines(terminatedAt, 0)
+	assert.Equal(t, terminatedAt.Add(-shutdownExitMargin), childDeadline)
+	assert.Equal(t, terminatedAt.Add(-shutdownExitMargin), flushDeadline)
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, exitCode(nil))
+	assert.Equal(t, exitCodeCannotExecute, exitCode(os.ErrClosed))
+}
+
+func TestRunInitFlushesPeriodically(t *testing.T) {
+	defer func(original time.Duration) { periodicFlushInterval = original }(periodicFlushInterval)
+	periodicFlushInterval = 50 * time.Millisecond
+	flusher := &fakeFlusher{}
+
+	code := RunInit([]string{"sh", "-c", "sleep 0.3"}, flusher, ChildLogs{}, make(chan os.Signal), DefaultTerminationGracePeriod)
+	assert.Equal(t, 0, code)
+
+	flusher.Lock()
+	defer flusher.Unlock()
+	require.Greater(t, len(flusher.flushes), 2)
+	for _, isLastFlushBeforeShutdown := range flusher.flushes[:len(flusher.flushes)-1] {
+		assert.False(t, isLastFlushBeforeShutdown)
+	}
+	assert.True(t, flusher.flushes[len(flusher.flushes)-1])
+}
+
+func TestWaitStatusExitCode(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "exit 3")
+	require.Error(t, cmd.Run())
+	assert.Equal(t, 3, waitStatusExitCode(cmd.ProcessState.Sys().(syscall.WaitStatus)))
+
+	cmd = exec.Command("sh", "-c", "kill -9 $$")
+	require.Error(t, cmd.Run())
+	assert.Equal(t, 128+int(syscall.SIGKILL), waitStatusExitCode(cmd.ProcessState.Sys().(syscall.WaitStatus)))
+}
@@ -0,0 +1,133 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package tags
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+)
+
+const (
+	executionEnvEnvVar = "AWS_EXECUTION_ENV"
+	// executionEnvPrefix prefixes the runtime in AWS_EXECUTION_ENV, such as AWS_Lambda_python3.9
+	executionEnvPrefix = "AWS_Lambda_"
+
+	runtimeKey        = "runtime"
+	runtimeVersionKey = "runtime_version"
+	architectureKey   = "architecture"
+
+	// customRuntime is the runtime of the functions using a custom runtime, whose
+	// AWS_EXECUTION_ENV isn't set, on Amazon Linux 2018.03. It is suffixed with the
+	// version of Amazon Linux on the later ones, such as provided.al2.
+	customRuntime = "provided"
+)
+
+// runtimeEnv is where the runtime of the function is detected from, faked in the tests
+type runtimeEnv struct {
+	getenv func(string) string
+	// root is the root of the filesystem the os-release and libc files are looked for in
+	root   string
+	goarch string
+}
+
+// DetectRuntimeTags returns the runtime, runtime_version and architecture tags of the function.
+// The runtime is read from AWS_EXECUTION_ENV, the custom runtimes don't set it and are detected
+// from the OS of the sandbox, with the libc as their version.
+func DetectRuntimeTags() map[string]string {
+	return detectRuntimeTags(runtimeEnv{getenv: os.Getenv, root: "/", goarch: goruntime.GOARCH})
+}
+
+// AddRuntimeTags adds the runtime tags to a tag map, the tags already set by the user are kept.
+func AddRuntimeTags(tagMap map[string]string, runtimeTags map[string]string) map[string]string {
+	for k, v := range runtimeTags {
+		if _, found := tagMap[k]; !found {
+			tagMap = setIfNotEmpty(tagMap, k, v)
+		}
+	}
+	return tagMap
+}
+
+func detectRuntimeTags(env runtimeEnv) map[string]string {
+	tags := make(map[string]string)
+
+	if executionEnv := env.getenv(executionEnvEnvVar); strings.HasPrefix(executionEnv, executionEnvPrefix) {
+		runtime := strings.TrimPrefix(executionEnv, executionEnvPrefix)
+		tags = setIfNotEmpty(tags, runtimeKey, runtime)
+		if i := strings.IndexAny(runtime, "0123456789"); i > 0 {
+			tags = setIfNotEmpty(tags, runtimeVersionKey, runtime[i:])
+		}
+	} else {
+		tags = setIfNotEmpty(tags, runtimeKey, detectCustomRuntime(env.root))
+		tags = setIfNotEmpty(tags, runtimeVersionKey, detectLibc(env.root))
+	}
+
+	tags = setIfNotEmpty(tags, architectureKey, architecture(env.goarch))
+	return tags
+}
+
+// detectCustomRuntime returns the custom runtime matching the OS of the sandbox
+func detectCustomRuntime(root string) string {
+	file, err := os.Open(filepath.Join(root, "etc", "os-release"))
+	if err != nil {
+		return customRuntime
+	}
+	defer file.Close()
+
+	var id, versionID string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			versionID = value
+		}
+	}
+
+	if id == "amzn" && versionID != "" && !strings.Contains(versionID, ".") {
+		// Amazon Linux 2 and later, Amazon Linux 1 versions are dates such as 2018.03
+		return customRuntime + ".al" + versionID
+	}
+	return customRuntime
+}
+
+// detectLibc returns the libc of the sandbox, such as glibc-2.26 or musl, empty if not found
+func detectLibc(root string) string {
+	for _, dir := range []string{"lib64", "lib"} {
+		if matches, _ := filepath.Glob(filepath.Join(root, dir, "libc-*.so")); len(matches) > 0 {
+			return "glibc-" + strings.TrimSuffix(strings.TrimPrefix(filepath.Base(matches[0]), "libc-"), ".so")
+		}
+	}
+	for _, dir := range []string{"lib64", "lib"} {
+		if _, err := os.Stat(filepath.Join(root, dir, "libc.so.6")); err == nil {
+			return "glibc"
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "lib", "ld-musl-*")); len(matches) > 0 {
+		return "musl"
+	}
+	return ""
+}
+
+// architecture returns the architecture of the function as named by AWS, the extension is
+// built for the architecture of the function
+func architecture(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "arm64"
+	}
+	return goarch
+}
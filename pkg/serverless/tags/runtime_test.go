@@ -0,0 +1,166 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package tags
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeRoot creates a filesystem root holding the given files
+func newFakeRoot(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+func fakeGetenv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+const (
+	amazonLinux2OSRelease = `NAME="Amazon Linux"
+VERSION="2"
+ID="amzn"
+ID_LIKE="centos rhel fedora"
+VERSION_ID="2"
+PRETTY_NAME="Amazon Linux 2"
+`
+	amazonLinux1OSRelease = `NAME="Amazon Linux AMI"
+VERSION="2018.03"
+ID="amzn"
+ID_LIKE="rhel fedora"
+VERSION_ID="2018.03"
+PRETTY_NAME="Amazon Linux AMI 2018.03"
+`
+)
+
+func TestDetectRuntimeTags(t *testing.T) {
+	tests := []struct {
+		name         string
+		executionEnv string
+		files        map[string]string
+		goarch       string
+		expected     map[string]string
+	}{
+		{
+			name:         "python",
+			executionEnv: "AWS_Lambda_python3.9",
+			goarch:       "amd64",
+			expected:     map[string]string{"runtime": "python3.9", "runtime_version": "3.9", "architecture": "x86_64"},
+		},
+		{
+			name:         "nodejs",
+			executionEnv: "AWS_Lambda_nodejs18.x",
+			goarch:       "arm64",
+			expected:     map[string]string{"runtime": "nodejs18.x", "runtime_version": "18.x", "architecture": "arm64"},
+		},
+		{
+			name:         "java",
+			executionEnv: "AWS_Lambda_java11",
+			goarch:       "amd64",
+			expected:     map[string]string{"runtime": "java11", "runtime_version": "11", "architecture": "x86_64"},
+		},
+		{
+			name:         "dotnet",
+			executionEnv: "AWS_Lambda_dotnetcore3.1",
+			goarch:       "amd64",
+			expected:     map[string]string{"runtime": "dotnetcore3.1", "runtime_version": "3.1", "architecture": "x86_64"},
+		},
+		{
+			name:         "ruby",
+			executionEnv: "AWS_Lambda_ruby2.7",
+			goarch:       "arm64",
+			expected:     map[string]string{"runtime": "ruby2.7", "runtime_version": "2.7", "architecture": "arm64"},
+		},
+		{
+			name:         "go",
+			executionEnv: "AWS_Lambda_go1.x",
+			goarch:       "amd64",
+			expected:     map[string]string{"runtime": "go1.x", "runtime_version": "1.x", "architecture": "x86_64"},
+		},
+		{
+			name: "custom runtime on amazon linux 2",
+			files: map[string]string{
+				"etc/os-release":      amazonLinux2OSRelease,
+				"lib64/libc-2.26.so":  "",
+				"lib64/libc.so.6":     "",
+				"lib64/libm-2.26.so":  "",
+				"lib64/libpthread.so": "",
+			},
+			goarch:   "arm64",
+			expected: map[string]string{"runtime": "provided.al2", "runtime_version": "glibc-2.26", "architecture": "arm64"},
+		},
+		{
+			name: "custom runtime on amazon linux 2018.03",
+			files: map[string]string{
+				"etc/os-release":     amazonLinux1OSRelease,
+				"lib64/libc-2.17.so": "",
+			},
+			goarch:   "amd64",
+			expected: map[string]string{"runtime": "provided", "runtime_version": "glibc-2.17", "architecture": "x86_64"},
+		},
+		{
+			name: "custom runtime with a libc without version",
+			files: map[string]string{
+				"etc/os-release":  "ID=amzn\nVERSION_ID=2023\n",
+				"lib64/libc.so.6": "",
+			},
+			goarch:   "amd64",
+			expected: map[string]string{"runtime": "provided.al2023", "runtime_version": "glibc", "architecture": "x86_64"},
+		},
+		{
+			name: "custom runtime with musl",
+			files: map[string]string{
+				"lib/ld-musl-x86_64.so.1": "",
+			},
+			goarch:   "amd64",
+			expected: map[string]string{"runtime": "provided", "runtime_version": "musl", "architecture": "x86_64"},
+		},
+		{
+			name:     "nothing detected",
+			goarch:   "amd64",
+			expected: map[string]string{"runtime": "provided", "architecture": "x86_64"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := runtimeEnv{
+				getenv: fakeGetenv(map[string]string{
+					executionEnvEnvVar:       test.executionEnv,
+					"AWS_LAMBDA_RUNTIME_API": "127.0.0.1:9001",
+				}),
+				root:   newFakeRoot(t, test.files),
+				goarch: test.goarch,
+			}
+			assert.Equal(t, test.expected, detectRuntimeTags(env))
+		})
+	}
+}
+
+func TestAddRuntimeTags(t *testing.T) {
+	tagMap := BuildTagMap("arn:aws:lambda:us-east-1:123456789012:function:my-function", []string{"runtime:my-runtime"})
+	tagMap = AddRuntimeTags(tagMap, map[string]string{"runtime": "python3.9", "runtime_version": "3.9", "architecture": "x86_64"})
+
+	// the tags set by the user win
+	assert.Equal(t, "my-runtime", tagMap["runtime"])
+	assert.Equal(t, "3.9", tagMap["runtime_version"])
+	assert.Equal(t, "x86_64", tagMap["architecture"])
+	assert.Contains(t, BuildTagsFromMap(tagMap), "architecture:x86_64")
+	assert.Equal(t, "x86_64", BuildTracerTags(tagMap)["architecture"])
+}
@@ -117,6 +117,12 @@ func AddColdStartTag(tags []string, coldStart bool) []string {
 	return tags
 }
 
+// AddRestoreTag appends the restore tag to existing tags, for the functions using SnapStart
+func AddRestoreTag(tags []string, restore bool) []string {
+	tags = append(tags, fmt.Sprintf("restore:%v", restore))
+	return tags
+}
+
 func setIfNotEmpty(tagMap map[string]string, key string, value string) map[string]string {
 	if key != "" && value != "" {
 		tagMap[key] = strings.ToLower(value)
@@ -256,3 +256,8 @@ func TestAddColdStartTagWithColdStart(t *testing.T) {
 		"cold_start:true",
 	})
 }
+
+func TestAddRestoreTag(t *testing.T) {
+	generatedTags := AddRestoreTag([]string{"cold_start:false"}, true)
+	assert.Equal(t, []string{"cold_start:false", "restore:true"}, generatedTags)
+}
@@ -0,0 +1,71 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package trace
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/traceutil"
+)
+
+// requestIDTag is the tag set by the Lambda libraries on the span of an invocation
+const requestIDTag = "request_id"
+
+// maxInvocationErrors is the maximum number of failed invocations kept to tag their spans,
+// the spans of an invocation are received at the end of the invocation at the latest
+const maxInvocationErrors = 10
+
+// invocationError is the error returned by the function for an invocation
+type invocationError struct {
+	errorType    string
+	errorMessage string
+}
+
+// invocationErrors keeps the errors of the last failed invocations, by request ID, so that
+// the spans of these invocations are tagged with them when the trace agent receives them
+type invocationErrors struct {
+	sync.Mutex
+	errors map[string]invocationError
+	// requestIDs holds the request IDs of the errors, the oldest first
+	requestIDs []string
+}
+
+func newInvocationErrors() *invocationErrors {
+	return &invocationErrors{errors: make(map[string]invocationError)}
+}
+
+func (e *invocationErrors) add(requestID string, errorType string, errorMessage string) {
+	e.Lock()
+	defer e.Unlock()
+	if _, found := e.errors[requestID]; !found {
+		e.requestIDs = append(e.requestIDs, requestID)
+	}
+	e.errors[requestID] = invocationError{errorType: errorType, errorMessage: errorMessage}
+	if len(e.requestIDs) > maxInvocationErrors {
+		delete(e.errors, e.requestIDs[0])
+		e.requestIDs = e.requestIDs[1:]
+	}
+}
+
+// tagSpan tags the span of a failed invocation with its error
+func (e *invocationErrors) tagSpan(span *pb.Span) {
+	requestID, found := span.Meta[requestIDTag]
+	if !found {
+		return
+	}
+	e.Lock()
+	invocationError, found := e.errors[requestID]
+	e.Unlock()
+	if !found {
+		return
+	}
+	span.Error = 1
+	traceutil.SetMeta(span, "error.type", invocationError.errorType)
+	if invocationError.errorMessage != "" {
+		traceutil.SetMeta(span, "error.msg", invocationError.errorMessage)
+	}
+}
@@ -0,0 +1,52 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !windows
+
+package trace
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvocationErrorsTagSpan(t *testing.T) {
+	e := newInvocationErrors()
+	e.add("request-1", "TypeError", "undefined is not a function")
+
+	span := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-1"}}
+	e.tagSpan(span)
+	assert.Equal(t, int32(1), span.Error)
+	assert.Equal(t, "TypeError", span.Meta["error.type"])
+	assert.Equal(t, "undefined is not a function", span.Meta["error.msg"])
+
+	other := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-2"}}
+	e.tagSpan(other)
+	assert.Equal(t, int32(0), other.Error)
+	assert.NotContains(t, other.Meta, "error.type")
+
+	child := &pb.Span{Name: "http.request"}
+	e.tagSpan(child)
+	assert.Equal(t, int32(0), child.Error)
+}
+
+func TestInvocationErrorsBounded(t *testing.T) {
+	e := newInvocationErrors()
+	for i := 0; i < maxInvocationErrors+2; i++ {
+		e.add(fmt.Sprintf("request-%d", i), "Error", "")
+	}
+	assert.Len(t, e.errors, maxInvocationErrors)
+	assert.Len(t, e.requestIDs, maxInvocationErrors)
+	assert.NotContains(t, e.errors, "request-0")
+	assert.Contains(t, e.errors, fmt.Sprintf("request-%d", maxInvocationErrors+1))
+
+	// an error without message doesn't set error.msg
+	span := &pb.Span{Meta: map[string]string{"request_id": "request-11"}}
+	e.tagSpan(span)
+	assert.NotContains(t, span.Meta, "error.msg")
+}
@@ -0,0 +1,209 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/sampler"
+)
+
+const (
+	samplingRuleTag     = "sampling_rule"
+	samplingDecisionTag = "sampling_decision"
+
+	// defaultSamplingRule tags the traces which didn't match any rule, they are kept
+	defaultSamplingRule = "default"
+	// forcedSamplingRule tags the traces kept regardless of the rules because they
+	// contain an error or were manually kept
+	forcedSamplingRule = "forced"
+)
+
+// SamplingRule is a trace sampling rule, in the format accepted by the tracing libraries
+// in DD_TRACE_SAMPLING_RULES. Empty fields match any value.
+type SamplingRule struct {
+	Service    string  `json:"service"`
+	Name       string  `json:"name"`
+	Resource   string  `json:"resource"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+func (r *SamplingRule) matches(root *pb.Span) bool {
+	return (r.Service == "" || r.Service == root.Service) &&
+		(r.Name == "" || r.Name == root.Name) &&
+		(r.Resource == "" || r.Resource == root.Resource)
+}
+
+// ParseSamplingRules parses a JSON array of sampling rules
+func ParseSamplingRules(raw string) ([]SamplingRule, error) {
+	var rules []SamplingRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse the sampling rules: %s", err)
+	}
+	for i, rule := range rules {
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return nil, fmt.Errorf("the sample_rate of the sampling rule %d must be between 0 and 1, got %v", i, rule.SampleRate)
+		}
+	}
+	return rules, nil
+}
+
+// samplingStats counts the sampling decisions taken for a rule since the last report
+type samplingStats struct {
+	rate    float64
+	kept    float64
+	dropped float64
+}
+
+// Sampler applies the sampling rules to the traces of the function, and caps the
+// number of kept traces per second over each invocation
+type Sampler struct {
+	rules  []SamplingRule
+	maxTPS float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowKept  float64
+	stats       map[string]*samplingStats
+}
+
+// NewSampler returns a sampler applying the given rules. A maxTPS of 0 disables the cap.
+func NewSampler(rules []SamplingRule, maxTPS float64) *Sampler {
+	return &Sampler{
+		rules:  rules,
+		maxTPS: maxTPS,
+		stats:  make(map[string]*samplingStats),
+	}
+}
+
+// StartWindow starts a new invocation window, the traces kept during the
+// previous invocations don't count towards the cap anymore.
+func (s *Sampler) StartWindow(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windowStart = now
+	s.windowKept = 0
+}
+
+// Sample returns whether the trace should be kept. Traces containing an error or
+// manually kept are always kept.
+func (s *Sampler) Sample(root *pb.Span, t pb.Trace) bool {
+	return s.sample(root, t, time.Now())
+}
+
+func (s *Sampler) sample(root *pb.Span, t pb.Trace, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+
+	if priority, ok := sampler.GetSamplingPriority(root); (ok && priority == sampler.PriorityUserKeep) || traceContainsError(t) {
+		s.windowKept++
+		s.record(forcedSamplingRule, 1, true)
+		return true
+	}
+
+	ruleName, rate := defaultSamplingRule, 1.0
+	for i := range s.rules {
+		if s.rules[i].matches(root) {
+			ruleName, rate = strconv.Itoa(i), s.rules[i].SampleRate
+			break
+		}
+	}
+
+	keep := sampler.SampleByRate(root.TraceID, rate)
+	if keep && s.maxTPS > 0 {
+		// the first second of the window is always fully allowed so that short
+		// invocations can keep up to maxTPS traces
+		elapsed := math.Max(now.Sub(s.windowStart).Seconds(), 1)
+		keep = s.windowKept < s.maxTPS*elapsed
+	}
+	if keep {
+		s.windowKept++
+	}
+	s.record(ruleName, rate, keep)
+	return keep
+}
+
+func (s *Sampler) record(ruleName string, rate float64, keep bool) {
+	stats, found := s.stats[ruleName]
+	if !found {
+		stats = &samplingStats{}
+		s.stats[ruleName] = stats
+	}
+	stats.rate = rate
+	if keep {
+		stats.kept++
+	} else {
+		stats.dropped++
+	}
+}
+
+// SendMetrics sends the number of kept and dropped traces and the effective sample rate
+// of each rule applied since the last call, so that users can check their configuration.
+func (s *Sampler) SendMetrics(tags []string, metricsChan chan []metrics.MetricSample) {
+	s.mu.Lock()
+	pending := s.stats
+	s.stats = make(map[string]*samplingStats)
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	timestamp := float64(time.Now().UnixNano())
+	var samples []metrics.MetricSample
+	for ruleName, stats := range pending {
+		ruleTags := append(append([]string{}, tags...),
+			fmt.Sprintf("%s:%s", samplingRuleTag, ruleName),
+			fmt.Sprintf("sample_rate:%v", stats.rate),
+		)
+		samples = append(samples,
+			metrics.MetricSample{
+				Name:       "datadog.serverless.trace.sampling.traces",
+				Value:      stats.kept,
+				Mtype:      metrics.CountType,
+				Tags:       append(append([]string{}, ruleTags...), samplingDecisionTag+":keep"),
+				SampleRate: 1,
+				Timestamp:  timestamp,
+			},
+			metrics.MetricSample{
+				Name:       "datadog.serverless.trace.sampling.traces",
+				Value:      stats.dropped,
+				Mtype:      metrics.CountType,
+				Tags:       append(append([]string{}, ruleTags...), samplingDecisionTag+":drop"),
+				SampleRate: 1,
+				Timestamp:  timestamp,
+			},
+			metrics.MetricSample{
+				Name:       "datadog.serverless.trace.sampling.effective_rate",
+				Value:      stats.kept / (stats.kept + stats.dropped),
+				Mtype:      metrics.GaugeType,
+				Tags:       ruleTags,
+				SampleRate: 1,
+				Timestamp:  timestamp,
+			},
+		)
+	}
+	metricsChan <- samples
+}
+
+func traceContainsError(t pb.Trace) bool {
+	for _, span := range t {
+		if span.Error != 0 {
+			return true
+		}
+	}
+	return false
+}
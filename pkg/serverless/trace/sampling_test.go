@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !windows
+
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/sampler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTrace(traceID uint64, service, name, resource string) (*pb.Span, pb.Trace) {
+	root := &pb.Span{TraceID: traceID, SpanID: 1, Service: service, Name: name, Resource: resource, Metrics: map[string]float64{}}
+	return root, pb.Trace{root}
+}
+
+func TestParseSamplingRules(t *testing.T) {
+	rules, err := ParseSamplingRules(`[{"service":"checkout","name":"aws.lambda","sample_rate":0.5},{"resource":"GET /health","sample_rate":0}]`)
+	require.NoError(t, err)
+	assert.Equal(t, []SamplingRule{
+		{Service: "checkout", Name: "aws.lambda", SampleRate: 0.5},
+		{Resource: "GET /health", SampleRate: 0},
+	}, rules)
+
+	_, err = ParseSamplingRules(`{"sample_rate":0.5}`)
+	assert.Error(t, err)
+
+	_, err = ParseSamplingRules(`[{"sample_rate":1.5}]`)
+	assert.Error(t, err)
+}
+
+func TestSamplerRules(t *testing.T) {
+	s := NewSampler([]SamplingRule{
+		{Resource: "GET /health", SampleRate: 0},
+		{Service: "checkout", SampleRate: 1},
+	}, 0)
+
+	// first matching rule wins
+	root, trace := makeTrace(1, "checkout", "aws.lambda", "GET /health")
+	assert.False(t, s.Sample(root, trace))
+	root, trace = makeTrace(2, "checkout", "aws.lambda", "POST /cart")
+	assert.True(t, s.Sample(root, trace))
+	// no matching rule keeps the trace
+	root, trace = makeTrace(3, "billing", "aws.lambda", "POST /invoice")
+	assert.True(t, s.Sample(root, trace))
+}
+
+func TestSamplerAlwaysKeepsErrorsAndUserKeep(t *testing.T) {
+	s := NewSampler([]SamplingRule{{SampleRate: 0}}, 0)
+
+	root, trace := makeTrace(1, "checkout", "aws.lambda", "POST /cart")
+	assert.False(t, s.Sample(root, trace))
+
+	root, trace = makeTrace(2, "checkout", "aws.lambda", "POST /cart")
+	trace = append(trace, &pb.Span{TraceID: 2, SpanID: 2, ParentID: 1, Error: 1})
+	assert.True(t, s.Sample(root, trace))
+
+	root, trace = makeTrace(3, "checkout", "aws.lambda", "POST /cart")
+	sampler.SetSamplingPriority(root, sampler.PriorityUserKeep)
+	assert.True(t, s.Sample(root, trace))
+}
+
+func TestSamplerMaxTPS(t *testing.T) {
+	s := NewSampler(nil, 2)
+	start := time.Now()
+	s.StartWindow(start)
+
+	kept := 0
+	for i := uint64(1); i <= 5; i++ {
+		root, trace := makeTrace(i, "checkout", "aws.lambda", "POST /cart")
+		if s.sample(root, trace, start.Add(100*time.Millisecond)) {
+			kept++
+		}
+	}
+	assert.Equal(t, 2, kept)
+
+	// the budget grows with the duration of the invocation
+	root, trace := makeTrace(6, "checkout", "aws.lambda", "POST /cart")
+	assert.True(t, s.sample(root, trace, start.Add(2*time.Second)))
+
+	// errors are kept even over the cap
+	root, trace = makeTrace(7, "checkout", "aws.lambda", "POST /cart")
+	root.Error = 1
+	assert.True(t, s.sample(root, trace, start.Add(2*time.Second)))
+
+	// a new invocation resets the window
+	s.StartWindow(start.Add(3 * time.Second))
+	root, trace = makeTrace(8, "checkout", "aws.lambda", "POST /cart")
+	assert.True(t, s.sample(root, trace, start.Add(3*time.Second)))
+}
+
+func TestSamplerSendMetrics(t *testing.T) {
+	s := NewSampler([]SamplingRule{{Service: "checkout", SampleRate: 0}}, 0)
+	metricsChan := make(chan []metrics.MetricSample, 1)
+
+	s.SendMetrics([]string{"functionname:test"}, metricsChan)
+	assert.Len(t, metricsChan, 0)
+
+	root, trace := makeTrace(1, "checkout", "aws.lambda", "POST /cart")
+	s.Sample(root, trace)
+	root, trace = makeTrace(2, "checkout", "aws.lambda", "POST /cart")
+	s.Sample(root, trace)
+
+	s.SendMetrics([]string{"functionname:test"}, metricsChan)
+	samples := <-metricsChan
+	require.Len(t, samples, 3)
+
+	byName := make(map[string]metrics.MetricSample)
+	for _, sample := range samples {
+		assert.Contains(t, sample.Tags, "functionname:test")
+		assert.Contains(t, sample.Tags, "sampling_rule:0")
+		assert.Contains(t, sample.Tags, "sample_rate:0")
+		key := sample.Name
+		for _, tag := range sample.Tags {
+			if tag == "sampling_decision:keep" || tag == "sampling_decision:drop" {
+				key += "|" + tag
+			}
+		}
+		byName[key] = sample
+	}
+	assert.Equal(t, float64(0), byName["datadog.serverless.trace.sampling.traces|sampling_decision:keep"].Value)
+	assert.Equal(t, float64(2), byName["datadog.serverless.trace.sampling.traces|sampling_decision:drop"].Value)
+	assert.Equal(t, float64(0), byName["datadog.serverless.trace.sampling.effective_rate"].Value)
+
+	// the counters are reset after each report
+	s.SendMetrics([]string{"functionname:test"}, metricsChan)
+	assert.Len(t, metricsChan, 0)
+}
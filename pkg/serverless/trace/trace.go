@@ -7,17 +7,27 @@ package trace
 
 import (
 	"context"
+	"time"
 
 	ddConfig "github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/metrics"
+	serverlessMetrics "github.com/DataDog/datadog-agent/pkg/serverless/metrics"
 	"github.com/DataDog/datadog-agent/pkg/trace/agent"
 	"github.com/DataDog/datadog-agent/pkg/trace/config"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/writer"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
 )
 
 // ServerlessTraceAgent represents a trace agent in a serverless context
 type ServerlessTraceAgent struct {
-	ta     *agent.Agent
-	cancel context.CancelFunc
+	ta               *agent.Agent
+	sampler          *Sampler
+	invocationErrors *invocationErrors
+	xrayContexts     *xrayContexts
+	triggerTags      *triggerTags
+	warmups          *warmups
+	cancel           context.CancelFunc
 }
 
 // Load abstracts the file configuration loading
@@ -51,6 +61,13 @@ func (s *ServerlessTraceAgent) Start(enabled bool, loadConfig Load) {
 			tc.Hostname = ""
 			tc.SynchronousFlushing = true
 			s.ta = agent.NewAgent(context, tc)
+			s.setupSampler(tc)
+			s.invocationErrors = newInvocationErrors()
+			s.xrayContexts = newXRayContexts()
+			s.triggerTags = newTriggerTags()
+			s.warmups = newWarmups()
+			s.ta.ModifySpan = s.modifySpan
+			s.ta.SampleTrace = s.sampleTrace
 			s.cancel = cancel
 			go func() {
 				s.ta.Run()
@@ -59,11 +76,126 @@ func (s *ServerlessTraceAgent) Start(enabled bool, loadConfig Load) {
 	}
 }
 
+// setupSampler applies the sampling rules from DD_APM_SAMPLING_RULES and the cap from
+// DD_APM_MAX_TPS to the traces kept by the trace agent, if any of them is configured
+func (s *ServerlessTraceAgent) setupSampler(tc *config.AgentConfig) {
+	var rules []SamplingRule
+	if raw := ddConfig.Datadog.GetString("apm_config.sampling_rules"); raw != "" {
+		var err error
+		if rules, err = ParseSamplingRules(raw); err != nil {
+			log.Errorf("Invalid DD_APM_SAMPLING_RULES, traces won't be sampled by rule: %s", err)
+		}
+	}
+	var maxTPS float64
+	if ddConfig.Datadog.IsSet("apm_config.max_traces_per_second") {
+		maxTPS = tc.TargetTPS
+	}
+	if len(rules) == 0 && maxTPS <= 0 {
+		return
+	}
+	log.Debugf("Sampling traces with the rules %+v and at most %v traces per second", rules, maxTPS)
+	s.sampler = NewSampler(rules, maxTPS)
+}
+
+// StartInvocation starts a new sampling window for the traces of an invocation
+func (s *ServerlessTraceAgent) StartInvocation() {
+	if s.sampler != nil {
+		s.sampler.StartWindow(time.Now())
+	}
+}
+
+// SendSamplingMetrics sends the metrics describing the sampling decisions taken since the last call
+func (s *ServerlessTraceAgent) SendSamplingMetrics(tags []string, metricsChan chan []metrics.MetricSample) {
+	if s.sampler != nil {
+		s.sampler.SendMetrics(tags, metricsChan)
+	}
+}
+
+// TakeEndpointCounts returns the trace payloads sent to each endpoint since the previous call
+func (s *ServerlessTraceAgent) TakeEndpointCounts() map[string]serverlessMetrics.EndpointCounts {
+	counts := make(map[string]serverlessMetrics.EndpointCounts)
+	if s.ta != nil {
+		for host, stats := range s.ta.TraceWriter.TakeEndpointStats() {
+			counts[host] = serverlessMetrics.EndpointCounts{Sent: stats.Sent, Errors: stats.Errors}
+		}
+	}
+	return counts
+}
+
+// SetInvocationError tags the spans of the invocation with the given request ID with the
+// error returned by the function. The spans must be received after the call to be tagged.
+func (s *ServerlessTraceAgent) SetInvocationError(requestID string, errorType string, errorMessage string) {
+	if s.invocationErrors != nil {
+		s.invocationErrors.add(requestID, errorType, errorMessage)
+	}
+}
+
+// SetXRayContext tags the spans of the invocation with the given request ID with its
+// X-Ray context. The spans must be received after the call to be tagged.
+func (s *ServerlessTraceAgent) SetXRayContext(requestID string, xrayContext XRayContext) {
+	if s.xrayContexts != nil {
+		s.xrayContexts.add(requestID, xrayContext)
+	}
+}
+
+// SetTriggerTags tags the spans of the invocation with the given request ID with the tags
+// describing its trigger, added to the ones already set. The spans must be received after
+// the call to be tagged.
+func (s *ServerlessTraceAgent) SetTriggerTags(requestID string, tags map[string]string) {
+	if s.triggerTags != nil {
+		s.triggerTags.add(requestID, tags)
+	}
+}
+
+// SetWarmup drops the traces of the invocation with the given request ID, detected as a
+// warm-up request. The traces must be received after the call to be dropped.
+func (s *ServerlessTraceAgent) SetWarmup(requestID string) {
+	if s.warmups != nil {
+		s.warmups.add(requestID)
+	}
+}
+
+// sampleTrace drops the traces of the warm-up invocations and applies the sampling rules
+// to the other ones
+func (s *ServerlessTraceAgent) sampleTrace(root *pb.Span, t pb.Trace) bool {
+	if s.warmups.contains(root) {
+		return false
+	}
+	if s.sampler != nil {
+		return s.sampler.Sample(root, t)
+	}
+	return true
+}
+
+// modifySpan tags the spans of the invocations with their error, X-Ray context and trigger
+func (s *ServerlessTraceAgent) modifySpan(span *pb.Span) {
+	s.invocationErrors.tagSpan(span)
+	s.xrayContexts.tagSpan(span)
+	s.triggerTags.tagSpan(span)
+}
+
 // Get returns the trace agent instance
 func (s *ServerlessTraceAgent) Get() *agent.Agent {
 	return s.ta
 }
 
+// UpdateAPIKey replaces the API key used to send the traces and stats when it is oldKey
+func (s *ServerlessTraceAgent) UpdateAPIKey(oldKey, newKey string) {
+	if s.ta != nil {
+		s.ta.TraceWriter.UpdateAPIKey(oldKey, newKey)
+		s.ta.StatsWriter.UpdateAPIKey(oldKey, newKey)
+	}
+}
+
+// SetRetryHandler sets the handler receiving the traces and stats payloads which failed to be sent
+// to the intake, instead of retrying them in the background while the sandbox may be frozen
+func (s *ServerlessTraceAgent) SetRetryHandler(handler writer.RetryHandler) {
+	if s.ta != nil {
+		s.ta.TraceWriter.SetRetryHandler(handler)
+		s.ta.StatsWriter.SetRetryHandler(handler)
+	}
+}
+
 // Stop stops the trace agent
 func (s *ServerlessTraceAgent) Stop() {
 	if s.cancel != nil {
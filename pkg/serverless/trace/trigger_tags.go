@@ -0,0 +1,69 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package trace
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/serverless/spanpointers"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/traceutil"
+)
+
+// maxTriggerTags is the maximum number of invocations whose trigger tags are kept to tag their spans
+const maxTriggerTags = 10
+
+// triggerTags keeps the tags describing the trigger of the last invocations, by request ID,
+// so that the spans of these invocations are tagged with them when the trace agent receives them
+type triggerTags struct {
+	sync.Mutex
+	tags map[string]map[string]string
+	// requestIDs holds the request IDs of the tags, the oldest first
+	requestIDs []string
+}
+
+func newTriggerTags() *triggerTags {
+	return &triggerTags{tags: make(map[string]map[string]string)}
+}
+
+// add adds tags to the ones of an invocation, the status code is only known at its end
+func (t *triggerTags) add(requestID string, tags map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+	invocationTags, found := t.tags[requestID]
+	if !found {
+		invocationTags = make(map[string]string, len(tags))
+		t.tags[requestID] = invocationTags
+		t.requestIDs = append(t.requestIDs, requestID)
+	}
+	for k, v := range tags {
+		invocationTags[k] = v
+	}
+	if len(t.requestIDs) > maxTriggerTags {
+		delete(t.tags, t.requestIDs[0])
+		t.requestIDs = t.requestIDs[1:]
+	}
+}
+
+// tagSpan tags the span of an invocation with the tags of its trigger, the span links being
+// merged with the ones already set by the tracer
+func (t *triggerTags) tagSpan(span *pb.Span) {
+	requestID, found := span.Meta[requestIDTag]
+	if !found {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for k, v := range t.tags[requestID] {
+		if v == "" {
+			continue
+		}
+		if current, found := span.Meta[k]; found && k == spanpointers.SpanLinksTag {
+			v = spanpointers.MergeSpanLinks(current, v)
+		}
+		traceutil.SetMeta(span, k, v)
+	}
+}
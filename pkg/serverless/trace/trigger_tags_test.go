@@ -0,0 +1,76 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !windows
+
+package trace
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/serverless/spanpointers"
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerTagsTagSpan(t *testing.T) {
+	tt := newTriggerTags()
+	tt.add("request-1", map[string]string{
+		"function_trigger.event_source": "lambda-function-url",
+		"http.method":                   "POST",
+		"http.route":                    "",
+	})
+	// the status code is added at the end of the invocation
+	tt.add("request-1", map[string]string{"http.status_code": "201"})
+
+	span := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-1"}}
+	tt.tagSpan(span)
+	assert.Equal(t, map[string]string{
+		"request_id":                    "request-1",
+		"function_trigger.event_source": "lambda-function-url",
+		"http.method":                   "POST",
+		"http.status_code":              "201",
+	}, span.Meta)
+
+	other := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-2"}}
+	tt.tagSpan(other)
+	assert.Len(t, other.Meta, 1)
+
+	child := &pb.Span{Name: "http.request"}
+	tt.tagSpan(child)
+	assert.Nil(t, child.Meta)
+}
+
+func TestTriggerTagsMergeSpanLinks(t *testing.T) {
+	tt := newTriggerTags()
+	pointers := []spanpointers.SpanPointer{{Kind: spanpointers.S3ObjectKind, Direction: spanpointers.DirectionUpstream, Hash: "e721375466d4116ab551213fdea08413"}}
+	tt.add("request-1", map[string]string{spanpointers.SpanLinksTag: spanpointers.SpanLinks(pointers)})
+
+	tracerLinks := `[{"trace_id":"0af7651916cd43dd8448eb211c80319c","span_id":"b7ad6b7169203331"}]`
+	span := &pb.Span{Name: "aws.lambda", Meta: map[string]string{
+		"request_id":              "request-1",
+		spanpointers.SpanLinksTag: tracerLinks,
+	}}
+	tt.tagSpan(span)
+	assert.Equal(t, spanpointers.MergeSpanLinks(tracerLinks, spanpointers.SpanLinks(pointers)), span.Meta[spanpointers.SpanLinksTag])
+	assert.Contains(t, span.Meta[spanpointers.SpanLinksTag], "b7ad6b7169203331")
+
+	// without links set by the tracer, the span has the pointers only
+	span = &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-1"}}
+	tt.tagSpan(span)
+	assert.Equal(t, spanpointers.SpanLinks(pointers), span.Meta[spanpointers.SpanLinksTag])
+}
+
+func TestTriggerTagsBounded(t *testing.T) {
+	tt := newTriggerTags()
+	for i := 0; i < maxTriggerTags+2; i++ {
+		tt.add(fmt.Sprintf("request-%d", i), map[string]string{"http.method": "GET"})
+	}
+	assert.Len(t, tt.tags, maxTriggerTags)
+	assert.Len(t, tt.requestIDs, maxTriggerTags)
+	assert.NotContains(t, tt.tags, "request-0")
+	assert.Contains(t, tt.tags, fmt.Sprintf("request-%d", maxTriggerTags+1))
+}
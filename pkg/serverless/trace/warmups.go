@@ -0,0 +1,51 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package trace
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+)
+
+// maxWarmups is the maximum number of warm-up invocations kept to drop their traces
+const maxWarmups = 10
+
+// warmups keeps the request IDs of the last invocations detected as warm-up requests,
+// so that their traces are dropped when the trace agent receives them
+type warmups struct {
+	sync.Mutex
+	requestIDs []string
+}
+
+func newWarmups() *warmups {
+	return &warmups{}
+}
+
+func (w *warmups) add(requestID string) {
+	w.Lock()
+	defer w.Unlock()
+	w.requestIDs = append(w.requestIDs, requestID)
+	if len(w.requestIDs) > maxWarmups {
+		w.requestIDs = w.requestIDs[1:]
+	}
+}
+
+// contains returns whether the given root span is the span of a warm-up invocation
+func (w *warmups) contains(root *pb.Span) bool {
+	requestID, found := root.Meta[requestIDTag]
+	if !found {
+		return false
+	}
+	w.Lock()
+	defer w.Unlock()
+	for _, id := range w.requestIDs {
+		if id == requestID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !windows
+
+package trace
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleTraceDropsWarmups(t *testing.T) {
+	s := &ServerlessTraceAgent{warmups: newWarmups()}
+	s.SetWarmup("request-1")
+
+	warmup := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-1"}}
+	assert.False(t, s.sampleTrace(warmup, pb.Trace{warmup}))
+
+	other := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-2"}}
+	assert.True(t, s.sampleTrace(other, pb.Trace{other}))
+
+	noRequestID := &pb.Span{Name: "http.request"}
+	assert.True(t, s.sampleTrace(noRequestID, pb.Trace{noRequestID}))
+}
+
+func TestWarmupsBounded(t *testing.T) {
+	w := newWarmups()
+	for i := 0; i < maxWarmups+2; i++ {
+		w.add(fmt.Sprintf("request-%d", i))
+	}
+	assert.Len(t, w.requestIDs, maxWarmups)
+	assert.False(t, w.contains(&pb.Span{Meta: map[string]string{"request_id": "request-0"}}))
+	assert.True(t, w.contains(&pb.Span{Meta: map[string]string{"request_id": fmt.Sprintf("request-%d", maxWarmups+1)}}))
+}
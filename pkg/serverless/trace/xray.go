@@ -0,0 +1,149 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package trace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/DataDog/datadog-agent/pkg/trace/traceutil"
+)
+
+const (
+	// XRayTracingType is the type of the tracing header of the invocations of functions
+	// with X-Ray active tracing enabled
+	XRayTracingType = "X-Amzn-Trace-Id"
+
+	// maxXRayContexts is the maximum number of X-Ray contexts kept to tag the spans of the invocations
+	maxXRayContexts = 10
+
+	xrayRootKey    = "Root"
+	xrayParentKey  = "Parent"
+	xraySampledKey = "Sampled"
+
+	// the X-Ray trace IDs are 1-<8 hex digits epoch>-<24 hex digits random>
+	xrayTraceIDParts     = 3
+	xrayTraceIDRandomLen = 24
+	xrayEntityIDLen      = 16
+
+	// Datadog trace IDs are converted from the last 16 hex digits of the X-Ray trace ID, on 63 bits
+	ddTraceIDMask = 0x7FFFFFFFFFFFFFFF
+)
+
+// XRayContext is the X-Ray context of an invocation, with its IDs converted to Datadog IDs
+type XRayContext struct {
+	TraceID    string
+	ParentID   string
+	Sampled    string
+	DDTraceID  uint64
+	DDParentID uint64
+}
+
+// ParseXRayTraceHeader parses an X-Amzn-Trace-Id header, such as
+// Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1,
+// and converts its IDs to Datadog trace and span IDs.
+func ParseXRayTraceHeader(header string) (XRayContext, error) {
+	var xrayContext XRayContext
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case xrayRootKey:
+			xrayContext.TraceID = kv[1]
+		case xrayParentKey:
+			xrayContext.ParentID = kv[1]
+		case xraySampledKey:
+			xrayContext.Sampled = kv[1]
+		}
+	}
+
+	var err error
+	if xrayContext.DDTraceID, err = convertXRayTraceID(xrayContext.TraceID); err != nil {
+		return XRayContext{}, err
+	}
+	if xrayContext.DDParentID, err = convertXRayEntityID(xrayContext.ParentID); err != nil {
+		return XRayContext{}, err
+	}
+	return xrayContext, nil
+}
+
+// convertXRayTraceID converts an X-Ray trace ID to a Datadog trace ID
+func convertXRayTraceID(traceID string) (uint64, error) {
+	parts := strings.Split(traceID, "-")
+	if len(parts) != xrayTraceIDParts || len(parts[2]) != xrayTraceIDRandomLen {
+		return 0, fmt.Errorf("invalid X-Ray trace ID %q", traceID)
+	}
+	id, err := strconv.ParseUint(parts[2][xrayTraceIDRandomLen-16:], 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-Ray trace ID %q: %v", traceID, err)
+	}
+	return id & ddTraceIDMask, nil
+}
+
+// convertXRayEntityID converts an X-Ray segment ID to a Datadog span ID
+func convertXRayEntityID(entityID string) (uint64, error) {
+	if len(entityID) != xrayEntityIDLen {
+		return 0, fmt.Errorf("invalid X-Ray parent ID %q", entityID)
+	}
+	id, err := strconv.ParseUint(entityID, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-Ray parent ID %q: %v", entityID, err)
+	}
+	return id, nil
+}
+
+// xrayContexts keeps the X-Ray contexts of the last invocations, by request ID, so that
+// the spans of these invocations are tagged with them when the trace agent receives them
+type xrayContexts struct {
+	sync.Mutex
+	contexts map[string]XRayContext
+	// requestIDs holds the request IDs of the contexts, the oldest first
+	requestIDs []string
+}
+
+func newXRayContexts() *xrayContexts {
+	return &xrayContexts{contexts: make(map[string]XRayContext)}
+}
+
+func (x *xrayContexts) add(requestID string, xrayContext XRayContext) {
+	x.Lock()
+	defer x.Unlock()
+	if _, found := x.contexts[requestID]; !found {
+		x.requestIDs = append(x.requestIDs, requestID)
+	}
+	x.contexts[requestID] = xrayContext
+	if len(x.requestIDs) > maxXRayContexts {
+		delete(x.contexts, x.requestIDs[0])
+		x.requestIDs = x.requestIDs[1:]
+	}
+}
+
+// tagSpan tags the span of an invocation with its X-Ray context. The spans always carry
+// the Datadog context set by the tracer, which wins: the X-Ray IDs are only added as tags.
+func (x *xrayContexts) tagSpan(span *pb.Span) {
+	requestID, found := span.Meta[requestIDTag]
+	if !found {
+		return
+	}
+	x.Lock()
+	xrayContext, found := x.contexts[requestID]
+	x.Unlock()
+	if !found {
+		return
+	}
+	traceutil.SetMeta(span, "aws.xray.trace_id", xrayContext.TraceID)
+	traceutil.SetMeta(span, "aws.xray.parent_id", xrayContext.ParentID)
+	if xrayContext.Sampled != "" {
+		traceutil.SetMeta(span, "aws.xray.sampled", xrayContext.Sampled)
+	}
+	traceutil.SetMeta(span, "_dd.xray.trace_id", strconv.FormatUint(xrayContext.DDTraceID, 10))
+	traceutil.SetMeta(span, "_dd.xray.parent_id", strconv.FormatUint(xrayContext.DDParentID, 10))
+}
@@ -0,0 +1,99 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !windows
+
+package trace
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DataDog/datadog-agent/pkg/trace/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseXRayTraceHeader(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected XRayContext
+		err      bool
+	}{
+		{
+			header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+			expected: XRayContext{
+				TraceID:    "1-5759e988-bd862e3fe1be46a994272793",
+				ParentID:   "53995c3f42cd8ad8",
+				Sampled:    "1",
+				DDTraceID:  7043144561403045779,
+				DDParentID: 6023947403358210776,
+			},
+		},
+		{
+			// the order of the fields doesn't matter and the sampling decision is optional
+			header: "Parent=00000000000000ff; Root=1-60f1a2b3-1f7a9b0c2d3e4f5a6b7c8d9e",
+			expected: XRayContext{
+				TraceID:    "1-60f1a2b3-1f7a9b0c2d3e4f5a6b7c8d9e",
+				ParentID:   "00000000000000ff",
+				DDTraceID:  3260130430031793566,
+				DDParentID: 255,
+			},
+		},
+		{header: "", err: true},
+		{header: "Parent=53995c3f42cd8ad8;Sampled=1", err: true},
+		{header: "Root=1-5759e988;Parent=53995c3f42cd8ad8", err: true},
+		{header: "Root=1-5759e988-bd862e3fe1be46a99427279z;Parent=53995c3f42cd8ad8", err: true},
+		{header: "Root=1-5759e988-bd862e3fe1be46a994272793", err: true},
+		{header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			xrayContext, err := ParseXRayTraceHeader(test.header)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, xrayContext)
+		})
+	}
+}
+
+func TestXRayContextsTagSpan(t *testing.T) {
+	x := newXRayContexts()
+	xrayContext, err := ParseXRayTraceHeader("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	assert.NoError(t, err)
+	x.add("request-1", xrayContext)
+
+	span := &pb.Span{TraceID: 42, SpanID: 43, Name: "aws.lambda", Meta: map[string]string{"request_id": "request-1"}}
+	x.tagSpan(span)
+	// the Datadog context wins, the X-Ray IDs are tags only
+	assert.Equal(t, uint64(42), span.TraceID)
+	assert.Equal(t, uint64(0), span.ParentID)
+	assert.Equal(t, "1-5759e988-bd862e3fe1be46a994272793", span.Meta["aws.xray.trace_id"])
+	assert.Equal(t, "53995c3f42cd8ad8", span.Meta["aws.xray.parent_id"])
+	assert.Equal(t, "1", span.Meta["aws.xray.sampled"])
+	assert.Equal(t, "7043144561403045779", span.Meta["_dd.xray.trace_id"])
+	assert.Equal(t, "6023947403358210776", span.Meta["_dd.xray.parent_id"])
+
+	other := &pb.Span{Name: "aws.lambda", Meta: map[string]string{"request_id": "request-2"}}
+	x.tagSpan(other)
+	assert.NotContains(t, other.Meta, "aws.xray.trace_id")
+
+	child := &pb.Span{Name: "http.request"}
+	x.tagSpan(child)
+	assert.Nil(t, child.Meta)
+}
+
+func TestXRayContextsBounded(t *testing.T) {
+	x := newXRayContexts()
+	for i := 0; i < maxXRayContexts+2; i++ {
+		x.add(fmt.Sprintf("request-%d", i), XRayContext{})
+	}
+	assert.Len(t, x.contexts, maxXRayContexts)
+	assert.Len(t, x.requestIDs, maxXRayContexts)
+	assert.NotContains(t, x.contexts, "request-0")
+	assert.Contains(t, x.contexts, fmt.Sprintf("request-%d", maxXRayContexts+1))
+}
@@ -0,0 +1,214 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package snmp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	coreconfig "github.com/DataDog/datadog-agent/pkg/config"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// secretsOrigin is the origin of the secrets referenced by the credentials, as listed in the flare
+const secretsOrigin = "snmp_listener"
+
+// legacyCredentialKeys maps the legacy keys of the credentials to their current key
+var legacyCredentialKeys = map[string]string{
+	"community":          "community_string",
+	"authentication_key": "authKey",
+	"privacy_key":        "privKey",
+}
+
+// SecretResolver fetches the values of secret handles from the secrets backend, such as secrets.Refresh
+// which bypasses the cache of the backend so that rotated secrets are picked up
+type SecretResolver func(handles []string, origin string) (map[string]string, error)
+
+// rawListenerConfigs returns the snmp_listener configs as written in the config file, before the
+// secrets they reference were resolved when the config was loaded. Don't make it a method, to be
+// overridden in tests.
+var rawListenerConfigs = func() []map[string]interface{} {
+	path := coreconfig.Datadog.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var raw struct {
+		SNMPListener struct {
+			Configs []map[string]interface{} `yaml:"configs"`
+		} `yaml:"snmp_listener"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+	return raw.SNMPListener.Configs
+}
+
+// rawConfigsByKey indexes the raw configs by the key of their settings other than the credentials, the
+// configs sharing their key being left out as they can't be told apart
+func rawConfigsByKey(rawConfigs []map[string]interface{}) map[string]map[string]interface{} {
+	byKey := make(map[string]map[string]interface{}, len(rawConfigs))
+	ambiguous := map[string]bool{}
+	for _, raw := range rawConfigs {
+		key := rawKey(raw)
+		if _, found := byKey[key]; found {
+			ambiguous[key] = true
+		}
+		byKey[key] = raw
+	}
+	for key := range ambiguous {
+		delete(byKey, key)
+	}
+	return byKey
+}
+
+// rawKey returns the key of a raw config, matching the rawConfigKey of the config decoded from it
+func rawKey(raw map[string]interface{}) string {
+	field := func(keys ...string) string {
+		for _, key := range keys {
+			if value, found := raw[key]; found && value != nil {
+				if s := fmt.Sprint(value); s != "" && s != "0" {
+					return s
+				}
+			}
+		}
+		return ""
+	}
+	return strings.Join([]string{
+		field("network_address", "network"),
+		field("port"),
+		field("snmp_version", "version"),
+		field("namespace"),
+		field("context_name"),
+		field("loader"),
+	}, "|")
+}
+
+// rawConfigKey returns the key of a config to match it with its raw config, before its defaults are set
+func (c *Config) rawConfigKey() string {
+	port := ""
+	if c.Port != 0 {
+		port = strconv.Itoa(int(c.Port))
+	}
+	return strings.Join([]string{
+		firstNonEmpty(c.Network, c.NetworkLegacy),
+		port,
+		firstNonEmpty(c.Version, c.VersionLegacy),
+		c.Namespace,
+		c.ContextName,
+		c.Loader,
+	}, "|")
+}
+
+// secretHandle returns the handle of a value using the ENC[] syntax
+func secretHandle(value string) (string, bool) {
+	value = strings.Trim(value, " \t")
+	if strings.HasPrefix(value, "ENC[") && strings.HasSuffix(value, "]") {
+		return value[4 : len(value)-1], true
+	}
+	return "", false
+}
+
+// credentials returns the credentials which may reference a secret, by config key
+func (c *Config) credentials() map[string]*string {
+	return map[string]*string{
+		"community_string": &c.Community,
+		"user":             &c.User,
+		"authKey":          &c.AuthKey,
+		"privKey":          &c.PrivKey,
+	}
+}
+
+// loadSecretHandles records the secret handles referenced by the credentials, either still in the
+// config or in the raw config written in the config file when they were resolved at load
+func (c *Config) loadSecretHandles(raw map[string]interface{}) {
+	rawHandles := map[string]string{}
+	for key, value := range raw {
+		if current, isLegacy := legacyCredentialKeys[key]; isLegacy {
+			key = current
+		}
+		if value, isString := value.(string); isString {
+			if handle, found := secretHandle(value); found {
+				rawHandles[key] = handle
+			}
+		}
+	}
+	for key, value := range c.credentials() {
+		handle, found := secretHandle(*value)
+		if !found {
+			handle, found = rawHandles[key]
+		}
+		if !found {
+			continue
+		}
+		if c.SecretHandles == nil {
+			c.SecretHandles = map[string]string{}
+		}
+		c.SecretHandles[key] = handle
+	}
+}
+
+// ResolveSecrets resolves the secrets referenced by the credentials with the ENC[] syntax, and
+// returns whether a credential changed. The credentials are left unchanged when one of the
+// secrets can't be resolved.
+func (c *Config) ResolveSecrets(resolveSecrets SecretResolver) (bool, error) {
+	if len(c.SecretHandles) == 0 {
+		return false, nil
+	}
+	unique := map[string]struct{}{}
+	for _, handle := range c.SecretHandles {
+		unique[handle] = struct{}{}
+	}
+	handles := make([]string, 0, len(unique))
+	for handle := range unique {
+		handles = append(handles, handle)
+	}
+	sort.Strings(handles)
+
+	values, err := resolveSecrets(handles, secretsOrigin)
+	if err != nil {
+		return false, err
+	}
+	for _, handle := range handles {
+		if _, found := values[handle]; !found {
+			return false, fmt.Errorf("secret handle '%s' was not resolved", handle)
+		}
+	}
+
+	changed := false
+	credentials := c.credentials()
+	for key, handle := range c.SecretHandles {
+		if value := values[handle]; *credentials[key] != value {
+			*credentials[key] = value
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// CopyCredentials copies the credentials of another config, such as after its secrets were rotated
+func (c *Config) CopyCredentials(from Config) {
+	c.Community = from.Community
+	c.User = from.User
+	c.AuthKey = from.AuthKey
+	c.PrivKey = from.PrivKey
+}
+
+// digestCredential returns the value of a credential hashed in the digest: its secret handle when it
+// references a secret, so that the digest doesn't change when the secret is rotated
+func (c *Config) digestCredential(key string, value string) string {
+	if handle, found := c.SecretHandles[key]; found {
+		return "ENC[" + handle + "]"
+	}
+	return value
+}
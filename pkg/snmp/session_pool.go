@@ -0,0 +1,432 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// defaultSessionPoolSize is the number of idle sessions kept by credential set until the
+	// pool is resized to the concurrency of its users
+	defaultSessionPoolSize = 4
+	// maxSessionErrors is the number of consecutive socket errors after which a session is
+	// recycled, the timeouts of the devices which don't answer aren't counted
+	maxSessionErrors = 3
+	// maxSessionIdleTime is the time after which an idle session is recycled
+	maxSessionIdleTime = 5 * time.Minute
+	// maxEngineAge is the time after which the engine of a device is discovered again
+	maxEngineAge = time.Hour
+	// maxCachedEngines is the maximum number of devices whose engine is cached
+	maxCachedEngines = 16384
+)
+
+var sharedSessionPool = NewSessionPool(defaultSessionPoolSize)
+
+// SharedSessionPool returns the session pool shared by the SNMP listener and the checks
+// opting into it
+func SharedSessionPool() *SessionPool {
+	return sharedSessionPool
+}
+
+// SessionPool reuses the SNMP sessions across devices to save their setup: the v1 and v2c
+// sessions of a credential set share their UDP sockets, and the engine of the v3 devices
+// is cached so that probing them again skips the engine discovery exchange. A nil
+// SessionPool creates and closes a session for each device.
+type SessionPool struct {
+	mu sync.Mutex
+	// size is the maximum number of idle sessions by credential set
+	size int
+	// idle holds the idle v1 and v2c sessions, by credential set
+	idle map[string][]*pooledSocket
+	// engines holds the engine of the v3 devices, by credential set and device
+	engines map[string]cachedEngine
+	// constrained is true while the memory of the users of the pool is constrained: a single idle
+	// session is kept by credential set and the engines aren't cached
+	constrained bool
+}
+
+// pooledSocket is an unconnected UDP socket shared by the sessions of a credential set,
+// with the session using it
+type pooledSocket struct {
+	conn     *targetConn
+	session  *gosnmp.GoSNMP
+	errors   int
+	lastUsed time.Time
+}
+
+// cachedEngine is the engine of a v3 device, learnt from its last answer
+type cachedEngine struct {
+	securityParameters *gosnmp.UsmSecurityParameters
+	contextEngineID    string
+	learnt             time.Time
+}
+
+// PooledSession is a session to a device obtained from a SessionPool, it must be released
+// once done
+type PooledSession struct {
+	*gosnmp.GoSNMP
+	pool      *SessionPool
+	key       string
+	socket    *pooledSocket
+	engineKey string
+}
+
+// NewSessionPool returns a pool keeping at most size idle sessions by credential set, the
+// concurrency of its users
+func NewSessionPool(size int) *SessionPool {
+	return &SessionPool{
+		size:    size,
+		idle:    map[string][]*pooledSocket{},
+		engines: map[string]cachedEngine{},
+	}
+}
+
+// Resize sets the maximum number of idle sessions by credential set, to follow the
+// concurrency of the users of the pool
+func (p *SessionPool) Resize(size int) {
+	if p == nil || size <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = size
+	p.trimIdle()
+}
+
+// SetConstrained shrinks the pool while the memory of its users is constrained: it keeps a single
+// idle session by credential set and forgets the engines of the v3 devices, which are discovered
+// again by their next session. The pool grows back to its size once it isn't constrained anymore.
+func (p *SessionPool) SetConstrained(constrained bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.constrained = constrained
+	if constrained {
+		p.trimIdle()
+		p.engines = map[string]cachedEngine{}
+	}
+}
+
+// idleSize returns the maximum number of idle sessions by credential set. The caller must hold the lock.
+func (p *SessionPool) idleSize() int {
+	if p.constrained {
+		return 1
+	}
+	return p.size
+}
+
+// trimIdle closes the idle sessions past the maximum number of idle sessions by credential set. The
+// caller must hold the lock.
+func (p *SessionPool) trimIdle() {
+	size := p.idleSize()
+	for key, sockets := range p.idle {
+		for len(sockets) > size {
+			sockets[len(sockets)-1].conn.closeSocket()
+			sockets = sockets[:len(sockets)-1]
+		}
+		p.idle[key] = sockets
+	}
+}
+
+// MemoryUsage returns the approximate memory used by the idle sessions and the cached engines of
+// the pool in bytes: the size of their structs and the length of their strings
+func (p *SessionPool) MemoryUsage() int64 {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var usage int64
+	for key, sockets := range p.idle {
+		socketSize := unsafe.Sizeof(pooledSocket{}) + unsafe.Sizeof(targetConn{}) + unsafe.Sizeof(gosnmp.GoSNMP{})
+		usage += int64(unsafe.Sizeof(key)) + int64(len(key)) + int64(len(sockets))*int64(socketSize)
+	}
+	for key, engine := range p.engines {
+		usage += int64(unsafe.Sizeof(key)) + int64(len(key)) + int64(unsafe.Sizeof(engine)) + int64(unsafe.Sizeof(gosnmp.UsmSecurityParameters{})) +
+			int64(len(engine.contextEngineID)) + int64(len(engine.securityParameters.AuthoritativeEngineID))
+	}
+	return usage
+}
+
+// Connect returns a session to the target of params, reusing an idle session of the same
+// credential set when the SNMP version allows it. params must not be used afterwards.
+func (p *SessionPool) Connect(params *gosnmp.GoSNMP) (*PooledSession, error) {
+	if p == nil {
+		if err := params.Connect(); err != nil {
+			return nil, err
+		}
+		return &PooledSession{GoSNMP: params}, nil
+	}
+
+	key := credentialKey(params)
+	if params.Version == gosnmp.Version3 {
+		return p.connectV3(key, params)
+	}
+	if params.Transport != "" && params.Transport != "udp" {
+		if err := params.Connect(); err != nil {
+			return nil, err
+		}
+		return &PooledSession{GoSNMP: params}, nil
+	}
+
+	port := params.Port
+	if port == 0 {
+		port = 161
+	}
+	target, err := net.ResolveUDPAddr("udp", net.JoinHostPort(params.Target, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", params.Target, err)
+	}
+
+	// the sockets are bound to the address family of their first target
+	if target.IP.To4() != nil {
+		key += "|4"
+	} else {
+		key += "|6"
+	}
+
+	if socket := p.takeIdle(key, time.Now()); socket != nil {
+		socket.conn.setTarget(target)
+		socket.session.Target = params.Target
+		socket.session.Port = port
+		return &PooledSession{GoSNMP: socket.session, pool: p, key: key, socket: socket}, nil
+	}
+
+	// the session is initialized by a connection to the target, whose socket is then
+	// replaced by the shared one
+	if err := params.Connect(); err != nil {
+		return nil, err
+	}
+	params.Conn.Close()
+	conn, err := newTargetConn(target)
+	if err != nil {
+		return nil, err
+	}
+	params.Conn = conn
+	socket := &pooledSocket{conn: conn, session: params}
+	return &PooledSession{GoSNMP: params, pool: p, key: key, socket: socket}, nil
+}
+
+// takeIdle returns an idle session of a credential set, recycling the unhealthy ones
+func (p *SessionPool) takeIdle(key string, now time.Time) *pooledSocket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sockets := p.idle[key]
+	for len(sockets) > 0 {
+		socket := sockets[len(sockets)-1]
+		sockets = sockets[:len(sockets)-1]
+		if socket.errors >= maxSessionErrors || now.Sub(socket.lastUsed) > maxSessionIdleTime {
+			socket.conn.closeSocket()
+			continue
+		}
+		if len(sockets) > 0 {
+			p.idle[key] = sockets
+		} else {
+			delete(p.idle, key)
+		}
+		return socket
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// connectV3 connects a v3 session, with the engine of its device when it is known
+func (p *SessionPool) connectV3(key string, params *gosnmp.GoSNMP) (*PooledSession, error) {
+	engineKey := key + "|" + params.Target
+	now := time.Now()
+	p.mu.Lock()
+	engine, found := p.engines[engineKey]
+	if found && now.Sub(engine.learnt) > maxEngineAge {
+		delete(p.engines, engineKey)
+		found = false
+	}
+	p.mu.Unlock()
+
+	if found {
+		securityParameters := engine.securityParameters.Copy().(*gosnmp.UsmSecurityParameters)
+		securityParameters.AuthoritativeEngineTime += uint32(now.Sub(engine.learnt).Seconds())
+		securityParameters.Logger = params.Logger
+		params.SecurityParameters = securityParameters
+		if params.ContextEngineID == "" {
+			params.ContextEngineID = engine.contextEngineID
+		}
+	}
+	if err := params.Connect(); err != nil {
+		return nil, err
+	}
+	return &PooledSession{GoSNMP: params, pool: p, key: key, engineKey: engineKey}, nil
+}
+
+// Release ends the use of the session, err being the error of its last request if any.
+// The session is recycled after repeated socket errors, and the engine of a v3 device is
+// discovered again after an error.
+func (s *PooledSession) Release(err error) {
+	switch {
+	case s.pool == nil:
+		s.GoSNMP.Conn.Close()
+	case s.socket != nil:
+		s.pool.releaseSocket(s.key, s.socket, err)
+	default:
+		s.pool.releaseV3(s.engineKey, s.GoSNMP, err)
+		s.GoSNMP.Conn.Close()
+	}
+}
+
+func (p *SessionPool) releaseSocket(key string, socket *pooledSocket, err error) {
+	switch {
+	case err == nil:
+		socket.errors = 0
+	case !isTimeout(err):
+		socket.errors++
+	}
+	socket.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if socket.errors >= maxSessionErrors || len(p.idle[key]) >= p.idleSize() {
+		socket.conn.closeSocket()
+		return
+	}
+	p.idle[key] = append(p.idle[key], socket)
+}
+
+func (p *SessionPool) releaseV3(engineKey string, session *gosnmp.GoSNMP, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	securityParameters, ok := session.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if err != nil || !ok || securityParameters.AuthoritativeEngineID == "" || p.constrained {
+		delete(p.engines, engineKey)
+		return
+	}
+	if _, found := p.engines[engineKey]; !found && len(p.engines) >= maxCachedEngines {
+		for evicted := range p.engines {
+			delete(p.engines, evicted)
+			break
+		}
+	}
+	p.engines[engineKey] = cachedEngine{
+		securityParameters: securityParameters.Copy().(*gosnmp.UsmSecurityParameters),
+		contextEngineID:    session.ContextEngineID,
+		learnt:             time.Now(),
+	}
+}
+
+// isTimeout returns whether an error is the timeout of a device which didn't answer
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return strings.Contains(err.Error(), "timeout")
+}
+
+// credentialKey returns the key of the credential set and the settings of a session, the
+// sessions with the same key can be reused for each other's devices
+func credentialKey(params *gosnmp.GoSNMP) string {
+	h := fnv.New64()
+	fmt.Fprintf(h, "%s|%d|%s|%s|%d|%d|%d|%d|%s|%s", params.Transport, params.Version, params.Community, params.Timeout,
+		params.Retries, params.MaxOids, params.MsgFlags, params.SecurityModel, params.ContextName, params.ContextEngineID)
+	if usm, ok := params.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok && params.Version == gosnmp.Version3 {
+		fmt.Fprintf(h, "|%s|%d|%s|%d|%s", usm.UserName, usm.AuthenticationProtocol, usm.AuthenticationPassphrase,
+			usm.PrivacyProtocol, usm.PrivacyPassphrase)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// targetConn is a net.Conn sending to a target from a shared unconnected UDP socket, the
+// packets received from other addresses, such as the late answers of the previous targets,
+// are dropped. It doesn't implement net.PacketConn so that gosnmp uses it as a connected
+// socket.
+type targetConn struct {
+	socket *net.UDPConn
+	mu     sync.RWMutex
+	target *net.UDPAddr
+}
+
+func newTargetConn(target *net.UDPAddr) (*targetConn, error) {
+	network := "udp6"
+	if target.IP.To4() != nil {
+		network = "udp4"
+	}
+	socket, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &targetConn{socket: socket, target: target}, nil
+}
+
+func (c *targetConn) setTarget(target *net.UDPAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = target
+}
+
+func (c *targetConn) currentTarget() *net.UDPAddr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.target
+}
+
+// Read reads the next packet sent by the target
+func (c *targetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.socket.ReadFromUDP(b)
+		if err != nil {
+			return n, err
+		}
+		target := c.currentTarget()
+		if addr.Port == target.Port && addr.IP.Equal(target.IP) {
+			return n, nil
+		}
+	}
+}
+
+// Write sends a packet to the target
+func (c *targetConn) Write(b []byte) (int, error) {
+	return c.socket.WriteToUDP(b, c.currentTarget())
+}
+
+// Close doesn't close the shared socket, which is closed when the session is recycled
+func (c *targetConn) Close() error {
+	return nil
+}
+
+func (c *targetConn) closeSocket() {
+	c.socket.Close()
+}
+
+func (c *targetConn) LocalAddr() net.Addr {
+	return c.socket.LocalAddr()
+}
+
+func (c *targetConn) RemoteAddr() net.Addr {
+	return c.currentTarget()
+}
+
+func (c *targetConn) SetDeadline(t time.Time) error {
+	return c.socket.SetDeadline(t)
+}
+
+func (c *targetConn) SetReadDeadline(t time.Time) error {
+	return c.socket.SetReadDeadline(t)
+}
+
+func (c *targetConn) SetWriteDeadline(t time.Time) error {
+	return c.socket.SetWriteDeadline(t)
+}
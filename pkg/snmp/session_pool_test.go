@@ -0,0 +1,309 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package snmp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSysNameOid = "1.3.6.1.2.1.1.5.0"
+
+// startFakeAgent starts a v2c agent answering the GETs of its sysName
+func startFakeAgent(t *testing.T, sysName string) uint16 {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Couldn't listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request, err := decoder.SnmpDecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			response := gosnmp.SnmpPacket{
+				Version:   request.Version,
+				Community: request.Community,
+				PDUType:   gosnmp.GetResponse,
+				RequestID: request.RequestID,
+			}
+			for _, variable := range request.Variables {
+				answer := gosnmp.SnmpPDU{Name: variable.Name, Type: gosnmp.NoSuchObject}
+				if strings.TrimPrefix(variable.Name, ".") == testSysNameOid {
+					answer = gosnmp.SnmpPDU{Name: variable.Name, Type: gosnmp.OctetString, Value: sysName}
+				}
+				response.Variables = append(response.Variables, answer)
+			}
+			payload, err := response.MarshalMsg()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(payload, addr) //nolint:errcheck
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func v2cParams(port uint16) *gosnmp.GoSNMP {
+	return &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      port,
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+		Transport: "udp",
+	}
+}
+
+func getSysName(t *testing.T, session *PooledSession) string {
+	value, err := session.Get([]string{testSysNameOid})
+	require.NoError(t, err)
+	require.Len(t, value.Variables, 1)
+	return string(value.Variables[0].Value.([]byte))
+}
+
+func TestSessionPoolReusesV2cSessions(t *testing.T) {
+	portA := startFakeAgent(t, "device-a")
+	portB := startFakeAgent(t, "device-b")
+	pool := NewSessionPool(1)
+
+	session, err := pool.Connect(v2cParams(portA))
+	require.NoError(t, err)
+	assert.Equal(t, "device-a", getSysName(t, session))
+	localAddr := session.GoSNMP.Conn.LocalAddr().String()
+	session.Release(nil)
+
+	// the session of the same credential set is reused for another device
+	session, err = pool.Connect(v2cParams(portB))
+	require.NoError(t, err)
+	assert.Equal(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	assert.Equal(t, "device-b", getSysName(t, session))
+
+	// the idle session is taken, another one is created
+	other, err := pool.Connect(v2cParams(portA))
+	require.NoError(t, err)
+	assert.NotEqual(t, localAddr, other.GoSNMP.Conn.LocalAddr().String())
+	assert.Equal(t, "device-a", getSysName(t, other))
+	session.Release(nil)
+	// the pool is full, the session is closed
+	other.Release(nil)
+	assert.Len(t, pool.idle, 1)
+
+	// the sessions of other credential sets aren't reused
+	params := v2cParams(portA)
+	params.Community = "private"
+	session, err = pool.Connect(params)
+	require.NoError(t, err)
+	assert.NotEqual(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	session.Release(nil)
+	assert.Len(t, pool.idle, 2)
+}
+
+func TestSessionPoolRecyclesUnhealthySessions(t *testing.T) {
+	port := startFakeAgent(t, "device")
+	pool := NewSessionPool(1)
+
+	session, err := pool.Connect(v2cParams(port))
+	require.NoError(t, err)
+	localAddr := session.GoSNMP.Conn.LocalAddr().String()
+
+	// the timeouts of the devices which don't answer don't make the session unhealthy
+	for i := 0; i < maxSessionErrors; i++ {
+		session.Release(errors.New("request timeout (after 3 retries)"))
+		session, err = pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		assert.Equal(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	}
+
+	for i := 0; i < maxSessionErrors-1; i++ {
+		session.Release(errors.New("connection refused"))
+		session, err = pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		assert.Equal(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	}
+	session.Release(errors.New("connection refused"))
+	assert.Empty(t, pool.idle)
+
+	session, err = pool.Connect(v2cParams(port))
+	require.NoError(t, err)
+	assert.NotEqual(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	assert.Equal(t, "device", getSysName(t, session))
+	session.Release(nil)
+
+	// the sessions idle for too long are recycled
+	for _, sockets := range pool.idle {
+		sockets[0].lastUsed = time.Now().Add(-maxSessionIdleTime - time.Minute)
+	}
+	localAddr = session.GoSNMP.Conn.LocalAddr().String()
+	session, err = pool.Connect(v2cParams(port))
+	require.NoError(t, err)
+	assert.NotEqual(t, localAddr, session.GoSNMP.Conn.LocalAddr().String())
+	session.Release(nil)
+}
+
+func TestSessionPoolResize(t *testing.T) {
+	port := startFakeAgent(t, "device")
+	pool := NewSessionPool(3)
+
+	var sessions []*PooledSession
+	for i := 0; i < 3; i++ {
+		session, err := pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		session.Release(nil)
+	}
+	for _, sockets := range pool.idle {
+		assert.Len(t, sockets, 3)
+	}
+
+	pool.Resize(1)
+	for _, sockets := range pool.idle {
+		assert.Len(t, sockets, 1)
+	}
+}
+
+func TestSessionPoolCachesV3Engines(t *testing.T) {
+	pool := NewSessionPool(1)
+	v3Params := func() *gosnmp.GoSNMP {
+		return &gosnmp.GoSNMP{
+			Target:        "127.0.0.1",
+			Port:          161,
+			Version:       gosnmp.Version3,
+			Timeout:       time.Second,
+			Transport:     "udp",
+			SecurityModel: gosnmp.UserSecurityModel,
+			MsgFlags:      gosnmp.AuthNoPriv,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{
+				UserName:                 "user",
+				AuthenticationProtocol:   gosnmp.SHA,
+				AuthenticationPassphrase: "password",
+			},
+		}
+	}
+
+	session, err := pool.Connect(v3Params())
+	require.NoError(t, err)
+	assert.Empty(t, session.SecurityParameters.(*gosnmp.UsmSecurityParameters).AuthoritativeEngineID)
+	// the engine discovered by the requests of the session
+	usm := session.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = "engine"
+	usm.AuthoritativeEngineBoots = 7
+	usm.AuthoritativeEngineTime = 1000
+	session.ContextEngineID = "engine"
+	session.Release(nil)
+
+	pool.engines[session.engineKey] = cachedEngine{
+		securityParameters: pool.engines[session.engineKey].securityParameters,
+		contextEngineID:    "engine",
+		learnt:             time.Now().Add(-time.Minute),
+	}
+
+	// the engine is known, its time is advanced since it was learnt
+	session, err = pool.Connect(v3Params())
+	require.NoError(t, err)
+	usm = session.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	assert.Equal(t, "engine", usm.AuthoritativeEngineID)
+	assert.Equal(t, uint32(7), usm.AuthoritativeEngineBoots)
+	assert.InDelta(t, 1060, usm.AuthoritativeEngineTime, 1)
+	assert.Equal(t, "engine", session.ContextEngineID)
+
+	// the engine is discovered again after an error, e.g. a reboot of the device
+	session.Release(errors.New("incoming packet is not authentic"))
+	session, err = pool.Connect(v3Params())
+	require.NoError(t, err)
+	assert.Empty(t, session.SecurityParameters.(*gosnmp.UsmSecurityParameters).AuthoritativeEngineID)
+	session.Release(nil)
+
+	// the engines of other credential sets aren't used
+	params := v3Params()
+	params.SecurityParameters.(*gosnmp.UsmSecurityParameters).UserName = "other"
+	session, err = pool.Connect(params)
+	require.NoError(t, err)
+	assert.Empty(t, session.SecurityParameters.(*gosnmp.UsmSecurityParameters).AuthoritativeEngineID)
+	session.Release(nil)
+}
+
+func TestNilSessionPool(t *testing.T) {
+	port := startFakeAgent(t, "device")
+	var pool *SessionPool
+
+	session, err := pool.Connect(v2cParams(port))
+	require.NoError(t, err)
+	assert.Equal(t, "device", getSysName(t, session))
+	session.Release(nil)
+	pool.Resize(10)
+}
+
+func TestSessionPoolConstrained(t *testing.T) {
+	port := startFakeAgent(t, "device")
+	pool := NewSessionPool(3)
+
+	var sessions []*PooledSession
+	for i := 0; i < 3; i++ {
+		session, err := pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		session.Release(nil)
+	}
+	pool.engines["engine"] = cachedEngine{securityParameters: &gosnmp.UsmSecurityParameters{AuthoritativeEngineID: "engine"}}
+	usage := pool.MemoryUsage()
+	assert.Greater(t, usage, int64(0))
+
+	// a single idle session is kept by credential set and the engines are forgotten
+	pool.SetConstrained(true)
+	for _, sockets := range pool.idle {
+		assert.Len(t, sockets, 1)
+	}
+	assert.Empty(t, pool.engines)
+	assert.Less(t, pool.MemoryUsage(), usage)
+
+	sessions = sessions[:0]
+	for i := 0; i < 2; i++ {
+		session, err := pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		session.Release(nil)
+	}
+	for _, sockets := range pool.idle {
+		assert.Len(t, sockets, 1)
+	}
+
+	// the pool grows back to its size
+	pool.SetConstrained(false)
+	sessions = sessions[:0]
+	for i := 0; i < 3; i++ {
+		session, err := pool.Connect(v2cParams(port))
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		session.Release(nil)
+	}
+	for _, sockets := range pool.idle {
+		assert.Len(t, sockets, 3)
+	}
+}
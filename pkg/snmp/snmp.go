@@ -9,23 +9,51 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"net"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/DataDog/datadog-agent/pkg/collector/check/defaults"
 	coreconfig "github.com/DataDog/datadog-agent/pkg/config"
 
 	"github.com/DataDog/viper"
 	"github.com/gosnmp/gosnmp"
 )
 
+// probeOIDRegex matches a numeric OID, such as 1.3.6.1.2.1.1.2.0, with an optional leading dot
+var probeOIDRegex = regexp.MustCompile(`^\.?[0-9]+(\.[0-9]+)+$`)
+
 const (
 	defaultPort    = 161
 	defaultTimeout = 5
 	defaultRetries = 3
+
+	defaultNeighborWalkDepth = 2
+
+	// defaultNamespace is the default value of network_devices.namespace
+	defaultNamespace = "default"
+
+	// MaxSuggestedCollectionInterval caps the min collection interval suggested from the interface count
+	// of a device, in seconds, so that a bogus interface count doesn't stop its collection
+	MaxSuggestedCollectionInterval = 600
+
+	defaultInterfaceCountIntervalFactor = 1.0
+)
+
+// The rules prioritizing the devices scheduled when the discovered devices exceed MaxDevicesPerAgent
+const (
+	// DevicePriorityFirstDiscovered schedules the devices in the order they were discovered
+	DevicePriorityFirstDiscovered = "first_discovered"
+	// DevicePriorityLowestIP schedules the devices with the lowest IPs
+	DevicePriorityLowestIP = "lowest_ip"
+	// DevicePriorityProfile schedules the devices whose sysObjectID matches the highest profile priority,
+	// then in the order they were discovered
+	DevicePriorityProfile = "profile_priority"
 )
 
 // ListenerConfig holds global configuration for SNMP discovery
@@ -33,15 +61,52 @@ type ListenerConfig struct {
 	Workers               int      `mapstructure:"workers"`
 	DiscoveryInterval     int      `mapstructure:"discovery_interval"`
 	AllowedFailures       int      `mapstructure:"discovery_allowed_failures"`
+	HealthCheckInterval   int      `mapstructure:"health_check_interval"`
 	Loader                string   `mapstructure:"loader"`
 	CollectDeviceMetadata bool     `mapstructure:"collect_device_metadata"`
 	MinCollectionInterval uint     `mapstructure:"min_collection_interval"`
-	Configs               []Config `mapstructure:"configs"`
+	DiscoveryProbeOIDs    []string `mapstructure:"discovery_probe_oids"`
+	SecretRefreshInterval int      `mapstructure:"secret_refresh_interval"`
+	ConfigReloadInterval  int      `mapstructure:"config_reload_interval"`
+	// MaxDevicesPerAgent is the number of devices scheduled at most, 0 for no limit. The devices
+	// discovered past it are pending until scheduled devices are evicted, in the order of DevicePriority.
+	MaxDevicesPerAgent int               `mapstructure:"max_devices_per_agent"`
+	DevicePriority     string            `mapstructure:"device_priority"`
+	ProfilePriorities  []ProfilePriority `mapstructure:"profile_priorities"`
+	// ProfileOIDCounts override the number of OIDs expected to be collected from the devices of a profile,
+	// counted from the profile definitions otherwise, used by the cluster agent to balance the checks of
+	// the devices between the cluster check runners.
+	ProfileOIDCounts []ProfileOIDCount `mapstructure:"profile_oid_counts"`
+	Configs          []Config          `mapstructure:"configs"`
+	// InterfaceCountThreshold is the number of interfaces over which the devices get a longer min collection
+	// interval, 0 to disable it, scaled by InterfaceCountIntervalFactor
+	InterfaceCountThreshold      int     `mapstructure:"interface_count_threshold"`
+	InterfaceCountIntervalFactor float64 `mapstructure:"interface_count_interval_factor"`
+	// DiscoveryMemoryBudget is the approximate memory in bytes used at most by the discovery and its device
+	// registry, 0 for no limit. Past it, the new subnet sweeps are paused and the session pool is shrunk.
+	DiscoveryMemoryBudget int64 `mapstructure:"discovery_memory_budget"`
+	// DeviceLatency keeps the round-trip latency of the last discovery probe answered by each scheduled
+	// device, for the status and the dry-run discovery
+	DeviceLatency bool `mapstructure:"discovery_device_latency"`
 
 	// legacy
 	AllowedFailuresLegacy int `mapstructure:"allowed_failures"`
 }
 
+// ProfilePriority is the priority of the devices whose sysObjectID matches a pattern, such as
+// 1.3.6.1.4.1.9.1.* for a prefix, when the devices are scheduled by profile priority
+type ProfilePriority struct {
+	SysObjectID string `mapstructure:"sysobjectid"`
+	Priority    int    `mapstructure:"priority"`
+}
+
+// ProfileOIDCount is the number of OIDs collected from the devices whose sysObjectID matches a
+// pattern, such as 1.3.6.1.4.1.9.1.* for a prefix
+type ProfileOIDCount struct {
+	SysObjectID string `mapstructure:"sysobjectid"`
+	OIDCount    int    `mapstructure:"oid_count"`
+}
+
 // Config holds configuration for a particular subnet
 type Config struct {
 	Network                     string          `mapstructure:"network_address"`
@@ -63,9 +128,27 @@ type Config struct {
 	Loader                      string          `mapstructure:"loader"`
 	CollectDeviceMetadataConfig *bool           `mapstructure:"collect_device_metadata"`
 	CollectDeviceMetadata       bool
-	Namespace                   string   `mapstructure:"namespace"`
-	Tags                        []string `mapstructure:"tags"`
-	MinCollectionInterval       uint     `mapstructure:"min_collection_interval"`
+	Namespace                   string             `mapstructure:"namespace"`
+	Tags                        []string           `mapstructure:"tags"`
+	MinCollectionInterval       uint               `mapstructure:"min_collection_interval"`
+	SubnetSource                SubnetSourceConfig `mapstructure:"subnet_source"`
+	AllowedFailures             int                `mapstructure:"discovery_allowed_failures"`
+	HealthCheckInterval         int                `mapstructure:"health_check_interval"`
+	// DiscoveryProbeOIDs are the OIDs a device is probed with to be discovered, tried in order
+	// until one of them answers, for the devices which restrict access to the system subtree
+	DiscoveryProbeOIDs []string `mapstructure:"discovery_probe_oids"`
+	// Seeds are the IPs of the devices whose LLDP and CDP neighbors are discovered, recursively up to
+	// NeighborWalkDepth hops, in addition to or instead of sweeping the network address
+	Seeds             []string `mapstructure:"seeds"`
+	NeighborWalkDepth int      `mapstructure:"neighbor_walk_depth"`
+	// InterfaceCountThreshold is the number of interfaces over which the devices get a longer min collection
+	// interval, unless MinCollectionInterval is set, 0 to disable it. The interval is scaled by
+	// InterfaceCountIntervalFactor, see SuggestedCollectionInterval.
+	InterfaceCountThreshold      int     `mapstructure:"interface_count_threshold"`
+	InterfaceCountIntervalFactor float64 `mapstructure:"interface_count_interval_factor"`
+	// SecretHandles holds the secret handles referenced by the credentials with the ENC[] syntax,
+	// by config key, to resolve them again when the secrets are rotated
+	SecretHandles map[string]string `mapstructure:"-"`
 
 	// Legacy
 	NetworkLegacy      string `mapstructure:"network"`
@@ -79,6 +162,27 @@ type Config struct {
 
 // NewListenerConfig parses configuration and returns a built ListenerConfig
 func NewListenerConfig() (ListenerConfig, error) {
+	return newListenerConfig(coreconfig.Datadog)
+}
+
+// ReloadListenerConfig reads the config file again and returns the ListenerConfig it holds now, so that
+// its configs can be applied without restarting the listener. The file is loaded like the main config at
+// startup, with its defaults, environment variables and secrets.
+func ReloadListenerConfig() (ListenerConfig, error) {
+	path := coreconfig.Datadog.ConfigFileUsed()
+	if path == "" {
+		return ListenerConfig{}, errors.New("no config file to reload")
+	}
+	config := coreconfig.NewConfig("datadog", "DD", strings.NewReplacer(".", "_"))
+	coreconfig.InitConfig(config)
+	config.SetConfigFile(path)
+	if _, err := coreconfig.LoadCustom(config, "datadog.yaml", true); err != nil {
+		return ListenerConfig{}, err
+	}
+	return newListenerConfig(config)
+}
+
+func newListenerConfig(datadogConfig coreconfig.Config) (ListenerConfig, error) {
 	var snmpConfig ListenerConfig
 	opt := viper.DecodeHook(
 		func(rf reflect.Kind, rt reflect.Kind, data interface{}) (interface{}, error) {
@@ -98,18 +202,50 @@ func NewListenerConfig() (ListenerConfig, error) {
 	)
 	// Set defaults before unmarshalling
 	snmpConfig.CollectDeviceMetadata = true
-	if err := coreconfig.Datadog.UnmarshalKey("snmp_listener", &snmpConfig, opt); err != nil {
+	if err := datadogConfig.UnmarshalKey("snmp_listener", &snmpConfig, opt); err != nil {
 		return snmpConfig, err
 	}
 
 	if snmpConfig.AllowedFailures == 0 && snmpConfig.AllowedFailuresLegacy != 0 {
 		snmpConfig.AllowedFailures = snmpConfig.AllowedFailuresLegacy
 	}
+	probeOIDs, err := normalizeProbeOIDs(snmpConfig.DiscoveryProbeOIDs)
+	if err != nil {
+		return snmpConfig, err
+	}
+	snmpConfig.DiscoveryProbeOIDs = probeOIDs
+	switch snmpConfig.DevicePriority {
+	case "":
+		snmpConfig.DevicePriority = DevicePriorityFirstDiscovered
+	case DevicePriorityFirstDiscovered, DevicePriorityLowestIP, DevicePriorityProfile:
+	default:
+		return snmpConfig, fmt.Errorf("invalid device priority %q", snmpConfig.DevicePriority)
+	}
+	if snmpConfig.MaxDevicesPerAgent < 0 {
+		return snmpConfig, fmt.Errorf("invalid max devices per agent %d", snmpConfig.MaxDevicesPerAgent)
+	}
+	if snmpConfig.DiscoveryMemoryBudget < 0 {
+		return snmpConfig, fmt.Errorf("invalid discovery memory budget %d", snmpConfig.DiscoveryMemoryBudget)
+	}
+	if err := validateInterfaceCountSettings(snmpConfig.InterfaceCountThreshold, snmpConfig.InterfaceCountIntervalFactor); err != nil {
+		return snmpConfig, err
+	}
+	for _, profile := range snmpConfig.ProfileOIDCounts {
+		if profile.OIDCount < 0 {
+			return snmpConfig, fmt.Errorf("invalid OID count %d for sysObjectID %q", profile.OIDCount, profile.SysObjectID)
+		}
+	}
+
+	// the secret handles of the credentials are only known from the config file once resolved, the
+	// configs may come from the environment instead so they are matched by key rather than by position
+	rawConfigs := rawConfigsByKey(rawListenerConfigs())
 
 	// Set the default values, we can't otherwise on an array
 	for i := range snmpConfig.Configs {
 		// We need to modify the struct in place
 		config := &snmpConfig.Configs[i]
+		// the key is computed before the defaults are set, as the raw configs don't have them
+		rawConfig := rawConfigs[config.rawConfigKey()]
 		if config.Port == 0 {
 			config.Port = defaultPort
 		}
@@ -128,11 +264,42 @@ func NewListenerConfig() (ListenerConfig, error) {
 			config.Loader = snmpConfig.Loader
 		}
 		if config.Namespace == "" {
-			config.Namespace = coreconfig.Datadog.GetString("network_devices.namespace")
+			config.Namespace = datadogConfig.GetString("network_devices.namespace")
 		}
 		if config.MinCollectionInterval == 0 {
 			config.MinCollectionInterval = snmpConfig.MinCollectionInterval
 		}
+		if config.AllowedFailures == 0 {
+			config.AllowedFailures = snmpConfig.AllowedFailures
+		}
+		if config.HealthCheckInterval == 0 {
+			config.HealthCheckInterval = snmpConfig.HealthCheckInterval
+		}
+		if len(config.DiscoveryProbeOIDs) == 0 {
+			config.DiscoveryProbeOIDs = snmpConfig.DiscoveryProbeOIDs
+		} else if config.DiscoveryProbeOIDs, err = normalizeProbeOIDs(config.DiscoveryProbeOIDs); err != nil {
+			return snmpConfig, fmt.Errorf("network %s: %v", firstNonEmpty(config.Network, config.NetworkLegacy), err)
+		}
+		for _, seed := range config.Seeds {
+			if net.ParseIP(seed) == nil {
+				return snmpConfig, fmt.Errorf("network %s: invalid seed %q", firstNonEmpty(config.Network, config.NetworkLegacy), seed)
+			}
+		}
+		if len(config.Seeds) > 0 && config.NeighborWalkDepth == 0 {
+			config.NeighborWalkDepth = defaultNeighborWalkDepth
+		}
+		if err := validateInterfaceCountSettings(config.InterfaceCountThreshold, config.InterfaceCountIntervalFactor); err != nil {
+			return snmpConfig, fmt.Errorf("network %s: %v", firstNonEmpty(config.Network, config.NetworkLegacy), err)
+		}
+		if config.InterfaceCountThreshold == 0 {
+			config.InterfaceCountThreshold = snmpConfig.InterfaceCountThreshold
+		}
+		if config.InterfaceCountIntervalFactor == 0 {
+			config.InterfaceCountIntervalFactor = snmpConfig.InterfaceCountIntervalFactor
+		}
+		if config.InterfaceCountIntervalFactor == 0 {
+			config.InterfaceCountIntervalFactor = defaultInterfaceCountIntervalFactor
+		}
 		config.Community = firstNonEmpty(config.Community, config.CommunityLegacy)
 		config.AuthKey = firstNonEmpty(config.AuthKey, config.AuthKeyLegacy)
 		config.AuthProtocol = firstNonEmpty(config.AuthProtocol, config.AuthProtocolLegacy)
@@ -140,26 +307,96 @@ func NewListenerConfig() (ListenerConfig, error) {
 		config.PrivProtocol = firstNonEmpty(config.PrivProtocol, config.PrivProtocolLegacy)
 		config.Network = firstNonEmpty(config.Network, config.NetworkLegacy)
 		config.Version = firstNonEmpty(config.Version, config.VersionLegacy)
+		config.loadSecretHandles(rawConfig)
 	}
 	return snmpConfig, nil
 }
 
-// Digest returns an hash value representing the data stored in this configuration, minus the network address
+// ProfilePriority returns the priority of the most specific profile priority pattern matching a
+// sysObjectID, 0 when none matches
+func (c *ListenerConfig) ProfilePriority(sysObjectID string) int {
+	priority, longest := 0, -1
+	for _, profile := range c.ProfilePriorities {
+		if length, matches := matchSysObjectID(profile.SysObjectID, sysObjectID); matches && length > longest {
+			priority, longest = profile.Priority, length
+		}
+	}
+	return priority
+}
+
+// ProfileOIDCount returns the OID count of the most specific profile OID count pattern matching a
+// sysObjectID, and whether one matches
+func (c *ListenerConfig) ProfileOIDCount(sysObjectID string) (int, bool) {
+	count, longest := 0, -1
+	for _, profile := range c.ProfileOIDCounts {
+		if length, matches := matchSysObjectID(profile.SysObjectID, sysObjectID); matches && length > longest {
+			count, longest = profile.OIDCount, length
+		}
+	}
+	return count, longest >= 0
+}
+
+// matchSysObjectID returns whether a sysObjectID matches a pattern, either equal to it or a prefix
+// ending with *, and the length of the pattern to pick the most specific one
+func matchSysObjectID(pattern string, sysObjectID string) (int, bool) {
+	pattern = strings.TrimPrefix(pattern, ".")
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return len(pattern), strings.HasPrefix(sysObjectID, prefix)
+	}
+	return len(pattern), pattern == sysObjectID
+}
+
+// validateInterfaceCountSettings validates the settings of the collection interval suggested from the interface count
+func validateInterfaceCountSettings(threshold int, factor float64) error {
+	if threshold < 0 {
+		return fmt.Errorf("invalid interface count threshold %d", threshold)
+	}
+	if factor < 0 {
+		return fmt.Errorf("invalid interface count interval factor %v", factor)
+	}
+	return nil
+}
+
+// normalizeProbeOIDs validates the discovery probe OIDs and strips their leading dot
+func normalizeProbeOIDs(oids []string) ([]string, error) {
+	normalized := make([]string, 0, len(oids))
+	for _, oid := range oids {
+		if !probeOIDRegex.MatchString(oid) {
+			return nil, fmt.Errorf("invalid discovery probe OID %q", oid)
+		}
+		normalized = append(normalized, strings.TrimPrefix(oid, "."))
+	}
+	return normalized, nil
+}
+
+// Digest returns an hash value representing the data stored in this configuration, minus the network address.
+// The credentials referencing a secret are hashed by handle, so that rotating the secret keeps the digest.
+// The loader and the namespace are part of it, so that the same device gets a distinct entity ID per namespace
+// and switching either of them schedules new check configs in place of the old ones. The default namespace
+// isn't, so that the devices discovered before the namespace was hashed keep their entity ID and cache key.
 func (c *Config) Digest(address string) string {
+	community := c.digestCredential("community_string", c.Community)
+	user := c.digestCredential("user", c.User)
+	authKey := c.digestCredential("authKey", c.AuthKey)
+	privKey := c.digestCredential("privKey", c.PrivKey)
+
 	h := fnv.New64()
 	// Hash write never returns an error
 	h.Write([]byte(address))                   //nolint:errcheck
 	h.Write([]byte(fmt.Sprintf("%d", c.Port))) //nolint:errcheck
 	h.Write([]byte(c.Version))                 //nolint:errcheck
-	h.Write([]byte(c.Community))               //nolint:errcheck
-	h.Write([]byte(c.User))                    //nolint:errcheck
-	h.Write([]byte(c.AuthKey))                 //nolint:errcheck
+	h.Write([]byte(community))                 //nolint:errcheck
+	h.Write([]byte(user))                      //nolint:errcheck
+	h.Write([]byte(authKey))                   //nolint:errcheck
 	h.Write([]byte(c.AuthProtocol))            //nolint:errcheck
-	h.Write([]byte(c.PrivKey))                 //nolint:errcheck
+	h.Write([]byte(privKey))                   //nolint:errcheck
 	h.Write([]byte(c.PrivProtocol))            //nolint:errcheck
 	h.Write([]byte(c.ContextEngineID))         //nolint:errcheck
 	h.Write([]byte(c.ContextName))             //nolint:errcheck
 	h.Write([]byte(c.Loader))                  //nolint:errcheck
+	if c.Namespace != defaultNamespace {
+		h.Write([]byte(c.Namespace)) //nolint:errcheck
+	}
 
 	// Sort the addresses to get a stable digest
 	addresses := make([]string, 0, len(c.IgnoredIPAddresses))
@@ -174,6 +411,25 @@ func (c *Config) Digest(address string) string {
 	return strconv.FormatUint(h.Sum64(), 16)
 }
 
+// Fingerprint returns an hash value representing the whole configuration, to tell whether it changed
+// when the config file is reloaded. The credentials referencing a secret are hashed by handle, so that
+// the fingerprint is the same whether the secrets were resolved or not.
+func (c Config) Fingerprint() string {
+	for key, value := range c.credentials() {
+		*value = c.digestCredential(key, *value)
+	}
+	// the legacy keys and the optional settings were merged into the current ones
+	c.CollectDeviceMetadataConfig = nil
+	c.CommunityLegacy = ""
+	c.AuthKeyLegacy = ""
+	c.PrivKeyLegacy = ""
+
+	h := fnv.New64()
+	// Hash write never returns an error
+	h.Write([]byte(fmt.Sprintf("%#v", c))) //nolint:errcheck
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
 // BuildSNMPParams returns a valid GoSNMP struct to start making queries
 func (c *Config) BuildSNMPParams(deviceIP string) (*gosnmp.GoSNMP, error) {
 	if c.Community == "" && c.User == "" {
@@ -252,6 +508,41 @@ func (c *Config) BuildSNMPParams(deviceIP string) (*gosnmp.GoSNMP, error) {
 	}, nil
 }
 
+// SuggestedCollectionInterval returns the min collection interval suggested for a device with the given
+// number of interfaces, in seconds, 0 to keep the interval of the config. The devices with more interfaces
+// than InterfaceCountThreshold get the default check interval scaled by their interface count over the
+// threshold and by InterfaceCountIntervalFactor, up to MaxSuggestedCollectionInterval. An interval set
+// by the config is never overridden.
+func (c *Config) SuggestedCollectionInterval(interfaceCount int) uint {
+	if c.MinCollectionInterval != 0 || c.InterfaceCountThreshold <= 0 || interfaceCount <= c.InterfaceCountThreshold {
+		return 0
+	}
+	factor := c.InterfaceCountIntervalFactor
+	if factor == 0 {
+		factor = defaultInterfaceCountIntervalFactor
+	}
+	interval := math.Ceil(defaults.DefaultCheckInterval.Seconds() * factor * float64(interfaceCount) / float64(c.InterfaceCountThreshold))
+	if interval > MaxSuggestedCollectionInterval {
+		return MaxSuggestedCollectionInterval
+	}
+	if interval <= defaults.DefaultCheckInterval.Seconds() {
+		// a factor below 1 doesn't make the interval shorter than the default one
+		return 0
+	}
+	return uint(interval)
+}
+
+// SeedIPs returns the IPs of the seed devices of the neighbor walk
+func (c *Config) SeedIPs() []net.IP {
+	ips := make([]net.IP, 0, len(c.Seeds))
+	for _, seed := range c.Seeds {
+		if ip := net.ParseIP(seed); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
 // IsIPIgnored checks the given IP against IgnoredIPAddresses
 func (c *Config) IsIPIgnored(ip net.IP) bool {
 	ipString := ip.String()
@@ -259,6 +550,17 @@ func (c *Config) IsIPIgnored(ip net.IP) bool {
 	return present
 }
 
+// TagsReference returns whether one of the subnet tags references the given discovery fact
+func (c *Config) TagsReference(fact string) bool {
+	template := "%%" + fact + "%%"
+	for _, tag := range c.Tags {
+		if strings.Contains(tag, template) {
+			return true
+		}
+	}
+	return false
+}
+
 func firstNonEmpty(a, b string) string {
 	if a != "" {
 		return a
@@ -6,6 +6,10 @@
 package snmp
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"strings"
 	"testing"
 
@@ -13,6 +17,7 @@ import (
 
 	"github.com/gosnmp/gosnmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildSNMPParams(t *testing.T) {
@@ -196,6 +201,104 @@ snmp_listener:
 	assert.Equal(t, uint(60), conf.Configs[1].MinCollectionInterval)
 }
 
+func Test_HealthCheckConfig(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_allowed_failures: 5
+  health_check_interval: 300
+  configs:
+   - network: 127.1.0.0/30
+     discovery_allowed_failures: 2
+     health_check_interval: 60
+   - network: 127.2.0.0/30
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, conf.Configs[0].AllowedFailures)
+	assert.Equal(t, 60, conf.Configs[0].HealthCheckInterval)
+	assert.Equal(t, 5, conf.Configs[1].AllowedFailures)
+	assert.Equal(t, 300, conf.Configs[1].HealthCheckInterval)
+}
+
+func Test_DiscoveryProbeOIDsConfig(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_probe_oids:
+   - 1.3.6.1.2.1.1.2.0
+   - .1.3.6.1.2.1.2.1.0
+  configs:
+   - network: 127.1.0.0/30
+     discovery_probe_oids: [1.3.6.1.2.1.1.1.0]
+   - network: 127.2.0.0/30
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"1.3.6.1.2.1.1.1.0"}, conf.Configs[0].DiscoveryProbeOIDs)
+	assert.Equal(t, []string{"1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.2.1.0"}, conf.Configs[1].DiscoveryProbeOIDs)
+
+	for _, oid := range []string{"sysObjectID", "1", "1.3.6.1..2", "1.3.6.1.2.", "1.3.6.1.2.1.1.2.0 "} {
+		err = config.Datadog.ReadConfig(strings.NewReader(fmt.Sprintf(`
+snmp_listener:
+  configs:
+   - network: 127.1.0.0/30
+     discovery_probe_oids: ["1.3.6.1.2.1.1.2.0", "%s"]
+`, oid)))
+		assert.NoError(t, err)
+		_, err = NewListenerConfig()
+		assert.EqualError(t, err, fmt.Sprintf("network 127.1.0.0/30: invalid discovery probe OID %q", oid))
+	}
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_probe_oids: [iso.3.6.1]
+`))
+	assert.NoError(t, err)
+	_, err = NewListenerConfig()
+	assert.EqualError(t, err, `invalid discovery probe OID "iso.3.6.1"`)
+}
+
+func Test_NeighborWalkConfig(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - seeds: [10.0.0.1, "fd00::1"]
+   - network: 127.1.0.0/30
+     seeds: [10.0.0.2]
+     neighbor_walk_depth: 5
+   - network: 127.2.0.0/30
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1"}, conf.Configs[0].Seeds)
+	assert.Equal(t, defaultNeighborWalkDepth, conf.Configs[0].NeighborWalkDepth)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, conf.Configs[0].SeedIPs())
+	assert.Equal(t, 5, conf.Configs[1].NeighborWalkDepth)
+	assert.Empty(t, conf.Configs[2].Seeds)
+	assert.Equal(t, 0, conf.Configs[2].NeighborWalkDepth)
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 127.1.0.0/30
+     seeds: [switch-1]
+`))
+	assert.NoError(t, err)
+	_, err = NewListenerConfig()
+	assert.EqualError(t, err, `network 127.1.0.0/30: invalid seed "switch-1"`)
+}
+
 func Test_Configs(t *testing.T) {
 	config.Datadog.SetConfigType("yaml")
 	err := config.Datadog.ReadConfig(strings.NewReader(`
@@ -293,3 +396,411 @@ snmp_listener:
 	networkConf = conf.Configs[0]
 	assert.Equal(t, "hello", networkConf.Namespace)
 }
+
+func TestDigestLoaderAndNamespace(t *testing.T) {
+	config := Config{
+		Network:   "127.1.0.0/30",
+		Community: "public",
+		Loader:    "core",
+		Namespace: "default",
+	}
+	digest := config.Digest("127.1.0.1")
+	assert.Equal(t, digest, config.Digest("127.1.0.1"))
+
+	// the same device in another namespace is another entity
+	otherNamespace := config
+	otherNamespace.Namespace = "org-2"
+	assert.NotEqual(t, digest, otherNamespace.Digest("127.1.0.1"))
+
+	otherLoader := config
+	otherLoader.Loader = "python"
+	assert.NotEqual(t, digest, otherLoader.Digest("127.1.0.1"))
+	assert.NotEqual(t, otherNamespace.Digest("127.1.0.1"), otherLoader.Digest("127.1.0.1"))
+
+	// the devices in the default namespace keep the digest they had before the namespace was hashed
+	noNamespace := config
+	noNamespace.Namespace = ""
+	assert.Equal(t, digest, noNamespace.Digest("127.1.0.1"))
+}
+
+func TestFingerprint(t *testing.T) {
+	collectDeviceMetadata := true
+	config := Config{
+		Network:                     "127.1.0.0/30",
+		Community:                   "ENC[snmp_community]",
+		CollectDeviceMetadataConfig: &collectDeviceMetadata,
+		SecretHandles:               map[string]string{"community_string": "snmp_community"},
+	}
+	fingerprint := config.Fingerprint()
+	assert.Equal(t, "ENC[snmp_community]", config.Community)
+
+	// the fingerprint is the same once the secrets are resolved
+	resolved := config
+	resolved.Community = "public"
+	resolved.CommunityLegacy = "public"
+	resolved.CollectDeviceMetadataConfig = new(bool)
+	assert.Equal(t, fingerprint, resolved.Fingerprint())
+
+	// the settings missing from the digest are part of it
+	healthChecked := config
+	healthChecked.HealthCheckInterval = 60
+	assert.NotEqual(t, fingerprint, healthChecked.Fingerprint())
+	assert.Equal(t, config.Digest("127.1.0.1"), healthChecked.Digest("127.1.0.1"))
+}
+
+func TestReloadListenerConfig(t *testing.T) {
+	defer config.Datadog.SetConfigFile("")
+	file, err := ioutil.TempFile(t.TempDir(), "datadog*.yaml")
+	require.NoError(t, err)
+	_, err = file.WriteString(`
+snmp_listener:
+  config_reload_interval: 60
+  configs:
+   - network: 127.0.0.1/30
+     community_string: ENC[snmp_community]
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	config.Datadog.SetConfigFile(file.Name())
+
+	conf, err := ReloadListenerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 60, conf.ConfigReloadInterval)
+	require.Len(t, conf.Configs, 1)
+	assert.Equal(t, "127.0.0.1/30", conf.Configs[0].Network)
+	assert.Equal(t, uint16(161), conf.Configs[0].Port)
+	// the file is loaded with the defaults and the environment variables, like at startup
+	assert.Equal(t, "default", conf.Configs[0].Namespace)
+	os.Setenv("DD_NETWORK_DEVICES_NAMESPACE", "reloaded")
+	defer os.Unsetenv("DD_NETWORK_DEVICES_NAMESPACE")
+	conf, err = ReloadListenerConfig()
+	require.NoError(t, err)
+	require.Len(t, conf.Configs, 1)
+	assert.Equal(t, "reloaded", conf.Configs[0].Namespace)
+	// without a secret backend, the secrets are resolved by the listener
+	assert.Equal(t, "ENC[snmp_community]", conf.Configs[0].Community)
+	assert.Equal(t, map[string]string{"community_string": "snmp_community"}, conf.Configs[0].SecretHandles)
+}
+
+func TestTagsReference(t *testing.T) {
+	config := Config{
+		Tags: []string{"site:paris", "sys_name:%%sysName%%"},
+	}
+	assert.True(t, config.TagsReference("sysName"))
+	assert.False(t, config.TagsReference("subnet"))
+}
+
+func TestNewListenerConfigSecretHandles(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 127.0.0.1/30
+     community_string: ENC[snmp_community]
+   - network: 127.0.0.2/30
+     user: admin
+     authentication_key: ENC[snmp_auth]
+     privKey: ENC[snmp_priv]
+   - network: 127.0.0.3/30
+     community_string: public
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"community_string": "snmp_community"}, conf.Configs[0].SecretHandles)
+	assert.Equal(t, map[string]string{"authKey": "snmp_auth", "privKey": "snmp_priv"}, conf.Configs[1].SecretHandles)
+	assert.Nil(t, conf.Configs[2].SecretHandles)
+}
+
+func TestNewListenerConfigResolvedSecretHandles(t *testing.T) {
+	// the secrets of the config file were resolved when the config was loaded
+	defer func(previous func() []map[string]interface{}) { rawListenerConfigs = previous }(rawListenerConfigs)
+	rawListenerConfigs = func() []map[string]interface{} {
+		return []map[string]interface{}{{"network": "127.0.0.1/30", "community": "ENC[snmp_community]"}}
+	}
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 127.0.0.1/30
+     community: resolved
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "resolved", conf.Configs[0].Community)
+	assert.Equal(t, map[string]string{"community_string": "snmp_community"}, conf.Configs[0].SecretHandles)
+}
+
+func TestNewListenerConfigSecretHandlesMatchedByKey(t *testing.T) {
+	// the configs don't match the ones of the config file by position, such as when they come from
+	// the environment
+	defer func(previous func() []map[string]interface{}) { rawListenerConfigs = previous }(rawListenerConfigs)
+	rawListenerConfigs = func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"network": "10.0.0.0/30", "community": "ENC[community_a]"},
+			{"network_address": "127.0.0.1/30", "port": 1161, "community_string": "ENC[community_b]"},
+			{"network": "172.16.0.0/30", "community": "ENC[community_c]"},
+			{"network": "172.16.0.0/30", "community": "ENC[community_d]"},
+		}
+	}
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 192.168.0.0/30
+     community: ENC[community_e]
+   - network_address: 127.0.0.1/30
+     port: 1161
+     community_string: resolved_b
+   - network: 10.0.0.0/30
+     community: resolved_a
+   - network: 172.16.0.0/30
+     community: resolved_c
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"community_string": "community_e"}, conf.Configs[0].SecretHandles)
+	assert.Equal(t, map[string]string{"community_string": "community_b"}, conf.Configs[1].SecretHandles)
+	assert.Equal(t, map[string]string{"community_string": "community_a"}, conf.Configs[2].SecretHandles)
+	// the raw configs sharing their key can't be told apart
+	assert.Nil(t, conf.Configs[3].SecretHandles)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	secrets := map[string]string{"snmp_auth": "auth-1", "snmp_priv": "priv-1"}
+	var resolveErr error
+	resolve := func(handles []string, origin string) (map[string]string, error) {
+		assert.Equal(t, []string{"snmp_auth", "snmp_priv"}, handles)
+		assert.Equal(t, "snmp_listener", origin)
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		return secrets, nil
+	}
+	c := Config{
+		User:          "admin",
+		AuthKey:       "ENC[snmp_auth]",
+		PrivKey:       "ENC[snmp_priv]",
+		SecretHandles: map[string]string{"authKey": "snmp_auth", "privKey": "snmp_priv"},
+	}
+
+	changed, err := c.ResolveSecrets(resolve)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "auth-1", c.AuthKey)
+	assert.Equal(t, "priv-1", c.PrivKey)
+	digest := c.Digest("127.0.0.1")
+
+	changed, err = c.ResolveSecrets(resolve)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// a rotated secret changes the credential but not the digest
+	secrets["snmp_priv"] = "priv-2"
+	changed, err = c.ResolveSecrets(resolve)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "priv-2", c.PrivKey)
+	assert.Equal(t, digest, c.Digest("127.0.0.1"))
+
+	// the previous credentials are kept when the secrets can't be resolved
+	resolveErr = fmt.Errorf("backend unavailable")
+	_, err = c.ResolveSecrets(resolve)
+	assert.Error(t, err)
+	assert.Equal(t, "priv-2", c.PrivKey)
+
+	resolveErr = nil
+	delete(secrets, "snmp_auth")
+	_, err = c.ResolveSecrets(resolve)
+	assert.Error(t, err)
+	assert.Equal(t, "auth-1", c.AuthKey)
+}
+
+func TestNewListenerConfigDevicePriority(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  max_devices_per_agent: 500
+  device_priority: profile_priority
+  profile_priorities:
+   - sysobjectid: 1.3.6.1.4.1.9.*
+     priority: 10
+   - sysobjectid: 1.3.6.1.4.1.9.1.1745
+     priority: 20
+  configs:
+   - network: 127.0.0.1/30
+     community_string: public
+`))
+	require.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 500, conf.MaxDevicesPerAgent)
+	assert.Equal(t, DevicePriorityProfile, conf.DevicePriority)
+	assert.Equal(t, 20, conf.ProfilePriority("1.3.6.1.4.1.9.1.1745"))
+	assert.Equal(t, 10, conf.ProfilePriority("1.3.6.1.4.1.9.1.1746"))
+	assert.Equal(t, 0, conf.ProfilePriority("1.3.6.1.4.1.2636.1.1.1.2.21"))
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 127.0.0.1/30
+     community_string: public
+`))
+	require.NoError(t, err)
+	conf, err = NewListenerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 0, conf.MaxDevicesPerAgent)
+	assert.Equal(t, DevicePriorityFirstDiscovered, conf.DevicePriority)
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  device_priority: random
+`))
+	require.NoError(t, err)
+	_, err = NewListenerConfig()
+	assert.Error(t, err)
+}
+
+func TestNewListenerConfigDiscoveryMemoryBudget(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_memory_budget: 67108864
+  configs:
+   - network: 127.0.0.1/30
+     community_string: public
+`))
+	require.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), conf.DiscoveryMemoryBudget)
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_memory_budget: -1
+`))
+	require.NoError(t, err)
+	_, err = NewListenerConfig()
+	assert.Error(t, err)
+}
+
+func TestNewListenerConfigDeviceLatency(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  discovery_device_latency: true
+  configs:
+   - network: 127.0.0.1/30
+     community_string: public
+`))
+	require.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	require.NoError(t, err)
+	assert.True(t, conf.DeviceLatency)
+}
+
+func TestNewListenerConfigProfileOIDCounts(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  profile_oid_counts:
+   - sysobjectid: 1.3.6.1.4.1.9.*
+     oid_count: 150
+   - sysobjectid: .1.3.6.1.4.1.9.1.1745
+     oid_count: 600
+  configs:
+   - network: 127.0.0.1/30
+     community_string: public
+`))
+	require.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	require.NoError(t, err)
+	for sysObjectID, expected := range map[string]int{
+		"1.3.6.1.4.1.9.1.1745": 600,
+		"1.3.6.1.4.1.9.1.1746": 150,
+	} {
+		count, found := conf.ProfileOIDCount(sysObjectID)
+		assert.True(t, found, sysObjectID)
+		assert.Equal(t, expected, count, sysObjectID)
+	}
+	for _, sysObjectID := range []string{"1.3.6.1.4.1.2636.1.1.1.2.21", ""} {
+		_, found := conf.ProfileOIDCount(sysObjectID)
+		assert.False(t, found, sysObjectID)
+	}
+
+	err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  profile_oid_counts:
+   - sysobjectid: 1.3.6.1.4.1.9.*
+     oid_count: -1
+`))
+	require.NoError(t, err)
+	_, err = NewListenerConfig()
+	assert.Error(t, err)
+}
+
+func TestNewListenerConfigInterfaceCount(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  interface_count_threshold: 1000
+  configs:
+   - network: 127.1.0.0/30
+     interface_count_threshold: 500
+     interface_count_interval_factor: 2
+   - network: 127.2.0.0/30
+`))
+	require.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 500, conf.Configs[0].InterfaceCountThreshold)
+	assert.Equal(t, 2.0, conf.Configs[0].InterfaceCountIntervalFactor)
+	assert.Equal(t, 1000, conf.Configs[1].InterfaceCountThreshold)
+	assert.Equal(t, 1.0, conf.Configs[1].InterfaceCountIntervalFactor)
+
+	for _, invalid := range []string{"interface_count_threshold: -1", "interface_count_interval_factor: -2"} {
+		err = config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network: 127.1.0.0/30
+     ` + invalid + `
+`))
+		require.NoError(t, err)
+		_, err = NewListenerConfig()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSuggestedCollectionInterval(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		config         Config
+		interfaceCount int
+		expected       uint
+	}{
+		{"disabled", Config{}, 5000, 0},
+		{"unknown interface count", Config{InterfaceCountThreshold: 1000}, 0, 0},
+		{"under the threshold", Config{InterfaceCountThreshold: 1000}, 999, 0},
+		{"at the threshold", Config{InterfaceCountThreshold: 1000}, 1000, 0},
+		{"just over the threshold", Config{InterfaceCountThreshold: 1000}, 1001, 16},
+		{"twice the threshold", Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 1}, 2000, 30},
+		{"scaled by the factor", Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 2}, 2000, 60},
+		{"factor keeping the default interval", Config{InterfaceCountThreshold: 1000, InterfaceCountIntervalFactor: 0.5}, 2000, 0},
+		{"capped", Config{InterfaceCountThreshold: 10}, 1000000, MaxSuggestedCollectionInterval},
+		{"explicit interval", Config{InterfaceCountThreshold: 1000, MinCollectionInterval: 20}, 5000, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.config.SuggestedCollectionInterval(test.interfaceCount))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package snmp
+
+import (
+	"context"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/ec2"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// StaticSubnetSource is the type of the source scanning the configured network address
+	StaticSubnetSource = "static"
+	// AWSSubnetSource is the type of the source scanning the VPC subnets matching tags
+	AWSSubnetSource = "aws"
+
+	defaultSubnetRefreshInterval = 600
+)
+
+// SubnetSourceConfig holds the configuration of the source of the networks to scan
+type SubnetSourceConfig struct {
+	Type            string            `mapstructure:"type"`
+	Tags            map[string]string `mapstructure:"tags"`
+	RefreshInterval int               `mapstructure:"refresh_interval"`
+}
+
+// SubnetSource provides the networks to scan for a subnet configuration
+type SubnetSource interface {
+	// Networks returns the CIDRs of the networks to scan
+	Networks(ctx context.Context) []string
+	// RefreshInterval returns how often the networks should be listed again, 0 if they never change
+	RefreshInterval() time.Duration
+}
+
+// subnetSourceFactories maps a source type to its constructor, sources for other cloud providers
+// only need to be registered here
+var subnetSourceFactories = map[string]func(config Config) SubnetSource{
+	StaticSubnetSource: newStaticSubnetSource,
+	AWSSubnetSource:    newAWSSubnetSource,
+}
+
+// NewSubnetSource returns the source of the networks to scan for this configuration,
+// defaulting to the static network address when no or an unknown source is configured
+func (c *Config) NewSubnetSource() SubnetSource {
+	sourceType := c.SubnetSource.Type
+	if sourceType == "" {
+		sourceType = StaticSubnetSource
+	}
+	factory, found := subnetSourceFactories[sourceType]
+	if !found {
+		log.Errorf("Unknown SNMP subnet source %q, using the static network address %q", sourceType, c.Network)
+		factory = newStaticSubnetSource
+	}
+	return factory(*c)
+}
+
+// staticSubnetSource always returns the configured network address
+type staticSubnetSource struct {
+	networks []string
+}
+
+func newStaticSubnetSource(config Config) SubnetSource {
+	if config.Network == "" && len(config.Seeds) > 0 {
+		// only the neighbors of the seeds are discovered
+		return &staticSubnetSource{}
+	}
+	return &staticSubnetSource{networks: []string{config.Network}}
+}
+
+func (s *staticSubnetSource) Networks(context.Context) []string {
+	return s.networks
+}
+
+func (s *staticSubnetSource) RefreshInterval() time.Duration {
+	return 0
+}
+
+// awsSubnetSource lists the VPC subnets carrying the configured tags
+type awsSubnetSource struct {
+	tags            map[string]string
+	refreshInterval time.Duration
+	// fallback is the static network address, if any
+	fallback SubnetSource
+}
+
+// getSubnetsByTags is overridden in tests
+var getSubnetsByTags = ec2.GetSubnetsByTags
+
+func newAWSSubnetSource(config Config) SubnetSource {
+	refreshInterval := config.SubnetSource.RefreshInterval
+	if refreshInterval <= 0 {
+		refreshInterval = defaultSubnetRefreshInterval
+	}
+	source := &awsSubnetSource{
+		tags:            config.SubnetSource.Tags,
+		refreshInterval: time.Duration(refreshInterval) * time.Second,
+	}
+	if config.Network != "" {
+		source.fallback = newStaticSubnetSource(config)
+	}
+	return source
+}
+
+// Networks returns the CIDRs of the matching subnets, or the static network address if they can't be listed
+func (s *awsSubnetSource) Networks(ctx context.Context) []string {
+	subnets, err := getSubnetsByTags(ctx, s.tags)
+	if err != nil {
+		var fallback []string
+		if s.fallback != nil {
+			fallback = s.fallback.Networks(ctx)
+		}
+		log.Warnf("Unable to list the AWS VPC subnets matching %v, check the credentials and the ec2:DescribeSubnets permission of the instance role, falling back to the static networks %v: %s", s.tags, fallback, err)
+		return fallback
+	}
+	networks := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		networks = append(networks, subnet.Cidr)
+	}
+	log.Debugf("Found %d AWS VPC subnets matching %v: %v", len(networks), s.tags, networks)
+	return networks
+}
+
+func (s *awsSubnetSource) RefreshInterval() time.Duration {
+	return s.refreshInterval
+}
@@ -0,0 +1,107 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2020-present Datadog, Inc.
+
+package snmp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/ec2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SubnetSourceConfig(t *testing.T) {
+	config.Datadog.SetConfigType("yaml")
+	err := config.Datadog.ReadConfig(strings.NewReader(`
+snmp_listener:
+  configs:
+   - network_address: 127.1.0.0/30
+   - network_address: 127.2.0.0/30
+     subnet_source:
+       type: aws
+       refresh_interval: 120
+       tags:
+         monitoring: snmp
+`))
+	assert.NoError(t, err)
+
+	conf, err := NewListenerConfig()
+	assert.NoError(t, err)
+
+	assert.Equal(t, SubnetSourceConfig{}, conf.Configs[0].SubnetSource)
+	assert.Equal(t, SubnetSourceConfig{
+		Type:            "aws",
+		RefreshInterval: 120,
+		Tags:            map[string]string{"monitoring": "snmp"},
+	}, conf.Configs[1].SubnetSource)
+}
+
+func TestStaticSubnetSource(t *testing.T) {
+	for _, sourceType := range []string{"", "static", "unknown"} {
+		c := Config{Network: "127.1.0.0/30", SubnetSource: SubnetSourceConfig{Type: sourceType}}
+		source := c.NewSubnetSource()
+		assert.Equal(t, []string{"127.1.0.0/30"}, source.Networks(context.Background()))
+		assert.Equal(t, time.Duration(0), source.RefreshInterval())
+	}
+}
+
+func TestStaticSubnetSourceSeedsOnly(t *testing.T) {
+	c := Config{Seeds: []string{"10.0.0.1"}}
+	assert.Empty(t, c.NewSubnetSource().Networks(context.Background()))
+
+	c.Network = "127.1.0.0/30"
+	assert.Equal(t, []string{"127.1.0.0/30"}, c.NewSubnetSource().Networks(context.Background()))
+}
+
+func TestAWSSubnetSource(t *testing.T) {
+	defer func() { getSubnetsByTags = ec2.GetSubnetsByTags }()
+
+	var requestedTags map[string]string
+	getSubnetsByTags = func(ctx context.Context, tags map[string]string) ([]ec2.Subnet, error) {
+		requestedTags = tags
+		return []ec2.Subnet{
+			{ID: "subnet-1", Cidr: "10.0.1.0/24"},
+			{ID: "subnet-2", Cidr: "10.0.2.0/24"},
+		}, nil
+	}
+
+	c := Config{
+		Network: "127.1.0.0/30",
+		SubnetSource: SubnetSourceConfig{
+			Type: "aws",
+			Tags: map[string]string{"monitoring": "snmp"},
+		},
+	}
+	source := c.NewSubnetSource()
+	assert.Equal(t, []string{"10.0.1.0/24", "10.0.2.0/24"}, source.Networks(context.Background()))
+	assert.Equal(t, map[string]string{"monitoring": "snmp"}, requestedTags)
+	assert.Equal(t, defaultSubnetRefreshInterval*time.Second, source.RefreshInterval())
+
+	c.SubnetSource.RefreshInterval = 60
+	assert.Equal(t, 60*time.Second, c.NewSubnetSource().RefreshInterval())
+}
+
+func TestAWSSubnetSourceFallback(t *testing.T) {
+	defer func() { getSubnetsByTags = ec2.GetSubnetsByTags }()
+
+	getSubnetsByTags = func(ctx context.Context, tags map[string]string) ([]ec2.Subnet, error) {
+		return nil, errors.New("UnauthorizedOperation: You are not authorized to perform this operation")
+	}
+
+	c := Config{
+		Network:      "127.1.0.0/30",
+		SubnetSource: SubnetSourceConfig{Type: "aws"},
+	}
+	assert.Equal(t, []string{"127.1.0.0/30"}, c.NewSubnetSource().Networks(context.Background()))
+
+	c.Network = ""
+	assert.Empty(t, c.NewSubnetSource().Networks(context.Background()))
+}
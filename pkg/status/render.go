@@ -49,6 +49,7 @@ func FormatStatus(data []byte) (string, error) {
 	inventoriesStats := stats["inventories"]
 	systemProbeStats := stats["systemProbeStats"]
 	snmpTrapsStats := stats["snmpTrapsStats"]
+	snmpDiscoveryStats, _ := stats["snmpDiscoveryStats"].([]interface{})
 	title := fmt.Sprintf("Agent (v%s)", stats["version"])
 	stats["title"] = title
 	renderStatusTemplate(b, "/header.tmpl", stats)
@@ -69,6 +70,9 @@ func FormatStatus(data []byte) (string, error) {
 	if traps.IsEnabled() {
 		renderStatusTemplate(b, "/snmp-traps.tmpl", snmpTrapsStats)
 	}
+	if len(snmpDiscoveryStats) > 0 {
+		renderStatusTemplate(b, "/snmp-discovery.tmpl", snmpDiscoveryStats)
+	}
 	if config.IsContainerized() {
 		renderAutodiscoveryStats(b, stats["adEnabledFeatures"], stats["adConfigErrors"], stats["filterErrors"])
 	}
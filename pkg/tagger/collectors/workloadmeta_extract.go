@@ -118,7 +118,7 @@ func (c *WorkloadMetaCollector) handleKubePod(ev workloadmeta.Event) []*TagInfo
 		StandardTags:         standard,
 	})
 
-	for _, containerID := range pod.Containers {
+	for _, containerID := range pod.AllContainers() {
 		container, err := c.store.GetContainer(containerID)
 		if err != nil {
 			log.Debugf("pod %q has reference to non-existing container %q", pod.Name, containerID)
@@ -63,7 +63,11 @@ func (c *WorkloadMetaCollector) Stream() error {
 	const name = "tagger-workloadmeta"
 	health := health.RegisterLiveness(name)
 
-	ch := c.store.Subscribe(name, nil)
+	// the images aren't tagged, only the workloads using them
+	ch := c.store.Subscribe(name, workloadmeta.NewFilter(
+		[]workloadmeta.Kind{workloadmeta.KindContainer, workloadmeta.KindKubernetesPod, workloadmeta.KindECSTask},
+		nil,
+	))
 
 	for {
 		select {
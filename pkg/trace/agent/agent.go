@@ -57,6 +57,14 @@ type Agent struct {
 	// In takes incoming payloads to be processed by the agent.
 	In chan *api.Payload
 
+	// SampleTrace, when set, is called on the traces kept by the samplers and
+	// may drop them. Stats are still computed on the dropped traces.
+	SampleTrace func(root *pb.Span, t pb.Trace) bool
+
+	// ModifySpan, when set, is called on every span after it has been normalized
+	// and obfuscated, before it is truncated and sampled.
+	ModifySpan func(*pb.Span)
+
 	// config
 	conf *config.AgentConfig
 
@@ -227,6 +235,9 @@ func (a *Agent) Process(p *api.Payload) {
 				traceutil.SetMeta(span, k, v)
 			}
 			a.obfuscator.Obfuscate(span)
+			if a.ModifySpan != nil {
+				a.ModifySpan(span)
+			}
 			Truncate(span)
 			if p.ClientComputedTopLevel {
 				traceutil.UpdateTracerTopLevel(span)
@@ -267,6 +278,9 @@ func (a *Agent) Process(p *api.Payload) {
 		}
 
 		events, keep := a.sample(ts, pt)
+		if keep && a.SampleTrace != nil {
+			keep = a.SampleTrace(pt.Root, pt.Trace)
+		}
 		if !p.ClientComputedStats {
 			if envtraces == nil {
 				envtraces = make([]stats.EnvTrace, 0, len(p.Traces))
@@ -278,7 +278,7 @@ func (c *AgentConfig) acquireHostnameFallback() error {
 func (c *AgentConfig) NewHTTPClient() *http.Client {
 	return &http.Client{
 		Timeout:   10 * time.Second,
-		Transport: c.NewHTTPTransport(),
+		Transport: httputils.WithProxyErrors(c.NewHTTPTransport()),
 	}
 }
 
@@ -138,8 +138,11 @@ type sender struct {
 	inflight int32         // inflight payloads
 	attempt  int32         // active retry attempt
 
-	mu     sync.RWMutex // guards closed
-	closed bool         // closed reports if the loop is stopped
+	mu           sync.RWMutex // guards closed and retryHandler
+	closed       bool         // closed reports if the loop is stopped
+	retryHandler RetryHandler // retryHandler receives the payloads failing with a retriable error, if set
+
+	apiKey atomic.Value // the API key of the requests, cfg.apiKey until it is updated
 }
 
 // newSender returns a new sender based on the given config cfg.
@@ -149,10 +152,43 @@ func newSender(cfg *senderConfig) *sender {
 		queue:  make(chan *payload, cfg.maxQueued),
 		climit: make(chan struct{}, cfg.maxConns),
 	}
+	s.apiKey.Store(cfg.apiKey)
 	go s.loop()
 	return &s
 }
 
+// updateAPIKey replaces the API key of the sender if it is oldKey, such as when the key was resolved
+// again after it changed.
+func (s *sender) updateAPIKey(oldKey, newKey string) {
+	if s.apiKey.Load().(string) == oldKey {
+		s.apiKey.Store(newKey)
+	}
+}
+
+// updateSendersAPIKey replaces the API key of the senders using oldKey.
+func updateSendersAPIKey(senders []*sender, oldKey, newKey string) {
+	for _, s := range senders {
+		s.updateAPIKey(oldKey, newKey)
+	}
+}
+
+// setSendersRetryHandler sets the handler receiving the payloads of the senders failing with a
+// retriable error, instead of retrying them.
+func setSendersRetryHandler(senders []*sender, handler RetryHandler) {
+	for _, s := range senders {
+		s.mu.Lock()
+		s.retryHandler = handler
+		s.mu.Unlock()
+	}
+}
+
+// hasRetryHandler reports whether the payloads failing with a retriable error are handed to a handler.
+func (s *sender) hasRetryHandler() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.retryHandler != nil
+}
+
 // loop runs the main sender loop.
 func (s *sender) loop() {
 	for p := range s.queue {
@@ -216,6 +252,7 @@ func (s *sender) Push(p *payload) {
 			select {
 			case p := <-s.queue:
 				s.releasePayload(p, eventTypeDropped, &eventData{
+					host:  s.cfg.url.Host,
 					bytes: p.body.Len(),
 					count: 1,
 				})
@@ -238,12 +275,13 @@ func (s *sender) sendPayload(p *payload) {
 	start := time.Now()
 	err = s.do(req)
 	stats := &eventData{
+		host:     s.cfg.url.Host,
 		bytes:    p.body.Len(),
 		count:    1,
 		duration: time.Since(start),
 		err:      err,
 	}
-	switch err.(type) {
+	switch e := err.(type) {
 	case *retriableError:
 		// request failed again, but can be retried
 		s.mu.RLock()
@@ -252,6 +290,14 @@ func (s *sender) sendPayload(p *payload) {
 			// sender is stopped
 			return
 		}
+		if s.retryHandler != nil {
+			// the handler retries the payload later, the sender doesn't back off
+			atomic.AddInt32(&p.retries, 1)
+			s.recordEvent(eventTypeRetry, stats)
+			atomic.AddInt32(&s.inflight, -1)
+			s.retryHandler(&FailedPayload{sender: s, payload: p, retryAfter: e.retryAfter})
+			return
+		}
 		atomic.AddInt32(&s.attempt, 1)
 
 		if r := atomic.AddInt32(&p.retries, 1); (r&(r-1)) == 0 && r > 3 {
@@ -285,6 +331,52 @@ func (s *sender) sendPayload(p *payload) {
 	}
 }
 
+// EndpointStats counts the payloads sent to an endpoint, and the ones which were rejected or dropped.
+type EndpointStats struct {
+	Sent   int64
+	Errors int64
+}
+
+// endpointStats accumulates the EndpointStats of each endpoint, by host. The zero value is ready to use.
+type endpointStats struct {
+	mu    sync.Mutex
+	stats map[string]*EndpointStats
+}
+
+// record counts the payload of a sender event, the retries are only counted once they are sent or dropped
+func (e *endpointStats) record(t eventType, data *eventData) {
+	if data == nil || data.host == "" || (t != eventTypeSent && t != eventTypeRejected && t != eventTypeDropped) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stats == nil {
+		e.stats = make(map[string]*EndpointStats)
+	}
+	stats, found := e.stats[data.host]
+	if !found {
+		stats = &EndpointStats{}
+		e.stats[data.host] = stats
+	}
+	if t == eventTypeSent {
+		stats.Sent += int64(data.count)
+	} else {
+		stats.Errors += int64(data.count)
+	}
+}
+
+// take returns the stats of each endpoint since the previous call, and resets them
+func (e *endpointStats) take() map[string]EndpointStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := make(map[string]EndpointStats, len(e.stats))
+	for host, s := range e.stats {
+		stats[host] = *s
+	}
+	e.stats = nil
+	return stats
+}
+
 // waitForSenders blocks until all senders have sent their inflight payloads
 func waitForSenders(senders []*sender) {
 	var wg sync.WaitGroup
@@ -322,7 +414,11 @@ func (s *sender) recordEvent(t eventType, data *eventData) {
 var userAgent = fmt.Sprintf("Datadog Trace Agent/%s/%s", info.Version, info.GitCommit)
 
 // retriableError is an error returned by the server which may be retried at a later time.
-type retriableError struct{ err error }
+type retriableError struct {
+	err error
+	// retryAfter is the delay the server asked to wait before retrying, 0 if none
+	retryAfter time.Duration
+}
 
 // Error implements error.
 func (e retriableError) Error() string { return e.err.Error() }
@@ -333,13 +429,13 @@ const (
 )
 
 func (s *sender) do(req *http.Request) error {
-	req.Header.Set(headerAPIKey, s.cfg.apiKey)
+	req.Header.Set(headerAPIKey, s.apiKey.Load().(string))
 	req.Header.Set(headerUserAgent, userAgent)
 	resp, err := s.cfg.client.Do(req)
 	if err != nil {
 		// request errors include timeouts or name resolution errors and
 		// should thus be retried.
-		return &retriableError{err}
+		return &retriableError{err: err}
 	}
 	// From https://golang.org/pkg/net/http/#Response:
 	// The default HTTP client's Transport may not reuse HTTP/1.x "keep-alive"
@@ -347,9 +443,11 @@ func (s *sender) do(req *http.Request) error {
 	io.Copy(ioutil.Discard, resp.Body)
 	resp.Body.Close()
 
-	if isRetriable(resp.StatusCode) {
+	// the rate limited payloads are only retried by a retry handler, which can wait as asked
+	if isRetriable(resp.StatusCode) || (resp.StatusCode == http.StatusTooManyRequests && s.hasRetryHandler()) {
 		return &retriableError{
-			fmt.Errorf("server responded with %q", resp.Status),
+			err:        fmt.Errorf("server responded with %q", resp.Status),
+			retryAfter: httputils.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
 		}
 	}
 	if resp.StatusCode/100 != 2 {
@@ -369,6 +467,56 @@ func isRetriable(code int) bool {
 	return code/100 == 5
 }
 
+// RetryHandler receives the payloads which failed to be sent with a retriable error. It must not block.
+type RetryHandler func(p *FailedPayload)
+
+// FailedPayload is a payload which failed to be sent with a retriable error, handed to the retry
+// handler of its writer instead of being retried by the sender. It must be either retried or dropped.
+type FailedPayload struct {
+	sender     *sender
+	payload    *payload
+	retryAfter time.Duration
+}
+
+// Size returns the size of the payload in bytes.
+func (p *FailedPayload) Size() int {
+	return p.payload.body.Len()
+}
+
+// Attempts returns the number of times the payload failed to be sent.
+func (p *FailedPayload) Attempts() int {
+	return int(atomic.LoadInt32(&p.payload.retries))
+}
+
+// RetryAfter returns the delay the intake asked to wait before sending the payload again, 0 if none.
+func (p *FailedPayload) RetryAfter() time.Duration {
+	return p.retryAfter
+}
+
+// Retry sends the payload again and waits for it to be sent. If it fails again, it is handed to
+// the retry handler again.
+func (p *FailedPayload) Retry() {
+	s := p.sender
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		p.Drop()
+		return
+	}
+	s.Push(p.payload)
+	s.WaitForInflight()
+}
+
+// Drop drops the payload, counted as dropped by its writer.
+func (p *FailedPayload) Drop() {
+	p.sender.recordEvent(eventTypeDropped, &eventData{
+		bytes: p.payload.body.Len(),
+		count: 1,
+	})
+	ppool.Put(p.payload)
+}
+
 // payloads specifies a payload to be sent by the sender.
 type payload struct {
 	body    *bytes.Buffer     // request body
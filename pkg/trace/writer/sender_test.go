@@ -15,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -257,6 +258,45 @@ func TestSender(t *testing.T) {
 			assert.True(time.Since(start)-failed[i].duration < time.Second)
 		}
 	})
+
+	t.Run("retry handler", func(t *testing.T) {
+		assert := assert.New(t)
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		var recorder mockRecorder
+		cfg := testSenderConfig(server.URL)
+		cfg.recorder = &recorder
+		s := newSender(cfg)
+		failed := make(chan *FailedPayload, 1)
+		setSendersRetryHandler([]*sender{s}, func(p *FailedPayload) { failed <- p })
+
+		// the rate limited payload is handed to the handler instead of being retried by the sender
+		p := newPayload(nil)
+		p.body.WriteString("traces")
+		s.Push(p)
+		retried := <-failed
+		s.WaitForInflight()
+		assert.Equal(int32(1), atomic.LoadInt32(&attempts))
+		assert.Equal(30*time.Second, retried.RetryAfter())
+		assert.Equal(1, retried.Attempts())
+		assert.Equal(len("traces"), retried.Size())
+		assert.Len(recorder.data(eventTypeRetry), 1)
+
+		retried.Retry()
+		assert.Equal(int32(2), atomic.LoadInt32(&attempts))
+		assert.Len(recorder.data(eventTypeSent), 1)
+		assert.Empty(failed)
+		s.Stop()
+	})
 }
 
 func TestPayload(t *testing.T) {
@@ -301,6 +341,23 @@ func TestPayload(t *testing.T) {
 	})
 }
 
+func TestEndpointStats(t *testing.T) {
+	assert := assert.New(t)
+	var stats endpointStats
+	stats.record(eventTypeSent, &eventData{host: "trace.agent.datadoghq.com", count: 1})
+	stats.record(eventTypeSent, &eventData{host: "trace.agent.datadoghq.com", count: 1})
+	stats.record(eventTypeRetry, &eventData{host: "trace.agent.datadoghq.eu", count: 1})
+	stats.record(eventTypeRejected, &eventData{host: "trace.agent.datadoghq.eu", count: 1})
+	stats.record(eventTypeDropped, &eventData{host: "trace.agent.datadoghq.eu", count: 1})
+	stats.record(eventTypeSent, nil)
+
+	assert.Equal(map[string]EndpointStats{
+		"trace.agent.datadoghq.com": {Sent: 2},
+		"trace.agent.datadoghq.eu":  {Errors: 2},
+	}, stats.take())
+	assert.Empty(stats.take())
+}
+
 // useBackoffDuration replaces the current backoff duration with d and returns a
 // function which restores it.
 func useBackoffDuration(d time.Duration) func() {
@@ -124,6 +124,17 @@ func (w *StatsWriter) FlushSync() error {
 	return nil
 }
 
+// SetRetryHandler sets the handler receiving the payloads of the StatsWriter which failed to be sent
+// with a retriable error, rate limited ones included, instead of retrying them with a backoff.
+func (w *StatsWriter) SetRetryHandler(handler RetryHandler) {
+	setSendersRetryHandler(w.senders, handler)
+}
+
+// UpdateAPIKey replaces the API key of the senders of the StatsWriter using oldKey.
+func (w *StatsWriter) UpdateAPIKey(oldKey, newKey string) {
+	updateSendersAPIKey(w.senders, oldKey, newKey)
+}
+
 // Stop stops a running StatsWriter.
 func (w *StatsWriter) Stop() {
 	w.stop <- struct{}{}
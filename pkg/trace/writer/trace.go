@@ -66,6 +66,9 @@ type TraceWriter struct {
 	syncMode  bool
 	flushChan chan chan struct{}
 
+	// endpoints counts the payloads sent to each endpoint
+	endpoints endpointStats
+
 	easylog *logutil.ThrottledLogger
 }
 
@@ -108,6 +111,17 @@ func NewTraceWriter(cfg *config.AgentConfig) *TraceWriter {
 	return tw
 }
 
+// SetRetryHandler sets the handler receiving the payloads of the TraceWriter which failed to be sent
+// with a retriable error, rate limited ones included, instead of retrying them with a backoff.
+func (w *TraceWriter) SetRetryHandler(handler RetryHandler) {
+	setSendersRetryHandler(w.senders, handler)
+}
+
+// UpdateAPIKey replaces the API key of the senders of the TraceWriter using oldKey.
+func (w *TraceWriter) UpdateAPIKey(oldKey, newKey string) {
+	updateSendersAPIKey(w.senders, oldKey, newKey)
+}
+
 // Stop stops the TraceWriter and attempts to flush whatever is left in the senders buffers.
 func (w *TraceWriter) Stop() {
 	log.Debug("Exiting trace writer. Trying to flush whatever is left...")
@@ -284,8 +298,14 @@ func (w *TraceWriter) report() {
 
 var _ eventRecorder = (*TraceWriter)(nil)
 
+// TakeEndpointStats returns the payloads sent to each endpoint since the previous call, by host.
+func (w *TraceWriter) TakeEndpointStats() map[string]EndpointStats {
+	return w.endpoints.take()
+}
+
 // recordEvent implements eventRecorder.
 func (w *TraceWriter) recordEvent(t eventType, data *eventData) {
+	w.endpoints.record(t, data)
 	if data != nil {
 		metrics.Histogram("datadog.trace_agent.trace_writer.connection_fill", data.connectionFill, nil, 1)
 		metrics.Histogram("datadog.trace_agent.trace_writer.queue_fill", data.queueFill, nil, 1)
@@ -0,0 +1,18 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build !ec2
+
+package ec2
+
+import (
+	"context"
+	"fmt"
+)
+
+// GetSubnetsByTags lists the VPC subnets of the current region carrying all the given tags
+func GetSubnetsByTags(ctx context.Context, tags map[string]string) ([]Subnet, error) {
+	return nil, fmt.Errorf("listing VPC subnets requires the agent to be built with the ec2 build tag")
+}
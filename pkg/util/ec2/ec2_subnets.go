@@ -0,0 +1,68 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build ec2
+
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// GetSubnetsByTags lists the VPC subnets of the current region carrying all the given tags,
+// using the credentials available to the instance.
+func GetSubnetsByTags(ctx context.Context, tags map[string]string) ([]Subnet, error) {
+	if !config.IsCloudProviderEnabled(CloudProviderName) {
+		return nil, fmt.Errorf("cloud provider is disabled by configuration")
+	}
+
+	instanceIdentity, err := getInstanceIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	awsSess, err := session.NewSession(&aws.Config{
+		Region: aws.String(instanceIdentity.Region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get aws session, %s", err)
+	}
+
+	filters := make([]*ec2.Filter, 0, len(tags))
+	for key, value := range tags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+
+	var subnets []Subnet
+	connection := ec2.New(awsSess)
+	err = connection.DescribeSubnetsPagesWithContext(ctx,
+		&ec2.DescribeSubnetsInput{Filters: filters},
+		func(page *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+			for _, subnet := range page.Subnets {
+				subnets = append(subnets, Subnet{
+					ID:   aws.StringValue(subnet.SubnetId),
+					Cidr: aws.StringValue(subnet.CidrBlock),
+				})
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(subnets, func(i, j int) bool { return subnets[i].ID < subnets[j].ID })
+	return subnets, nil
+}
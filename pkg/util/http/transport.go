@@ -90,6 +90,42 @@ func CreateHTTPTransport() *http.Transport {
 	return transport
 }
 
+// proxyErrorTransport adds the URL of the proxy a request was sent through to its error
+type proxyErrorTransport struct {
+	*http.Transport
+}
+
+// WithProxyErrors returns a RoundTripper sending the requests with transport, whose errors
+// carry the URL of the proxy they were sent through, without its credentials, so that the
+// connection errors to the proxy are told apart from the ones to the intake
+func WithProxyErrors(transport *http.Transport) http.RoundTripper {
+	return proxyErrorTransport{transport}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t proxyErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil && t.Proxy != nil {
+		if proxyURL, proxyErr := t.Proxy(req); proxyErr == nil && proxyURL != nil {
+			err = fmt.Errorf("error sending the request through proxy %s: %w", logSafeURLString(proxyURL), err)
+		}
+	}
+	return resp, err
+}
+
+// SafeProxyURL returns a proxy URL from the configuration without its credentials, to be
+// logged or reported
+func SafeProxyURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid proxy URL>"
+	}
+	return logSafeURLString(proxyURL)
+}
+
 // GetProxyTransportFunc return a proxy function for a http.Transport that
 // would return the right proxy depending on the configuration.
 func GetProxyTransportFunc(p *config.Proxy) func(*http.Request) (*url.URL, error) {
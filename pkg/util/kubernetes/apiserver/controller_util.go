@@ -196,6 +196,8 @@ func (h *AutoscalersController) updateExternalMetrics() {
 
 	if len(globalCache) == 0 {
 		log.Debugf("No External Metrics to evaluate at the moment")
+		autoscalers.ResetServedMetrics()
+		autoscalers.ResetInvalidMetrics()
 		return
 	}
 
@@ -218,6 +220,8 @@ func (h *AutoscalersController) processingLoop(stopCh <-chan struct{}) {
 				return
 			case <-tickerAutoscalerRefreshProcess.C:
 				if !h.isLeaderFunc() {
+					// the new leader serves the metrics it refreshes
+					autoscalers.ResetServedMetrics()
 					continue
 				}
 				// Updating the metrics against Datadog should not affect the Ref pipeline.
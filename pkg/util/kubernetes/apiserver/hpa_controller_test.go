@@ -88,6 +88,7 @@ var alwaysLeader = func() bool { return true }
 type fakeDatadogClient struct {
 	queryMetricsFunc  func(from, to int64, query string) ([]datadog.Series, error)
 	getRateLimitsFunc func() map[string]datadog.RateLimit
+	postEventFunc     func(event *datadog.Event) (*datadog.Event, error)
 }
 
 type fakeProcessor struct {
@@ -125,6 +126,13 @@ func (d *fakeDatadogClient) GetRateLimitStats() map[string]datadog.RateLimit {
 	return nil
 }
 
+func (d *fakeDatadogClient) PostEvent(event *datadog.Event) (*datadog.Event, error) {
+	if d.postEventFunc != nil {
+		return d.postEventFunc(event)
+	}
+	return event, nil
+}
+
 var maxAge = 30 * time.Second
 
 func makePoints(ts int, val float64) datadog.DataPoint {
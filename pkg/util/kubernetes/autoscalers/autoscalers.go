@@ -12,6 +12,7 @@ import (
 	"regexp"
 
 	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/util/log"
@@ -20,6 +21,8 @@ import (
 
 // InspectHPA returns the list of external metrics from the hpa to use for autoscaling.
 func InspectHPA(hpa *autoscalingv2.HorizontalPodAutoscaler) (emList []custommetrics.ExternalMetricValue) {
+	pointSelection := custommetrics.PointSelectionFromAnnotations(hpa.Annotations, "HorizontalPodAutoscaler", hpa.Namespace, hpa.Name)
+	fallbackValue := custommetrics.FallbackValueFromAnnotations(hpa.Annotations, "HorizontalPodAutoscaler", hpa.Namespace, hpa.Name)
 	for _, metricSpec := range hpa.Spec.Metrics {
 		switch metricSpec.Type {
 		case autoscalingv2.ExternalMetricSourceType:
@@ -36,11 +39,14 @@ func InspectHPA(hpa *autoscalingv2.HorizontalPodAutoscaler) (emList []custommetr
 			em := custommetrics.ExternalMetricValue{
 				MetricName: metricSpec.External.MetricName,
 				Ref: custommetrics.ObjectReference{
-					Type:      "horizontal",
-					Name:      hpa.Name,
-					Namespace: hpa.Namespace,
-					UID:       string(hpa.UID),
+					Type:              "horizontal",
+					Name:              hpa.Name,
+					Namespace:         hpa.Namespace,
+					UID:               string(hpa.UID),
+					CreationTimestamp: creationTimestamp(hpa.CreationTimestamp),
 				},
+				PointSelection: pointSelection,
+				FallbackValue:  fallbackValue,
 			}
 			if metricSpec.External.MetricSelector != nil {
 				em.Labels = metricSpec.External.MetricSelector.MatchLabels
@@ -55,6 +61,8 @@ func InspectHPA(hpa *autoscalingv2.HorizontalPodAutoscaler) (emList []custommetr
 
 // InspectWPA returns the list of external metrics from the wpa to use for autoscaling.
 func InspectWPA(wpa *v1alpha1.WatermarkPodAutoscaler) (emList []custommetrics.ExternalMetricValue) {
+	pointSelection := custommetrics.PointSelectionFromAnnotations(wpa.Annotations, "WatermarkPodAutoscaler", wpa.Namespace, wpa.Name)
+	fallbackValue := custommetrics.FallbackValueFromAnnotations(wpa.Annotations, "WatermarkPodAutoscaler", wpa.Namespace, wpa.Name)
 	for _, metricSpec := range wpa.Spec.Metrics {
 		switch metricSpec.Type {
 		case v1alpha1.ExternalMetricSourceType:
@@ -66,11 +74,14 @@ func InspectWPA(wpa *v1alpha1.WatermarkPodAutoscaler) (emList []custommetrics.Ex
 			em := custommetrics.ExternalMetricValue{
 				MetricName: metricSpec.External.MetricName,
 				Ref: custommetrics.ObjectReference{
-					Type:      "watermark",
-					Name:      wpa.Name,
-					Namespace: wpa.Namespace,
-					UID:       string(wpa.UID),
+					Type:              "watermark",
+					Name:              wpa.Name,
+					Namespace:         wpa.Namespace,
+					UID:               string(wpa.UID),
+					CreationTimestamp: creationTimestamp(wpa.CreationTimestamp),
 				},
+				PointSelection: pointSelection,
+				FallbackValue:  fallbackValue,
 			}
 			if metricSpec.External.MetricSelector != nil {
 				em.Labels = metricSpec.External.MetricSelector.MatchLabels
@@ -83,6 +94,14 @@ func InspectWPA(wpa *v1alpha1.WatermarkPodAutoscaler) (emList []custommetrics.Ex
 	return
 }
 
+// creationTimestamp returns the creation time of an autoscaler in seconds, 0 if it isn't set
+func creationTimestamp(created metav1.Time) int64 {
+	if created.IsZero() {
+		return 0
+	}
+	return created.Unix()
+}
+
 // DiffExternalMetrics returns the list of external metrics that reference hpas that are not in the given list of hpas.
 func DiffExternalMetrics(informerList []*autoscalingv2.HorizontalPodAutoscaler, wpaInformerList []*v1alpha1.WatermarkPodAutoscaler, storedMetricsList []custommetrics.ExternalMetricValue) (toDelete []custommetrics.ExternalMetricValue) {
 	autoscalerMetrics := map[string][]custommetrics.ExternalMetricValue{}
@@ -316,6 +316,32 @@ func TestInspect(t *testing.T) {
 				},
 			},
 		},
+		"with a point selection": {
+			&autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{custommetrics.PointSelectionAnnotation: "max"},
+				},
+				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+					Metrics: []autoscalingv2.MetricSpec{
+						{
+							Type: autoscalingv2.ExternalMetricSourceType,
+							External: &autoscalingv2.ExternalMetricSource{
+								MetricName: "foo",
+							},
+						},
+					},
+				},
+			},
+			[]custommetrics.ExternalMetricValue{
+				{
+					MetricName: "foo",
+					Ref: custommetrics.ObjectReference{
+						Type: "horizontal",
+					},
+					PointSelection: custommetrics.PointSelectionMax,
+				},
+			},
+		},
 		"incomplete, missing external metrics": {
 			&autoscalingv2.HorizontalPodAutoscaler{
 				Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
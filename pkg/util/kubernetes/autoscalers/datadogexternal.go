@@ -18,6 +18,7 @@ import (
 	"gopkg.in/zorkian/go-datadog-api.v2"
 	utilserror "k8s.io/apimachinery/pkg/util/errors"
 
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	"github.com/DataDog/datadog-agent/pkg/config"
 	"github.com/DataDog/datadog-agent/pkg/telemetry"
 	httputils "github.com/DataDog/datadog-agent/pkg/util/http"
@@ -53,6 +54,23 @@ type Point struct {
 	Value     float64
 	Timestamp int64
 	Valid     bool
+	// Error explains why the query could not be processed, if known.
+	Error error
+	// IngestionDelay is the number of seconds the query window was shifted back by to account for
+	// the ingestion lag of the metric, the point is expected to be that much older.
+	IngestionDelay int64
+	// Conversion is the unit conversion applied to the value, nil if the metric has none.
+	Conversion *custommetrics.UnitConversion
+	// Window holds the points of the query window the value can be selected among, oldest first,
+	// the point itself being the last one. It is empty when the value can't be selected, such as
+	// the values of the formulas.
+	Window []WindowPoint
+}
+
+// WindowPoint is a point of the query window of an external metric, before unit conversion.
+type WindowPoint struct {
+	Value     float64
+	Timestamp int64
 }
 
 const (
@@ -64,8 +82,8 @@ const (
 )
 
 // queryDatadogExternal converts the metric name and labels from the Ref format into a Datadog metric.
-// It returns the last value for a bucket of 5 minutes,
-func (p *Processor) queryDatadogExternal(ddQueries []string, bucketSize int64) (map[string]Point, error) {
+// It returns the last value for a bucket of 5 minutes, ending ingestionDelay seconds ago.
+func (p *Processor) queryDatadogExternal(ddQueries []string, bucketSize int64, ingestionDelay int64) (map[string]Point, error) {
 	ddQueriesLen := len(ddQueries)
 	if ddQueriesLen == 0 {
 		log.Tracef("No query in input - nothing to do")
@@ -73,7 +91,8 @@ func (p *Processor) queryDatadogExternal(ddQueries []string, bucketSize int64) (
 	}
 
 	query := strings.Join(ddQueries, ",")
-	seriesSlice, err := p.datadogClient.QueryMetrics(time.Now().Unix()-bucketSize, time.Now().Unix(), query)
+	to := time.Now().Unix() - ingestionDelay
+	seriesSlice, err := p.datadogClient.QueryMetrics(to-bucketSize, to, query)
 	if err != nil {
 		ddRequests.Inc("error", le.JoinLeaderValue)
 		return nil, log.Errorf("Error while executing metric query %s: %s", query, err)
@@ -129,6 +148,8 @@ func (p *Processor) queryDatadogExternal(ddQueries []string, bucketSize int64) (
 			point.Value = *serie.Points[i][value]                       // store the original value
 			point.Timestamp = int64(*serie.Points[i][timestamp] / 1000) // Datadog's API returns timestamps in s
 			point.Valid = true
+			point.IngestionDelay = ingestionDelay
+			point.Window = windowPoints(serie.Points[:i+1])
 
 			m := fmt.Sprintf("%s{%s}", *serie.Metric, *serie.Scope)
 			processedMetrics[ddQueries[queryIndex]] = point
@@ -160,11 +181,23 @@ func (p *Processor) queryDatadogExternal(ddQueries []string, bucketSize int64) (
 	return processedMetrics, nil
 }
 
+// windowPoints returns the points of a series with a value, the empty ones being left out
+func windowPoints(points []datadog.DataPoint) []WindowPoint {
+	window := make([]WindowPoint, 0, len(points))
+	for _, p := range points {
+		if p[value] == nil || p[timestamp] == nil {
+			continue
+		}
+		window = append(window, WindowPoint{Value: *p[value], Timestamp: int64(*p[timestamp] / 1000)})
+	}
+	return window
+}
+
 // setTelemetryMetric is a helper to submit telemetry metrics
-func setTelemetryMetric(val string, metric telemetry.Gauge) error {
+func setTelemetryMetric(val string, metric telemetry.Gauge, endpoint string) error {
 	valFloat, err := strconv.Atoi(val)
 	if err == nil {
-		metric.Set(float64(valFloat), queryEndpoint, le.JoinLeaderValue)
+		metric.Set(float64(valFloat), endpoint, le.JoinLeaderValue)
 	}
 	return err
 }
@@ -174,23 +207,35 @@ func (p *Processor) updateRateLimitingMetrics() error {
 	queryLimits := updateMap[queryEndpoint]
 
 	errors := []error{
-		setTelemetryMetric(queryLimits.Limit, rateLimitsLimit),
-		setTelemetryMetric(queryLimits.Remaining, rateLimitsRemaining),
-		setTelemetryMetric(queryLimits.Period, rateLimitsPeriod),
-		setTelemetryMetric(queryLimits.Reset, rateLimitsReset),
+		setTelemetryMetric(queryLimits.Limit, rateLimitsLimit, queryEndpoint),
+		setTelemetryMetric(queryLimits.Remaining, rateLimitsRemaining, queryEndpoint),
+		setTelemetryMetric(queryLimits.Period, rateLimitsPeriod, queryEndpoint),
+		setTelemetryMetric(queryLimits.Reset, rateLimitsReset, queryEndpoint),
+	}
+
+	// the rate limits of the scalar query API are only known once a formula was evaluated
+	if p.scalarClient != nil {
+		if scalarLimits := p.scalarClient.getRateLimits(); scalarLimits.Remaining != "" {
+			errors = append(errors,
+				setTelemetryMetric(scalarLimits.Limit, rateLimitsLimit, scalarQueryEndpoint),
+				setTelemetryMetric(scalarLimits.Remaining, rateLimitsRemaining, scalarQueryEndpoint),
+				setTelemetryMetric(scalarLimits.Period, rateLimitsPeriod, scalarQueryEndpoint),
+				setTelemetryMetric(scalarLimits.Reset, rateLimitsReset, scalarQueryEndpoint),
+			)
+		}
 	}
 
 	return utilserror.NewAggregate(errors)
 }
 
-// NewDatadogClient generates a new client to query metrics from Datadog
-func NewDatadogClient() (*datadog.Client, error) {
-	apiKey := config.SanitizeAPIKey(config.Datadog.GetString("external_metrics_provider.api_key"))
+// datadogClientConfig returns the api and app keys and the endpoint used to query Datadog
+func datadogClientConfig() (apiKey, appKey, endpoint string, err error) {
+	apiKey = config.SanitizeAPIKey(config.Datadog.GetString("external_metrics_provider.api_key"))
 	if apiKey == "" {
 		apiKey = config.SanitizeAPIKey(config.Datadog.GetString("api_key"))
 	}
 
-	appKey := config.SanitizeAPIKey(config.Datadog.GetString("external_metrics_provider.app_key"))
+	appKey = config.SanitizeAPIKey(config.Datadog.GetString("external_metrics_provider.app_key"))
 	if appKey == "" {
 		appKey = config.SanitizeAPIKey(config.Datadog.GetString("app_key"))
 	}
@@ -201,13 +246,22 @@ func NewDatadogClient() (*datadog.Client, error) {
 	//   - DD_EXTERNAL_METRICS_PROVIDER_ENDPOINT
 	//   - DATADOG_HOST
 	//   - DD_SITE
-	endpoint := os.Getenv("DATADOG_HOST")
+	endpoint = os.Getenv("DATADOG_HOST")
 	if config.Datadog.GetString(metricsEndpointConfig) != "" || endpoint == "" {
 		endpoint = config.GetMainEndpoint(metricsEndpointPrefix, metricsEndpointConfig)
 	}
 
 	if appKey == "" || apiKey == "" {
-		return nil, errors.New("missing the api/app key pair to query Datadog")
+		return "", "", "", errors.New("missing the api/app key pair to query Datadog")
+	}
+	return apiKey, appKey, endpoint, nil
+}
+
+// NewDatadogClient generates a new client to query metrics from Datadog
+func NewDatadogClient() (*datadog.Client, error) {
+	apiKey, appKey, endpoint, err := datadogClientConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	log.Infof("Initialized the Datadog Client for HPA with endpoint %q", endpoint)
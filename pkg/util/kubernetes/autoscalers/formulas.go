@@ -0,0 +1,293 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	httputils "github.com/DataDog/datadog-agent/pkg/util/http"
+	le "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// formulaPrefix marks the queries evaluated with the v2 scalar query API, in the form
+	// `formula:<formula>;<name>=<query>;<name>=<query>...`, e.g. `formula:a/b;a=sum:requests{*};b=sum:hosts{*}`
+	formulaPrefix       = "formula:"
+	scalarQueryEndpoint = "/api/v2/query/scalar"
+	// scalarAggregator is the aggregation of the points of the query window into the value of a query
+	scalarAggregator = "avg"
+	scalarTimeout    = 10 * time.Second
+)
+
+var (
+	errFormulasDisabled = errors.New("formula queries are disabled, set external_metrics_provider.enable_v2_formulas to enable them")
+
+	formulaQueryNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// formulaQuery is a formula combining named metric queries, evaluated by the v2 scalar query API
+type formulaQuery struct {
+	formula string
+	queries []namedQuery
+}
+
+type namedQuery struct {
+	name  string
+	query string
+}
+
+// isFormulaQuery returns whether a query is a formula evaluated by the v2 scalar query API
+func isFormulaQuery(query string) bool {
+	return strings.HasPrefix(query, formulaPrefix)
+}
+
+// parseFormulaQuery parses a query in the form `formula:<formula>;<name>=<query>;...`
+func parseFormulaQuery(query string) (formulaQuery, error) {
+	parts := strings.Split(strings.TrimPrefix(query, formulaPrefix), ";")
+	fq := formulaQuery{formula: strings.TrimSpace(parts[0])}
+	if fq.formula == "" {
+		return fq, fmt.Errorf("missing formula")
+	}
+	if len(parts) == 1 {
+		return fq, fmt.Errorf("missing the queries of the formula")
+	}
+
+	names := make(map[string]struct{}, len(parts)-1)
+	for _, part := range parts[1:] {
+		sep := strings.Index(part, "=")
+		if sep < 0 {
+			return fq, fmt.Errorf("query %q is not in the form <name>=<query>", part)
+		}
+		name, q := strings.TrimSpace(part[:sep]), strings.TrimSpace(part[sep+1:])
+		if !formulaQueryNameRegexp.MatchString(name) {
+			return fq, fmt.Errorf("invalid query name %q", name)
+		}
+		if _, found := names[name]; found {
+			return fq, fmt.Errorf("duplicate query name %q", name)
+		}
+		if q == "" {
+			return fq, fmt.Errorf("empty query %q", name)
+		}
+		names[name] = struct{}{}
+		fq.queries = append(fq.queries, namedQuery{name: name, query: q})
+	}
+	return fq, nil
+}
+
+// scalarClient queries the v2 scalar query API of Datadog, which isn't covered by the v1 client
+type scalarClient struct {
+	endpoint   string
+	apiKey     string
+	appKey     string
+	httpClient *http.Client
+
+	rateLimitsLock sync.Mutex
+	rateLimits     datadog.RateLimit
+}
+
+// newScalarClient returns a client of the v2 scalar query API, using the same keys and endpoint
+// as the v1 client
+func newScalarClient() (*scalarClient, error) {
+	apiKey, appKey, endpoint, err := datadogClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Initialized the Datadog scalar query client for HPA with endpoint %q", endpoint)
+	return &scalarClient{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		apiKey:   apiKey,
+		appKey:   appKey,
+		httpClient: &http.Client{
+			Transport: httputils.CreateHTTPTransport(),
+			Timeout:   scalarTimeout,
+		},
+	}, nil
+}
+
+type scalarRequest struct {
+	Data scalarRequestData `json:"data"`
+}
+
+type scalarRequestData struct {
+	Type       string                  `json:"type"`
+	Attributes scalarRequestAttributes `json:"attributes"`
+}
+
+type scalarRequestAttributes struct {
+	From     int64                `json:"from"`
+	To       int64                `json:"to"`
+	Queries  []scalarRequestQuery `json:"queries"`
+	Formulas []scalarFormula      `json:"formulas"`
+}
+
+type scalarRequestQuery struct {
+	DataSource string `json:"data_source"`
+	Name       string `json:"name"`
+	Query      string `json:"query"`
+	Aggregator string `json:"aggregator"`
+}
+
+type scalarFormula struct {
+	Formula string `json:"formula"`
+}
+
+type scalarResponse struct {
+	Data struct {
+		Attributes struct {
+			Columns []scalarColumn `json:"columns"`
+		} `json:"attributes"`
+	} `json:"data"`
+	Errors string `json:"errors"`
+}
+
+type scalarColumn struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Values json.RawMessage `json:"values"`
+}
+
+// query evaluates a formula over the window between from and to, in seconds
+func (c *scalarClient) query(from, to int64, fq formulaQuery) (float64, error) {
+	request := scalarRequest{Data: scalarRequestData{
+		Type: "scalar_request",
+		Attributes: scalarRequestAttributes{
+			From:     from * 1000,
+			To:       to * 1000,
+			Formulas: []scalarFormula{{Formula: fq.formula}},
+		},
+	}}
+	for _, q := range fq.queries {
+		request.Data.Attributes.Queries = append(request.Data.Attributes.Queries, scalarRequestQuery{
+			DataSource: "metrics",
+			Name:       q.name,
+			Query:      q.query,
+			Aggregator: scalarAggregator,
+		})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+scalarQueryEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", c.apiKey)
+	req.Header.Set("DD-APPLICATION-KEY", c.appKey)
+	req.Header.Set("User-Agent", "Datadog-Cluster-Agent")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	c.updateRateLimits(resp.Header)
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var response scalarResponse
+	// the body of an error response may not be JSON
+	if err := json.Unmarshal(respBody, &response); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("invalid response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("API returned error %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if response.Errors != "" {
+		return 0, fmt.Errorf("API returned error: %s", response.Errors)
+	}
+	return parseScalarValue(response.Data.Attributes.Columns)
+}
+
+// parseScalarValue returns the single value of the formula, the formula must not be grouped
+func parseScalarValue(columns []scalarColumn) (float64, error) {
+	for _, column := range columns {
+		if column.Type != "number" {
+			continue
+		}
+		var values []*float64
+		if err := json.Unmarshal(column.Values, &values); err != nil {
+			return 0, fmt.Errorf("invalid values: %s", err)
+		}
+		switch {
+		case len(values) > 1:
+			return 0, fmt.Errorf("%d values returned, the formula must return a single value", len(values))
+		case len(values) == 0 || values[0] == nil:
+			return 0, fmt.Errorf("no value returned")
+		}
+		return *values[0], nil
+	}
+	return 0, fmt.Errorf("no value returned")
+}
+
+// updateRateLimits records the rate limit headers of a response
+func (c *scalarClient) updateRateLimits(header http.Header) {
+	if header.Get("X-RateLimit-Remaining") == "" {
+		return
+	}
+	c.rateLimitsLock.Lock()
+	defer c.rateLimitsLock.Unlock()
+	c.rateLimits = datadog.RateLimit{
+		Limit:     header.Get("X-RateLimit-Limit"),
+		Period:    header.Get("X-RateLimit-Period"),
+		Reset:     header.Get("X-RateLimit-Reset"),
+		Remaining: header.Get("X-RateLimit-Remaining"),
+	}
+}
+
+// getRateLimits returns the rate limits of the last response
+func (c *scalarClient) getRateLimits() datadog.RateLimit {
+	c.rateLimitsLock.Lock()
+	defer c.rateLimitsLock.Unlock()
+	return c.rateLimits
+}
+
+// queryFormula evaluates a formula query, the errors are reported on the returned point
+func (p *Processor) queryFormula(query string, bucketSize int64, ingestionDelay int64) Point {
+	if p.scalarClient == nil {
+		return Point{Timestamp: time.Now().Unix(), Error: errFormulasDisabled}
+	}
+	fq, err := parseFormulaQuery(query)
+	if err != nil {
+		return Point{Timestamp: time.Now().Unix(), Error: fmt.Errorf("invalid formula query %q: %s", query, err)}
+	}
+
+	to := time.Now().Unix() - ingestionDelay
+	value, err := p.scalarClient.query(to-bucketSize, to, fq)
+	if err != nil {
+		ddRequests.Inc("error", le.JoinLeaderValue)
+		log.Debugf("Error while evaluating the formula query %s: %s", query, err)
+		return Point{Timestamp: time.Now().Unix(), Error: fmt.Errorf("formula %q: %s", fq.formula, err)}
+	}
+	ddRequests.Inc("success", le.JoinLeaderValue)
+
+	metricsEval.Set(value, query, le.JoinLeaderValue)
+	log.Debugf("Validated %s | Value:%v at %d", query, value, to)
+	return Point{
+		Value:          value,
+		Timestamp:      to,
+		Valid:          true,
+		IngestionDelay: ingestionDelay,
+	}
+}
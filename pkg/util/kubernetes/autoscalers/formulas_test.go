@@ -0,0 +1,275 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+)
+
+// scalarStub is a stub of the v2 scalar query API answering by formula
+type scalarStub struct {
+	sync.Mutex
+	requests  []scalarRequest
+	responses map[string]string
+	// delay is the time taken by each request, inFlight and maxInFlight count the concurrent ones
+	delay       time.Duration
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *scalarStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != scalarQueryEndpoint || r.Header.Get("DD-API-KEY") != "apikey" || r.Header.Get("DD-APPLICATION-KEY") != "appkey" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var request scalarRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.Lock()
+	s.requests = append(s.requests, request)
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.Unlock()
+	time.Sleep(s.delay)
+	s.Lock()
+	s.inFlight--
+	s.Unlock()
+
+	response, found := s.responses[request.Data.Attributes.Formulas[0].Formula]
+	if !found {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("internal error")) //nolint:errcheck
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", "1000")
+	w.Header().Set("X-RateLimit-Period", "3600")
+	w.Header().Set("X-RateLimit-Remaining", "42")
+	w.Header().Set("X-RateLimit-Reset", "10")
+	w.Write([]byte(response)) //nolint:errcheck
+}
+
+func newScalarStub(t *testing.T, responses map[string]string) (*scalarStub, *scalarClient) {
+	stub := &scalarStub{responses: responses}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	return stub, &scalarClient{endpoint: server.URL, apiKey: "apikey", appKey: "appkey", httpClient: server.Client()}
+}
+
+// v1RateLimits returns the rate limits of the v1 query endpoint with the given remaining requests
+func v1RateLimits(remaining string) func() map[string]datadog.RateLimit {
+	return func() map[string]datadog.RateLimit {
+		return map[string]datadog.RateLimit{queryEndpoint: {Limit: "1000", Period: "3600", Remaining: remaining, Reset: "10"}}
+	}
+}
+
+func scalarResponseWithValues(values string) string {
+	return `{"data":{"type":"scalar_response","attributes":{"columns":[{"name":"query1","type":"number","values":` + values + `}]}}}`
+}
+
+func TestParseFormulaQuery(t *testing.T) {
+	fq, err := parseFormulaQuery("formula:a / b * 100; a=sum:requests{app:foo}.as_count() ;b=sum:hosts{app:foo}")
+	require.NoError(t, err)
+	assert.Equal(t, formulaQuery{
+		formula: "a / b * 100",
+		queries: []namedQuery{
+			{name: "a", query: "sum:requests{app:foo}.as_count()"},
+			{name: "b", query: "sum:hosts{app:foo}"},
+		},
+	}, fq)
+
+	for _, invalid := range []string{
+		"formula:",
+		"formula:a",
+		"formula:a;sum:requests{*}",
+		"formula:a;1a=sum:requests{*}",
+		"formula:a;a=",
+		"formula:a+a;a=sum:requests{*};a=sum:hosts{*}",
+	} {
+		_, err := parseFormulaQuery(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseScalarValue(t *testing.T) {
+	for _, tt := range []struct {
+		values string
+		value  float64
+		err    string
+	}{
+		{values: `[12.5]`, value: 12.5},
+		{values: `[]`, err: "no value returned"},
+		{values: `[null]`, err: "no value returned"},
+		{values: `[1, 2]`, err: "2 values returned"},
+	} {
+		value, err := parseScalarValue([]scalarColumn{
+			{Name: "app", Type: "group", Values: json.RawMessage(`[["app:foo"]]`)},
+			{Name: "query1", Type: "number", Values: json.RawMessage(tt.values)},
+		})
+		if tt.err != "" {
+			assert.Contains(t, err.Error(), tt.err, tt.values)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.value, value)
+	}
+}
+
+func TestQueryExternalMetricFormulas(t *testing.T) {
+	stub, scalarCl := newScalarStub(t, map[string]string{
+		"a/b": scalarResponseWithValues(`[0.25]`),
+		"a*2": scalarResponseWithValues(`[1, 2]`),
+		"a+b": `{"errors":"unknown metric"}`,
+	})
+	v1Query := "avg:nginx.net.request_per_s{app:foo}.rollup(30)"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			assert.Equal(t, v1Query, query)
+			return []datadog.Series{{
+				Metric: makePtr("nginx.net.request_per_s"),
+				Scope:  makePtr("app:foo"),
+				Points: []datadog.DataPoint{makePoints(0, 10)},
+			}}, nil
+		},
+		getRateLimitsFunc: v1RateLimits("1000"),
+	}
+	p := &Processor{datadogClient: datadogClient, scalarClient: scalarCl, ingestionDelay: 60}
+
+	valid := "formula:a/b;a=sum:requests{app:foo};b=sum:hosts{app:foo}"
+	grouped := "formula:a*2;a=sum:requests{app:foo} by {host}"
+	apiError := "formula:a+b;a=sum:requests{app:foo};b=sum:unknown{app:foo}"
+	serverError := "formula:c;c=sum:requests{app:foo}"
+	now := time.Now().Unix()
+	processed, err := p.QueryExternalMetric([]string{valid, grouped, apiError, serverError, v1Query, valid})
+	// the errors of the formulas are reported on their points only
+	assert.NoError(t, err)
+	require.Len(t, processed, 5)
+
+	assert.True(t, processed[v1Query].Valid)
+	assert.Equal(t, 10.0, processed[v1Query].Value)
+
+	point := processed[valid]
+	assert.True(t, point.Valid)
+	assert.Equal(t, 0.25, point.Value)
+	assert.InDelta(t, now-60, point.Timestamp, 2)
+	assert.Equal(t, int64(60), point.IngestionDelay)
+
+	for query, expected := range map[string]string{
+		grouped:     `formula "a*2": 2 values returned`,
+		apiError:    `formula "a+b": API returned error: unknown metric`,
+		serverError: `formula "c": API returned error 500: internal error`,
+	} {
+		assert.False(t, processed[query].Valid, query)
+		require.Error(t, processed[query].Error, query)
+		assert.Contains(t, processed[query].Error.Error(), expected)
+	}
+
+	// each formula is evaluated once, with its queries and the shifted query window
+	require.Len(t, stub.requests, 4)
+	for _, request := range stub.requests {
+		attributes := request.Data.Attributes
+		if attributes.Formulas[0].Formula != "a/b" {
+			continue
+		}
+		assert.Equal(t, "scalar_request", request.Data.Type)
+		assert.Equal(t, []scalarRequestQuery{
+			{DataSource: "metrics", Name: "a", Query: "sum:requests{app:foo}", Aggregator: scalarAggregator},
+			{DataSource: "metrics", Name: "b", Query: "sum:hosts{app:foo}", Aggregator: scalarAggregator},
+		}, attributes.Queries)
+		assert.Equal(t, int64(300*1000), attributes.To-attributes.From)
+		assert.InDelta(t, (now-60)*1000, attributes.To, 2000)
+	}
+	assert.Equal(t, "42", scalarCl.getRateLimits().Remaining)
+}
+
+func TestQueryExternalMetricFormulasBoundedWorkers(t *testing.T) {
+	mockConfig := config.Mock()
+	mockConfig.Set("external_metrics_provider.max_parallel_formulas", 2)
+
+	responses := make(map[string]string)
+	var queries []string
+	for i := 0; i < 7; i++ {
+		formula := fmt.Sprintf("a*%d", i)
+		responses[formula] = scalarResponseWithValues(fmt.Sprintf("[%d]", i))
+		queries = append(queries, fmt.Sprintf("formula:%s;a=sum:requests{app:foo}", formula))
+	}
+	stub, scalarCl := newScalarStub(t, responses)
+	stub.delay = 20 * time.Millisecond
+	datadogClient := &fakeDatadogClient{getRateLimitsFunc: v1RateLimits("1000")}
+	p := &Processor{datadogClient: datadogClient, scalarClient: scalarCl}
+
+	processed, err := p.QueryExternalMetric(queries)
+	assert.NoError(t, err)
+	require.Len(t, processed, len(queries))
+	for i, query := range queries {
+		assert.True(t, processed[query].Valid, query)
+		assert.Equal(t, float64(i), processed[query].Value, query)
+	}
+	// the formulas are all evaluated, by no more than the configured number of workers at once
+	assert.Len(t, stub.requests, len(queries))
+	assert.LessOrEqual(t, stub.maxInFlight, 2)
+}
+
+func TestQueryExternalMetricFormulasDisabled(t *testing.T) {
+	called := false
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			called = true
+			return nil, nil
+		},
+		getRateLimitsFunc: v1RateLimits("1000"),
+	}
+	p := &Processor{datadogClient: datadogClient}
+
+	query := "formula:a/b;a=sum:requests{app:foo};b=sum:hosts{app:foo}"
+	processed, err := p.QueryExternalMetric([]string{query})
+	assert.NoError(t, err)
+	assert.False(t, called)
+	require.Contains(t, processed, query)
+	assert.False(t, processed[query].Valid)
+	assert.Equal(t, errFormulasDisabled, processed[query].Error)
+}
+
+func TestQueryExternalMetricFormulasRateLimit(t *testing.T) {
+	_, scalarCl := newScalarStub(t, map[string]string{"a": scalarResponseWithValues(`[3]`)})
+	datadogClient := &fakeDatadogClient{
+		getRateLimitsFunc: v1RateLimits("1000"),
+	}
+	p := &Processor{
+		datadogClient: datadogClient,
+		scalarClient:  scalarCl,
+		rateLimit:     rateLimitGuard{minRemaining: 100, maxAge: time.Minute},
+	}
+	defer p.rateLimit.setPaused(false)
+
+	// the scalar query API has fewer remaining requests, the queries are paused
+	query := "formula:a;a=sum:requests{app:foo}"
+	processed, _ := p.QueryExternalMetric([]string{query})
+	assert.True(t, processed[query].Valid)
+	assert.True(t, p.rateLimit.paused(time.Now()))
+
+	// the cached value of the formula is served while the queries are paused
+	cached, err := p.QueryExternalMetric([]string{query})
+	assert.Equal(t, errRateLimitGuard, err)
+	assert.Equal(t, processed[query], cached[query])
+}
@@ -0,0 +1,178 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// invalidReasonLimitExceeded is the reason of the external metrics over the limits
+	invalidReasonLimitExceeded = "limit exceeded"
+
+	// metricLimitsExpvarName is the name of the expvar map exposing the number of external metrics served and over the limits
+	metricLimitsExpvarName = "external-metrics-limits"
+)
+
+var (
+	metricLimitsExpvars  = expvar.NewMap(metricLimitsExpvarName)
+	metricLimitsServed   = expvar.Int{}
+	metricLimitsRejected = expvar.Int{}
+)
+
+func init() {
+	metricLimitsExpvars.Set("Served", &metricLimitsServed)
+	metricLimitsExpvars.Set("Rejected", &metricLimitsRejected)
+}
+
+// metricLimiter caps the number of external metrics served, in total and per namespace, so that
+// a controller creating autoscalers in a loop can't drive the usage of the Datadog API. The metrics
+// are admitted by creation time of their autoscaler: the metrics over the limits are always those
+// of the most recent autoscalers, whatever the Cluster Agent serving them, and deleting a metric
+// admits the next one. The limits are read from the config on each update, to be changed at runtime.
+type metricLimiter struct {
+	sync.Mutex
+	// rejected holds the metrics over the limits at the last update, an event is sent when a
+	// metric goes over the limits
+	rejected map[string]struct{}
+}
+
+// LimitedMetric is an external metric admitted by the limits on the number of external metrics
+// served, the metrics being admitted by creation time of the object they are served for
+type LimitedMetric struct {
+	ID                string
+	Namespace         string
+	Name              string
+	CreationTimestamp int64
+}
+
+// admit splits the metrics between the ones served and the ones over the limits, with the
+// description of the limit they exceed. A limit of 0 or less is disabled.
+func (l *metricLimiter) admit(emList map[string]custommetrics.ExternalMetricValue, maxMetrics, maxPerNamespace int) (admitted map[string]custommetrics.ExternalMetricValue, rejected map[string]string) {
+	metrics := make([]LimitedMetric, 0, len(emList))
+	for id, em := range emList {
+		metrics = append(metrics, LimitedMetric{ID: id, Namespace: em.Ref.Namespace, Name: em.Ref.Name, CreationTimestamp: em.Ref.CreationTimestamp})
+	}
+	rejected = rejectOverLimits(metrics, maxMetrics, maxPerNamespace)
+
+	admitted = make(map[string]custommetrics.ExternalMetricValue, len(emList)-len(rejected))
+	for id, em := range emList {
+		if _, found := rejected[id]; !found {
+			admitted[id] = em
+		}
+	}
+	return admitted, rejected
+}
+
+// rejectOverLimits returns the metrics over the limits, with the description of the limit they
+// exceed. A limit of 0 or less is disabled.
+func rejectOverLimits(metrics []LimitedMetric, maxMetrics, maxPerNamespace int) map[string]string {
+	rejected := make(map[string]string)
+	if maxMetrics <= 0 && maxPerNamespace <= 0 {
+		return rejected
+	}
+
+	sorted := append([]LimitedMetric{}, metrics...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.CreationTimestamp != b.CreationTimestamp {
+			return a.CreationTimestamp < b.CreationTimestamp
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+
+	admitted := 0
+	perNamespace := make(map[string]int)
+	for _, metric := range sorted {
+		switch {
+		case maxPerNamespace > 0 && perNamespace[metric.Namespace] >= maxPerNamespace:
+			rejected[metric.ID] = fmt.Sprintf("the limit of %d external metrics in the namespace %s", maxPerNamespace, metric.Namespace)
+		case maxMetrics > 0 && admitted >= maxMetrics:
+			rejected[metric.ID] = fmt.Sprintf("the limit of %d external metrics", maxMetrics)
+		default:
+			admitted++
+			perNamespace[metric.Namespace]++
+		}
+	}
+	return rejected
+}
+
+// RejectMetricsOverLimits returns the metrics over the limits on the number of external metrics
+// served, with the description of the limit they exceed, and exposes the number of metrics served
+// and over the limits. It admits the DatadogMetrics, the external metrics of the autoscalers being
+// admitted by the Processor.
+func RejectMetricsOverLimits(metrics []LimitedMetric) map[string]string {
+	maxMetrics, maxPerNamespace := metricLimits()
+	rejected := rejectOverLimits(metrics, maxMetrics, maxPerNamespace)
+	metricLimitsServed.Set(int64(len(metrics) - len(rejected)))
+	metricLimitsRejected.Set(int64(len(rejected)))
+	return rejected
+}
+
+// report sends an event for each metric going over the limits, and exposes the number of metrics
+// served and rejected.
+func (l *metricLimiter) report(client DatadogClient, emList map[string]custommetrics.ExternalMetricValue, rejected map[string]string, aggregator string, rollup int) {
+	metricLimitsServed.Set(int64(len(emList) - len(rejected)))
+	metricLimitsRejected.Set(int64(len(rejected)))
+
+	l.Lock()
+	defer l.Unlock()
+	previous := l.rejected
+	l.rejected = make(map[string]struct{}, len(rejected))
+	for id, limit := range rejected {
+		l.rejected[id] = struct{}{}
+		if _, found := previous[id]; found {
+			continue
+		}
+
+		em := emList[id]
+		log.Warnf("The external metric %s of %s %s/%s is not served, it is over %s", em.MetricName, em.Ref.Type, em.Ref.Namespace, em.Ref.Name, limit)
+		query := getKey(em.MetricName, em.Labels, aggregator, rollup)
+		if _, err := client.PostEvent(limitExceededEvent(em, query, limit)); err != nil {
+			log.Warnf("Could not send the event of the external metric %s of %s %s/%s over the limits: %v", em.MetricName, em.Ref.Type, em.Ref.Namespace, em.Ref.Name, err)
+		}
+	}
+}
+
+// limitExceededEvent returns the event reporting that an external metric isn't served as it is over a limit
+func limitExceededEvent(em custommetrics.ExternalMetricValue, query, limit string) *datadog.Event {
+	autoscaler := fmt.Sprintf("%s autoscaler %s/%s", em.Ref.Type, em.Ref.Namespace, em.Ref.Name)
+	return &datadog.Event{
+		Title:       datadog.String(fmt.Sprintf("External metric %s of the %s is over the limits", em.MetricName, autoscaler)),
+		Text:        datadog.String(fmt.Sprintf("The external metric %s used by the %s is invalid (%s), it is over %s and the autoscaler won't scale on it.\nQuery: %s", em.MetricName, autoscaler, invalidReasonLimitExceeded, limit, query)),
+		AlertType:   datadog.String("error"),
+		SourceType:  datadog.String("kubernetes"),
+		Aggregation: datadog.String("external_metrics:" + em.Ref.UID),
+		Tags: []string{
+			"external_metric:" + em.MetricName,
+			"autoscaler_kind:" + em.Ref.Type,
+			"autoscaler_name:" + em.Ref.Name,
+			"kube_namespace:" + em.Ref.Namespace,
+		},
+	}
+}
+
+// metricLimits returns the limits on the number of external metrics served, in total and per namespace
+func metricLimits() (maxMetrics, maxPerNamespace int) {
+	return config.Datadog.GetInt("external_metrics_provider.max_metrics"), config.Datadog.GetInt("external_metrics_provider.max_metrics_per_namespace")
+}
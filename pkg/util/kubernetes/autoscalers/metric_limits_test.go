@@ -0,0 +1,147 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+)
+
+// newLimitsTestProcessor returns a processor whose queries all return a valid point, recording
+// the metrics queried on the last update and the events sent
+func newLimitsTestProcessor() (p *Processor, queried map[string]bool, events *[]*datadog.Event) {
+	queried = make(map[string]bool)
+	events = &[]*datadog.Event{}
+	penTime := (int(time.Now().Unix()) - int(maxAge.Seconds()/2)) * 1000
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			var series []datadog.Series
+			for i, q := range strings.Split(query, ",") {
+				metricName := strings.TrimSuffix(strings.TrimPrefix(q, "avg:"), "{*}.rollup(30)")
+				queried[metricName] = true
+				queryIndex := i
+				series = append(series, datadog.Series{
+					Metric:     &metricName,
+					Scope:      makePtr("*"),
+					QueryIndex: &queryIndex,
+					Points:     []datadog.DataPoint{makePoints(penTime, 10), makePoints(0, 20)},
+				})
+			}
+			return series, nil
+		},
+		postEventFunc: func(event *datadog.Event) (*datadog.Event, error) {
+			*events = append(*events, event)
+			return event, nil
+		},
+	}
+	return &Processor{datadogClient: datadogClient, externalMaxAge: maxAge}, queried, events
+}
+
+// limitsTestMetric returns the external metric of an autoscaler created at the given time, named after the metric
+func limitsTestMetric(name, namespace string, created int64) custommetrics.ExternalMetricValue {
+	return custommetrics.ExternalMetricValue{
+		MetricName: name,
+		Ref: custommetrics.ObjectReference{
+			Type:              "horizontal",
+			Name:              name,
+			Namespace:         namespace,
+			UID:               name,
+			CreationTimestamp: created,
+		},
+	}
+}
+
+func validMetrics(emList map[string]custommetrics.ExternalMetricValue) []string {
+	var valid []string
+	for id, em := range emList {
+		if em.Valid {
+			valid = append(valid, id)
+		}
+	}
+	return valid
+}
+
+func TestProcessor_MetricLimits(t *testing.T) {
+	mockConfig := config.Mock()
+	mockConfig.Set("external_metrics_provider.max_metrics", 3)
+	mockConfig.Set("external_metrics_provider.max_metrics_per_namespace", 2)
+
+	p, queried, events := newLimitsTestProcessor()
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"a": limitsTestMetric("a", "shop", 100),
+		"b": limitsTestMetric("b", "shop", 200),
+		"c": limitsTestMetric("c", "shop", 300),
+		"d": limitsTestMetric("d", "payments", 400),
+		"e": limitsTestMetric("e", "payments", 500),
+	}
+
+	// c is over the limit of its namespace, e over the total limit
+	emList = p.UpdateExternalMetrics(emList)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "d": true}, queried)
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, validMetrics(emList))
+	require.Len(t, *events, 2)
+	texts := []string{(*events)[0].GetText(), (*events)[1].GetText()}
+	assert.ElementsMatch(t, []string{
+		"The external metric c used by the horizontal autoscaler shop/c is invalid (limit exceeded), it is over the limit of 2 external metrics in the namespace shop and the autoscaler won't scale on it.\nQuery: avg:c{*}.rollup(30)",
+		"The external metric e used by the horizontal autoscaler payments/e is invalid (limit exceeded), it is over the limit of 3 external metrics and the autoscaler won't scale on it.\nQuery: avg:e{*}.rollup(30)",
+	}, texts)
+	assert.Equal(t, int64(3), metricLimitsServed.Value())
+	assert.Equal(t, int64(2), metricLimitsRejected.Value())
+
+	// the metrics staying over the limits are reported once
+	emList = p.UpdateExternalMetrics(emList)
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, validMetrics(emList))
+	assert.Len(t, *events, 2)
+
+	// the limits are read on each update
+	mockConfig.Set("external_metrics_provider.max_metrics", 0)
+	emList = p.UpdateExternalMetrics(emList)
+	assert.ElementsMatch(t, []string{"a", "b", "d", "e"}, validMetrics(emList))
+	assert.Len(t, *events, 2)
+}
+
+func TestProcessor_MetricLimitsDeletionAdmitsNext(t *testing.T) {
+	mockConfig := config.Mock()
+	mockConfig.Set("external_metrics_provider.max_metrics", 2)
+
+	p, queried, events := newLimitsTestProcessor()
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"a": limitsTestMetric("a", "shop", 100),
+		"b": limitsTestMetric("b", "shop", 200),
+		"c": limitsTestMetric("c", "shop", 300),
+	}
+	emList = p.UpdateExternalMetrics(emList)
+	assert.ElementsMatch(t, []string{"a", "b"}, validMetrics(emList))
+	require.Len(t, *events, 1)
+	assert.Contains(t, (*events)[0].GetTitle(), "shop/c")
+
+	// deleting a admits c, the next one by creation time
+	delete(emList, "a")
+	for metric := range queried {
+		delete(queried, metric)
+	}
+	emList = p.UpdateExternalMetrics(emList)
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, queried)
+	assert.ElementsMatch(t, []string{"b", "c"}, validMetrics(emList))
+
+	// a new metric doesn't evict the ones served
+	emList["f"] = limitsTestMetric("f", "shop", 400)
+	emList = p.UpdateExternalMetrics(emList)
+	assert.ElementsMatch(t, []string{"b", "c"}, validMetrics(emList))
+	assert.False(t, emList["f"].Valid)
+	require.Len(t, *events, 2)
+	assert.Contains(t, (*events)[1].GetTitle(), "shop/f")
+}
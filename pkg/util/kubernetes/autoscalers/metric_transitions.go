@@ -0,0 +1,177 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	le "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// Reasons for which an external metric is invalid, reported in the transition events
+const (
+	invalidReasonAPIError     = "API error"
+	invalidReasonEmptySeries  = "empty series"
+	invalidReasonStale        = "stale"
+	invalidReasonInvalidQuery = "invalid query"
+)
+
+var metricsInvalid = telemetry.NewGaugeWithOpts("", "external_metrics_invalid",
+	[]string{"metric", le.JoinLeaderLabel}, "1 if the external metric is invalid, 0 if it is valid",
+	telemetry.Options{NoDoubleUnderscoreSep: true})
+
+// globalInvalidGauge tracks the queries reported by metricsInvalid, so that the series of the
+// removed metrics are deleted
+var globalInvalidGauge = &invalidGauge{}
+
+// ResetInvalidMetrics deletes the external_metrics_invalid series of all the external metrics,
+// when none are left to evaluate
+func ResetInvalidMetrics() {
+	globalInvalidGauge.set(nil, "", 0)
+}
+
+// invalidGauge holds the queries of the last refresh reported by metricsInvalid
+type invalidGauge struct {
+	sync.Mutex
+	queries map[string]struct{}
+}
+
+// set reports the validity of the metrics of a refresh, and deletes the series of the queries
+// that are no longer evaluated
+func (g *invalidGauge) set(updated map[string]custommetrics.ExternalMetricValue, aggregator string, rollup int) {
+	g.Lock()
+	defer g.Unlock()
+	queries := make(map[string]struct{}, len(updated))
+	for _, em := range updated {
+		query := getKey(em.MetricName, em.Labels, aggregator, rollup)
+		// a query shared by several autoscalers is invalid if any of its metrics is
+		if _, found := queries[query]; found && em.Valid {
+			continue
+		}
+		queries[query] = struct{}{}
+		if em.Valid {
+			metricsInvalid.Set(0, query, le.JoinLeaderValue)
+		} else {
+			metricsInvalid.Set(1, query, le.JoinLeaderValue)
+		}
+	}
+	for query := range g.queries {
+		if _, found := queries[query]; !found {
+			metricsInvalid.Delete(query, le.JoinLeaderValue)
+		}
+	}
+	g.queries = queries
+}
+
+// transitionState is the state kept in memory for an external metric of an autoscaler
+// to rate limit its events. The validity itself is read from the stored metrics.
+type transitionState struct {
+	lastEvent time.Time
+	// invalidReported is true when the metric going invalid was reported, its
+	// recovery is only reported in this case
+	invalidReported bool
+}
+
+// transitionReporter reports the external metrics going from valid to invalid and back
+// as Datadog events, at most one event per metric every minInterval.
+type transitionReporter struct {
+	sync.Mutex
+	enabled     bool
+	minInterval time.Duration
+	states      map[string]*transitionState
+}
+
+// report compares the validity of the metrics stored before the update with the updated ones,
+// reasons holding why the invalid ones are. Comparing with the stored metrics, rather than with
+// a state kept in memory, keeps the transitions consistent when another Cluster Agent becomes
+// the leader.
+func (r *transitionReporter) report(client DatadogClient, emList, updated map[string]custommetrics.ExternalMetricValue, reasons map[string]string, aggregator string, rollup int) {
+	globalInvalidGauge.set(updated, aggregator, rollup)
+
+	if !r.enabled {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.states == nil {
+		r.states = make(map[string]*transitionState)
+	}
+	// forget the metrics of the autoscalers that were removed
+	for id := range r.states {
+		if _, found := emList[id]; !found {
+			delete(r.states, id)
+		}
+	}
+
+	now := time.Now()
+	for id, em := range updated {
+		previous, found := emList[id]
+		if !found || previous.Valid == em.Valid {
+			continue
+		}
+
+		state, found := r.states[id]
+		if !found {
+			state = &transitionState{}
+			r.states[id] = state
+		}
+		if em.Valid && !state.invalidReported {
+			// metrics are invalid until their first evaluation, they don't recover
+			continue
+		}
+		if now.Sub(state.lastEvent) < r.minInterval {
+			log.Debugf("Not reporting the external metric %s of %s %s/%s becoming valid=%t, an event was sent %s ago", em.MetricName, em.Ref.Type, em.Ref.Namespace, em.Ref.Name, em.Valid, now.Sub(state.lastEvent))
+			continue
+		}
+
+		query := getKey(em.MetricName, em.Labels, aggregator, rollup)
+		if _, err := client.PostEvent(transitionEvent(em, query, reasons[id])); err != nil {
+			log.Warnf("Could not send the event of the external metric %s of %s %s/%s becoming valid=%t: %v", em.MetricName, em.Ref.Type, em.Ref.Namespace, em.Ref.Name, em.Valid, err)
+			continue
+		}
+		state.lastEvent = now
+		state.invalidReported = !em.Valid
+	}
+}
+
+// transitionEvent returns the event reporting that an external metric became invalid, or valid again
+func transitionEvent(em custommetrics.ExternalMetricValue, query, reason string) *datadog.Event {
+	autoscaler := fmt.Sprintf("%s autoscaler %s/%s", em.Ref.Type, em.Ref.Namespace, em.Ref.Name)
+	var title, text, alertType string
+	if em.Valid {
+		title = fmt.Sprintf("External metric %s of the %s is valid again", em.MetricName, autoscaler)
+		text = fmt.Sprintf("The external metric %s used by the %s is valid again.\nQuery: %s", em.MetricName, autoscaler, query)
+		alertType = "success"
+	} else {
+		title = fmt.Sprintf("External metric %s of the %s is invalid", em.MetricName, autoscaler)
+		text = fmt.Sprintf("The external metric %s used by the %s is invalid (%s), the autoscaler won't scale on it.\nQuery: %s", em.MetricName, autoscaler, reason, query)
+		alertType = "error"
+	}
+
+	return &datadog.Event{
+		Title:       datadog.String(title),
+		Text:        datadog.String(text),
+		AlertType:   datadog.String(alertType),
+		SourceType:  datadog.String("kubernetes"),
+		Aggregation: datadog.String("external_metrics:" + em.Ref.UID),
+		Tags: []string{
+			"external_metric:" + em.MetricName,
+			"autoscaler_kind:" + em.Ref.Type,
+			"autoscaler_name:" + em.Ref.Name,
+			"kube_namespace:" + em.Ref.Namespace,
+		},
+	}
+}
@@ -0,0 +1,148 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+func TestProcessor_ReportTransitions(t *testing.T) {
+	metricName := "requests_per_s"
+	penTime := (int(time.Now().Unix()) - int(maxAge.Seconds()/2)) * 1000
+	validSeries := []datadog.Series{
+		{
+			Metric: &metricName,
+			Points: []datadog.DataPoint{
+				makePoints(penTime, 14),
+				makePoints(0, 27),
+			},
+			Scope: makePtr("foo:bar"),
+		},
+	}
+
+	var series []datadog.Series
+	var queryErr error
+	var events []*datadog.Event
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(int64, int64, string) ([]datadog.Series, error) {
+			return series, queryErr
+		},
+		postEventFunc: func(event *datadog.Event) (*datadog.Event, error) {
+			events = append(events, event)
+			return event, nil
+		},
+	}
+	p := &Processor{
+		datadogClient:  datadogClient,
+		externalMaxAge: maxAge,
+		transitions:    transitionReporter{enabled: true, minInterval: time.Hour},
+	}
+
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"id1": {
+			MetricName: metricName,
+			Labels:     map[string]string{"foo": "bar"},
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Name: "web", Namespace: "prod", UID: "1234"},
+		},
+	}
+
+	// the first valid evaluation of a metric isn't a recovery
+	series = validSeries
+	emList = p.UpdateExternalMetrics(emList)
+	require.True(t, emList["id1"].Valid)
+	assert.Len(t, events, 0)
+
+	// the metric becomes invalid
+	series, queryErr = nil, fmt.Errorf("API error 500")
+	emList = p.UpdateExternalMetrics(emList)
+	require.False(t, emList["id1"].Valid)
+	require.Len(t, events, 1)
+	assert.Equal(t, "error", events[0].GetAlertType())
+	assert.Contains(t, events[0].GetText(), "(API error)")
+	assert.Contains(t, events[0].GetText(), "avg:requests_per_s{foo:bar}.rollup(30)")
+	assert.ElementsMatch(t, []string{
+		"external_metric:requests_per_s",
+		"autoscaler_kind:horizontal",
+		"autoscaler_name:web",
+		"kube_namespace:prod",
+	}, events[0].Tags)
+
+	// staying invalid isn't a transition
+	emList = p.UpdateExternalMetrics(emList)
+	assert.Len(t, events, 1)
+
+	// the recovery is rate limited
+	series, queryErr = validSeries, nil
+	emList = p.UpdateExternalMetrics(emList)
+	require.True(t, emList["id1"].Valid)
+	assert.Len(t, events, 1)
+
+	// the transitions are computed from the stored metrics, a new processor
+	// taking over the metrics reports the next transition
+	p.transitions = transitionReporter{enabled: true, minInterval: time.Hour}
+	series = []datadog.Series{}
+	emList = p.UpdateExternalMetrics(emList)
+	require.False(t, emList["id1"].Valid)
+	require.Len(t, events, 2)
+	assert.Contains(t, events[1].GetText(), "(empty series)")
+
+	p.transitions.minInterval = 0
+	series = validSeries
+	emList = p.UpdateExternalMetrics(emList)
+	require.True(t, emList["id1"].Valid)
+	require.Len(t, events, 3)
+	assert.Equal(t, "success", events[2].GetAlertType())
+
+	// the state of the removed metrics is dropped
+	p.UpdateExternalMetrics(map[string]custommetrics.ExternalMetricValue{})
+	assert.Len(t, p.transitions.states, 0)
+}
+
+func TestInvalidGaugeDeletesRemovedQueries(t *testing.T) {
+	g := &invalidGauge{}
+	g.set(map[string]custommetrics.ExternalMetricValue{
+		"id1": {MetricName: "requests_per_s", Labels: map[string]string{"foo": "bar"}, Valid: true},
+		"id2": {MetricName: "requests_per_s", Labels: map[string]string{"foo": "bar"}},
+		"id3": {MetricName: "errors_per_s", Valid: true},
+	}, "avg", 30)
+	assert.Len(t, g.queries, 2)
+
+	g.set(map[string]custommetrics.ExternalMetricValue{
+		"id3": {MetricName: "errors_per_s"},
+	}, "avg", 30)
+	assert.Equal(t, map[string]struct{}{"avg:errors_per_s{*}.rollup(30)": {}}, g.queries)
+
+	g.set(nil, "", 0)
+	assert.Len(t, g.queries, 0)
+}
+
+func TestProcessor_ReportTransitionsDisabled(t *testing.T) {
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(int64, int64, string) ([]datadog.Series, error) {
+			return nil, fmt.Errorf("API error 500")
+		},
+		postEventFunc: func(event *datadog.Event) (*datadog.Event, error) {
+			t.Fatal("no event expected")
+			return nil, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, externalMaxAge: maxAge}
+
+	updated := p.UpdateExternalMetrics(map[string]custommetrics.ExternalMetricValue{
+		"id1": {MetricName: "requests_per_s", Valid: true},
+	})
+	require.False(t, updated["id1"].Valid)
+}
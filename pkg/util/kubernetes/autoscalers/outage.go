@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	le "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// outageExpvarName is the name of the expvar map exposing the state of the outage policy.
+const outageExpvarName = "external-metrics-outage"
+
+var (
+	outageExpvars = expvar.NewMap(outageExpvarName)
+	outagePolicy  = expvar.String{}
+	outageMaxAge  = expvar.String{}
+	outageActive  = expvar.Int{}
+	outageSince   = expvar.String{}
+	outageServed  = expvar.Int{}
+
+	outagePolicyActive = telemetry.NewGaugeWithOpts("", "external_metrics_outage_policy_active",
+		[]string{"policy", le.JoinLeaderLabel}, "1 if the outage policy is applied as Datadog can't be queried, 0 otherwise",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+func init() {
+	outageExpvars.Set("Policy", &outagePolicy)
+	outageExpvars.Set("MaxAge", &outageMaxAge)
+	outageExpvars.Set("Active", &outageActive)
+	outageExpvars.Set("Since", &outageSince)
+	outageExpvars.Set("Served", &outageServed)
+}
+
+// outageState tracks the outages of Datadog, during which the external metrics are served
+// according to the outage policy.
+var outageState = struct {
+	sync.Mutex
+	since time.Time
+}{}
+
+// ReportOutage records whether Datadog could be queried at the last refresh of the external
+// metrics, and the number of metrics served by the outage policy during an outage.
+func ReportOutage(config custommetrics.OutagePolicyConfig, outage bool, served int, now time.Time) {
+	outageState.Lock()
+	defer outageState.Unlock()
+
+	policy := string(config.Policy)
+	outagePolicy.Set(policy)
+	if config.Policy == custommetrics.OutagePolicyHoldLastValue {
+		outageMaxAge.Set(config.MaxAge.String())
+	} else {
+		outageMaxAge.Set("")
+	}
+
+	if !outage {
+		if !outageState.since.IsZero() {
+			log.Infof("Datadog can be queried again after an outage since %s, serving the external metrics from Datadog", outageState.since.Format(time.RFC3339))
+		}
+		outageState.since = time.Time{}
+		outageActive.Set(0)
+		outageSince.Set("")
+		outageServed.Set(0)
+		outagePolicyActive.Set(0, policy, le.JoinLeaderValue)
+		return
+	}
+
+	if outageState.since.IsZero() {
+		outageState.since = now
+		log.Warnf("Datadog can't be queried, serving the external metrics with the %s outage policy", policy)
+	}
+	outageActive.Set(1)
+	outageSince.Set(outageState.since.Format(time.RFC3339))
+	outageServed.Set(int64(served))
+	outagePolicyActive.Set(1, policy, le.JoinLeaderValue)
+}
@@ -0,0 +1,150 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+func outageTestMetrics(now int64) map[string]custommetrics.ExternalMetricValue {
+	fallback := 3.0
+	return map[string]custommetrics.ExternalMetricValue{
+		"held": {
+			MetricName: "requests",
+			Labels:     map[string]string{"app": "nginx"},
+			Valid:      true,
+			Value:      10,
+			Timestamp:  now - 60,
+		},
+		"expired": {
+			MetricName: "errors",
+			Labels:     map[string]string{"app": "nginx"},
+			Valid:      true,
+			Value:      5,
+			Timestamp:  now - 1000,
+		},
+		"fallback": {
+			MetricName:    "latency",
+			Labels:        map[string]string{"app": "nginx"},
+			FallbackValue: &fallback,
+		},
+	}
+}
+
+func TestProcessor_UpdateExternalMetricsOutagePolicy(t *testing.T) {
+	outage := true
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			if outage {
+				return nil, fmt.Errorf("networking Error, timeout")
+			}
+			return []datadog.Series{
+				laggingSeries("requests", from, to, 0),
+				laggingSeries("errors", from, to, 0),
+				laggingSeries("latency", from, to, 0),
+			}, nil
+		},
+	}
+	now := time.Now().Unix()
+
+	// the last valid values are held with their timestamp until they are older than the max age
+	p := &Processor{
+		datadogClient:  datadogClient,
+		externalMaxAge: 2 * time.Minute,
+		outagePolicy:   custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute},
+	}
+	updated := p.UpdateExternalMetrics(outageTestMetrics(now))
+	require.Len(t, updated, 3)
+	assert.True(t, updated["held"].Valid)
+	assert.Equal(t, 10.0, updated["held"].Value)
+	assert.Equal(t, now-60, updated["held"].Timestamp)
+	assert.Equal(t, custommetrics.OutagePolicyHoldLastValue, updated["held"].Outage)
+	assert.False(t, updated["expired"].Valid)
+	assert.Empty(t, updated["expired"].Outage)
+	assert.False(t, updated["fallback"].Valid)
+
+	// the held value keeps its timestamp while the outage lasts
+	updated = p.UpdateExternalMetrics(updated)
+	assert.True(t, updated["held"].Valid)
+	assert.Equal(t, now-60, updated["held"].Timestamp)
+
+	// the live values replace the held ones as soon as Datadog can be queried again
+	outage = false
+	updated = p.UpdateExternalMetrics(updated)
+	for id, em := range updated {
+		assert.True(t, em.Valid, id)
+		assert.Equal(t, 42.0, em.Value, id)
+		assert.Empty(t, em.Outage, id)
+	}
+}
+
+func TestProcessor_UpdateExternalMetricsStaticFallback(t *testing.T) {
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return nil, fmt.Errorf("networking Error, timeout")
+		},
+	}
+	now := time.Now().Unix()
+
+	p := &Processor{
+		datadogClient:  datadogClient,
+		externalMaxAge: 2 * time.Minute,
+		outagePolicy:   custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyStaticFallback},
+	}
+	updated := p.UpdateExternalMetrics(outageTestMetrics(now))
+	require.Len(t, updated, 3)
+	assert.True(t, updated["fallback"].Valid)
+	assert.Equal(t, 3.0, updated["fallback"].Value)
+	assert.Equal(t, custommetrics.OutagePolicyStaticFallback, updated["fallback"].Outage)
+	// the metrics without a fallback value are invalidated
+	assert.False(t, updated["held"].Valid)
+	assert.False(t, updated["expired"].Valid)
+
+	// the fail-closed policy invalidates all the metrics
+	p.outagePolicy = custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyFailClosed}
+	for id, em := range p.UpdateExternalMetrics(outageTestMetrics(now)) {
+		assert.False(t, em.Valid, id)
+		assert.Empty(t, em.Outage, id)
+	}
+}
+
+func TestReportOutage(t *testing.T) {
+	config := custommetrics.OutagePolicyConfig{Policy: custommetrics.OutagePolicyHoldLastValue, MaxAge: 10 * time.Minute}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	state := func() map[string]interface{} {
+		values := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(outageExpvars.String()), &values))
+		return values
+	}
+
+	ReportOutage(config, true, 2, start)
+	ReportOutage(config, true, 3, start.Add(time.Minute))
+	values := state()
+	assert.Equal(t, "hold-last-value", values["Policy"])
+	assert.Equal(t, "10m0s", values["MaxAge"])
+	assert.Equal(t, 1.0, values["Active"])
+	// the outage started at the first refresh which couldn't query Datadog
+	assert.Equal(t, start.Format(time.RFC3339), values["Since"])
+	assert.Equal(t, 3.0, values["Served"])
+
+	ReportOutage(config, false, 0, start.Add(2*time.Minute))
+	values = state()
+	assert.Equal(t, 0.0, values["Active"])
+	assert.Equal(t, "", values["Since"])
+	assert.Equal(t, 0.0, values["Served"])
+}
@@ -0,0 +1,59 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+// Select returns the point whose value is selected among the points of its window: the highest
+// or the lowest one with its timestamp, or their average with the timestamp of the end of the
+// window. The point is returned as is for the last point selection, or when it has no window.
+// The unit conversion of the point applies to the selected value.
+// The freshness of a point is checked before the selection, from the end of its window, so that
+// an older highest point doesn't invalidate the metric.
+func (p Point) Select(selection custommetrics.PointSelection) Point {
+	if !p.Valid || len(p.Window) == 0 {
+		return p
+	}
+
+	selected := p.Window[len(p.Window)-1]
+	switch selection {
+	case custommetrics.PointSelectionMax:
+		// the most recent of the highest points
+		for i := len(p.Window) - 1; i >= 0; i-- {
+			if p.Window[i].Value > selected.Value {
+				selected = p.Window[i]
+			}
+		}
+	case custommetrics.PointSelectionMin:
+		for i := len(p.Window) - 1; i >= 0; i-- {
+			if p.Window[i].Value < selected.Value {
+				selected = p.Window[i]
+			}
+		}
+	case custommetrics.PointSelectionAvg:
+		var sum float64
+		for _, wp := range p.Window {
+			sum += wp.Value
+		}
+		selected.Value = sum / float64(len(p.Window))
+	default:
+		return p
+	}
+
+	p.Timestamp = selected.Timestamp
+	p.Value = selected.Value
+	if p.Conversion != nil {
+		conversion := *p.Conversion
+		conversion.RawValue = selected.Value
+		p.Conversion = &conversion
+		p.Value *= conversion.Factor
+	}
+	return p
+}
@@ -0,0 +1,140 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+// querySparseSerie returns the point of a sparse serie, with empty buckets between its points and
+// a last point skipped as it can still change
+func querySparseSerie(t *testing.T) Point {
+	t.Helper()
+	p := Processor{datadogClient: &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{{
+				Points: []datadog.DataPoint{
+					makePartialPoints(90000),
+					makePoints(100000, 40),
+					makePartialPoints(110000),
+					makePoints(120000, 80),
+					makePoints(130000, 20),
+					makePartialPoints(140000),
+					makePoints(150000, 80),
+					makePoints(160000, 30),
+					makePoints(170000, 1000),
+					makePartialPoints(180000),
+				},
+				Scope:      makePtr("foo:bar"),
+				Metric:     makePtr("mymetric"),
+				QueryIndex: makePtrInt(0),
+			}}, nil
+		},
+	}}
+	points, err := p.queryDatadogExternal([]string{"avg:mymetric{foo:bar}.rollup(30)"}, 30, 0)
+	require.NoError(t, err)
+	point := points["avg:mymetric{foo:bar}.rollup(30)"]
+	require.True(t, point.Valid)
+	return point
+}
+
+func TestQueryDatadogExternalWindow(t *testing.T) {
+	point := querySparseSerie(t)
+
+	// the empty buckets and the skipped last point aren't part of the window
+	assert.Equal(t, 30.0, point.Value)
+	assert.Equal(t, int64(160), point.Timestamp)
+	assert.Equal(t, []WindowPoint{
+		{Value: 40, Timestamp: 100},
+		{Value: 80, Timestamp: 120},
+		{Value: 20, Timestamp: 130},
+		{Value: 80, Timestamp: 150},
+		{Value: 30, Timestamp: 160},
+	}, point.Window)
+}
+
+func TestPointSelect(t *testing.T) {
+	point := querySparseSerie(t)
+
+	for _, test := range []struct {
+		selection custommetrics.PointSelection
+		value     float64
+		timestamp int64
+	}{
+		{"", 30, 160},
+		{custommetrics.PointSelectionLast, 30, 160},
+		// the most recent of the highest points
+		{custommetrics.PointSelectionMax, 80, 150},
+		{custommetrics.PointSelectionMin, 20, 130},
+		// the average of the points with a value, at the end of the window
+		{custommetrics.PointSelectionAvg, 50, 160},
+	} {
+		t.Run(string(test.selection), func(t *testing.T) {
+			selected := point.Select(test.selection)
+			assert.True(t, selected.Valid)
+			assert.Equal(t, test.value, selected.Value)
+			assert.Equal(t, test.timestamp, selected.Timestamp)
+		})
+	}
+}
+
+func TestPointSelectSinglePoint(t *testing.T) {
+	// the single point of a serie isn't skipped
+	p := Processor{datadogClient: &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{{
+				Points:     []datadog.DataPoint{makePoints(110000, 7)},
+				Scope:      makePtr("foo:bar"),
+				Metric:     makePtr("mymetric"),
+				QueryIndex: makePtrInt(0),
+			}}, nil
+		},
+	}}
+	points, err := p.queryDatadogExternal([]string{"mymetric{foo:bar}"}, 30, 0)
+	require.NoError(t, err)
+	point := points["mymetric{foo:bar}"]
+	require.True(t, point.Valid)
+
+	for _, selection := range []custommetrics.PointSelection{custommetrics.PointSelectionLast, custommetrics.PointSelectionMax, custommetrics.PointSelectionMin, custommetrics.PointSelectionAvg} {
+		selected := point.Select(selection)
+		assert.Equal(t, 7.0, selected.Value, selection)
+		assert.Equal(t, int64(110), selected.Timestamp, selection)
+	}
+}
+
+func TestPointSelectConversion(t *testing.T) {
+	point := Point{
+		Value:      0.3,
+		Timestamp:  160,
+		Valid:      true,
+		Conversion: &custommetrics.UnitConversion{Spec: "millisecond->second", Factor: 0.001, RawValue: 300},
+		Window:     []WindowPoint{{Value: 500, Timestamp: 150}, {Value: 300, Timestamp: 160}},
+	}
+
+	selected := point.Select(custommetrics.PointSelectionMax)
+	assert.InDelta(t, 0.5, selected.Value, 1e-9)
+	assert.Equal(t, &custommetrics.UnitConversion{Spec: "millisecond->second", Factor: 0.001, RawValue: 500}, selected.Conversion)
+	// the conversion of the point isn't changed
+	assert.Equal(t, 300.0, point.Conversion.RawValue)
+}
+
+func TestPointSelectWithoutWindow(t *testing.T) {
+	// the merged points and the values of the formulas are returned as is, as are the invalid points
+	for _, point := range []Point{
+		{Value: 12, Timestamp: 100, Valid: true},
+		{Value: 0, Timestamp: 100, Valid: false, Window: []WindowPoint{{Value: 5, Timestamp: 90}}},
+	} {
+		assert.Equal(t, point, point.Select(custommetrics.PointSelectionMax))
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"math"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,6 +40,7 @@ const (
 type DatadogClient interface {
 	QueryMetrics(from, to int64, query string) ([]datadog.Series, error)
 	GetRateLimitStats() map[string]datadog.RateLimit
+	PostEvent(event *datadog.Event) (*datadog.Event, error)
 }
 
 // ProcessorInterface is used to easily mock the interface for testing
@@ -52,6 +54,22 @@ type ProcessorInterface interface {
 type Processor struct {
 	externalMaxAge time.Duration
 	datadogClient  DatadogClient
+	transitions    transitionReporter
+	limits         metricLimiter
+	rateLimit      rateLimitGuard
+	costs          *queryCosts
+	// ingestionDelay is the default number of seconds the query window is shifted back by, and
+	// metricIngestionDelays overrides it by metric name, for the metrics arriving late in Datadog
+	ingestionDelay        int64
+	metricIngestionDelays map[string]int64
+	// unitConversions are the conversions of the values of the metrics, by metric name
+	unitConversions map[string]unitConversion
+	// scalarClient evaluates the formula queries with the v2 scalar query API, nil when they are disabled
+	scalarClient *scalarClient
+	// outagePolicy is how the external metrics are served while Datadog can't be queried
+	outagePolicy custommetrics.OutagePolicyConfig
+	// served holds the metrics of the last refresh exposed on the Prometheus endpoint, nil when it is disabled
+	served *servedMetrics
 }
 
 // queryResponse ensures that we capture all the signals from the call to Datadog's backend.
@@ -63,10 +81,59 @@ type queryResponse struct {
 // NewProcessor returns a new Processor
 func NewProcessor(datadogCl DatadogClient) *Processor {
 	externalMaxAge := math.Max(config.Datadog.GetFloat64("external_metrics_provider.max_age"), 3*config.Datadog.GetFloat64("external_metrics_provider.rollup"))
+	var scalarCl *scalarClient
+	if config.Datadog.GetBool("external_metrics_provider.enable_v2_formulas") {
+		var err error
+		if scalarCl, err = newScalarClient(); err != nil {
+			log.Errorf("Could not initialize the client of the v2 scalar query API, the formula queries are disabled: %v", err)
+		}
+	}
+	var served *servedMetrics
+	if ServedMetricsEndpointEnabled() {
+		served = globalServedMetrics
+	}
 	return &Processor{
 		externalMaxAge: time.Duration(externalMaxAge) * time.Second,
 		datadogClient:  datadogCl,
+		transitions: transitionReporter{
+			enabled:     config.Datadog.GetBool("external_metrics_provider.invalid_metric_events"),
+			minInterval: config.Datadog.GetDuration("external_metrics_provider.invalid_metric_events_interval") * time.Second,
+		},
+		rateLimit:             newRateLimitGuard(config.Datadog.GetInt("external_metrics_provider.min_remaining_requests"), time.Duration(externalMaxAge)*time.Second),
+		costs:                 globalQueryCosts,
+		ingestionDelay:        config.Datadog.GetInt64("external_metrics_provider.ingestion_delay"),
+		metricIngestionDelays: parseIngestionDelays(config.Datadog.GetStringMapString("external_metrics_provider.metric_ingestion_delays")),
+		unitConversions:       configuredUnitConversions(),
+		scalarClient:          scalarCl,
+		outagePolicy:          custommetrics.GetOutagePolicyConfig(),
+		served:                served,
+	}
+}
+
+// parseIngestionDelays parses the ingestion delays in seconds by metric name, ignoring the invalid ones
+func parseIngestionDelays(raw map[string]string) map[string]int64 {
+	delays := make(map[string]int64, len(raw))
+	for metric, value := range raw {
+		delay, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || delay < 0 {
+			log.Warnf("Ignoring the invalid ingestion delay %q of the metric %s, it must be a positive number of seconds", value, metric)
+			continue
+		}
+		delays[metric] = delay
+	}
+	return delays
+}
+
+// queryIngestionDelay returns the ingestion delay of a query, the highest one of the metrics it
+// queries or the default one
+func (p *Processor) queryIngestionDelay(query string) int64 {
+	delay := p.ingestionDelay
+	for metric, metricDelay := range p.metricIngestionDelays {
+		if metricDelay > delay && strings.Contains(query, ":"+metric+"{") {
+			delay = metricDelay
+		}
 	}
+	return delay
 }
 
 // ProcessEMList processes a list of ExternalMetricValue.
@@ -122,9 +189,14 @@ func (p *Processor) UpdateExternalMetrics(emList map[string]custommetrics.Extern
 	var err error
 	updated = make(map[string]custommetrics.ExternalMetricValue)
 
-	uniqueQueries := make(map[string]struct{}, len(emList))
-	batch := make([]string, 0, len(emList))
-	for _, e := range emList {
+	// the metrics over the limits are invalid and not queried
+	maxMetrics, maxPerNamespace := metricLimits()
+	admitted, rejected := p.limits.admit(emList, maxMetrics, maxPerNamespace)
+	p.limits.report(p.datadogClient, emList, rejected, aggregator, rollup)
+
+	uniqueQueries := make(map[string]struct{}, len(admitted))
+	batch := make([]string, 0, len(admitted))
+	for _, e := range admitted {
 		q := getKey(e.MetricName, e.Labels, aggregator, rollup)
 		if _, found := uniqueQueries[q]; !found {
 			uniqueQueries[q] = struct{}{}
@@ -132,79 +204,290 @@ func (p *Processor) UpdateExternalMetrics(emList map[string]custommetrics.Extern
 		}
 	}
 
+	// reasons holds why the invalid metrics are, for the transition events
+	reasons := make(map[string]string)
+	defer func() {
+		p.transitions.report(p.datadogClient, emList, updated, reasons, aggregator, rollup)
+		if p.served != nil {
+			p.served.set(updated)
+		}
+	}()
+
+	for id := range rejected {
+		em := emList[id]
+		reasons[id] = invalidReasonLimitExceeded
+		em.Valid = false
+		em.Value = 0
+		em.Conversion = nil
+		em.Timestamp = time.Now().Unix()
+		updated[id] = em
+	}
+
+	if p.costs != nil {
+		p.costs.setOwners(admitted, aggregator, rollup)
+	}
+
 	metrics, err := p.QueryExternalMetric(batch)
 	if len(metrics) == 0 && err != nil {
 		log.Errorf("Error getting metrics from Datadog: %v", err.Error())
 		// If no metrics can be retrieved from Datadog in a given list, we need to invalidate them
-		// To avoid undesirable autoscaling behaviors
-		return invalidate(emList)
+		// To avoid undesirable autoscaling behaviors, unless the outage policy serves them
+		now := time.Now()
+		served := 0
+		invalid := make(map[string]custommetrics.ExternalMetricValue)
+		for id, em := range admitted {
+			if outageEm, ok := p.serveDuringOutage(em, now); ok {
+				updated[id] = outageEm
+				served++
+			} else {
+				invalid[id] = em
+			}
+		}
+		for id, em := range invalidate(invalid) {
+			reasons[id] = invalidReasonAPIError
+			updated[id] = em
+		}
+		ReportOutage(p.outagePolicy, true, served, now)
+		return updated
 	}
+	ReportOutage(p.outagePolicy, false, 0, time.Now())
 
-	for id, em := range emList {
+	for id, em := range admitted {
+		em.Outage = ""
 		metricIdentifier := getKey(em.MetricName, em.Labels, aggregator, rollup)
-		metric := metrics[metricIdentifier]
-
-		if time.Now().Unix()-metric.Timestamp > maxAge || !metric.Valid {
+		metric, found := metrics[metricIdentifier]
+
+		if time.Now().Unix()-metric.Timestamp > maxAge+metric.IngestionDelay || !metric.Valid {
+			switch {
+			case !found:
+				// the chunk of the query failed
+				reasons[id] = invalidReasonAPIError
+			case metric.Error != nil:
+				reasons[id] = invalidReasonInvalidQuery
+			case !metric.Valid:
+				reasons[id] = invalidReasonEmptySeries
+			default:
+				reasons[id] = invalidReasonStale
+			}
 			// invalidating sparse metrics that are outdated
 			em.Valid = false
 			em.Value = metric.Value
+			em.Conversion = metric.Conversion
 			em.Timestamp = time.Now().Unix()
 			updated[id] = em
 			continue
 		}
 
+		// the freshness is checked from the end of the query window, whatever the point selected
+		selected := metric.Select(em.PointSelection)
 		em.Valid = true
-		em.Value = metric.Value
+		em.Value = selected.Value
+		em.Conversion = selected.Conversion
 		em.Timestamp = metric.Timestamp
+		em.ValueTimestamp = selected.Timestamp
 		log.Debugf("Updated the external metric %s{%v} for %s %s/%s", em.MetricName, em.Labels, em.Ref.Type, em.Ref.Namespace, em.Ref.Name)
 		updated[id] = em
 	}
 	return updated
 }
 
+// serveDuringOutage returns the external metric as served by the outage policy while Datadog
+// can't be queried, false when it must be invalidated. The value held by the hold-last-value
+// policy keeps the timestamp of the last valid point, so that it expires after the max age of
+// the policy however long the outage lasts.
+func (p *Processor) serveDuringOutage(em custommetrics.ExternalMetricValue, now time.Time) (custommetrics.ExternalMetricValue, bool) {
+	var lastValidTime time.Time
+	if em.Valid && em.Outage != custommetrics.OutagePolicyStaticFallback {
+		lastValidTime = time.Unix(em.Timestamp, 0)
+	}
+	value, timestamp, ok := p.outagePolicy.Serve(em.Value, lastValidTime, em.FallbackValue, now)
+	if !ok {
+		return em, false
+	}
+	if p.outagePolicy.Policy == custommetrics.OutagePolicyStaticFallback {
+		em.Conversion = nil
+	}
+	em.Valid = true
+	em.Value = value
+	em.Timestamp = timestamp.Unix()
+	em.Outage = p.outagePolicy.Policy
+	return em, true
+}
+
 // QueryExternalMetric queries Datadog to validate the availability and value of one or more external metrics
 // Also updates the rate limits statistics as a result of the query.
+// While the queries are paused to preserve the rate limit, the last results are returned instead.
 func (p *Processor) QueryExternalMetric(queries []string) (processed map[string]Point, err error) {
 	processed = make(map[string]Point)
 	if len(queries) == 0 {
 		return processed, nil
 	}
 
+	now := time.Now()
+	if p.rateLimit.paused(now) {
+		log.Debugf("Queries to Datadog are paused, serving the cached values of %d queries", len(queries))
+		return p.rateLimit.cached(queries), errRateLimitGuard
+	}
+	p.rateLimit.resume(now)
+
+	var errors []error
+	// Formula queries are evaluated one by one with the v2 scalar query API
+	var formulas []string
+	// Queries that cannot fit in a single call are split into sub-queries whose results are merged afterwards.
+	// Queries that cannot be split safely are flagged as invalid with the reason.
+	splitQueries := make(map[string][]string)
+	uniqueQueries := make(map[string]struct{}, len(queries))
+	batch := make([]string, 0, len(queries))
+	addToBatch := func(q string) {
+		if _, found := uniqueQueries[q]; !found {
+			uniqueQueries[q] = struct{}{}
+			batch = append(batch, q)
+		}
+	}
+	for _, q := range queries {
+		if isFormulaQuery(q) {
+			if _, found := uniqueQueries[q]; !found {
+				uniqueQueries[q] = struct{}{}
+				formulas = append(formulas, q)
+			}
+			continue
+		}
+		if !isQueryBeyondLimits(q) {
+			addToBatch(q)
+			continue
+		}
+		subQueries, err := splitQuery(q)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", err.Error(), q)
+			log.Warn(err)
+			processed[q] = Point{Timestamp: time.Now().Unix(), Error: err}
+			errors = append(errors, err)
+			continue
+		}
+		log.Debugf("Query is too long, split into %d queries: %s", len(subQueries), q)
+		splitQueries[q] = subQueries
+		for _, subQuery := range subQueries {
+			addToBatch(subQuery)
+		}
+	}
+
 	bucketSize := config.Datadog.GetInt64("external_metrics_provider.bucket_size")
-	chunks := makeChunks(queries)
+	// the queries are grouped by ingestion delay as they share the query window of their chunk
+	var delays []int64
+	delayedBatches := make(map[int64][]string)
+	for _, q := range batch {
+		delay := p.queryIngestionDelay(q)
+		if _, found := delayedBatches[delay]; !found {
+			delays = append(delays, delay)
+		}
+		delayedBatches[delay] = append(delayedBatches[delay], q)
+	}
+	var chunks [][]string
+	var chunkDelays []int64
+	for _, delay := range delays {
+		for _, chunk := range makeChunks(delayedBatches[delay]) {
+			chunks = append(chunks, chunk)
+			chunkDelays = append(chunkDelays, delay)
+		}
+	}
 	log.Tracef("List of batches %v", chunks)
+	if p.costs != nil {
+		costChunks := chunks
+		if p.scalarClient != nil {
+			// each formula is a call of its own
+			for _, f := range formulas {
+				costChunks = append(costChunks, []string{f})
+			}
+		}
+		p.costs.record(queries, splitQueries, costChunks)
+	}
 
 	// we have a number of chunks with `chunkSize` metrics.
-	responses := make(chan queryResponse, len(queries))
+	responses := make(chan queryResponse, len(chunks)+len(formulas))
+
+	// each formula is a call of its own, they are sent by a bounded number of workers
+	formulaWorkers := config.Datadog.GetInt("external_metrics_provider.max_parallel_formulas")
+	if formulaWorkers <= 0 {
+		formulaWorkers = 1
+	}
+	if formulaWorkers > len(formulas) {
+		formulaWorkers = len(formulas)
+	}
+	formulaQueue := make(chan string, len(formulas))
+	for _, f := range formulas {
+		formulaQueue <- f
+	}
+	close(formulaQueue)
 
 	var waitResp sync.WaitGroup
-	waitResp.Add(len(chunks))
-	for _, c := range chunks {
-		go func(chunk []string) {
+	waitResp.Add(len(chunks) + formulaWorkers)
+	for i, c := range chunks {
+		go func(chunk []string, ingestionDelay int64) {
 			defer waitResp.Done()
-			resp, err := p.queryDatadogExternal(chunk, bucketSize)
+			resp, err := p.queryDatadogExternal(chunk, bucketSize, ingestionDelay)
 			responses <- queryResponse{resp, err}
-		}(c)
+		}(c, chunkDelays[i])
+	}
+	for i := 0; i < formulaWorkers; i++ {
+		go func() {
+			defer waitResp.Done()
+			for formula := range formulaQueue {
+				point := p.queryFormula(formula, bucketSize, p.queryIngestionDelay(formula))
+				// the error of a formula is reported on its point only, the other queries are not affected
+				responses <- queryResponse{metrics: map[string]Point{formula: point}}
+			}
+		}()
 	}
 	waitResp.Wait()
 	close(responses)
-	var errors []error
+	results := make(map[string]Point, len(batch))
 	for elem := range responses {
 		for k, v := range elem.metrics {
-			processed[k] = v
+			results[k] = v
 		}
 		if elem.err != nil {
 			errors = append(errors, elem.err)
 		}
 	}
-	log.Debugf("Processed %d chunks", len(chunks))
+	for _, q := range queries {
+		if subQueries, found := splitQueries[q]; found {
+			point := mergePoints(q, subQueries, results)
+			if !point.Valid {
+				point.Timestamp = time.Now().Unix()
+			}
+			processed[q] = p.convertPoint(q, point)
+		} else if point, found := results[q]; found {
+			processed[q] = p.convertPoint(q, point)
+		}
+	}
+	log.Debugf("Processed %d chunks and %d formulas", len(chunks), len(formulas))
 
 	if err := p.updateRateLimitingMetrics(); err != nil {
 		errors = append(errors, err)
 	}
+	queryLimits := p.mostConstrainedRateLimit()
+	p.rateLimit.update(processed, queryLimits.Remaining, queryLimits.Reset, time.Now())
 	return processed, utilserror.NewAggregate(errors)
 }
 
+// mostConstrainedRateLimit returns the rate limit of the query endpoint with the fewest remaining
+// requests, the queries being paused as soon as one of them runs low
+func (p *Processor) mostConstrainedRateLimit() datadog.RateLimit {
+	queryLimits := p.datadogClient.GetRateLimitStats()[queryEndpoint]
+	if p.scalarClient == nil {
+		return queryLimits
+	}
+	scalarLimits := p.scalarClient.getRateLimits()
+	scalarRemaining, err := strconv.Atoi(scalarLimits.Remaining)
+	if err != nil {
+		return queryLimits
+	}
+	if remaining, err := strconv.Atoi(queryLimits.Remaining); err == nil && remaining <= scalarRemaining {
+		return queryLimits
+	}
+	return scalarLimits
+}
+
 func isURLBeyondLimits(uriLength, numBuckets int) (bool, error) {
 	// The metric name can be at maximum 200 characters. Kubernetes limits the labels to 63 characters.
 	// Autoscalers with enough labels to form single a query of more than 7k characters are not supported.
@@ -245,6 +528,7 @@ func invalidate(emList map[string]custommetrics.ExternalMetricValue) (invList ma
 	invList = make(map[string]custommetrics.ExternalMetricValue)
 	for id, e := range emList {
 		e.Valid = false
+		e.Outage = ""
 		e.Timestamp = metav1.Now().Unix()
 		invList[id] = e
 	}
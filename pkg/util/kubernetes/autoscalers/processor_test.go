@@ -18,17 +18,20 @@ import (
 	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
 	le "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection/metrics"
 
+	"github.com/DataDog/watermarkpodautoscaler/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/zorkian/go-datadog-api.v2"
 	autoscalingv2 "k8s.io/api/autoscaling/v2beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/rand"
 )
 
 type fakeDatadogClient struct {
 	queryMetricsFunc  func(from, to int64, query string) ([]datadog.Series, error)
 	getRateLimitsFunc func() map[string]datadog.RateLimit
+	postEventFunc     func(event *datadog.Event) (*datadog.Event, error)
 }
 
 func (d *fakeDatadogClient) QueryMetrics(from, to int64, query string) ([]datadog.Series, error) {
@@ -45,6 +48,13 @@ func (d *fakeDatadogClient) GetRateLimitStats() map[string]datadog.RateLimit {
 	return nil
 }
 
+func (d *fakeDatadogClient) PostEvent(event *datadog.Event) (*datadog.Event, error) {
+	if d.postEventFunc != nil {
+		return d.postEventFunc(event)
+	}
+	return event, nil
+}
+
 var maxAge = 30 * time.Second
 
 func makePoints(ts, val int) datadog.DataPoint {
@@ -194,6 +204,7 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 			strippedTs := make(map[string]custommetrics.ExternalMetricValue)
 			for id, m := range externalMetrics {
 				m.Timestamp = 0
+				m.ValueTimestamp = 0
 				strippedTs[id] = m
 			}
 			fmt.Println(strippedTs)
@@ -230,6 +241,73 @@ func TestProcessor_UpdateExternalMetrics(t *testing.T) {
 
 }
 
+func TestProcessor_HPAAndWPASharingQuery(t *testing.T) {
+	metricName := "requests_per_s"
+	var queries []string
+	var queriesMu sync.Mutex
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			queriesMu.Lock()
+			queries = append(queries, query)
+			queriesMu.Unlock()
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Points: []datadog.DataPoint{makePoints(int(time.Now().Unix())*1000, 42)},
+					Scope:  makePtr("app:nginx"),
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient, externalMaxAge: maxAge}
+
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{UID: types.UID("hpa-uid"), Namespace: "default", Name: "nginx"},
+		Spec:       makeSpec(metricName, map[string]string{"app": "nginx"}),
+	}
+	wpa := &v1alpha1.WatermarkPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{UID: types.UID("wpa-uid"), Namespace: "default", Name: "nginx"},
+		Spec:       makeWPASpec(metricName, map[string]string{"app": "nginx"}),
+	}
+
+	// the controllers of both kinds of autoscalers store their metrics in the same list
+	emList := p.ProcessEMList(InspectHPA(hpa))
+	for id, em := range p.ProcessEMList(InspectWPA(wpa)) {
+		emList[id] = em
+	}
+	require.Len(t, emList, 2)
+
+	// the query is only issued once, each autoscaler keeps its own metric
+	updated := p.UpdateExternalMetrics(emList)
+	require.Len(t, queries, 1)
+	assert.Contains(t, queries[0], "requests_per_s{app:nginx}")
+	require.Len(t, updated, 2)
+	for _, em := range updated {
+		assert.True(t, em.Valid)
+		assert.Equal(t, 42.0, em.Value)
+	}
+
+	// the metric of the deleted autoscaler is garbage collected, the
+	// remaining one is still queried
+	var stored []custommetrics.ExternalMetricValue
+	for _, em := range updated {
+		stored = append(stored, em)
+	}
+	toDelete := DiffExternalMetrics(nil, []*v1alpha1.WatermarkPodAutoscaler{wpa}, stored)
+	require.Len(t, toDelete, 1)
+	assert.Equal(t, "horizontal", toDelete[0].Ref.Type)
+	delete(updated, custommetrics.ExternalMetricValueKeyFunc(toDelete[0]))
+
+	queries = nil
+	updated = p.UpdateExternalMetrics(updated)
+	require.Len(t, queries, 1)
+	require.Len(t, updated, 1)
+	for _, em := range updated {
+		assert.Equal(t, "watermark", em.Ref.Type)
+		assert.True(t, em.Valid)
+	}
+}
+
 var ASCIIRunes = []rune("qwertyuiopasdfghjklzxcvbnm1234567890")
 
 func randStringRune(n int) string {
@@ -240,6 +318,98 @@ func randStringRune(n int) string {
 	return string(b)
 }
 
+// laggingSeries returns a series with a point every 30 seconds over the queried window, the
+// points more recent than lag seconds being empty as they haven't been ingested yet
+func laggingSeries(metricName string, from, to, lag int64) datadog.Series {
+	var points []datadog.DataPoint
+	ingested := time.Now().Unix() - lag
+	for ts := from - from%30 + 30; ts <= to; ts += 30 {
+		if ts > ingested {
+			points = append(points, makePartialPoints(int(ts)*1000))
+		} else {
+			points = append(points, makePoints(int(ts)*1000, 42))
+		}
+	}
+	return datadog.Series{Metric: &metricName, Points: points, Scope: makePtr("app:nginx")}
+}
+
+func TestProcessor_IngestionDelay(t *testing.T) {
+	metricName := "logs.requests"
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"external_metric-default-foo-logs.requests": {
+			MetricName: metricName,
+			Labels:     map[string]string{"app": "nginx"},
+		},
+	}
+	var windowEnd int64
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			windowEnd = to
+			return []datadog.Series{laggingSeries(metricName, from, to, 150)}, nil
+		},
+	}
+
+	// without delay, the trailing points of the window are empty and the most recent one is stale
+	p := &Processor{datadogClient: datadogClient, externalMaxAge: 2 * time.Minute}
+	updated := p.UpdateExternalMetrics(emList)
+	require.Len(t, updated, 1)
+	for _, em := range updated {
+		assert.False(t, em.Valid)
+	}
+
+	// the window ends before the ingestion lag, the freshness check accounts for the delay
+	p = &Processor{
+		datadogClient:         datadogClient,
+		externalMaxAge:        2 * time.Minute,
+		metricIngestionDelays: map[string]int64{metricName: 120},
+	}
+	now := time.Now().Unix()
+	updated = p.UpdateExternalMetrics(emList)
+	assert.InDelta(t, now-120, windowEnd, 2)
+	require.Len(t, updated, 1)
+	for _, em := range updated {
+		assert.True(t, em.Valid)
+		assert.Equal(t, 42.0, em.Value)
+		// the timestamp is the one of the selected point, older than the delay
+		assert.True(t, now-em.Timestamp >= 150, "timestamp %d isn't the one of an ingested point", em.Timestamp)
+	}
+}
+
+func TestProcessor_QueriesGroupedByIngestionDelay(t *testing.T) {
+	windows := make(map[string]int64)
+	var windowsMu sync.Mutex
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			windowsMu.Lock()
+			defer windowsMu.Unlock()
+			windows[query] = to
+			return nil, nil
+		},
+	}
+	p := &Processor{
+		datadogClient:         datadogClient,
+		ingestionDelay:        30,
+		metricIngestionDelays: map[string]int64{"logs.requests": 180},
+	}
+	now := time.Now().Unix()
+	_, _ = p.QueryExternalMetric([]string{
+		"avg:logs.requests{app:nginx}.rollup(30)",
+		"avg:nginx.net.request_per_s{app:nginx}.rollup(30)",
+		"avg:logs.requests_total{app:nginx}.rollup(30)",
+	})
+	require.Len(t, windows, 2)
+	assert.InDelta(t, now-180, windows["avg:logs.requests{app:nginx}.rollup(30)"], 2)
+	assert.InDelta(t, now-30, windows["avg:nginx.net.request_per_s{app:nginx}.rollup(30),avg:logs.requests_total{app:nginx}.rollup(30)"], 2)
+}
+
+func TestParseIngestionDelays(t *testing.T) {
+	assert.Equal(t, map[string]int64{"logs.requests": 120}, parseIngestionDelays(map[string]string{
+		"logs.requests": "120",
+		"invalid":       "2m",
+		"negative":      "-30",
+	}))
+}
+
 func TestValidateExternalMetricsBatching(t *testing.T) {
 	metricName := "foo"
 	penTime := (int(time.Now().Unix()) - int(maxAge.Seconds()/2)) * 1000
@@ -328,7 +498,7 @@ func TestValidateExternalMetricsBatching(t *testing.T) {
 				},
 			},
 			batchCalls: 0,
-			err:        nil,
+			err:        fmt.Errorf("query is too long"),
 			timeout:    false,
 		},
 		{
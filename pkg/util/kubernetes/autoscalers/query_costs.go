@@ -0,0 +1,222 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+// queryCostsExpvarName is the name of the expvar map exposing the Datadog API calls attributed
+// to each external metric.
+const queryCostsExpvarName = "external-metrics-query-costs"
+
+// globalQueryCosts is shared by the processors, so that the costs are exposed in a single expvar.
+var globalQueryCosts = newQueryCosts()
+
+func init() {
+	expvar.Publish(queryCostsExpvarName, expvar.Func(func() interface{} {
+		return globalQueryCosts.report()
+	}))
+}
+
+// MetricQueryCost is the usage of the Datadog API attributed to an external metric.
+type MetricQueryCost struct {
+	// Queries is the number of times the metric was queried
+	Queries int64 `json:"queries"`
+	// APICalls is the number of calls to the query API attributed to the metric, the calls
+	// querying several metrics at once are shared between them
+	APICalls float64 `json:"api_calls"`
+	// Autoscalers are the autoscalers using the metric, as <type>:<namespace>/<name>
+	Autoscalers []string `json:"autoscalers"`
+}
+
+// queryOwner is the external metric a query was built from, and the autoscalers using it
+type queryOwner struct {
+	metricName  string
+	autoscalers []string
+}
+
+// queryCosts attributes the calls to the query API to the external metrics queried. The calls
+// are made per chunk of queries, each query of a chunk is attributed an equal share of the call,
+// and the sub-queries of a split query attribute their share to it.
+type queryCosts struct {
+	sync.Mutex
+	// owners maps the queries of the external metrics to their metric, the queries without
+	// owner, such as the ones of the DatadogMetrics, are reported as themselves
+	owners  map[string]queryOwner
+	metrics map[string]*MetricQueryCost
+	// totalCalls is the number of calls to the query API made
+	totalCalls int64
+}
+
+func newQueryCosts() *queryCosts {
+	return &queryCosts{
+		owners:  make(map[string]queryOwner),
+		metrics: make(map[string]*MetricQueryCost),
+	}
+}
+
+// PruneQueryCosts removes the costs of the queries which aren't refreshed anymore, such as the
+// ones of the deleted DatadogMetrics. The costs are kept for the given queries only.
+func PruneQueryCosts(queries []string) {
+	globalQueryCosts.pruneQueries(queries)
+}
+
+// setOwners replaces the owners of the queries with the external metrics being updated, the
+// costs of the metrics which aren't updated anymore are removed.
+func (c *queryCosts) setOwners(emList map[string]custommetrics.ExternalMetricValue, aggregator string, rollup int) {
+	owners := make(map[string]queryOwner, len(emList))
+	for _, em := range emList {
+		q := getKey(em.MetricName, em.Labels, aggregator, rollup)
+		owner := owners[q]
+		owner.metricName = em.MetricName
+		owner.autoscalers = append(owner.autoscalers, fmt.Sprintf("%s:%s/%s", em.Ref.Type, em.Ref.Namespace, em.Ref.Name))
+		owners[q] = owner
+	}
+	for _, owner := range owners {
+		sort.Strings(owner.autoscalers)
+	}
+
+	// the autoscalers of the metrics are replaced, a deleted autoscaler isn't reported anymore
+	autoscalers := make(map[string][]string, len(owners))
+	for _, owner := range owners {
+		autoscalers[owner.metricName] = mergeAutoscalers(autoscalers[owner.metricName], owner.autoscalers)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.owners = owners
+	for key, cost := range c.metrics {
+		metricAutoscalers, found := autoscalers[key]
+		if !found {
+			delete(c.metrics, key)
+			continue
+		}
+		cost.Autoscalers = metricAutoscalers
+	}
+}
+
+// pruneQueries removes the costs of the queries which aren't in the given ones, the costs of
+// the owned queries are pruned on each update of their owners.
+func (c *queryCosts) pruneQueries(queries []string) {
+	active := make(map[string]struct{}, len(queries))
+	for _, q := range queries {
+		active[q] = struct{}{}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, owner := range c.owners {
+		active[owner.metricName] = struct{}{}
+	}
+	for key := range c.metrics {
+		if _, found := active[key]; !found {
+			delete(c.metrics, key)
+		}
+	}
+}
+
+// record attributes the calls made for the given chunks of queries to the queries they were
+// built from. The calls are attributed whether they succeeded or not.
+func (c *queryCosts) record(queries []string, splitQueries map[string][]string, chunks [][]string) {
+	// batchOwners maps the queries of the chunks to the queries they were built from, a
+	// sub-query shared by several queries splits its share between them
+	batchOwners := make(map[string][]string, len(queries))
+	seen := make(map[string]struct{}, len(queries))
+	for _, q := range queries {
+		if _, found := seen[q]; found {
+			continue
+		}
+		seen[q] = struct{}{}
+		if subQueries, found := splitQueries[q]; found {
+			for _, subQuery := range subQueries {
+				batchOwners[subQuery] = append(batchOwners[subQuery], q)
+			}
+			continue
+		}
+		batchOwners[q] = append(batchOwners[q], q)
+	}
+
+	calls := make(map[string]float64, len(queries))
+	var totalCalls int64
+	for _, chunk := range chunks {
+		if len(chunk) == 0 {
+			// no call is made for an empty chunk
+			continue
+		}
+		totalCalls++
+		share := 1 / float64(len(chunk))
+		for _, b := range chunk {
+			owners := batchOwners[b]
+			for _, q := range owners {
+				calls[q] += share / float64(len(owners))
+			}
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.totalCalls += totalCalls
+	for q, call := range calls {
+		key, autoscalers := q, []string(nil)
+		if owner, found := c.owners[q]; found {
+			key, autoscalers = owner.metricName, owner.autoscalers
+		}
+		cost, found := c.metrics[key]
+		if !found {
+			cost = &MetricQueryCost{}
+			c.metrics[key] = cost
+		}
+		cost.Queries++
+		cost.APICalls += call
+		if autoscalers != nil {
+			cost.Autoscalers = mergeAutoscalers(cost.Autoscalers, autoscalers)
+		}
+	}
+}
+
+// mergeAutoscalers returns the sorted union of two sorted lists of autoscalers
+func mergeAutoscalers(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// report returns a copy of the costs of the metrics, by metric name.
+func (c *queryCosts) report() map[string]MetricQueryCost {
+	c.Lock()
+	defer c.Unlock()
+	report := make(map[string]MetricQueryCost, len(c.metrics))
+	for key, cost := range c.metrics {
+		report[key] = MetricQueryCost{
+			Queries:     cost.Queries,
+			APICalls:    cost.APICalls,
+			Autoscalers: append([]string(nil), cost.Autoscalers...),
+		}
+	}
+	return report
+}
@@ -0,0 +1,129 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+func TestQueryCostsAttribution(t *testing.T) {
+	costs := newQueryCosts()
+
+	emList := make(map[string]custommetrics.ExternalMetricValue)
+	var queries []string
+	for i := 0; i < 2*chunkSize+3; i++ {
+		em := custommetrics.ExternalMetricValue{
+			MetricName: fmt.Sprintf("requests.%d", i%7),
+			Labels:     map[string]string{"app": fmt.Sprintf("app-%d", i)},
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Namespace: "default", Name: fmt.Sprintf("hpa-%d", i)},
+		}
+		emList[fmt.Sprintf("id-%d", i)] = em
+		queries = append(queries, getKey(em.MetricName, em.Labels, "avg", 30))
+	}
+	costs.setOwners(emList, "avg", 30)
+
+	// a query split in sub-queries, one of them shared with another query of the batch
+	splitQueries := map[string][]string{queries[0]: {"sub-0", queries[1]}}
+	// the queries are repeated in the list, the batch is deduplicated
+	queries = append(queries, queries[2])
+	batch := []string{"sub-0"}
+	batch = append(batch, queries[1:len(queries)-1]...)
+
+	for round := 0; round < 3; round++ {
+		chunks := makeChunks(batch)
+		require.Len(t, chunks, 3)
+		costs.record(queries, splitQueries, chunks)
+	}
+	// an empty chunk doesn't make any call
+	costs.record(nil, nil, [][]string{nil})
+
+	report := costs.report()
+	assert.Len(t, report, 7)
+	var totalCalls float64
+	var totalQueries int64
+	for _, cost := range report {
+		totalCalls += cost.APICalls
+		totalQueries += cost.Queries
+	}
+	assert.Equal(t, int64(9), costs.totalCalls)
+	assert.InDelta(t, float64(costs.totalCalls), totalCalls, 1e-9)
+	assert.Equal(t, int64(3*(2*chunkSize+3)), totalQueries)
+	assert.Contains(t, report["requests.0"].Autoscalers, "horizontal:default/hpa-0")
+	assert.Contains(t, report["requests.0"].Autoscalers, "horizontal:default/hpa-7")
+}
+
+func TestQueryCostsWithoutOwner(t *testing.T) {
+	costs := newQueryCosts()
+	costs.record([]string{"avg:requests{app:a}", "avg:requests{app:b}"}, nil, [][]string{{"avg:requests{app:a}", "avg:requests{app:b}"}})
+
+	assert.Equal(t, map[string]MetricQueryCost{
+		"avg:requests{app:a}": {Queries: 1, APICalls: 0.5},
+		"avg:requests{app:b}": {Queries: 1, APICalls: 0.5},
+	}, costs.report())
+}
+
+func TestQueryCostsPrunedOnUpdate(t *testing.T) {
+	costs := newQueryCosts()
+	hpa := func(metricName, name string) custommetrics.ExternalMetricValue {
+		return custommetrics.ExternalMetricValue{
+			MetricName: metricName,
+			Labels:     map[string]string{"app": name},
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Namespace: "default", Name: name},
+		}
+	}
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"id-a": hpa("requests", "a"),
+		"id-b": hpa("requests", "b"),
+		"id-c": hpa("latency", "c"),
+	}
+	costs.setOwners(emList, "avg", 30)
+	var queries []string
+	for _, em := range emList {
+		queries = append(queries, getKey(em.MetricName, em.Labels, "avg", 30))
+	}
+	costs.record(queries, nil, [][]string{queries})
+	require.Len(t, costs.report(), 2)
+
+	// the autoscalers deleted aren't reported anymore, neither are the metrics they used
+	delete(emList, "id-b")
+	delete(emList, "id-c")
+	costs.setOwners(emList, "avg", 30)
+	assert.Equal(t, map[string]MetricQueryCost{
+		"requests": {Queries: 2, APICalls: 2.0 / 3, Autoscalers: []string{"horizontal:default/a"}},
+	}, costs.report())
+
+	costs.setOwners(nil, "avg", 30)
+	assert.Empty(t, costs.report())
+}
+
+func TestQueryCostsPruneQueries(t *testing.T) {
+	costs := newQueryCosts()
+	queries := []string{"avg:requests{app:a}", "avg:requests{app:b}"}
+	costs.record(queries, nil, [][]string{queries})
+
+	// the queries of the DatadogMetrics deleted aren't reported anymore
+	costs.pruneQueries(queries[:1])
+	assert.Equal(t, map[string]MetricQueryCost{
+		"avg:requests{app:a}": {Queries: 1, APICalls: 0.5},
+	}, costs.report())
+
+	costs.pruneQueries(nil)
+	assert.Empty(t, costs.report())
+}
+
+func TestMergeAutoscalers(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c", "d"}, mergeAutoscalers([]string{"a", "c"}, []string{"b", "c", "d"}))
+	assert.Equal(t, []string{"a"}, mergeAutoscalers(nil, []string{"a"}))
+	assert.Empty(t, mergeAutoscalers(nil, nil))
+}
@@ -0,0 +1,149 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	le "github.com/DataDog/datadog-agent/pkg/util/kubernetes/apiserver/leaderelection/metrics"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// rateLimitExpvarName is the name of the expvar map exposing the state of the rate limit guard.
+const rateLimitExpvarName = "external-metrics-rate-limit"
+
+var (
+	errRateLimitGuard = errors.New("queries to Datadog are paused until the rate limit resets, serving the cached values")
+
+	publishRateLimitExpvars sync.Once
+	rateLimitPaused         = expvar.Int{}
+	rateLimitRemaining      = expvar.Int{}
+	rateLimitPauseUntil     = expvar.String{}
+
+	rateLimitGuardPaused = telemetry.NewGaugeWithOpts("", "rate_limit_queries_paused",
+		[]string{"endpoint", le.JoinLeaderLabel}, "1 if the queries are paused until the rate limit resets, 0 otherwise",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+// newRateLimitGuard returns a guard pausing the queries below minRemaining remaining requests, its
+// state is only exposed in the expvars and the status when it is enabled.
+func newRateLimitGuard(minRemaining int, maxAge time.Duration) rateLimitGuard {
+	if minRemaining > 0 {
+		publishRateLimitExpvars.Do(func() {
+			rateLimitExpvars := expvar.NewMap(rateLimitExpvarName)
+			rateLimitExpvars.Set("Paused", &rateLimitPaused)
+			rateLimitExpvars.Set("Remaining", &rateLimitRemaining)
+			rateLimitExpvars.Set("PausedUntil", &rateLimitPauseUntil)
+		})
+	}
+	return rateLimitGuard{minRemaining: minRemaining, maxAge: maxAge}
+}
+
+// rateLimitGuard stops querying Datadog when the remaining requests of the org rate limit
+// drop below minRemaining, until the rate limit resets. The last results are cached
+// to be served while the queries are paused.
+type rateLimitGuard struct {
+	sync.Mutex
+	minRemaining int
+	maxAge       time.Duration
+	pausedUntil  time.Time
+	cache        map[string]Point
+}
+
+// paused returns whether the queries are paused at the given time.
+func (g *rateLimitGuard) paused(now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	return now.Before(g.pausedUntil)
+}
+
+// cached returns the last results of the given queries, their timestamps are left untouched
+// so that they are flagged as stale once they are older than the max age.
+func (g *rateLimitGuard) cached(queries []string) map[string]Point {
+	g.Lock()
+	defer g.Unlock()
+	points := make(map[string]Point, len(queries))
+	for _, q := range queries {
+		if point, found := g.cache[q]; found {
+			points[q] = point
+		}
+	}
+	return points
+}
+
+// update caches the valid results and pauses the queries if the remaining requests,
+// as read from the rate limit headers of the last response, are below minRemaining.
+func (g *rateLimitGuard) update(processed map[string]Point, remaining, reset string, now time.Time) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.minRemaining <= 0 {
+		return
+	}
+
+	if g.cache == nil {
+		g.cache = make(map[string]Point)
+	}
+	for q, point := range processed {
+		if point.Valid {
+			g.cache[q] = point
+		}
+	}
+	for q, point := range g.cache {
+		if now.Unix()-point.Timestamp > int64(g.maxAge.Seconds())+point.IngestionDelay {
+			delete(g.cache, q)
+		}
+	}
+
+	remainingInt, err := strconv.Atoi(remaining)
+	if err != nil {
+		// no rate limit headers in the response
+		return
+	}
+	rateLimitRemaining.Set(int64(remainingInt))
+	if remainingInt >= g.minRemaining {
+		return
+	}
+
+	resetSeconds, err := strconv.Atoi(reset)
+	if err != nil || resetSeconds <= 0 {
+		return
+	}
+	g.pausedUntil = now.Add(time.Duration(resetSeconds) * time.Second)
+	log.Warnf("Only %d queries remaining before the rate limit resets, below the minimum of %d: pausing the queries to Datadog until %s", remainingInt, g.minRemaining, g.pausedUntil.Format(time.RFC3339))
+	g.setPaused(true)
+}
+
+// resume clears the paused state once the rate limit has reset.
+func (g *rateLimitGuard) resume(now time.Time) {
+	g.Lock()
+	defer g.Unlock()
+	if g.pausedUntil.IsZero() || now.Before(g.pausedUntil) {
+		return
+	}
+	log.Infof("The rate limit has reset, resuming the queries to Datadog")
+	g.pausedUntil = time.Time{}
+	g.setPaused(false)
+}
+
+func (g *rateLimitGuard) setPaused(paused bool) {
+	if paused {
+		rateLimitPaused.Set(1)
+		rateLimitPauseUntil.Set(g.pausedUntil.Format(time.RFC3339))
+		rateLimitGuardPaused.Set(1, queryEndpoint, le.JoinLeaderValue)
+		return
+	}
+	rateLimitPaused.Set(0)
+	rateLimitPauseUntil.Set("")
+	rateLimitGuardPaused.Set(0, queryEndpoint, le.JoinLeaderValue)
+}
@@ -0,0 +1,131 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+// newRateLimitedServer returns a stub of the query API answering with a single point
+// and the given number of remaining requests in the rate limit headers.
+func newRateLimitedServer(remaining *int64, calls *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(calls, 1)
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Period", "3600")
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(atomic.LoadInt64(remaining), 10))
+		w.Header().Set("X-RateLimit-Reset", "60")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"ok","series":[{"metric":"requests","scope":"app:foo","expression":"avg:requests{app:foo}","pointlist":[[%d000,42]]}]}`, time.Now().Unix())
+	}))
+}
+
+func TestRateLimitGuard(t *testing.T) {
+	remaining, calls := int64(50), int64(0)
+	server := newRateLimitedServer(&remaining, &calls)
+	defer server.Close()
+
+	client := datadog.NewClient("apikey", "appkey")
+	client.SetBaseUrl(server.URL)
+	p := &Processor{
+		datadogClient: client,
+		rateLimit:     rateLimitGuard{minRemaining: 10, maxAge: time.Minute},
+	}
+	query := "avg:requests{app:foo}.rollup(30)"
+
+	// enough requests remaining, the query goes through
+	points, err := p.QueryExternalMetric([]string{query})
+	require.NoError(t, err)
+	assert.True(t, points[query].Valid)
+	assert.Equal(t, 42.0, points[query].Value)
+	assert.False(t, p.rateLimit.paused(time.Now()))
+	assert.Equal(t, int64(50), rateLimitRemaining.Value())
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	// the remaining requests drop below the minimum, the queries are paused after this one
+	atomic.StoreInt64(&remaining, 5)
+	_, err = p.QueryExternalMetric([]string{query})
+	require.NoError(t, err)
+	assert.True(t, p.rateLimit.paused(time.Now()))
+	assert.Equal(t, int64(1), rateLimitPaused.Value())
+	assert.Equal(t, int64(5), rateLimitRemaining.Value())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	// paused: the cached value is served without querying Datadog
+	points, err = p.QueryExternalMetric([]string{query, "avg:unknown{*}.rollup(30)"})
+	assert.Equal(t, errRateLimitGuard, err)
+	assert.Len(t, points, 1)
+	assert.True(t, points[query].Valid)
+	assert.Equal(t, 42.0, points[query].Value)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	// the rate limit resets, the queries resume
+	p.rateLimit.Lock()
+	p.rateLimit.pausedUntil = time.Now().Add(-time.Second)
+	p.rateLimit.Unlock()
+	atomic.StoreInt64(&remaining, 100)
+	_, err = p.QueryExternalMetric([]string{query})
+	require.NoError(t, err)
+	assert.False(t, p.rateLimit.paused(time.Now()))
+	assert.Equal(t, int64(0), rateLimitPaused.Value())
+	assert.Equal(t, int64(3), atomic.LoadInt64(&calls))
+}
+
+func TestRateLimitGuardDisabled(t *testing.T) {
+	remaining, calls := int64(1), int64(0)
+	server := newRateLimitedServer(&remaining, &calls)
+	defer server.Close()
+
+	client := datadog.NewClient("apikey", "appkey")
+	client.SetBaseUrl(server.URL)
+	p := &Processor{datadogClient: client}
+	query := "avg:requests{app:foo}.rollup(30)"
+
+	for i := 0; i < 3; i++ {
+		_, err := p.QueryExternalMetric([]string{query})
+		require.NoError(t, err)
+	}
+	assert.False(t, p.rateLimit.paused(time.Now()))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&calls))
+}
+
+func TestRateLimitGuardCache(t *testing.T) {
+	now := time.Now()
+	g := rateLimitGuard{minRemaining: 10, maxAge: time.Minute}
+	g.update(map[string]Point{
+		"fresh":   {Value: 1, Timestamp: now.Unix(), Valid: true},
+		"old":     {Value: 2, Timestamp: now.Add(-2 * time.Minute).Unix(), Valid: true},
+		"invalid": {Timestamp: now.Unix()},
+	}, "", "", now)
+
+	// missing rate limit headers never pause the queries
+	assert.False(t, g.paused(now))
+	cached := g.cached([]string{"fresh", "old", "invalid"})
+	assert.Len(t, cached, 1)
+	assert.Equal(t, 1.0, cached["fresh"].Value)
+}
+
+func TestRateLimitGuardExpvarsOnlyPublishedWhenEnabled(t *testing.T) {
+	newRateLimitGuard(0, time.Minute)
+	assert.Nil(t, expvar.Get(rateLimitExpvarName))
+
+	newRateLimitGuard(10, time.Minute)
+	newRateLimitGuard(10, time.Minute)
+	assert.NotNil(t, expvar.Get(rateLimitExpvarName))
+}
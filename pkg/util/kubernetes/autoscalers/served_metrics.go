@@ -0,0 +1,196 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// ServedMetricsPath is the path of the Prometheus endpoint exposing the external metrics served,
+	// on the server of the metrics of the cluster agent
+	ServedMetricsPath = "/metrics/external"
+
+	servedMetricValueName = "datadog_external_metric_value"
+	servedMetricValidName = "datadog_external_metric_valid"
+	servedMetricAgeName   = "datadog_external_metric_age_seconds"
+)
+
+// servedMetricFixedLabels are the labels set on every series, a label of the scope of a metric
+// with the same name is prefixed with scopeLabelPrefix
+var servedMetricFixedLabels = []string{"metric", "autoscaler_kind", "autoscaler_namespace", "autoscaler_name"}
+
+const scopeLabelPrefix = "scope_"
+
+// globalServedMetrics holds the external metrics served after the last refresh, it is only set by the
+// processors when the Prometheus endpoint is enabled.
+var globalServedMetrics = &servedMetrics{}
+
+// ServedMetricsEndpointEnabled returns whether the external metrics served are exposed on the
+// Prometheus endpoint.
+func ServedMetricsEndpointEnabled() bool {
+	return config.Datadog.GetBool("external_metrics_provider.prometheus_endpoint")
+}
+
+// ResetServedMetrics clears the external metrics served, when there is no metric to refresh anymore
+// or the cluster agent lost the leadership, so that the last refresh isn't served forever.
+func ResetServedMetrics() {
+	globalServedMetrics.set(nil)
+}
+
+// servedMetrics is the snapshot of the external metrics served, replaced on each refresh. It only
+// holds the metrics of the last refresh, so that the number of series exposed is bounded by the
+// number of metrics served.
+type servedMetrics struct {
+	sync.RWMutex
+	metrics []custommetrics.ExternalMetricValue
+}
+
+// set replaces the metrics served with the ones of a refresh
+func (s *servedMetrics) set(emList map[string]custommetrics.ExternalMetricValue) {
+	metrics := make([]custommetrics.ExternalMetricValue, 0, len(emList))
+	for _, em := range emList {
+		metrics = append(metrics, em)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = metrics
+}
+
+// servedSeries is the set of labels of an external metric served
+type servedSeries struct {
+	labels string
+	em     custommetrics.ExternalMetricValue
+}
+
+// render writes the value, the validity and the age at now of the metrics served in the Prometheus
+// text format
+func (s *servedMetrics) render(now time.Time) []byte {
+	s.RLock()
+	series := make([]servedSeries, 0, len(s.metrics))
+	for _, em := range s.metrics {
+		series = append(series, servedSeries{labels: servedMetricLabels(em), em: em})
+	}
+	s.RUnlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].labels < series[j].labels
+	})
+
+	var buf bytes.Buffer
+	writeServedMetric(&buf, servedMetricValueName, "Value of the external metric served to the autoscaler.", series, func(em custommetrics.ExternalMetricValue) float64 {
+		return em.Value
+	})
+	writeServedMetric(&buf, servedMetricValidName, "Whether the external metric served to the autoscaler is valid (1) or not (0).", series, func(em custommetrics.ExternalMetricValue) float64 {
+		if em.Valid {
+			return 1
+		}
+		return 0
+	})
+	writeServedMetric(&buf, servedMetricAgeName, "Age in seconds of the value of the external metric served to the autoscaler.", series, func(em custommetrics.ExternalMetricValue) float64 {
+		return math.Max(0, now.Sub(time.Unix(em.Timestamp, 0)).Seconds())
+	})
+	return buf.Bytes()
+}
+
+func writeServedMetric(buf *bytes.Buffer, name string, help string, series []servedSeries, value func(custommetrics.ExternalMetricValue) float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	for _, s := range series {
+		fmt.Fprintf(buf, "%s{%s} %s\n", name, s.labels, strconv.FormatFloat(value(s.em), 'g', -1, 64))
+	}
+}
+
+// servedMetricLabels returns the labels of the series of an external metric: the metric, its
+// autoscaler, and its scope. The names of the labels of the scope are sanitized, the ones which
+// are the same once sanitized are only exposed once.
+func servedMetricLabels(em custommetrics.ExternalMetricValue) string {
+	values := []string{em.MetricName, em.Ref.Type, em.Ref.Namespace, em.Ref.Name}
+	used := make(map[string]struct{}, len(servedMetricFixedLabels)+len(em.Labels))
+	pairs := make([]string, 0, len(servedMetricFixedLabels)+len(em.Labels))
+	for i, name := range servedMetricFixedLabels {
+		used[name] = struct{}{}
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+
+	scope := make([]string, 0, len(em.Labels))
+	for name := range em.Labels {
+		scope = append(scope, name)
+	}
+	sort.Strings(scope)
+	for _, name := range scope {
+		sanitized := sanitizeLabelName(name)
+		if _, found := used[sanitized]; found {
+			log.Tracef("Not exposing the label %q of the external metric %s, its name is already used", name, em.MetricName)
+			continue
+		}
+		used[sanitized] = struct{}{}
+		pairs = append(pairs, sanitized+`="`+escapeLabelValue(em.Labels[name])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sanitizeLabelName returns a valid Prometheus label name for a label of the scope of an external
+// metric: the invalid characters are replaced with underscores, and the names which are reserved,
+// start with a digit, or are the names of the fixed labels are prefixed.
+func sanitizeLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	sanitized := b.String()
+	if sanitized == "" || strings.HasPrefix(sanitized, "__") {
+		return scopeLabelPrefix + sanitized
+	}
+	for _, fixed := range servedMetricFixedLabels {
+		if sanitized == fixed {
+			return scopeLabelPrefix + sanitized
+		}
+	}
+	return sanitized
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// ServedMetricsHandler serves the external metrics served after the last refresh in the Prometheus
+// text format. Only the leader refreshes the metrics, the handler of the other replicas serves no
+// metrics.
+func ServedMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(globalServedMetrics.render(time.Now())) //nolint:errcheck
+	})
+}
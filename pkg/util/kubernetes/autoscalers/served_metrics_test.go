@@ -0,0 +1,137 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+)
+
+func TestSanitizeLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"kube_service":     "kube_service",
+		"kube-service":     "kube_service",
+		"app.kubernetes/x": "app_kubernetes_x",
+		"Env":              "Env",
+		"2xx":              "_2xx",
+		"http2":            "http2",
+		"__name__":         "scope___name__",
+		"":                 "scope_",
+		"metric":           "scope_metric",
+		"autoscaler_name":  "scope_autoscaler_name",
+		"région":           "r_gion",
+	} {
+		assert.Equal(t, expected, sanitizeLabelName(name), name)
+	}
+}
+
+func TestServedMetricsRender(t *testing.T) {
+	now := time.Unix(1625000000, 0)
+	served := &servedMetrics{}
+	served.set(map[string]custommetrics.ExternalMetricValue{
+		"external_metric-horizontal-default-web-requests": {
+			MetricName: "nginx.net.request_per_s",
+			Labels:     map[string]string{"kube-service": "web", "kube_service": "duplicate", "metric": "scope"},
+			Timestamp:  now.Unix() - 45,
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Name: "web", Namespace: "default"},
+			Value:      123.5,
+			Valid:      true,
+		},
+		"external_metric-watermark-prod-queue-queue": {
+			MetricName: "rabbitmq.queue.messages",
+			Labels:     map[string]string{"queue": `jobs "high"`},
+			Timestamp:  now.Unix() + 10,
+			Ref:        custommetrics.ObjectReference{Type: "watermark", Name: "worker", Namespace: "prod"},
+			Value:      0,
+			Valid:      false,
+		},
+	})
+
+	expected := `# HELP datadog_external_metric_value Value of the external metric served to the autoscaler.
+# TYPE datadog_external_metric_value gauge
+datadog_external_metric_value{metric="nginx.net.request_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",kube_service="web",scope_metric="scope"} 123.5
+datadog_external_metric_value{metric="rabbitmq.queue.messages",autoscaler_kind="watermark",autoscaler_namespace="prod",autoscaler_name="worker",queue="jobs \"high\""} 0
+# HELP datadog_external_metric_valid Whether the external metric served to the autoscaler is valid (1) or not (0).
+# TYPE datadog_external_metric_valid gauge
+datadog_external_metric_valid{metric="nginx.net.request_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",kube_service="web",scope_metric="scope"} 1
+datadog_external_metric_valid{metric="rabbitmq.queue.messages",autoscaler_kind="watermark",autoscaler_namespace="prod",autoscaler_name="worker",queue="jobs \"high\""} 0
+# HELP datadog_external_metric_age_seconds Age in seconds of the value of the external metric served to the autoscaler.
+# TYPE datadog_external_metric_age_seconds gauge
+datadog_external_metric_age_seconds{metric="nginx.net.request_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",kube_service="web",scope_metric="scope"} 45
+datadog_external_metric_age_seconds{metric="rabbitmq.queue.messages",autoscaler_kind="watermark",autoscaler_namespace="prod",autoscaler_name="worker",queue="jobs \"high\""} 0
+`
+	assert.Equal(t, expected, string(served.render(now)))
+
+	// the metrics of the last refresh replace the previous ones
+	served.set(map[string]custommetrics.ExternalMetricValue{})
+	assert.NotContains(t, string(served.render(now)), "{")
+}
+
+func TestResetServedMetrics(t *testing.T) {
+	defer ResetServedMetrics()
+	globalServedMetrics.set(map[string]custommetrics.ExternalMetricValue{
+		"external_metric-horizontal-default-web-requests": {
+			MetricName: "nginx.net.request_per_s",
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Name: "web", Namespace: "default"},
+			Valid:      true,
+		},
+	})
+	assert.Contains(t, string(globalServedMetrics.render(time.Now())), "nginx.net.request_per_s")
+
+	ResetServedMetrics()
+	assert.NotContains(t, string(globalServedMetrics.render(time.Now())), "{")
+}
+
+func TestServedMetricsUpdatedOnRefresh(t *testing.T) {
+	penTime := (int(time.Now().Unix()) - int(maxAge.Seconds()/2)) * 1000
+	metricName := "requests_per_s"
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Points: []datadog.DataPoint{
+						makePoints(penTime, 42),
+						makePoints(0, 27),
+					},
+					Scope: makePtr("env:prod"),
+				},
+			}, nil
+		},
+	}
+	served := &servedMetrics{}
+	p := &Processor{externalMaxAge: maxAge, datadogClient: datadogClient, served: served}
+	p.UpdateExternalMetrics(map[string]custommetrics.ExternalMetricValue{
+		"id1": {
+			MetricName: metricName,
+			Labels:     map[string]string{"env": "prod"},
+			Ref:        custommetrics.ObjectReference{Type: "horizontal", Name: "web", Namespace: "default"},
+		},
+	})
+
+	previous := globalServedMetrics
+	globalServedMetrics = served
+	defer func() { globalServedMetrics = previous }()
+	recorder := httptest.NewRecorder()
+	ServedMetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ServedMetricsPath, nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	body := recorder.Body.String()
+	assert.Contains(t, body, `datadog_external_metric_value{metric="requests_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",env="prod"} 42`+"\n")
+	assert.Contains(t, body, `datadog_external_metric_valid{metric="requests_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",env="prod"} 1`+"\n")
+	// the age is computed when the endpoint is scraped
+	assert.Regexp(t, `datadog_external_metric_age_seconds\{metric="requests_per_s",autoscaler_kind="horizontal",autoscaler_namespace="default",autoscaler_name="web",env="prod"\} 1[56](\.\d+)?\n`, body)
+}
@@ -0,0 +1,204 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// splittableQueryRegex matches the simple `aggregator:metric{tags}suffix` form, which is the only one we know how to split.
+var splittableQueryRegex = regexp.MustCompile(`^([a-z]+):([^{}:]+)\{([^{}]*)\}([^{}]*)$`)
+
+// booleanScopeRegex matches the scopes using the boolean syntax, whose tags can't be spread across sub-queries.
+var booleanScopeRegex = regexp.MustCompile(`\b(AND|OR|NOT|IN)\b|[()]`)
+
+// singleValuedTagKeys lists the tag keys with a single value per series, the only ones a query is split on.
+// The values of another key can overlap: a series tagged with several of them would be counted by several
+// sub-queries, and it doesn't match a scope ANDing them while it matches the sub-queries.
+var singleValuedTagKeys = map[string]struct{}{
+	"host":                {},
+	"container_id":        {},
+	"container_name":      {},
+	"pod_name":            {},
+	"kube_container_name": {},
+	"kube_namespace":      {},
+	"kube_deployment":     {},
+	"kube_replica_set":    {},
+	"kube_stateful_set":   {},
+	"kube_daemon_set":     {},
+	"kube_job":            {},
+	"kube_cronjob":        {},
+}
+
+// mergeableAggregators lists the space aggregators for which the results of queries over disjoint scopes
+// can be combined into the result of the query over the union of the scopes.
+// `avg` is deliberately absent: averaging partial averages is only correct when every partition has the same number of series.
+var mergeableAggregators = map[string]func(a, b float64) float64{
+	"sum": func(a, b float64) float64 { return a + b },
+	"max": func(a, b float64) float64 {
+		if b > a {
+			return b
+		}
+		return a
+	},
+	"min": func(a, b float64) float64 {
+		if b < a {
+			return b
+		}
+		return a
+	},
+}
+
+// isQueryBeyondLimits returns true if a query alone cannot fit in a call to Datadog's API.
+func isQueryBeyondLimits(query string) bool {
+	return len(url.QueryEscape(query))+extraQueryCharacters >= maxCharactersPerChunk
+}
+
+// splitQuery splits a query which is too long to be sent as is into several shorter queries.
+// Datadog ORs the values of a tag key repeated in a scope, so the values of the key with the highest
+// cardinality are spread across sub-queries that each keep the rest of the scope. Only the keys with a
+// single value per series and whose values are exact tags are split on, so that the sub-queries cover
+// disjoint scopes and their results can be merged with mergePoints.
+func splitQuery(query string) ([]string, error) {
+	matches := splittableQueryRegex.FindStringSubmatch(query)
+	if matches == nil {
+		return nil, fmt.Errorf("query is too long and is not a simple `aggregator:metric{tags}` query, it cannot be split")
+	}
+	aggregator, metric, scope, suffix := matches[1], matches[2], matches[3], matches[4]
+	if _, found := mergeableAggregators[aggregator]; !found {
+		return nil, fmt.Errorf("query is too long and the %q aggregator cannot be computed from split queries, use one of sum, max or min", aggregator)
+	}
+
+	if booleanScopeRegex.MatchString(scope) {
+		return nil, fmt.Errorf("query is too long and its scope uses boolean operators, it cannot be split")
+	}
+
+	valuesByKey := make(map[string][]string)
+	var keys []string
+	for _, tag := range strings.Split(scope, ",") {
+		key := tag
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key = tag[:i]
+		}
+		if _, found := valuesByKey[key]; !found {
+			keys = append(keys, key)
+		}
+		valuesByKey[key] = append(valuesByKey[key], tag)
+	}
+	sort.Strings(keys)
+
+	// Split on the tag key with the highest cardinality, it is the one that makes the query long.
+	var splitKey string
+	for _, key := range keys {
+		if isSplittableKey(key, valuesByKey[key]) && len(valuesByKey[key]) > len(valuesByKey[splitKey]) {
+			splitKey = key
+		}
+	}
+	if splitKey == "" {
+		return nil, fmt.Errorf("query is too long and has no tag with multiple values to split on, among the tags with a single value per series")
+	}
+	// the scope of a repeated value would be queried by several sub-queries
+	valuesByKey[splitKey] = uniqueValues(valuesByKey[splitKey])
+
+	var baseTags []string
+	for _, key := range keys {
+		if key != splitKey {
+			baseTags = append(baseTags, valuesByKey[key]...)
+		}
+	}
+	makeQuery := func(values []string) string {
+		tags := append(append([]string{}, baseTags...), values...)
+		return fmt.Sprintf("%s:%s{%s}%s", aggregator, metric, strings.Join(tags, ","), suffix)
+	}
+
+	var subQueries []string
+	var current []string
+	for _, value := range valuesByKey[splitKey] {
+		if isQueryBeyondLimits(makeQuery(append(current, value))) {
+			if len(current) == 0 {
+				return nil, fmt.Errorf("query is too long even when splitting on the %q tag", splitKey)
+			}
+			subQueries = append(subQueries, makeQuery(current))
+			current = nil
+		}
+		current = append(current, value)
+	}
+	if isQueryBeyondLimits(makeQuery(current)) {
+		return nil, fmt.Errorf("query is too long even when splitting on the %q tag", splitKey)
+	}
+	subQueries = append(subQueries, makeQuery(current))
+
+	return subQueries, nil
+}
+
+// isSplittableKey returns whether the values of a tag key cover disjoint scopes: the key has a single value
+// per series and its values are exact tags, without wildcards.
+func isSplittableKey(key string, values []string) bool {
+	if _, found := singleValuedTagKeys[key]; !found || len(uniqueValues(values)) < 2 {
+		return false
+	}
+	for _, value := range values {
+		if !strings.HasPrefix(value, key+":") || strings.Contains(value, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueValues(values []string) []string {
+	seen := make(map[string]struct{}, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, found := seen[value]; !found {
+			seen[value] = struct{}{}
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// mergePoints computes the result of a split query from the results of its sub-queries.
+// Sub-queries without data are skipped as their scope doesn't contribute to the original query,
+// but a missing result (the sub-query failed) invalidates the whole query.
+func mergePoints(query string, subQueries []string, results map[string]Point) Point {
+	merged := Point{}
+	matches := splittableQueryRegex.FindStringSubmatch(query)
+	if matches == nil {
+		return merged
+	}
+	merge := mergeableAggregators[matches[1]]
+	if merge == nil {
+		return merged
+	}
+
+	for _, subQuery := range subQueries {
+		point, found := results[subQuery]
+		if !found {
+			return Point{}
+		}
+		if !point.Valid {
+			continue
+		}
+		if !merged.Valid {
+			merged = point
+			// the value of the merged points can't be selected among the points of their windows
+			merged.Window = nil
+			continue
+		}
+		merged.Value = merge(merged.Value, point.Value)
+		// Keep the oldest timestamp, the merged value is only as fresh as its oldest part.
+		if point.Timestamp < merged.Timestamp {
+			merged.Timestamp = point.Timestamp
+		}
+	}
+	return merged
+}
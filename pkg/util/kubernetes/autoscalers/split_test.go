@@ -0,0 +1,245 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+func makeLongQuery(aggregator string, numPods int) string {
+	tags := []string{"kube_namespace:default"}
+	for i := 0; i < numPods; i++ {
+		tags = append(tags, fmt.Sprintf("pod_name:frontend-7d9f8b6c5-%05d", i))
+	}
+	return fmt.Sprintf("%s:kubernetes.cpu.usage.total{%s}.rollup(30)", aggregator, strings.Join(tags, ","))
+}
+
+func TestSplitQuery(t *testing.T) {
+	query := makeLongQuery("sum", 500)
+	require.True(t, isQueryBeyondLimits(query))
+
+	subQueries, err := splitQuery(query)
+	require.NoError(t, err)
+	require.Len(t, subQueries, 3)
+
+	var pods []string
+	for _, subQuery := range subQueries {
+		assert.False(t, isQueryBeyondLimits(subQuery))
+		assert.True(t, strings.HasPrefix(subQuery, "sum:kubernetes.cpu.usage.total{kube_namespace:default,pod_name:"))
+		assert.True(t, strings.HasSuffix(subQuery, "}.rollup(30)"))
+
+		scope := subQuery[strings.Index(subQuery, "{")+1 : strings.Index(subQuery, "}")]
+		for _, tag := range strings.Split(scope, ",") {
+			if strings.HasPrefix(tag, "pod_name:") {
+				pods = append(pods, tag)
+			}
+		}
+	}
+	// Every pod is queried exactly once
+	assert.Len(t, pods, 500)
+	assert.Equal(t, "pod_name:frontend-7d9f8b6c5-00000", pods[0])
+	assert.Equal(t, "pod_name:frontend-7d9f8b6c5-00499", pods[499])
+}
+
+func TestSplitQueryDisjointPartitions(t *testing.T) {
+	// the repeated pods are only queried once, and the multi-valued service tag is kept in every sub-query
+	query := strings.Replace(makeLongQuery("sum", 500), "{kube_namespace:default,", "{kube_namespace:default,kube_service:a,kube_service:b,pod_name:frontend-7d9f8b6c5-00000,", 1)
+	require.True(t, isQueryBeyondLimits(query))
+
+	subQueries, err := splitQuery(query)
+	require.NoError(t, err)
+
+	pods := 0
+	for _, subQuery := range subQueries {
+		assert.True(t, strings.HasPrefix(subQuery, "sum:kubernetes.cpu.usage.total{kube_namespace:default,kube_service:a,kube_service:b,pod_name:"))
+		pods += strings.Count(subQuery, "pod_name:")
+	}
+	assert.Equal(t, 500, pods)
+}
+
+func TestSplitQueryErrors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		query string
+		err   string
+	}{
+		{
+			desc:  "avg cannot be merged",
+			query: makeLongQuery("avg", 500),
+			err:   `the "avg" aggregator cannot be computed from split queries`,
+		},
+		{
+			desc:  "no multi-valued tag",
+			query: fmt.Sprintf("sum:kubernetes.cpu.usage.total{foo:%s}.rollup(30)", strings.Repeat("a", 7000)),
+			err:   "has no tag with multiple values to split on",
+		},
+		{
+			desc:  "single value too long",
+			query: fmt.Sprintf("sum:kubernetes.cpu.usage.total{pod_name:%s,pod_name:bar}.rollup(30)", strings.Repeat("a", 7000)),
+			err:   `too long even when splitting on the "pod_name" tag`,
+		},
+		{
+			desc:  "tag with several values per series",
+			query: strings.Replace(makeLongQuery("sum", 500), "pod_name:", "kube_service:", -1),
+			err:   "has no tag with multiple values to split on",
+		},
+		{
+			desc:  "overlapping wildcard",
+			query: strings.Replace(makeLongQuery("max", 500), "pod_name:frontend-7d9f8b6c5-00000", "pod_name:frontend-*", 1),
+			err:   "has no tag with multiple values to split on",
+		},
+		{
+			desc:  "boolean AND",
+			query: strings.Replace(makeLongQuery("sum", 500), "kube_namespace:default,", "kube_namespace:default AND ", 1),
+			err:   "its scope uses boolean operators",
+		},
+		{
+			desc:  "boolean IN",
+			query: strings.Replace(makeLongQuery("sum", 500), "{kube_namespace:default,", "{kube_namespace IN (default,prod),", 1),
+			err:   "its scope uses boolean operators",
+		},
+		{
+			desc:  "arithmetic",
+			query: makeLongQuery("sum", 500) + "/" + makeLongQuery("sum", 1),
+			err:   "is not a simple `aggregator:metric{tags}` query",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			subQueries, err := splitQuery(test.query)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.err)
+			assert.Nil(t, subQueries)
+		})
+	}
+}
+
+func TestMergePoints(t *testing.T) {
+	subQueries := []string{"a", "b", "c"}
+	results := map[string]Point{
+		"a": {Value: 2, Timestamp: 110, Valid: true},
+		"b": {Value: 5, Timestamp: 100, Valid: true},
+		"c": {Value: 3, Timestamp: 120, Valid: true},
+	}
+
+	tests := []struct {
+		desc     string
+		query    string
+		results  map[string]Point
+		expected Point
+	}{
+		{
+			desc:     "sum",
+			query:    "sum:foo{*}",
+			results:  results,
+			expected: Point{Value: 10, Timestamp: 100, Valid: true},
+		},
+		{
+			desc:     "max",
+			query:    "max:foo{*}",
+			results:  results,
+			expected: Point{Value: 5, Timestamp: 100, Valid: true},
+		},
+		{
+			desc:     "min",
+			query:    "min:foo{*}",
+			results:  results,
+			expected: Point{Value: 2, Timestamp: 100, Valid: true},
+		},
+		{
+			desc:     "avg is rejected",
+			query:    "avg:foo{*}",
+			results:  results,
+			expected: Point{},
+		},
+		{
+			desc:  "sub-query without data is skipped",
+			query: "sum:foo{*}",
+			results: map[string]Point{
+				"a": {Value: 2, Timestamp: 110, Valid: true},
+				"b": {Timestamp: 130},
+				"c": {Value: 3, Timestamp: 120, Valid: true},
+			},
+			expected: Point{Value: 5, Timestamp: 110, Valid: true},
+		},
+		{
+			desc:  "no sub-query with data",
+			query: "sum:foo{*}",
+			results: map[string]Point{
+				"a": {Timestamp: 110},
+				"b": {Timestamp: 130},
+				"c": {Timestamp: 120},
+			},
+			expected: Point{},
+		},
+		{
+			desc:  "failed sub-query",
+			query: "sum:foo{*}",
+			results: map[string]Point{
+				"a": {Value: 2, Timestamp: 110, Valid: true},
+				"c": {Value: 3, Timestamp: 120, Valid: true},
+			},
+			expected: Point{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, mergePoints(test.query, subQueries, test.results))
+		})
+	}
+}
+
+func TestQueryExternalMetricSplit(t *testing.T) {
+	penTime := float64((time.Now().Unix() - 15) * 1000)
+	lastTime := float64(time.Now().Unix() * 1000)
+	metricName := "kubernetes.cpu.usage.total"
+
+	var calls int32
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			atomic.AddInt32(&calls, 1)
+			// Each sub-query reports one unit per pod in its scope
+			pods := float64(strings.Count(query, "pod_name:"))
+			return []datadog.Series{
+				{
+					Metric: &metricName,
+					Scope:  makePtr("kube_namespace:default"),
+					Points: []datadog.DataPoint{
+						{&penTime, &pods},
+						{&lastTime, &pods},
+					},
+				},
+			}, nil
+		},
+	}
+	p := &Processor{datadogClient: datadogClient}
+
+	sumQuery := makeLongQuery("sum", 500)
+	avgQuery := makeLongQuery("avg", 500)
+	processed, err := p.QueryExternalMetric([]string{sumQuery, avgQuery})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `the "avg" aggregator cannot be computed from split queries`)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	require.Len(t, processed, 2)
+	assert.True(t, processed[sumQuery].Valid)
+	assert.Equal(t, float64(500), processed[sumQuery].Value)
+	assert.Equal(t, int64(penTime/1000), processed[sumQuery].Timestamp)
+
+	assert.False(t, processed[avgQuery].Valid)
+	require.Error(t, processed[avgQuery].Error)
+	assert.Contains(t, processed[avgQuery].Error.Error(), `the "avg" aggregator cannot be computed from split queries`)
+}
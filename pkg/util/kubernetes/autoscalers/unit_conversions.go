@@ -0,0 +1,165 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// unitConversionSeparator separates the source and the target units of a conversion, as in bytes->megabytes
+const unitConversionSeparator = "->"
+
+// unit is a unit supported by the conversions, with its scale to the base unit of its family
+type unit struct {
+	family string
+	scale  float64
+}
+
+// units are the units the external metrics values can be converted between, by name and abbreviation
+var units = map[string]unit{
+	"bytes":     {"bytes", 1},
+	"b":         {"bytes", 1},
+	"kilobytes": {"bytes", 1e3},
+	"kb":        {"bytes", 1e3},
+	"megabytes": {"bytes", 1e6},
+	"mb":        {"bytes", 1e6},
+	"gigabytes": {"bytes", 1e9},
+	"gb":        {"bytes", 1e9},
+	"terabytes": {"bytes", 1e12},
+	"tb":        {"bytes", 1e12},
+	"kibibytes": {"bytes", 1 << 10},
+	"kib":       {"bytes", 1 << 10},
+	"mebibytes": {"bytes", 1 << 20},
+	"mib":       {"bytes", 1 << 20},
+	"gibibytes": {"bytes", 1 << 30},
+	"gib":       {"bytes", 1 << 30},
+
+	"nanoseconds":  {"time", 1e-9},
+	"ns":           {"time", 1e-9},
+	"microseconds": {"time", 1e-6},
+	"us":           {"time", 1e-6},
+	"milliseconds": {"time", 1e-3},
+	"ms":           {"time", 1e-3},
+	"seconds":      {"time", 1},
+	"s":            {"time", 1},
+	"minutes":      {"time", 60},
+	"min":          {"time", 60},
+	"hours":        {"time", 3600},
+	"h":            {"time", 3600},
+
+	"fraction": {"ratio", 1},
+	"percent":  {"ratio", 0.01},
+}
+
+// unitConversion is the conversion of the values of a metric from a unit to another
+type unitConversion struct {
+	spec   string
+	factor float64
+}
+
+// parseUnitConversion parses a conversion between two units of the same family, such as bytes->megabytes
+func parseUnitConversion(spec string) (unitConversion, error) {
+	parts := strings.Split(spec, unitConversionSeparator)
+	if len(parts) != 2 {
+		return unitConversion{}, fmt.Errorf("expected a conversion in the format <unit>%s<unit>", unitConversionSeparator)
+	}
+	fromName := strings.ToLower(strings.TrimSpace(parts[0]))
+	toName := strings.ToLower(strings.TrimSpace(parts[1]))
+	from, found := units[fromName]
+	if !found {
+		return unitConversion{}, fmt.Errorf("unknown unit %q", fromName)
+	}
+	to, found := units[toName]
+	if !found {
+		return unitConversion{}, fmt.Errorf("unknown unit %q", toName)
+	}
+	if from.family != to.family {
+		return unitConversion{}, fmt.Errorf("cannot convert %s to %s", fromName, toName)
+	}
+	return unitConversion{
+		spec:   fromName + unitConversionSeparator + toName,
+		factor: from.scale / to.scale,
+	}, nil
+}
+
+// parseUnitConversions parses the unit conversions by metric name. The invalid ones are left out and
+// reported in the returned error.
+func parseUnitConversions(raw map[string]string) (map[string]unitConversion, error) {
+	conversions := make(map[string]unitConversion, len(raw))
+	var invalid []string
+	for metric, spec := range raw {
+		conversion, err := parseUnitConversion(spec)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%q of the metric %s: %v", spec, metric, err))
+			continue
+		}
+		conversions[metric] = conversion
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return conversions, fmt.Errorf("invalid unit conversions %s", strings.Join(invalid, ", "))
+	}
+	return conversions, nil
+}
+
+// ValidateUnitConversions checks the unit conversions of the external metrics configured in
+// external_metrics_provider.metric_unit_conversions, so that the Cluster Agent refuses to start
+// rather than serving the values of the metrics in another unit than expected.
+func ValidateUnitConversions() error {
+	_, err := parseUnitConversions(config.Datadog.GetStringMapString("external_metrics_provider.metric_unit_conversions"))
+	return err
+}
+
+// configuredUnitConversions returns the valid unit conversions configured
+func configuredUnitConversions() map[string]unitConversion {
+	conversions, err := parseUnitConversions(config.Datadog.GetStringMapString("external_metrics_provider.metric_unit_conversions"))
+	if err != nil {
+		log.Errorf("Ignoring the %v", err)
+	}
+	return conversions
+}
+
+// queryUnitConversion returns the unit conversion of the metrics of a query, there is none when the
+// metrics of the query have different conversions
+func (p *Processor) queryUnitConversion(query string) (unitConversion, bool) {
+	var conversion unitConversion
+	var found bool
+	for metric, metricConversion := range p.unitConversions {
+		if !strings.Contains(query, ":"+metric+"{") {
+			continue
+		}
+		if found && metricConversion.factor != conversion.factor {
+			log.Debugf("The metrics of the query %s have different unit conversions, not converting its value", query)
+			return unitConversion{}, false
+		}
+		conversion = metricConversion
+		found = true
+	}
+	return conversion, found
+}
+
+// convertPoint applies the unit conversion of the metrics of a query to its point, recording the raw value
+func (p *Processor) convertPoint(query string, point Point) Point {
+	conversion, found := p.queryUnitConversion(query)
+	if !found {
+		return point
+	}
+	point.Conversion = &custommetrics.UnitConversion{
+		Spec:     conversion.spec,
+		Factor:   conversion.factor,
+		RawValue: point.Value,
+	}
+	point.Value *= conversion.factor
+	return point
+}
@@ -0,0 +1,177 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2017-present Datadog, Inc.
+
+// +build kubeapiserver
+
+package autoscalers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/clusteragent/custommetrics"
+	"github.com/DataDog/datadog-agent/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/zorkian/go-datadog-api.v2"
+)
+
+func TestParseUnitConversion(t *testing.T) {
+	for _, tt := range []struct {
+		spec   string
+		factor float64
+	}{
+		{"bytes->bytes", 1},
+		{"bytes->kilobytes", 1e-3},
+		{"bytes->megabytes", 1e-6},
+		{"bytes->gigabytes", 1e-9},
+		{"bytes->terabytes", 1e-12},
+		{"bytes->kibibytes", 1.0 / (1 << 10)},
+		{"bytes->mebibytes", 1.0 / (1 << 20)},
+		{"bytes->gibibytes", 1.0 / (1 << 30)},
+		{"gib->mb", (1 << 30) / 1e6},
+		{"ns->ns", 1},
+		{"ns->us", 1e-3},
+		{"ns->ms", 1e-6},
+		{"ns->s", 1e-9},
+		{"ms->s", 1e-3},
+		{"s->min", 1.0 / 60},
+		{"hours->minutes", 60},
+		{"fraction->percent", 100},
+		{"percent->fraction", 0.01},
+		{" Bytes -> MB ", 1e-6},
+	} {
+		t.Run(tt.spec, func(t *testing.T) {
+			conversion, err := parseUnitConversion(tt.spec)
+			require.NoError(t, err)
+			assert.InEpsilon(t, tt.factor, conversion.factor, 1e-12)
+		})
+	}
+
+	conversion, err := parseUnitConversion(" Bytes -> MB ")
+	require.NoError(t, err)
+	assert.Equal(t, "bytes->mb", conversion.spec)
+}
+
+func TestParseUnitConversionInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"bytes",
+		"bytes->",
+		"bytes->megabytes->gigabytes",
+		"bytes->furlongs",
+		"parsecs->bytes",
+		"bytes->seconds",
+		"percent->ms",
+	} {
+		_, err := parseUnitConversion(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func mustParseUnitConversions(t *testing.T, raw map[string]string) map[string]unitConversion {
+	conversions, err := parseUnitConversions(raw)
+	require.NoError(t, err)
+	return conversions
+}
+
+func TestValidateUnitConversions(t *testing.T) {
+	mockConfig := config.Mock()
+	defer mockConfig.Set("external_metrics_provider.metric_unit_conversions", map[string]string{})
+	mockConfig.Set("external_metrics_provider.metric_unit_conversions", map[string]string{"redis.mem.used": "bytes->megabytes"})
+	assert.NoError(t, ValidateUnitConversions())
+
+	mockConfig.Set("external_metrics_provider.metric_unit_conversions", map[string]string{"redis.mem.used": "bytes->seconds"})
+	assert.Error(t, ValidateUnitConversions())
+}
+
+func TestParseUnitConversions(t *testing.T) {
+	conversions, err := parseUnitConversions(map[string]string{
+		"redis.mem.used":        "bytes->megabytes",
+		"trace.http.request":    "ns->ms",
+		"invalid.unit":          "bytes->furlongs",
+		"invalid.family":        "bytes->ms",
+		"invalid.specification": "megabytes",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"bytes->furlongs" of the metric invalid.unit: unknown unit "furlongs"`)
+	assert.Contains(t, err.Error(), `"bytes->ms" of the metric invalid.family`)
+	assert.Contains(t, err.Error(), `"megabytes" of the metric invalid.specification`)
+	assert.Len(t, conversions, 2)
+	assert.Equal(t, unitConversion{spec: "bytes->megabytes", factor: 1e-6}, conversions["redis.mem.used"])
+	assert.Equal(t, "ns->ms", conversions["trace.http.request"].spec)
+}
+
+func TestProcessor_UnitConversion(t *testing.T) {
+	emList := map[string]custommetrics.ExternalMetricValue{
+		"external_metric-default-foo-redis.mem.used": {
+			MetricName: "redis.mem.used",
+			Labels:     map[string]string{"app": "nginx"},
+		},
+		"external_metric-default-foo-nginx.requests": {
+			MetricName: "nginx.requests",
+			Labels:     map[string]string{"app": "nginx"},
+		},
+	}
+	datadogClient := &fakeDatadogClient{
+		queryMetricsFunc: func(from, to int64, query string) ([]datadog.Series, error) {
+			var series []datadog.Series
+			for i, q := range strings.Split(query, ",") {
+				metricName := q[strings.Index(q, ":")+1 : strings.Index(q, "{")]
+				serie := laggingSeries(metricName, from, to, 0)
+				serie.QueryIndex = makePtrInt(i)
+				series = append(series, serie)
+			}
+			return series, nil
+		},
+	}
+	p := &Processor{
+		datadogClient:   datadogClient,
+		externalMaxAge:  2 * time.Minute,
+		unitConversions: mustParseUnitConversions(t, map[string]string{"redis.mem.used": "bytes->kilobytes"}),
+	}
+
+	updated := p.UpdateExternalMetrics(emList)
+	require.Len(t, updated, 2)
+
+	mem := updated["external_metric-default-foo-redis.mem.used"]
+	assert.True(t, mem.Valid)
+	assert.InEpsilon(t, 0.042, mem.Value, 1e-12)
+	require.NotNil(t, mem.Conversion)
+	assert.Equal(t, "bytes->kilobytes", mem.Conversion.Spec)
+	assert.InEpsilon(t, 1e-3, mem.Conversion.Factor, 1e-12)
+	assert.Equal(t, 42.0, mem.Conversion.RawValue)
+
+	// the metrics without conversion keep their raw value
+	requests := updated["external_metric-default-foo-nginx.requests"]
+	assert.True(t, requests.Valid)
+	assert.Equal(t, 42.0, requests.Value)
+	assert.Nil(t, requests.Conversion)
+}
+
+func TestProcessor_QueryUnitConversion(t *testing.T) {
+	p := &Processor{unitConversions: mustParseUnitConversions(t, map[string]string{
+		"redis.mem.used": "bytes->megabytes",
+		"redis.mem.peak": "b->mb",
+		"trace.duration": "ns->ms",
+	})}
+
+	conversion, found := p.queryUnitConversion("avg:redis.mem.used{app:redis}.rollup(30)")
+	assert.True(t, found)
+	assert.Equal(t, "bytes->megabytes", conversion.spec)
+
+	// the metrics of a query with the same factor are converted
+	_, found = p.queryUnitConversion("max:redis.mem.used{app:redis}.rollup(30)+max:redis.mem.peak{app:redis}.rollup(30)")
+	assert.True(t, found)
+
+	// the metrics of a query with different factors aren't
+	_, found = p.queryUnitConversion("max:redis.mem.used{app:redis}.rollup(30)/max:trace.duration{app:redis}.rollup(30)")
+	assert.False(t, found)
+
+	_, found = p.queryUnitConversion("avg:redis.mem.used_total{app:redis}.rollup(30)")
+	assert.False(t, found)
+}
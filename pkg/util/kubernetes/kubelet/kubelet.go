@@ -419,8 +419,22 @@ func (ku *KubeUtil) IsAgentHostNetwork(ctx context.Context) (bool, error) {
 
 // IsPodReady return a bool if the Pod is ready
 func IsPodReady(pod *Pod) bool {
+	readyCondition := false
+	for _, status := range pod.Status.Conditions {
+		if status.Type == "Ready" && status.Status == "True" {
+			readyCondition = true
+			break
+		}
+	}
+	return IsPodReadyWithCondition(pod, readyCondition)
+}
+
+// IsPodReadyWithCondition returns whether the Pod is ready like IsPodReady, given
+// whether its Ready condition is True, for the callers which already parsed its
+// conditions
+func IsPodReadyWithCondition(pod *Pod, readyCondition bool) bool {
 	// static pods are always reported as Pending, so we make an exception there
-	if pod.Status.Phase == "Pending" && isPodStatic(pod) {
+	if pod.Status.Phase == "Pending" && IsPodStatic(pod) {
 		return true
 	}
 
@@ -431,17 +445,13 @@ func IsPodReady(pod *Pod) bool {
 	if tolerate, ok := pod.Metadata.Annotations[unreadyAnnotation]; ok && tolerate == "true" {
 		return true
 	}
-	for _, status := range pod.Status.Conditions {
-		if status.Type == "Ready" && status.Status == "True" {
-			return true
-		}
-	}
-	return false
+	return readyCondition
 }
 
-// isPodStatic identifies whether a pod is static or not based on an annotation
+// IsPodStatic identifies whether a pod is a static pod without container statuses, based on an
+// annotation. Static pods aren't updated in the pod list after their creation.
 // Static pods can be sent to the kubelet from files or an http endpoint.
-func isPodStatic(pod *Pod) bool {
+func IsPodStatic(pod *Pod) bool {
 	if source, ok := pod.Metadata.Annotations[configSourceAnnotation]; ok == true && (source == "file" || source == "http") {
 		return len(pod.Status.Containers) == 0
 	}
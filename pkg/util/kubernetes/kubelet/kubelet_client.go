@@ -10,14 +10,17 @@ package kubelet
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/config"
@@ -30,6 +33,10 @@ var (
 	kubeletExpVar = expvar.NewInt("kubeletQueries")
 )
 
+// tlsFailuresBeforeReload is the number of consecutive TLS failures after which the client
+// certificate and the CA bundle are reloaded even if their files don't look modified
+const tlsFailuresBeforeReload = 2
+
 type kubeletClientConfig struct {
 	scheme         string
 	baseURL        string
@@ -45,9 +52,55 @@ type kubeletClient struct {
 	kubeletURL string
 	headers    http.Header
 	config     kubeletClientConfig
+
+	// tlsMutex protects client, tlsModTimes and tlsFailures, the transport of the client
+	// is rebuilt when the client certificate or the CA bundle are rotated
+	tlsMutex sync.RWMutex
+	// tlsModTimes are the modification times of the TLS files when they were last loaded
+	tlsModTimes map[string]time.Time
+	// tlsFailures counts the consecutive requests which failed with a TLS error
+	tlsFailures int
 }
 
 func newForConfig(config kubeletClientConfig, timeout time.Duration) (*kubeletClient, error) {
+	if config.caPath == "" && filesystem.FileExists(kubernetes.DefaultServiceAccountCAPath) {
+		config.caPath = kubernetes.DefaultServiceAccountCAPath
+	}
+
+	tlsModTimes := getTLSModTimes(config)
+	customTransport, err := buildTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not use token in plain text
+	headers := http.Header{}
+	if config.scheme == "https" {
+		if config.token != "" {
+			headers.Set(authorizationHeaderKey, fmt.Sprintf("bearer %s", config.token))
+		}
+	}
+
+	// Defaulting timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &kubeletClient{
+		client: http.Client{
+			Transport: customTransport,
+			Timeout:   timeout,
+		},
+		kubeletURL:  fmt.Sprintf("%s://%s", config.scheme, config.baseURL),
+		config:      config,
+		headers:     headers,
+		tlsModTimes: tlsModTimes,
+	}, nil
+}
+
+// buildTransport builds the transport of the client, loading the CA bundle and the
+// client certificate from their files
+func buildTransport(config kubeletClientConfig) (*http.Transport, error) {
 	var err error
 
 	// Building transport based on options
@@ -57,10 +110,6 @@ func newForConfig(config kubeletClientConfig, timeout time.Duration) (*kubeletCl
 	tlsConfig := &tls.Config{}
 	tlsConfig.InsecureSkipVerify = !config.tlsVerify
 
-	if config.caPath == "" && filesystem.FileExists(kubernetes.DefaultServiceAccountCAPath) {
-		config.caPath = kubernetes.DefaultServiceAccountCAPath
-	}
-
 	if config.caPath != "" {
 		tlsConfig.RootCAs, err = kubernetes.GetCertificateAuthority(config.caPath)
 		if err != nil {
@@ -76,28 +125,109 @@ func newForConfig(config kubeletClientConfig, timeout time.Duration) (*kubeletCl
 	}
 	customTransport.TLSClientConfig = tlsConfig
 
-	// Do not use token in plain text
-	headers := http.Header{}
-	if config.scheme == "https" {
-		if config.token != "" {
-			headers.Set(authorizationHeaderKey, fmt.Sprintf("bearer %s", config.token))
+	return customTransport, nil
+}
+
+// getTLSModTimes returns the modification times of the TLS files of the client, the
+// files which can't be read are left out
+func getTLSModTimes(config kubeletClientConfig) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{config.caPath, config.clientCertPath, config.clientKeyPath} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
 		}
 	}
+	return modTimes
+}
 
-	// Defaulting timeout
-	if timeout == 0 {
-		timeout = 30 * time.Second
+// tlsFilesChanged returns whether one of the TLS files was modified since they were loaded
+func tlsFilesChanged(loaded, current map[string]time.Time) bool {
+	if len(loaded) != len(current) {
+		return true
 	}
+	for path, modTime := range current {
+		if !loaded[path].Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
 
-	return &kubeletClient{
-		client: http.Client{
-			Transport: customTransport,
-			Timeout:   timeout,
-		},
-		kubeletURL: fmt.Sprintf("%s://%s", config.scheme, config.baseURL),
-		config:     config,
-		headers:    headers,
-	}, nil
+// reloadTLS rebuilds the transport of the client when its TLS files were modified since they
+// were loaded, or unconditionally when force is set. It returns whether the transport was
+// rebuilt, the previous transport is kept when the files can't be loaded.
+func (kc *kubeletClient) reloadTLS(force bool) bool {
+	if kc.config.scheme != "https" {
+		return false
+	}
+	modTimes := getTLSModTimes(kc.config)
+
+	kc.tlsMutex.Lock()
+	defer kc.tlsMutex.Unlock()
+	if !force && !tlsFilesChanged(kc.tlsModTimes, modTimes) {
+		return false
+	}
+	// the files are only reloaded again once they are modified, or after repeated TLS errors
+	kc.tlsModTimes = modTimes
+	transport, err := buildTransport(kc.config)
+	if err != nil {
+		log.Warnf("Unable to reload the TLS configuration of the kubelet client, keeping the previous one: %s", err)
+		return false
+	}
+	if previous, ok := kc.client.Transport.(*http.Transport); ok {
+		previous.CloseIdleConnections()
+	}
+	log.Infof("Reloaded the client certificate and the CA bundle of the kubelet client")
+	kc.client.Transport = transport
+	kc.tlsFailures = 0
+	return true
+}
+
+// httpClient returns the HTTP client to use for the next request, with the current TLS configuration
+func (kc *kubeletClient) httpClient() http.Client {
+	kc.reloadTLS(false)
+	kc.tlsMutex.RLock()
+	defer kc.tlsMutex.RUnlock()
+	return kc.client
+}
+
+// handleTLSError counts the consecutive requests which failed with a TLS error. It returns
+// whether the TLS configuration was reloaded after repeated failures, for the request to be
+// retried before the caller backs off.
+func (kc *kubeletClient) handleTLSError(err error) bool {
+	kc.tlsMutex.Lock()
+	if err == nil || !isTLSError(err) {
+		kc.tlsFailures = 0
+		kc.tlsMutex.Unlock()
+		return false
+	}
+	kc.tlsFailures++
+	failures := kc.tlsFailures
+	kc.tlsMutex.Unlock()
+
+	if failures < tlsFailuresBeforeReload {
+		return false
+	}
+	log.Debugf("%d consecutive TLS errors querying the kubelet, reloading the TLS configuration: %s", failures, err)
+	return kc.reloadTLS(true)
+}
+
+// isTLSError returns whether the error is a failure of the TLS handshake, as returned when
+// the client certificate or the certificate of the kubelet were rotated
+func isTLSError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCertificate x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCertificate) ||
+		errors.As(err, &hostname) || errors.As(err, &recordHeader) {
+		return true
+	}
+	// the alerts sent by the kubelet, such as a bad certificate, aren't exported
+	return strings.Contains(err.Error(), "tls: ")
 }
 
 func (kc *kubeletClient) checkConnection(ctx context.Context) error {
@@ -113,6 +243,28 @@ func (kc *kubeletClient) checkConnection(ctx context.Context) error {
 	return nil
 }
 
+// do sends the request with the current TLS configuration, retrying it once if it was
+// reloaded after repeated TLS errors
+func (kc *kubeletClient) do(req *http.Request) (*http.Response, error) {
+	return kc.doWithTimeout(req, -1)
+}
+
+// doWithTimeout is do with a timeout overriding the one of the client, unless negative
+func (kc *kubeletClient) doWithTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		client := kc.httpClient()
+		if timeout >= 0 {
+			client.Timeout = timeout
+		}
+		response, err := client.Do(req)
+		kubeletExpVar.Add(1)
+		if !kc.handleTLSError(err) || attempt > 0 {
+			return response, err
+		}
+		log.Debugf("Retrying %s with the reloaded TLS configuration", req.URL.String())
+	}
+}
+
 func (kc *kubeletClient) query(ctx context.Context, path string) ([]byte, int, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s%s", kc.kubeletURL, path), nil)
@@ -121,8 +273,7 @@ func (kc *kubeletClient) query(ctx context.Context, path string) ([]byte, int, e
 	}
 	req.Header = kc.headers
 
-	response, err := kc.client.Do(req)
-	kubeletExpVar.Add(1)
+	response, err := kc.do(req)
 	if err != nil {
 		log.Debugf("Cannot request %s: %s", req.URL.String(), err)
 		return nil, 0, err
@@ -139,6 +290,26 @@ func (kc *kubeletClient) query(ctx context.Context, path string) ([]byte, int, e
 	return b, response.StatusCode, nil
 }
 
+// stream issues a request whose response body is read as it arrives, without the timeout
+// of the client: the caller must close the body and cancel the context to end the stream.
+func (kc *kubeletClient) stream(ctx context.Context, path string) (io.ReadCloser, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s%s", kc.kubeletURL, path), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to create new request: %w", err)
+	}
+	req.Header = kc.headers
+
+	response, err := kc.doWithTimeout(req, 0)
+	if err != nil {
+		log.Debugf("Cannot request %s: %s", req.URL.String(), err)
+		return nil, 0, err
+	}
+
+	log.Tracef("Successfully opened stream %s, status code: %d", req.URL.String(), response.StatusCode)
+	return response.Body, response.StatusCode, nil
+}
+
 func getKubeletClient(ctx context.Context) (*kubeletClient, error) {
 	var err error
 
@@ -0,0 +1,210 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a self-signed certificate valid for 127.0.0.1 and its PEM encoding
+type testCertificate struct {
+	tlsCert tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, serial int64) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{Organization: []string{"Datadog"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return testCertificate{tlsCert: tlsCert, certPEM: certPEM, keyPEM: keyPEM}
+}
+
+// rotatingKubelet is a TLS server whose certificate can be swapped while it is running
+type rotatingKubelet struct {
+	sync.Mutex
+	server *httptest.Server
+	cert   tls.Certificate
+}
+
+func newRotatingKubelet(cert tls.Certificate) *rotatingKubelet {
+	k := &rotatingKubelet{cert: cert}
+	k.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	k.server.TLS = &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			k.Lock()
+			defer k.Unlock()
+			return &k.cert, nil
+		},
+	}
+	k.server.StartTLS()
+	return k
+}
+
+func (k *rotatingKubelet) rotate(cert tls.Certificate) {
+	k.Lock()
+	defer k.Unlock()
+	k.cert = cert
+	// new connections are needed for the new certificate to be presented
+	k.server.CloseClientConnections()
+}
+
+// writeTLSFiles writes the certificate as the CA bundle and the client certificate of the kubelet client
+func writeTLSFiles(t *testing.T, config kubeletClientConfig, cert testCertificate) {
+	require.NoError(t, ioutil.WriteFile(config.caPath, cert.certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(config.clientCertPath, cert.certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(config.clientKeyPath, cert.keyPEM, 0600))
+}
+
+// setModTime sets the modification time of the TLS files of the kubelet client
+func setModTime(t *testing.T, config kubeletClientConfig, modTime time.Time) {
+	for _, path := range []string{config.caPath, config.clientCertPath, config.clientKeyPath} {
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+}
+
+func newRotatingKubeletClient(t *testing.T, cert testCertificate) (*kubeletClient, *rotatingKubelet, kubeletClientConfig) {
+	dir, err := ioutil.TempDir("", "kubelet-client-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	k := newRotatingKubelet(cert.tlsCert)
+	t.Cleanup(k.server.Close)
+
+	config := kubeletClientConfig{
+		scheme:         "https",
+		baseURL:        strings.TrimPrefix(k.server.URL, "https://"),
+		tlsVerify:      true,
+		caPath:         filepath.Join(dir, "ca.crt"),
+		clientCertPath: filepath.Join(dir, "client.crt"),
+		clientKeyPath:  filepath.Join(dir, "client.key"),
+	}
+	writeTLSFiles(t, config, cert)
+	setModTime(t, config, time.Now().Add(-time.Hour))
+
+	kc, err := newForConfig(config, 5*time.Second)
+	require.NoError(t, err)
+	return kc, k, config
+}
+
+func TestKubeletClientReloadsRotatedCertificates(t *testing.T) {
+	ctx := context.Background()
+	first := newTestCertificate(t, 1)
+	kc, k, config := newRotatingKubeletClient(t, first)
+
+	b, code, err := kc.query(ctx, "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", string(b))
+
+	// the certificates are rotated, the files are reloaded before the next query
+	second := newTestCertificate(t, 2)
+	k.rotate(second.tlsCert)
+	writeTLSFiles(t, config, second)
+
+	b, code, err = kc.query(ctx, "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", string(b))
+	clientCerts := kc.client.Transport.(*http.Transport).TLSClientConfig.Certificates
+	require.Len(t, clientCerts, 1)
+	assert.Equal(t, second.tlsCert.Certificate, clientCerts[0].Certificate)
+}
+
+func TestKubeletClientReloadsAfterRepeatedTLSErrors(t *testing.T) {
+	ctx := context.Background()
+	first := newTestCertificate(t, 1)
+	kc, k, config := newRotatingKubeletClient(t, first)
+
+	_, _, err := kc.query(ctx, "/healthz")
+	require.NoError(t, err)
+
+	// the files are rotated without their modification time changing
+	second := newTestCertificate(t, 2)
+	k.rotate(second.tlsCert)
+	writeTLSFiles(t, config, second)
+	setModTime(t, config, time.Now().Add(-time.Hour))
+
+	_, _, err = kc.query(ctx, "/healthz")
+	require.Error(t, err)
+	assert.True(t, isTLSError(err), err.Error())
+
+	// the second failure reloads the files and the query is retried
+	b, code, err := kc.query(ctx, "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", string(b))
+	assert.Equal(t, 0, kc.tlsFailures)
+}
+
+func TestKubeletClientKeepsTransportOnInvalidFiles(t *testing.T) {
+	ctx := context.Background()
+	first := newTestCertificate(t, 1)
+	kc, _, config := newRotatingKubeletClient(t, first)
+
+	// a rotation in progress leaves an invalid CA bundle, the previous configuration is kept
+	require.NoError(t, ioutil.WriteFile(config.caPath, []byte("not a certificate"), 0600))
+	assert.False(t, kc.reloadTLS(false))
+
+	_, code, err := kc.query(ctx, "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, 200, code)
+}
+
+func TestIsTLSError(t *testing.T) {
+	assert.True(t, isTLSError(x509.UnknownAuthorityError{}))
+	assert.True(t, isTLSError(&net.OpError{Op: "remote error", Err: stringError("tls: bad certificate")}))
+	assert.False(t, isTLSError(&net.OpError{Op: "dial", Err: stringError("connection refused")}))
+}
+
+type stringError string
+
+func (e stringError) Error() string { return string(e) }
@@ -0,0 +1,110 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const kubeletPodWatchPath = "/pods?watch=true"
+
+// ErrPodStreamNotSupported is returned by StreamLocalPods when the kubelet doesn't
+// stream the pod updates, the pods must be polled instead
+var ErrPodStreamNotSupported = errors.New("the kubelet doesn't support streaming pod updates")
+
+// PodEventType is the type of a pod update streamed by the kubelet
+type PodEventType string
+
+const (
+	// PodAdded is sent for the pods created, and for all the pods when the stream starts
+	PodAdded PodEventType = "ADDED"
+	// PodModified is sent for the pods updated
+	PodModified PodEventType = "MODIFIED"
+	// PodDeleted is sent for the pods removed from the node
+	PodDeleted PodEventType = "DELETED"
+
+	podBookmark PodEventType = "BOOKMARK"
+	podError    PodEventType = "ERROR"
+)
+
+// PodEvent is a pod update streamed by the kubelet
+type PodEvent struct {
+	Type PodEventType
+	Pod  *Pod
+}
+
+// PodStreamer is implemented by the kubelet clients able to stream the pod updates
+type PodStreamer interface {
+	StreamLocalPods(ctx context.Context, handler func(PodEvent)) error
+}
+
+// podWatchEvent is a pod update as sent on the watch stream
+type podWatchEvent struct {
+	Type   PodEventType `json:"type"`
+	Object *Pod         `json:"object"`
+	// Kind is set when the kubelet ignored the watch parameter and answered with the pod list
+	Kind string `json:"kind"`
+}
+
+// StreamLocalPods streams the updates of the pods running on the node, calling handler for each
+// of them. It blocks until the stream ends: it returns nil when the kubelet closed the stream or
+// the context is cancelled, and ErrPodStreamNotSupported when the kubelet answered with the
+// full pod list instead of streaming the updates.
+func (ku *KubeUtil) StreamLocalPods(ctx context.Context, handler func(PodEvent)) error {
+	body, code, err := ku.kubeletClient.stream(ctx, kubeletPodWatchPath)
+	if err != nil {
+		return fmt.Errorf("error performing kubelet query %s%s: %w", ku.kubeletClient.kubeletURL, kubeletPodWatchPath, err)
+	}
+	defer body.Close()
+
+	switch code {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return ErrPodStreamNotSupported
+	default:
+		return fmt.Errorf("unexpected status code %d on %s%s", code, ku.kubeletClient.kubeletURL, kubeletPodWatchPath)
+	}
+
+	decoder := ku.podUnmarshaller.jsonConfig.NewDecoder(body)
+	for {
+		var event podWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to decode the pod stream: %w", err)
+		}
+
+		switch event.Type {
+		case PodAdded, PodModified, PodDeleted:
+			if event.Object == nil {
+				continue
+			}
+			pod := event.Object
+			allContainers := make([]ContainerStatus, 0, len(pod.Status.InitContainers)+len(pod.Status.Containers))
+			allContainers = append(allContainers, pod.Status.InitContainers...)
+			allContainers = append(allContainers, pod.Status.Containers...)
+			pod.Status.AllContainers = allContainers
+			handler(PodEvent{Type: event.Type, Pod: pod})
+		case podBookmark:
+		case podError:
+			return errors.New("the kubelet reported an error on the pod stream")
+		default:
+			if event.Kind == "PodList" || event.Type == "" {
+				return ErrPodStreamNotSupported
+			}
+			log.Debugf("Ignoring pod update of unknown type %q", event.Type)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamTestKubeUtil(url string) *KubeUtil {
+	return &KubeUtil{
+		kubeletClient:   &kubeletClient{client: http.Client{}, kubeletURL: url},
+		podUnmarshaller: newPodUnmarshaller(),
+	}
+}
+
+func TestStreamLocalPods(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/pods", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("watch"))
+		for _, event := range []string{"ADDED", "BOOKMARK", "MODIFIED", "DELETED"} {
+			fmt.Fprintf(w, `{"type":%q,"object":{"metadata":{"name":"nginx","uid":"1234"},"status":{"initContainerStatuses":[{"name":"init","containerID":"docker://abc"}],"containerStatuses":[{"name":"nginx","containerID":"docker://def"}]}}}`+"\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+	ku := newStreamTestKubeUtil(ts.URL)
+
+	for i := 0; i < 2; i++ {
+		// the stream is opened again after the kubelet closed it
+		var events []PodEvent
+		err := ku.StreamLocalPods(context.Background(), func(event PodEvent) {
+			events = append(events, event)
+		})
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		assert.Equal(t, PodAdded, events[0].Type)
+		assert.Equal(t, PodModified, events[1].Type)
+		assert.Equal(t, PodDeleted, events[2].Type)
+		assert.Equal(t, "1234", events[0].Pod.Metadata.UID)
+		require.Len(t, events[0].Pod.Status.GetAllContainers(), 2)
+		assert.Equal(t, "docker://abc", events[0].Pod.Status.GetAllContainers()[0].ID)
+	}
+}
+
+func TestStreamLocalPodsNotSupported(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the kubelet ignores the watch parameter and answers with the pod list
+		w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","items":[]}`))
+	}))
+	defer ts.Close()
+
+	err := newStreamTestKubeUtil(ts.URL).StreamLocalPods(context.Background(), func(PodEvent) {
+		t.Fatal("no pod event expected")
+	})
+	assert.Equal(t, ErrPodStreamNotSupported, err)
+}
+
+func TestStreamLocalPodsError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	err := newStreamTestKubeUtil(ts.URL).StreamLocalPods(context.Background(), func(PodEvent) {})
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrPodStreamNotSupported, err)
+}
@@ -30,6 +30,8 @@ type PodWatcher struct {
 	lastSeenReady  map[string]time.Time
 	tagsDigest     map[string]string
 	oldPhase       map[string]string
+	oldConditions  map[string]string
+	oldWaiting     map[string]string
 }
 
 // NewPodWatcher creates a new watcher given an expiry duration
@@ -49,6 +51,8 @@ func NewPodWatcher(expiryDuration time.Duration, isWatchingTags bool) (*PodWatch
 	if isWatchingTags {
 		watcher.tagsDigest = make(map[string]string)
 		watcher.oldPhase = make(map[string]string)
+		watcher.oldConditions = make(map[string]string)
+		watcher.oldWaiting = make(map[string]string)
 	}
 	return watcher, nil
 }
@@ -71,6 +75,55 @@ func (w *PodWatcher) PullChanges(ctx context.Context) ([]*Pod, error) {
 	return w.computeChanges(podList)
 }
 
+// PullPodList pulls a new podList from the kubelet without updating the state
+// of the watcher, so that the caller can check it before calling ComputeChanges.
+func (w *PodWatcher) PullPodList(ctx context.Context) ([]*Pod, error) {
+	return w.kubeUtil.GetLocalPodList(ctx)
+}
+
+// ComputeChanges updates the state of the watcher with a podList returned by
+// PullPodList and returns the new / updated pods, like PullChanges.
+func (w *PodWatcher) ComputeChanges(podList []*Pod) ([]*Pod, error) {
+	return w.computeChanges(podList)
+}
+
+// UpdatePod updates the state of the watcher with a pod received from the kubelet
+// pod stream and returns it if it changed, like PullChanges does for the pod list.
+func (w *PodWatcher) UpdatePod(pod *Pod) []*Pod {
+	updatedPods, _ := w.computeChanges([]*Pod{pod})
+	return updatedPods
+}
+
+// DeletePod removes a pod deleted from the node, as received from the kubelet pod
+// stream, and returns its entities and those of its containers like Expire.
+func (w *PodWatcher) DeletePod(pod *Pod) []string {
+	w.Lock()
+	defer w.Unlock()
+	var expired []string
+
+	for _, container := range pod.Status.GetAllContainers() {
+		if _, found := w.lastSeen[container.ID]; found {
+			delete(w.lastSeen, container.ID)
+			delete(w.lastSeenReady, container.ID)
+			expired = append(expired, container.ID)
+		}
+	}
+
+	podEntity := PodUIDToEntityName(pod.Metadata.UID)
+	if _, found := w.lastSeen[podEntity]; found {
+		delete(w.lastSeen, podEntity)
+		if w.isWatchingTags() {
+			delete(w.tagsDigest, podEntity)
+			delete(w.oldPhase, podEntity)
+			delete(w.oldConditions, podEntity)
+			delete(w.oldWaiting, podEntity)
+		}
+		expired = append(expired, podEntity)
+	}
+
+	return expired
+}
+
 // computeChanges is used by PullChanges, split for testing
 func (w *PodWatcher) computeChanges(podList []*Pod) ([]*Pod, error) {
 	now := time.Now()
@@ -86,12 +139,14 @@ func (w *PodWatcher) computeChanges(podList []*Pod) ([]*Pod, error) {
 		if w.isWatchingTags() && !foundPod {
 			w.tagsDigest[podEntity] = digestPodMeta(pod.Metadata)
 			w.oldPhase[podEntity] = pod.Status.Phase
+			w.oldConditions[podEntity] = digestPodConditions(pod.Status.Conditions)
+			w.oldWaiting[podEntity] = digestWaitingContainers(pod.Status.GetAllContainers())
 			newPod = true
 		}
 
 		// static pods are included specifically because they won't have any container
 		// as they're not updated in the pod list after creation
-		if isPodStatic(pod) && !foundPod {
+		if IsPodStatic(pod) && !foundPod {
 			newPod = true
 		}
 
@@ -130,6 +185,10 @@ func (w *PodWatcher) computeChanges(podList []*Pod) ([]*Pod, error) {
 		newLabelsOrAnnotations := false
 		// Detect changes in the pod phase
 		newPhase := false
+		// Detect transitions of the pod conditions
+		newConditions := false
+		// Detect new waiting reasons of the containers not created yet
+		newWaiting := false
 		if w.isWatchingTags() {
 			newTagsDigest := digestPodMeta(pod.Metadata)
 			if foundPod && newTagsDigest != w.tagsDigest[podEntity] {
@@ -142,8 +201,18 @@ func (w *PodWatcher) computeChanges(podList []*Pod) ([]*Pod, error) {
 				w.oldPhase[podEntity] = pod.Status.Phase
 				newPhase = true
 			}
+			// compared to our last seen conditions one of them has a new status or reason
+			if newConditionsDigest := digestPodConditions(pod.Status.Conditions); foundPod && newConditionsDigest != w.oldConditions[podEntity] {
+				w.oldConditions[podEntity] = newConditionsDigest
+				newConditions = true
+			}
+			// compared to our last seen waiting reasons a pending container failed to pull its image or recovered
+			if newWaitingDigest := digestWaitingContainers(pod.Status.GetAllContainers()); foundPod && newWaitingDigest != w.oldWaiting[podEntity] {
+				w.oldWaiting[podEntity] = newWaitingDigest
+				newWaiting = true
+			}
 		}
-		if newPod || updatedContainer || newLabelsOrAnnotations || newPhase {
+		if newPod || updatedContainer || newLabelsOrAnnotations || newPhase || newConditions || newWaiting {
 			updatedPods = append(updatedPods, pod)
 		}
 	}
@@ -170,6 +239,8 @@ func (w *PodWatcher) Expire() ([]string, error) {
 			if w.isWatchingTags() {
 				delete(w.tagsDigest, id)
 				delete(w.oldPhase, id)
+				delete(w.oldConditions, id)
+				delete(w.oldWaiting, id)
 			}
 			expiredContainers = append(expiredContainers, id)
 		}
@@ -223,3 +294,47 @@ func digestMapValues(m map[string]string) string {
 	}
 	return strconv.FormatUint(h.Sum64(), 16)
 }
+
+// digestWaitingContainers returns a unique hash of the name and waiting reason
+// of the containers not created yet. The messages are not hashed, they change
+// on every retry without a transition.
+func digestWaitingContainers(containers []ContainerStatus) string {
+	var values []string
+	for _, c := range containers {
+		if c.IsPending() && c.State.Waiting != nil {
+			values = append(values, c.Name+"\x00"+c.State.Waiting.Reason)
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	sort.Strings(values)
+	h := fnv.New64()
+	for _, v := range values {
+		h.Write([]byte(v))    //nolint:errcheck
+		h.Write([]byte{'\n'}) //nolint:errcheck
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// digestPodConditions returns a unique hash of the type, status and reason of
+// the pod conditions, whatever their order. Their messages and transition times
+// aren't hashed: a new message without transition doesn't update the pod.
+func digestPodConditions(conditions []Conditions) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+
+	values := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		values = append(values, c.Type+"\x00"+c.Status+"\x00"+c.Reason)
+	}
+	sort.Strings(values)
+	h := fnv.New64()
+	for _, v := range values {
+		h.Write([]byte(v))    //nolint:errcheck
+		h.Write([]byte{'\n'}) //nolint:errcheck
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
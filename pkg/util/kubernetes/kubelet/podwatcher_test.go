@@ -333,6 +333,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherExpireDelay() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 	_, err = watcher.computeChanges(sourcePods)
@@ -375,6 +377,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherExpireWholePod() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 
@@ -455,6 +459,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherLabelsValueChange() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 	twoPods := sourcePods[:2]
@@ -498,6 +504,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherPhaseChange() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 	twoPods := sourcePods[:2]
@@ -511,6 +519,97 @@ func (suite *PodwatcherTestSuite) TestPodWatcherPhaseChange() {
 	require.Len(suite.T(), changes, 1)
 }
 
+func (suite *PodwatcherTestSuite) TestPodWatcherConditionsChange() {
+	sourcePods, err := loadPodsFixture("./testdata/podlist_1.8-2.json")
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), sourcePods, 7)
+
+	watcher := &PodWatcher{
+		lastSeen:       make(map[string]time.Time),
+		lastSeenReady:  make(map[string]time.Time),
+		tagsDigest:     make(map[string]string),
+		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
+		expiryDuration: 5 * time.Minute,
+	}
+	twoPods := sourcePods[:2]
+	twoPods[0].Status.Conditions = []Conditions{
+		{Type: "PodScheduled", Status: "False", Reason: "Unschedulable", Message: "0/3 nodes are available: 3 Insufficient cpu."},
+	}
+	changes, err := watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 2)
+
+	// a new message without transition isn't a change
+	twoPods[0].Status.Conditions[0].Message = "0/4 nodes are available: 4 Insufficient cpu."
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 0)
+
+	// the pod is scheduled
+	twoPods[0].Status.Conditions[0] = Conditions{Type: "PodScheduled", Status: "True"}
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 1)
+	assert.Equal(suite.T(), twoPods[0].Metadata.UID, changes[0].Metadata.UID)
+
+	// a new condition, whatever their order
+	twoPods[0].Status.Conditions = append([]Conditions{{Type: "Initialized", Status: "True"}}, twoPods[0].Status.Conditions...)
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 1)
+	twoPods[0].Status.Conditions[0], twoPods[0].Status.Conditions[1] = twoPods[0].Status.Conditions[1], twoPods[0].Status.Conditions[0]
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 0)
+}
+
+func (suite *PodwatcherTestSuite) TestPodWatcherWaitingContainersChange() {
+	sourcePods, err := loadPodsFixture("./testdata/podlist_1.8-2.json")
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), sourcePods, 7)
+
+	watcher := &PodWatcher{
+		lastSeen:       make(map[string]time.Time),
+		lastSeenReady:  make(map[string]time.Time),
+		tagsDigest:     make(map[string]string),
+		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
+		expiryDuration: 5 * time.Minute,
+	}
+	twoPods := sourcePods[:2]
+	twoPods[0].Status.Containers = append(twoPods[0].Status.Containers, ContainerStatus{
+		Name:  "sidecar",
+		Image: "registry.example.com/sidecar:1.0",
+		State: ContainerState{Waiting: &ContainerStateWaiting{Reason: "ContainerCreating"}},
+	})
+	sidecar := &twoPods[0].Status.Containers[len(twoPods[0].Status.Containers)-1]
+	changes, err := watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 2)
+
+	// the image of the pending container can't be pulled
+	sidecar.State.Waiting = &ContainerStateWaiting{Reason: "ErrImagePull", Message: "rpc error: not found"}
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 1)
+	assert.Equal(suite.T(), twoPods[0].Metadata.UID, changes[0].Metadata.UID)
+
+	// a new message without a new reason isn't a change
+	sidecar.State.Waiting.Message = "rpc error: manifest unknown"
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 0)
+
+	// the kubelet backs off
+	sidecar.State.Waiting = &ContainerStateWaiting{Reason: "ImagePullBackOff"}
+	changes, err = watcher.computeChanges(twoPods)
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), changes, 1)
+}
+
 // TestPodWatcherPhaseChangeNotRegistered test makes sure that we only check for
 // pod phases in the tagger and not for auto discovery
 func (suite *PodwatcherTestSuite) TestPodWatcherPhaseChangeNotRegistered() {
@@ -544,6 +643,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherAnnotationsValueChange() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 	twoPods := sourcePods[:2]
@@ -603,6 +704,8 @@ func (suite *PodwatcherTestSuite) TestPodWatcherContainerCreatingTags() {
 		lastSeenReady:  make(map[string]time.Time),
 		tagsDigest:     make(map[string]string),
 		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
 		expiryDuration: 5 * time.Minute,
 	}
 
@@ -611,6 +714,46 @@ func (suite *PodwatcherTestSuite) TestPodWatcherContainerCreatingTags() {
 	require.Len(suite.T(), changes, 1)
 }
 
+func (suite *PodwatcherTestSuite) TestPodWatcherUpdateAndDeletePod() {
+	sourcePods, err := loadPodsFixture("./testdata/podlist_container_ready.json")
+	require.Nil(suite.T(), err)
+	require.Len(suite.T(), sourcePods, 5)
+
+	watcher := &PodWatcher{
+		lastSeen:       make(map[string]time.Time),
+		lastSeenReady:  make(map[string]time.Time),
+		tagsDigest:     make(map[string]string),
+		oldPhase:       make(map[string]string),
+		oldConditions:  make(map[string]string),
+		oldWaiting:     make(map[string]string),
+		expiryDuration: 5 * time.Minute,
+	}
+
+	// A new pod is sent once
+	pod := sourcePods[0]
+	require.Len(suite.T(), watcher.UpdatePod(pod), 1)
+	require.Len(suite.T(), watcher.UpdatePod(pod), 0)
+
+	// Label changes are detected
+	pod.Metadata.Labels["streamed"] = "true"
+	require.Len(suite.T(), watcher.UpdatePod(pod), 1)
+
+	// Deleting the pod expires it and its containers
+	deleted := watcher.DeletePod(pod)
+	assert.ElementsMatch(suite.T(), []string{
+		"docker://bfcd62d56d00667d8026c822c0061b56d1d4e91dbec3ad148652dad10fa0f267",
+		"kubernetes_pod://3137267a-85f7-11e9-892f-02c6fa0ccfb0",
+	}, deleted)
+	assert.Len(suite.T(), watcher.lastSeen, 0)
+	assert.Len(suite.T(), watcher.lastSeenReady, 0)
+	assert.Len(suite.T(), watcher.tagsDigest, 0)
+	assert.Len(suite.T(), watcher.oldPhase, 0)
+
+	// Deleting an unknown pod is a no-op, and the pod is sent again when it reappears
+	require.Len(suite.T(), watcher.DeletePod(pod), 0)
+	require.Len(suite.T(), watcher.UpdatePod(pod), 1)
+}
+
 func TestPodwatcherTestSuite(t *testing.T) {
 	suite.Run(t, new(PodwatcherTestSuite))
 }
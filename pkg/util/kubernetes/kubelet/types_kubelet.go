@@ -32,6 +32,11 @@ type PodMetadata struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 	Labels      map[string]string `json:"labels,omitempty"`
 	Owners      []PodOwner        `json:"ownerReferences,omitempty"`
+	// CreationTimestamp and DeletionTimestamp are RFC3339 timestamps, kept as
+	// strings so that a timestamp in an unexpected format doesn't fail the
+	// decoding of the whole pod list
+	CreationTimestamp string `json:"creationTimestamp,omitempty"`
+	DeletionTimestamp string `json:"deletionTimestamp,omitempty"`
 }
 
 // PodOwner contains fields for unmarshalling a Pod.Metadata.Owners
@@ -53,11 +58,12 @@ type Spec struct {
 
 // ContainerSpec contains fields for unmarshalling a Pod.Spec.Containers
 type ContainerSpec struct {
-	Name           string              `json:"name"`
-	Image          string              `json:"image,omitempty"`
-	Ports          []ContainerPortSpec `json:"ports,omitempty"`
-	ReadinessProbe *ContainerProbe     `json:"readinessProbe,omitempty"`
-	Env            []EnvVar            `json:"env,omitempty"`
+	Name            string              `json:"name"`
+	Image           string              `json:"image,omitempty"`
+	ImagePullPolicy string              `json:"imagePullPolicy,omitempty"`
+	Ports           []ContainerPortSpec `json:"ports,omitempty"`
+	ReadinessProbe  *ContainerProbe     `json:"readinessProbe,omitempty"`
+	Env             []EnvVar            `json:"env,omitempty"`
 }
 
 // ContainerPortSpec contains fields for unmarshalling a Pod.Spec.Containers.Ports
@@ -102,6 +108,10 @@ type Status struct {
 	InitContainers []ContainerStatus `json:"initContainerStatuses,omitempty"`
 	AllContainers  []ContainerStatus
 	Conditions     []Conditions `json:"conditions,omitempty"`
+	QOSClass       string       `json:"qosClass,omitempty"`
+	// StartTime is the RFC3339 timestamp of the pod being acknowledged by the
+	// kubelet, empty while the pod is pending
+	StartTime string `json:"startTime,omitempty"`
 }
 
 // GetAllContainers returns the list of init and regular containers
@@ -112,8 +122,12 @@ func (s *Status) GetAllContainers() []ContainerStatus {
 
 // Conditions contains fields for unmarshalling a Pod.Status.Conditions
 type Conditions struct {
-	Type   string `json:"type,omitempty"`
-	Status string `json:"status,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// LastTransitionTime is the RFC3339 timestamp of the last change of the status
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
 }
 
 // ContainerStatus contains fields for unmarshalling a Pod.Status.Containers
@@ -147,7 +161,8 @@ type ContainerState struct {
 
 // ContainerStateWaiting is a waiting state of a container.
 type ContainerStateWaiting struct {
-	Reason string `json:"reason"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
 }
 
 // ContainerStateRunning is a running state of a container.
@@ -0,0 +1,162 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/util/containers"
+)
+
+const (
+	cgroupDriverSystemd = "systemd"
+
+	qosClassGuaranteed = "Guaranteed"
+	qosClassBurstable  = "Burstable"
+	qosClassBestEffort = "BestEffort"
+)
+
+// buildCgroupPath returns the cgroup path the kubelet creates for a
+// container, relative to the root of the cgroup hierarchy, following the
+// kubelet naming conventions of the cgroupfs and systemd cgroup drivers. It
+// returns an empty string when the QoS class of the pod is unknown.
+func buildCgroupPath(driver, root, qosClass, podUID, runtime, containerID string) string {
+	var qos string
+	switch qosClass {
+	case qosClassGuaranteed:
+	case qosClassBurstable, qosClassBestEffort:
+		qos = strings.ToLower(qosClass)
+	default:
+		return ""
+	}
+
+	if driver == cgroupDriverSystemd {
+		return buildSystemdCgroupPath(root, qos, podUID, runtime, containerID)
+	}
+
+	containerDir := containerID
+	if runtime == containers.RuntimeNameCRIO {
+		containerDir = "crio-" + containerID
+	}
+
+	return path.Join("/", root, qos, "pod"+podUID, containerDir)
+}
+
+// buildSystemdCgroupPath builds the nested slices of the systemd cgroup
+// driver, e.g. /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/<scope>
+func buildSystemdCgroupPath(root, qos, podUID, runtime, containerID string) string {
+	slices := []string{root}
+	prefix := root
+	if qos != "" {
+		prefix = root + "-" + qos
+		slices = append(slices, prefix)
+	}
+	// systemd uses dashes to express the slice hierarchy
+	slices = append(slices, prefix+"-pod"+strings.ReplaceAll(podUID, "-", "_"))
+
+	elements := make([]string, 0, len(slices)+2)
+	elements = append(elements, "/")
+	for _, slice := range slices {
+		elements = append(elements, slice+".slice")
+	}
+
+	var scopePrefix string
+	switch runtime {
+	case containers.RuntimeNameContainerd:
+		scopePrefix = "cri-containerd"
+	case containers.RuntimeNameCRIO:
+		scopePrefix = "crio"
+	default:
+		scopePrefix = runtime
+	}
+	elements = append(elements, fmt.Sprintf("%s-%s.scope", scopePrefix, containerID))
+
+	return path.Join(elements...)
+}
+
+// cgroupHierarchy returns the directory of the cgroup hierarchy in which the
+// kubelet creates the cgroups of the pods: the memory controller with cgroup
+// v1, the root of the unified hierarchy with cgroup v2
+func cgroupHierarchy(cgroupFSRoot string) string {
+	if info, err := os.Stat(path.Join(cgroupFSRoot, "memory")); err == nil && info.IsDir() {
+		return path.Join(cgroupFSRoot, "memory")
+	}
+	return cgroupFSRoot
+}
+
+// listCgroupPodUIDs returns the UIDs of the pods whose cgroup exists in the
+// given hierarchy, following the kubelet naming conventions of the cgroupfs
+// and systemd cgroup drivers
+func listCgroupPodUIDs(hierarchy, driver, root string) (map[string]struct{}, error) {
+	podsDir := path.Join(hierarchy, root)
+	qosDirs := []string{"burstable", "besteffort"}
+	if driver == cgroupDriverSystemd {
+		podsDir = path.Join(hierarchy, root+".slice")
+		qosDirs = []string{root + "-burstable.slice", root + "-besteffort.slice"}
+	}
+
+	entries, err := ioutil.ReadDir(podsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[string]struct{})
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if uid, ok := parseCgroupPodUID(driver, entry.Name()); ok {
+			uids[uid] = struct{}{}
+			continue
+		}
+		// the pods of the burstable and besteffort QoS classes are nested in
+		// the cgroup of their class
+		for _, qosDir := range qosDirs {
+			if entry.Name() != qosDir {
+				continue
+			}
+			qosEntries, err := ioutil.ReadDir(path.Join(podsDir, qosDir))
+			if err != nil {
+				return nil, err
+			}
+			for _, qosEntry := range qosEntries {
+				if uid, ok := parseCgroupPodUID(driver, qosEntry.Name()); ok && qosEntry.IsDir() {
+					uids[uid] = struct{}{}
+				}
+			}
+		}
+	}
+
+	return uids, nil
+}
+
+// parseCgroupPodUID returns the UID of the pod of a cgroup directory, e.g.
+// pod<uid> with the cgroupfs driver and kubepods-burstable-pod<uid>.slice,
+// the dashes of the UID being replaced by underscores, with systemd
+func parseCgroupPodUID(driver, name string) (string, bool) {
+	if driver == cgroupDriverSystemd {
+		if !strings.HasSuffix(name, ".slice") {
+			return "", false
+		}
+		i := strings.LastIndex(name, "-pod")
+		if i < 0 {
+			return "", false
+		}
+		uid := strings.ReplaceAll(strings.TrimSuffix(name[i+len("-pod"):], ".slice"), "_", "-")
+		return uid, uid != ""
+	}
+
+	if !strings.HasPrefix(name, "pod") || len(name) == len("pod") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, "pod"), true
+}
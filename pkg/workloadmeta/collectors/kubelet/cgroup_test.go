@@ -0,0 +1,145 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCgroupPath(t *testing.T) {
+	const (
+		podUID      = "0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21"
+		containerID = "3e8f9a"
+	)
+
+	tests := []struct {
+		name     string
+		driver   string
+		root     string
+		qosClass string
+		runtime  string
+		expected string
+	}{
+		{
+			name:     "cgroupfs guaranteed",
+			driver:   "cgroupfs",
+			root:     "kubepods",
+			qosClass: "Guaranteed",
+			runtime:  "docker",
+			expected: "/kubepods/pod0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21/3e8f9a",
+		},
+		{
+			name:     "cgroupfs burstable",
+			driver:   "cgroupfs",
+			root:     "kubepods",
+			qosClass: "Burstable",
+			runtime:  "containerd",
+			expected: "/kubepods/burstable/pod0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21/3e8f9a",
+		},
+		{
+			name:     "cgroupfs besteffort cri-o",
+			driver:   "cgroupfs",
+			root:     "kubepods",
+			qosClass: "BestEffort",
+			runtime:  "cri-o",
+			expected: "/kubepods/besteffort/pod0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21/crio-3e8f9a",
+		},
+		{
+			name:     "systemd guaranteed",
+			driver:   "systemd",
+			root:     "kubepods",
+			qosClass: "Guaranteed",
+			runtime:  "docker",
+			expected: "/kubepods.slice/kubepods-pod0bd6e2b6_5b8d_4f1b_9c3e_6a0f4d8e5c21.slice/docker-3e8f9a.scope",
+		},
+		{
+			name:     "systemd burstable",
+			driver:   "systemd",
+			root:     "kubepods",
+			qosClass: "Burstable",
+			runtime:  "containerd",
+			expected: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0bd6e2b6_5b8d_4f1b_9c3e_6a0f4d8e5c21.slice/cri-containerd-3e8f9a.scope",
+		},
+		{
+			name:     "systemd besteffort",
+			driver:   "systemd",
+			root:     "kubepods",
+			qosClass: "BestEffort",
+			runtime:  "cri-o",
+			expected: "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod0bd6e2b6_5b8d_4f1b_9c3e_6a0f4d8e5c21.slice/crio-3e8f9a.scope",
+		},
+		{
+			name:     "unknown qos class",
+			driver:   "cgroupfs",
+			root:     "kubepods",
+			qosClass: "",
+			runtime:  "docker",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, buildCgroupPath(tt.driver, tt.root, tt.qosClass, podUID, tt.runtime, containerID))
+		})
+	}
+}
+
+func TestListCgroupPodUIDs(t *testing.T) {
+	tests := []struct {
+		driver string
+		dirs   []string
+	}{
+		{
+			driver: "cgroupfs",
+			dirs: []string{
+				"kubepods/pod0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21/3e8f9a",
+				"kubepods/burstable/pod7c1d2e3f-4a5b-6c7d-8e9f-0a1b2c3d4e5f",
+				"kubepods/besteffort/pod9f8e7d6c-5b4a-3c2d-1e0f-a9b8c7d6e5f4",
+				"kubepods/burstable/unrelated",
+			},
+		},
+		{
+			driver: "systemd",
+			dirs: []string{
+				"kubepods.slice/kubepods-pod0bd6e2b6_5b8d_4f1b_9c3e_6a0f4d8e5c21.slice/cri-containerd-3e8f9a.scope",
+				"kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod7c1d2e3f_4a5b_6c7d_8e9f_0a1b2c3d4e5f.slice",
+				"kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod9f8e7d6c_5b4a_3c2d_1e0f_a9b8c7d6e5f4.slice",
+				"kubepods.slice/kubepods-burstable.slice/unrelated.scope",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.driver, func(t *testing.T) {
+			hierarchy, err := ioutil.TempDir("", "cgroup")
+			require.NoError(t, err)
+			defer os.RemoveAll(hierarchy)
+			for _, dir := range test.dirs {
+				require.NoError(t, os.MkdirAll(filepath.Join(hierarchy, dir), 0755))
+			}
+
+			uids, err := listCgroupPodUIDs(hierarchy, test.driver, "kubepods")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]struct{}{
+				"0bd6e2b6-5b8d-4f1b-9c3e-6a0f4d8e5c21": {},
+				"7c1d2e3f-4a5b-6c7d-8e9f-0a1b2c3d4e5f": {},
+				"9f8e7d6c-5b4a-3c2d-1e0f-a9b8c7d6e5f4": {},
+			}, uids)
+		})
+	}
+
+	_, err := listCgroupPodUIDs("/nonexistent", "cgroupfs", "kubepods")
+	assert.Error(t, err)
+}
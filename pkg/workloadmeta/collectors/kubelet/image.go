@@ -0,0 +1,157 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+// imageRefs is an image of the node and the containers using it
+type imageRefs struct {
+	image      workloadmeta.ContainerImageMetadata
+	containers map[string]struct{}
+}
+
+// parseImageID returns the reference by digest and the digest of an image
+// from the imageID of a container status, such as
+// docker-pullable://nginx@sha256:0123... The images which were never
+// pushed or pulled have no reference by digest, their digest is their ID.
+func parseImageID(imageID string) (string, string) {
+	if i := strings.Index(imageID, "://"); i >= 0 {
+		imageID = imageID[i+len("://"):]
+	}
+	if i := strings.LastIndex(imageID, "@"); i >= 0 {
+		return imageID, imageID[i+1:]
+	}
+	return "", imageID
+}
+
+// trackImages references the images used by the containers, and returns the
+// events of the images which are new or have new references.
+func (c *collector) trackImages(containerEvents []workloadmeta.Event) []workloadmeta.Event {
+	c.imagesMu.Lock()
+	defer c.imagesMu.Unlock()
+
+	if c.images == nil {
+		c.images = make(map[string]*imageRefs)
+		c.containerImages = make(map[string]string)
+	}
+
+	var events []workloadmeta.Event
+	changed := make(map[string]struct{})
+	for _, event := range containerEvents {
+		container := event.Entity.(workloadmeta.Container)
+		digest := container.Image.Digest
+		if digest == "" {
+			continue
+		}
+
+		if previous, found := c.containerImages[container.ID]; found && previous != digest {
+			events = append(events, c.releaseImage(container.ID)...)
+		}
+		c.containerImages[container.ID] = digest
+
+		refs, found := c.images[digest]
+		if !found {
+			refs = &imageRefs{
+				image: workloadmeta.ContainerImageMetadata{
+					EntityID: workloadmeta.EntityID{
+						Kind: workloadmeta.KindContainerImage,
+						ID:   digest,
+					},
+				},
+				containers: make(map[string]struct{}),
+			}
+			c.images[digest] = refs
+			changed[digest] = struct{}{}
+		}
+		refs.containers[container.ID] = struct{}{}
+
+		if container.Image.Name != "" && container.Image.Tag != "" {
+			if addReference(&refs.image.RepoTags, container.Image.Name+":"+container.Image.Tag) {
+				changed[digest] = struct{}{}
+			}
+		}
+		if repoDigest, _ := parseImageID(container.Image.ID); repoDigest != "" {
+			if addReference(&refs.image.RepoDigests, repoDigest) {
+				changed[digest] = struct{}{}
+			}
+		}
+	}
+
+	for _, event := range containerEvents {
+		digest := event.Entity.(workloadmeta.Container).Image.Digest
+		if _, found := changed[digest]; !found {
+			continue
+		}
+		delete(changed, digest)
+
+		// the entity is copied, the store keeps it while the
+		// references keep being updated
+		image := c.images[digest].image
+		image.RepoTags = append([]string(nil), image.RepoTags...)
+		image.RepoDigests = append([]string(nil), image.RepoDigests...)
+		events = append(events, workloadmeta.Event{
+			Source: collectorID,
+			Type:   workloadmeta.EventTypeSet,
+			Entity: image,
+		})
+	}
+
+	return events
+}
+
+// untrackImage removes the reference of an expired container to its image,
+// and returns the event unsetting the image if it was the last one.
+func (c *collector) untrackImage(containerID string) []workloadmeta.Event {
+	c.imagesMu.Lock()
+	defer c.imagesMu.Unlock()
+
+	return c.releaseImage(containerID)
+}
+
+// releaseImage removes the reference of a container to its image, it must be
+// called with imagesMu held.
+func (c *collector) releaseImage(containerID string) []workloadmeta.Event {
+	digest, found := c.containerImages[containerID]
+	if !found {
+		return nil
+	}
+	delete(c.containerImages, containerID)
+
+	refs := c.images[digest]
+	delete(refs.containers, containerID)
+	if len(refs.containers) > 0 {
+		return nil
+	}
+	delete(c.images, digest)
+
+	return []workloadmeta.Event{
+		{
+			Source: collectorID,
+			Type:   workloadmeta.EventTypeUnset,
+			Entity: refs.image.EntityID,
+		},
+	}
+}
+
+// addReference adds a reference to a sorted list of references, it returns
+// false if it was already in it.
+func addReference(references *[]string, reference string) bool {
+	i := sort.SearchStrings(*references, reference)
+	if i < len(*references) && (*references)[i] == reference {
+		return false
+	}
+	*references = append(*references, "")
+	copy((*references)[i+1:], (*references)[i:])
+	(*references)[i] = reference
+	return true
+}
@@ -10,7 +10,11 @@ package kubelet
 import (
 	"context"
 	"errors"
+	"reflect"
+	goruntime "runtime"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"k8s.io/kubernetes/third_party/forked/golang/expansion"
 
@@ -26,11 +30,81 @@ const (
 	expireFreq  = 15 * time.Second
 )
 
+// containerFieldPriorities are the merge priorities of the fields of the
+// containers set by the collector: the kubelet is the reference for how a
+// container is declared in its pod, while its state is only as fresh as the
+// last pod list or update, the runtime collectors knowing it better.
+var containerFieldPriorities = workloadmeta.FieldPriorities{
+	"Type":       workloadmeta.MergePriorityAuthoritative,
+	"CgroupPath": workloadmeta.MergePriorityAuthoritative,
+	"Image":      workloadmeta.MergePriorityAuthoritative,
+	"EnvVars":    workloadmeta.MergePriorityAuthoritative,
+	"State":      workloadmeta.MergePriorityBestEffort,
+}
+
+// podWatcher is the part of kubelet.PodWatcher used by the collector
+type podWatcher interface {
+	PullPodList(ctx context.Context) ([]*kubelet.Pod, error)
+	ComputeChanges(podList []*kubelet.Pod) ([]*kubelet.Pod, error)
+	Expire() ([]string, error)
+	UpdatePod(pod *kubelet.Pod) []*kubelet.Pod
+	DeletePod(pod *kubelet.Pod) []string
+}
+
 type collector struct {
-	watcher    *kubelet.PodWatcher
-	store      *workloadmeta.Store
-	lastExpire time.Time
-	expireFreq time.Duration
+	watcher      podWatcher
+	notify       func([]workloadmeta.Event)
+	lastExpire   time.Time
+	expireFreq   time.Duration
+	cgroupDriver string
+	cgroupRoot   string
+	// windowsNode is true on Windows nodes, where containers are isolated
+	// by the Host Compute Service instead of cgroups.
+	windowsNode bool
+	// streaming is 1 while the pod updates are received on the kubelet pod
+	// stream, the pod list is then only pulled to expire pods. Accessed atomically.
+	streaming int32
+	// streamBackoff is the initial delay before reconnecting to the pod stream
+	streamBackoff time.Duration
+
+	// lastContainers holds the last emitted entity of each container, so that
+	// the containers are only re-emitted when their own fields changed
+	lastContainers   map[string]workloadmeta.Container
+	lastContainersMu sync.Mutex
+
+	// images holds the images used by the containers, by digest, and
+	// containerImages the digest of the image of each container. An image
+	// is unset once the last container using it expired.
+	images          map[string]*imageRefs
+	containerImages map[string]string
+	imagesMu        sync.Mutex
+
+	// annotationsFilter, labelsFilter and envVarsFilter drop the pod
+	// annotations and labels and the container environment variables not
+	// read by the consumers of the store, nil keeping all of them
+	annotationsFilter *metadataFilter
+	labelsFilter      *metadataFilter
+	envVarsFilter     *metadataFilter
+	// skipEnvVars is true when the environment variables of the containers
+	// aren't collected
+	skipEnvVars bool
+	// dropped counts the metadata dropped from each entity once
+	dropped droppedMetadataCounter
+	// maxConditionMessageLength is the maximum length of the messages of the
+	// pod conditions, 0 or less keeping them whole
+	maxConditionMessageLength int
+
+	// podListHealth detects the incomplete or stale pod lists, which are
+	// ignored until the kubelet recovers
+	podListHealth *podListHealth
+
+	// ownership tracks the pods claiming each container, so that a pod
+	// deletion doesn't unset the containers of the pod replacing it
+	ownership containerOwnership
+
+	// pending tracks the containers of each pod whose image can't be
+	// pulled, their entities having a pod UID based ID until they are created
+	pending pendingContainers
 }
 
 func init() {
@@ -39,26 +113,54 @@ func init() {
 	})
 }
 
-func (c *collector) Start(_ context.Context, store *workloadmeta.Store) error {
+func (c *collector) Start(ctx context.Context, store *workloadmeta.Store) error {
 	if !config.IsFeaturePresent(config.Kubernetes) {
 		return errors.New("the Agent is not running in Kubernetes")
 	}
 
 	var err error
 
-	c.store = store
+	c.notify = store.Notify
 	c.lastExpire = time.Now()
 	c.expireFreq = expireFreq
+	c.cgroupDriver = config.Datadog.GetString("kubelet_cgroup_driver")
+	c.cgroupRoot = config.Datadog.GetString("kubelet_cgroup_root")
+	c.windowsNode = goruntime.GOOS == "windows"
+	c.annotationsFilter = newMetadataFilterFromConfig(metadataKindAnnotation, "kubelet_workloadmeta_annotations", "kubernetes_pod_annotations_as_tags")
+	c.labelsFilter = newMetadataFilterFromConfig(metadataKindLabel, "kubelet_workloadmeta_labels", "kubernetes_pod_labels_as_tags")
+	c.envVarsFilter = newMetadataFilterFromConfig(metadataKindEnvVar, "kubelet_workloadmeta_env_vars", "")
+	c.skipEnvVars = !config.Datadog.GetBool("kubelet_workloadmeta_collect_env_vars")
+	c.maxConditionMessageLength = config.Datadog.GetInt("kubelet_pod_condition_message_max_length")
+	c.podListHealth = c.newPodListHealth()
 	c.watcher, err = kubelet.NewPodWatcher(expireFreq, true)
 	if err != nil {
 		return err
 	}
 
+	c.startPodSource(ctx, config.Datadog.GetString("kubelet_pod_watcher_source"))
+
 	return nil
 }
 
 func (c *collector) Pull(ctx context.Context) error {
-	updatedPods, err := c.watcher.PullChanges(ctx)
+	if c.isStreaming() && time.Since(c.lastExpire) < c.expireFreq {
+		// the pod updates are received on the stream, the pod list is only
+		// pulled to expire the pods whose deletion was missed
+		return nil
+	}
+
+	pods, err := c.watcher.PullPodList(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.podListHealth.check(pods) != "" {
+		// the store keeps the entities of the last healthy pod list: neither
+		// the incomplete pods nor the expiry of the missing ones are emitted
+		return nil
+	}
+
+	updatedPods, err := c.watcher.ComputeChanges(pods)
 	if err != nil {
 		return err
 	}
@@ -69,16 +171,36 @@ func (c *collector) Pull(ctx context.Context) error {
 		var expiredIDs []string
 		expiredIDs, err = c.watcher.Expire()
 		if err == nil {
+			// the containers of the pods removed from the pod list are kept
+			// while the pods replacing them still list them
+			expiredIDs = c.filterDeletedPodExpires(expiredPodUIDs(expiredIDs), expiredIDs)
 			events = append(events, c.parseExpires(expiredIDs)...)
 			c.lastExpire = time.Now()
 		}
 	}
 
-	c.store.Notify(events)
+	c.notify(events)
 
 	return err
 }
 
+// newPodListHealth returns the detection of the degraded pod lists set up in
+// the config. The stale pod lists are only detected on Linux nodes, where the
+// pods created by the kubelet have a cgroup.
+func (c *collector) newPodListHealth() *podListHealth {
+	health := &podListHealth{
+		emptyStatusesThreshold: config.Datadog.GetFloat64("kubelet_pod_list_empty_statuses_threshold"),
+		maxUnchangedPulls:      config.Datadog.GetInt("kubelet_pod_list_stale_pulls"),
+	}
+	if !c.windowsNode {
+		hierarchy := cgroupHierarchy(config.Datadog.GetString("container_cgroup_root"))
+		health.listCgroupPodUIDs = func() (map[string]struct{}, error) {
+			return listCgroupPodUIDs(hierarchy, c.cgroupDriver, c.cgroupRoot)
+		}
+	}
+	return health
+}
+
 func (c *collector) parsePods(pods []*kubelet.Pod) []workloadmeta.Event {
 	events := []workloadmeta.Event{}
 
@@ -89,17 +211,34 @@ func (c *collector) parsePods(pods []*kubelet.Pod) []workloadmeta.Event {
 			continue
 		}
 
-		containerSpecs := make(
-			[]kubelet.ContainerSpec, 0,
-			len(pod.Spec.Containers)+len(pod.Spec.InitContainers),
+		// the type of a container is the spec list it is declared in
+		initContainerIDs, initPendingIDs, initContainerEvents := c.parsePodContainers(
+			pod,
+			pod.Spec.InitContainers,
+			pod.Status.InitContainers,
+			workloadmeta.ContainerTypeInit,
 		)
-		containerSpecs = append(containerSpecs, pod.Spec.InitContainers...)
-		containerSpecs = append(containerSpecs, pod.Spec.Containers...)
-
-		containerIDs, containerEvents := c.parsePodContainers(
-			containerSpecs,
-			pod.Status.GetAllContainers(),
+		containerIDs, pendingIDs, containerEvents := c.parsePodContainers(
+			pod,
+			pod.Spec.Containers,
+			pod.Status.Containers,
+			workloadmeta.ContainerTypeRegular,
 		)
+		containerEvents = append(initContainerEvents, containerEvents...)
+		pendingIDs = append(initPendingIDs, pendingIDs...)
+
+		// the pending containers created since the last update of the pod,
+		// or which aren't failing anymore, are unset before their
+		// replacement is set
+		pendingEvents := c.unsetPendingContainers(c.pending.set(podMeta.UID, pendingIDs))
+
+		// the images are emitted before the containers referencing them
+		imageEvents := c.trackImages(containerEvents)
+
+		// a change of the pod alone, such as its annotations being
+		// rewritten, only re-emits the pod: the tags of its containers
+		// are computed from the pod entity
+		containerEvents = c.filterUnchangedContainers(containerEvents)
 
 		podOwners := pod.Owners()
 		owners := make([]workloadmeta.KubernetesPodOwner, 0, len(podOwners))
@@ -111,76 +250,171 @@ func (c *collector) parsePods(pods []*kubelet.Pod) []workloadmeta.Event {
 			})
 		}
 
+		conditions, readyCondition := c.parsePodConditions(pod.Status.Conditions)
+
 		entity := workloadmeta.KubernetesPod{
 			EntityID: workloadmeta.EntityID{
 				Kind: workloadmeta.KindKubernetesPod,
 				ID:   podMeta.UID,
 			},
-			EntityMeta: workloadmeta.EntityMeta{
+			EntityMeta: c.filterEntityMeta(podMeta.UID, workloadmeta.EntityMeta{
 				Name:        podMeta.Name,
 				Namespace:   podMeta.Namespace,
 				Annotations: podMeta.Annotations,
 				Labels:      podMeta.Labels,
-			},
+			}),
 			Owners:                     owners,
 			PersistentVolumeClaimNames: pod.GetPersistentVolumeClaimNames(),
 			Containers:                 containerIDs,
-			Ready:                      kubelet.IsPodReady(pod),
+			InitContainers:             initContainerIDs,
+			Ready:                      kubelet.IsPodReadyWithCondition(pod, readyCondition),
 			Phase:                      pod.Status.Phase,
 			IP:                         pod.Status.PodIP,
+			HostIP:                     pod.Status.HostIP,
 			PriorityClass:              pod.Spec.PriorityClassName,
+			CreationTimestamp:          parseTimestamp(podMeta.CreationTimestamp),
+			StartTime:                  parseTimestamp(pod.Status.StartTime),
+			DeletionTimestamp:          parseTimestamp(podMeta.DeletionTimestamp),
+			Conditions:                 conditions,
+			PendingContainers:          pendingIDs,
 		}
+		// a deletion timestamp in an unexpected format still marks the pod terminating
+		entity.Terminating = podMeta.DeletionTimestamp != ""
 
+		events = append(events, pendingEvents...)
+		events = append(events, imageEvents...)
 		events = append(events, containerEvents...)
 		events = append(events, workloadmeta.Event{
 			Source: collectorID,
 			Type:   workloadmeta.EventTypeSet,
 			Entity: entity,
 		})
+
+		// the containers kept for this pod while another pod was deleted
+		// are unset once it doesn't list them anymore
+		unclaimed := c.ownership.claim(podMeta.UID, podContainerIDs(pod))
+		events = append(events, c.parseExpires(unclaimed)...)
 	}
 
 	return events
 }
 
+// parsePodConditions returns the conditions of a pod, their messages truncated,
+// and whether its Ready condition is True
+func (c *collector) parsePodConditions(podConditions []kubelet.Conditions) ([]workloadmeta.KubernetesPodCondition, bool) {
+	if len(podConditions) == 0 {
+		return nil, false
+	}
+
+	conditions := make([]workloadmeta.KubernetesPodCondition, 0, len(podConditions))
+	ready := false
+	for _, condition := range podConditions {
+		if condition.Type == "Ready" && condition.Status == "True" {
+			ready = true
+		}
+		conditions = append(conditions, workloadmeta.KubernetesPodCondition{
+			Type:               condition.Type,
+			Status:             condition.Status,
+			Reason:             condition.Reason,
+			Message:            truncateMessage(condition.Message, c.maxConditionMessageLength),
+			LastTransitionTime: parseTimestamp(condition.LastTransitionTime),
+		})
+	}
+
+	return conditions, ready
+}
+
+// truncateMessage truncates a message longer than maxLength bytes, without
+// cutting a UTF-8 character, a maxLength of 0 or less keeping it whole
+func truncateMessage(message string, maxLength int) string {
+	if maxLength <= 0 || len(message) <= maxLength {
+		return message
+	}
+	const ellipsis = "..."
+	if maxLength <= len(ellipsis) {
+		return ellipsis[:maxLength]
+	}
+	end := maxLength - len(ellipsis)
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+	return message[:end] + ellipsis
+}
+
+// parsePodContainers returns the IDs of the containers of a pod created by
+// the runtime, the IDs of those whose image can't be pulled, and their events
 func (c *collector) parsePodContainers(
+	pod *kubelet.Pod,
 	containerSpecs []kubelet.ContainerSpec,
 	containerStatuses []kubelet.ContainerStatus,
-) ([]string, []workloadmeta.Event) {
+	containerType workloadmeta.ContainerType,
+) ([]string, []string, []workloadmeta.Event) {
 	containerIDs := make([]string, 0, len(containerStatuses))
+	var pendingIDs []string
 	events := make([]workloadmeta.Event, 0, len(containerStatuses))
 
 	for _, container := range containerStatuses {
-		if container.ID == "" {
+		pending := isImagePullFailure(container)
+		if container.ID == "" && !pending {
 			// A container without an ID has not been created by
 			// the runtime yet, so we ignore them until it's
-			// detected again.
+			// detected again, unless its image can't be pulled.
 			continue
 		}
 
-		var env map[string]string
 		var image workloadmeta.ContainerImage
 		var ports []workloadmeta.ContainerPort
 
-		runtime, containerID := containers.SplitEntityName(container.ID)
-		containerIDs = append(containerIDs, containerID)
-
 		containerSpec := findContainerSpec(container.Name, containerSpecs)
 		if containerSpec != nil {
-			env = extractEnvFromSpec(containerSpec.Env)
 			image = buildImage(containerSpec.Image)
+			image.PullPolicy = containerSpec.ImagePullPolicy
 
-			ports = make([]workloadmeta.ContainerPort, 0, len(containerSpec.Ports))
-			for _, port := range containerSpec.Ports {
-				ports = append(ports, workloadmeta.ContainerPort{
-					Name: port.Name,
-					Port: port.ContainerPort,
-				})
-			}
+			ports = parseContainerPorts(pod, containerSpec.Ports)
 		} else {
 			log.Debugf("cannot find spec for container %q", container.Name)
 		}
 
+		if pending {
+			// the container has no ID nor image yet, its entity is
+			// identified by its pod and its name
+			containerID := pendingContainerID(pod.Metadata.UID, container.Name)
+			pendingIDs = append(pendingIDs, containerID)
+			events = append(events, workloadmeta.Event{
+				Source:     collectorID,
+				Type:       workloadmeta.EventTypeSet,
+				Priorities: containerFieldPriorities,
+				Entity: workloadmeta.Container{
+					EntityID: workloadmeta.EntityID{
+						Kind: workloadmeta.KindContainer,
+						ID:   containerID,
+					},
+					EntityMeta: workloadmeta.EntityMeta{
+						Name: container.Name,
+					},
+					Image:   image,
+					EnvVars: c.filterEnvVars(containerID, containerSpec),
+					Ports:   ports,
+					State: workloadmeta.ContainerState{
+						WaitingReason:  container.State.Waiting.Reason,
+						WaitingMessage: truncateMessage(container.State.Waiting.Message, c.maxConditionMessageLength),
+					},
+					Type: containerType,
+				},
+			})
+			continue
+		}
+
+		runtime, containerID := containers.SplitEntityName(container.ID)
+		containerIDs = append(containerIDs, containerID)
+
 		image.ID = container.ImageID
+		_, image.Digest = parseImageID(container.ImageID)
+
+		var cgroupPath string
+		if !c.windowsNode {
+			cgroupPath = buildCgroupPath(c.cgroupDriver, c.cgroupRoot, pod.Status.QOSClass, pod.Metadata.UID, runtime, containerID)
+		}
 
 		containerState := workloadmeta.ContainerState{}
 		if st := container.State.Running; st != nil {
@@ -190,11 +424,16 @@ func (c *collector) parsePodContainers(
 			containerState.Running = false
 			containerState.StartedAt = st.StartedAt
 			containerState.FinishedAt = st.FinishedAt
+			if containerType == workloadmeta.ContainerTypeInit {
+				exitCode := st.ExitCode
+				containerState.ExitCode = &exitCode
+			}
 		}
 
 		events = append(events, workloadmeta.Event{
-			Source: collectorID,
-			Type:   workloadmeta.EventTypeSet,
+			Source:     collectorID,
+			Type:       workloadmeta.EventTypeSet,
+			Priorities: containerFieldPriorities,
 			Entity: workloadmeta.Container{
 				EntityID: workloadmeta.EntityID{
 					Kind: workloadmeta.KindContainer,
@@ -203,16 +442,125 @@ func (c *collector) parsePodContainers(
 				EntityMeta: workloadmeta.EntityMeta{
 					Name: container.Name,
 				},
-				Image:   image,
-				EnvVars: env,
-				Ports:   ports,
-				Runtime: workloadmeta.ContainerRuntime(runtime),
-				State:   containerState,
+				Image:      image,
+				EnvVars:    c.filterEnvVars(containerID, containerSpec),
+				Ports:      ports,
+				Runtime:    workloadmeta.ContainerRuntime(runtime),
+				State:      containerState,
+				Type:       containerType,
+				CgroupPath: cgroupPath,
 			},
 		})
 	}
 
-	return containerIDs, events
+	return containerIDs, pendingIDs, events
+}
+
+// filterEntityMeta drops the annotations and labels of a pod which aren't
+// collected
+func (c *collector) filterEntityMeta(podUID string, meta workloadmeta.EntityMeta) workloadmeta.EntityMeta {
+	var dropped int
+	meta.Annotations, dropped = c.annotationsFilter.filter(meta.Annotations)
+	c.dropped.count(metadataKindAnnotation, podUID, dropped)
+	meta.Labels, dropped = c.labelsFilter.filter(meta.Labels)
+	c.dropped.count(metadataKindLabel, podUID, dropped)
+	return meta
+}
+
+// filterEnvVars returns the environment variables of a container which are
+// collected
+func (c *collector) filterEnvVars(containerID string, containerSpec *kubelet.ContainerSpec) map[string]string {
+	if containerSpec == nil {
+		return nil
+	}
+	if c.skipEnvVars {
+		c.dropped.count(metadataKindEnvVar, containerID, len(containerSpec.Env))
+		return nil
+	}
+	env, dropped := c.envVarsFilter.filter(extractEnvFromSpec(containerSpec.Env))
+	c.dropped.count(metadataKindEnvVar, containerID, dropped)
+	return env
+}
+
+// filterUnchangedContainers drops the events of the containers whose entity
+// is the same as the last one emitted.
+func (c *collector) filterUnchangedContainers(events []workloadmeta.Event) []workloadmeta.Event {
+	c.lastContainersMu.Lock()
+	defer c.lastContainersMu.Unlock()
+
+	if c.lastContainers == nil {
+		c.lastContainers = make(map[string]workloadmeta.Container)
+	}
+
+	changed := events[:0]
+	for _, event := range events {
+		container := event.Entity.(workloadmeta.Container)
+		if last, found := c.lastContainers[container.ID]; found && reflect.DeepEqual(last, container) {
+			continue
+		}
+		c.lastContainers[container.ID] = container
+		changed = append(changed, event)
+	}
+
+	return changed
+}
+
+// timestampLayouts are the layouts of the timestamps found in the kubelet
+// payload: RFC3339 with or without fractional seconds, with a "Z" or a
+// numeric offset, and without any zone, which is then UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseTimestamp parses a timestamp of the kubelet payload, it returns the
+// zero time if the timestamp is empty or in an unknown format
+func parseTimestamp(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+	log.Debugf("cannot parse kubelet timestamp %q", value)
+	return time.Time{}
+}
+
+// parseContainerPorts returns the ports of a container. The ports of the
+// containers of host network pods are always exposed on the host, on the
+// same port, even if the hostPort is omitted in their spec.
+func parseContainerPorts(pod *kubelet.Pod, portSpecs []kubelet.ContainerPortSpec) []workloadmeta.ContainerPort {
+	ports := make([]workloadmeta.ContainerPort, 0, len(portSpecs))
+	for _, port := range portSpecs {
+		protocol := port.Protocol
+		if protocol == "" {
+			// k8s defaults to TCP if the protocol is omitted
+			protocol = "TCP"
+		}
+
+		hostPort := port.HostPort
+		if pod.Spec.HostNetwork && hostPort == 0 {
+			hostPort = port.ContainerPort
+		}
+
+		var hostIP string
+		if hostPort != 0 {
+			hostIP = pod.Status.HostIP
+		}
+
+		ports = append(ports, workloadmeta.ContainerPort{
+			Name:     port.Name,
+			Port:     port.ContainerPort,
+			Protocol: protocol,
+			HostPort: hostPort,
+			HostIP:   hostIP,
+		})
+	}
+
+	return ports
 }
 
 func findContainerSpec(name string, specs []kubelet.ContainerSpec) *kubelet.ContainerSpec {
@@ -273,6 +621,8 @@ func buildImage(imageSpec string) workloadmeta.ContainerImage {
 
 func (c *collector) parseExpires(expiredIDs []string) []workloadmeta.Event {
 	events := make([]workloadmeta.Event, 0, len(expiredIDs))
+	var unclaimed []string
+	var pendingEvents []workloadmeta.Event
 
 	for _, expiredID := range expiredIDs {
 		prefix, id := containers.SplitEntityName(expiredID)
@@ -280,9 +630,16 @@ func (c *collector) parseExpires(expiredIDs []string) []workloadmeta.Event {
 		var kind workloadmeta.Kind
 		if prefix == kubelet.KubePodEntityName {
 			kind = workloadmeta.KindKubernetesPod
+			unclaimed = append(unclaimed, c.ownership.release(id)...)
+			pendingEvents = append(pendingEvents, c.unsetPendingContainers(c.pending.release(id))...)
 		} else {
 			kind = workloadmeta.KindContainer
+			c.lastContainersMu.Lock()
+			delete(c.lastContainers, id)
+			c.lastContainersMu.Unlock()
+			c.ownership.forget(expiredID)
 		}
+		c.dropped.forget(id)
 
 		events = append(events, workloadmeta.Event{
 			Source: collectorID,
@@ -292,6 +649,19 @@ func (c *collector) parseExpires(expiredIDs []string) []workloadmeta.Event {
 				ID:   id,
 			},
 		})
+
+		if kind == workloadmeta.KindContainer {
+			// the image is unset after the last container using it
+			events = append(events, c.untrackImage(id)...)
+		}
+	}
+
+	// the containers of the expired pods whose image couldn't be pulled
+	// are unset with them
+	events = append(events, pendingEvents...)
+
+	if len(unclaimed) > 0 {
+		events = append(events, c.parseExpires(unclaimed)...)
 	}
 
 	return events
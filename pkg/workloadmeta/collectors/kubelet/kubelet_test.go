@@ -0,0 +1,684 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+func loadPodList(t *testing.T, path string) []*kubelet.Pod {
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var podList kubelet.PodList
+	require.NoError(t, json.Unmarshal(raw, &podList))
+	// the kubelet client fills the init and regular containers list
+	for _, pod := range podList.Items {
+		pod.Status.AllContainers = append(append([]kubelet.ContainerStatus{}, pod.Status.InitContainers...), pod.Status.Containers...)
+	}
+	return podList.Items
+}
+
+func containersByName(events []workloadmeta.Event) map[string]workloadmeta.Container {
+	containers := make(map[string]workloadmeta.Container)
+	for _, event := range events {
+		if container, ok := event.Entity.(workloadmeta.Container); ok {
+			containers[container.Name] = container
+		}
+	}
+	return containers
+}
+
+func TestParsePodsWindows(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods", windowsNode: true}
+	events := c.parsePods(loadPodList(t, "testdata/podlist_windows.json"))
+
+	containers := containersByName(events)
+	require.Len(t, containers, 2)
+
+	iis := containers["iis"]
+	assert.Equal(t, "e4a9c2f7b1d6e3a8f0c5b9d2e7a4f1c6b3d8e0a5f2c7b4d9e1a6f3c8b5d0e2a7", iis.ID)
+	assert.Equal(t, workloadmeta.ContainerRuntime("containerd"), iis.Runtime)
+	assert.Equal(t, workloadmeta.ContainerImage{
+		ID:         "mcr.microsoft.com/dotnet/framework/aspnet@sha256:c3f1a8e6b2d9f4a7e0c5b8d1f6a3e9c2b7d4f0a5e8c1b6d3f9a2e7c4b0d5f8a1",
+		Digest:     "sha256:c3f1a8e6b2d9f4a7e0c5b8d1f6a3e9c2b7d4f0a5e8c1b6d3f9a2e7c4b0d5f8a1",
+		RawName:    "mcr.microsoft.com/dotnet/framework/aspnet:4.8-windowsservercore-ltsc2019",
+		Name:       "mcr.microsoft.com/dotnet/framework/aspnet",
+		ShortName:  "aspnet",
+		Tag:        "4.8-windowsservercore-ltsc2019",
+		PullPolicy: "IfNotPresent",
+	}, iis.Image)
+	assert.Equal(t, map[string]string{
+		"APP_ROOT":      `C:\inetpub\wwwroot`,
+		"APP_LOGS":      `C:\inetpub\wwwroot\logs`,
+		"DD_AGENT_HOST": "",
+	}, iis.EnvVars)
+	assert.True(t, iis.State.Running)
+	assert.Equal(t, workloadmeta.ContainerTypeRegular, iis.Type)
+	assert.Nil(t, iis.State.ExitCode)
+	// Windows containers don't run in cgroups
+	assert.Empty(t, iis.CgroupPath)
+
+	initConfig := containers["init-config"]
+	assert.Equal(t, workloadmeta.ContainerRuntime("containerd"), initConfig.Runtime)
+	assert.Equal(t, "nanoserver", initConfig.Image.ShortName)
+	assert.Equal(t, "ltsc2019", initConfig.Image.Tag)
+	assert.False(t, initConfig.State.Running)
+	assert.Equal(t, workloadmeta.ContainerTypeInit, initConfig.Type)
+	require.NotNil(t, initConfig.State.ExitCode)
+	assert.Equal(t, int32(0), *initConfig.State.ExitCode)
+	assert.Empty(t, initConfig.CgroupPath)
+}
+
+func TestParsePodsInitContainers(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Status.InitContainers[0].State.Terminated.ExitCode = 1
+	events := c.parsePods(pods)
+
+	var pod workloadmeta.KubernetesPod
+	for _, event := range events {
+		if entity, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+			pod = entity
+		}
+	}
+	containers := containersByName(events)
+	assert.Equal(t, []string{containers["iis"].ID}, pod.Containers)
+	assert.Equal(t, []string{containers["init-config"].ID}, pod.InitContainers)
+	assert.Equal(t, []string{containers["init-config"].ID, containers["iis"].ID}, pod.AllContainers())
+
+	// a failed init container is reported with its exit code
+	initConfig := containers["init-config"]
+	assert.Equal(t, workloadmeta.ContainerTypeInit, initConfig.Type)
+	require.NotNil(t, initConfig.State.ExitCode)
+	assert.Equal(t, int32(1), *initConfig.State.ExitCode)
+}
+
+func TestParsePodsAnnotationsUpdate(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	require.Len(t, pods, 1)
+	events := c.parsePods(pods)
+	// two images, two containers and the pod
+	require.Len(t, events, 5)
+
+	// the same pod with one annotation rewritten only re-emits the pod
+	pods = loadPodList(t, "testdata/podlist_windows.json")
+	if pods[0].Metadata.Annotations == nil {
+		pods[0].Metadata.Annotations = make(map[string]string)
+	}
+	pods[0].Metadata.Annotations["cert-manager.io/revision"] = "2"
+	events = c.parsePods(pods)
+	require.Len(t, events, 1)
+	pod, ok := events[0].Entity.(workloadmeta.KubernetesPod)
+	require.True(t, ok)
+	assert.Equal(t, "2", pod.Annotations["cert-manager.io/revision"])
+	assert.Len(t, pod.Containers, 2)
+
+	// a container is re-emitted when its own fields changed, with its
+	// image which has a new tag
+	pods = loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Spec.Containers[0].Image = pods[0].Spec.Containers[0].Image + "-patched"
+	events = c.parsePods(pods)
+	assert.Len(t, events, 3)
+	assert.Len(t, containersByName(events), 1)
+
+	// and after it expired
+	containerID := pod.Containers[0]
+	c.parseExpires([]string{"containerd://" + containerID})
+	events = c.parsePods(pods)
+	assert.Len(t, events, 3)
+	assert.Equal(t, workloadmeta.KindContainerImage, events[0].Entity.GetID().Kind)
+	assert.Equal(t, containerID, events[1].Entity.GetID().ID)
+}
+
+func TestParsePodsImages(t *testing.T) {
+	const digest = "sha256:2fbd3d9ace56ac3ec2775f64f5ec5e6551ab30c5e25cc0c2633f33b15b8ca542"
+	newPod := func(uid string, containerID string, image string) *kubelet.Pod {
+		return &kubelet.Pod{
+			Metadata: kubelet.PodMetadata{Name: "hyperkube-" + uid, UID: uid},
+			Spec: kubelet.Spec{
+				Containers: []kubelet.ContainerSpec{{Name: "hyperkube", Image: image}},
+			},
+			Status: kubelet.Status{
+				AllContainers: []kubelet.ContainerStatus{
+					{
+						Name:    "hyperkube",
+						ID:      "docker://" + containerID,
+						Image:   image,
+						ImageID: "docker-pullable://gcr.io/google_containers/hyperkube@" + digest,
+					},
+				},
+			},
+		}
+	}
+	imageEvents := func(events []workloadmeta.Event) []workloadmeta.Event {
+		var images []workloadmeta.Event
+		for _, event := range events {
+			if event.Entity.GetID().Kind == workloadmeta.KindContainerImage {
+				images = append(images, event)
+			}
+		}
+		return images
+	}
+
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	events := c.parsePods([]*kubelet.Pod{newPod("pod-1", "container-1", "gcr.io/google_containers/hyperkube:v1.8.3")})
+	require.Len(t, events, 3)
+	assert.Equal(t, workloadmeta.Event{
+		Source: collectorID,
+		Type:   workloadmeta.EventTypeSet,
+		Entity: workloadmeta.ContainerImageMetadata{
+			EntityID:    workloadmeta.EntityID{Kind: workloadmeta.KindContainerImage, ID: digest},
+			RepoTags:    []string{"gcr.io/google_containers/hyperkube:v1.8.3"},
+			RepoDigests: []string{"gcr.io/google_containers/hyperkube@" + digest},
+		},
+	}, events[0])
+	assert.Equal(t, digest, containersByName(events)["hyperkube"].Image.Digest)
+
+	// the image isn't re-emitted on the next pulls
+	events = c.parsePods([]*kubelet.Pod{newPod("pod-1", "container-1", "gcr.io/google_containers/hyperkube:v1.8.3")})
+	assert.Empty(t, imageEvents(events))
+
+	// another pod uses the image with another tag
+	events = c.parsePods([]*kubelet.Pod{newPod("pod-2", "container-2", "gcr.io/google_containers/hyperkube:stable")})
+	images := imageEvents(events)
+	require.Len(t, images, 1)
+	assert.Equal(t, []string{
+		"gcr.io/google_containers/hyperkube:stable",
+		"gcr.io/google_containers/hyperkube:v1.8.3",
+	}, images[0].Entity.(workloadmeta.ContainerImageMetadata).RepoTags)
+
+	// the image is kept while a container uses it
+	events = c.parseExpires([]string{"docker://container-1", kubelet.PodUIDToEntityName("pod-1")})
+	assert.Empty(t, imageEvents(events))
+
+	// and unset after the last one
+	events = c.parseExpires([]string{"docker://container-2", kubelet.PodUIDToEntityName("pod-2")})
+	assert.Equal(t, []workloadmeta.Event{
+		{
+			Source: collectorID,
+			Type:   workloadmeta.EventTypeUnset,
+			Entity: workloadmeta.EntityID{Kind: workloadmeta.KindContainerImage, ID: digest},
+		},
+	}, imageEvents(events))
+	assert.Empty(t, c.images)
+	assert.Empty(t, c.containerImages)
+}
+
+func TestParseImageID(t *testing.T) {
+	for imageID, expected := range map[string][2]string{
+		"docker-pullable://nginx@sha256:0123": {"nginx@sha256:0123", "sha256:0123"},
+		"docker.io/library/nginx@sha256:0123": {"docker.io/library/nginx@sha256:0123", "sha256:0123"},
+		"docker://sha256:4567":                {"", "sha256:4567"},
+		"sha256:4567":                         {"", "sha256:4567"},
+		"":                                    {"", ""},
+	} {
+		repoDigest, digest := parseImageID(imageID)
+		assert.Equal(t, expected, [2]string{repoDigest, digest}, imageID)
+	}
+}
+
+func TestParsePodsTimestamps(t *testing.T) {
+	podEntity := func(events []workloadmeta.Event) workloadmeta.KubernetesPod {
+		for _, event := range events {
+			if pod, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+				return pod
+			}
+		}
+		t.Fatal("no pod entity")
+		return workloadmeta.KubernetesPod{}
+	}
+
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	pod := podEntity(c.parsePods(pods))
+	assert.Equal(t, time.Date(2021, 10, 4, 9, 12, 41, 0, time.UTC), pod.CreationTimestamp)
+	assert.Equal(t, time.Date(2021, 10, 4, 9, 12, 41, 0, time.UTC), pod.StartTime)
+	assert.True(t, pod.DeletionTimestamp.IsZero())
+	assert.False(t, pod.Terminating)
+
+	// terminating pod, with a numeric offset and fractional seconds
+	pods = loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Metadata.DeletionTimestamp = "2021-10-04T11:30:00.5+02:00"
+	pod = podEntity(c.parsePods(pods))
+	assert.Equal(t, time.Date(2021, 10, 4, 9, 30, 0, 500000000, time.UTC), pod.DeletionTimestamp)
+	assert.True(t, pod.Terminating)
+
+	// a deletion timestamp in an unknown format still marks the pod terminating
+	pods = loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Metadata.DeletionTimestamp = "Mon Oct  4 09:30:00 2021"
+	pod = podEntity(c.parsePods(pods))
+	assert.True(t, pod.DeletionTimestamp.IsZero())
+	assert.True(t, pod.Terminating)
+
+	// pending pod not acknowledged by the kubelet yet
+	pods = loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Status.Phase = "Pending"
+	pods[0].Status.StartTime = ""
+	pods[0].Metadata.CreationTimestamp = "2021-10-04T09:12:41+0000"
+	pod = podEntity(c.parsePods(pods))
+	assert.Equal(t, time.Date(2021, 10, 4, 9, 12, 41, 0, time.UTC), pod.CreationTimestamp)
+	assert.True(t, pod.StartTime.IsZero())
+	assert.False(t, pod.Terminating)
+}
+
+func TestParsePodsPorts(t *testing.T) {
+	newPod := func(hostNetwork bool) *kubelet.Pod {
+		pod := &kubelet.Pod{
+			Metadata: kubelet.PodMetadata{Name: "coredns", UID: "coredns-uid"},
+			Spec: kubelet.Spec{
+				HostNetwork: hostNetwork,
+				Containers: []kubelet.ContainerSpec{
+					{
+						Name:  "coredns",
+						Image: "coredns/coredns:1.8.0",
+						Ports: []kubelet.ContainerPortSpec{
+							{Name: "dns", ContainerPort: 53, Protocol: "UDP"},
+							{Name: "dns-tcp", ContainerPort: 53, Protocol: "TCP", HostPort: 5353},
+							{Name: "metrics", ContainerPort: 9153},
+						},
+					},
+					{
+						Name:  "sidecar",
+						Image: "nginx:1.21",
+						Ports: []kubelet.ContainerPortSpec{
+							// port names are only unique within a container
+							{Name: "metrics", ContainerPort: 9113, Protocol: "TCP"},
+						},
+					},
+				},
+			},
+			Status: kubelet.Status{
+				HostIP: "10.0.0.1",
+				PodIP:  "192.168.1.2",
+				AllContainers: []kubelet.ContainerStatus{
+					{Name: "coredns", ID: "containerd://coredns-id"},
+					{Name: "sidecar", ID: "containerd://sidecar-id"},
+				},
+			},
+		}
+		if hostNetwork {
+			pod.Status.PodIP = pod.Status.HostIP
+		}
+		return pod
+	}
+
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	events := c.parsePods([]*kubelet.Pod{newPod(false)})
+	require.Len(t, events, 3)
+	pod, ok := events[2].Entity.(workloadmeta.KubernetesPod)
+	require.True(t, ok)
+	assert.Equal(t, "192.168.1.2", pod.IP)
+	assert.Equal(t, "10.0.0.1", pod.HostIP)
+
+	containers := containersByName(events)
+	assert.Equal(t, []workloadmeta.ContainerPort{
+		{Name: "dns", Port: 53, Protocol: "UDP"},
+		{Name: "dns-tcp", Port: 53, Protocol: "TCP", HostPort: 5353, HostIP: "10.0.0.1"},
+		{Name: "metrics", Port: 9153, Protocol: "TCP"},
+	}, containers["coredns"].Ports)
+	assert.Equal(t, []workloadmeta.ContainerPort{
+		{Name: "metrics", Port: 9113, Protocol: "TCP"},
+	}, containers["sidecar"].Ports)
+
+	// the ports of host network pods are exposed on the host even without hostPort
+	c = &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	containers = containersByName(c.parsePods([]*kubelet.Pod{newPod(true)}))
+	assert.Equal(t, []workloadmeta.ContainerPort{
+		{Name: "dns", Port: 53, Protocol: "UDP", HostPort: 53, HostIP: "10.0.0.1"},
+		{Name: "dns-tcp", Port: 53, Protocol: "TCP", HostPort: 5353, HostIP: "10.0.0.1"},
+		{Name: "metrics", Port: 9153, Protocol: "TCP", HostPort: 9153, HostIP: "10.0.0.1"},
+	}, containers["coredns"].Ports)
+	assert.Equal(t, []workloadmeta.ContainerPort{
+		{Name: "metrics", Port: 9113, Protocol: "TCP", HostPort: 9113, HostIP: "10.0.0.1"},
+	}, containers["sidecar"].Ports)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2021, 10, 4, 9, 12, 41, 0, time.UTC)
+	for _, value := range []string{
+		"2021-10-04T09:12:41Z",
+		"2021-10-04T09:12:41.000Z",
+		"2021-10-04T11:12:41+02:00",
+		"2021-10-04T04:12:41-0500",
+		"2021-10-04T09:12:41",
+	} {
+		assert.Equal(t, expected, parseTimestamp(value), value)
+	}
+	assert.True(t, parseTimestamp("").IsZero())
+	assert.True(t, parseTimestamp("yesterday").IsZero())
+}
+
+func TestParsePodsLinuxFixtures(t *testing.T) {
+	fixtures := []string{
+		"podlist_1.8-2.json",
+		"podlist_container_ready.json",
+		"podlist_init_container_running.json",
+		"podlist_init_container_terminated.json",
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+			pods := loadPodList(t, filepath.Join("..", "..", "..", "util", "kubernetes", "kubelet", "testdata", fixture))
+			events := c.parsePods(pods)
+
+			containers := containersByName(events)
+			require.NotEmpty(t, containers)
+			for name, container := range containers {
+				assert.NotEmpty(t, container.ID, name)
+				assert.Contains(t, []workloadmeta.ContainerRuntime{"docker", "containerd"}, container.Runtime, name)
+				assert.NotEmpty(t, container.Image.Name, name)
+				assert.NotEmpty(t, container.Image.ShortName, name)
+				assert.NotEmpty(t, container.Image.Tag, name)
+			}
+		})
+	}
+}
+
+type fakePodWatcher struct {
+	sync.Mutex
+	pulls   int
+	pods    []*kubelet.Pod
+	updated []*kubelet.Pod
+	deleted []*kubelet.Pod
+}
+
+func (w *fakePodWatcher) PullPodList(ctx context.Context) ([]*kubelet.Pod, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.pulls++
+	return w.pods, nil
+}
+
+// ComputeChanges returns every pod of the pod list as changed
+func (w *fakePodWatcher) ComputeChanges(podList []*kubelet.Pod) ([]*kubelet.Pod, error) {
+	return podList, nil
+}
+
+func (w *fakePodWatcher) Expire() ([]string, error) {
+	return nil, nil
+}
+
+func (w *fakePodWatcher) UpdatePod(pod *kubelet.Pod) []*kubelet.Pod {
+	w.Lock()
+	defer w.Unlock()
+	w.updated = append(w.updated, pod)
+	return []*kubelet.Pod{pod}
+}
+
+func (w *fakePodWatcher) DeletePod(pod *kubelet.Pod) []string {
+	w.Lock()
+	defer w.Unlock()
+	w.deleted = append(w.deleted, pod)
+	return []string{kubelet.PodUIDToEntityName(pod.Metadata.UID)}
+}
+
+// fakePodStreamer replays a scripted stream call per call of StreamLocalPods,
+// the last one being repeated
+type fakePodStreamer struct {
+	sync.Mutex
+	calls   int
+	scripts []func(handler func(kubelet.PodEvent)) error
+}
+
+func (s *fakePodStreamer) StreamLocalPods(ctx context.Context, handler func(kubelet.PodEvent)) error {
+	s.Lock()
+	script := s.scripts[len(s.scripts)-1]
+	if s.calls < len(s.scripts) {
+		script = s.scripts[s.calls]
+	}
+	s.calls++
+	s.Unlock()
+	return script(handler)
+}
+
+func (s *fakePodStreamer) callCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+func newStreamingCollector(watcher podWatcher) *collector {
+	return &collector{
+		watcher:       watcher,
+		notify:        func([]workloadmeta.Event) {},
+		lastExpire:    time.Now(),
+		expireFreq:    expireFreq,
+		streaming:     streamingEnabled,
+		streamBackoff: time.Millisecond,
+	}
+}
+
+func streamPod(uid string) *kubelet.Pod {
+	return &kubelet.Pod{Metadata: kubelet.PodMetadata{Name: "nginx", UID: uid}}
+}
+
+func TestStreamPodsReconnects(t *testing.T) {
+	watcher := &fakePodWatcher{}
+	c := newStreamingCollector(watcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streamer := &fakePodStreamer{scripts: []func(func(kubelet.PodEvent)) error{
+		func(handler func(kubelet.PodEvent)) error {
+			handler(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: streamPod("1")})
+			return nil
+		},
+		func(handler func(kubelet.PodEvent)) error {
+			return errors.New("connection reset")
+		},
+		func(handler func(kubelet.PodEvent)) error {
+			handler(kubelet.PodEvent{Type: kubelet.PodDeleted, Pod: streamPod("1")})
+			return nil
+		},
+		func(handler func(kubelet.PodEvent)) error {
+			<-ctx.Done()
+			return nil
+		},
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		c.streamPods(ctx, streamer)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return streamer.callCount() == 4 }, 5*time.Second, time.Millisecond)
+	assert.True(t, c.isStreaming())
+	watcher.Lock()
+	assert.Len(t, watcher.updated, 1)
+	assert.Len(t, watcher.deleted, 1)
+	watcher.Unlock()
+
+	cancel()
+	<-done
+	assert.False(t, c.isStreaming())
+}
+
+func TestStartPodSource(t *testing.T) {
+	defer func(original func() (kubelet.PodStreamer, error)) { getPodStreamer = original }(getPodStreamer)
+
+	for _, tt := range []struct {
+		source    string
+		streaming bool
+		calls     int
+	}{
+		{source: "polling", streaming: false, calls: 0},
+		{source: "streaming", streaming: true, calls: 1},
+		{source: "watch", streaming: false, calls: 0},
+	} {
+		t.Run(tt.source, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			received := make(chan struct{})
+			streamer := &fakePodStreamer{scripts: []func(func(kubelet.PodEvent)) error{
+				func(handler func(kubelet.PodEvent)) error {
+					close(received)
+					<-ctx.Done()
+					return nil
+				},
+			}}
+			getPodStreamer = func() (kubelet.PodStreamer, error) { return streamer, nil }
+
+			c := newStreamingCollector(&fakePodWatcher{})
+			c.streaming = 0
+			c.startPodSource(ctx, tt.source)
+			assert.Equal(t, tt.streaming, c.isStreaming())
+			if tt.streaming {
+				<-received
+			}
+			assert.Equal(t, tt.calls, streamer.callCount())
+		})
+	}
+}
+
+func TestStreamPodsFallsBackWhenNotSupported(t *testing.T) {
+	c := newStreamingCollector(&fakePodWatcher{})
+	streamer := &fakePodStreamer{scripts: []func(func(kubelet.PodEvent)) error{
+		func(handler func(kubelet.PodEvent)) error {
+			return kubelet.ErrPodStreamNotSupported
+		},
+	}}
+
+	c.streamPods(context.Background(), streamer)
+	assert.Equal(t, 1, streamer.callCount())
+	assert.False(t, c.isStreaming())
+}
+
+func TestStreamPodsFallsBackAfterFailures(t *testing.T) {
+	c := newStreamingCollector(&fakePodWatcher{})
+	streamer := &fakePodStreamer{scripts: []func(func(kubelet.PodEvent)) error{
+		func(handler func(kubelet.PodEvent)) error {
+			return errors.New("connection refused")
+		},
+	}}
+
+	c.streamPods(context.Background(), streamer)
+	assert.Equal(t, maxStreamFailures, streamer.callCount())
+	assert.False(t, c.isStreaming())
+}
+
+func TestPullWhileStreaming(t *testing.T) {
+	watcher := &fakePodWatcher{}
+	c := newStreamingCollector(watcher)
+
+	// the pod list isn't pulled until the pods must be expired
+	require.NoError(t, c.Pull(context.Background()))
+	assert.Equal(t, 0, watcher.pulls)
+
+	c.lastExpire = time.Now().Add(-expireFreq)
+	require.NoError(t, c.Pull(context.Background()))
+	assert.Equal(t, 1, watcher.pulls)
+
+	// without the stream, the pod list is pulled every time
+	c.streaming = 0
+	require.NoError(t, c.Pull(context.Background()))
+	assert.Equal(t, 2, watcher.pulls)
+}
+
+func podsByName(events []workloadmeta.Event) map[string]workloadmeta.KubernetesPod {
+	pods := make(map[string]workloadmeta.KubernetesPod)
+	for _, event := range events {
+		if pod, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+			pods[pod.Name] = pod
+		}
+	}
+	return pods
+}
+
+func TestParsePodsConditionsUnschedulable(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pod := podsByName(c.parsePods(loadPodList(t, "testdata/podlist_conditions.json")))["batch-worker-7d4b9c6f8-k2m5p"]
+
+	assert.False(t, pod.Ready)
+	assert.Equal(t, "Pending", pod.Phase)
+	assert.Equal(t, []workloadmeta.KubernetesPodCondition{
+		{
+			Type:               "PodScheduled",
+			Status:             "False",
+			Reason:             "Unschedulable",
+			Message:            "0/3 nodes are available: 1 node(s) had taint {node-role.kubernetes.io/master: }, that the pod didn't tolerate, 2 Insufficient cpu.",
+			LastTransitionTime: time.Date(2021, 11, 8, 14, 2, 11, 0, time.UTC),
+		},
+	}, pod.Conditions)
+	_, found := pod.Condition("Ready")
+	assert.False(t, found)
+}
+
+func TestParsePodsConditionsReadinessProbeFailing(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pods := loadPodList(t, "testdata/podlist_conditions.json")
+	pod := podsByName(c.parsePods(pods))["web-5f8c7b9d4-q7x2n"]
+
+	assert.False(t, pod.Ready)
+	assert.Len(t, pod.Conditions, 4)
+	containersReady, found := pod.Condition("ContainersReady")
+	require.True(t, found)
+	assert.Equal(t, workloadmeta.KubernetesPodCondition{
+		Type:               "ContainersReady",
+		Status:             "False",
+		Reason:             "ContainersNotReady",
+		Message:            "containers with unready status: [web]",
+		LastTransitionTime: time.Date(2021, 11, 8, 13, 55, 40, 0, time.UTC),
+	}, containersReady)
+
+	// the readiness is derived from the parsed conditions, as IsPodReady does
+	for i := range pods[1].Status.Conditions {
+		if pods[1].Status.Conditions[i].Type == "Ready" {
+			pods[1].Status.Conditions[i].Status = "True"
+		}
+	}
+	pod = podsByName(c.parsePods(pods))["web-5f8c7b9d4-q7x2n"]
+	assert.True(t, pod.Ready)
+	assert.Equal(t, kubelet.IsPodReady(pods[1]), pod.Ready)
+}
+
+func TestParsePodsConditionsMessageLength(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods", maxConditionMessageLength: 24}
+	pod := podsByName(c.parsePods(loadPodList(t, "testdata/podlist_conditions.json")))["batch-worker-7d4b9c6f8-k2m5p"]
+	scheduled, found := pod.Condition("PodScheduled")
+	require.True(t, found)
+	assert.Equal(t, "0/3 nodes are availab...", scheduled.Message)
+
+	// the messages are truncated on a UTF-8 character boundary
+	assert.Equal(t, "n...", truncateMessage("nœud indisponible", 5))
+	assert.Equal(t, "short", truncateMessage("short", 6))
+	assert.Equal(t, "kept whole", truncateMessage("kept whole", 0))
+}
+
+func TestContainerFieldPriorities(t *testing.T) {
+	containerType := reflect.TypeOf(workloadmeta.Container{})
+	for field := range containerFieldPriorities {
+		_, ok := containerType.FieldByName(field)
+		assert.True(t, ok, "no field %q in workloadmeta.Container", field)
+	}
+
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	for _, event := range c.parsePods(loadPodList(t, "testdata/podlist_windows.json")) {
+		if _, ok := event.Entity.(workloadmeta.Container); ok {
+			assert.Equal(t, workloadmeta.MergePriorityBestEffort, event.Priorities["State"])
+			assert.Equal(t, workloadmeta.MergePriorityAuthoritative, event.Priorities["Image"])
+		}
+	}
+}
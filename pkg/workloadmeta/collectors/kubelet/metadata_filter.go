@@ -0,0 +1,195 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+
+	"github.com/DataDog/datadog-agent/pkg/config"
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	metadataKindAnnotation = "annotation"
+	metadataKindLabel      = "label"
+	metadataKindEnvVar     = "env_var"
+)
+
+// datadogMetadataPatterns match the annotations, labels and environment
+// variables read by autodiscovery and the tagger, by kind, they are never dropped
+var datadogMetadataPatterns = map[string][]string{
+	metadataKindAnnotation: {
+		"ad.datadoghq.com/*",
+		"service-discovery.datadoghq.com/*",
+		"tags.datadoghq.com/*",
+	},
+	metadataKindLabel: {
+		"ad.datadoghq.com/*",
+		"service-discovery.datadoghq.com/*",
+		"tags.datadoghq.com/*",
+	},
+	metadataKindEnvVar: {"DD_ENV", "DD_SERVICE", "DD_VERSION"},
+}
+
+var droppedMetadata = telemetry.NewCounterWithOpts("workloadmeta_kubelet", "dropped_metadata",
+	[]string{"kind"}, "Number of annotations, labels and environment variables dropped by the kubelet collector, counted once per pod or container.",
+	telemetry.Options{NoDoubleUnderscoreSep: true})
+
+// metadataFilter drops the annotations, labels or environment variables
+// which aren't read by the consumers of the store, to bound the memory they
+// hold on nodes running many pods. A nil filter keeps everything.
+type metadataFilter struct {
+	// include, when not empty, lists the only keys kept besides the
+	// Datadog ones, and exclude the keys dropped
+	include []glob.Glob
+	exclude []glob.Glob
+	datadog []glob.Glob
+	// asTags match the lower-cased keys turned into tags by the user
+	// configuration, they are never dropped either
+	asTags []glob.Glob
+}
+
+// newMetadataFilterFromConfig returns the filter of a kind of metadata
+// configured with the <prefix>_include and <prefix>_exclude options, the
+// keys of the asTagsOption map, if any, being always kept
+func newMetadataFilterFromConfig(kind string, prefix string, asTagsOption string) *metadataFilter {
+	var asTags []string
+	if asTagsOption != "" {
+		for key := range config.Datadog.GetStringMapString(asTagsOption) {
+			asTags = append(asTags, key)
+		}
+	}
+	return newMetadataFilter(
+		kind,
+		config.Datadog.GetStringSlice(prefix+"_include"),
+		config.Datadog.GetStringSlice(prefix+"_exclude"),
+		asTags,
+	)
+}
+
+// newMetadataFilter returns a filter keeping the keys matching the include
+// patterns, if any, and not matching the exclude ones, nil when there are no
+// patterns. The Datadog keys of the kind and the asTags keys, matched as the
+// tagger does regardless of their case, are always kept.
+func newMetadataFilter(kind string, include []string, exclude []string, asTags []string) *metadataFilter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	lowerAsTags := make([]string, 0, len(asTags))
+	for _, key := range asTags {
+		lowerAsTags = append(lowerAsTags, strings.ToLower(key))
+	}
+	return &metadataFilter{
+		include: compilePatterns(include),
+		exclude: compilePatterns(exclude),
+		datadog: compilePatterns(datadogMetadataPatterns[kind]),
+		asTags:  compilePatterns(lowerAsTags),
+	}
+}
+
+func compilePatterns(patterns []string) []glob.Glob {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			log.Errorf("Failed to compile glob for [%s]: %v", pattern, err)
+			continue
+		}
+		globs = append(globs, g)
+	}
+	return globs
+}
+
+// filter returns the metadata without the dropped keys, and the number of
+// keys dropped. The metadata is shared with the kubelet pod, so a new map is
+// returned when a key is dropped.
+func (f *metadataFilter) filter(metadata map[string]string) (map[string]string, int) {
+	if f == nil || len(metadata) == 0 {
+		return metadata, 0
+	}
+
+	var filtered map[string]string
+	for key := range metadata {
+		if f.keep(key) {
+			continue
+		}
+		if filtered == nil {
+			filtered = make(map[string]string, len(metadata))
+			for k, v := range metadata {
+				filtered[k] = v
+			}
+		}
+		delete(filtered, key)
+	}
+
+	if filtered == nil {
+		return metadata, 0
+	}
+	return filtered, len(metadata) - len(filtered)
+}
+
+// keep returns whether a key is kept
+func (f *metadataFilter) keep(key string) bool {
+	if matchAny(f.datadog, key) || matchAny(f.asTags, strings.ToLower(key)) {
+		return true
+	}
+	if len(f.include) > 0 && !matchAny(f.include, key) {
+		return false
+	}
+	return !matchAny(f.exclude, key)
+}
+
+func matchAny(globs []glob.Glob, key string) bool {
+	for _, g := range globs {
+		if g.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// droppedMetadataCounter counts the metadata dropped from each pod or
+// container once, instead of every time the entity is parsed again. An
+// entity is counted again once it expired.
+type droppedMetadataCounter struct {
+	mu sync.Mutex
+	// counted holds the kinds of metadata counted for each entity ID
+	counted map[string]map[string]struct{}
+}
+
+// count counts the metadata of a kind dropped from an entity, unless it was
+// already counted for it
+func (d *droppedMetadataCounter) count(kind string, entityID string, dropped int) {
+	if dropped == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, found := d.counted[entityID][kind]; found {
+		return
+	}
+	if d.counted == nil {
+		d.counted = make(map[string]map[string]struct{})
+	}
+	if d.counted[entityID] == nil {
+		d.counted[entityID] = make(map[string]struct{})
+	}
+	d.counted[entityID][kind] = struct{}{}
+	droppedMetadata.Add(float64(dropped), kind)
+}
+
+// forget forgets an entity which expired
+func (d *droppedMetadataCounter) forget(entityID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.counted, entityID)
+}
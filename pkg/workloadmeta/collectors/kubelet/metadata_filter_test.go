@@ -0,0 +1,166 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	metadata := map[string]string{
+		"ad.datadoghq.com/iis.check_names":  `["iis"]`,
+		"tags.datadoghq.com/env":            "prod",
+		"sidecar.istio.io/status":           "{...}",
+		"cert-manager.io/certificate-name":  "web",
+		"app.kubernetes.io/name":            "web",
+		"kubectl.kubernetes.io/last-config": "{...}",
+	}
+
+	// no pattern keeps everything
+	f := newMetadataFilter(metadataKindAnnotation, nil, nil, nil)
+	assert.Nil(t, f)
+	filtered, dropped := f.filter(metadata)
+	assert.Equal(t, metadata, filtered)
+	assert.Equal(t, 0, dropped)
+
+	// the Datadog keys are kept even when they don't match the included ones
+	f = newMetadataFilter(metadataKindAnnotation, []string{"app.kubernetes.io/*"}, nil, nil)
+	filtered, dropped = f.filter(metadata)
+	assert.Equal(t, map[string]string{
+		"ad.datadoghq.com/iis.check_names": `["iis"]`,
+		"tags.datadoghq.com/env":           "prod",
+		"app.kubernetes.io/name":           "web",
+	}, filtered)
+	assert.Equal(t, 3, dropped)
+
+	// and when they match the excluded ones
+	f = newMetadataFilter(metadataKindAnnotation, nil, []string{"*istio.io/*", "cert-manager.io/*", "*datadoghq.com/*"}, nil)
+	filtered, _ = f.filter(metadata)
+	assert.Equal(t, map[string]string{
+		"ad.datadoghq.com/iis.check_names":  `["iis"]`,
+		"tags.datadoghq.com/env":            "prod",
+		"app.kubernetes.io/name":            "web",
+		"kubectl.kubernetes.io/last-config": "{...}",
+	}, filtered)
+
+	// so are the keys turned into tags by the user, whatever their case
+	f = newMetadataFilter(metadataKindAnnotation, []string{"app.kubernetes.io/*"}, nil, []string{"Cert-Manager.io/*", "sidecar.istio.io/status"})
+	filtered, dropped = f.filter(metadata)
+	assert.Equal(t, map[string]string{
+		"ad.datadoghq.com/iis.check_names": `["iis"]`,
+		"tags.datadoghq.com/env":           "prod",
+		"sidecar.istio.io/status":          "{...}",
+		"cert-manager.io/certificate-name": "web",
+		"app.kubernetes.io/name":           "web",
+	}, filtered)
+	assert.Equal(t, 1, dropped)
+
+	// the metadata of the kubelet pod isn't modified
+	assert.Len(t, metadata, 6)
+}
+
+func TestParsePodsMetadataFilter(t *testing.T) {
+	c := &collector{
+		cgroupDriver:      "cgroupfs",
+		cgroupRoot:        "kubepods",
+		annotationsFilter: newMetadataFilter(metadataKindAnnotation, nil, []string{"cert-manager.io/*"}, nil),
+		labelsFilter:      newMetadataFilter(metadataKindLabel, []string{"app"}, nil, nil),
+		skipEnvVars:       true,
+	}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	require.Len(t, pods, 1)
+	pods[0].Metadata.Annotations = map[string]string{
+		"ad.datadoghq.com/iis.check_names": `["iis"]`,
+		"cert-manager.io/revision":         "1",
+	}
+	pods[0].Metadata.Labels = map[string]string{
+		"app":                        "iis",
+		"pod-template-hash":          "5d4c7b8f9",
+		"tags.datadoghq.com/service": "web",
+	}
+	pods[0].Spec.Containers[0].Env = []kubelet.EnvVar{{Name: "DD_ENV", Value: "prod"}}
+	events := c.parsePods(pods)
+
+	var pod workloadmeta.KubernetesPod
+	for _, event := range events {
+		if entity, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+			pod = entity
+		}
+	}
+	// the fields used by autodiscovery and the tagger are kept
+	assert.Equal(t, map[string]string{"ad.datadoghq.com/iis.check_names": `["iis"]`}, pod.Annotations)
+	assert.Equal(t, map[string]string{"app": "iis", "tags.datadoghq.com/service": "web"}, pod.Labels)
+	assert.Equal(t, pods[0].Metadata.Name, pod.Name)
+	assert.Equal(t, pods[0].Metadata.Namespace, pod.Namespace)
+
+	containers := containersByName(events)
+	require.Len(t, containers, 2)
+	for _, container := range containers {
+		assert.Nil(t, container.EnvVars)
+		assert.NotEmpty(t, container.Name)
+		assert.NotEmpty(t, container.Image.Name)
+	}
+}
+
+func TestParsePodsDefaultMetadata(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods"}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Metadata.Annotations = map[string]string{"cert-manager.io/revision": "1"}
+	pods[0].Spec.Containers[0].Env = []kubelet.EnvVar{{Name: "DD_ENV", Value: "prod"}}
+	events := c.parsePods(pods)
+
+	for _, event := range events {
+		if pod, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+			assert.Equal(t, "1", pod.Annotations["cert-manager.io/revision"])
+		}
+	}
+	assert.Equal(t, "prod", containersByName(events)[pods[0].Spec.Containers[0].Name].EnvVars["DD_ENV"])
+}
+
+func TestParsePodsEnvVarsFilter(t *testing.T) {
+	c := &collector{
+		cgroupDriver:  "cgroupfs",
+		cgroupRoot:    "kubepods",
+		envVarsFilter: newMetadataFilter(metadataKindEnvVar, nil, []string{"JAVA_*", "DD_*"}, nil),
+	}
+	pods := loadPodList(t, "testdata/podlist_windows.json")
+	pods[0].Spec.Containers[0].Env = []kubelet.EnvVar{
+		{Name: "DD_ENV", Value: "prod"},
+		{Name: "DD_AGENT_HOST", Value: "10.0.0.1"},
+		{Name: "JAVA_OPTS", Value: "-Xmx1g"},
+		{Name: "LANG", Value: "C"},
+	}
+	events := c.parsePods(pods)
+
+	// the variables used for tagging are kept
+	assert.Equal(t, map[string]string{"DD_ENV": "prod", "LANG": "C"}, containersByName(events)[pods[0].Spec.Containers[0].Name].EnvVars)
+}
+
+func TestDroppedMetadataCounter(t *testing.T) {
+	var d droppedMetadataCounter
+
+	// each kind of metadata is counted once per entity
+	d.count(metadataKindLabel, "pod-1", 2)
+	d.count(metadataKindLabel, "pod-1", 2)
+	d.count(metadataKindAnnotation, "pod-1", 1)
+	d.count(metadataKindEnvVar, "container-1", 0)
+	assert.Len(t, d.counted, 1)
+	assert.Len(t, d.counted["pod-1"], 2)
+
+	// and counted again once the entity expired
+	d.forget("pod-1")
+	assert.Empty(t, d.counted)
+	d.count(metadataKindLabel, "pod-1", 2)
+	assert.Len(t, d.counted["pod-1"], 1)
+}
@@ -0,0 +1,219 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+var containerOwnershipTransfers = telemetry.NewCounterWithOpts("workloadmeta_kubelet", "container_ownership_transfers",
+	[]string{}, "Number of containers claimed by a pod while another live pod owned them.",
+	telemetry.Options{NoDoubleUnderscoreSep: true})
+
+// containerOwnership tracks the pods claiming each container. When a pod is
+// recreated with the same name, such as a StatefulSet pod, the statuses of
+// the old and the new pods can briefly list the same container: the deletion
+// of the old pod must not unset a container the new pod runs. The containers
+// are identified by their entity name, such as containerd://<id>.
+type containerOwnership struct {
+	sync.Mutex
+	// owners is the UID of the pod owning each container, the last one
+	// which claimed it
+	owners map[string]string
+	// claims holds the containers listed on the last update of each live pod
+	claims map[string]map[string]struct{}
+	// suppressed holds the containers whose Unset was suppressed, they are
+	// unset once no live pod claims them anymore
+	suppressed map[string]struct{}
+}
+
+func (o *containerOwnership) init() {
+	if o.owners == nil {
+		o.owners = make(map[string]string)
+		o.claims = make(map[string]map[string]struct{})
+		o.suppressed = make(map[string]struct{})
+	}
+}
+
+// claim sets the containers listed by a pod, and returns the containers it
+// doesn't list anymore whose Unset was suppressed and which are now unclaimed
+func (o *containerOwnership) claim(podUID string, containerIDs []string) []string {
+	o.Lock()
+	defer o.Unlock()
+	o.init()
+
+	previous := o.claims[podUID]
+	current := make(map[string]struct{}, len(containerIDs))
+	for _, id := range containerIDs {
+		current[id] = struct{}{}
+		if owner, found := o.owners[id]; found && owner != podUID {
+			o.transfer(id, owner, podUID)
+		}
+		o.owners[id] = podUID
+	}
+	o.claims[podUID] = current
+
+	var unclaimed []string
+	for id := range previous {
+		if _, found := current[id]; !found {
+			if o.disown(podUID, id) {
+				unclaimed = append(unclaimed, id)
+			}
+		}
+	}
+	return unclaimed
+}
+
+// release removes the claims of a pod removed from the node, and returns the
+// containers whose Unset was suppressed and which are now unclaimed
+func (o *containerOwnership) release(podUID string) []string {
+	o.Lock()
+	defer o.Unlock()
+	o.init()
+
+	claimed := o.claims[podUID]
+	delete(o.claims, podUID)
+	var unclaimed []string
+	for id := range claimed {
+		if o.disown(podUID, id) {
+			unclaimed = append(unclaimed, id)
+		}
+	}
+	return unclaimed
+}
+
+// claimedByOtherPod returns whether a container expired with the deletion of
+// pods is claimed by another live pod, which then owns it. Its Unset is then
+// suppressed. The containers which none of the deleted pods claimed expired
+// for another reason, such as a container gone unready, and are never kept.
+func (o *containerOwnership) claimedByOtherPod(containerID string, deletedPodUIDs map[string]struct{}) bool {
+	o.Lock()
+	defer o.Unlock()
+	o.init()
+
+	deletedBy := ""
+	for uid := range deletedPodUIDs {
+		if o.isClaimedBy(uid, containerID) {
+			deletedBy = uid
+			break
+		}
+	}
+	if deletedBy == "" {
+		return false
+	}
+
+	owner := o.owners[containerID]
+	candidate := ""
+	if _, deleted := deletedPodUIDs[owner]; !deleted && o.isClaimedBy(owner, containerID) {
+		candidate = owner
+	} else {
+		for uid := range o.claims {
+			if _, deleted := deletedPodUIDs[uid]; !deleted && o.isClaimedBy(uid, containerID) {
+				candidate = uid
+				break
+			}
+		}
+	}
+	if candidate == "" {
+		return false
+	}
+
+	if candidate != owner {
+		o.transfer(containerID, owner, candidate)
+	}
+	o.suppressed[containerID] = struct{}{}
+	log.Debugf("Ignoring the removal of container %s with pod %s, it belongs to pod %s", containerID, deletedBy, candidate)
+	return true
+}
+
+// forget removes the ownership of a container which was unset
+func (o *containerOwnership) forget(containerID string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.owners, containerID)
+	delete(o.suppressed, containerID)
+}
+
+// disown removes the ownership of a container by a pod which doesn't claim it
+// anymore, moving it to another pod claiming it if any. It returns true if the
+// container's Unset was suppressed and no live pod claims it anymore. It must
+// be called with the lock held.
+func (o *containerOwnership) disown(podUID string, containerID string) bool {
+	if o.owners[containerID] != podUID {
+		return false
+	}
+	for uid := range o.claims {
+		if uid != podUID && o.isClaimedBy(uid, containerID) {
+			o.transfer(containerID, podUID, uid)
+			return false
+		}
+	}
+	delete(o.owners, containerID)
+	if _, found := o.suppressed[containerID]; !found {
+		return false
+	}
+	delete(o.suppressed, containerID)
+	return true
+}
+
+func (o *containerOwnership) isClaimedBy(podUID string, containerID string) bool {
+	_, found := o.claims[podUID][containerID]
+	return found
+}
+
+// transfer moves the ownership of a container, it must be called with the lock held
+func (o *containerOwnership) transfer(containerID string, from string, to string) {
+	log.Debugf("Container %s moves from pod %s to pod %s", containerID, from, to)
+	containerOwnershipTransfers.Inc()
+	o.owners[containerID] = to
+}
+
+// podContainerIDs returns the entity names of the containers listed by a pod
+func podContainerIDs(pod *kubelet.Pod) []string {
+	statuses := pod.Status.GetAllContainers()
+	ids := make([]string, 0, len(statuses))
+	for _, container := range statuses {
+		if !container.IsPending() {
+			ids = append(ids, container.ID)
+		}
+	}
+	return ids
+}
+
+// filterDeletedPodExpires drops the containers expired with the deletion of
+// pods which are claimed by another live pod
+func (c *collector) filterDeletedPodExpires(deletedPodUIDs map[string]struct{}, expiredIDs []string) []string {
+	if len(deletedPodUIDs) == 0 {
+		return expiredIDs
+	}
+	filtered := expiredIDs[:0]
+	for _, id := range expiredIDs {
+		if !strings.HasPrefix(id, kubelet.KubePodPrefix) && c.ownership.claimedByOtherPod(id, deletedPodUIDs) {
+			continue
+		}
+		filtered = append(filtered, id)
+	}
+	return filtered
+}
+
+// expiredPodUIDs returns the UIDs of the pods among the entities expired by
+// the pod watcher, which were removed from the pod list
+func expiredPodUIDs(expiredIDs []string) map[string]struct{} {
+	uids := make(map[string]struct{})
+	for _, id := range expiredIDs {
+		if strings.HasPrefix(id, kubelet.KubePodPrefix) {
+			uids[strings.TrimPrefix(id, kubelet.KubePodPrefix)] = struct{}{}
+		}
+	}
+	return uids
+}
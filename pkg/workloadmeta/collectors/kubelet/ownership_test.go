@@ -0,0 +1,242 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+// replayPodWatcher tracks the containers like the kubelet pod watcher: the
+// deletion of a pod expires the containers listed in its last status, and the
+// containers not listed by any pod anymore are expired by Expire
+type replayPodWatcher struct {
+	fakePodWatcher
+	seen   map[string]struct{}
+	listed map[string][]string
+}
+
+func newReplayPodWatcher() *replayPodWatcher {
+	return &replayPodWatcher{
+		seen:   make(map[string]struct{}),
+		listed: make(map[string][]string),
+	}
+}
+
+func (w *replayPodWatcher) UpdatePod(pod *kubelet.Pod) []*kubelet.Pod {
+	w.listed[pod.Metadata.UID] = podContainerIDs(pod)
+	for _, id := range w.listed[pod.Metadata.UID] {
+		w.seen[id] = struct{}{}
+	}
+	return []*kubelet.Pod{pod}
+}
+
+func (w *replayPodWatcher) Expire() ([]string, error) {
+	live := make(map[string]struct{})
+	for _, ids := range w.listed {
+		for _, id := range ids {
+			live[id] = struct{}{}
+		}
+	}
+	var expired []string
+	for id := range w.seen {
+		if _, found := live[id]; !found {
+			delete(w.seen, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired, nil
+}
+
+func (w *replayPodWatcher) DeletePod(pod *kubelet.Pod) []string {
+	delete(w.listed, pod.Metadata.UID)
+	var expired []string
+	for _, id := range podContainerIDs(pod) {
+		if _, found := w.seen[id]; found {
+			delete(w.seen, id)
+			expired = append(expired, id)
+		}
+	}
+	return append(expired, kubelet.PodUIDToEntityName(pod.Metadata.UID))
+}
+
+// replayStore holds the entities set by the events of the collector
+type replayStore map[workloadmeta.EntityID]workloadmeta.Entity
+
+func (s replayStore) notify(events []workloadmeta.Event) {
+	for _, event := range events {
+		if event.Type == workloadmeta.EventTypeSet {
+			s[event.Entity.GetID()] = event.Entity
+		} else {
+			delete(s, event.Entity.GetID())
+		}
+	}
+}
+
+func (s replayStore) ids(kind workloadmeta.Kind) []string {
+	var ids []string
+	for id := range s {
+		if id.Kind == kind {
+			ids = append(ids, id.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// capturedStatefulSetPod returns the cassandra-0 pod of a StatefulSet, from a
+// pod list captured on a kubelet
+func capturedStatefulSetPod(t *testing.T) (*kubelet.Pod, []*kubelet.Pod) {
+	pods := loadPodList(t, filepath.Join("..", "..", "..", "util", "kubernetes", "kubelet", "testdata", "podlist_persistent_volume_claim.json"))
+	for _, pod := range pods {
+		if pod.Metadata.Name == "cassandra-0" {
+			return pod, pods
+		}
+	}
+	require.FailNow(t, "the cassandra-0 pod isn't in the pod list")
+	return nil, nil
+}
+
+// withPodStatus returns a copy of a pod with another UID, whose cassandra
+// container has the given ID
+func withPodStatus(t *testing.T, pod *kubelet.Pod, uid string, containerID string) *kubelet.Pod {
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	var copied kubelet.Pod
+	require.NoError(t, json.Unmarshal(raw, &copied))
+	copied.Metadata.UID = uid
+	copied.Status.Containers[0].ID = containerID
+	copied.Status.AllContainers = append(append([]kubelet.ContainerStatus{}, copied.Status.InitContainers...), copied.Status.Containers...)
+	return &copied
+}
+
+// replacePod returns the pod list with a pod replaced by others
+func replacePod(pods []*kubelet.Pod, replaced *kubelet.Pod, replacements ...*kubelet.Pod) []*kubelet.Pod {
+	var list []*kubelet.Pod
+	for _, pod := range pods {
+		if pod != replaced {
+			list = append(list, pod)
+		}
+	}
+	return append(list, replacements...)
+}
+
+const (
+	recreatedPodUID         = "5b0c7f2e-da0c-11e9-b8b8-42010af002dd"
+	recreatedPodContainerID = "docker://0d6e4b1c2f3a59e8b7c6d5a4f3e2d1c0b9a8f7e6d5c4b3a29180f7e6d5c4b3a2"
+)
+
+func TestStatefulSetPodReplacement(t *testing.T) {
+	store := replayStore{}
+	c := newStreamingCollector(newReplayPodWatcher())
+	c.notify = store.notify
+
+	// cassandra-0 is recreated by a rolling update, the last status of the
+	// old pod reporting the cassandra container of the new one before its
+	// deletion
+	oldPod, _ := capturedStatefulSetPod(t)
+	newPod := withPodStatus(t, oldPod, recreatedPodUID, recreatedPodContainerID)
+	lastStatus := withPodStatus(t, oldPod, oldPod.Metadata.UID, recreatedPodContainerID)
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: oldPod})
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: newPod})
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodModified, Pod: lastStatus})
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodDeleted, Pod: lastStatus})
+	// the containers the old pod stopped listing are expired by the pod watcher
+	c.lastExpire = time.Now().Add(-expireFreq)
+	require.NoError(t, c.Pull(context.Background()))
+
+	assert.Equal(t, []string{recreatedPodUID}, store.ids(workloadmeta.KindKubernetesPod))
+	assert.Equal(t, []string{"0d6e4b1c2f3a59e8b7c6d5a4f3e2d1c0b9a8f7e6d5c4b3a29180f7e6d5c4b3a2"}, store.ids(workloadmeta.KindContainer))
+}
+
+// expiringPodWatcher returns the pod lists pulled and expires the entities
+// set before each pull
+type expiringPodWatcher struct {
+	fakePodWatcher
+	expired []string
+}
+
+func (w *expiringPodWatcher) Expire() ([]string, error) {
+	expired := w.expired
+	w.expired = nil
+	return expired, nil
+}
+
+func TestStatefulSetPodReplacementPolling(t *testing.T) {
+	store := replayStore{}
+	watcher := &expiringPodWatcher{}
+	c := &collector{watcher: watcher, notify: store.notify, expireFreq: expireFreq}
+	pull := func(pods []*kubelet.Pod, expired ...string) {
+		watcher.pods = pods
+		watcher.expired = expired
+		c.lastExpire = time.Now().Add(-expireFreq)
+		require.NoError(t, c.Pull(context.Background()))
+	}
+
+	oldPod, pods := capturedStatefulSetPod(t)
+	oldContainerID := oldPod.Status.Containers[0].ID
+	pull(pods)
+	require.Contains(t, store.ids(workloadmeta.KindContainer), "6eaa4782de428f5ea639e33a837ed47aa9fa9e6969f8cb23e39ff788a751ce7d")
+
+	// the last status of the old pod reports the container of the new one
+	newPod := withPodStatus(t, oldPod, recreatedPodUID, recreatedPodContainerID)
+	pull(replacePod(pods, oldPod, withPodStatus(t, oldPod, oldPod.Metadata.UID, recreatedPodContainerID), newPod), oldContainerID)
+
+	// the old pod expires with the containers it listed, the new pod still
+	// running its container
+	pull(replacePod(pods, oldPod, newPod), kubelet.PodUIDToEntityName(oldPod.Metadata.UID), recreatedPodContainerID)
+	assert.Contains(t, store.ids(workloadmeta.KindKubernetesPod), recreatedPodUID)
+	assert.NotContains(t, store.ids(workloadmeta.KindKubernetesPod), oldPod.Metadata.UID)
+	assert.Contains(t, store.ids(workloadmeta.KindContainer), "0d6e4b1c2f3a59e8b7c6d5a4f3e2d1c0b9a8f7e6d5c4b3a29180f7e6d5c4b3a2")
+	assert.NotContains(t, store.ids(workloadmeta.KindContainer), "6eaa4782de428f5ea639e33a837ed47aa9fa9e6969f8cb23e39ff788a751ce7d")
+
+	// a container expired without its pod, such as gone unready, is unset
+	pull(replacePod(pods, oldPod, newPod), recreatedPodContainerID)
+	assert.NotContains(t, store.ids(workloadmeta.KindContainer), "0d6e4b1c2f3a59e8b7c6d5a4f3e2d1c0b9a8f7e6d5c4b3a29180f7e6d5c4b3a2")
+}
+
+func TestContainerOwnershipUnsetOnceUnclaimed(t *testing.T) {
+	store := replayStore{}
+	c := newStreamingCollector(newReplayPodWatcher())
+	c.notify = store.notify
+
+	containerPod := func(uid string, containerIDs ...string) *kubelet.Pod {
+		pod := streamPod(uid)
+		for _, id := range containerIDs {
+			pod.Status.AllContainers = append(pod.Status.AllContainers, kubelet.ContainerStatus{Name: id, ID: "containerd://" + id})
+		}
+		return pod
+	}
+
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: containerPod("old", "shared")})
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: containerPod("new", "shared")})
+
+	// the new pod still claims the container
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodDeleted, Pod: containerPod("old", "shared")})
+	assert.Equal(t, []string{"new"}, store.ids(workloadmeta.KindKubernetesPod))
+	assert.Equal(t, []string{"shared"}, store.ids(workloadmeta.KindContainer))
+
+	// the container is unset once the new pod doesn't list it anymore
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodModified, Pod: containerPod("new", "restarted")})
+	assert.Equal(t, []string{"restarted"}, store.ids(workloadmeta.KindContainer))
+
+	// without another pod claiming them, the containers of a deleted pod are unset
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodDeleted, Pod: containerPod("new", "restarted")})
+	assert.Empty(t, store.ids(workloadmeta.KindKubernetesPod))
+	assert.Empty(t, store.ids(workloadmeta.KindContainer))
+}
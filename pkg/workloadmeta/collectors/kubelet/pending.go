@@ -0,0 +1,116 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+// imagePullFailureReasons are the waiting reasons of the containers which
+// can't be created because their image can't be pulled
+var imagePullFailureReasons = map[string]struct{}{
+	"ErrImagePull":     {},
+	"ImagePullBackOff": {},
+}
+
+// isImagePullFailure returns whether a container not created yet is waiting
+// for an image which can't be pulled
+func isImagePullFailure(container kubelet.ContainerStatus) bool {
+	if !container.IsPending() || container.State.Waiting == nil {
+		return false
+	}
+	_, found := imagePullFailureReasons[container.State.Waiting.Reason]
+	return found
+}
+
+// pendingContainerID returns the ID of the entity of a container of a pod
+// which has no ID because it wasn't created by the runtime
+func pendingContainerID(podUID string, containerName string) string {
+	return podUID + "/" + containerName
+}
+
+// pendingContainers tracks the entities of the containers which can't be
+// created, by pod, so that they are unset once the runtime creates them or
+// the pod goes away.
+type pendingContainers struct {
+	sync.Mutex
+	pods map[string]map[string]struct{}
+}
+
+// set sets the pending containers of a pod, and returns the containers which
+// were pending on its last update and aren't anymore
+func (p *pendingContainers) set(podUID string, containerIDs []string) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	previous := p.pods[podUID]
+	if len(containerIDs) == 0 {
+		delete(p.pods, podUID)
+	} else {
+		if p.pods == nil {
+			p.pods = make(map[string]map[string]struct{})
+		}
+		current := make(map[string]struct{}, len(containerIDs))
+		for _, id := range containerIDs {
+			current[id] = struct{}{}
+		}
+		p.pods[podUID] = current
+	}
+
+	var resolved []string
+	for id := range previous {
+		if _, found := p.pods[podUID][id]; !found {
+			resolved = append(resolved, id)
+		}
+	}
+	return resolved
+}
+
+// release removes the pending containers of a pod removed from the node, and
+// returns them
+func (p *pendingContainers) release(podUID string) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	pending := p.pods[podUID]
+	delete(p.pods, podUID)
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// unsetPendingContainers returns the events unsetting the entities of
+// pending containers
+func (c *collector) unsetPendingContainers(containerIDs []string) []workloadmeta.Event {
+	if len(containerIDs) == 0 {
+		return nil
+	}
+
+	c.lastContainersMu.Lock()
+	defer c.lastContainersMu.Unlock()
+
+	events := make([]workloadmeta.Event, 0, len(containerIDs))
+	for _, id := range containerIDs {
+		delete(c.lastContainers, id)
+		c.dropped.forget(id)
+		events = append(events, workloadmeta.Event{
+			Source: collectorID,
+			Type:   workloadmeta.EventTypeUnset,
+			Entity: workloadmeta.EntityID{
+				Kind: workloadmeta.KindContainer,
+				ID:   id,
+			},
+		})
+	}
+	return events
+}
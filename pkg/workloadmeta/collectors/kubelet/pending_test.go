@@ -0,0 +1,169 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+// imagePullPod returns a pod whose app container is waiting with the given
+// reason, or running in the container with the given ID if it has one
+func imagePullPod(appID string, reason string, message string) *kubelet.Pod {
+	pod := &kubelet.Pod{
+		Metadata: kubelet.PodMetadata{Name: "web", Namespace: "default", UID: "pod-uid"},
+		Spec: kubelet.Spec{
+			Containers: []kubelet.ContainerSpec{
+				{Name: "app", Image: "registry.example.com/app:1.2", ImagePullPolicy: "Always"},
+				{Name: "proxy", Image: "envoyproxy/envoy:v1.18.3", ImagePullPolicy: "IfNotPresent"},
+			},
+		},
+		Status: kubelet.Status{
+			Phase: "Pending",
+			Containers: []kubelet.ContainerStatus{
+				{Name: "app", Image: "registry.example.com/app:1.2", ID: appID},
+				{
+					Name:    "proxy",
+					Image:   "envoyproxy/envoy:v1.18.3",
+					ImageID: "docker-pullable://envoyproxy/envoy@sha256:e5c2c6e8f4b7a1d9c3e0f6b2a8d4c7e1f5b9a3d6c0e2f8b4a7d1c5e9f3b6a0d2",
+					ID:      "containerd://proxy-id",
+					State:   kubelet.ContainerState{Running: &kubelet.ContainerStateRunning{}},
+				},
+			},
+		},
+	}
+	if appID == "" {
+		pod.Status.Containers[0].State.Waiting = &kubelet.ContainerStateWaiting{Reason: reason, Message: message}
+	} else {
+		pod.Status.Containers[0].State.Running = &kubelet.ContainerStateRunning{}
+	}
+	pod.Status.AllContainers = pod.Status.Containers
+	return pod
+}
+
+// eventsOfKind returns the events of the entities of a kind, by event type
+func eventsOfKind(events []workloadmeta.Event, kind workloadmeta.Kind) map[workloadmeta.EventType][]workloadmeta.Entity {
+	byType := make(map[workloadmeta.EventType][]workloadmeta.Entity)
+	for _, event := range events {
+		if event.Entity.GetID().Kind == kind {
+			byType[event.Type] = append(byType[event.Type], event.Entity)
+		}
+	}
+	return byType
+}
+
+func TestParsePodsImagePullFailure(t *testing.T) {
+	c := &collector{cgroupDriver: "cgroupfs", cgroupRoot: "kubepods", maxConditionMessageLength: 64}
+
+	// the image of the app container can't be pulled, it has no ID
+	events := c.parsePods([]*kubelet.Pod{imagePullPod("", "ErrImagePull", `rpc error: code = NotFound desc = failed to pull and unpack image "registry.example.com/app:1.2"`)})
+	containers := eventsOfKind(events, workloadmeta.KindContainer)
+	require.Len(t, containers[workloadmeta.EventTypeSet], 2)
+	assert.Empty(t, containers[workloadmeta.EventTypeUnset])
+
+	app := containersByName(events)["app"]
+	assert.Equal(t, "pod-uid/app", app.ID)
+	assert.Empty(t, app.Runtime)
+	assert.Empty(t, app.CgroupPath)
+	assert.Equal(t, workloadmeta.ContainerTypeRegular, app.Type)
+	assert.Equal(t, "app", app.Image.ShortName)
+	assert.Equal(t, "Always", app.Image.PullPolicy)
+	assert.Empty(t, app.Image.Digest)
+	assert.False(t, app.State.Running)
+	assert.Equal(t, "ErrImagePull", app.State.WaitingReason)
+	assert.Len(t, app.State.WaitingMessage, 64)
+	assert.Equal(t, "IfNotPresent", containersByName(events)["proxy"].Image.PullPolicy)
+	assert.Empty(t, containersByName(events)["proxy"].State.WaitingReason)
+
+	pod := podsByName(events)["web"]
+	assert.Equal(t, []string{"proxy-id"}, pod.Containers)
+	assert.Equal(t, []string{"pod-uid/app"}, pod.PendingContainers)
+	// the pending containers aren't listed with the created ones
+	assert.Equal(t, []string{"proxy-id"}, pod.AllContainers())
+
+	// the kubelet backs off, the pending container is updated in place
+	events = c.parsePods([]*kubelet.Pod{imagePullPod("", "ImagePullBackOff", "Back-off pulling image")})
+	containers = eventsOfKind(events, workloadmeta.KindContainer)
+	require.Len(t, containers[workloadmeta.EventTypeSet], 1)
+	assert.Empty(t, containers[workloadmeta.EventTypeUnset])
+	assert.Equal(t, "ImagePullBackOff", containersByName(events)["app"].State.WaitingReason)
+	assert.Equal(t, "Back-off pulling image", containersByName(events)["app"].State.WaitingMessage)
+	assert.Equal(t, []string{"pod-uid/app"}, podsByName(events)["web"].PendingContainers)
+
+	// the image is pulled, the pending container is replaced by the one
+	// created by the runtime
+	events = c.parsePods([]*kubelet.Pod{imagePullPod("containerd://app-id", "", "")})
+	containers = eventsOfKind(events, workloadmeta.KindContainer)
+	require.Len(t, containers[workloadmeta.EventTypeUnset], 1)
+	assert.Equal(t, workloadmeta.EntityID{Kind: workloadmeta.KindContainer, ID: "pod-uid/app"}, containers[workloadmeta.EventTypeUnset][0])
+	require.Len(t, containers[workloadmeta.EventTypeSet], 1)
+	app = containersByName(events)["app"]
+	assert.Equal(t, "app-id", app.ID)
+	assert.True(t, app.State.Running)
+	assert.Empty(t, app.State.WaitingReason)
+	assert.Equal(t, "Always", app.Image.PullPolicy)
+	// the pending container is unset before the real one is set
+	for i, event := range events {
+		if event.Type == workloadmeta.EventTypeUnset {
+			assert.Equal(t, 0, i)
+		}
+	}
+	pod = podsByName(events)["web"]
+	assert.Equal(t, []string{"app-id", "proxy-id"}, pod.Containers)
+	assert.Empty(t, pod.PendingContainers)
+
+	// the pending container isn't unset again
+	events = c.parsePods([]*kubelet.Pod{imagePullPod("containerd://app-id", "", "")})
+	assert.Empty(t, eventsOfKind(events, workloadmeta.KindContainer)[workloadmeta.EventTypeUnset])
+}
+
+func TestParsePodsImagePullFailurePodDeleted(t *testing.T) {
+	var notified []workloadmeta.Event
+	c := newStreamingCollector(&fakePodWatcher{})
+	c.notify = func(events []workloadmeta.Event) {
+		notified = append(notified, events...)
+	}
+
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: imagePullPod("", "ImagePullBackOff", "Back-off pulling image")})
+	assert.Equal(t, []string{"pod-uid/app"}, podsByName(notified)["web"].PendingContainers)
+
+	// the pending container goes away with its pod
+	notified = nil
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodDeleted, Pod: imagePullPod("", "ImagePullBackOff", "Back-off pulling image")})
+	assert.Contains(t, notified, workloadmeta.Event{
+		Source: collectorID,
+		Type:   workloadmeta.EventTypeUnset,
+		Entity: workloadmeta.EntityID{Kind: workloadmeta.KindContainer, ID: "pod-uid/app"},
+	})
+	assert.Contains(t, notified, workloadmeta.Event{
+		Source: collectorID,
+		Type:   workloadmeta.EventTypeUnset,
+		Entity: workloadmeta.EntityID{Kind: workloadmeta.KindKubernetesPod, ID: "pod-uid"},
+	})
+	assert.Empty(t, c.pending.release("pod-uid"))
+
+	// a pod recreated with the same container emits it again
+	notified = nil
+	c.handlePodEvent(kubelet.PodEvent{Type: kubelet.PodAdded, Pod: imagePullPod("", "ImagePullBackOff", "Back-off pulling image")})
+	assert.Equal(t, "ImagePullBackOff", containersByName(notified)["app"].State.WaitingReason)
+}
+
+func TestPendingContainersOtherReasons(t *testing.T) {
+	// the containers being created or crashing aren't pending on their image
+	for _, reason := range []string{"ContainerCreating", "PodInitializing", "CrashLoopBackOff"} {
+		c := &collector{}
+		events := c.parsePods([]*kubelet.Pod{imagePullPod("", reason, "")})
+		assert.NotContains(t, containersByName(events), "app", reason)
+		assert.Empty(t, podsByName(events)["web"].PendingContainers, reason)
+	}
+}
@@ -0,0 +1,191 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/DataDog/datadog-agent/pkg/telemetry"
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// degradedEmptyStatuses is reported when too many running pods have no
+	// container statuses in the pod list
+	degradedEmptyStatuses = "empty_container_statuses"
+	// degradedStale is reported when the pod list stopped changing while new
+	// pods were created on the node
+	degradedStale = "stale"
+)
+
+var (
+	podListDegraded = telemetry.NewGaugeWithOpts("workloadmeta_kubelet", "pod_list_degraded",
+		[]string{}, "Whether the pod list returned by the kubelet is incomplete or stale, 1 when it is.",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+	degradedPodLists = telemetry.NewCounterWithOpts("workloadmeta_kubelet", "degraded_pod_lists",
+		[]string{"reason"}, "Number of pod lists returned by the kubelet ignored because they were incomplete or stale.",
+		telemetry.Options{NoDoubleUnderscoreSep: true})
+)
+
+// podListHealth detects the pod lists returned by kubelets under pressure,
+// which may miss the container statuses of the pods or not be updated
+// anymore. The entities of such a pod list are not emitted, the store keeping
+// those of the last healthy one. A nil podListHealth considers every pod list
+// healthy.
+type podListHealth struct {
+	// emptyStatusesThreshold is the fraction of running pods without
+	// container statuses above which a pod list is incomplete, 0 to disable it
+	emptyStatusesThreshold float64
+	// maxUnchangedPulls is the number of pulls returning the same pod list
+	// after which a pod list is stale if new pods have a cgroup, 0 to disable it
+	maxUnchangedPulls int
+	// listCgroupPodUIDs returns the UIDs of the pods with a cgroup on the node
+	listCgroupPodUIDs func() (map[string]struct{}, error)
+
+	// lastVersion is the digest of the resource versions of the pods of the
+	// last pod list, and unchangedPulls the number of pulls since it changed
+	lastVersion    uint64
+	unchangedPulls int
+	// cgroupPodUIDs are the UIDs of the pods with a cgroup when the pod list
+	// last changed, the pods created since then aren't part of it
+	cgroupPodUIDs map[string]struct{}
+	// degradedReason is the reason why the last pod list is degraded, empty
+	// when it is healthy
+	degradedReason string
+}
+
+// check returns the reason why a pod list is degraded, empty when it is
+// healthy, and reports the transitions between healthy and degraded pod lists
+func (h *podListHealth) check(pods []*kubelet.Pod) string {
+	if h == nil {
+		return ""
+	}
+
+	// the resource versions are tracked whatever the state of the pod list
+	stale := h.isStale(pods)
+
+	reason := ""
+	if ratio, ok := h.emptyStatusesRatio(pods); ok {
+		reason = degradedEmptyStatuses
+		if h.degradedReason != reason {
+			log.Warnf("%.0f%% of the running pods have no container statuses in the kubelet pod list, keeping the last complete pod list until the kubelet recovers", ratio*100)
+		}
+	} else if stale {
+		reason = degradedStale
+		if h.degradedReason != reason {
+			log.Warnf("The kubelet pod list didn't change over the last %d pulls while new pods were created, keeping the last pod list until the kubelet recovers", h.unchangedPulls)
+		}
+	}
+
+	if reason != "" {
+		degradedPodLists.Inc(reason)
+		podListDegraded.Set(1)
+	} else if h.degradedReason != "" {
+		log.Infof("The kubelet pod list is healthy again, resuming the collection of the pods")
+		podListDegraded.Set(0)
+	}
+	h.degradedReason = reason
+
+	return reason
+}
+
+// emptyStatusesRatio returns the fraction of running pods without container
+// statuses, and whether it exceeds the threshold
+func (h *podListHealth) emptyStatusesRatio(pods []*kubelet.Pod) (float64, bool) {
+	if h.emptyStatusesThreshold <= 0 {
+		return 0, false
+	}
+
+	var running, empty int
+	for _, pod := range pods {
+		// static pods aren't updated in the pod list after their creation
+		if pod.Status.Phase != "Running" || kubelet.IsPodStatic(pod) {
+			continue
+		}
+		running++
+		if len(pod.Status.Containers) == 0 {
+			empty++
+		}
+	}
+	if running == 0 {
+		return 0, false
+	}
+
+	ratio := float64(empty) / float64(running)
+	return ratio, ratio > h.emptyStatusesThreshold
+}
+
+// isStale returns whether the pod list hasn't changed for maxUnchangedPulls
+// pulls while pods missing from it were created on the node since it last
+// changed
+func (h *podListHealth) isStale(pods []*kubelet.Pod) bool {
+	if h.maxUnchangedPulls <= 0 || h.listCgroupPodUIDs == nil {
+		return false
+	}
+
+	// the pulls are only counted once the pod cgroups could be read
+	version := podListVersion(pods)
+	if version != h.lastVersion || h.cgroupPodUIDs == nil {
+		h.lastVersion = version
+		h.unchangedPulls = 0
+		h.cgroupPodUIDs = h.readCgroupPodUIDs()
+		return false
+	}
+
+	h.unchangedPulls++
+	if h.unchangedPulls < h.maxUnchangedPulls {
+		return false
+	}
+
+	listed := make(map[string]struct{}, len(pods))
+	for _, pod := range pods {
+		listed[pod.Metadata.UID] = struct{}{}
+	}
+	for uid := range h.readCgroupPodUIDs() {
+		if _, found := h.cgroupPodUIDs[uid]; found {
+			continue
+		}
+		if _, found := listed[uid]; !found {
+			return true
+		}
+	}
+	return false
+}
+
+// readCgroupPodUIDs returns the UIDs of the pods with a cgroup, nil when
+// they can't be read
+func (h *podListHealth) readCgroupPodUIDs() map[string]struct{} {
+	uids, err := h.listCgroupPodUIDs()
+	if err != nil {
+		log.Debugf("cannot list the pod cgroups: %s", err)
+		return nil
+	}
+	if uids == nil {
+		uids = map[string]struct{}{}
+	}
+	return uids
+}
+
+// podListVersion returns a digest of the UIDs and resource versions of the
+// pods, which changes whenever a pod is created, updated or deleted
+func podListVersion(pods []*kubelet.Pod) uint64 {
+	versions := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		versions = append(versions, pod.Metadata.UID+"/"+pod.Metadata.ResVersion)
+	}
+	sort.Strings(versions)
+
+	h := fnv.New64a()
+	for _, version := range versions {
+		h.Write([]byte(version)) //nolint:errcheck
+		h.Write([]byte{0})       //nolint:errcheck
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,123 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/workloadmeta"
+)
+
+func runningPod(uid, resourceVersion string, withStatuses bool) *kubelet.Pod {
+	pod := &kubelet.Pod{
+		Metadata: kubelet.PodMetadata{Name: "nginx-" + uid, UID: uid, ResVersion: resourceVersion},
+		Spec:     kubelet.Spec{Containers: []kubelet.ContainerSpec{{Name: "nginx", Image: "nginx:1.21"}}},
+		Status:   kubelet.Status{Phase: "Running", QOSClass: "BestEffort"},
+	}
+	if withStatuses {
+		pod.Status.Containers = []kubelet.ContainerStatus{{Name: "nginx", ID: "containerd://" + uid + "-nginx"}}
+	}
+	return pod
+}
+
+// notifiedPods returns the UIDs of the pods of the events
+func notifiedPods(events []workloadmeta.Event) []string {
+	var uids []string
+	for _, event := range events {
+		if pod, ok := event.Entity.(workloadmeta.KubernetesPod); ok {
+			uids = append(uids, pod.ID)
+		}
+	}
+	return uids
+}
+
+func TestPullDegradedPodLists(t *testing.T) {
+	watcher := &fakePodWatcher{}
+	cgroupPods := map[string]struct{}{"a": {}}
+	var notified [][]workloadmeta.Event
+	c := &collector{
+		watcher:      watcher,
+		notify:       func(events []workloadmeta.Event) { notified = append(notified, events) },
+		lastExpire:   time.Now(),
+		expireFreq:   time.Hour,
+		cgroupDriver: "cgroupfs",
+		cgroupRoot:   "kubepods",
+		podListHealth: &podListHealth{
+			emptyStatusesThreshold: 0.5,
+			maxUnchangedPulls:      2,
+			listCgroupPodUIDs: func() (map[string]struct{}, error) {
+				return cgroupPods, nil
+			},
+		},
+	}
+	pull := func(pods ...*kubelet.Pod) {
+		watcher.pods = pods
+		require.NoError(t, c.Pull(context.Background()))
+	}
+
+	pull(runningPod("a", "1", true))
+	require.Len(t, notified, 1)
+	assert.Equal(t, []string{"a"}, notifiedPods(notified[0]))
+
+	// the running pods lost their container statuses, the pod list is ignored
+	pull(runningPod("a", "2", false), runningPod("b", "1", false))
+	pull(runningPod("a", "2", false))
+	assert.Len(t, notified, 1)
+	assert.Equal(t, degradedEmptyStatuses, c.podListHealth.degradedReason)
+
+	// the kubelet recovered
+	pull(runningPod("a", "3", true))
+	require.Len(t, notified, 2)
+	assert.Equal(t, []string{"a"}, notifiedPods(notified[1]))
+	assert.Empty(t, c.podListHealth.degradedReason)
+
+	// a new pod has a cgroup, but the pod list doesn't change anymore
+	cgroupPods = map[string]struct{}{"a": {}, "c": {}}
+	pull(runningPod("a", "3", true))
+	require.Len(t, notified, 3)
+	pull(runningPod("a", "3", true))
+	pull(runningPod("a", "3", true))
+	assert.Len(t, notified, 3)
+	assert.Equal(t, degradedStale, c.podListHealth.degradedReason)
+
+	// the pod list is updated again
+	pull(runningPod("a", "3", true), runningPod("c", "1", true))
+	require.Len(t, notified, 4)
+	assert.Equal(t, []string{"a", "c"}, notifiedPods(notified[3]))
+	assert.Empty(t, c.podListHealth.degradedReason)
+}
+
+func TestPodListHealthUnchangedWithoutNewPods(t *testing.T) {
+	health := &podListHealth{
+		maxUnchangedPulls: 2,
+		listCgroupPodUIDs: func() (map[string]struct{}, error) {
+			// a pod cgroup left behind before the pod list stopped changing
+			return map[string]struct{}{"a": {}, "orphan": {}}, nil
+		},
+	}
+	pods := []*kubelet.Pod{runningPod("a", "1", true)}
+	for i := 0; i < 5; i++ {
+		assert.Empty(t, health.check(pods))
+	}
+}
+
+func TestPodListHealthStaticPods(t *testing.T) {
+	health := &podListHealth{emptyStatusesThreshold: 0.5}
+	static := runningPod("static", "1", false)
+	static.Metadata.Annotations = map[string]string{"kubernetes.io/config.source": "file"}
+	assert.Empty(t, health.check([]*kubelet.Pod{static, runningPod("a", "1", true)}))
+
+	var nilHealth *podListHealth
+	assert.Empty(t, nilHealth.check([]*kubelet.Pod{runningPod("a", "1", false)}))
+}
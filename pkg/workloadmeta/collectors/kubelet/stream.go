@@ -0,0 +1,140 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+// +build kubelet
+
+package kubelet
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-agent/pkg/util/kubernetes/kubelet"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	podSourcePolling   = "polling"
+	podSourceStreaming = "streaming"
+
+	// maxStreamFailures is the number of consecutive failures of the pod
+	// stream after which the collector falls back to polling
+	maxStreamFailures = 5
+	minStreamBackoff  = time.Second
+	maxStreamBackoff  = 30 * time.Second
+	streamingEnabled  = 1
+)
+
+// getPodStreamer returns the kubelet client streaming the pod updates, it is
+// replaced in tests.
+var getPodStreamer = func() (kubelet.PodStreamer, error) {
+	ku, err := kubelet.GetKubeUtil()
+	if err != nil {
+		return nil, err
+	}
+	streamer, ok := ku.(kubelet.PodStreamer)
+	if !ok {
+		return nil, errors.New("the kubelet client cannot stream the pod updates")
+	}
+	return streamer, nil
+}
+
+// startPodSource starts receiving the pod updates from the source set in
+// kubelet_pod_watcher_source, the pod list being polled unless it is streaming.
+func (c *collector) startPodSource(ctx context.Context, source string) {
+	switch source {
+	case podSourceStreaming:
+		c.startStreaming(ctx)
+	case podSourcePolling:
+	default:
+		log.Warnf("Unknown kubelet_pod_watcher_source %q, polling the kubelet", source)
+	}
+}
+
+// startStreaming starts receiving the pod updates on the kubelet pod stream,
+// if the kubelet client supports it.
+func (c *collector) startStreaming(ctx context.Context) {
+	streamer, err := getPodStreamer()
+	if err != nil {
+		log.Warnf("Cannot stream the pod updates, polling the kubelet: %s", err)
+		return
+	}
+
+	if c.streamBackoff == 0 {
+		c.streamBackoff = minStreamBackoff
+	}
+	atomic.StoreInt32(&c.streaming, streamingEnabled)
+	go c.streamPods(ctx, streamer)
+}
+
+func (c *collector) isStreaming() bool {
+	return atomic.LoadInt32(&c.streaming) == streamingEnabled
+}
+
+// streamPods receives the pod updates until the context is cancelled, reconnecting
+// when the stream ends. It falls back to polling when the kubelet doesn't support
+// streaming or after maxStreamFailures consecutive failures.
+func (c *collector) streamPods(ctx context.Context, streamer kubelet.PodStreamer) {
+	defer atomic.StoreInt32(&c.streaming, 0)
+
+	failures := 0
+	backoff := c.streamBackoff
+	for {
+		received := false
+		err := streamer.StreamLocalPods(ctx, func(event kubelet.PodEvent) {
+			received = true
+			c.handlePodEvent(event)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if received {
+			failures = 0
+			backoff = c.streamBackoff
+		}
+
+		switch {
+		case err == nil:
+			log.Debugf("The kubelet closed the pod stream, reconnecting")
+		case errors.Is(err, kubelet.ErrPodStreamNotSupported):
+			log.Infof("The kubelet doesn't support streaming the pod updates, polling it instead")
+			return
+		default:
+			failures++
+			if failures >= maxStreamFailures {
+				log.Warnf("The kubelet pod stream failed %d times in a row, polling the kubelet instead: %s", failures, err)
+				return
+			}
+			log.Debugf("The kubelet pod stream failed, reconnecting in %s: %s", backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if err != nil {
+			backoff *= 2
+			if backoff > maxStreamBackoff {
+				backoff = maxStreamBackoff
+			}
+		}
+	}
+}
+
+// handlePodEvent converts a pod update of the stream to workloadmeta events
+func (c *collector) handlePodEvent(event kubelet.PodEvent) {
+	if event.Type == kubelet.PodDeleted {
+		deleted := map[string]struct{}{event.Pod.Metadata.UID: {}}
+		expiredIDs := c.filterDeletedPodExpires(deleted, c.watcher.DeletePod(event.Pod))
+		c.notify(c.parseExpires(expiredIDs))
+		return
+	}
+	c.notify(c.parsePods(c.watcher.UpdatePod(event.Pod)))
+}
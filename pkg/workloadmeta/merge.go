@@ -0,0 +1,125 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-present Datadog, Inc.
+
+package workloadmeta
+
+import (
+	"reflect"
+	"sort"
+)
+
+// MergePriority is how much the store trusts a source for a field of the
+// entities it sets, when several sources describe the same entity.
+type MergePriority int
+
+// List of merge priorities, from the least to the most trusted.
+const (
+	// MergePriorityBestEffort is for the fields the source only knows
+	// approximately, such as a container state polled from the kubelet.
+	MergePriorityBestEffort MergePriority = iota
+	// MergePriorityDefault is the priority of the fields without an
+	// explicit one.
+	MergePriorityDefault
+	// MergePriorityAuthoritative is for the fields the source is the
+	// reference for, such as how a container is declared in its pod.
+	MergePriorityAuthoritative
+)
+
+// FieldPriorities are the merge priorities of the fields of the entities
+// set by a source, by name of the top-level field of the entity struct, such
+// as "State" for Container.State.
+type FieldPriorities map[string]MergePriority
+
+// priority returns the merge priority of the given field
+func (p FieldPriorities) priority(field string) MergePriority {
+	if priority, ok := p[field]; ok {
+		return priority
+	}
+	return MergePriorityDefault
+}
+
+// sourceEntity is an entity as set by one source
+type sourceEntity struct {
+	entity     Entity
+	priorities FieldPriorities
+	// seq orders the entities by the time they were set, the most recent
+	// one winning between sources of the same priority
+	seq uint64
+}
+
+// cachedEntity holds the entities set by each source for an entity ID, and
+// the entity merged from them
+type cachedEntity struct {
+	sources map[string]sourceEntity
+	merged  Entity
+}
+
+// set stores the entity set by a source and merges it with the other ones
+func (e *cachedEntity) set(source string, entity Entity, priorities FieldPriorities, seq uint64) {
+	e.sources[source] = sourceEntity{entity: entity, priorities: priorities, seq: seq}
+	e.merged = mergeEntities(e.sources)
+}
+
+// unset removes the entity set by a source, and returns whether the entity
+// is still set by another source
+func (e *cachedEntity) unset(source string) bool {
+	delete(e.sources, source)
+	if len(e.sources) == 0 {
+		e.merged = nil
+		return false
+	}
+	e.merged = mergeEntities(e.sources)
+	return true
+}
+
+// mergeEntities combines the entities set by several sources field by field:
+// each top-level field comes from the source with the highest priority for it
+// among the ones which set it, the most recent one for the same priority. The
+// zero values are considered unknown by their source. The entities of another
+// type than the most recent one are ignored.
+func mergeEntities(sources map[string]sourceEntity) Entity {
+	ordered := make([]sourceEntity, 0, len(sources))
+	for _, s := range sources {
+		ordered = append(ordered, s)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].seq < ordered[j].seq })
+
+	latest := ordered[len(ordered)-1].entity
+	if len(ordered) == 1 {
+		return latest
+	}
+	entityType := reflect.TypeOf(latest)
+	if entityType.Kind() != reflect.Struct {
+		return latest
+	}
+
+	merged := reflect.New(entityType).Elem()
+	for i := 0; i < entityType.NumField(); i++ {
+		field := entityType.Field(i)
+		if field.PkgPath != "" {
+			// the entities only have exported fields
+			continue
+		}
+		var value reflect.Value
+		var priority MergePriority
+		for _, s := range ordered {
+			if reflect.TypeOf(s.entity) != entityType {
+				continue
+			}
+			candidate := reflect.ValueOf(s.entity).Field(i)
+			if candidate.IsZero() {
+				continue
+			}
+			if p := s.priorities.priority(field.Name); !value.IsValid() || p >= priority {
+				value, priority = candidate, p
+			}
+		}
+		if value.IsValid() {
+			merged.Field(i).Set(value)
+		}
+	}
+
+	return merged.Interface().(Entity)
+}
@@ -38,8 +38,11 @@ type subscriber struct {
 // unit of work being done by a piece of software, like a process, a container,
 // a kubernetes pod, or a task in any cloud provider.
 type Store struct {
+	// store holds the entities by kind and ID, each of them merged from the
+	// sources which set it. seq is incremented on each set.
 	storeMut sync.RWMutex
-	store    map[Kind]map[string]Entity
+	store    map[Kind]map[string]*cachedEntity
+	seq      uint64
 
 	subscribersMut sync.RWMutex
 	subscribers    []subscriber
@@ -59,7 +62,7 @@ func NewStore() *Store {
 	}
 
 	return &Store{
-		store:       make(map[Kind]map[string]Entity),
+		store:       make(map[Kind]map[string]*cachedEntity),
 		subscribers: []subscriber{},
 
 		candidates: candidates,
@@ -159,7 +162,7 @@ func (s *Store) Subscribe(name string, filter *Filter) chan EventBundle {
 				// after the above TODO has been
 				// addressed.
 				Type:   EventTypeSet,
-				Entity: entity,
+				Entity: entity.merged,
 			})
 		}
 	}
@@ -229,6 +232,20 @@ func (s *Store) GetECSTask(id string) (ECSTask, error) {
 	return t, nil
 }
 
+// GetContainerImage returns metadata about a container image, by digest.
+func (s *Store) GetContainerImage(digest string) (ContainerImageMetadata, error) {
+	var i ContainerImageMetadata
+
+	entity, err := s.getEntityByKind(KindContainerImage, digest)
+	if err != nil {
+		return i, err
+	}
+
+	i = entity.(ContainerImageMetadata)
+
+	return i, nil
+}
+
 // Notify notifies the store with a slice of events.
 func (s *Store) Notify(events []Event) {
 	if len(events) > 0 {
@@ -280,27 +297,45 @@ func (s *Store) pull(ctx context.Context) {
 	}
 }
 
+// handleEvents stores the entities set or unset by the events, and notifies
+// the subscribers with the entities merged from all their sources: an unset
+// entity still set by another source is notified as set.
 func (s *Store) handleEvents(evs []Event) {
 	s.storeMut.Lock()
 
+	merged := make([]Event, 0, len(evs))
 	for _, ev := range evs {
 		meta := ev.Entity.GetID()
 
 		entitiesOfKind, ok := s.store[meta.Kind]
 		if !ok {
-			s.store[meta.Kind] = make(map[string]Entity)
+			s.store[meta.Kind] = make(map[string]*cachedEntity)
 			entitiesOfKind = s.store[meta.Kind]
 		}
 
 		switch ev.Type {
 		case EventTypeSet:
-			entitiesOfKind[meta.ID] = ev.Entity
+			entity, ok := entitiesOfKind[meta.ID]
+			if !ok {
+				entity = &cachedEntity{sources: make(map[string]sourceEntity)}
+				entitiesOfKind[meta.ID] = entity
+			}
+			s.seq++
+			entity.set(ev.Source, ev.Entity, ev.Priorities, s.seq)
+			merged = append(merged, Event{Type: EventTypeSet, Source: ev.Source, Entity: entity.merged})
 		case EventTypeUnset:
+			entity, ok := entitiesOfKind[meta.ID]
+			if ok && entity.unset(ev.Source) {
+				merged = append(merged, Event{Type: EventTypeSet, Source: ev.Source, Entity: entity.merged})
+				continue
+			}
 			delete(entitiesOfKind, meta.ID)
+			merged = append(merged, ev)
 		default:
 			log.Errorf("cannot handle event of type %d. event dump: %+v", ev)
 		}
 	}
+	evs = merged
 
 	// unlock the store before notifying subscribers, as they might need to
 	// read it for related entities (such as a pod's containers) while they
@@ -341,7 +376,7 @@ func (s *Store) getEntityByKind(kind Kind, id string) (Entity, error) {
 		return nil, errors.NewNotFound(id)
 	}
 
-	return entity, nil
+	return entity.merged, nil
 }
 
 func notifyChannel(name string, ch chan EventBundle, events []Event, wait bool) {
@@ -8,6 +8,7 @@ package workloadmeta
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/errors"
 )
@@ -56,3 +57,137 @@ func TestHandleEvents(t *testing.T) {
 		t.Errorf("expected container %q to be absent. found or had errors. err: %q", container.ID, err)
 	}
 }
+
+func TestHandleEventsContainerImage(t *testing.T) {
+	s := NewStore()
+
+	image := ContainerImageMetadata{
+		EntityID: EntityID{
+			Kind: KindContainerImage,
+			ID:   "sha256:0123",
+		},
+		RepoTags:    []string{"nginx:1.21"},
+		RepoDigests: []string{"nginx@sha256:0123"},
+	}
+
+	s.handleEvents([]Event{
+		{
+			Type:   EventTypeSet,
+			Source: fooSource,
+			Entity: image,
+		},
+	})
+
+	gotImage, err := s.GetContainerImage(image.ID)
+	if err != nil {
+		t.Errorf("expected to find image %q, not found", image.ID)
+	}
+
+	if !reflect.DeepEqual(image, gotImage) {
+		t.Errorf("expected image %q to match the one in the store", image.ID)
+	}
+
+	// the collectors unset an image with its ID only
+	s.handleEvents([]Event{
+		{
+			Type:   EventTypeUnset,
+			Source: fooSource,
+			Entity: image.EntityID,
+		},
+	})
+
+	_, err = s.GetContainerImage(image.ID)
+	if err == nil || !errors.IsNotFound(err) {
+		t.Errorf("expected image %q to be absent. found or had errors. err: %q", image.ID, err)
+	}
+}
+
+// handleEventsAndReceive handles the events and returns the bundle they are
+// notified in to the subscriber
+func handleEventsAndReceive(s *Store, ch chan EventBundle, evs []Event) EventBundle {
+	go s.handleEvents(evs)
+	bundle := <-ch
+	close(bundle.Ch)
+	return bundle
+}
+
+func TestHandleEventsMergeSources(t *testing.T) {
+	s := NewStore()
+	ch := s.Subscribe("test", nil)
+
+	id := EntityID{Kind: KindContainer, ID: "foobar"}
+	runtimeContainer := Container{
+		EntityID: id,
+		Image:    ContainerImage{RawName: "redis@sha256:0123"},
+		EnvVars:  map[string]string{"FOO": "runtime"},
+		Runtime:  "containerd",
+	}
+	kubeletContainer := Container{
+		EntityID: id,
+		Image:    ContainerImage{RawName: "redis:6"},
+		EnvVars:  map[string]string{"FOO": "spec"},
+		State:    ContainerState{Running: true},
+		Type:     ContainerTypeRegular,
+	}
+	kubeletPriorities := FieldPriorities{
+		"Image":   MergePriorityAuthoritative,
+		"EnvVars": MergePriorityAuthoritative,
+		"Type":    MergePriorityAuthoritative,
+		"State":   MergePriorityBestEffort,
+	}
+
+	handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeSet, Source: fooSource, Entity: runtimeContainer},
+	})
+
+	// the runtime doesn't know the state yet, the best effort one of the
+	// kubelet is used meanwhile
+	bundle := handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeSet, Source: barSource, Entity: kubeletContainer, Priorities: kubeletPriorities},
+	})
+	expected := Container{
+		EntityID: id,
+		Image:    ContainerImage{RawName: "redis:6"},
+		EnvVars:  map[string]string{"FOO": "spec"},
+		Runtime:  "containerd",
+		State:    ContainerState{Running: true},
+		Type:     ContainerTypeRegular,
+	}
+	if len(bundle.Events) != 1 || !reflect.DeepEqual(expected, bundle.Events[0].Entity) {
+		t.Errorf("expected the merged container %+v to be notified, got %+v", expected, bundle.Events)
+	}
+
+	// the state of the runtime wins over the one of the kubelet, even
+	// when the kubelet sets the container again
+	runtimeContainer.State = ContainerState{Running: false, FinishedAt: time.Unix(1600000000, 0)}
+	handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeSet, Source: fooSource, Entity: runtimeContainer},
+	})
+	handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeSet, Source: barSource, Entity: kubeletContainer, Priorities: kubeletPriorities},
+	})
+	expected.State = runtimeContainer.State
+	gotContainer, err := s.GetContainer(id.ID)
+	if err != nil || !reflect.DeepEqual(expected, gotContainer) {
+		t.Errorf("expected container %+v to be the merged one, got %+v (err: %v)", expected, gotContainer, err)
+	}
+
+	// the container is still set by the runtime once the kubelet unsets it
+	bundle = handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeUnset, Source: barSource, Entity: kubeletContainer},
+	})
+	if len(bundle.Events) != 1 || bundle.Events[0].Type != EventTypeSet || !reflect.DeepEqual(runtimeContainer, bundle.Events[0].Entity) {
+		t.Errorf("expected the runtime container %+v to be notified, got %+v", runtimeContainer, bundle.Events)
+	}
+
+	bundle = handleEventsAndReceive(s, ch, []Event{
+		{Type: EventTypeUnset, Source: fooSource, Entity: runtimeContainer},
+	})
+	if len(bundle.Events) != 1 || bundle.Events[0].Type != EventTypeUnset {
+		t.Errorf("expected the container to be unset, got %+v", bundle.Events)
+	}
+	_, err = s.GetContainer(id.ID)
+	if err == nil || !errors.IsNotFound(err) {
+		t.Errorf("expected container %q to be absent. found or had errors. err: %q", id.ID, err)
+	}
+}
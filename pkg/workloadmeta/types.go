@@ -13,6 +13,9 @@ type Kind string
 // ContainerRuntime is the container runtime used by a container.
 type ContainerRuntime string
 
+// ContainerType is the type of a container in its pod.
+type ContainerType string
+
 // ECSLaunchType is the launch type of an ECS task.
 type ECSLaunchType string
 
@@ -21,12 +24,16 @@ type EventType int
 
 // List of enumerable constants for the types above.
 const (
-	KindContainer     Kind = "container"
-	KindKubernetesPod Kind = "kubernetes_pod"
-	KindECSTask       Kind = "ecs_task"
+	KindContainer      Kind = "container"
+	KindKubernetesPod  Kind = "kubernetes_pod"
+	KindECSTask        Kind = "ecs_task"
+	KindContainerImage Kind = "container_image"
 
 	ContainerRuntimeDocker ContainerRuntime = "docker"
 
+	ContainerTypeRegular ContainerType = "regular"
+	ContainerTypeInit    ContainerType = "init"
+
 	ECSLaunchTypeEC2      ECSLaunchType = "ec2"
 	ECSLaunchTypeFargate  ECSLaunchType = "fargate"
 	ECSLaunchTypeExternal ECSLaunchType = "external"
@@ -66,11 +73,18 @@ type EntityMeta struct {
 
 // ContainerImage is the an image used by a container.
 type ContainerImage struct {
-	ID        string
+	ID string
+	// Digest is the digest of the image, the ID of its
+	// KindContainerImage entity. It is empty until the container is
+	// created by the runtime.
+	Digest    string
 	RawName   string
 	Name      string
 	ShortName string
 	Tag       string
+	// PullPolicy is the imagePullPolicy of the container in its pod spec,
+	// such as Always or IfNotPresent, it is empty outside of a pod
+	PullPolicy string
 }
 
 // ContainerState is the state of a container.
@@ -78,12 +92,25 @@ type ContainerState struct {
 	Running    bool
 	StartedAt  time.Time
 	FinishedAt time.Time
+	// ExitCode is the exit code of a terminated init container, nil
+	// while it hasn't terminated and for the other containers
+	ExitCode *int32
+	// WaitingReason and WaitingMessage explain why a container of a pod
+	// isn't created yet, such as ImagePullBackOff, they are empty once it
+	// is created
+	WaitingReason  string
+	WaitingMessage string
 }
 
 // ContainerPort is a port open in the container.
 type ContainerPort struct {
-	Name string
-	Port int
+	Name     string
+	Port     int
+	Protocol string
+	// HostPort and HostIP are the port and the IP the port is exposed on
+	// on the host, they are empty if it isn't
+	HostPort int
+	HostIP   string
 }
 
 // Container is a containerized workload.
@@ -95,6 +122,12 @@ type Container struct {
 	Ports   []ContainerPort
 	Runtime ContainerRuntime
 	State   ContainerState
+	// Type is the type of the container in its pod, it is empty for
+	// the containers collected outside of a pod
+	Type ContainerType
+	// CgroupPath is the expected cgroup path of the container, relative to
+	// the root of the cgroup hierarchy.
+	CgroupPath string
 }
 
 // GetID returns the Container's EntityID.
@@ -111,10 +144,28 @@ type KubernetesPod struct {
 	Owners                     []KubernetesPodOwner
 	PersistentVolumeClaimNames []string
 	Containers                 []string
+	InitContainers             []string
 	Ready                      bool
 	Phase                      string
 	IP                         string
+	HostIP                     string
 	PriorityClass              string
+	CreationTimestamp          time.Time
+	// StartTime is zero until the pod is acknowledged by the kubelet
+	StartTime time.Time
+	// DeletionTimestamp is zero unless the pod is being deleted
+	DeletionTimestamp time.Time
+	// Terminating is true once the pod is being deleted, its checks can be
+	// unscheduled without waiting for its expiration
+	Terminating bool
+	// Conditions are the conditions of the pod reported by the kubelet, such
+	// as PodScheduled or ContainersReady, Ready being derived from them
+	Conditions []KubernetesPodCondition
+	// PendingContainers are the IDs of the containers which can't be
+	// created by the runtime because their image can't be pulled, they
+	// aren't in Containers nor InitContainers. Their entities are replaced
+	// by the real containers once they are created.
+	PendingContainers []string
 }
 
 // GetID returns the KubernetesPod's EntityID.
@@ -122,8 +173,36 @@ func (p KubernetesPod) GetID() EntityID {
 	return p.EntityID
 }
 
+// Condition returns the condition of the pod with the given type, if it has one.
+func (p KubernetesPod) Condition(conditionType string) (KubernetesPodCondition, bool) {
+	for _, c := range p.Conditions {
+		if c.Type == conditionType {
+			return c, true
+		}
+	}
+	return KubernetesPodCondition{}, false
+}
+
+// AllContainers returns the IDs of the init and regular containers of the pod.
+func (p KubernetesPod) AllContainers() []string {
+	containers := make([]string, 0, len(p.InitContainers)+len(p.Containers))
+	containers = append(containers, p.InitContainers...)
+	return append(containers, p.Containers...)
+}
+
 var _ Entity = KubernetesPod{}
 
+// KubernetesPodCondition is a condition of a pod, such as the PodScheduled
+// condition of a pending pod being False with the Unschedulable reason.
+type KubernetesPodCondition struct {
+	Type   string
+	Status string
+	Reason string
+	// Message is truncated to kubelet_pod_condition_message_max_length
+	Message            string
+	LastTransitionTime time.Time
+}
+
 // KubernetesPodOwner is extracted from a pod's owner references.
 type KubernetesPodOwner struct {
 	Kind string
@@ -146,11 +225,35 @@ func (t ECSTask) GetID() EntityID {
 
 var _ Entity = ECSTask{}
 
+// ContainerImageMetadata is an image present on the node, shared by the
+// containers using it. Its ID is the digest of the image.
+type ContainerImageMetadata struct {
+	EntityID
+	// RepoTags are the references of the image used by the containers,
+	// such as nginx:1.21
+	RepoTags []string
+	// RepoDigests are the references of the image by digest, such as
+	// nginx@sha256:0123...
+	RepoDigests []string
+}
+
+// GetID returns the ContainerImageMetadata's EntityID.
+func (i ContainerImageMetadata) GetID() EntityID {
+	return i.EntityID
+}
+
+var _ Entity = ContainerImageMetadata{}
+
 // Event is an event generated by a metadata collector.
 type Event struct {
 	Type   EventType
 	Source string
 	Entity Entity
+	// Priorities are the merge priorities of the fields of the entity of
+	// an EventTypeSet event, the fields without one having
+	// MergePriorityDefault. They are used when several sources set the
+	// same entity.
+	Priorities FieldPriorities
 }
 
 // EventBundle is a collection of events, and a channel that needs to be closed